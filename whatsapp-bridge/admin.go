@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// StoreUsage describes the disk usage of the bridge's store directory
+type StoreUsage struct {
+	MessagesDBBytes int64 `json:"messages_db_bytes"`
+	SessionDBBytes  int64 `json:"session_db_bytes"`
+	MediaBytes      int64 `json:"media_bytes"`
+	MediaFiles      int   `json:"media_files"`
+	ArchiveBytes    int64 `json:"archive_bytes"`
+	TotalBytes      int64 `json:"total_bytes"`
+}
+
+// MaintenanceRequest represents the request body for the maintenance API
+type MaintenanceRequest struct {
+	Vacuum       bool `json:"vacuum"`
+	Analyze      bool `json:"analyze"`
+	Reindex      bool `json:"reindex"`
+	CleanupMedia bool `json:"cleanup_media"`
+	DryRun       bool `json:"dry_run"`
+}
+
+// MaintenanceResponse represents the response for the maintenance API
+type MaintenanceResponse struct {
+	Success        bool        `json:"success"`
+	Message        string      `json:"message"`
+	Operations     []string    `json:"operations,omitempty"`
+	Before         *StoreUsage `json:"before,omitempty"`
+	After          *StoreUsage `json:"after,omitempty"`
+	OrphanedFiles  []string    `json:"orphaned_files,omitempty"`
+	RemovedFiles   int         `json:"removed_files"`
+	ReclaimedBytes int64       `json:"reclaimed_bytes"`
+}
+
+// Get the size of a SQLite database including its WAL and shared-memory files
+func sqliteFileSize(path string) int64 {
+	var size int64
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if info, err := os.Stat(path + suffix); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// Check whether a file in the store directory belongs to one of the SQLite databases
+func isDatabaseFile(name string) bool {
+	for _, suffix := range []string{".db", ".db-wal", ".db-shm", ".db-journal"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Calculate the current disk usage of the store directory
+func getStoreUsage() (*StoreUsage, error) {
+	usage := &StoreUsage{
+		MessagesDBBytes: sqliteFileSize(filepath.Join(storeDir(), "messages.db")),
+		SessionDBBytes:  sqliteFileSize(filepath.Join(storeDir(), "whatsapp.db")),
+	}
+
+	err := filepath.WalkDir(storeDir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || isDatabaseFile(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(path, archiveDir()+string(filepath.Separator)) {
+			usage.ArchiveBytes += info.Size()
+			return nil
+		}
+		usage.MediaBytes += info.Size()
+		usage.MediaFiles++
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan store directory: %v", err)
+	}
+
+	usage.TotalBytes = usage.MessagesDBBytes + usage.SessionDBBytes + usage.MediaBytes + usage.ArchiveBytes
+	return usage, nil
+}
+
+// Find downloaded media files that no longer have a message row referencing them
+func findOrphanedMedia(messageStore *MessageStore) ([]string, error) {
+	// Media of archived messages is still referenced by the archive files
+	rows, err := messageStore.db.Query(`SELECT chat_jid, filename FROM messages WHERE media_type != '' AND filename != ''
+		UNION SELECT chat_jid, filename FROM archived_media`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	known := make(map[string]bool)
+	for rows.Next() {
+		var chatJID, filename string
+		if err := rows.Scan(&chatJID, &filename); err != nil {
+			return nil, err
+		}
+		known[filepath.Clean(filepath.Join(mediaDirForChat(chatJID), filename))] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var orphaned []string
+	err = filepath.WalkDir(storeDir(), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Media lives in per-chat subdirectories, files directly in store/ are ours
+		if d.IsDir() {
+			// Uploads are cleaned up on their own, once no pending send uses them
+			if path == archiveDir() || path == uploadsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Dir(path) == filepath.Clean(storeDir()) || isDatabaseFile(d.Name()) {
+			return nil
+		}
+		if !known[filepath.Clean(path)] {
+			orphaned = append(orphaned, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan store directory: %v", err)
+	}
+
+	return orphaned, nil
+}
+
+// Run the requested maintenance operations on the message store
+func runMaintenance(messageStore *MessageStore, req MaintenanceRequest) (*MaintenanceResponse, error) {
+	before, err := getStoreUsage()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &MaintenanceResponse{Success: true, Before: before}
+
+	if req.CleanupMedia {
+		orphaned, err := findOrphanedMedia(messageStore)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find orphaned media: %v", err)
+		}
+		resp.OrphanedFiles = orphaned
+		resp.Operations = append(resp.Operations, "cleanup_media")
+
+		if !req.DryRun {
+			for _, path := range orphaned {
+				if err := os.Remove(path); err != nil {
+					bridgeLog.Warnf("Failed to remove orphaned media %s: %v", path, err)
+					continue
+				}
+				resp.RemovedFiles++
+			}
+		}
+	}
+
+	// Statements are run in this order so ANALYZE sees the rebuilt indexes
+	statements := []struct {
+		enabled bool
+		name    string
+		sql     string
+	}{
+		{req.Reindex, "reindex", "REINDEX"},
+		{req.Vacuum, "vacuum", "VACUUM"},
+		{req.Vacuum, "rebuild_search_index", rebuildSearchIndex}, // VACUUM renumbers the rowids it is keyed by
+		{req.Vacuum, "rebuild_ocr_index", rebuildOCRIndex},
+		{req.Vacuum, "rebuild_document_index", rebuildDocumentIndex},
+		{req.Analyze, "analyze", "ANALYZE"},
+	}
+	for _, stmt := range statements {
+		if !stmt.enabled {
+			continue
+		}
+		resp.Operations = append(resp.Operations, stmt.name)
+		if req.DryRun {
+			continue
+		}
+		if _, err := messageStore.db.Exec(stmt.sql); err != nil {
+			return nil, fmt.Errorf("%s failed: %v", stmt.name, err)
+		}
+	}
+
+	// Fold the WAL back into the database file so the reported size is accurate
+	if !req.DryRun && (req.Vacuum || req.Reindex) {
+		messageStore.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	}
+
+	after, err := getStoreUsage()
+	if err != nil {
+		return nil, err
+	}
+	resp.After = after
+	resp.ReclaimedBytes = before.TotalBytes - after.TotalBytes
+
+	if req.DryRun {
+		resp.Message = fmt.Sprintf("Dry run: would run %s", strings.Join(resp.Operations, ", "))
+	} else {
+		resp.Message = fmt.Sprintf("Ran %s, reclaimed %d bytes", strings.Join(resp.Operations, ", "), resp.ReclaimedBytes)
+	}
+
+	return resp, nil
+}
+
+// Register the admin REST handlers
+func registerAdminHandlers(messageStore *MessageStore) {
+	// Handler for disk usage reporting and store maintenance
+	documentAPI(
+		apiOperation{
+			Method:   http.MethodGet,
+			Path:     "/api/admin/maintenance",
+			Summary:  "Report disk usage of the store directory",
+			Tag:      "admin",
+			Scope:    ScopeAdmin,
+			Response: MaintenanceResponse{},
+		},
+		apiOperation{
+			Method:   http.MethodPost,
+			Path:     "/api/admin/maintenance",
+			Summary:  "Run VACUUM/ANALYZE/REINDEX and orphaned media cleanup",
+			Tag:      "admin",
+			Scope:    ScopeAdmin,
+			Audit:    true,
+			Request:  MaintenanceRequest{},
+			Response: MaintenanceResponse{},
+		},
+	)
+	http.HandleFunc("/api/admin/maintenance", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			// Report current disk usage without changing anything
+			usage, err := getStoreUsage()
+			if err != nil {
+				writeError(w, ErrCodeInternal, err.Error(), nil)
+				return
+			}
+			writeJSON(w, http.StatusOK, MaintenanceResponse{
+				Success: true,
+				Message: "Current store usage",
+				Before:  usage,
+			})
+
+		case http.MethodPost:
+			// Parse the request body
+			var req MaintenanceRequest
+			if !decodeJSON(w, r, &req) {
+				return
+			}
+
+			// Validate request
+			if !req.Vacuum && !req.Analyze && !req.Reindex && !req.CleanupMedia {
+				writeError(w, ErrCodeInvalidRequest, "At least one of vacuum, analyze, reindex or cleanup_media is required", nil)
+				return
+			}
+
+			resp, err := runMaintenance(messageStore, req)
+			if err != nil {
+				writeError(w, ErrCodeInternal, fmt.Sprintf("Maintenance failed: %v", err), nil)
+				return
+			}
+
+			bridgeLog.Infof("Maintenance complete: %s", resp.Message)
+			writeJSON(w, http.StatusOK, resp)
+
+		default:
+			writeError(w, ErrCodeMethodNotAllowed, "Method not allowed", nil)
+		}
+	})
+}
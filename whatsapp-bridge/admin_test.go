@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestOrphanedMediaSkipsUploads(t *testing.T) {
+	_, dir, err := newUploadDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	// An upload an outbox entry still waits to send
+	pending := filepath.Join(dir, "invoice.pdf")
+	if err := os.WriteFile(pending, []byte("%PDF"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	chat := "15551350001@s.whatsapp.net"
+	if err := os.MkdirAll(mediaDirForChat(chat), 0755); err != nil {
+		t.Fatal(err)
+	}
+	orphan := filepath.Join(mediaDirForChat(chat), "gone.jpg")
+	if err := os.WriteFile(orphan, []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(orphan) })
+
+	orphaned, err := findOrphanedMedia(testStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(orphaned, pending) {
+		t.Errorf("Pending upload %s counted as orphaned media", pending)
+	}
+	if !slices.Contains(orphaned, orphan) {
+		t.Errorf("Orphaned media %s not found in %v", orphan, orphaned)
+	}
+}
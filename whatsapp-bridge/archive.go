@@ -0,0 +1,617 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Directory holding the compressed per-chat message archives
+func archiveDir() string {
+	return filepath.Join(storeDir(), "archive")
+}
+
+// archivedMessage is a full messages row as written to an archive file
+type archivedMessage struct {
+	ID            string     `json:"id"`
+	ChatJID       string     `json:"chat_jid"`
+	Sender        string     `json:"sender"`
+	Content       string     `json:"content"`
+	Timestamp     time.Time  `json:"timestamp"`
+	IsFromMe      bool       `json:"is_from_me"`
+	MediaType     string     `json:"media_type,omitempty"`
+	Filename      string     `json:"filename,omitempty"`
+	URL           string     `json:"url,omitempty"`
+	MediaKey      []byte     `json:"media_key,omitempty"`
+	FileSHA256    []byte     `json:"file_sha256,omitempty"`
+	FileEncSHA256 []byte     `json:"file_enc_sha256,omitempty"`
+	FileLength    uint64     `json:"file_length,omitempty"`
+	Starred       bool       `json:"is_starred,omitempty"`
+	ViewOnce      bool       `json:"is_view_once,omitempty"`
+	Revoked       bool       `json:"is_revoked,omitempty"`
+	RevokedAt     *time.Time `json:"revoked_at,omitempty"`
+	Selected      string     `json:"selected_option,omitempty"`
+	OCRText       string     `json:"ocr_text,omitempty"`
+	OCRAt         *time.Time `json:"ocr_at,omitempty"`
+	DocumentText  string     `json:"document_text,omitempty"`
+	DocumentAt    *time.Time `json:"document_text_at,omitempty"`
+	DocumentPages int        `json:"document_pages,omitempty"`
+	DocumentTitle string     `json:"document_title,omitempty"`
+	Language      string     `json:"language,omitempty"`
+}
+
+// MessageArchive is the summary row of an archive file
+type MessageArchive struct {
+	ID             int64     `json:"id"`
+	ChatJID        string    `json:"chat_jid"`
+	Path           string    `json:"path"`
+	FirstTimestamp time.Time `json:"first_timestamp"`
+	LastTimestamp  time.Time `json:"last_timestamp"`
+	MessageCount   int       `json:"message_count"`
+	SizeBytes      int64     `json:"size_bytes"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// Get the messages of a chat older than a cutoff, oldest first
+func (store *MessageStore) messagesBefore(chatJID string, cutoff time.Time) ([]archivedMessage, error) {
+	rows, err := store.db.Query(
+		`SELECT id, chat_jid, COALESCE(sender, ''), COALESCE(content, ''), timestamp, is_from_me, COALESCE(media_type, ''),
+			COALESCE(filename, ''), COALESCE(url, ''), media_key, file_sha256, file_enc_sha256, COALESCE(file_length, 0),
+			COALESCE(is_starred, 0), COALESCE(is_view_once, 0), COALESCE(is_revoked, 0), revoked_at, COALESCE(selected_option, ''),
+			COALESCE(ocr_text, ''), ocr_at, COALESCE(document_text, ''), document_text_at,
+			COALESCE(document_pages, 0), COALESCE(document_title, ''), COALESCE(language, '')
+		FROM messages WHERE chat_jid = ? AND timestamp < ? ORDER BY timestamp`,
+		chatJID, cutoff.Local(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []archivedMessage
+	for rows.Next() {
+		var m archivedMessage
+		if err := rows.Scan(&m.ID, &m.ChatJID, &m.Sender, &m.Content, &m.Timestamp, &m.IsFromMe, &m.MediaType,
+			&m.Filename, &m.URL, &m.MediaKey, &m.FileSHA256, &m.FileEncSHA256, &m.FileLength,
+			&m.Starred, &m.ViewOnce, &m.Revoked, &m.RevokedAt, &m.Selected,
+			&m.OCRText, &m.OCRAt, &m.DocumentText, &m.DocumentAt,
+			&m.DocumentPages, &m.DocumentTitle, &m.Language); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// List archive summaries, optionally for a single chat
+func (store *MessageStore) ListArchives(chatJID string) ([]MessageArchive, error) {
+	query := "SELECT id, chat_jid, path, first_timestamp, last_timestamp, message_count, size_bytes, created_at FROM message_archives"
+	var args []interface{}
+	if chatJID != "" {
+		query += " WHERE chat_jid = ?"
+		args = append(args, chatJID)
+	}
+	query += " ORDER BY chat_jid, first_timestamp"
+
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	archives := []MessageArchive{}
+	for rows.Next() {
+		var a MessageArchive
+		if err := rows.Scan(&a.ID, &a.ChatJID, &a.Path, &a.FirstTimestamp, &a.LastTimestamp, &a.MessageCount,
+			&a.SizeBytes, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		archives = append(archives, a)
+	}
+	return archives, rows.Err()
+}
+
+// Write messages to a new gzip-compressed JSON lines file, returning its size
+func writeArchiveFile(path string, messages []archivedMessage) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated archive behind
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+
+	gz := gzip.NewWriter(f)
+	enc := json.NewEncoder(gz)
+	for _, m := range messages {
+		if err := enc.Encode(m); err != nil {
+			f.Close()
+			return 0, err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), os.Rename(tmp, path)
+}
+
+// Read all messages from an archive file
+func readArchiveFile(path string) ([]archivedMessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var messages []archivedMessage
+	dec := json.NewDecoder(bufio.NewReader(gz))
+	for dec.More() {
+		var m archivedMessage
+		if err := dec.Decode(&m); err != nil {
+			return nil, fmt.Errorf("corrupt archive %s: %v", path, err)
+		}
+		messages = append(messages, m)
+	}
+	return messages, nil
+}
+
+// Path of a new archive file for a chat's messages
+func archivePath(chatJID string, messages []archivedMessage) string {
+	first, last := messages[0].Timestamp, messages[len(messages)-1].Timestamp
+	name := fmt.Sprintf("%s_%s_%d.jsonl.gz", first.Format("20060102"), last.Format("20060102"), time.Now().UnixNano())
+	return filepath.Join(archiveDir(), strings.ReplaceAll(chatJID, ":", "_"), name)
+}
+
+// Move a chat's messages older than the cutoff into a new archive file. Returns
+// nil if the chat has no messages to archive.
+func archiveChat(messageStore *MessageStore, chatJID string, cutoff time.Time) (*MessageArchive, error) {
+	messages, err := messageStore.messagesBefore(chatJID, cutoff)
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+
+	archive := &MessageArchive{
+		ChatJID:        chatJID,
+		Path:           archivePath(chatJID, messages),
+		FirstTimestamp: messages[0].Timestamp,
+		LastTimestamp:  messages[len(messages)-1].Timestamp,
+		MessageCount:   len(messages),
+		CreatedAt:      time.Now(),
+	}
+	if archive.SizeBytes, err = writeArchiveFile(archive.Path, messages); err != nil {
+		return nil, fmt.Errorf("failed to write archive: %v", err)
+	}
+
+	// Only delete the rows once the archive is safely on disk
+	tx, err := messageStore.db.Begin()
+	if err != nil {
+		os.Remove(archive.Path)
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`INSERT INTO message_archives (chat_jid, path, first_timestamp, last_timestamp, message_count, size_bytes, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		archive.ChatJID, archive.Path, archive.FirstTimestamp, archive.LastTimestamp, archive.MessageCount,
+		archive.SizeBytes, archive.CreatedAt,
+	)
+	if err == nil {
+		archive.ID, err = result.LastInsertId()
+	}
+	for _, m := range messages {
+		if err != nil {
+			break
+		}
+		// Downloaded media of archived messages must survive orphaned media cleanup
+		if m.MediaType != "" && m.Filename != "" {
+			if _, err = tx.Exec("INSERT OR IGNORE INTO archived_media (chat_jid, filename) VALUES (?, ?)", m.ChatJID, m.Filename); err != nil {
+				break
+			}
+		}
+		// Derived rows go too, the archive keeps only the messages
+		_, err = deleteMessageRows(tx, m.ID, m.ChatJID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		os.Remove(archive.Path)
+		return nil, fmt.Errorf("failed to archive messages: %v", err)
+	}
+
+	return archive, nil
+}
+
+// Move archived messages of a chat within a time range back into the database,
+// returning the number of restored messages
+func restoreArchivedMessages(messageStore *MessageStore, chatJID string, after, before *time.Time) (int, error) {
+	archives, err := messageStore.ListArchives(chatJID)
+	if err != nil {
+		return 0, err
+	}
+
+	restored := 0
+	for _, archive := range archives {
+		if (after != nil && archive.LastTimestamp.Before(*after)) || (before != nil && archive.FirstTimestamp.After(*before)) {
+			continue
+		}
+
+		messages, err := readArchiveFile(archive.Path)
+		if err != nil {
+			return restored, err
+		}
+
+		var restore, keep []archivedMessage
+		for _, m := range messages {
+			if (after != nil && m.Timestamp.Before(*after)) || (before != nil && m.Timestamp.After(*before)) {
+				keep = append(keep, m)
+			} else {
+				restore = append(restore, m)
+			}
+		}
+		if len(restore) == 0 {
+			continue
+		}
+
+		n, err := restoreFromArchive(messageStore, archive, restore, keep)
+		restored += n
+		if err != nil {
+			return restored, err
+		}
+	}
+	return restored, nil
+}
+
+// Insert some messages of an archive back into the database and rewrite the archive with the rest
+func restoreFromArchive(messageStore *MessageStore, archive MessageArchive, restore, keep []archivedMessage) (int, error) {
+	newPath := ""
+	var size int64
+	if len(keep) > 0 {
+		newPath = archivePath(archive.ChatJID, keep)
+		var err error
+		if size, err = writeArchiveFile(newPath, keep); err != nil {
+			return 0, fmt.Errorf("failed to rewrite archive: %v", err)
+		}
+	}
+
+	tx, err := messageStore.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Media stay protected from orphaned media cleanup while a message still
+	// in the archive uses them
+	kept := map[string]bool{}
+	for _, m := range keep {
+		kept[m.Filename] = true
+	}
+	for _, m := range restore {
+		if m.MediaType == "" || m.Filename == "" || kept[m.Filename] {
+			continue
+		}
+		if _, err = tx.Exec("DELETE FROM archived_media WHERE chat_jid = ? AND filename = ?", m.ChatJID, m.Filename); err != nil {
+			break
+		}
+	}
+
+	for _, m := range restore {
+		if err != nil {
+			break
+		}
+		// Never overwrite a newer copy that was stored since archiving, e.g. by a history sync
+		var result sql.Result
+		if result, err = tx.Exec(
+			`INSERT OR IGNORE INTO messages
+			(id, chat_jid, sender, content, timestamp, is_from_me, media_type, filename, url, media_key, file_sha256, file_enc_sha256, file_length,
+			is_starred, is_view_once, is_revoked, revoked_at, selected_option, document_pages, document_title, language)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), NULLIF(?, 0), NULLIF(?, ''), NULLIF(?, ''))`,
+			m.ID, m.ChatJID, m.Sender, m.Content, m.Timestamp, m.IsFromMe, m.MediaType, m.Filename, m.URL,
+			m.MediaKey, m.FileSHA256, m.FileEncSHA256, m.FileLength,
+			m.Starred, m.ViewOnce, m.Revoked, m.RevokedAt, m.Selected, m.DocumentPages, m.DocumentTitle, m.Language,
+		); err != nil {
+			break
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		// Recognized and extracted text goes in with updates, which add it to
+		// its search index
+		if m.OCRAt != nil {
+			if _, err = tx.Exec("UPDATE messages SET ocr_text = ?, ocr_at = ? WHERE id = ? AND chat_jid = ?", m.OCRText, m.OCRAt, m.ID, m.ChatJID); err != nil {
+				break
+			}
+		}
+		if m.DocumentAt != nil {
+			if _, err = tx.Exec("UPDATE messages SET document_text = ?, document_text_at = ? WHERE id = ? AND chat_jid = ?", m.DocumentText, m.DocumentAt, m.ID, m.ChatJID); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		if len(keep) == 0 {
+			_, err = tx.Exec("DELETE FROM message_archives WHERE id = ?", archive.ID)
+		} else {
+			_, err = tx.Exec(
+				"UPDATE message_archives SET path = ?, first_timestamp = ?, last_timestamp = ?, message_count = ?, size_bytes = ? WHERE id = ?",
+				newPath, keep[0].Timestamp, keep[len(keep)-1].Timestamp, len(keep), size, archive.ID,
+			)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		if newPath != "" {
+			os.Remove(newPath)
+		}
+		return 0, fmt.Errorf("failed to restore messages: %v", err)
+	}
+
+	if err := os.Remove(archive.Path); err != nil {
+		bridgeLog.Warnf("Failed to remove old archive %s: %v", archive.Path, err)
+	}
+	return len(restore), nil
+}
+
+// Take a message out of the archives of its chat, rewriting the archive holding
+// it with the rest. Returns nil if no archive holds it.
+func removeArchivedMessage(messageStore *MessageStore, messageID, chatJID string) (*archivedMessage, error) {
+	archives, err := messageStore.ListArchives(chatJID)
+	if err != nil {
+		return nil, err
+	}
+	for _, archive := range archives {
+		messages, err := readArchiveFile(archive.Path)
+		if err != nil {
+			return nil, err
+		}
+		var removed *archivedMessage
+		var keep []archivedMessage
+		for i := range messages {
+			if messages[i].ID == messageID {
+				removed = &messages[i]
+			} else {
+				keep = append(keep, messages[i])
+			}
+		}
+		if removed == nil {
+			continue
+		}
+
+		newPath := ""
+		var size int64
+		if len(keep) > 0 {
+			newPath = archivePath(chatJID, keep)
+			if size, err = writeArchiveFile(newPath, keep); err != nil {
+				return nil, fmt.Errorf("failed to rewrite archive: %v", err)
+			}
+		}
+
+		tx, err := messageStore.db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		if len(keep) == 0 {
+			_, err = tx.Exec("DELETE FROM message_archives WHERE id = ?", archive.ID)
+		} else {
+			_, err = tx.Exec(
+				"UPDATE message_archives SET path = ?, first_timestamp = ?, last_timestamp = ?, message_count = ?, size_bytes = ? WHERE id = ?",
+				newPath, keep[0].Timestamp, keep[len(keep)-1].Timestamp, len(keep), size, archive.ID,
+			)
+		}
+		if err == nil && removed.Filename != "" && !slices.ContainsFunc(keep, func(m archivedMessage) bool { return m.Filename == removed.Filename }) {
+			_, err = tx.Exec("DELETE FROM archived_media WHERE chat_jid = ? AND filename = ?", chatJID, removed.Filename)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			if newPath != "" {
+				os.Remove(newPath)
+			}
+			return nil, fmt.Errorf("failed to remove message from archive: %v", err)
+		}
+
+		if err := os.Remove(archive.Path); err != nil {
+			bridgeLog.Warnf("Failed to remove old archive %s: %v", archive.Path, err)
+		}
+		return removed, nil
+	}
+	return nil, nil
+}
+
+// ArchiveRequest represents the request body for the archive API
+type ArchiveRequest struct {
+	OlderThanMonths int    `json:"older_than_months"`
+	ChatJID         string `json:"chat_jid,omitempty"` // Only archive this chat, all chats when empty
+	DryRun          bool   `json:"dry_run,omitempty"`
+}
+
+// ArchiveResponse represents the response for the archive API
+type ArchiveResponse struct {
+	Success          bool             `json:"success"`
+	Message          string           `json:"message"`
+	ArchivedMessages int              `json:"archived_messages"`
+	Archives         []MessageArchive `json:"archives"`
+}
+
+// ListArchivesResponse represents the response for the list archives API
+type ListArchivesResponse struct {
+	Success  bool             `json:"success"`
+	Archives []MessageArchive `json:"archives"`
+}
+
+// RestoreArchiveRequest represents the request body for the restore archive API
+type RestoreArchiveRequest struct {
+	ChatJID    string     `json:"chat_jid"`
+	AfterTime  *time.Time `json:"after_time,omitempty"`
+	BeforeTime *time.Time `json:"before_time,omitempty"`
+}
+
+// RestoreArchiveResponse represents the response for the restore archive API
+type RestoreArchiveResponse struct {
+	Success          bool   `json:"success"`
+	Message          string `json:"message"`
+	RestoredMessages int    `json:"restored_messages"`
+}
+
+// Register the REST handlers for archiving old messages and restoring them
+func registerArchiveHandlers(messageStore *MessageStore) {
+	// Handler for listing archives
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/archives",
+		Summary: "List the archive files old messages were moved to",
+		Tag:     "admin",
+		Scope:   ScopeAdmin,
+		Params: []apiParam{
+			{Name: "chat_jid", Description: "Only archives of this chat"},
+		},
+		Response: ListArchivesResponse{},
+	})
+	http.HandleFunc("GET /api/archives", func(w http.ResponseWriter, r *http.Request) {
+		archives, err := messageStore.ListArchives(r.URL.Query().Get("chat_jid"))
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list archives: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, ListArchivesResponse{Success: true, Archives: archives})
+	})
+
+	// Handler for archiving old messages
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/archives",
+		Summary:  "Move messages older than N months into compressed per-chat archive files",
+		Tag:      "admin",
+		Scope:    ScopeAdmin,
+		Audit:    true,
+		Request:  ArchiveRequest{},
+		Response: ArchiveResponse{},
+	})
+	http.HandleFunc("POST /api/archives", func(w http.ResponseWriter, r *http.Request) {
+		var req ArchiveRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if req.OlderThanMonths <= 0 {
+			writeError(w, ErrCodeInvalidRequest, "older_than_months must be a positive integer", nil)
+			return
+		}
+		cutoff := time.Now().AddDate(0, -req.OlderThanMonths, 0)
+
+		chatJIDs := []string{req.ChatJID}
+		if req.ChatJID == "" {
+			chats, err := messageStore.ListChats("", -1, 0)
+			if err != nil {
+				writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list chats: %v", err), nil)
+				return
+			}
+			chatJIDs = chatJIDs[:0]
+			for _, chat := range chats {
+				chatJIDs = append(chatJIDs, chat.JID)
+			}
+		}
+
+		resp := ArchiveResponse{Success: true, Archives: []MessageArchive{}}
+		for _, chatJID := range chatJIDs {
+			if req.DryRun {
+				messages, err := messageStore.messagesBefore(chatJID, cutoff)
+				if err != nil {
+					writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to read messages of %s: %v", chatJID, err), nil)
+					return
+				}
+				resp.ArchivedMessages += len(messages)
+				continue
+			}
+
+			archive, err := archiveChat(messageStore, chatJID, cutoff)
+			if err != nil {
+				writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to archive %s: %v", chatJID, err),
+					map[string]interface{}{"archives": resp.Archives})
+				return
+			}
+			if archive != nil {
+				resp.Archives = append(resp.Archives, *archive)
+				resp.ArchivedMessages += archive.MessageCount
+			}
+		}
+
+		if req.DryRun {
+			resp.Message = fmt.Sprintf("Dry run: would archive %d messages older than %s", resp.ArchivedMessages, cutoff.Format("2006-01-02"))
+		} else {
+			resp.Message = fmt.Sprintf("Archived %d messages older than %s into %d files, run a vacuum to reclaim the space",
+				resp.ArchivedMessages, cutoff.Format("2006-01-02"), len(resp.Archives))
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+
+	// Handler for restoring archived messages
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/archives/restore",
+		Summary:  "Move archived messages of a chat in a time range back into the database",
+		Tag:      "admin",
+		Scope:    ScopeAdmin,
+		Audit:    true,
+		Request:  RestoreArchiveRequest{},
+		Response: RestoreArchiveResponse{},
+	})
+	http.HandleFunc("POST /api/archives/restore", func(w http.ResponseWriter, r *http.Request) {
+		var req RestoreArchiveRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if req.ChatJID == "" {
+			writeError(w, ErrCodeInvalidRequest, "Chat JID is required", nil)
+			return
+		}
+
+		restored, err := restoreArchivedMessages(messageStore, req.ChatJID, req.AfterTime, req.BeforeTime)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to restore archived messages: %v", err),
+				map[string]int{"restored_messages": restored})
+			return
+		}
+
+		writeJSON(w, http.StatusOK, RestoreArchiveResponse{
+			Success:          true,
+			Message:          fmt.Sprintf("Restored %d messages of %s", restored, req.ChatJID),
+			RestoredMessages: restored,
+		})
+	})
+}
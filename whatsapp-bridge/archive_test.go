@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Get a column of a stored message
+func messageColumn(t *testing.T, chatJID, messageID, column string, v interface{}) {
+	t.Helper()
+	if err := testStore.db.QueryRow("SELECT "+column+" FROM messages WHERE id = ? AND chat_jid = ?", messageID, chatJID).Scan(v); err != nil {
+		t.Fatalf("%s of %s: %v", column, messageID, err)
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	chat := "15551340001@s.whatsapp.net"
+	sent := time.Date(2025, 6, 1, 9, 0, 0, 0, time.Local)
+	storeTestMessage(t, Message{ID: "ARC1", ChatJID: chat, Sender: "15551340001", MediaType: "image", Filename: "secret.jpg", Time: sent}, "https://mmg.whatsapp.net/x", []byte("key"), 10)
+	storeTestMessage(t, Message{ID: "ARC3", ChatJID: chat, Sender: "15551340001", MediaType: "document", Filename: "lease.pdf", Time: sent}, "", nil, 0)
+	storeTestMessage(t, Message{ID: "ARC2", ChatJID: chat, Sender: "15551340001", Content: "oops", Time: sent.Add(time.Minute)}, "", nil, 0)
+	if err := testStore.MarkViewOnce("ARC1", chat); err != nil {
+		t.Fatal(err)
+	}
+	testStore.SetStarred(chat, "ARC1", true)
+	testStore.db.Exec("UPDATE messages SET language = 'it' WHERE id = 'ARC2' AND chat_jid = ?", chat)
+	if err := testStore.StoreDocumentInfo("ARC3", chat, DocumentInfo{PageCount: 7, Title: "Lease"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.StoreDocumentText("ARC3", chat, "tenancy agreement"); err != nil {
+		t.Fatal(err)
+	}
+	if err := testStore.StoreOCRText("ARC1", chat, "boarding pass gate B12"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testStore.MarkRevoked("ARC2", chat, sent.Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := testStore.TagMessage("ARC2", chat, "todo"); err != nil {
+		t.Fatal(err)
+	}
+
+	if archive, err := archiveChat(testStore, chat, sent.Add(time.Hour)); err != nil || archive == nil || archive.MessageCount != 3 {
+		t.Fatalf("archiveChat = %+v, %v", archive, err)
+	}
+	var tags, media int
+	testStore.db.QueryRow("SELECT COUNT(*) FROM message_tags WHERE chat_jid = ?", chat).Scan(&tags)
+	testStore.db.QueryRow("SELECT COUNT(*) FROM archived_media WHERE chat_jid = ?", chat).Scan(&media)
+	if tags != 0 || media != 2 {
+		t.Errorf("Archiving left %d tags and protected %d media, want 0 and 2", tags, media)
+	}
+	if n, err := restoreArchivedMessages(testStore, chat, nil, nil); err != nil || n != 3 {
+		t.Fatalf("restoreArchivedMessages = %d, %v", n, err)
+	}
+	testStore.db.QueryRow("SELECT COUNT(*) FROM archived_media WHERE chat_jid = ?", chat).Scan(&media)
+	if media != 0 {
+		t.Errorf("Restoring left %d media protected as archived", media)
+	}
+
+	var viewOnce, starred, revoked bool
+	messageColumn(t, chat, "ARC1", "is_view_once", &viewOnce)
+	messageColumn(t, chat, "ARC1", "is_starred", &starred)
+	messageColumn(t, chat, "ARC2", "is_revoked", &revoked)
+	if !viewOnce || !starred || !revoked {
+		t.Errorf("Restored view once %v, starred %v, revoked %v, want all kept", viewOnce, starred, revoked)
+	}
+
+	var ocrText string
+	messageColumn(t, chat, "ARC1", "ocr_text", &ocrText)
+	var indexed int
+	testStore.db.QueryRow("SELECT COUNT(*) FROM messages_ocr_fts WHERE messages_ocr_fts MATCH 'boarding'").Scan(&indexed)
+	if ocrText != "boarding pass gate B12" || indexed != 1 {
+		t.Errorf("Restored OCR text %q, found %d times in its index", ocrText, indexed)
+	}
+
+	if text, ok := testStore.DocumentText("ARC3", chat); !ok || text != "tenancy agreement" {
+		t.Errorf("Restored document text %q, %v", text, ok)
+	}
+	testStore.db.QueryRow("SELECT COUNT(*) FROM messages_document_fts WHERE messages_document_fts MATCH 'tenancy'").Scan(&indexed)
+	if indexed != 1 {
+		t.Errorf("Restored document text found %d times in its index", indexed)
+	}
+
+	var pages int
+	var title string
+	messageColumn(t, chat, "ARC3", "document_pages", &pages)
+	messageColumn(t, chat, "ARC3", "document_title", &title)
+	if pages != 7 || title != "Lease" {
+		t.Errorf("Restored document with %d pages and title %q", pages, title)
+	}
+
+	var language string
+	messageColumn(t, chat, "ARC2", "language", &language)
+	if language != "it" {
+		t.Errorf("Restored language %q", language)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Maximum number of bytes of request arguments and results kept per audit entry
+const auditMaxCapture = 16 * 1024
+
+// AuditEntry represents a recorded mutating API operation
+type AuditEntry struct {
+	ID         int64     `json:"id"`
+	Timestamp  time.Time `json:"timestamp"`
+	Caller     string    `json:"caller"`
+	Method     string    `json:"method"`
+	Endpoint   string    `json:"endpoint"`
+	Arguments  string    `json:"arguments,omitempty"`
+	Status     int       `json:"status"`
+	Success    bool      `json:"success"`
+	Result     string    `json:"result,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// Store an audit log entry
+func (store *MessageStore) StoreAuditEntry(entry AuditEntry) error {
+	_, err := store.db.Exec(
+		`INSERT INTO audit_log (timestamp, caller, method, endpoint, arguments, status, success, result, remote_addr, duration_ms)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.Timestamp, entry.Caller, entry.Method, entry.Endpoint, entry.Arguments,
+		entry.Status, entry.Success, entry.Result, entry.RemoteAddr, entry.DurationMs,
+	)
+	return err
+}
+
+// AuditFilter describes which audit log entries QueryAuditLog returns
+type AuditFilter struct {
+	Caller   string
+	Endpoint string
+	Since    *time.Time
+	Limit    int
+	Offset   int
+}
+
+// Query audit log entries, newest first
+func (store *MessageStore) QueryAuditLog(f AuditFilter) ([]AuditEntry, error) {
+	var conditions []string
+	var args []interface{}
+	if f.Caller != "" {
+		conditions = append(conditions, "caller = ?")
+		args = append(args, f.Caller)
+	}
+	if f.Endpoint != "" {
+		conditions = append(conditions, "endpoint = ?")
+		args = append(args, f.Endpoint)
+	}
+	if f.Since != nil {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, f.Since.Local())
+	}
+
+	query := `SELECT id, timestamp, caller, method, endpoint, COALESCE(arguments, ''), status, success,
+		COALESCE(result, ''), COALESCE(remote_addr, ''), duration_ms FROM audit_log`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	args = append(args, f.Limit, f.Offset)
+
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.Timestamp, &e.Caller, &e.Method, &e.Endpoint, &e.Arguments,
+			&e.Status, &e.Success, &e.Result, &e.RemoteAddr, &e.DurationMs); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// auditRecorder captures the status and (bounded) body of a response
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *auditRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *auditRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if remaining := auditMaxCapture - rec.body.Len(); remaining > 0 {
+		rec.body.Write(b[:min(len(b), remaining)])
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// errorReader fails every read with an error
+type errorReader struct{ err error }
+
+func (e errorReader) Read([]byte) (int, error) {
+	return 0, e.err
+}
+
+// Truncate captured text to the audit capture limit
+func truncateForAudit(s string) string {
+	if len(s) > auditMaxCapture {
+		return s[:auditMaxCapture] + "…"
+	}
+	return s
+}
+
+// Wrap a handler so calls to operations marked for auditing are recorded in the audit log
+func withAudit(messageStore *MessageStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := operationFromContext(r.Context())
+		if op == nil || !op.Audit {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Capture the arguments, restoring the body for the handler
+		arguments := r.URL.RawQuery
+		if r.Body != nil {
+			body, err := io.ReadAll(r.Body)
+			if err == nil {
+				r.Body = io.NopCloser(bytes.NewReader(body))
+				if len(body) > 0 {
+					arguments = redactJSONContent(string(body), false)
+				}
+			} else {
+				// Hand the handler the same failure, e.g. a body over the size limit
+				r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), errorReader{err}))
+			}
+		}
+
+		start := time.Now()
+		rec := &auditRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		// Pull success out of our JSON envelopes, falling back to the status code
+		success := rec.status < 400
+		var envelope struct {
+			Success *bool `json:"success"`
+		}
+		if json.Unmarshal(rec.body.Bytes(), &envelope) == nil && envelope.Success != nil {
+			success = *envelope.Success
+		}
+
+		entry := AuditEntry{
+			Timestamp:  start,
+			Caller:     callerName(r),
+			Method:     r.Method,
+			Endpoint:   r.URL.Path,
+			Arguments:  truncateForAudit(arguments),
+			Status:     rec.status,
+			Success:    success,
+			Result:     redactJSONContent(strings.TrimSpace(rec.body.String()), true),
+			RemoteAddr: r.RemoteAddr,
+			DurationMs: time.Since(start).Milliseconds(),
+		}
+		if err := messageStore.StoreAuditEntry(entry); err != nil {
+			bridgeLog.Warnf("Failed to write audit log entry for %s %s: %v", r.Method, r.URL.Path, err)
+		}
+	})
+}
+
+// ListAuditResponse represents the response for the audit log API
+type ListAuditResponse struct {
+	Success bool         `json:"success"`
+	Entries []AuditEntry `json:"entries"`
+	Page
+}
+
+// Register the audit log REST handlers
+func registerAuditHandlers(messageStore *MessageStore) {
+	// Handler for reviewing recorded operations
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/audit",
+		Summary: "List recorded mutating operations, newest first",
+		Tag:     "admin",
+		Scope:   ScopeAdmin,
+		Params: []apiParam{
+			{Name: "caller", Description: "Only operations by this token name"},
+			{Name: "endpoint", Description: "Only operations on this endpoint path, e.g. /api/send"},
+			{Name: "since", Description: "Only operations after this time" + timeFormatsHint},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ListAuditResponse{},
+	})
+	http.HandleFunc("/api/audit", func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		since, err := parseTimeParam(r, "since")
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		entries, err := messageStore.QueryAuditLog(AuditFilter{
+			Caller:   r.URL.Query().Get("caller"),
+			Endpoint: r.URL.Query().Get("endpoint"),
+			Since:    since,
+			Limit:    limit + 1,
+			Offset:   offset,
+		})
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to query audit log: %v", err), nil)
+			return
+		}
+
+		entries, page := trimPage(entries, offset, limit)
+		writeJSON(w, http.StatusOK, ListAuditResponse{Success: true, Entries: entries, Page: page})
+	})
+}
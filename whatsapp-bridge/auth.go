@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Capability scopes required by the REST endpoints
+const (
+	ScopeReadMessages   = "read:messages"
+	ScopeSendMessages   = "send:messages"
+	ScopeManageGroups   = "manage:groups"
+	ScopeManageContacts = "manage:contacts"
+	ScopeAdmin          = "admin"
+	ScopeAll            = "*"
+)
+
+// APIToken is a bearer token granting a set of scopes
+type APIToken struct {
+	Name            string   `json:"name"`
+	Token           string   `json:"token"`
+	Scopes          []string `json:"scopes"`
+	RequireApproval bool     `json:"require_approval,omitempty"` // Messages sent with this token wait in the outbox for approval
+}
+
+// Check whether the token grants a scope
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == ScopeAll || s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Load API tokens from the environment. WHATSAPP_API_KEY configures a single
+// full-access key, WHATSAPP_API_TOKENS_FILE points to a JSON list of scoped tokens.
+// No tokens means authentication is disabled.
+func loadAPITokens() ([]*APIToken, error) {
+	var tokens []*APIToken
+
+	if key := envString("WHATSAPP_API_KEY", ""); key != "" {
+		tokens = append(tokens, &APIToken{Name: "api_key", Token: key, Scopes: []string{ScopeAll}})
+	}
+
+	if path := dataPath(envString("WHATSAPP_API_TOKENS_FILE", "")); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token file: %v", err)
+		}
+		var fileTokens []*APIToken
+		if err := json.Unmarshal(data, &fileTokens); err != nil {
+			return nil, fmt.Errorf("failed to parse token file: %v", err)
+		}
+		for _, t := range fileTokens {
+			if t.Token == "" || t.Name == "" {
+				return nil, fmt.Errorf("every token in %s needs a name and a token", path)
+			}
+		}
+		tokens = append(tokens, fileTokens...)
+	}
+
+	return tokens, nil
+}
+
+// Context key for the authenticated token of a request
+type apiTokenKey struct{}
+
+// Get the token that authenticated a request, nil when authentication is disabled
+func tokenFromContext(ctx context.Context) *APIToken {
+	token, _ := ctx.Value(apiTokenKey{}).(*APIToken)
+	return token
+}
+
+// Get a name for whoever made a request, for logging and auditing
+func callerName(r *http.Request) string {
+	if token := tokenFromContext(r.Context()); token != nil {
+		return token.Name
+	}
+	return "anonymous"
+}
+
+// Extract the presented token from the Authorization header, X-API-Key header or
+// access_token query parameter (for <img> tags and links in the web UI)
+func presentedToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// Wrap a handler with bearer token authentication and per-route scope checks.
+// Operations marked public (the health probes, web UI and API docs) need no
+// token, and requests no documented operation matches are refused.
+func withAuth(tokens []*APIToken, next http.Handler) http.Handler {
+	if len(tokens) == 0 {
+		bridgeLog.Warnf("no API tokens configured, the REST API is unauthenticated")
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := operationFromContext(r.Context())
+		if op == nil {
+			// Every route is documented, so nothing tells what this request may
+			// reach and what it needs
+			writeError(w, ErrCodeUnauthorized, "A valid API token is required", nil)
+			return
+		}
+		if op.Public {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		presented := presentedToken(r)
+		var token *APIToken
+		for _, t := range tokens {
+			if subtle.ConstantTimeCompare([]byte(t.Token), []byte(presented)) == 1 {
+				token = t
+				break
+			}
+		}
+		if token == nil {
+			writeError(w, ErrCodeUnauthorized, "A valid API token is required", nil)
+			return
+		}
+
+		scope := op.Scope
+		if scope == "" {
+			scope = ScopeAdmin
+		}
+		if !token.HasScope(scope) {
+			writeError(w, ErrCodeForbidden, fmt.Sprintf("Token %q lacks the %s scope", token.Name, scope),
+				map[string]string{"required_scope": scope})
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiTokenKey{}, token)))
+	})
+}
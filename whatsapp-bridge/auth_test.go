@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthCoversHead(t *testing.T) {
+	called := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/test/auth", func(w http.ResponseWriter, r *http.Request) {
+		called++
+	})
+	documented := apiOperations
+	t.Cleanup(func() { apiOperations = documented })
+	documentAPI(apiOperation{Method: http.MethodGet, Path: "/api/test/auth", Scope: ScopeReadMessages})
+	tokens := []*APIToken{{Name: "reader", Token: "read-token", Scopes: []string{ScopeReadMessages}}}
+	server := httptest.NewServer(withOperation(mux, withAuth(tokens, mux)))
+	defer server.Close()
+
+	for _, tc := range []struct {
+		method, path, token string
+		want                int
+	}{
+		{http.MethodGet, "/api/test/auth", "", http.StatusUnauthorized},
+		{http.MethodHead, "/api/test/auth", "", http.StatusUnauthorized},
+		{http.MethodHead, "/api/test/auth", "read-token", http.StatusOK},
+		{http.MethodGet, "/api/test/unknown", "", http.StatusUnauthorized},
+	} {
+		called = 0
+		req, _ := http.NewRequest(tc.method, server.URL+tc.path, nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.want {
+			t.Errorf("%s %s with token %q answered %d, want %d", tc.method, tc.path, tc.token, resp.StatusCode, tc.want)
+		}
+		if ran := called > 0; ran != (tc.want == http.StatusOK) {
+			t.Errorf("%s %s with token %q ran the handler: %v", tc.method, tc.path, tc.token, ran)
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Databases in the store directory that backups include
+var backupDatabases = []string{"messages.db", "whatsapp.db"}
+
+// The backup job, shared by the scheduler and the REST API so backups never overlap
+var backupJob = newSyncJob("backup")
+
+// Directory holding the backup archives
+func backupDir() string {
+	return dataPath(envString("WHATSAPP_BACKUP_DIR", "backups"))
+}
+
+// BackupInfo describes a backup archive
+type BackupInfo struct {
+	Name      string    `json:"name"`
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+	Uploaded  bool      `json:"uploaded,omitempty"`
+}
+
+// Copy a database that may be in use to a file with the SQLite online backup
+// API, which gives a consistent snapshot without stopping writers
+func backupDatabase(srcPath, destPath string) error {
+	src, err := sql.Open("sqlite3", "file:"+srcPath+"?mode=ro&_busy_timeout=10000")
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dest, err := sql.Open("sqlite3", "file:"+destPath)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	ctx := context.Background()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	return destConn.Raw(func(destDriver interface{}) error {
+		return srcConn.Raw(func(srcDriver interface{}) error {
+			backup, err := destDriver.(*sqlite3.SQLiteConn).Backup("main", srcDriver.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			if _, err := backup.Step(-1); err != nil {
+				backup.Close()
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+}
+
+// Write the files of a directory to a gzipped tar archive
+func writeTarGz(path, dir string, names []string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+
+	for _, name := range names {
+		if err := addToTar(tw, filepath.Join(dir, name), name); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Add a file to a tar archive
+func addToTar(tw *tar.Writer, path, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// Snapshot the databases into a new archive, drop archives beyond the
+// WHATSAPP_BACKUP_KEEP newest and upload the new one if S3 is configured
+func createBackup() (*BackupInfo, error) {
+	dir := backupDir()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %v", err)
+	}
+	snapshot, err := os.MkdirTemp(dir, ".snapshot-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot directory: %v", err)
+	}
+	defer os.RemoveAll(snapshot)
+
+	var names []string
+	for _, name := range backupDatabases {
+		src := filepath.Join(storeDir(), name)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := backupDatabase(src, filepath.Join(snapshot, name)); err != nil {
+			return nil, fmt.Errorf("failed to back up %s: %v", name, err)
+		}
+		names = append(names, name)
+	}
+
+	now := time.Now()
+	info := &BackupInfo{Name: "whatsapp-" + now.Format("20060102-150405") + ".tar.gz", CreatedAt: now}
+	info.Path = filepath.Join(dir, info.Name)
+	// Written under a temporary name so a partial archive is never taken for a backup
+	partial := info.Path + ".partial"
+	if err := writeTarGz(partial, snapshot, names); err != nil {
+		os.Remove(partial)
+		return nil, fmt.Errorf("failed to write backup archive: %v", err)
+	}
+	if err := os.Rename(partial, info.Path); err != nil {
+		return nil, fmt.Errorf("failed to write backup archive: %v", err)
+	}
+	if stat, err := os.Stat(info.Path); err == nil {
+		info.Size = stat.Size()
+	}
+	bridgeLog.Infof("Backed up %s to %s (%d bytes)", strings.Join(names, ", "), info.Path, info.Size)
+
+	if err := pruneBackups(envInt("WHATSAPP_BACKUP_KEEP", 7)); err != nil {
+		bridgeLog.Warnf("Failed to remove old backups: %v", err)
+	}
+
+	if cfg, ok := loadS3Config(); ok {
+		if err := uploadToS3(cfg, info.Path, info.Name); err != nil {
+			return info, fmt.Errorf("backup %s was created but the upload failed: %v", info.Name, err)
+		}
+		info.Uploaded = true
+		bridgeLog.Infof("Uploaded backup %s to %s", info.Name, cfg.Endpoint)
+	}
+	return info, nil
+}
+
+// List the backup archives, newest first
+func listBackups() ([]BackupInfo, error) {
+	entries, err := os.ReadDir(backupDir())
+	if os.IsNotExist(err) {
+		return []BackupInfo{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	backups := []BackupInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), "whatsapp-") || !strings.HasSuffix(entry.Name(), ".tar.gz") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, BackupInfo{
+			Name:      entry.Name(),
+			Path:      filepath.Join(backupDir(), entry.Name()),
+			Size:      info.Size(),
+			CreatedAt: info.ModTime(),
+		})
+	}
+	// Names hold the creation time, so they sort chronologically
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name > backups[j].Name })
+	return backups, nil
+}
+
+// Remove all but the newest archives
+func pruneBackups(keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	backups, err := listBackups()
+	if err != nil {
+		return err
+	}
+	for i := keep; i < len(backups); i++ {
+		if err := os.Remove(backups[i].Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the time of the next scheduled backup. Schedules are a time of day like
+// "03:00" for nightly backups or an interval like "6h".
+func nextBackupTime(schedule string, now time.Time) (time.Time, error) {
+	if interval, err := time.ParseDuration(schedule); err == nil {
+		if interval <= 0 {
+			return time.Time{}, fmt.Errorf("backup interval must be positive")
+		}
+		return now.Add(interval), nil
+	}
+	at, err := time.Parse("15:04", schedule)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid backup schedule %q, expected a time like 03:00 or an interval like 6h", schedule)
+	}
+	next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next, nil
+}
+
+// Take backups on the schedule in WHATSAPP_BACKUP_SCHEDULE, if any
+func runBackupScheduler() {
+	schedule := envString("WHATSAPP_BACKUP_SCHEDULE", "")
+	if schedule == "" {
+		return
+	}
+	for {
+		next, err := nextBackupTime(schedule, time.Now())
+		if err != nil {
+			bridgeLog.Errorf("Backups are disabled: %v", err)
+			return
+		}
+		time.Sleep(time.Until(next))
+		func() {
+			defer recoverPanic("taking a scheduled backup")
+			ran, _ := backupJob.runAndWait(func(j *syncJob) error {
+				_, err := createBackup()
+				return err
+			})
+			if !ran {
+				bridgeLog.Warnf("Skipping scheduled backup, one is already running")
+			}
+		}()
+	}
+}
+
+// s3Config locates an S3-compatible bucket backups are uploaded to
+type s3Config struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+// Load the S3 upload settings, reporting whether uploads are configured
+func loadS3Config() (s3Config, bool) {
+	cfg := s3Config{
+		Endpoint:  strings.TrimRight(envString("WHATSAPP_BACKUP_S3_ENDPOINT", ""), "/"),
+		Bucket:    envString("WHATSAPP_BACKUP_S3_BUCKET", ""),
+		Region:    envString("WHATSAPP_BACKUP_S3_REGION", "us-east-1"),
+		Prefix:    strings.Trim(envString("WHATSAPP_BACKUP_S3_PREFIX", ""), "/"),
+		AccessKey: envString("WHATSAPP_BACKUP_S3_ACCESS_KEY", ""),
+		SecretKey: envString("WHATSAPP_BACKUP_S3_SECRET_KEY", ""),
+	}
+	return cfg, cfg.Endpoint != "" && cfg.Bucket != "" && cfg.AccessKey != "" && cfg.SecretKey != ""
+}
+
+// Compute an HMAC-SHA256
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Upload a file to an S3-compatible bucket with a path-style PUT signed with
+// AWS Signature Version 4
+func uploadToS3(cfg s3Config, path, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// The payload hash is part of the signature, so the file is read twice
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	payloadHash := hex.EncodeToString(hash.Sum(nil))
+
+	key := name
+	if cfg.Prefix != "" {
+		key = cfg.Prefix + "/" + name
+	}
+	req, err := http.NewRequest(http.MethodPut, cfg.Endpoint+"/"+cfg.Bucket+"/"+key, file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("Content-Type", "application/gzip")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		http.MethodPut,
+		req.URL.EscapedPath(),
+		"",
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + cfg.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+cfg.SecretKey), date)
+	for _, part := range []string{cfg.Region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cfg.AccessKey, scope, signedHeaders, signature))
+
+	resp, err := (&http.Client{Timeout: 30 * time.Minute}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("upload rejected with %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// BackupResponse represents the response for the backup API
+type BackupResponse struct {
+	Success bool        `json:"success"`
+	Message string      `json:"message"`
+	Backup  *BackupInfo `json:"backup,omitempty"`
+}
+
+// ListBackupsResponse represents the response for the backup listing API
+type ListBackupsResponse struct {
+	Success  bool         `json:"success"`
+	Schedule string       `json:"schedule,omitempty"`
+	Status   SyncStatus   `json:"status"`
+	Backups  []BackupInfo `json:"backups"`
+}
+
+// Register the REST handlers for taking and listing backups
+func registerBackupHandlers() {
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/admin/backups",
+		Summary:  "Snapshot the databases into a new backup archive now",
+		Tag:      "admin",
+		Scope:    ScopeAdmin,
+		Audit:    true,
+		Response: BackupResponse{},
+	})
+	http.HandleFunc("POST /api/admin/backups", func(w http.ResponseWriter, r *http.Request) {
+		var info *BackupInfo
+		ran, err := backupJob.runAndWait(func(j *syncJob) error {
+			var err error
+			info, err = createBackup()
+			return err
+		})
+		if !ran {
+			writeError(w, ErrCodeConflict, "A backup is already running", nil)
+			return
+		}
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Backup failed: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, BackupResponse{Success: true, Message: fmt.Sprintf("Created backup %s", info.Name), Backup: info})
+	})
+
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/admin/backups",
+		Summary:  "List the backup archives, newest first, and the state of the last backup",
+		Tag:      "admin",
+		Scope:    ScopeAdmin,
+		Response: ListBackupsResponse{},
+	})
+	http.HandleFunc("GET /api/admin/backups", func(w http.ResponseWriter, r *http.Request) {
+		backups, err := listBackups()
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list backups: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, ListBackupsResponse{
+			Success:  true,
+			Schedule: envString("WHATSAPP_BACKUP_SCHEDULE", ""),
+			Status:   backupJob.Status(),
+			Backups:  backups,
+		})
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// bootstrapStep is one of the sync steps run in the background after connecting
+type bootstrapStep struct {
+	job     *syncJob
+	run     func(client *whatsmeow.Client, messageStore *MessageStore, job *syncJob) error
+	setting string // Environment variable that can turn the step off
+}
+
+// Background job running the startup sync steps in order
+var bootstrapSync = newSyncJob("bootstrap")
+
+// Startup sync steps, in the order they run
+var bootstrapSteps = []bootstrapStep{
+	{contactSync, PopulateContacts, ""},
+	{newSyncJob("lid_resync"), ResyncLIDsWithContacts, ""},
+	{newSyncJob("lid_fix"), FixLIDMappings, ""},
+	{participantSync, PopulateGroupParticipants, "WHATSAPP_SYNC_PARTICIPANTS"},
+}
+
+// Run the startup sync steps in the background so the API is available right away.
+// A failing step doesn't stop the ones after it.
+func startBootstrap(client *whatsmeow.Client, messageStore *MessageStore) {
+	bootstrapSync.start(func(j *syncJob) error {
+		j.setTotal(len(bootstrapSteps))
+
+		failed := 0
+		for _, step := range bootstrapSteps {
+			if step.setting != "" && !envBool(step.setting, true) {
+				j.advance(1)
+				continue
+			}
+			started, err := step.job.runAndWait(func(job *syncJob) error {
+				return step.run(client, messageStore, job)
+			})
+			if !started {
+				bridgeLog.Infof("Skipping %s sync, it is already running", step.job.Status().Name)
+			}
+			if err != nil {
+				failed++
+			}
+			j.advance(1)
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d of %d steps failed", failed, len(bootstrapSteps))
+		}
+		return nil
+	})
+}
+
+// BootstrapStatusResponse represents the response for the bootstrap status API
+type BootstrapStatusResponse struct {
+	Success bool         `json:"success"`
+	Status  SyncStatus   `json:"status"`
+	Steps   []SyncStatus `json:"steps"`
+}
+
+// Register the REST handler reporting the startup sync progress
+func registerBootstrapHandlers() {
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/sync/bootstrap",
+		Summary:  "Get the progress of the startup contact, LID and participant sync",
+		Tag:      "sync",
+		Scope:    ScopeReadMessages,
+		Response: BootstrapStatusResponse{},
+	})
+	http.HandleFunc("GET /api/sync/bootstrap", func(w http.ResponseWriter, r *http.Request) {
+		resp := BootstrapStatusResponse{Success: true, Status: bootstrapSync.Status()}
+		for _, step := range bootstrapSteps {
+			resp.Steps = append(resp.Steps, step.job.Status())
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
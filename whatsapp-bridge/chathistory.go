@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Limits of on-demand chat history syncs
+const (
+	defaultChatHistoryCount = 50
+	maxChatHistoryCount     = 1000
+	chatHistoryPageSize     = 50 // Messages asked for per request to the phone
+)
+
+// SyncChatHistoryRequest represents the request body for the chat history sync API
+type SyncChatHistoryRequest struct {
+	ChatJID       string `json:"chat_jid"`
+	Count         int    `json:"count,omitempty"`      // Older messages to fetch, or media messages with media_only; 50 by default
+	MediaOnly     bool   `json:"media_only,omitempty"` // Keep asking for older messages until count media messages arrived
+	MediaType     string `json:"media_type,omitempty"` // Only count media of this type (image, video, audio or document), implies media_only
+	Download      bool   `json:"download,omitempty"`   // Download the media of the fetched messages as they arrive
+	AllowViewOnce bool   `json:"allow_view_once,omitempty"`
+}
+
+// ChatHistoryProgress describes what an on-demand chat history sync fetched so far
+type ChatHistoryProgress struct {
+	Request          SyncChatHistoryRequest `json:"request"`
+	Requests         int                    `json:"requests"` // Requests sent to the phone
+	MessagesReceived int                    `json:"messages_received"`
+	MediaReceived    int                    `json:"media_received"` // Media messages matching the request
+	Exhausted        bool                   `json:"exhausted,omitempty"`
+	Files            []BulkMediaFile        `json:"files,omitempty"` // Downloaded media
+}
+
+// chatHistorySync pages back through the history of a chat on demand
+type chatHistorySync struct {
+	job      *syncJob
+	received chan []Message
+	mu       sync.Mutex
+	progress ChatHistoryProgress
+}
+
+// Get a snapshot of the sync's progress
+func (s *chatHistorySync) Progress() ChatHistoryProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.progress
+	p.Files = append([]BulkMediaFile{}, p.Files...)
+	return p
+}
+
+// On-demand history syncs by chat JID
+var (
+	chatHistoryMu    sync.Mutex
+	chatHistorySyncs = map[string]*chatHistorySync{}
+)
+
+// Get the on-demand history sync of a chat, creating it if create is set
+func chatHistoryFor(chatJID string, create bool) *chatHistorySync {
+	chatHistoryMu.Lock()
+	defer chatHistoryMu.Unlock()
+	s := chatHistorySyncs[chatJID]
+	if s == nil && create {
+		s = &chatHistorySync{job: newSyncJob("history " + chatJID), received: make(chan []Message, 16)}
+		chatHistorySyncs[chatJID] = s
+	}
+	return s
+}
+
+// Hand the messages stored from an on-demand history sync to the sync of
+// their chat waiting for them, if there is one
+func deliverChatHistory(chatJID string, messages []Message) {
+	s := chatHistoryFor(chatJID, false)
+	if s == nil || s.job.Status().State != SyncRunning {
+		return
+	}
+	select {
+	case s.received <- messages:
+	default:
+		bridgeLog.Warnf("Dropped on-demand history of %s, its sync isn't keeping up", chatJID)
+	}
+}
+
+// Check whether a message counts toward a media history request
+func (req SyncChatHistoryRequest) matchesMedia(m Message) bool {
+	if req.MediaType != "" {
+		return m.MediaType == req.MediaType
+	}
+	_, err := whatsmeowMediaType(m.MediaType)
+	return err == nil
+}
+
+// Ask the phone for older messages of a chat until the request is met, the
+// history ends or the phone stops answering
+func (s *chatHistorySync) run(client *whatsmeow.Client, messageStore *MessageStore, chat types.JID, req SyncChatHistoryRequest) error {
+	timeout := time.Duration(max(envInt("WHATSAPP_HISTORY_REQUEST_TIMEOUT_SECONDS", 60), 1)) * time.Second
+	maxRequests := max(envInt("WHATSAPP_HISTORY_MAX_REQUESTS", 20), 1)
+	// Drop answers to an earlier sync that came in too late
+	for len(s.received) > 0 {
+		<-s.received
+	}
+	s.job.setTotal(req.Count)
+	ctx := s.job.context()
+
+	found := 0
+	for found < req.Count {
+		if s.Progress().Requests >= maxRequests {
+			return fmt.Errorf("gave up after %d requests with %d of %d messages", maxRequests, found, req.Count)
+		}
+		count := req.Count - found
+		if req.MediaOnly {
+			count = chatHistoryPageSize
+		}
+		if err := requestHistorySync(ctx, client, messageStore, chat, min(count, chatHistoryPageSize)); err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.progress.Requests++
+		s.mu.Unlock()
+
+		var messages []Message
+		select {
+		case messages = <-s.received:
+		case <-ctx.Done():
+			return errJobStopped
+		case <-time.After(timeout):
+			return fmt.Errorf("the phone didn't answer within %s, it has to be online", timeout)
+		}
+		if len(messages) == 0 {
+			s.mu.Lock()
+			s.progress.Exhausted = true
+			s.mu.Unlock()
+			return nil
+		}
+
+		for _, m := range messages {
+			matches := !req.MediaOnly || req.matchesMedia(m)
+			if matches && found < req.Count {
+				found++
+				s.job.advance(1)
+			}
+			var file *BulkMediaFile
+			if matches && req.Download {
+				if _, err := whatsmeowMediaType(m.MediaType); err == nil {
+					f := downloadBulkFile(ctx, client, messageStore, m, req.AllowViewOnce)
+					file = &f
+				}
+			}
+			s.mu.Lock()
+			s.progress.MessagesReceived++
+			if matches && req.MediaOnly {
+				s.progress.MediaReceived++
+			}
+			if file != nil {
+				s.progress.Files = append(s.progress.Files, *file)
+			}
+			s.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// SyncChatHistoryResponse represents the response for the chat history sync APIs
+type SyncChatHistoryResponse struct {
+	Success  bool                `json:"success"`
+	Message  string              `json:"message,omitempty"`
+	Status   SyncStatus          `json:"status"`
+	Progress ChatHistoryProgress `json:"progress"`
+}
+
+// Register the REST handlers fetching older history of a chat on demand
+func registerChatHistoryHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	// Handler for starting an on-demand history sync
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/sync_chat_history",
+		Summary:  "Fetch older messages of a chat from the phone in the background, optionally until count media messages arrived and downloading their media, e.g. the last 200 photos of a group",
+		Tag:      "sync",
+		Scope:    ScopeReadMessages,
+		Audit:    true,
+		Request:  SyncChatHistoryRequest{},
+		Response: SyncChatHistoryResponse{},
+	})
+	http.HandleFunc("POST /api/sync_chat_history", func(w http.ResponseWriter, r *http.Request) {
+		var req SyncChatHistoryRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		chat, err := types.ParseJID(req.ChatJID)
+		if err != nil || chat.User == "" {
+			writeError(w, ErrCodeInvalidRequest, "A valid chat_jid is required", nil)
+			return
+		}
+		req.ChatJID = chat.String()
+		if req.Count <= 0 {
+			req.Count = defaultChatHistoryCount
+		}
+		if req.Count > maxChatHistoryCount {
+			writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("count must be at most %d", maxChatHistoryCount), nil)
+			return
+		}
+		if req.MediaType != "" {
+			if _, err := whatsmeowMediaType(req.MediaType); err != nil {
+				writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("Invalid media_type: %v", err), nil)
+				return
+			}
+			req.MediaOnly = true
+		}
+		if !client.IsConnected() {
+			writeError(w, ErrCodeNotConnected, "Not connected to WhatsApp", nil)
+			return
+		}
+
+		s := chatHistoryFor(req.ChatJID, true)
+		started := s.job.start(func(j *syncJob) error {
+			s.mu.Lock()
+			s.progress = ChatHistoryProgress{Request: req}
+			s.mu.Unlock()
+			return s.run(client, messageStore, chat, req)
+		})
+		if !started {
+			writeError(w, ErrCodeConflict, fmt.Sprintf("History of %s is already syncing", req.ChatJID), s.job.Status())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, SyncChatHistoryResponse{
+			Success:  true,
+			Message:  fmt.Sprintf("Fetching older history of %s", req.ChatJID),
+			Status:   s.job.Status(),
+			Progress: s.Progress(),
+		})
+	})
+
+	// Handler for following an on-demand history sync
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/sync_chat_history/{jid}",
+		Summary:  "Get the progress of the latest on-demand history sync of a chat",
+		Tag:      "sync",
+		Scope:    ScopeReadMessages,
+		Params:   []apiParam{{Name: "jid", In: "path", Description: "Chat JID", Required: true}},
+		Response: SyncChatHistoryResponse{},
+	})
+	http.HandleFunc("GET /api/sync_chat_history/{jid}", func(w http.ResponseWriter, r *http.Request) {
+		chatJID := r.PathValue("jid")
+		s := chatHistoryFor(chatJID, false)
+		if s == nil {
+			writeError(w, ErrCodeNotFound, fmt.Sprintf("No history sync was started for %s", chatJID), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, SyncChatHistoryResponse{Success: true, Status: s.job.Status(), Progress: s.Progress()})
+	})
+
+	// Handler for stopping an on-demand history sync
+	documentAPI(apiOperation{
+		Method:   http.MethodDelete,
+		Path:     "/api/sync_chat_history/{jid}",
+		Summary:  "Stop the running on-demand history sync of a chat, aborting the request or download in flight",
+		Tag:      "sync",
+		Scope:    ScopeReadMessages,
+		Audit:    true,
+		Params:   []apiParam{{Name: "jid", In: "path", Description: "Chat JID", Required: true}},
+		Response: SyncChatHistoryResponse{},
+	})
+	http.HandleFunc("DELETE /api/sync_chat_history/{jid}", func(w http.ResponseWriter, r *http.Request) {
+		chatJID := r.PathValue("jid")
+		s := chatHistoryFor(chatJID, false)
+		if s == nil || !s.job.stop() {
+			writeError(w, ErrCodeNotFound, fmt.Sprintf("No history sync is running for %s", chatJID), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, SyncChatHistoryResponse{Success: true, Message: "Stopping the sync", Status: s.job.Status(), Progress: s.Progress()})
+	})
+}
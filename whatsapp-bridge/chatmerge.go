@@ -0,0 +1,326 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Tables keyed by chat JID whose rows move along when chats are merged. Rows
+// that would collide with a row already under the canonical chat are dropped.
+var mergedChatTables = []string{
+	"messages", "media_retries", "watches", "reminders", "message_tags", "links", "extracted_events",
+	"message_archives", "archived_media", "pinned_messages", "mentions", "payments", "message_receipts",
+	"message_embeddings", "chat_freshness", "extracted_entities", "message_translations",
+	"live_locations", "group_events", "group_event_responses",
+}
+
+// SplitChat is a contact whose history is split between a LID chat and a
+// phone number chat
+type SplitChat struct {
+	LIDJID        string `json:"lid_jid"`
+	PhoneJID      string `json:"phone_jid"` // The canonical chat
+	LIDName       string `json:"lid_name,omitempty"`
+	PhoneName     string `json:"phone_name,omitempty"`
+	LIDMessages   int    `json:"lid_messages"`
+	PhoneMessages int    `json:"phone_messages"`
+}
+
+// ChatMerge records a merge of one chat into another
+type ChatMerge struct {
+	ID                int64     `json:"id"`
+	FromJID           string    `json:"from_jid"`
+	ToJID             string    `json:"to_jid"`
+	MessagesMoved     int64     `json:"messages_moved"`
+	DuplicatesDropped int64     `json:"duplicates_dropped"` // Messages stored under both chats
+	MergedAt          time.Time `json:"merged_at"`
+}
+
+// Find the chats stored both under a LID and under its phone number, through lid_map
+func (store *MessageStore) FindSplitChats() ([]SplitChat, error) {
+	rows, err := store.db.Query(
+		`SELECT m.lid, m.pn, COALESCE(l.name, ''), COALESCE(p.name, ''),
+			(SELECT COUNT(*) FROM messages WHERE chat_jid = m.lid), (SELECT COUNT(*) FROM messages WHERE chat_jid = m.pn)
+		FROM lid_map m JOIN chats l ON l.jid = m.lid JOIN chats p ON p.jid = m.pn
+		ORDER BY m.pn`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	splits := []SplitChat{}
+	for rows.Next() {
+		var s SplitChat
+		if err := rows.Scan(&s.LIDJID, &s.PhoneJID, &s.LIDName, &s.PhoneName, &s.LIDMessages, &s.PhoneMessages); err != nil {
+			return nil, err
+		}
+		splits = append(splits, s)
+	}
+	return splits, rows.Err()
+}
+
+// Move everything stored under a chat to another one and delete it, recording
+// the merge. The conversation segments of both chats are dropped to be
+// recomputed over the merged history.
+func (store *MessageStore) MergeChats(fromJID, toJID string) (*ChatMerge, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var fromName, toName sql.NullString
+	var fromLast, toLast sql.NullTime
+	if err := tx.QueryRow("SELECT name, last_message_time FROM chats WHERE jid = ?", fromJID).Scan(&fromName, &fromLast); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, newAPIError(ErrCodeNotFound, "chat %s not found", fromJID)
+		}
+		return nil, err
+	}
+	if err := tx.QueryRow("SELECT name, last_message_time FROM chats WHERE jid = ?", toJID).Scan(&toName, &toLast); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, newAPIError(ErrCodeNotFound, "chat %s not found", toJID)
+		}
+		return nil, err
+	}
+
+	merge := &ChatMerge{FromJID: fromJID, ToJID: toJID, MergedAt: time.Now()}
+	for _, table := range mergedChatTables {
+		result, err := tx.Exec("UPDATE OR IGNORE "+table+" SET chat_jid = ? WHERE chat_jid = ?", toJID, fromJID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to move %s: %v", table, err)
+		}
+		dropped, err := tx.Exec("DELETE FROM "+table+" WHERE chat_jid = ?", fromJID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to drop duplicate %s: %v", table, err)
+		}
+		if table == "messages" {
+			merge.MessagesMoved, _ = result.RowsAffected()
+			merge.DuplicatesDropped, _ = dropped.RowsAffected()
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM conversation_segments WHERE chat_jid IN (?, ?)", fromJID, toJID); err != nil {
+		return nil, err
+	}
+
+	// Keep the canonical chat's name unless it has none
+	name := toName.String
+	if name == "" {
+		name = fromName.String
+	}
+	last := toLast
+	if fromLast.Valid && (!last.Valid || fromLast.Time.After(last.Time)) {
+		last = fromLast
+	}
+	if _, err := tx.Exec("UPDATE chats SET name = ?, last_message_time = ? WHERE jid = ?", name, last, toJID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("DELETE FROM chats WHERE jid = ?", fromJID); err != nil {
+		return nil, err
+	}
+	if err := refreshChatFreshness(tx, toJID); err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec(
+		"INSERT INTO chat_merges (from_jid, to_jid, messages_moved, duplicates_dropped, merged_at) VALUES (?, ?, ?, ?, ?)",
+		fromJID, toJID, merge.MessagesMoved, merge.DuplicatesDropped, merge.MergedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	merge.ID, _ = result.LastInsertId()
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	moveChatMedia(fromJID, toJID)
+	return merge, nil
+}
+
+// Move the downloaded media of a merged chat to the canonical chat's
+// directory, so they aren't downloaded again. Files already there are kept.
+func moveChatMedia(fromJID, toJID string) {
+	fromDir, toDir := mediaDirForChat(fromJID), mediaDirForChat(toJID)
+	entries, err := os.ReadDir(fromDir)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(toDir, 0755); err != nil {
+		bridgeLog.Warnf("Failed to create media directory of %s: %v", toJID, err)
+		return
+	}
+	for _, entry := range entries {
+		target := filepath.Join(toDir, entry.Name())
+		if _, err := os.Stat(target); err == nil {
+			continue
+		}
+		if err := os.Rename(filepath.Join(fromDir, entry.Name()), target); err != nil {
+			bridgeLog.Warnf("Failed to move media %s of %s: %v", entry.Name(), fromJID, err)
+		}
+	}
+	os.Remove(fromDir)
+}
+
+// List recorded chat merges, latest first
+func (store *MessageStore) ListChatMerges(limit, offset int) ([]ChatMerge, error) {
+	rows, err := store.db.Query(
+		"SELECT id, from_jid, to_jid, messages_moved, duplicates_dropped, merged_at FROM chat_merges ORDER BY id DESC LIMIT ? OFFSET ?",
+		limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	merges := []ChatMerge{}
+	for rows.Next() {
+		var m ChatMerge
+		if err := rows.Scan(&m.ID, &m.FromJID, &m.ToJID, &m.MessagesMoved, &m.DuplicatesDropped, &m.MergedAt); err != nil {
+			return nil, err
+		}
+		merges = append(merges, m)
+	}
+	return merges, rows.Err()
+}
+
+// MergeChatsRequest represents the request body for the chat merge API
+type MergeChatsRequest struct {
+	LIDJID string `json:"lid_jid,omitempty"` // Merge only this LID chat into its phone number chat
+	All    bool   `json:"all,omitempty"`     // Merge every split chat found
+	DryRun bool   `json:"dry_run,omitempty"` // Only list what would be merged
+}
+
+// SplitChatsResponse represents the response for the split chats API
+type SplitChatsResponse struct {
+	Success bool        `json:"success"`
+	Chats   []SplitChat `json:"chats"`
+}
+
+// MergeChatsResponse represents the response for the chat merge API
+type MergeChatsResponse struct {
+	Success bool        `json:"success"`
+	Message string      `json:"message"`
+	Planned []SplitChat `json:"planned,omitempty"` // Chats a dry run would merge
+	Merges  []ChatMerge `json:"merges"`
+}
+
+// ListChatMergesResponse represents the response for the chat merge history API
+type ListChatMergesResponse struct {
+	Success bool        `json:"success"`
+	Merges  []ChatMerge `json:"merges"`
+	Page
+}
+
+// Register the admin REST handlers detecting and merging LID/phone split chats
+func registerChatMergeHandlers(messageStore *MessageStore) {
+	// Handler for finding split chats
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/admin/chats/split",
+		Summary:  "List contacts whose history is split between a LID chat and a phone number chat",
+		Tag:      "admin",
+		Scope:    ScopeAdmin,
+		Response: SplitChatsResponse{},
+	})
+	http.HandleFunc("GET /api/admin/chats/split", func(w http.ResponseWriter, r *http.Request) {
+		splits, err := messageStore.FindSplitChats()
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to find split chats: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, SplitChatsResponse{Success: true, Chats: splits})
+	})
+
+	// Handler for merging split chats
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/admin/chats/merge",
+		Summary:  "Merge LID chats into the phone number chats of the same contacts: one given by lid_jid, or all of them",
+		Tag:      "admin",
+		Scope:    ScopeAdmin,
+		Audit:    true,
+		Request:  MergeChatsRequest{},
+		Response: MergeChatsResponse{},
+	})
+	http.HandleFunc("POST /api/admin/chats/merge", func(w http.ResponseWriter, r *http.Request) {
+		var req MergeChatsRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if (req.LIDJID == "") == !req.All {
+			writeError(w, ErrCodeInvalidRequest, "Give either lid_jid or all", nil)
+			return
+		}
+		splits, err := messageStore.FindSplitChats()
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to find split chats: %v", err), nil)
+			return
+		}
+		if req.LIDJID != "" {
+			var selected []SplitChat
+			for _, s := range splits {
+				if s.LIDJID == req.LIDJID {
+					selected = append(selected, s)
+				}
+			}
+			if len(selected) == 0 {
+				writeError(w, ErrCodeNotFound, fmt.Sprintf("%s isn't a LID chat with a separate phone number chat", req.LIDJID), nil)
+				return
+			}
+			splits = selected
+		}
+
+		if req.DryRun {
+			writeJSON(w, http.StatusOK, MergeChatsResponse{
+				Success: true,
+				Message: fmt.Sprintf("%d chats would be merged", len(splits)),
+				Planned: splits,
+				Merges:  []ChatMerge{},
+			})
+			return
+		}
+		merges := []ChatMerge{}
+		for _, s := range splits {
+			merge, err := messageStore.MergeChats(s.LIDJID, s.PhoneJID)
+			if err != nil {
+				writeAPIError(w, fmt.Sprintf("Failed to merge %s into %s after %d merges", s.LIDJID, s.PhoneJID, len(merges)), err)
+				return
+			}
+			bridgeLog.Infof("Merged chat %s into %s: %d messages moved, %d duplicates dropped",
+				s.LIDJID, s.PhoneJID, merge.MessagesMoved, merge.DuplicatesDropped)
+			merges = append(merges, *merge)
+		}
+		writeJSON(w, http.StatusOK, MergeChatsResponse{Success: true, Message: fmt.Sprintf("%d chats merged", len(merges)), Merges: merges})
+	})
+
+	// Handler for the merge history
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/admin/chats/merges",
+		Summary: "List past chat merges, latest first",
+		Tag:     "admin",
+		Scope:   ScopeAdmin,
+		Params: []apiParam{
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ListChatMergesResponse{},
+	})
+	http.HandleFunc("GET /api/admin/chats/merges", func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		merges, err := messageStore.ListChatMerges(limit+1, offset)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list chat merges: %v", err), nil)
+			return
+		}
+		merges, page := trimPage(merges, offset, limit)
+		writeJSON(w, http.StatusOK, ListChatMergesResponse{Success: true, Merges: merges, Page: page})
+	})
+}
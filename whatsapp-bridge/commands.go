@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/appstate"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// When the bridge started, reported by /status
+var bridgeStartTime = time.Now()
+
+// commandContext gives self-chat commands access to the bridge
+type commandContext struct {
+	client       *whatsmeow.Client
+	messageStore *MessageStore
+}
+
+// selfCommand is a command the account owner can type in their "message yourself" chat
+type selfCommand struct {
+	Name        string // Without the leading slash
+	Usage       string // Arguments, e.g. "<chat> [hours]"
+	Description string
+	Run         func(cc *commandContext, args []string) (string, error)
+}
+
+// All self-chat commands by name, filled in by the register*Commands functions
+var selfCommands = map[string]selfCommand{}
+
+// Make commands available in the self-chat
+func registerSelfCommand(cmds ...selfCommand) {
+	for _, cmd := range cmds {
+		selfCommands[cmd.Name] = cmd
+	}
+}
+
+// Run a command typed in the self-chat and answer in the chat. Returns false if
+// the message wasn't a command.
+func handleSelfCommand(client *whatsmeow.Client, messageStore *MessageStore, content string) bool {
+	fields := strings.Fields(content)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return false
+	}
+
+	name := strings.ToLower(strings.TrimPrefix(fields[0], "/"))
+	cmd, ok := selfCommands[name]
+	var reply string
+	if !ok {
+		reply = fmt.Sprintf("Unknown command /%s, send /help for a list of commands", name)
+	} else {
+		out, err := cmd.Run(&commandContext{client: client, messageStore: messageStore}, fields[1:])
+		if err != nil {
+			reply = fmt.Sprintf("/%s failed: %v", name, err)
+		} else {
+			reply = out
+		}
+	}
+
+	if err := sendSelfMessage(context.Background(), client, reply); err != nil {
+		bridgeLog.Warnf("Failed to reply to /%s: %v", name, err)
+	}
+	return true
+}
+
+// Look up a chat's name for command replies
+func (store *MessageStore) chatName(jid string) string {
+	var name sql.NullString
+	store.db.QueryRow("SELECT name FROM chats WHERE jid = ?", jid).Scan(&name)
+	if name.String == "" {
+		return jid
+	}
+	return name.String
+}
+
+// Find a chat by JID, phone number or (part of its) name
+func resolveChat(messageStore *MessageStore, query string) (types.JID, string, error) {
+	if strings.Contains(query, "@") {
+		jid, err := types.ParseJID(query)
+		if err != nil {
+			return types.JID{}, "", fmt.Errorf("invalid JID %s: %v", query, err)
+		}
+		return jid, messageStore.chatName(jid.String()), nil
+	}
+	if _, err := strconv.ParseUint(query, 10, 64); err == nil {
+		jid := types.NewJID(query, types.DefaultUserServer)
+		return jid, messageStore.chatName(jid.String()), nil
+	}
+
+	chats, err := messageStore.ListChats(query, 10, 0)
+	if err != nil {
+		return types.JID{}, "", err
+	}
+	var matches []ChatSummary
+	for _, chat := range chats {
+		if strings.EqualFold(chat.Name, query) {
+			matches = []ChatSummary{chat}
+			break
+		}
+		matches = append(matches, chat)
+	}
+
+	switch len(matches) {
+	case 0:
+		return types.JID{}, "", fmt.Errorf("no chat matches %q", query)
+	case 1:
+		jid, err := types.ParseJID(matches[0].JID)
+		return jid, matches[0].Name, err
+	default:
+		names := make([]string, len(matches))
+		for i, chat := range matches {
+			names[i] = fmt.Sprintf("%s (%s)", chat.Name, chat.JID)
+		}
+		return types.JID{}, "", fmt.Errorf("%q matches several chats: %s", query, strings.Join(names, ", "))
+	}
+}
+
+// Count the stored chats and messages
+func (store *MessageStore) CountChatsAndMessages() (chats, messages int, err error) {
+	err = store.db.QueryRow("SELECT (SELECT COUNT(*) FROM chats), (SELECT COUNT(*) FROM messages)").Scan(&chats, &messages)
+	return chats, messages, err
+}
+
+// SenderActivity is the number of messages a sender wrote in a chat
+type SenderActivity struct {
+	Sender string
+	Name   string
+	Count  int
+}
+
+// Count the messages per sender in a chat since a point in time, most active first
+func (store *MessageStore) ChatActivity(chatJID string, since time.Time) ([]SenderActivity, error) {
+	rows, err := store.db.Query(
+		`SELECT m.sender, COALESCE(c.name, ''), COUNT(*) FROM messages m
+		LEFT JOIN chats c ON c.jid = m.sender || '@s.whatsapp.net'
+		WHERE m.chat_jid = ? AND m.timestamp > ?
+		GROUP BY m.sender ORDER BY COUNT(*) DESC`,
+		chatJID, since.Local(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var activity []SenderActivity
+	for rows.Next() {
+		var a SenderActivity
+		if err := rows.Scan(&a.Sender, &a.Name, &a.Count); err != nil {
+			return nil, err
+		}
+		activity = append(activity, a)
+	}
+	return activity, rows.Err()
+}
+
+// Shorten text for a one-line preview
+func truncateText(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len([]rune(s)) > n {
+		return string([]rune(s)[:n]) + "…"
+	}
+	return s
+}
+
+// /status reports the connection and store state
+func statusCommand(cc *commandContext, args []string) (string, error) {
+	chats, messages, err := cc.messageStore.CountChatsAndMessages()
+	if err != nil {
+		return "", err
+	}
+	pending, err := cc.messageStore.CountOutbox(OutboxPending)
+	if err != nil {
+		return "", err
+	}
+
+	account := "not logged in"
+	if cc.client.Store.ID != nil {
+		account = cc.client.Store.ID.ToNonAD().String()
+	}
+	status := fmt.Sprintf("Connected: %t\nAccount: %s\nUptime: %s\nChats: %d\nMessages: %d\nPending approvals: %d",
+		cc.client.IsConnected(), account, time.Since(bridgeStartTime).Round(time.Second), chats, messages, pending)
+	if historyQueue != nil {
+		if stats := historyQueue.stats(); stats.Pending+stats.Active > 0 {
+			status += fmt.Sprintf("\nHistory sync: %d batches pending, %d in progress", stats.Pending, stats.Active)
+		}
+	}
+	return status, nil
+}
+
+// /mute and /unmute change the mute setting of a chat on all linked devices
+func muteCommand(mute bool) func(cc *commandContext, args []string) (string, error) {
+	return func(cc *commandContext, args []string) (string, error) {
+		if len(args) == 0 {
+			return "", fmt.Errorf("a chat is required")
+		}
+
+		// An optional trailing number of hours limits the mute, muting forever otherwise
+		var duration time.Duration
+		if mute && len(args) > 1 {
+			if hours, err := strconv.Atoi(args[len(args)-1]); err == nil && hours > 0 {
+				duration = time.Duration(hours) * time.Hour
+				args = args[:len(args)-1]
+			}
+		}
+
+		jid, name, err := resolveChat(cc.messageStore, strings.Join(args, " "))
+		if err != nil {
+			return "", err
+		}
+		payload := map[string]interface{}{"chat_jid": jid.String(), "muted": mute, "duration": duration.String()}
+		err = journal(cc.messageStore, OpKindMute, jid.String(), payload, func() error {
+			return throttle(opAppState, func() error {
+				ctx, cancel := callContext(context.Background(), callQuery)
+				defer cancel()
+				return cc.client.SendAppState(ctx, appstate.BuildMute(jid, mute, duration))
+			})
+		})
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case !mute:
+			return fmt.Sprintf("Unmuted %s", name), nil
+		case duration > 0:
+			return fmt.Sprintf("Muted %s for %s", name, duration), nil
+		default:
+			return fmt.Sprintf("Muted %s", name), nil
+		}
+	}
+}
+
+// /summary describes the recent activity in a chat
+func summaryCommand(cc *commandContext, args []string) (string, error) {
+	if len(args) == 0 {
+		return "", fmt.Errorf("a chat is required")
+	}
+
+	hours := 24
+	if len(args) > 1 {
+		if h, err := strconv.Atoi(args[len(args)-1]); err == nil && h > 0 {
+			hours = h
+			args = args[:len(args)-1]
+		}
+	}
+
+	jid, name, err := resolveChat(cc.messageStore, strings.Join(args, " "))
+	if err != nil {
+		return "", err
+	}
+	since := time.Now().Add(-time.Duration(hours) * time.Hour)
+
+	activity, err := cc.messageStore.ChatActivity(jid.String(), since)
+	if err != nil {
+		return "", err
+	}
+	if len(activity) == 0 {
+		return fmt.Sprintf("No messages in %s in the last %d hours", name, hours), nil
+	}
+
+	total := 0
+	names := map[string]string{}
+	for _, a := range activity {
+		total += a.Count
+		names[a.Sender] = a.Sender
+		if a.Name != "" {
+			names[a.Sender] = a.Name
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s, last %d hours: %d messages from %d senders\n", name, hours, total, len(activity))
+	for _, a := range activity[:min(len(activity), 5)] {
+		fmt.Fprintf(&b, "• %s: %d\n", names[a.Sender], a.Count)
+	}
+
+	recent, err := cc.messageStore.QueryMessages(MessageFilter{ChatJID: jid.String(), After: &since, Limit: 5})
+	if err != nil {
+		return "", err
+	}
+	b.WriteString("\nLatest:\n")
+	for i := len(recent) - 1; i >= 0; i-- {
+		m := recent[i]
+		text := m.Content
+		if m.MediaType != "" {
+			text = fmt.Sprintf("[%s] %s", m.MediaType, text)
+		}
+		fmt.Fprintf(&b, "%s %s: %s\n", m.Time.Format("15:04"), names[m.Sender], truncateText(text, 80))
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// /help lists the available commands
+func helpCommand(cc *commandContext, args []string) (string, error) {
+	names := make([]string, 0, len(selfCommands))
+	for name := range selfCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("Commands:")
+	for _, name := range names {
+		cmd := selfCommands[name]
+		fmt.Fprintf(&b, "\n/%s", cmd.Name)
+		if cmd.Usage != "" {
+			fmt.Fprintf(&b, " %s", cmd.Usage)
+		}
+		fmt.Fprintf(&b, " - %s", cmd.Description)
+	}
+	return b.String(), nil
+}
+
+// Register the built-in self-chat commands
+func registerSelfCommands() {
+	registerSelfCommand(
+		selfCommand{Name: "help", Description: "List the available commands", Run: helpCommand},
+		selfCommand{Name: "status", Description: "Show the connection and store status", Run: statusCommand},
+		selfCommand{Name: "mute", Usage: "<chat> [hours]", Description: "Mute a chat, forever unless hours are given", Run: muteCommand(true)},
+		selfCommand{Name: "unmute", Usage: "<chat>", Description: "Unmute a chat", Run: muteCommand(false)},
+		selfCommand{Name: "summary", Usage: "<chat> [hours]", Description: "Summarize a chat's activity, the last 24 hours by default", Run: summaryCommand},
+	)
+}
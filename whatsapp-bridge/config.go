@@ -0,0 +1,297 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Settings come from the environment, then from the config file, then from
+// defaults. Nested keys of the config file map to the environment variable of
+// the same name, so log.level sets WHATSAPP_LOG_LEVEL.
+var (
+	settingsMu   sync.Mutex
+	fileSettings = map[string]string{}
+	usedSettings = map[string]string{} // Settings read so far and their defaults
+	configPath   string
+)
+
+// Load the config file named by WHATSAPP_CONFIG, or config.yaml in the data
+// directory if it exists.
+// JSON files are read as well, being valid YAML.
+func loadConfigFile() error {
+	path, explicit := os.LookupEnv("WHATSAPP_CONFIG")
+	if !explicit {
+		path = "config.yaml"
+	}
+	path = dataPath(path)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && !explicit {
+			return nil
+		}
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+	settings := map[string]string{}
+	flattenSettings("", doc, settings)
+
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	fileSettings, configPath = settings, path
+	return nil
+}
+
+// Flatten a config file section into settings named like environment variables
+func flattenSettings(prefix string, section map[string]interface{}, settings map[string]string) {
+	for key, value := range section {
+		name := strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(key))
+		if prefix != "" {
+			name = prefix + "_" + name
+		} else if !strings.HasPrefix(name, "WHATSAPP_") {
+			name = "WHATSAPP_" + name
+		}
+
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flattenSettings(name, v, settings)
+		case []interface{}:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			settings[name] = strings.Join(items, ",")
+		case nil:
+			settings[name] = ""
+		default:
+			settings[name] = fmt.Sprint(v)
+		}
+	}
+}
+
+// Look up a setting in the environment, then in the config file
+func lookupSetting(key, def string) (string, bool) {
+	settingsMu.Lock()
+	usedSettings[key] = def
+	fromFile, inFile := fileSettings[key]
+	settingsMu.Unlock()
+
+	if v, ok := os.LookupEnv(key); ok {
+		return v, true
+	}
+	return fromFile, inFile
+}
+
+// Get a string setting, falling back to a default
+func envString(key, def string) string {
+	if v, ok := lookupSetting(key, def); ok {
+		return strings.TrimSpace(v)
+	}
+	return def
+}
+
+// Get a comma separated list setting
+func envList(key string, def []string) []string {
+	v, ok := lookupSetting(key, strings.Join(def, ","))
+	if !ok {
+		return def
+	}
+	return splitList(v)
+}
+
+// Split a comma-separated list, dropping empty items
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Get an integer setting, ignoring unparsable values
+func envInt(key string, def int) int {
+	if n, err := strconv.Atoi(envString(key, strconv.Itoa(def))); err == nil {
+		return n
+	}
+	return def
+}
+
+// Get a decimal setting, ignoring unparsable values
+func envFloat(key string, def float64) float64 {
+	if f, err := strconv.ParseFloat(envString(key, strconv.FormatFloat(def, 'g', -1, 64)), 64); err == nil {
+		return f
+	}
+	return def
+}
+
+// Get a boolean setting, ignoring unparsable values
+func envBool(key string, def bool) bool {
+	if b, err := strconv.ParseBool(envString(key, strconv.FormatBool(def))); err == nil {
+		return b
+	}
+	return def
+}
+
+// Setting is the effective value of a setting and where it came from
+type Setting struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Source  string `json:"source"` // env, file or default
+	Default string `json:"default,omitempty"`
+}
+
+// Whether a setting holds a credential that must not be shown. Webhook URLs
+// count, as they often carry their token in the path or query.
+func isSecretSetting(key string) bool {
+	for _, word := range []string{"KEY", "TOKEN", "SECRET", "PASSWORD"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return strings.HasSuffix(key, "_WEBHOOK_URL")
+}
+
+// List the settings in the config file and those read so far, with secrets redacted
+func effectiveSettings() []Setting {
+	settingsMu.Lock()
+	keys := map[string]string{}
+	for key := range fileSettings {
+		keys[key] = ""
+	}
+	for key, def := range usedSettings {
+		keys[key] = def
+	}
+	fromFile := make(map[string]string, len(fileSettings))
+	for key, value := range fileSettings {
+		fromFile[key] = value
+	}
+	settingsMu.Unlock()
+
+	settings := make([]Setting, 0, len(keys))
+	for key, def := range keys {
+		setting := Setting{Key: key, Value: def, Source: "default", Default: def}
+		if v, ok := os.LookupEnv(key); ok {
+			setting.Value, setting.Source = v, "env"
+		} else if v, ok := fromFile[key]; ok {
+			setting.Value, setting.Source = v, "file"
+		}
+		if isSecretSetting(key) && setting.Value != "" {
+			setting.Value = "[redacted]"
+		} else if u, err := url.Parse(setting.Value); err == nil && u.User != nil {
+			// Database URLs carry their password
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), "redacted")
+				setting.Value = u.String()
+			}
+		}
+		settings = append(settings, setting)
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].Key < settings[j].Key })
+	return settings
+}
+
+// ConfigResponse represents the response for the config API
+type ConfigResponse struct {
+	Success  bool      `json:"success"`
+	File     string    `json:"file,omitempty"`
+	Settings []Setting `json:"settings"`
+}
+
+// Register the REST handler showing the effective settings
+func registerConfigHandlers() {
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/config",
+		Summary:  "Get the effective settings and whether they come from the environment, the config file or defaults, with secrets redacted",
+		Tag:      "admin",
+		Scope:    ScopeAdmin,
+		Response: ConfigResponse{},
+	})
+	http.HandleFunc("GET /api/config", func(w http.ResponseWriter, r *http.Request) {
+		settingsMu.Lock()
+		file := configPath
+		settingsMu.Unlock()
+		writeJSON(w, http.StatusOK, ConfigResponse{Success: true, File: file, Settings: effectiveSettings()})
+	})
+}
+
+// Root directory of everything the bridge keeps on disk, so a container needs a
+// single volume. Relative paths in settings are resolved against it.
+func dataDir() string {
+	return envString("WHATSAPP_DATA_DIR", ".")
+}
+
+// Resolve a path against the data directory unless it is absolute
+func dataPath(path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dataDir(), path)
+}
+
+// Get the SQL dialect and address of the WhatsApp session database, SQLite in
+// the store directory unless WHATSAPP_SESSION_DB holds a PostgreSQL URL. Any
+// other value is refused rather than ignored. The message store stays in
+// SQLite, which the MCP server reads directly.
+func sessionDatabase() (dialect, address string, err error) {
+	url := envString("WHATSAPP_SESSION_DB", "")
+	switch {
+	case url == "":
+		return "sqlite3", "file:" + filepath.Join(storeDir(), "whatsapp.db") + "?_foreign_keys=on", nil
+	case strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://"):
+		return "postgres", url, nil
+	}
+	return "", "", fmt.Errorf("WHATSAPP_SESSION_DB must be a postgres:// or postgresql:// URL, or unset for SQLite")
+}
+
+// Directory holding the databases, downloaded media and archives
+func storeDir() string {
+	return dataPath(envString("WHATSAPP_STORE_DIR", "store"))
+}
+
+// CORSConfig controls which browser origins may call the REST API
+type CORSConfig struct {
+	AllowedOrigins []string // "*" allows any origin, empty disables CORS
+	AllowedMethods []string
+	AllowedHeaders []string
+	MaxAge         int // Seconds browsers may cache preflight results
+}
+
+// Load the CORS settings from the environment
+func loadCORSConfig() CORSConfig {
+	return CORSConfig{
+		AllowedOrigins: envList("WHATSAPP_CORS_ORIGINS", nil),
+		AllowedMethods: envList("WHATSAPP_CORS_METHODS", []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}),
+		AllowedHeaders: envList("WHATSAPP_CORS_HEADERS", []string{"Content-Type", "Authorization"}),
+		MaxAge:         envInt("WHATSAPP_CORS_MAX_AGE", 600),
+	}
+}
+
+// ApprovalConfig controls which outbound messages wait in the outbox for a human
+// to approve them before they are delivered
+type ApprovalConfig struct {
+	Recipients []string // Phone numbers or JIDs whose messages need approval, "*" for all
+	Notify     bool     // Announce queued messages in the owner's self-chat
+}
+
+// Load the approval settings from the environment
+func loadApprovalConfig() ApprovalConfig {
+	return ApprovalConfig{
+		Recipients: envList("WHATSAPP_APPROVAL_RECIPIENTS", nil),
+		Notify:     envBool("WHATSAPP_APPROVAL_NOTIFY", true),
+	}
+}
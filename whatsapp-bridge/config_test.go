@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestSessionDatabase(t *testing.T) {
+	for url, want := range map[string]string{
+		"":                              "sqlite3",
+		"postgres://bridge@db/whatsapp": "postgres",
+		"postgresql://db/whatsapp":      "postgres",
+		"mysql://db/whatsapp":           "",
+		"/var/lib/whatsapp.db":          "",
+	} {
+		t.Setenv("WHATSAPP_SESSION_DB", url)
+		dialect, _, err := sessionDatabase()
+		if dialect != want || (err == nil) != (want != "") {
+			t.Errorf("WHATSAPP_SESSION_DB=%q gives %q, %v, want %q", url, dialect, err, want)
+		}
+	}
+}
+
+func TestSecretSettings(t *testing.T) {
+	for key, want := range map[string]bool{
+		"WHATSAPP_API_TOKEN":                 true,
+		"WHATSAPP_S3_SECRET_KEY":             true,
+		"WHATSAPP_REMINDER_WEBHOOK_URL":      true,
+		"WHATSAPP_MENTIONS_WEBHOOK_URL":      true,
+		"WHATSAPP_CONTACT_DATES_WEBHOOK_URL": true,
+		"WHATSAPP_PORT":                      false,
+		"WHATSAPP_EMBEDDINGS_URL":            false,
+	} {
+		if got := isSecretSetting(key); got != want {
+			t.Errorf("isSecretSetting(%s) = %v, want %v", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Most contacts shared in one message
+const maxSharedContacts = 50
+
+// ContactPhone is a phone number of a contact card
+type ContactPhone struct {
+	Number   string `json:"number"`             // International format, like +39 333 1234567
+	Type     string `json:"type,omitempty"`     // cell (default), home, work, ...
+	WhatsApp *bool  `json:"whatsapp,omitempty"` // Link the number to its WhatsApp account, true by default
+}
+
+// ContactEmail is an email address of a contact card
+type ContactEmail struct {
+	Address string `json:"address"`
+	Type    string `json:"type,omitempty"` // home, work, ...
+}
+
+// ContactCard is a contact to share, turned into a vCard
+type ContactCard struct {
+	Name         string         `json:"name,omitempty"` // Shown name, from the first and last name if empty
+	FirstName    string         `json:"first_name,omitempty"`
+	LastName     string         `json:"last_name,omitempty"`
+	Phones       []ContactPhone `json:"phones,omitempty"`
+	Emails       []ContactEmail `json:"emails,omitempty"`
+	Organization string         `json:"organization,omitempty"`
+	JobTitle     string         `json:"job_title,omitempty"`
+	URL          string         `json:"url,omitempty"`
+	Birthday     string         `json:"birthday,omitempty"` // YYYY-MM-DD, or MM-DD if the year is unknown
+	Note         string         `json:"note,omitempty"`
+}
+
+// Escape a vCard text value
+var vcardEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`)
+
+// Keep the letters of a vCard parameter value, like a phone type
+func vcardParam(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r == '-' {
+			return r
+		}
+		return -1
+	}, value)
+}
+
+// Get the shown name of a contact card
+func (c ContactCard) displayName() string {
+	if name := strings.TrimSpace(c.Name); name != "" {
+		return name
+	}
+	return strings.TrimSpace(c.FirstName + " " + c.LastName)
+}
+
+// Build the vCard of a contact card, with the waid parameter WhatsApp
+// clients use to offer messaging the contact
+func (c ContactCard) VCard() (string, error) {
+	name := c.displayName()
+	if name == "" {
+		return "", newAPIError(ErrCodeInvalidRequest, "A contact needs a name, or a first or last name")
+	}
+	if len(c.Phones) == 0 && len(c.Emails) == 0 {
+		return "", newAPIError(ErrCodeInvalidRequest, "Contact %s needs a phone number or an email address", name)
+	}
+
+	var b strings.Builder
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&b, format+"\r\n", args...)
+	}
+	line("BEGIN:VCARD")
+	line("VERSION:3.0")
+	line("N:%s;%s;;;", vcardEscaper.Replace(c.LastName), vcardEscaper.Replace(c.FirstName))
+	line("FN:%s", vcardEscaper.Replace(name))
+	if c.Organization != "" {
+		line("ORG:%s;", vcardEscaper.Replace(c.Organization))
+	}
+	if c.JobTitle != "" {
+		line("TITLE:%s", vcardEscaper.Replace(c.JobTitle))
+	}
+	for _, p := range c.Phones {
+		digits := strings.Map(func(r rune) rune {
+			if r >= '0' && r <= '9' {
+				return r
+			}
+			return -1
+		}, p.Number)
+		if len(digits) < minPhoneDigits {
+			return "", newAPIError(ErrCodeInvalidRequest, "Invalid phone number %q of contact %s", p.Number, name)
+		}
+		typ := vcardParam(p.Type)
+		if typ == "" {
+			typ = "CELL"
+		}
+		params := fmt.Sprintf(";type=%s;type=VOICE", strings.ToUpper(typ))
+		if p.WhatsApp == nil || *p.WhatsApp {
+			params += ";waid=" + digits
+		}
+		line("TEL%s:%s", params, vcardEscaper.Replace(strings.TrimSpace(p.Number)))
+	}
+	for _, e := range c.Emails {
+		if !strings.Contains(e.Address, "@") {
+			return "", newAPIError(ErrCodeInvalidRequest, "Invalid email address %q of contact %s", e.Address, name)
+		}
+		params := ";type=INTERNET"
+		if typ := vcardParam(e.Type); typ != "" {
+			params += ";type=" + strings.ToUpper(typ)
+		}
+		line("EMAIL%s:%s", params, vcardEscaper.Replace(strings.TrimSpace(e.Address)))
+	}
+	if c.URL != "" {
+		line("URL:%s", vcardEscaper.Replace(c.URL))
+	}
+	if c.Birthday != "" {
+		year, month, day, ok := parseContactDate(c.Birthday)
+		if !ok {
+			return "", newAPIError(ErrCodeInvalidRequest, "birthday of contact %s must be YYYY-MM-DD or MM-DD", name)
+		}
+		if year > 0 {
+			line("BDAY:%04d-%02d-%02d", year, month, day)
+		} else {
+			line("BDAY:--%02d%02d", month, day)
+		}
+	}
+	if c.Note != "" {
+		line("NOTE:%s", vcardEscaper.Replace(c.Note))
+	}
+	line("END:VCARD")
+	return b.String(), nil
+}
+
+// SendContactRequest represents the request body for the send contact API
+type SendContactRequest struct {
+	Recipient   string        `json:"recipient"`
+	Contact     *ContactCard  `json:"contact,omitempty"`      // Built into a vCard
+	Contacts    []ContactCard `json:"contacts,omitempty"`     // Several contacts shared in one message, instead of contact
+	VCard       string        `json:"vcard,omitempty"`        // A ready vCard, instead of contact
+	DisplayName string        `json:"display_name,omitempty"` // Name shown for a ready vCard or several contacts
+}
+
+// Build the contact message of a contact card
+func (c ContactCard) toContactMessage() (*waProto.ContactMessage, error) {
+	vcard, err := c.VCard()
+	if err != nil {
+		return nil, err
+	}
+	return &waProto.ContactMessage{DisplayName: proto.String(c.displayName()), Vcard: proto.String(vcard)}, nil
+}
+
+// Build the contact message of a request, a contacts array message when it
+// shares several contacts
+func (req SendContactRequest) toMessage() (*waProto.Message, error) {
+	given := 0
+	for _, set := range []bool{req.Contact != nil, len(req.Contacts) > 0, req.VCard != ""} {
+		if set {
+			given++
+		}
+	}
+	switch {
+	case given > 1:
+		return nil, newAPIError(ErrCodeInvalidRequest, "Give only one of contact, contacts and vcard")
+	case len(req.Contacts) > maxSharedContacts:
+		return nil, newAPIError(ErrCodeInvalidRequest, "At most %d contacts can be shared in one message", maxSharedContacts)
+	case len(req.Contacts) == 1:
+		req.Contact = &req.Contacts[0]
+	case len(req.Contacts) > 1:
+		contacts := make([]*waProto.ContactMessage, len(req.Contacts))
+		for i, c := range req.Contacts {
+			contact, err := c.toContactMessage()
+			if err != nil {
+				return nil, err
+			}
+			contacts[i] = contact
+		}
+		displayName := req.DisplayName
+		if displayName == "" {
+			displayName = fmt.Sprintf("%d contacts", len(contacts))
+		}
+		return &waProto.Message{ContactsArrayMessage: &waProto.ContactsArrayMessage{
+			DisplayName: proto.String(displayName),
+			Contacts:    contacts,
+		}}, nil
+	}
+
+	switch {
+	case req.Contact != nil:
+		contact, err := req.Contact.toContactMessage()
+		if err != nil {
+			return nil, err
+		}
+		return &waProto.Message{ContactMessage: contact}, nil
+	case strings.Contains(strings.ToUpper(req.VCard), "BEGIN:VCARD"):
+		if req.DisplayName == "" {
+			return nil, newAPIError(ErrCodeInvalidRequest, "display_name is required with a vcard")
+		}
+		return &waProto.Message{ContactMessage: &waProto.ContactMessage{
+			DisplayName: proto.String(req.DisplayName),
+			Vcard:       proto.String(req.VCard),
+		}}, nil
+	case req.VCard != "":
+		return nil, newAPIError(ErrCodeInvalidRequest, "vcard is not a vCard")
+	}
+	return nil, newAPIError(ErrCodeInvalidRequest, "A contact, contacts or vcard is required")
+}
+
+// Register the REST handler sending contact cards
+func registerContactCardHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/send/contact",
+		Summary:  "Send a contact card, or several in one message, built from structured name, phone, email and organization fields or given as a ready vCard; phone numbers are linked to their WhatsApp accounts",
+		Tag:      "messages",
+		Scope:    ScopeSendMessages,
+		Audit:    true,
+		Request:  SendContactRequest{},
+		Response: SendInteractiveResponse{},
+	})
+	http.HandleFunc("POST /api/send/contact", func(w http.ResponseWriter, r *http.Request) {
+		var req SendContactRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if req.Recipient == "" {
+			writeError(w, ErrCodeInvalidRequest, "Recipient is required", nil)
+			return
+		}
+		msg, err := req.toMessage()
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		id, err := sendInteractiveMessage(r.Context(), client, messageStore, req.Recipient, msg)
+		if err != nil {
+			writeAPIError(w, "Failed to send contact", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, SendInteractiveResponse{Success: true, Message: fmt.Sprintf("Contact sent to %s", req.Recipient), MessageID: id})
+	})
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Kinds of contact dates
+const (
+	dateBirthday    = "birthday"
+	dateAnniversary = "anniversary"
+)
+
+// Where a contact date came from, by how much it is trusted: a date is only
+// replaced by one from an equally or more trusted source
+var contactDateSources = map[string]int{
+	"greeting": 0, // I wished them a happy birthday that day
+	"message":  1, // They told their birthday in a message
+	"vcard":    2, // A shared contact card
+	"manual":   3, // Set through the API
+}
+
+// How often the contact date worker looks for upcoming dates
+const contactDateCheckInterval = time.Hour
+
+// ContactDate is a yearly date of a contact, like their birthday
+type ContactDate struct {
+	ID         int64     `json:"id"`
+	ContactJID string    `json:"contact_jid"`
+	Name       string    `json:"name,omitempty"`
+	Kind       string    `json:"kind"` // birthday or anniversary
+	Month      int       `json:"month"`
+	Day        int       `json:"day"`
+	Year       int       `json:"year,omitempty"` // 0 if unknown
+	Label      string    `json:"label,omitempty"`
+	Source     string    `json:"source"`               // manual, vcard, message or greeting
+	MessageID  string    `json:"message_id,omitempty"` // Message it was found in
+	ChatJID    string    `json:"chat_jid,omitempty"`
+	Next       string    `json:"next"`       // Next occurrence, YYYY-MM-DD
+	DaysUntil  int       `json:"days_until"` // 0 if it is today
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Get the next occurrence of a yearly date on or after a day. February 29
+// falls on February 28 in other years.
+func nextOccurrence(month, day int, from time.Time) time.Time {
+	from = time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, from.Location())
+	for year := from.Year(); ; year++ {
+		d := day
+		if month == 2 && day == 29 && time.Date(year, 2, 29, 0, 0, 0, 0, from.Location()).Month() != 2 {
+			d = 28
+		}
+		next := time.Date(year, time.Month(month), d, 0, 0, 0, 0, from.Location())
+		if !next.Before(from) {
+			return next
+		}
+	}
+}
+
+// Fill in the next occurrence of a date from today
+func (d *ContactDate) schedule(now time.Time) {
+	next := nextOccurrence(d.Month, d.Day, now)
+	d.Next = next.Format("2006-01-02")
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	d.DaysUntil = int(next.Sub(today).Hours()/24 + 0.5)
+}
+
+// Check a month and day, and year if known, make a real date
+func validDate(year, month, day int) bool {
+	y := year
+	if y == 0 {
+		y = 2000 // A leap year, so February 29 is valid
+	}
+	t := time.Date(y, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	return month >= 1 && month <= 12 && t.Month() == time.Month(month) && t.Day() == day
+}
+
+// Parse a date as YYYY-MM-DD, YYYYMMDD, or without the year as MM-DD, --MM-DD
+// or --MMDD like in vCards
+func parseContactDate(value string) (year, month, day int, ok bool) {
+	value = strings.TrimSpace(value)
+	if i := strings.IndexByte(value, 'T'); i > 0 {
+		value = value[:i]
+	}
+	digits := strings.ReplaceAll(strings.TrimPrefix(value, "--"), "-", "")
+	if strings.Trim(digits, "0123456789") != "" {
+		return 0, 0, 0, false
+	}
+	switch len(digits) {
+	case 8:
+		year, _ = strconv.Atoi(digits[:4])
+		digits = digits[4:]
+	case 4:
+	default:
+		return 0, 0, 0, false
+	}
+	month, _ = strconv.Atoi(digits[:2])
+	day, _ = strconv.Atoi(digits[2:])
+	// Some address books store unknown years as 1604 or 0000
+	if year < 1900 {
+		year = 0
+	}
+	return year, month, day, validDate(year, month, day)
+}
+
+// A date found for a contact
+type foundContactDate struct {
+	contact          types.JID
+	kind             string
+	year, month, day int
+	label            string
+	source           string // See contactDateSources
+}
+
+// Read the WhatsApp account, name, birthday and anniversary from a vCard
+func parseVCardDates(vcard string) []foundContactDate {
+	// Continuation lines start with a space or tab
+	vcard = strings.NewReplacer("\r\n ", "", "\r\n\t", "", "\n ", "", "\n\t", "").Replace(vcard)
+	var contact types.JID
+	var name string
+	var dates []foundContactDate
+	for _, line := range strings.Split(vcard, "\n") {
+		line = strings.TrimRight(line, "\r")
+		colon := strings.IndexByte(line, ':')
+		if colon < 0 {
+			continue
+		}
+		params := strings.Split(line[:colon], ";")
+		property := strings.ToUpper(params[0])
+		// Grouped properties like item1.TEL
+		if i := strings.LastIndexByte(property, '.'); i >= 0 {
+			property = property[i+1:]
+		}
+		value := line[colon+1:]
+
+		switch property {
+		case "FN":
+			name = strings.TrimSpace(value)
+		case "TEL":
+			waid := ""
+			for _, p := range params[1:] {
+				if k, v, ok := strings.Cut(p, "="); ok && strings.EqualFold(k, "waid") {
+					waid = v
+				}
+			}
+			// The WhatsApp account wins over other numbers
+			if waid != "" {
+				contact = types.NewJID(waid, types.DefaultUserServer)
+			} else if contact.IsEmpty() {
+				if jid, err := parseContactJID(strings.TrimSpace(value)); err == nil && len(jid.User) >= minPhoneDigits {
+					contact = jid
+				}
+			}
+		case "BDAY", "ANNIVERSARY", "X-ANNIVERSARY":
+			year, month, day, ok := parseContactDate(value)
+			if !ok {
+				continue
+			}
+			kind := dateBirthday
+			if property != "BDAY" {
+				kind = dateAnniversary
+			}
+			dates = append(dates, foundContactDate{kind: kind, year: year, month: month, day: day})
+		}
+	}
+	if contact.IsEmpty() {
+		return nil
+	}
+	for i := range dates {
+		dates[i].contact, dates[i].label, dates[i].source = contact, name, "vcard"
+	}
+	return dates
+}
+
+// Statements of one's own birthday or anniversary, like "my birthday is on
+// May 12th" or "our anniversary is 3 June", and wishes for them
+var (
+	ownDateRe   = regexp.MustCompile(`(?i)\b(?:(my) (?:birthday|bday|b-day)|(our) (?:wedding )?anniversary) is (?:on )?(?:the )?`)
+	greetingRes = map[string]*regexp.Regexp{
+		dateBirthday:    regexp.MustCompile(`(?i)\b(?:happy (?:birthday|bday|b-day)|buon compleanno|feliz cumplea[nñ]os|joyeux anniversaire|alles gute zum geburtstag|feliz anivers[aá]rio)\b`),
+		dateAnniversary: regexp.MustCompile(`(?i)\bhappy (?:wedding )?anniversary\b`),
+	}
+)
+
+// Find the dates a message tells about a contact: the sender stating their
+// own date, or me wishing the other side of a direct chat a happy birthday
+func findMessageDates(msg Message, sender types.JID, isGroup bool) []foundContactDate {
+	var dates []foundContactDate
+	if msg.IsFromMe {
+		if isGroup {
+			return nil
+		}
+		chat, err := types.ParseJID(msg.ChatJID)
+		if err != nil {
+			return nil
+		}
+		for kind, re := range greetingRes {
+			if re.MatchString(msg.Content) {
+				local := msg.Time.Local()
+				dates = append(dates, foundContactDate{contact: chat, kind: kind, month: int(local.Month()), day: local.Day(), source: "greeting"})
+			}
+		}
+		return dates
+	}
+	text := strings.ToLower(msg.Content)
+	for _, m := range ownDateRe.FindAllStringSubmatchIndex(text, -1) {
+		// The date has to follow right after, like "is on May 12th" or "is tomorrow"
+		var date *dateMention
+		for _, mention := range findDates(text[m[1]:], msg.Time.Local()) {
+			if mention.start == 0 && (date == nil || mention.end > date.end) {
+				date = &mention
+			}
+		}
+		if date == nil {
+			continue
+		}
+		kind := dateBirthday
+		if m[4] >= 0 {
+			kind = dateAnniversary
+		}
+		dates = append(dates, foundContactDate{contact: sender, kind: kind, month: int(date.date.Month()), day: date.date.Day(), source: "message"})
+	}
+	return dates
+}
+
+// Store a date of a contact unless a more trusted one is stored, returning
+// whether it was stored
+func (store *MessageStore) StoreContactDate(d foundContactDate, messageID, chatJID string) (bool, error) {
+	// No need to remind of a birthday I just wished
+	reminded := 0
+	if d.source == "greeting" {
+		reminded = time.Now().Year()
+	}
+	result, err := store.db.Exec(
+		`INSERT INTO contact_dates (contact_jid, kind, month, day, year, label, source, message_id, chat_jid, updated_at, reminded_year)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(contact_jid, kind) DO UPDATE SET
+			month = excluded.month, day = excluded.day,
+			year = CASE WHEN excluded.source = 'manual' OR excluded.year > 0 OR excluded.month != contact_dates.month OR excluded.day != contact_dates.day
+				THEN excluded.year ELSE contact_dates.year END,
+			label = COALESCE(NULLIF(excluded.label, ''), contact_dates.label),
+			source = excluded.source, message_id = excluded.message_id, chat_jid = excluded.chat_jid, updated_at = excluded.updated_at,
+			reminded_year = CASE WHEN excluded.month != contact_dates.month OR excluded.day != contact_dates.day THEN excluded.reminded_year ELSE contact_dates.reminded_year END
+		WHERE ? >= (CASE contact_dates.source WHEN 'manual' THEN 3 WHEN 'vcard' THEN 2 WHEN 'message' THEN 1 ELSE 0 END)`,
+		d.contact.String(), d.kind, d.month, d.day, d.year, d.label, d.source, messageID, chatJID, time.Now(), reminded,
+		contactDateSources[d.source],
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// Store the birthdays and anniversaries of contacts shared as vCards
+func handleSharedContacts(messageStore *MessageStore, msg *waProto.Message, messageID, chatJID string) {
+	var vcards []string
+	if contact := msg.GetContactMessage(); contact != nil {
+		vcards = append(vcards, contact.GetVcard())
+	}
+	for _, contact := range msg.GetContactsArrayMessage().GetContacts() {
+		vcards = append(vcards, contact.GetVcard())
+	}
+	for _, vcard := range vcards {
+		for _, d := range parseVCardDates(vcard) {
+			if stored, err := messageStore.StoreContactDate(d, messageID, chatJID); err != nil {
+				bridgeLog.Warnf("Failed to store %s of %s: %v", d.kind, d.contact, err)
+			} else if stored {
+				bridgeLog.Infof("Stored %s of %s from a shared contact", d.kind, d.contact)
+			}
+		}
+	}
+}
+
+// Store the birthdays and anniversaries a message tells about
+func handleContactDates(messageStore *MessageStore, msg Message, sender types.JID, isGroup bool) {
+	if msg.Content == "" || !envBool("WHATSAPP_EXTRACT_CONTACT_DATES", true) {
+		return
+	}
+	for _, d := range findMessageDates(msg, sender, isGroup) {
+		if _, err := messageStore.StoreContactDate(d, msg.ID, msg.ChatJID); err != nil {
+			bridgeLog.Warnf("Failed to store %s of %s: %v", d.kind, d.contact, err)
+		}
+	}
+}
+
+const contactDateColumns = `id, contact_jid, kind, month, day, COALESCE(year, 0), COALESCE(label, ''), source,
+	COALESCE(message_id, ''), COALESCE(chat_jid, ''), updated_at`
+
+// Read contact dates from a query selecting contactDateColumns
+func (store *MessageStore) scanContactDates(rows *sql.Rows) ([]ContactDate, error) {
+	defer rows.Close()
+	dates := []ContactDate{}
+	now := time.Now()
+	for rows.Next() {
+		var d ContactDate
+		if err := rows.Scan(&d.ID, &d.ContactJID, &d.Kind, &d.Month, &d.Day, &d.Year, &d.Label, &d.Source,
+			&d.MessageID, &d.ChatJID, &d.UpdatedAt); err != nil {
+			return nil, err
+		}
+		if name := store.chatName(d.ContactJID); name != d.ContactJID {
+			d.Name = name
+		}
+		d.schedule(now)
+		dates = append(dates, d)
+	}
+	return dates, rows.Err()
+}
+
+// ContactDateFilter describes which dates ListContactDates returns
+type ContactDateFilter struct {
+	Contact  string // Any JID the contact is known under
+	Kind     string
+	Upcoming int // Only dates in the next this many days, -1 for all
+}
+
+// List contact dates, soonest first
+func (store *MessageStore) ListContactDates(f ContactDateFilter) ([]ContactDate, error) {
+	var conditions []string
+	var args []interface{}
+	if f.Contact != "" {
+		aliases, err := store.SenderAliases(f.Contact)
+		if err != nil {
+			return nil, err
+		}
+		var users []string
+		for _, alias := range aliases {
+			users = append(users, "substr(contact_jid, 1, instr(contact_jid, '@') - 1) = ?")
+			args = append(args, alias)
+		}
+		conditions = append(conditions, "("+strings.Join(users, " OR ")+")")
+	}
+	if f.Kind != "" {
+		conditions = append(conditions, "kind = ?")
+		args = append(args, f.Kind)
+	}
+	query := "SELECT " + contactDateColumns + " FROM contact_dates"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	dates, err := store.scanContactDates(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Upcoming >= 0 {
+		kept := dates[:0]
+		for _, d := range dates {
+			if d.DaysUntil <= f.Upcoming {
+				kept = append(kept, d)
+			}
+		}
+		dates = kept
+	}
+	sort.SliceStable(dates, func(i, j int) bool {
+		if dates[i].DaysUntil != dates[j].DaysUntil {
+			return dates[i].DaysUntil < dates[j].DaysUntil
+		}
+		return dates[i].ContactJID < dates[j].ContactJID
+	})
+	return dates, nil
+}
+
+// Delete a contact date, returning whether it existed
+func (store *MessageStore) DeleteContactDate(id int64) (bool, error) {
+	result, err := store.db.Exec("DELETE FROM contact_dates WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// ContactDateAlert is the payload POSTed to webhooks when a contact date is coming up
+type ContactDateAlert struct {
+	Event     string      `json:"event"` // Always "contact_date.upcoming"
+	Date      ContactDate `json:"date"`
+	Years     int         `json:"years,omitempty"` // Age or years married on the day, if the year is known
+	InDays    int         `json:"in_days"`
+	MessageTo string      `json:"message_to"` // JID to send wishes to
+}
+
+// Find the dates coming up within the lead time that weren't announced for
+// their next occurrence yet, and mark them announced
+func (store *MessageStore) claimUpcomingContactDates(lead int) ([]ContactDate, error) {
+	dates, err := store.ListContactDates(ContactDateFilter{Upcoming: lead})
+	if err != nil {
+		return nil, err
+	}
+	var claimed []ContactDate
+	for _, d := range dates {
+		year, _ := strconv.Atoi(d.Next[:4])
+		result, err := store.db.Exec("UPDATE contact_dates SET reminded_year = ? WHERE id = ? AND COALESCE(reminded_year, 0) < ?", year, d.ID, year)
+		if err != nil {
+			return claimed, err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			claimed = append(claimed, d)
+		}
+	}
+	return claimed, nil
+}
+
+// Announce a coming contact date through the webhook and self-chat
+func announceContactDate(client *whatsmeow.Client, d ContactDate) {
+	alert := ContactDateAlert{Event: "contact_date.upcoming", Date: d, InDays: d.DaysUntil, MessageTo: d.ContactJID}
+	if d.Year > 0 {
+		alert.Years, _ = strconv.Atoi(d.Next[:4])
+		alert.Years -= d.Year
+	}
+	who := d.Name
+	if who == "" {
+		who = d.ContactJID
+	}
+	bridgeLog.Infof("The %s of %s is on %s", d.Kind, who, d.Next)
+
+	webhookURL := envString("WHATSAPP_CONTACT_DATES_WEBHOOK_URL", envString("WHATSAPP_REMINDER_WEBHOOK_URL", ""))
+	if webhookURL != "" {
+		if err := postWebhook(webhookURL, alert); err != nil {
+			bridgeLog.Warnf("Failed to call webhook for the %s of %s: %v", d.Kind, who, err)
+		}
+	}
+
+	if envBool("WHATSAPP_CONTACT_DATES_NOTIFY_SELF", false) {
+		when := "today"
+		if d.DaysUntil == 1 {
+			when = "tomorrow"
+		} else if d.DaysUntil > 1 {
+			when = fmt.Sprintf("in %d days (%s)", d.DaysUntil, d.Next)
+		}
+		text := fmt.Sprintf("🎂 The %s of %s is %s", d.Kind, who, when)
+		if alert.Years > 0 {
+			text += fmt.Sprintf(", %d years", alert.Years)
+		}
+		if err := sendSelfMessage(context.Background(), client, text); err != nil {
+			bridgeLog.Warnf("Failed to send the %s of %s to self-chat: %v", d.Kind, who, err)
+		}
+	}
+}
+
+// Announce contact dates as they come up, WHATSAPP_CONTACT_DATES_LEAD_DAYS
+// ahead
+func runContactDateWorker(client *whatsmeow.Client, messageStore *MessageStore) {
+	lead := max(envInt("WHATSAPP_CONTACT_DATES_LEAD_DAYS", 1), 0)
+	ticker := time.NewTicker(contactDateCheckInterval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		dates, err := messageStore.claimUpcomingContactDates(lead)
+		if err != nil {
+			bridgeLog.Warnf("Failed to check upcoming contact dates: %v", err)
+		}
+		for _, d := range dates {
+			func() {
+				defer recoverPanic("announcing contact date %d", d.ID)
+				announceContactDate(client, d)
+			}()
+		}
+	}
+}
+
+// ContactDateRequest represents the request body for setting a contact date
+type ContactDateRequest struct {
+	Contact string `json:"contact"`         // JID or phone number
+	Kind    string `json:"kind,omitempty"`  // birthday (default) or anniversary
+	Date    string `json:"date"`            // YYYY-MM-DD, or MM-DD if the year is unknown
+	Label   string `json:"label,omitempty"` // Note shown with the date
+}
+
+// ListContactDatesResponse represents the response for the list contact dates API
+type ListContactDatesResponse struct {
+	Success bool          `json:"success"`
+	Dates   []ContactDate `json:"dates"`
+	Page
+}
+
+// ContactDateResponse represents the response for the contact date APIs
+type ContactDateResponse struct {
+	Success bool         `json:"success"`
+	Message string       `json:"message,omitempty"`
+	Date    *ContactDate `json:"date,omitempty"`
+}
+
+// Register the REST handlers managing contact birthdays and anniversaries
+func registerContactDateHandlers(messageStore *MessageStore) {
+	// Handler for listing contact dates
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/contacts/dates",
+		Summary: "List contact birthdays and anniversaries from shared contacts, messages and the API, soonest first",
+		Tag:     "contacts",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "contact", Description: "Only dates of this contact, JID or phone number"},
+			{Name: "kind", Description: "Only birthday or anniversary dates"},
+			{Name: "upcoming_days", Description: "Only dates in the next this many days", Type: "integer"},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ListContactDatesResponse{},
+	})
+	http.HandleFunc("GET /api/contacts/dates", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		f := ContactDateFilter{Kind: q.Get("kind"), Upcoming: -1}
+		if f.Kind != "" && f.Kind != dateBirthday && f.Kind != dateAnniversary {
+			writeError(w, ErrCodeInvalidRequest, "kind must be birthday or anniversary", nil)
+			return
+		}
+		if v := q.Get("contact"); v != "" {
+			jid, err := parseContactJID(v)
+			if err != nil {
+				writeAPIError(w, "", err)
+				return
+			}
+			f.Contact = jid.String()
+		}
+		if v := q.Get("upcoming_days"); v != "" {
+			days, err := strconv.Atoi(v)
+			if err != nil || days < 0 {
+				writeError(w, ErrCodeInvalidRequest, "upcoming_days must be a non-negative integer", nil)
+				return
+			}
+			f.Upcoming = days
+		}
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		dates, err := messageStore.ListContactDates(f)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list contact dates: %v", err), nil)
+			return
+		}
+		total := len(dates)
+		dates = dates[min(offset, total):min(offset+limit, total)]
+		writeJSON(w, http.StatusOK, ListContactDatesResponse{Success: true, Dates: dates, Page: countedPage(offset, len(dates), total)})
+	})
+
+	// Handler for adding or correcting a contact date
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/contacts/dates",
+		Summary:  "Set the birthday or anniversary of a contact, replacing one found in shared contacts or messages",
+		Tag:      "contacts",
+		Scope:    ScopeManageContacts,
+		Audit:    true,
+		Request:  ContactDateRequest{},
+		Response: ContactDateResponse{},
+	})
+	http.HandleFunc("POST /api/contacts/dates", func(w http.ResponseWriter, r *http.Request) {
+		var req ContactDateRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		jid, err := parseContactJID(strings.TrimSpace(req.Contact))
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if jid.Server == types.GroupServer {
+			writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("%s is a group, dates belong to contacts", jid), nil)
+			return
+		}
+		if req.Kind == "" {
+			req.Kind = dateBirthday
+		}
+		if req.Kind != dateBirthday && req.Kind != dateAnniversary {
+			writeError(w, ErrCodeInvalidRequest, "kind must be birthday or anniversary", nil)
+			return
+		}
+		year, month, day, ok := parseContactDate(req.Date)
+		if !ok {
+			writeError(w, ErrCodeInvalidRequest, "date must be YYYY-MM-DD, or MM-DD if the year is unknown", nil)
+			return
+		}
+
+		d := foundContactDate{contact: jid, kind: req.Kind, year: year, month: month, day: day, label: req.Label, source: "manual"}
+		if _, err := messageStore.StoreContactDate(d, "", ""); err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to store contact date: %v", err), nil)
+			return
+		}
+		dates, err := messageStore.ListContactDates(ContactDateFilter{Contact: jid.String(), Kind: req.Kind, Upcoming: -1})
+		if err != nil || len(dates) == 0 {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to load contact date: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, ContactDateResponse{Success: true, Date: &dates[0]})
+	})
+
+	// Handler for deleting a contact date
+	documentAPI(apiOperation{
+		Method:   http.MethodDelete,
+		Path:     "/api/contacts/dates",
+		Summary:  "Delete a contact birthday or anniversary",
+		Tag:      "contacts",
+		Scope:    ScopeManageContacts,
+		Audit:    true,
+		Params:   []apiParam{{Name: "id", Description: "ID of the date", Required: true, Type: "integer"}},
+		Response: ContactDateResponse{},
+	})
+	http.HandleFunc("DELETE /api/contacts/dates", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			writeError(w, ErrCodeInvalidRequest, "id must be an integer", nil)
+			return
+		}
+		deleted, err := messageStore.DeleteContactDate(id)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to delete contact date: %v", err), nil)
+			return
+		}
+		if !deleted {
+			writeError(w, ErrCodeNotFound, fmt.Sprintf("Contact date %d not found", id), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, ContactDateResponse{Success: true, Message: fmt.Sprintf("Contact date %d deleted", id)})
+	})
+}
@@ -0,0 +1,624 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/appstate"
+	"go.mau.fi/whatsmeow/proto/waSyncAction"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// Background job copying the session's contacts into the contacts table
+var contactSync = newSyncJob("contacts")
+
+// Contact represents a stored contact and the name it is displayed with
+type Contact struct {
+	JID          string     `json:"jid"`
+	Name         string     `json:"name"`
+	FirstName    string     `json:"first_name,omitempty"`
+	FullName     string     `json:"full_name,omitempty"`
+	PushName     string     `json:"push_name,omitempty"`
+	BusinessName string     `json:"business_name,omitempty"`
+	Override     string     `json:"override,omitempty"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
+}
+
+// SQL expression for the name a contact is displayed with, local overrides win
+const contactNameSQL = `COALESCE(NULLIF(o.name, ''), NULLIF(c.full_name, ''), NULLIF(c.first_name, ''),
+	NULLIF(c.business_name, ''), NULLIF(c.push_name, ''), '')`
+
+// Pick the best name WhatsApp knows for a contact
+func contactDisplayName(info types.ContactInfo) string {
+	for _, name := range []string{info.FullName, info.FirstName, info.BusinessName, info.PushName} {
+		if name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// Insert or update contacts in a single transaction
+func (store *MessageStore) UpsertContacts(contacts map[types.JID]types.ContactInfo) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	upsert, err := tx.Prepare(
+		`INSERT INTO contacts (jid, first_name, full_name, push_name, business_name, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(jid) DO UPDATE SET first_name = excluded.first_name, full_name = excluded.full_name,
+			push_name = excluded.push_name, business_name = excluded.business_name, updated_at = excluded.updated_at`,
+	)
+	if err != nil {
+		return err
+	}
+	defer upsert.Close()
+
+	// Give direct chats without a proper name the contact's name
+	nameChat, err := tx.Prepare("UPDATE chats SET name = ? WHERE jid = ? AND (name IS NULL OR name = '' OR name = ?)")
+	if err != nil {
+		return err
+	}
+	defer nameChat.Close()
+
+	now := time.Now()
+	for jid, info := range contacts {
+		if _, err := upsert.Exec(jid.String(), info.FirstName, info.FullName, info.PushName, info.BusinessName, now); err != nil {
+			return err
+		}
+		if name := contactDisplayName(info); name != "" {
+			if _, err := nameChat.Exec(name, jid.String(), jid.User); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// List contacts, optionally filtered by name, phone number or JID
+func (store *MessageStore) ListContacts(query string, limit, offset int) ([]Contact, error) {
+	rows, err := store.db.Query(
+		`SELECT c.jid, `+contactNameSQL+`, COALESCE(c.first_name, ''), COALESCE(c.full_name, ''), COALESCE(c.push_name, ''),
+			COALESCE(c.business_name, ''), COALESCE(o.name, ''), c.updated_at
+		FROM contacts c LEFT JOIN contact_overrides o ON o.jid = c.jid
+		WHERE ? = '' OR c.jid LIKE ? OR `+contactNameSQL+` LIKE ?
+		ORDER BY `+contactNameSQL+` = '', `+contactNameSQL+` COLLATE NOCASE
+		LIMIT ? OFFSET ?`,
+		query, "%"+query+"%", "%"+query+"%", limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	contacts := []Contact{}
+	for rows.Next() {
+		var c Contact
+		var updatedAt sql.NullTime
+		if err := rows.Scan(&c.JID, &c.Name, &c.FirstName, &c.FullName, &c.PushName, &c.BusinessName, &c.Override, &updatedAt); err != nil {
+			return nil, err
+		}
+		if updatedAt.Valid {
+			c.UpdatedAt = &updatedAt.Time
+		}
+		contacts = append(contacts, c)
+	}
+	return contacts, rows.Err()
+}
+
+// Get a single contact, sql.ErrNoRows if it isn't stored
+func (store *MessageStore) GetContact(jid string) (*Contact, error) {
+	c := &Contact{JID: jid}
+	var updatedAt sql.NullTime
+	err := store.db.QueryRow(
+		`SELECT `+contactNameSQL+`, COALESCE(c.first_name, ''), COALESCE(c.full_name, ''), COALESCE(c.push_name, ''),
+			COALESCE(c.business_name, ''), COALESCE(o.name, ''), c.updated_at
+		FROM contacts c LEFT JOIN contact_overrides o ON o.jid = c.jid WHERE c.jid = ?`,
+		jid,
+	).Scan(&c.Name, &c.FirstName, &c.FullName, &c.PushName, &c.BusinessName, &c.Override, &updatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if updatedAt.Valid {
+		c.UpdatedAt = &updatedAt.Time
+	}
+	return c, nil
+}
+
+// Create or update a contact entered locally
+func (store *MessageStore) StoreLocalContact(jid types.JID, fullName, firstName string) error {
+	return store.UpsertContacts(map[types.JID]types.ContactInfo{
+		jid: {Found: true, FullName: fullName, FirstName: firstName},
+	})
+}
+
+// Get the local display name override of a JID, empty if there is none
+func (store *MessageStore) GetNameOverride(jid string) string {
+	var name string
+	store.db.QueryRow("SELECT name FROM contact_overrides WHERE jid = ?", jid).Scan(&name)
+	return name
+}
+
+// Set how a JID is displayed locally, the chat is renamed right away
+func (store *MessageStore) SetNameOverride(jid, name string) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if _, err := tx.Exec(
+		"INSERT OR REPLACE INTO contact_overrides (jid, name, updated_at) VALUES (?, ?, ?)",
+		jid, name, now,
+	); err != nil {
+		return err
+	}
+	// Make sure the contact exists so it can be listed and resolved
+	if _, err := tx.Exec(
+		"INSERT INTO contacts (jid, updated_at) VALUES (?, ?) ON CONFLICT(jid) DO UPDATE SET updated_at = excluded.updated_at",
+		jid, now,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE chats SET name = ? WHERE jid = ?", name, jid); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Remove the local display name override of a JID, the chat gets the contact's
+// own name back. Returns false if there was no override.
+func (store *MessageStore) DeleteNameOverride(jid types.JID) (bool, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM contact_overrides WHERE jid = ?", jid.String())
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	name := jid.User
+	var contactName sql.NullString
+	tx.QueryRow(
+		`SELECT COALESCE(NULLIF(full_name, ''), NULLIF(first_name, ''), NULLIF(business_name, ''), NULLIF(push_name, ''))
+		FROM contacts WHERE jid = ?`,
+		jid.String(),
+	).Scan(&contactName)
+	if contactName.String != "" {
+		name = contactName.String
+	}
+	if jid.Server != types.GroupServer {
+		if _, err := tx.Exec("UPDATE chats SET name = ? WHERE jid = ?", name, jid.String()); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// Find the contacts best matching a name or alias. Only the contacts sharing
+// the best match rank are returned, so one result means an unambiguous match.
+func (store *MessageStore) MatchContacts(query string) ([]Contact, error) {
+	query = foldText(query)
+	if query == "" {
+		return nil, nil
+	}
+	contacts, err := store.ListContacts("", -1, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	best := nameMatch{rank: matchNone}
+	var matches []Contact
+	for _, c := range contacts {
+		m := matchContact(query, c)
+		switch {
+		case m.rank < best.rank:
+			best, matches = m, []Contact{c}
+		case m.rank == best.rank && m.rank != matchNone:
+			matches = append(matches, c)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Name < matches[j].Name })
+	return matches, nil
+}
+
+// Resolve a contact name or alias to its JID, with an error listing the
+// candidates if the name is ambiguous
+func (store *MessageStore) ResolveContactName(name string) (types.JID, string, error) {
+	matches, err := store.MatchContacts(name)
+	if err != nil {
+		return types.JID{}, "", newAPIError(ErrCodeInternal, "Failed to look up contact: %v", err)
+	}
+
+	switch len(matches) {
+	case 0:
+		return types.JID{}, "", newAPIError(ErrCodeNotFound, "No contact matches %q", name)
+	case 1:
+		jid, err := types.ParseJID(matches[0].JID)
+		if err != nil {
+			return types.JID{}, "", newAPIError(ErrCodeInternal, "Invalid JID %s stored for %s: %v", matches[0].JID, matches[0].Name, err)
+		}
+		return jid, matches[0].Name, nil
+	default:
+		names := make([]string, len(matches))
+		for i, c := range matches {
+			names[i] = fmt.Sprintf("%s (%s)", c.Name, c.JID)
+		}
+		return types.JID{}, "", &APIError{
+			Code:    ErrCodeInvalidRequest,
+			Message: fmt.Sprintf("%q matches several contacts: %s", name, strings.Join(names, ", ")),
+			Details: map[string]interface{}{"candidates": matches},
+		}
+	}
+}
+
+// Store a LID to phone number mapping
+func (store *MessageStore) StoreLIDMapping(lid, pn types.JID) error {
+	_, err := store.db.Exec(
+		"INSERT OR REPLACE INTO lid_map (lid, pn, updated_at) VALUES (?, ?, ?)",
+		lid.ToNonAD().String(), pn.ToNonAD().String(), time.Now(),
+	)
+	return err
+}
+
+// Copy the contacts known to the WhatsApp session into the contacts table
+func PopulateContacts(client *whatsmeow.Client, messageStore *MessageStore, job *syncJob) error {
+	contacts, err := client.Store.Contacts.GetAllContacts(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to get contacts: %v", err)
+	}
+	job.setTotal(len(contacts))
+
+	if err := messageStore.UpsertContacts(contacts); err != nil {
+		return fmt.Errorf("failed to store contacts: %v", err)
+	}
+	job.advance(len(contacts))
+	return nil
+}
+
+// Update the stored contact after WhatsApp reported a change to it (contact list
+// edit, new push name, ...). whatsmeow has already updated its own store by then.
+func handleContactChange(client *whatsmeow.Client, messageStore *MessageStore, jid types.JID) {
+	jid = jid.ToNonAD()
+	if jid.IsEmpty() || jid.Server == types.GroupServer {
+		return
+	}
+	info, err := client.Store.Contacts.GetContact(context.Background(), jid)
+	if err != nil || !info.Found {
+		return
+	}
+	if err := messageStore.UpsertContacts(map[types.JID]types.ContactInfo{jid: info}); err != nil {
+		bridgeLog.Warnf("Failed to update contact %s: %v", jid, err)
+	}
+}
+
+// Fully re-sync the contact list from the server, then copy it into the contacts table
+func RefreshContacts(client *whatsmeow.Client, messageStore *MessageStore, job *syncJob) error {
+	if !client.IsConnected() {
+		return fmt.Errorf("not connected to WhatsApp")
+	}
+	err := throttle(opQuery, func() error {
+		ctx, cancel := callContext(job.context(), callQuery)
+		defer cancel()
+		return client.FetchAppState(ctx, appstate.WAPatchCriticalUnblockLow, true, false)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch contact list: %v", err)
+	}
+	return PopulateContacts(client, messageStore, job)
+}
+
+// Save a contact to the WhatsApp address book through app state sync. Only
+// works for accounts whose primary device syncs its address book.
+func syncContactToAddressBook(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, jid types.JID, fullName, firstName string) error {
+	if !client.IsConnected() {
+		return fmt.Errorf("not connected to WhatsApp")
+	}
+	patch := appstate.PatchInfo{
+		Type: appstate.WAPatchCriticalUnblockLow,
+		Mutations: []appstate.MutationInfo{{
+			Index:   []string{appstate.IndexContact, jid.String()},
+			Version: 2,
+			Value: &waSyncAction.SyncActionValue{
+				ContactAction: &waSyncAction.ContactAction{
+					FullName:                 proto.String(fullName),
+					FirstName:                proto.String(firstName),
+					SaveOnPrimaryAddressbook: proto.Bool(true),
+				},
+			},
+		}},
+	}
+	payload := map[string]string{"jid": jid.String(), "full_name": fullName, "first_name": firstName}
+	return journal(messageStore, OpKindContact, jid.String(), payload, func() error {
+		return throttle(opAppState, func() error {
+			ctx, cancel := callContext(ctx, callQuery)
+			defer cancel()
+			return client.SendAppState(ctx, patch)
+		})
+	})
+}
+
+// Parse a contact JID or phone number
+func parseContactJID(value string) (types.JID, error) {
+	if strings.Contains(value, "@") {
+		jid, err := types.ParseJID(value)
+		if err != nil {
+			return types.JID{}, newAPIError(ErrCodeInvalidRequest, "Invalid JID %s: %v", value, err)
+		}
+		return jid.ToNonAD(), nil
+	}
+	phone := strings.NewReplacer("+", "", " ", "", "-", "", "(", "", ")", "").Replace(value)
+	if phone == "" || strings.Trim(phone, "0123456789") != "" {
+		return types.JID{}, newAPIError(ErrCodeInvalidRequest, "Invalid phone number %s", value)
+	}
+	return types.NewJID(phone, types.DefaultUserServer), nil
+}
+
+// Record the phone number of every LID contact (and the LID of every phone number
+// contact) the session knows, so LID senders and chats can be resolved to people
+func ResyncLIDsWithContacts(client *whatsmeow.Client, messageStore *MessageStore, job *syncJob) error {
+	ctx := context.Background()
+	contacts, err := client.Store.Contacts.GetAllContacts(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get contacts: %v", err)
+	}
+	job.setTotal(len(contacts))
+
+	for jid := range contacts {
+		var lid, pn types.JID
+		switch jid.Server {
+		case types.HiddenUserServer:
+			lid = jid
+			pn, err = client.Store.LIDs.GetPNForLID(ctx, jid)
+		case types.DefaultUserServer:
+			pn = jid
+			lid, err = client.Store.LIDs.GetLIDForPN(ctx, jid)
+		}
+		if err == nil && !lid.IsEmpty() && !pn.IsEmpty() {
+			if err := messageStore.StoreLIDMapping(lid, pn); err != nil {
+				return fmt.Errorf("failed to store LID mapping: %v", err)
+			}
+		}
+		job.advance(1)
+	}
+	return nil
+}
+
+// Name chats stored under a LID after the contact of the matching phone number
+func FixLIDMappings(client *whatsmeow.Client, messageStore *MessageStore, job *syncJob) error {
+	result, err := messageStore.db.Exec(
+		`UPDATE chats SET name = (
+			SELECT COALESCE(NULLIF(c.full_name, ''), NULLIF(c.first_name, ''), NULLIF(c.business_name, ''), NULLIF(c.push_name, ''))
+			FROM lid_map m JOIN contacts c ON c.jid = m.pn WHERE m.lid = chats.jid
+		)
+		WHERE jid LIKE '%@lid' AND (name IS NULL OR name = '' OR name = substr(jid, 1, instr(jid, '@') - 1))
+		AND EXISTS (
+			SELECT 1 FROM lid_map m JOIN contacts c ON c.jid = m.pn WHERE m.lid = chats.jid
+			AND COALESCE(NULLIF(c.full_name, ''), NULLIF(c.first_name, ''), NULLIF(c.business_name, ''), NULLIF(c.push_name, '')) IS NOT NULL
+		)`,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to fix LID chat names: %v", err)
+	}
+	n, _ := result.RowsAffected()
+	job.setTotal(int(n))
+	job.advance(int(n))
+	return nil
+}
+
+// CreateContactRequest represents the request body for creating a contact
+type CreateContactRequest struct {
+	Phone           string `json:"phone"`
+	Name            string `json:"name"`
+	FirstName       string `json:"first_name,omitempty"`
+	SyncAddressBook bool   `json:"sync_address_book,omitempty"`
+}
+
+// RenameContactRequest represents the request body for renaming a contact locally
+type RenameContactRequest struct {
+	Name string `json:"name"`
+}
+
+// ContactResponse represents the response for the contact APIs
+type ContactResponse struct {
+	Success   bool     `json:"success"`
+	Message   string   `json:"message,omitempty"`
+	Contact   *Contact `json:"contact,omitempty"`
+	Synced    bool     `json:"synced,omitempty"`
+	SyncError string   `json:"sync_error,omitempty"`
+}
+
+// ListContactsResponse represents the response for the contact list API
+type ListContactsResponse struct {
+	Success  bool      `json:"success"`
+	Contacts []Contact `json:"contacts"`
+	Page
+}
+
+// Register the REST handlers for contacts
+func registerContactHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	jidParam := apiParam{Name: "jid", In: "path", Description: "JID or phone number of the contact", Required: true}
+
+	// Handler for listing contacts
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/contacts",
+		Summary: "List contacts with the names they are displayed with",
+		Tag:     "contacts",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "query", Description: "Filter contacts by name, phone number or JID"},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ListContactsResponse{},
+	})
+	http.HandleFunc("GET /api/contacts", func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		contacts, err := messageStore.ListContacts(r.URL.Query().Get("query"), limit+1, offset)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list contacts: %v", err), nil)
+			return
+		}
+		contacts, page := trimPage(contacts, offset, limit)
+		writeJSON(w, http.StatusOK, ListContactsResponse{Success: true, Contacts: contacts, Page: page})
+	})
+
+	// Handler for creating a contact
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/contacts",
+		Summary:  "Create a local contact, optionally saving it to the WhatsApp address book",
+		Tag:      "contacts",
+		Scope:    ScopeManageContacts,
+		Audit:    true,
+		Request:  CreateContactRequest{},
+		Response: ContactResponse{},
+	})
+	http.HandleFunc("POST /api/contacts", func(w http.ResponseWriter, r *http.Request) {
+		var req CreateContactRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Phone == "" || req.Name == "" {
+			writeError(w, ErrCodeInvalidRequest, "Phone and name are required", nil)
+			return
+		}
+		jid, err := parseContactJID(req.Phone)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if req.FirstName == "" {
+			req.FirstName = strings.Fields(req.Name)[0]
+		}
+
+		if err := messageStore.StoreLocalContact(jid, req.Name, req.FirstName); err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to store contact: %v", err), nil)
+			return
+		}
+
+		resp := ContactResponse{Success: true, Message: fmt.Sprintf("Contact %s created", req.Name)}
+		if req.SyncAddressBook {
+			if err := syncContactToAddressBook(r.Context(), client, messageStore, jid, req.Name, req.FirstName); err != nil {
+				resp.SyncError = err.Error()
+			} else {
+				resp.Synced = true
+			}
+		}
+		resp.Contact, _ = messageStore.GetContact(jid.String())
+		writeJSON(w, http.StatusCreated, resp)
+	})
+
+	// Handler for renaming a contact locally
+	documentAPI(apiOperation{
+		Method:   http.MethodPut,
+		Path:     "/api/contacts/{jid}/name",
+		Summary:  "Set the name a JID is displayed with locally, overriding the WhatsApp name",
+		Tag:      "contacts",
+		Scope:    ScopeManageContacts,
+		Audit:    true,
+		Params:   []apiParam{jidParam},
+		Request:  RenameContactRequest{},
+		Response: ContactResponse{},
+	})
+	http.HandleFunc("PUT /api/contacts/{jid}/name", func(w http.ResponseWriter, r *http.Request) {
+		jid, err := parseContactJID(r.PathValue("jid"))
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		var req RenameContactRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" {
+			writeError(w, ErrCodeInvalidRequest, "Name is required", nil)
+			return
+		}
+		if err := messageStore.SetNameOverride(jid.String(), req.Name); err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to rename contact: %v", err), nil)
+			return
+		}
+		contact, _ := messageStore.GetContact(jid.String())
+		writeJSON(w, http.StatusOK, ContactResponse{Success: true, Message: fmt.Sprintf("%s renamed to %s", jid, req.Name), Contact: contact})
+	})
+
+	// Handler for removing a local name override
+	documentAPI(apiOperation{
+		Method:   http.MethodDelete,
+		Path:     "/api/contacts/{jid}/name",
+		Summary:  "Remove the local name override of a JID",
+		Tag:      "contacts",
+		Scope:    ScopeManageContacts,
+		Audit:    true,
+		Params:   []apiParam{jidParam},
+		Response: ContactResponse{},
+	})
+	http.HandleFunc("DELETE /api/contacts/{jid}/name", func(w http.ResponseWriter, r *http.Request) {
+		jid, err := parseContactJID(r.PathValue("jid"))
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		found, err := messageStore.DeleteNameOverride(jid)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to remove name override: %v", err), nil)
+			return
+		}
+		if !found {
+			writeError(w, ErrCodeNotFound, fmt.Sprintf("No name override for %s", jid), nil)
+			return
+		}
+		contact, _ := messageStore.GetContact(jid.String())
+		writeJSON(w, http.StatusOK, ContactResponse{Success: true, Message: fmt.Sprintf("Name override of %s removed", jid), Contact: contact})
+	})
+
+	// Handler for a manual full contact re-sync
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/contacts/refresh",
+		Summary:  "Re-sync the full contact list from WhatsApp in the background",
+		Tag:      "contacts",
+		Scope:    ScopeManageContacts,
+		Audit:    true,
+		Response: SyncStatusResponse{},
+	})
+	http.HandleFunc("POST /api/contacts/refresh", func(w http.ResponseWriter, r *http.Request) {
+		started := contactSync.start(func(j *syncJob) error {
+			return RefreshContacts(client, messageStore, j)
+		})
+		if !started {
+			writeError(w, ErrCodeConflict, "Contact sync is already running", contactSync.Status())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, SyncStatusResponse{
+			Success: true,
+			Message: "Contact sync started",
+			Status:  contactSync.Status(),
+		})
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// ContactStats summarizes the messages exchanged with a contact across all chats
+type ContactStats struct {
+	JID                     string         `json:"jid"`
+	Messages                int            `json:"messages"`     // Sent by them anywhere plus everything in direct chats
+	FromContact             int            `json:"from_contact"` // Sent by them, in direct chats and groups
+	FromMe                  int            `json:"from_me"`      // Sent by me in direct chats with them
+	Chats                   int            `json:"chats"`        // Chats they sent to or direct chats with them
+	Groups                  int            `json:"groups"`       // Groups they sent to
+	FirstInteraction        *time.Time     `json:"first_interaction,omitempty"`
+	LastInteraction         *time.Time     `json:"last_interaction,omitempty"`
+	MyAvgResponseSeconds    *float64       `json:"my_avg_response_seconds,omitempty"`    // How long I took to answer them in direct chats
+	TheirAvgResponseSeconds *float64       `json:"their_avg_response_seconds,omitempty"` // How long they took to answer me in direct chats
+	Media                   map[string]int `json:"media"`                                // Files shared in direct chats or sent by them, by media type
+}
+
+// Compute the statistics of a contact, matching them whether their messages
+// came from their phone number or their LID
+func (store *MessageStore) ContactStats(jid types.JID) (*ContactStats, error) {
+	aliases, err := store.SenderAliases(jid.String())
+	if err != nil {
+		return nil, err
+	}
+	var directChats []string
+	for _, alias := range aliases {
+		if strings.Contains(alias, "@") {
+			directChats = append(directChats, alias)
+		}
+	}
+
+	// Everything they sent, and everything in direct chats with them
+	var args []interface{}
+	for _, alias := range aliases {
+		args = append(args, alias)
+	}
+	for _, chat := range directChats {
+		args = append(args, chat)
+	}
+	rows, err := store.db.Query(
+		`SELECT chat_jid, COALESCE(is_from_me, 0), timestamp, COALESCE(media_type, '')
+		FROM messages
+		WHERE (sender IN (?`+strings.Repeat(", ?", len(aliases)-1)+`) AND COALESCE(is_from_me, 0) = 0)
+			OR chat_jid IN (?`+strings.Repeat(", ?", len(directChats)-1)+`)
+		ORDER BY chat_jid, timestamp, rowid`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := &ContactStats{JID: jid.String(), Media: map[string]int{}}
+	var first, last time.Time
+	var mine, theirs []time.Duration
+	var prevChat string
+	var prevFromMe bool
+	var prevTime time.Time
+	for rows.Next() {
+		var chat, mediaType string
+		var fromMe bool
+		var ts time.Time
+		if err := rows.Scan(&chat, &fromMe, &ts, &mediaType); err != nil {
+			return nil, err
+		}
+		direct := !strings.HasSuffix(chat, "@"+types.GroupServer)
+
+		stats.Messages++
+		if fromMe {
+			stats.FromMe++
+		} else {
+			stats.FromContact++
+		}
+		if chat != prevChat {
+			stats.Chats++
+			if !direct {
+				stats.Groups++
+			}
+		}
+		if mediaType != "" {
+			stats.Media[mediaType]++
+		}
+		if first.IsZero() || ts.Before(first) {
+			first = ts
+		}
+		if ts.After(last) {
+			last = ts
+		}
+
+		// A change of side in a direct chat is an answer
+		if direct && chat == prevChat && fromMe != prevFromMe {
+			if fromMe {
+				mine = append(mine, ts.Sub(prevTime))
+			} else {
+				theirs = append(theirs, ts.Sub(prevTime))
+			}
+		}
+		prevChat, prevFromMe, prevTime = chat, fromMe, ts
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stats.FirstInteraction = optionalTime(first)
+	stats.LastInteraction = optionalTime(last)
+	stats.MyAvgResponseSeconds = averageSeconds(mine)
+	stats.TheirAvgResponseSeconds = averageSeconds(theirs)
+	return stats, nil
+}
+
+// Average of durations in seconds, nil if there are none
+func averageSeconds(durations []time.Duration) *float64 {
+	if len(durations) == 0 {
+		return nil
+	}
+	var total time.Duration
+	for _, d := range durations {
+		total += d
+	}
+	avg := total.Seconds() / float64(len(durations))
+	return &avg
+}
+
+// ContactStatsResponse represents the response for the contact statistics API
+type ContactStatsResponse struct {
+	Success bool          `json:"success"`
+	Stats   *ContactStats `json:"stats"`
+}
+
+// Register the REST handler reporting statistics of a contact
+func registerContactStatsHandlers(messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/contacts/{jid}/stats",
+		Summary:  "Get message counts, first and last interaction, average response times and shared media counts of a contact across all chats",
+		Tag:      "contacts",
+		Scope:    ScopeReadMessages,
+		Params:   []apiParam{{Name: "jid", In: "path", Description: "JID, LID or phone number of the contact", Required: true}},
+		Response: ContactStatsResponse{},
+	})
+	http.HandleFunc("GET /api/contacts/{jid}/stats", func(w http.ResponseWriter, r *http.Request) {
+		jid, err := parseContactJID(r.PathValue("jid"))
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if jid.Server == types.GroupServer {
+			writeError(w, ErrCodeInvalidRequest, "Statistics are only available for contacts, not groups", nil)
+			return
+		}
+		stats, err := messageStore.ContactStats(jid)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to compute contact statistics: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, ContactStatsResponse{Success: true, Stats: stats})
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Exit codes telling service managers why the bridge stopped. Units can set
+// RestartPreventExitStatus=3 so a bridge that needs a new QR scan isn't restarted
+// in a loop.
+const (
+	exitOK           = 0 // Stopped on request
+	exitFatal        = 1 // Failed to start or lost the connection for good
+	exitAuthRequired = 3 // Not paired, run interactively to scan a QR code
+)
+
+// Tell systemd about the state of the service through $NOTIFY_SOCKET, doing
+// nothing when not started by systemd with Type=notify
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		bridgeLog.Warnf("Failed to notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		bridgeLog.Warnf("Failed to notify systemd: %v", err)
+	}
+}
+
+// Keep the systemd watchdog of the unit fed while the WhatsApp session is
+// healthy, so systemd restarts a bridge whose session stays dead
+func runSystemdWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		if watchdog.Status().Status != healthReconnecting {
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
+
+// Ask a running bridge on this machine whether it is ready, returning the exit
+// code for a container health check
+func runHealthcheck(port int) int {
+	httpClient := &http.Client{Timeout: 5 * time.Second}
+	resp, err := httpClient.Get(fmt.Sprintf("http://127.0.0.1:%d/api/health/ready", port))
+	if err != nil {
+		fmt.Println("Bridge is not responding:", err)
+		return exitFatal
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Println("Bridge is not ready:", resp.Status)
+		return exitFatal
+	}
+	return exitOK
+}
+
+// Write the process ID to a file, refusing to start if the process it names
+// is still running
+func writePIDFile(path string) error {
+	if data, err := os.ReadFile(path); err == nil {
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && pid != os.Getpid() && processRunning(pid) {
+			return fmt.Errorf("already running with PID %d according to %s", pid, path)
+		}
+	}
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// Remove the PID file if it still names this process
+func removePIDFile(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		bridgeLog.Warnf("Failed to remove PID file: %v", err)
+	}
+}
+
+// Whether a process exists
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
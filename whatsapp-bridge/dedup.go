@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sources messages are ingested from
+const (
+	sourceLive    = "live"    // Message events while connected
+	sourceHistory = "history" // History sync blobs sent after pairing or on demand
+)
+
+// Outcome of storing a message
+const (
+	ingestInserted  = "inserted"  // First time the message was seen
+	ingestMerged    = "merged"    // Already stored, and this copy filled in or changed fields
+	ingestDuplicate = "duplicate" // Already stored with everything this copy had
+)
+
+// Store a message, or merge it into the stored copy when the same message
+// arrives again from another source. A field is only taken from the new copy
+// if it isn't empty there, so a history sync copy without media info can't
+// blank out what a live event stored, and flags set since (starred, revoked,
+// view once) are kept. Nothing is updated when the new copy adds nothing.
+const mergeMessageSQL = `INSERT INTO messages
+	(id, chat_jid, sender, content, timestamp, is_from_me, media_type, filename, url, media_key, file_sha256, file_enc_sha256, file_length)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(id, chat_jid) DO UPDATE SET
+		sender = CASE WHEN length(excluded.sender) > 0 THEN excluded.sender ELSE messages.sender END,
+		content = CASE WHEN length(excluded.content) > 0 THEN excluded.content ELSE messages.content END,
+		media_type = CASE WHEN length(excluded.media_type) > 0 THEN excluded.media_type ELSE messages.media_type END,
+		filename = CASE WHEN length(excluded.filename) > 0 THEN excluded.filename ELSE messages.filename END,
+		url = CASE WHEN length(excluded.url) > 0 THEN excluded.url ELSE messages.url END,
+		media_key = CASE WHEN length(excluded.media_key) > 0 THEN excluded.media_key ELSE messages.media_key END,
+		file_sha256 = CASE WHEN length(excluded.file_sha256) > 0 THEN excluded.file_sha256 ELSE messages.file_sha256 END,
+		file_enc_sha256 = CASE WHEN length(excluded.file_enc_sha256) > 0 THEN excluded.file_enc_sha256 ELSE messages.file_enc_sha256 END,
+		file_length = CASE WHEN excluded.file_length > 0 THEN excluded.file_length ELSE messages.file_length END
+	WHERE (length(excluded.sender) > 0 AND excluded.sender IS NOT messages.sender)
+		OR (length(excluded.content) > 0 AND excluded.content IS NOT messages.content)
+		OR (length(excluded.media_type) > 0 AND excluded.media_type IS NOT messages.media_type)
+		OR (length(excluded.filename) > 0 AND excluded.filename IS NOT messages.filename)
+		OR (length(excluded.url) > 0 AND excluded.url IS NOT messages.url)
+		OR (length(excluded.media_key) > 0 AND excluded.media_key IS NOT messages.media_key)
+		OR (length(excluded.file_sha256) > 0 AND excluded.file_sha256 IS NOT messages.file_sha256)
+		OR (length(excluded.file_enc_sha256) > 0 AND excluded.file_enc_sha256 IS NOT messages.file_enc_sha256)
+		OR (excluded.file_length > 0 AND excluded.file_length IS NOT messages.file_length)`
+
+// IngestSourceStats counts what became of the messages from one source
+type IngestSourceStats struct {
+	Source     string     `json:"source"`
+	Inserted   int64      `json:"inserted"`
+	Merged     int64      `json:"merged"`
+	Duplicates int64      `json:"duplicates"`
+	LastSeen   *time.Time `json:"last_seen,omitempty"`
+}
+
+// ingestCounters counts ingestion outcomes per source since the bridge started
+type ingestCounters struct {
+	mu      sync.Mutex
+	since   time.Time
+	sources map[string]*IngestSourceStats
+}
+
+// Ingestion outcomes, updated by StoreMessage
+var ingestStats = &ingestCounters{since: time.Now(), sources: make(map[string]*IngestSourceStats)}
+
+// Count the outcome of storing a message from a source
+func (c *ingestCounters) record(source, outcome string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats, ok := c.sources[source]
+	if !ok {
+		stats = &IngestSourceStats{Source: source}
+		c.sources[source] = stats
+	}
+	switch outcome {
+	case ingestInserted:
+		stats.Inserted++
+	case ingestMerged:
+		stats.Merged++
+	case ingestDuplicate:
+		stats.Duplicates++
+	}
+	now := time.Now()
+	stats.LastSeen = &now
+}
+
+// Get the counts of every source, sorted by source
+func (c *ingestCounters) Stats() []IngestSourceStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := []IngestSourceStats{}
+	for _, s := range c.sources {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Source < stats[j].Source })
+	return stats
+}
+
+// IngestStatsResponse represents the response for the ingestion stats API
+type IngestStatsResponse struct {
+	Success bool                `json:"success"`
+	Since   time.Time           `json:"since"`
+	Sources []IngestSourceStats `json:"sources"`
+}
+
+// Register the REST handler reporting ingestion and deduplication counts
+func registerIngestStatsHandlers() {
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/ingest/stats",
+		Summary:  "Count the messages stored, merged into an existing copy and dropped as duplicates per source since the bridge started",
+		Tag:      "sync",
+		Scope:    ScopeAdmin,
+		Response: IngestStatsResponse{},
+	})
+	http.HandleFunc("GET /api/ingest/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, IngestStatsResponse{Success: true, Since: ingestStats.since, Sources: ingestStats.Stats()})
+	})
+}
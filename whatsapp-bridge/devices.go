@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waAdv"
+	waStore "go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// Kinds of devices linked to the account
+const (
+	deviceKindPhone     = "phone"       // The primary device, always device 0
+	deviceKindBridge    = "this_bridge" // The session of this bridge
+	deviceKindCompanion = "companion"   // Another linked device, like WhatsApp Web or desktop
+	deviceKindHosted    = "hosted"      // A device hosted by Meta, like the Cloud API
+)
+
+// LinkedDevice is a device of the account. WhatsApp tells companions only
+// which devices exist: the platform is known for the phone, from pairing, and
+// for this bridge, and when it was linked only for this bridge. Nothing tells
+// when any device was last active.
+type LinkedDevice struct {
+	JID       string     `json:"jid"`
+	Device    uint16     `json:"device"`
+	Kind      string     `json:"kind"`
+	Platform  string     `json:"platform,omitempty"`
+	LinkedAt  *time.Time `json:"linked_at,omitempty"`
+	Removable bool       `json:"removable"` // Whether DELETE /api/devices/{device} can unlink it
+}
+
+// List the devices of the account, the phone first
+func listLinkedDevices(ctx context.Context, client *whatsmeow.Client) ([]LinkedDevice, error) {
+	if !client.IsConnected() || client.Store.ID == nil {
+		return nil, newAPIError(ErrCodeNotConnected, "Not connected to WhatsApp")
+	}
+	own := *client.Store.ID
+	var jids []types.JID
+	err := throttle(opQuery, func() error {
+		ctx, cancel := callContext(ctx, callQuery)
+		defer cancel()
+		var err error
+		jids, err = client.GetUserDevices(ctx, []types.JID{own.ToNonAD()})
+		return err
+	})
+	if err != nil {
+		return nil, newCallError(ErrCodeInternal, err, "Failed to get the devices of the account: %v", err)
+	}
+
+	devices := make([]LinkedDevice, 0, len(jids))
+	for _, jid := range jids {
+		device := LinkedDevice{JID: jid.String(), Device: jid.Device, Kind: deviceKindCompanion}
+		switch {
+		case jid.Server == types.HostedServer:
+			device.Kind = deviceKindHosted
+		case jid.Device == 0:
+			device.Kind = deviceKindPhone
+			device.Platform = client.Store.Platform
+		case jid.Device == own.Device:
+			device.Kind = deviceKindBridge
+			device.Platform = strings.ToLower(waStore.DeviceProps.GetPlatformType().String())
+			device.LinkedAt = bridgeLinkedAt(client)
+			device.Removable = true
+		}
+		devices = append(devices, device)
+	}
+	// WhatsApp lists the phone first, but doesn't say it will
+	for i, device := range devices {
+		if device.Kind == deviceKindPhone && i > 0 {
+			devices[0], devices[i] = devices[i], devices[0]
+			break
+		}
+	}
+	return devices, nil
+}
+
+// Get when the phone linked this bridge from the signed identity it gave on
+// pairing, or nil if it can't be read
+func bridgeLinkedAt(client *whatsmeow.Client) *time.Time {
+	if client.Store.Account == nil {
+		return nil
+	}
+	var identity waAdv.ADVDeviceIdentity
+	if err := proto.Unmarshal(client.Store.Account.GetDetails(), &identity); err != nil || identity.GetTimestamp() == 0 {
+		return nil
+	}
+	linked := time.Unix(int64(identity.GetTimestamp()), 0)
+	return &linked
+}
+
+// Unlink a device of the account. Companions can only unlink themselves, the
+// other devices have to be removed under Linked devices on the phone.
+func removeLinkedDevice(ctx context.Context, client *whatsmeow.Client, device uint16) error {
+	devices, err := listLinkedDevices(ctx, client)
+	if err != nil {
+		return err
+	}
+	for _, d := range devices {
+		if d.Device != device {
+			continue
+		}
+		switch d.Kind {
+		case deviceKindBridge:
+		case deviceKindPhone:
+			return newAPIError(ErrCodeForbidden, "The phone is the primary device and can't be unlinked")
+		default:
+			return newAPIError(ErrCodeForbidden, "Only the phone can unlink device %d, remove it under Linked devices on the phone", device)
+		}
+
+		err := throttle(opQuery, func() error {
+			ctx, cancel := callContext(ctx, callQuery)
+			defer cancel()
+			return client.Logout(ctx)
+		})
+		if err != nil {
+			return newCallError(ErrCodeInternal, err, "Failed to unlink this bridge: %v", err)
+		}
+		// Logging out ourselves emits no LoggedOut event
+		bridgeLog.Warnf("Unlinked this bridge from the account, pair again through POST /api/auth/relogin")
+		watchdog.setAuthRequired(true)
+		sdNotify("STATUS=Logged out of WhatsApp, pairing is required")
+		return nil
+	}
+	return newAPIError(ErrCodeNotFound, "The account has no device %d", device)
+}
+
+// LinkedDevicesResponse represents the response for the linked devices API
+type LinkedDevicesResponse struct {
+	Success bool           `json:"success"`
+	Devices []LinkedDevice `json:"devices"`
+}
+
+// Register the REST handlers for the devices linked to the account
+func registerDeviceHandlers(client *whatsmeow.Client) {
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/devices",
+		Summary:  "List the devices linked to the account, with the platform and link time where WhatsApp tells them",
+		Tag:      "admin",
+		Scope:    ScopeAdmin,
+		Response: LinkedDevicesResponse{},
+	})
+	http.HandleFunc("GET /api/devices", func(w http.ResponseWriter, r *http.Request) {
+		devices, err := listLinkedDevices(r.Context(), client)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, LinkedDevicesResponse{Success: true, Devices: devices})
+	})
+
+	documentAPI(apiOperation{
+		Method:   http.MethodDelete,
+		Path:     "/api/devices/{device}",
+		Summary:  "Unlink a device from the account. Only this bridge can be unlinked, which leaves it waiting to be paired again.",
+		Tag:      "admin",
+		Scope:    ScopeAdmin,
+		Audit:    true,
+		Params:   []apiParam{{Name: "device", In: "path", Description: "Device number as listed by GET /api/devices", Required: true, Type: "integer"}},
+		Response: StatusResponse{},
+	})
+	http.HandleFunc("DELETE /api/devices/{device}", func(w http.ResponseWriter, r *http.Request) {
+		device, err := strconv.ParseUint(r.PathValue("device"), 10, 16)
+		if err != nil {
+			writeError(w, ErrCodeInvalidRequest, "device must be a device number", nil)
+			return
+		}
+		if err := removeLinkedDevice(r.Context(), client, uint16(device)); err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, StatusResponse{Success: true, Message: fmt.Sprintf("Unlinked device %d", device)})
+	})
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// How well a name matches a query, lower is better
+const (
+	matchOverride = iota // Exact match on a local name override
+	matchExact
+	matchPrefix
+	matchSubstring
+	matchFuzzy
+	matchNone
+)
+
+// Names of the match ranks as reported by the API
+var matchRankNames = map[int]string{
+	matchOverride:  "exact",
+	matchExact:     "exact",
+	matchPrefix:    "prefix",
+	matchSubstring: "substring",
+	matchFuzzy:     "fuzzy",
+}
+
+// Minimum trigram similarity for a fuzzy match
+const minTrigramSimilarity = 0.3
+
+// nameMatch is the rank of a match and a score ordering matches of the same rank
+type nameMatch struct {
+	rank  int
+	score float64
+}
+
+// Whether m is a better match than other
+func (m nameMatch) better(other nameMatch) bool {
+	if m.rank != other.rank {
+		return m.rank < other.rank
+	}
+	return m.score > other.score
+}
+
+// Lowercase a string and strip its diacritics, so "José" matches "jose"
+func foldText(s string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(strings.TrimSpace(s)) {
+		if !unicode.Is(unicode.Mn, r) {
+			b.WriteRune(unicode.ToLower(r))
+		}
+	}
+	return b.String()
+}
+
+// Rank how well a single name matches a folded query
+func matchName(query, name string) nameMatch {
+	name = foldText(name)
+	if name == "" {
+		return nameMatch{rank: matchNone}
+	}
+	coverage := float64(len(query)) / float64(len(name))
+	if name == query {
+		return nameMatch{matchExact, 1}
+	}
+	// Prefer names with a word equal to the query over longer words starting with it
+	words := strings.Fields(name)
+	for _, word := range words {
+		if strings.HasPrefix(word, query) {
+			return nameMatch{matchPrefix, float64(len(query)) / float64(len(word))}
+		}
+	}
+	if strings.HasPrefix(name, query) {
+		return nameMatch{matchPrefix, coverage}
+	}
+	if strings.Contains(name, query) {
+		return nameMatch{matchSubstring, coverage}
+	}
+
+	// Allow a typo every few characters, or enough shared trigrams
+	best := 0.0
+	maxDistance := max(len(query)/4, 1)
+	for _, candidate := range append(words, name) {
+		similarity := trigramSimilarity(query, candidate)
+		if editDistance(query, candidate) <= maxDistance {
+			similarity = max(similarity, 1-float64(maxDistance)/float64(len(candidate)+1))
+		}
+		best = max(best, similarity)
+	}
+	if best >= minTrigramSimilarity {
+		return nameMatch{matchFuzzy, best}
+	}
+	return nameMatch{rank: matchNone}
+}
+
+// Rank how well a contact matches a folded query, by any of its names or its number
+func matchContact(query string, c Contact) nameMatch {
+	best := nameMatch{rank: matchNone}
+	if c.Override != "" && foldText(c.Override) == query {
+		return nameMatch{matchOverride, 1}
+	}
+	for _, name := range []string{c.Override, c.FullName, c.FirstName, c.BusinessName, c.PushName} {
+		if m := matchName(query, name); m.better(best) {
+			best = m
+		}
+	}
+	if m := matchNumber(query, c.JID); m.better(best) {
+		best = m
+	}
+	return best
+}
+
+// Match a query made of digits against the user part of a JID
+func matchNumber(query, jid string) nameMatch {
+	number := strings.TrimLeft(query, "+")
+	if number == "" || strings.Trim(number, "0123456789") != "" {
+		return nameMatch{rank: matchNone}
+	}
+	user, _, _ := strings.Cut(jid, "@")
+	switch {
+	case user == number:
+		return nameMatch{matchExact, 1}
+	case strings.HasPrefix(user, number):
+		return nameMatch{matchPrefix, float64(len(number)) / float64(len(user))}
+	case strings.Contains(user, number):
+		return nameMatch{matchSubstring, float64(len(number)) / float64(len(user))}
+	}
+	return nameMatch{rank: matchNone}
+}
+
+// Trigrams of a string, padded so short words and word starts count
+func trigrams(s string) map[string]bool {
+	runes := []rune("  " + s + " ")
+	grams := make(map[string]bool, len(runes))
+	for i := 0; i+3 <= len(runes); i++ {
+		grams[string(runes[i:i+3])] = true
+	}
+	return grams
+}
+
+// Share of trigrams two strings have in common (Jaccard index)
+func trigramSimilarity(a, b string) float64 {
+	ga, gb := trigrams(a), trigrams(b)
+	shared := 0
+	for gram := range ga {
+		if gb[gram] {
+			shared++
+		}
+	}
+	union := len(ga) + len(gb) - shared
+	if union == 0 {
+		return 0
+	}
+	return float64(shared) / float64(union)
+}
+
+// Edit distance between two strings, counting swapped neighbours as one edit
+// (optimal string alignment distance)
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	rows := make([][]int, len(ra)+1)
+	for i := range rows {
+		rows[i] = make([]int, len(rb)+1)
+		rows[i][0] = i
+	}
+	for j := range rows[0] {
+		rows[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d := min(min(rows[i-1][j]+1, rows[i][j-1]+1), rows[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				d = min(d, rows[i-2][j-2]+1)
+			}
+			rows[i][j] = d
+		}
+	}
+	return rows[len(ra)][len(rb)]
+}
+
+// DirectoryEntry is a contact or chat found by a directory search
+type DirectoryEntry struct {
+	Type            string     `json:"type"` // contact, group or chat
+	JID             string     `json:"jid"`
+	Name            string     `json:"name"`
+	Match           string     `json:"match"`
+	Score           float64    `json:"score"`
+	LastMessageTime *time.Time `json:"last_message_time,omitempty"`
+
+	match nameMatch
+}
+
+// Search contacts and chats by name or number in one ranked list. A contact
+// and its direct chat are returned as a single entry.
+func (store *MessageStore) SearchDirectory(query string, limit int) ([]DirectoryEntry, error) {
+	query = foldText(query)
+	if query == "" {
+		return []DirectoryEntry{}, nil
+	}
+
+	contacts, err := store.ListContacts("", -1, 0)
+	if err != nil {
+		return nil, err
+	}
+	chats, err := store.ListChats("", -1, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]*DirectoryEntry)
+	for _, c := range contacts {
+		if m := matchContact(query, c); m.rank != matchNone {
+			entries[c.JID] = &DirectoryEntry{Type: "contact", JID: c.JID, Name: c.Name, match: m}
+		}
+	}
+	for _, chat := range chats {
+		m := matchName(query, chat.Name)
+		if n := matchNumber(query, chat.JID); n.better(m) {
+			m = n
+		}
+		lastMessage := chat.LastMessageTime
+
+		if entry, ok := entries[chat.JID]; ok {
+			entry.LastMessageTime = &lastMessage
+			if m.better(entry.match) {
+				entry.match = m
+			}
+			continue
+		}
+		if m.rank == matchNone {
+			continue
+		}
+		entryType := "chat"
+		if chat.IsGroup {
+			entryType = "group"
+		}
+		entries[chat.JID] = &DirectoryEntry{Type: entryType, JID: chat.JID, Name: chat.Name, LastMessageTime: &lastMessage, match: m}
+	}
+
+	results := make([]DirectoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		entry.Match = matchRankNames[entry.match.rank]
+		entry.Score = float64(int(entry.match.score*1000)) / 1000
+		results = append(results, *entry)
+	}
+
+	// Best match first, then the most recently active
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.match != b.match {
+			return a.match.better(b.match)
+		}
+		if (a.LastMessageTime == nil) != (b.LastMessageTime == nil) {
+			return a.LastMessageTime != nil
+		}
+		if a.LastMessageTime != nil && !a.LastMessageTime.Equal(*b.LastMessageTime) {
+			return a.LastMessageTime.After(*b.LastMessageTime)
+		}
+		return a.Name < b.Name
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// DirectorySearchResponse represents the response for the directory search API
+type DirectorySearchResponse struct {
+	Success bool             `json:"success"`
+	Results []DirectoryEntry `json:"results"`
+}
+
+// Register the REST handler searching contacts and chats
+func registerDirectoryHandlers(messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/search/directory",
+		Summary: "Search contacts and chats by name or number, ranked exact > prefix > substring > fuzzy",
+		Tag:     "contacts",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "query", Description: "Name, alias or phone number to search for", Required: true},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+		},
+		Response: DirectorySearchResponse{},
+	})
+	http.HandleFunc("GET /api/search/directory", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		if strings.TrimSpace(query) == "" {
+			writeError(w, ErrCodeInvalidRequest, "query is required", nil)
+			return
+		}
+		limit, _, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		results, err := messageStore.SearchDirectory(query, limit)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to search directory: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, DirectorySearchResponse{Success: true, Results: results})
+	})
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Most text kept from a document, longer text is cut
+const maxDocumentTextBytes = 1 << 20
+
+// Largest document sent to an extraction service
+const maxDocumentUploadBytes = 50 << 20
+
+// Full-text index over the text extracted from documents, kept in sync with
+// the messages table like messages_fts
+const documentIndexSchema = `
+	CREATE VIRTUAL TABLE messages_document_fts USING fts4(content="messages", document_text, tokenize=unicode61 "remove_diacritics=1");
+
+	CREATE TRIGGER messages_document_fts_delete BEFORE DELETE ON messages WHEN old.document_text IS NOT NULL BEGIN
+		DELETE FROM messages_document_fts WHERE docid = old.rowid;
+	END;
+	CREATE TRIGGER messages_document_fts_update_before BEFORE UPDATE OF document_text ON messages WHEN old.document_text IS NOT NULL BEGIN
+		DELETE FROM messages_document_fts WHERE docid = old.rowid;
+	END;
+	CREATE TRIGGER messages_document_fts_update_after AFTER UPDATE OF document_text ON messages WHEN new.document_text IS NOT NULL BEGIN
+		INSERT INTO messages_document_fts(docid, document_text) VALUES (new.rowid, new.document_text);
+	END;
+`
+
+// Statement rebuilding the document text index from the messages table
+const rebuildDocumentIndex = "INSERT INTO messages_document_fts(messages_document_fts) VALUES('rebuild')"
+
+// Create the document text index if it doesn't exist yet
+func initDocumentIndex(db *sql.DB) error {
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'messages_document_fts'").Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(documentIndexSchema); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(rebuildDocumentIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// documentConfig is how text is extracted from documents. DOCX and plain text
+// are read directly; other documents go to the extraction service if one is
+// set, such as Apache Tika's /tika endpoint, and PDFs to the command otherwise.
+type documentConfig struct {
+	Command      string // {path} is replaced by the file, the text is read from stdout
+	URL          string // Receives the file in a PUT and answers with plain text
+	APIKey       string
+	Timeout      time.Duration
+	AutoDownload bool // Download received documents to extract their text right away
+}
+
+// Get the document extraction settings, ok is false if it is off
+func loadDocumentConfig() (documentConfig, bool) {
+	cfg := documentConfig{
+		Command:      envString("WHATSAPP_DOCUMENT_EXTRACT_COMMAND", "pdftotext -enc UTF-8 {path} -"),
+		URL:          envString("WHATSAPP_DOCUMENT_EXTRACT_URL", ""),
+		APIKey:       envString("WHATSAPP_DOCUMENT_EXTRACT_API_KEY", ""),
+		Timeout:      time.Duration(max(envInt("WHATSAPP_DOCUMENT_EXTRACT_TIMEOUT_SECONDS", 120), 1)) * time.Second,
+		AutoDownload: envBool("WHATSAPP_DOCUMENT_EXTRACT_AUTO_DOWNLOAD", false),
+	}
+	return cfg, envBool("WHATSAPP_EXTRACT_DOCUMENTS", cfg.URL != "")
+}
+
+// Extract the text of a document file
+func extractDocumentText(cfg documentConfig, path string) (string, error) {
+	var text string
+	var err error
+	switch ext := strings.ToLower(filepath.Ext(path)); {
+	case ext == ".docx":
+		text, err = extractDOCXText(path)
+	case ext == ".txt" || ext == ".csv" || ext == ".md" || ext == ".json" || ext == ".xml" || ext == ".html":
+		var data []byte
+		data, err = os.ReadFile(path)
+		text = string(data)
+	case cfg.URL != "":
+		text, err = extractWithService(cfg, path)
+	case ext == ".pdf":
+		text, err = extractWithCommand(cfg, path)
+	default:
+		return "", newAPIError(ErrCodeUnsupportedMedia, "no extractor for %s documents, set WHATSAPP_DOCUMENT_EXTRACT_URL", ext)
+	}
+	if err != nil {
+		return "", err
+	}
+	text = strings.TrimSpace(strings.ToValidUTF8(text, ""))
+	if len(text) > maxDocumentTextBytes {
+		cut := maxDocumentTextBytes
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut]
+	}
+	return text, nil
+}
+
+// Run the extraction command on a file
+func extractWithCommand(cfg documentConfig, path string) (string, error) {
+	args := strings.Fields(cfg.Command)
+	if len(args) == 0 {
+		return "", fmt.Errorf("WHATSAPP_DOCUMENT_EXTRACT_COMMAND is empty")
+	}
+	for i := range args {
+		args[i] = strings.ReplaceAll(args[i], "{path}", path)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// Send a file to the extraction service
+func extractWithService(cfg documentConfig, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxDocumentUploadBytes {
+		return "", fmt.Errorf("document is larger than %d MB", maxDocumentUploadBytes>>20)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, cfg.URL, bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("invalid document extraction URL: %v", err)
+	}
+	req.Header.Set("Content-Type", http.DetectContentType(data))
+	req.Header.Set("Accept", "text/plain")
+	req.Header.Set("User-Agent", "whatsapp-bridge")
+	if cfg.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxDocumentTextBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("extraction service returned HTTP %d: %s", resp.StatusCode, truncateText(strings.TrimSpace(string(body)), 200))
+	}
+	return string(body), nil
+}
+
+// Read the text of a Word document, a paragraph per line
+func extractDOCXText(path string) (string, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid DOCX file: %v", err)
+	}
+	defer archive.Close()
+	for _, f := range archive.File {
+		if f.Name != "word/document.xml" {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+
+		var text strings.Builder
+		inText := false
+		decoder := xml.NewDecoder(io.LimitReader(r, maxDocumentUploadBytes))
+		for text.Len() <= maxDocumentTextBytes {
+			token, err := decoder.Token()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", fmt.Errorf("invalid DOCX file: %v", err)
+			}
+			switch t := token.(type) {
+			case xml.StartElement:
+				switch t.Name.Local {
+				case "t":
+					inText = true
+				case "tab":
+					text.WriteByte('\t')
+				case "br", "cr":
+					text.WriteByte('\n')
+				}
+			case xml.EndElement:
+				switch t.Name.Local {
+				case "t":
+					inText = false
+				case "p":
+					text.WriteByte('\n')
+				}
+			case xml.CharData:
+				if inText {
+					text.Write(t)
+				}
+			}
+		}
+		return text.String(), nil
+	}
+	return "", fmt.Errorf("invalid DOCX file: no word/document.xml")
+}
+
+// Store the text extracted from the document of a message
+func (store *MessageStore) StoreDocumentText(messageID, chatJID, text string) error {
+	_, err := store.db.Exec("UPDATE messages SET document_text = ?, document_text_at = ? WHERE id = ? AND chat_jid = ?", text, time.Now(), messageID, chatJID)
+	return err
+}
+
+// Get the text extracted from the document of a message, ok is false if it
+// wasn't extracted yet
+func (store *MessageStore) DocumentText(messageID, chatJID string) (text string, ok bool) {
+	var extracted sql.NullString
+	err := store.db.QueryRow("SELECT document_text FROM messages WHERE id = ? AND chat_jid = ? AND document_text_at IS NOT NULL", messageID, chatJID).Scan(&extracted)
+	return extracted.String, err == nil
+}
+
+// documentJob is a downloaded document waiting for its text to be extracted
+type documentJob struct {
+	messageID, chatJID, path string
+}
+
+// Downloaded documents waiting for the extraction worker
+var documentQueue = make(chan documentJob, 256)
+
+// Queue a downloaded document for text extraction, unless it is off
+func queueDocumentText(messageID, chatJID, mediaType, path string) {
+	if mediaType != "document" {
+		return
+	}
+	if _, ok := loadDocumentConfig(); !ok {
+		return
+	}
+	select {
+	case documentQueue <- documentJob{messageID, chatJID, path}:
+	default:
+		bridgeLog.Warnf("Document queue is full, skipping document of message %s", messageID)
+	}
+}
+
+// Extract the text of queued documents one at a time. Does nothing unless
+// WHATSAPP_EXTRACT_DOCUMENTS or WHATSAPP_DOCUMENT_EXTRACT_URL is set.
+func runDocumentWorker(messageStore *MessageStore) {
+	cfg, ok := loadDocumentConfig()
+	if !ok {
+		return
+	}
+	bridgeLog.Infof("Extracting the text of downloaded documents")
+	for job := range documentQueue {
+		func() {
+			defer recoverPanic("extracting text of document of message %s", job.messageID)
+			if _, done := messageStore.DocumentText(job.messageID, job.chatJID); done {
+				return
+			}
+			text, err := extractDocumentText(cfg, job.path)
+			if err != nil {
+				// Left for the document text API to retry
+				bridgeLog.Warnf("Failed to extract text of document of message %s: %v", job.messageID, err)
+				return
+			}
+			if err := messageStore.StoreDocumentText(job.messageID, job.chatJID, text); err != nil {
+				bridgeLog.Warnf("Failed to store text of document of message %s: %v", job.messageID, err)
+			}
+		}()
+	}
+}
+
+// Download a received document so its text gets extracted, if enabled
+func handleDocumentText(client *whatsmeow.Client, messageStore *MessageStore, msg Message) {
+	if msg.MediaType != "document" {
+		return
+	}
+	if cfg, ok := loadDocumentConfig(); !ok || !cfg.AutoDownload {
+		return
+	}
+	goSafe("downloading a document for text extraction", func() {
+		// downloadMedia queues the document
+		if _, _, _, _, err := downloadMedia(context.Background(), client, messageStore, msg.ID, msg.ChatJID); err != nil {
+			bridgeLog.Warnf("Failed to download document of message %s for text extraction: %v", msg.ID, err)
+		}
+	})
+}
+
+// DocumentTextRequest represents the request body for the document text API
+type DocumentTextRequest struct {
+	ChatJID string `json:"chat_jid"`
+	Force   bool   `json:"force,omitempty"` // Extract the text again even if it was before
+}
+
+// DocumentTextResponse represents the response for the document text API
+type DocumentTextResponse struct {
+	Success   bool   `json:"success"`
+	MessageID string `json:"message_id"`
+	ChatJID   string `json:"chat_jid"`
+	Filename  string `json:"filename,omitempty"`
+	Text      string `json:"text"`
+	Cached    bool   `json:"cached,omitempty"` // The text was extracted before
+}
+
+// Register the REST handler extracting the text of a document on demand
+func registerDocumentHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/messages/{id}/document_text",
+		Summary:  "Extract the text of the document (PDF, DOCX, ...) of a message, downloading it if needed; the text is stored with the message and searchable",
+		Tag:      "media",
+		Scope:    ScopeReadMessages,
+		Params:   []apiParam{{Name: "id", In: "path", Description: "ID of the message", Required: true}},
+		Request:  DocumentTextRequest{},
+		Response: DocumentTextResponse{},
+	})
+	http.HandleFunc("POST /api/messages/{id}/document_text", func(w http.ResponseWriter, r *http.Request) {
+		var req DocumentTextRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		messageID := r.PathValue("id")
+		if req.ChatJID == "" {
+			writeError(w, ErrCodeInvalidRequest, "chat_jid is required", nil)
+			return
+		}
+		cfg, ok := loadDocumentConfig()
+		if !ok {
+			writeError(w, ErrCodeInvalidRequest, "Document text extraction is off, set WHATSAPP_EXTRACT_DOCUMENTS=true or WHATSAPP_DOCUMENT_EXTRACT_URL", nil)
+			return
+		}
+
+		resp := DocumentTextResponse{Success: true, MessageID: messageID, ChatJID: req.ChatJID}
+		if text, done := messageStore.DocumentText(messageID, req.ChatJID); done && !req.Force {
+			resp.Text, resp.Cached = text, true
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+
+		_, mediaType, filename, path, err := downloadMedia(r.Context(), client, messageStore, messageID, req.ChatJID)
+		if err != nil {
+			writeAPIError(w, "Failed to download document", err)
+			return
+		}
+		if mediaType != "document" {
+			writeError(w, ErrCodeUnsupportedMedia, fmt.Sprintf("Message %s is %s media, not a document", messageID, mediaType), nil)
+			return
+		}
+		resp.Filename = filename
+		if resp.Text, err = extractDocumentText(cfg, path); err != nil {
+			writeAPIError(w, "Failed to extract text", err)
+			return
+		}
+		if err := messageStore.StoreDocumentText(messageID, req.ChatJID, resp.Text); err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to store extracted text: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
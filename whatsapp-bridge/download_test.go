@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+// Store an image message whose media the fake client serves from directPath
+func storeTestImage(t *testing.T, id, chatJID, directPath string) {
+	t.Helper()
+	storeTestMessage(t, Message{ID: id, ChatJID: chatJID, Sender: "15551239000", MediaType: "image", Filename: id + ".jpg"},
+		"https://mmg.whatsapp.net"+directPath+"?ccb=11-4", []byte("media-key"), 5)
+}
+
+func TestDownloadMedia(t *testing.T) {
+	client := setupTest(t)
+	storeTestImage(t, "DL1", "15551239001@s.whatsapp.net", "/v/t62/dl-1.enc")
+	client.with(func(c *fakeClient) { c.media["/v/t62/dl-1.enc"] = []byte("image") })
+
+	req := DownloadMediaRequest{MessageID: "DL1", ChatJID: "15551239001@s.whatsapp.net"}
+	var resp DownloadMediaResponse
+	status := postJSON(t, "/api/download", req, &resp)
+	if status != 200 || !resp.Success {
+		t.Fatalf("Got status %d: %+v", status, resp)
+	}
+	data, err := os.ReadFile(resp.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "image" {
+		t.Errorf("Saved %q, want the downloaded media", data)
+	}
+
+	// The saved copy is served the second time
+	var again DownloadMediaResponse
+	if status := postJSON(t, "/api/download", req, &again); status != 200 || again.Path != resp.Path {
+		t.Fatalf("Got status %d: %+v", status, again)
+	}
+	client.with(func(c *fakeClient) {
+		if c.downloads != 1 {
+			t.Errorf("Downloaded %d times, want once", c.downloads)
+		}
+	})
+}
+
+func TestDownloadExpiredMedia(t *testing.T) {
+	client := setupTest(t)
+	storeTestImage(t, "DL2", "15551239002@s.whatsapp.net", "/v/t62/dl-2.enc")
+
+	// The fake client has no media at the path, as if it had expired
+	req := DownloadMediaRequest{MessageID: "DL2", ChatJID: "15551239002@s.whatsapp.net"}
+	var resp ErrorResponse
+	status := postJSON(t, "/api/download", req, &resp)
+	expectError(t, status, resp, 202, ErrCodeMediaRetryPending)
+
+	client.with(func(c *fakeClient) {
+		if len(c.retries) != 1 || c.retries[0].ID != "DL2" {
+			t.Fatalf("Got media retry requests %+v, want one for DL2", c.retries)
+		}
+	})
+	retry, err := testStore.GetMediaRetry("DL2", "15551239002@s.whatsapp.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry.Status != mediaRetryRequested {
+		t.Errorf("Got retry status %q, want %q", retry.Status, mediaRetryRequested)
+	}
+
+	// Asking again doesn't send the sender another request while one is pending
+	postJSON(t, "/api/download", req, &resp)
+	client.with(func(c *fakeClient) {
+		if len(c.retries) != 1 {
+			t.Errorf("Sent %d media retry requests, want 1", len(c.retries))
+		}
+	})
+}
+
+func TestDownloadFailures(t *testing.T) {
+	setupTest(t)
+	storeTestMessage(t, Message{ID: "DL3", ChatJID: "15551239003@s.whatsapp.net", Sender: "15551239000", Content: "just text"}, "", nil, 0)
+	storeTestImage(t, "DL4", "15551239003@s.whatsapp.net", "/v/t62/dl-4.enc")
+
+	tests := []struct {
+		name   string
+		req    DownloadMediaRequest
+		err    error
+		status int
+		code   ErrorCode
+	}{
+		{"no message ID", DownloadMediaRequest{ChatJID: "15551239003@s.whatsapp.net"}, nil, 400, ErrCodeInvalidRequest},
+		{"unknown message", DownloadMediaRequest{MessageID: "NOPE", ChatJID: "15551239003@s.whatsapp.net"}, nil, 404, ErrCodeNotFound},
+		{"text message", DownloadMediaRequest{MessageID: "DL3", ChatJID: "15551239003@s.whatsapp.net"}, nil, 400, ErrCodeInvalidRequest},
+		{"download error", DownloadMediaRequest{MessageID: "DL4", ChatJID: "15551239003@s.whatsapp.net"}, errors.New("connection reset"), 502, ErrCodeDownloadFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := setupTest(t)
+			client.with(func(c *fakeClient) { c.downloadErr = tt.err })
+
+			var resp ErrorResponse
+			status := postJSON(t, "/api/download", tt.req, &resp)
+			expectError(t, status, resp, tt.status, tt.code)
+		})
+	}
+}
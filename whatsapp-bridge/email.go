@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Port SMTP servers take TLS connections on, instead of STARTTLS
+const smtpsPort = 465
+
+// How long delivering one email to the SMTP server may take
+const smtpTimeout = 2 * time.Minute
+
+// Largest media file attached to forwarded emails, WHATSAPP_EMAIL_MAX_ATTACHMENT_MB
+func emailMaxAttachmentBytes() int64 {
+	return int64(envInt("WHATSAPP_EMAIL_MAX_ATTACHMENT_MB", 20)) << 20
+}
+
+// Email a message that matched a watch to its address, with its media
+// attached when it can be downloaded
+func emailWatchMatch(client *whatsmeow.Client, messageStore *MessageStore, w *Watch, msg Message, chatName string) error {
+	from := envString("WHATSAPP_SMTP_FROM", envString("WHATSAPP_SMTP_USERNAME", ""))
+	if from == "" {
+		return fmt.Errorf("no sender address, set WHATSAPP_SMTP_FROM")
+	}
+	names := &senderNames{store: messageStore, names: map[string]string{}}
+	sender := names.name(msg)
+
+	subject := fmt.Sprintf("%s: %s in %s", w.Name, sender, chatName)
+	body := fmt.Sprintf("%s wrote in %s on %s:\n\n%s\n\nForwarded by the WhatsApp bridge for watch %q.\n",
+		sender, chatName, msg.Time.Format("2006-01-02 15:04"), relayText(msg), w.Name)
+	attachment := forwardableMediaPath(client, messageStore, msg, emailMaxAttachmentBytes())
+
+	message, err := buildEmail(from, w.EmailTo, subject, body, attachment)
+	if err != nil {
+		return err
+	}
+	return deliverEmail(from, w.EmailTo, message)
+}
+
+// Build a plain text email, as multipart/mixed with the file if one is given
+func buildEmail(from, to, subject, body, attachmentPath string) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(key, value string) { fmt.Fprintf(&buf, "%s: %s\r\n", key, value) }
+	header("From", from)
+	header("To", to)
+	header("Subject", mime.QEncoding.Encode("utf-8", subject))
+	header("Date", time.Now().Format(time.RFC1123Z))
+	header("Message-ID", emailMessageID(from))
+	header("MIME-Version", "1.0")
+
+	text := strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n")
+	if attachmentPath == "" {
+		header("Content-Type", `text/plain; charset="utf-8"`)
+		header("Content-Transfer-Encoding", "base64")
+		buf.WriteString("\r\n")
+		writeBase64Lines(&buf, []byte(text))
+		return buf.Bytes(), nil
+	}
+
+	data, err := os.ReadFile(attachmentPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read attachment: %v", err)
+	}
+	var parts bytes.Buffer
+	writer := multipart.NewWriter(&parts)
+	header("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": writer.Boundary()}))
+	buf.WriteString("\r\n")
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {`text/plain; charset="utf-8"`},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeBase64Lines(part, []byte(text))
+
+	name := filepath.Base(attachmentPath)
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	part, err = writer.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	writeBase64Lines(part, data)
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	buf.Write(parts.Bytes())
+	return buf.Bytes(), nil
+}
+
+// Write data as base64 in lines of 76 characters, as MIME requires
+func writeBase64Lines(w interface{ Write([]byte) (int, error) }, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		w.Write([]byte(encoded[:76] + "\r\n"))
+		encoded = encoded[76:]
+	}
+	w.Write([]byte(encoded + "\r\n"))
+}
+
+// Make a unique Message-ID in the domain of the sender
+func emailMessageID(from string) string {
+	domain := "whatsapp-bridge"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if at := strings.LastIndex(addr.Address, "@"); at >= 0 {
+			domain = addr.Address[at+1:]
+		}
+	}
+	random := make([]byte, 12)
+	rand.Read(random)
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(random), domain)
+}
+
+// Hand an email to the SMTP server set by WHATSAPP_SMTP_HOST and _PORT, over
+// TLS on port 465 and upgrading with STARTTLS where offered otherwise.
+// Credentials are only sent over TLS or to localhost.
+func deliverEmail(from, to string, message []byte) error {
+	host := envString("WHATSAPP_SMTP_HOST", "")
+	if host == "" {
+		return fmt.Errorf("no SMTP server, set WHATSAPP_SMTP_HOST")
+	}
+	port := envInt("WHATSAPP_SMTP_PORT", 587)
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: host}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if port == smtpsPort {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if port != smtpsPort {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(tlsConfig); err != nil {
+				return fmt.Errorf("STARTTLS failed: %v", err)
+			}
+		}
+	}
+	if user := envString("WHATSAPP_SMTP_USERNAME", ""); user != "" {
+		if err := c.Auth(smtp.PlainAuth("", user, envString("WHATSAPP_SMTP_PASSWORD", ""), host)); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %v", err)
+		}
+	}
+
+	fromAddr, err := mail.ParseAddress(from)
+	if err != nil {
+		return fmt.Errorf("invalid sender address %q: %v", from, err)
+	}
+	toAddr, err := mail.ParseAddress(to)
+	if err != nil {
+		return fmt.Errorf("invalid recipient address %q: %v", to, err)
+	}
+	if err := c.Mail(fromAddr.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(toAddr.Address); err != nil {
+		return err
+	}
+	data, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := data.Write(message); err != nil {
+		return err
+	}
+	if err := data.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
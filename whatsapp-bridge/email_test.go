@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Run an SMTP server accepting one email, which it sends to the channel
+func fakeSMTPServer(t *testing.T) (string, chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+		reply("220 localhost ready")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 localhost")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				var data strings.Builder
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					data.WriteString(line)
+				}
+				received <- data.String()
+				reply("250 queued")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestEmailWatchMatch(t *testing.T) {
+	addr, received := fakeSMTPServer(t)
+	host, port, _ := net.SplitHostPort(addr)
+	t.Setenv("WHATSAPP_SMTP_HOST", host)
+	t.Setenv("WHATSAPP_SMTP_PORT", port)
+	t.Setenv("WHATSAPP_SMTP_FROM", "bridge@example.com")
+
+	watch, err := WatchRequest{Name: "Invoices", Sender: "+1 555 126 0001", MediaType: "Document", EmailTo: "books@example.com"}.toWatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := Message{ID: "E1", ChatJID: "15551260001@s.whatsapp.net", Sender: "15551260001", MediaType: "document", Filename: "invoice.pdf", Content: "March invoice"}
+	if !watch.matches(msg) {
+		t.Fatalf("Watch %+v doesn't match a document from its sender", watch)
+	}
+	other := msg
+	other.Sender = "15551260002"
+	if watch.matches(other) {
+		t.Error("Watch matches a document from another sender")
+	}
+
+	if err := emailWatchMatch(nil, testStore, watch, msg, "Accountant"); err != nil {
+		t.Fatal(err)
+	}
+	email, err := mail.ReadMessage(strings.NewReader(<-received))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to := email.Header.Get("To"); to != "books@example.com" {
+		t.Errorf("Email went to %q", to)
+	}
+	if subject, _ := new(mime.WordDecoder).DecodeHeader(email.Header.Get("Subject")); subject != "Invoices: 15551260001 in Accountant" {
+		t.Errorf("Subject = %q", subject)
+	}
+}
+
+func TestBuildEmailAttachment(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "invoice.pdf")
+	if err := os.WriteFile(path, []byte(strings.Repeat("%PDF", 100)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data, err := buildEmail("bridge@example.com", "books@example.com", "Invoices: Ann in Ägypten", "See attached", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	email, err := mail.ReadMessage(strings.NewReader(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediaType, params, err := mime.ParseMediaType(email.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("Content-Type = %q, want multipart/mixed", email.Header.Get("Content-Type"))
+	}
+
+	reader := multipart.NewReader(email.Body, params["boundary"])
+	var filenames []string
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if part.FileName() != "" {
+			filenames = append(filenames, part.FileName())
+			if ct := part.Header.Get("Content-Type"); ct != "application/pdf" {
+				t.Errorf("Attachment Content-Type = %q, want application/pdf", ct)
+			}
+		}
+	}
+	if len(filenames) != 1 || filenames[0] != "invoice.pdf" {
+		t.Errorf("Attachments = %v, want invoice.pdf", filenames)
+	}
+}
+
+func TestEmailWatchNeedsSMTP(t *testing.T) {
+	t.Setenv("WHATSAPP_SMTP_HOST", "")
+	if _, err := (WatchRequest{Name: "Docs", MediaType: "document", EmailTo: "books@example.com"}).toWatch(); err == nil {
+		t.Error("Accepted an email watch without an SMTP server")
+	}
+	t.Setenv("WHATSAPP_SMTP_HOST", "smtp.example.com")
+	if _, err := (WatchRequest{Name: "Docs", MediaType: "document", EmailTo: "not an address"}).toWatch(); err == nil {
+		t.Error("Accepted an invalid email address")
+	}
+}
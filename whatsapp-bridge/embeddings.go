@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Maximum number of results of a semantic search
+const maxSemanticResults = 100
+
+// Client for the embeddings endpoint
+var embeddingsClient = &http.Client{Timeout: 60 * time.Second}
+
+// Wakes the embeddings worker up when a message arrives
+var embeddingsNudge = make(chan struct{}, 1)
+
+// Messages stored before this are only embedded with WHATSAPP_EMBEDDINGS_BACKFILL
+var embeddingsStart = time.Now()
+
+// embeddingsConfig is where message text is sent to be turned into vectors.
+// Any OpenAI compatible /v1/embeddings endpoint works, including local ones
+// like Ollama or LM Studio.
+type embeddingsConfig struct {
+	URL    string
+	Model  string
+	APIKey string
+	Batch  int
+}
+
+// Get the embeddings settings, ok is false if no endpoint is configured
+func loadEmbeddingsConfig() (embeddingsConfig, bool) {
+	cfg := embeddingsConfig{
+		URL:    envString("WHATSAPP_EMBEDDINGS_URL", ""),
+		Model:  envString("WHATSAPP_EMBEDDINGS_MODEL", "text-embedding-3-small"),
+		APIKey: envString("WHATSAPP_EMBEDDINGS_API_KEY", ""),
+		Batch:  max(envInt("WHATSAPP_EMBEDDINGS_BATCH", 32), 1),
+	}
+	return cfg, cfg.URL != ""
+}
+
+// Turn texts into unit vectors with the embeddings endpoint
+func embedTexts(cfg embeddingsConfig, texts []string) ([][]float32, error) {
+	body, err := json.Marshal(map[string]interface{}{"model": cfg.Model, "input": texts})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid embeddings URL: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "whatsapp-bridge")
+	if cfg.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+	}
+
+	resp, err := embeddingsClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("embeddings endpoint returned HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+
+	var result struct {
+		Data []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid embeddings response: %v", err)
+	}
+	if len(result.Data) != len(texts) {
+		return nil, fmt.Errorf("embeddings endpoint returned %d vectors for %d texts", len(result.Data), len(texts))
+	}
+	vectors := make([][]float32, len(texts))
+	for i, d := range result.Data {
+		if d.Index < 0 || d.Index >= len(texts) {
+			d.Index = i
+		}
+		vectors[d.Index] = normalizeVector(d.Embedding)
+	}
+	return vectors, nil
+}
+
+// Scale a vector to unit length, so cosine similarity is a dot product
+func normalizeVector(v []float32) []float32 {
+	var sum float64
+	for _, x := range v {
+		sum += float64(x) * float64(x)
+	}
+	if sum == 0 {
+		return v
+	}
+	norm := float32(math.Sqrt(sum))
+	for i := range v {
+		v[i] /= norm
+	}
+	return v
+}
+
+// Encode a vector as little-endian float32s
+func encodeVector(v []float32) []byte {
+	buf := make([]byte, 4*len(v))
+	for i, x := range v {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(x))
+	}
+	return buf
+}
+
+// Dot product of a vector and an encoded vector, 0 if their sizes differ
+func dotEncoded(v []float32, encoded []byte) float64 {
+	if len(encoded) != 4*len(v) {
+		return 0
+	}
+	var dot float64
+	for i, x := range v {
+		dot += float64(x) * float64(math.Float32frombits(binary.LittleEndian.Uint32(encoded[4*i:])))
+	}
+	return dot
+}
+
+// Get messages with text that have no vector for a model yet, newest first
+func (store *MessageStore) messagesToEmbed(model string, since time.Time, limit int) ([]Message, error) {
+	rows, err := store.db.Query(
+		`SELECT `+messageColumns+` FROM messages
+		WHERE content != '' AND COALESCE(is_revoked, 0) = 0 AND timestamp >= ?
+			AND NOT EXISTS (SELECT 1 FROM message_embeddings e
+				WHERE e.message_id = messages.id AND e.chat_jid = messages.chat_jid AND e.model = ?)
+		ORDER BY timestamp DESC LIMIT ?`,
+		since.Local(), model, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+// Store the vectors of messages
+func (store *MessageStore) StoreEmbeddings(model string, messages []Message, vectors [][]float32) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	for i, msg := range messages {
+		if _, err := tx.Exec(
+			"INSERT OR REPLACE INTO message_embeddings (message_id, chat_jid, model, vector, created_at) VALUES (?, ?, ?, ?, ?)",
+			msg.ID, msg.ChatJID, model, encodeVector(vectors[i]), now,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Let the embeddings worker know a message with text was stored
+func handleEmbedding(msg Message) {
+	if msg.Content == "" {
+		return
+	}
+	select {
+	case embeddingsNudge <- struct{}{}:
+	default:
+	}
+}
+
+// Embed new messages in batches as they arrive, and the ones stored before
+// with WHATSAPP_EMBEDDINGS_BACKFILL. Does nothing unless
+// WHATSAPP_EMBEDDINGS_URL is set.
+func runEmbeddingsWorker(messageStore *MessageStore) {
+	cfg, ok := loadEmbeddingsConfig()
+	if !ok {
+		return
+	}
+	since := embeddingsStart
+	if envBool("WHATSAPP_EMBEDDINGS_BACKFILL", false) {
+		since = time.Time{}
+	}
+	bridgeLog.Infof("Embedding messages with %s at %s", cfg.Model, cfg.URL)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-embeddingsNudge:
+		case <-ticker.C:
+		}
+		// Let messages arriving together go in one batch
+		time.Sleep(2 * time.Second)
+		embedPendingMessages(cfg, messageStore, since)
+	}
+}
+
+// Embed the messages since a time that have no vector yet, batch by batch,
+// until none are left or a batch fails
+func embedPendingMessages(cfg embeddingsConfig, messageStore *MessageStore, since time.Time) {
+	defer recoverPanic("embedding messages")
+	for {
+		messages, err := messageStore.messagesToEmbed(cfg.Model, since, cfg.Batch)
+		if err != nil {
+			bridgeLog.Warnf("Failed to list messages to embed: %v", err)
+			return
+		}
+		if len(messages) == 0 {
+			return
+		}
+		texts := make([]string, len(messages))
+		for i, msg := range messages {
+			texts[i] = msg.Content
+		}
+		vectors, err := embedTexts(cfg, texts)
+		if err != nil {
+			// Tried again on the next tick
+			bridgeLog.Warnf("Failed to embed messages: %v", err)
+			return
+		}
+		if err := messageStore.StoreEmbeddings(cfg.Model, messages, vectors); err != nil {
+			bridgeLog.Warnf("Failed to store message embeddings: %v", err)
+			return
+		}
+		bridgeLog.Debugf("Embedded %d messages", len(messages))
+	}
+}
+
+// SemanticMatch is a message found by meaning, with its cosine similarity to the query
+type SemanticMatch struct {
+	Score   float64 `json:"score"`
+	Message Message `json:"message"`
+}
+
+// Find the messages closest in meaning to a query vector, best first, by a
+// full scan of the stored vectors of a model
+func (store *MessageStore) SemanticSearch(model string, query []float32, chatJID string, minScore float64, limit int) ([]SemanticMatch, error) {
+	sqlQuery := "SELECT message_id, chat_jid, vector FROM message_embeddings WHERE model = ?"
+	args := []interface{}{model}
+	if chatJID != "" {
+		sqlQuery += " AND chat_jid = ?"
+		args = append(args, chatJID)
+	}
+	rows, err := store.db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	type hit struct {
+		id, chatJID string
+		score       float64
+	}
+	var hits []hit
+	for rows.Next() {
+		var h hit
+		var vector []byte
+		if err := rows.Scan(&h.id, &h.chatJID, &vector); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if h.score = dotEncoded(query, vector); h.score >= minScore {
+			hits = append(hits, h)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(hits, func(i, j int) bool { return hits[i].score > hits[j].score })
+
+	// Messages deleted since they were embedded are skipped
+	matches := []SemanticMatch{}
+	for _, h := range hits {
+		if len(matches) == limit {
+			break
+		}
+		rows, err := store.db.Query("SELECT "+messageColumns+" FROM messages WHERE id = ? AND chat_jid = ?", h.id, h.chatJID)
+		if err != nil {
+			return nil, err
+		}
+		messages, err := scanMessages(rows)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) > 0 && !messages[0].Revoked {
+			matches = append(matches, SemanticMatch{Score: h.score, Message: messages[0]})
+		}
+	}
+	return matches, nil
+}
+
+// SemanticSearchRequest represents the request body for the semantic search API
+type SemanticSearchRequest struct {
+	Query    string  `json:"query"`
+	ChatJID  string  `json:"chat_jid,omitempty"`
+	Limit    int     `json:"limit,omitempty"`     // Default 10, at most 100
+	MinScore float64 `json:"min_score,omitempty"` // Minimum cosine similarity
+}
+
+// SemanticSearchResponse represents the response for the semantic search API
+type SemanticSearchResponse struct {
+	Success bool            `json:"success"`
+	Model   string          `json:"model"`
+	Results []SemanticMatch `json:"results"`
+}
+
+// Register the REST handler searching messages by meaning
+func registerEmbeddingsHandlers(messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/messages/semantic-search",
+		Summary:  "Find the messages closest in meaning to a query, using the embeddings of WHATSAPP_EMBEDDINGS_URL",
+		Tag:      "search",
+		Scope:    ScopeReadMessages,
+		Request:  SemanticSearchRequest{},
+		Response: SemanticSearchResponse{},
+	})
+	http.HandleFunc("POST /api/messages/semantic-search", func(w http.ResponseWriter, r *http.Request) {
+		var req SemanticSearchRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		req.Query = strings.TrimSpace(req.Query)
+		if req.Query == "" {
+			writeError(w, ErrCodeInvalidRequest, "query is required", nil)
+			return
+		}
+		if req.Limit <= 0 {
+			req.Limit = 10
+		}
+		req.Limit = min(req.Limit, maxSemanticResults)
+
+		cfg, ok := loadEmbeddingsConfig()
+		if !ok {
+			writeError(w, ErrCodeInvalidRequest, "Semantic search needs an embeddings endpoint, set WHATSAPP_EMBEDDINGS_URL", nil)
+			return
+		}
+		vectors, err := embedTexts(cfg, []string{req.Query})
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to embed query: %v", err), nil)
+			return
+		}
+		results, err := messageStore.SemanticSearch(cfg.Model, vectors[0], req.ChatJID, req.MinScore, req.Limit)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to search messages: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, SemanticSearchResponse{Success: true, Model: cfg.Model, Results: results})
+	})
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Types of extracted entities
+const (
+	EntityPhone   = "phone"
+	EntityEmail   = "email"
+	EntityIBAN    = "iban"
+	EntityAddress = "address"
+)
+
+// Patterns of the entities recognized in message text
+var (
+	emailRe = regexp.MustCompile(`\b[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}\b`)
+	ibanRe  = regexp.MustCompile(`(?i)\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,3})?\b`)
+	phoneRe = regexp.MustCompile(`(?:\+|\()?\b\d(?:[ .\-/]?\(?\d+\)?){2,}\b`)
+	// Number first, street suffix last: 221B Baker Street, 1600 Amphitheatre Pkwy
+	streetFirstRe = regexp.MustCompile(`\b\d{1,5}[A-Za-z]?\s+(?:[A-Z][\w'.-]*\s+){1,4}(?:Street|St|Avenue|Ave|Road|Rd|Boulevard|Blvd|Lane|Ln|Drive|Dr|Way|Court|Ct|Place|Pl|Square|Sq|Parkway|Pkwy|Terrace|Highway|Hwy)\b\.?(?:,\s*[A-Z][\w'.-]*(?:\s+[A-Z][\w'.-]*)*)?(?:,?\s+[A-Z]{2}\s+\d{5})?`)
+	// Street type first, number last: Via Roma 12, Rue de Rivoli 99, Calle Mayor 5
+	streetLastRe = regexp.MustCompile(`\b(?:Via|Viale|Piazza|Piazzale|Corso|Largo|Vicolo|Rue|Boulevard|Avenue|Place|Calle|Avenida|Plaza|Paseo|Rua|Praça)\s+(?:(?:[A-Z][\w'.-]*|d[ei]|del|della|des|du|la|le)\s+){0,4}[A-Z][\w'.-]*,?\s+\d{1,5}[A-Za-z]?\b(?:,\s*\d{4,5}\s+[A-Z][\w'-]*)?`)
+	// Germanic compound streets: Hauptstraße 5, Kalverstraat 12
+	compoundStreetRe = regexp.MustCompile(`\b[A-Z][\p{L}-]*(?:straße|strasse|str\.|weg|platz|gasse|allee|straat|gracht|laan|plein|vej|gatan|gata)\s+\d{1,4}[A-Za-z]?\b(?:,\s*\d{4,5}\s+[A-Z][\p{L}-]*)?`)
+)
+
+// Digits a phone number has, per E.164 and the shortest numbers worth keeping.
+// Bare digit runs need more to tell them from order numbers and such.
+const (
+	minPhoneDigits     = 7
+	minBarePhoneDigits = 9
+	maxPhoneDigits     = 15
+)
+
+// ExtractedEntity is a piece of structured data found in a message, at the
+// character range [start, end) of its text
+type ExtractedEntity struct {
+	ID         int64     `json:"id"`
+	MessageID  string    `json:"message_id"`
+	ChatJID    string    `json:"chat_jid"`
+	ChatName   string    `json:"chat_name,omitempty"`
+	Sender     string    `json:"sender"`
+	Type       string    `json:"type"` // phone, email, iban or address
+	Value      string    `json:"value"`
+	Normalized string    `json:"normalized"` // Digits of a phone number, lowercase email, compact IBAN
+	Start      int       `json:"start"`
+	End        int       `json:"end"`
+	Time       time.Time `json:"timestamp"`
+}
+
+// Check an IBAN's checksum
+func validIBAN(iban string) bool {
+	if len(iban) < 15 || len(iban) > 34 {
+		return false
+	}
+	var digits strings.Builder
+	for _, c := range iban[4:] + iban[:4] {
+		switch {
+		case c >= '0' && c <= '9':
+			digits.WriteRune(c)
+		case c >= 'A' && c <= 'Z':
+			fmt.Fprintf(&digits, "%d", c-'A'+10)
+		default:
+			return false
+		}
+	}
+	n, ok := new(big.Int).SetString(digits.String(), 10)
+	return ok && new(big.Int).Mod(n, big.NewInt(97)).Int64() == 1
+}
+
+// Normalize a phone number to its digits, keeping an international prefix as +
+func normalizePhone(value string) string {
+	var digits strings.Builder
+	for _, c := range value {
+		if c >= '0' && c <= '9' {
+			digits.WriteRune(c)
+		}
+	}
+	number := digits.String()
+	switch {
+	case strings.HasPrefix(value, "+"):
+		return "+" + number
+	case strings.HasPrefix(value, "00"):
+		return "+" + number[2:]
+	}
+	return number
+}
+
+// Whether a pattern matches a whole value
+func wholeMatch(re *regexp.Regexp, value string) bool {
+	loc := re.FindStringIndex(value)
+	return loc != nil && loc[0] == 0 && loc[1] == len(value)
+}
+
+// Find the phone numbers, emails, IBANs and addresses in a text. Entities
+// don't overlap: IBANs are found first, then emails, addresses and phone
+// numbers last, as the others hold digit runs that pass for one.
+func extractEntities(text string) []ExtractedEntity {
+	var entities []ExtractedEntity
+	var taken [][2]int
+	overlaps := func(loc []int) bool {
+		for _, t := range taken {
+			if loc[0] < t[1] && t[0] < loc[1] {
+				return true
+			}
+		}
+		return false
+	}
+	add := func(kind string, loc []int, normalized string) {
+		taken = append(taken, [2]int{loc[0], loc[1]})
+		entities = append(entities, ExtractedEntity{
+			Type:       kind,
+			Value:      text[loc[0]:loc[1]],
+			Normalized: normalized,
+			Start:      utf8.RuneCountInString(text[:loc[0]]),
+			End:        utf8.RuneCountInString(text[:loc[1]]),
+		})
+	}
+
+	for _, loc := range ibanRe.FindAllStringIndex(text, -1) {
+		iban := strings.ToUpper(strings.ReplaceAll(text[loc[0]:loc[1]], " ", ""))
+		if validIBAN(iban) {
+			add(EntityIBAN, loc, iban)
+		}
+	}
+	for _, loc := range emailRe.FindAllStringIndex(text, -1) {
+		if !overlaps(loc) {
+			add(EntityEmail, loc, strings.ToLower(text[loc[0]:loc[1]]))
+		}
+	}
+	for _, re := range []*regexp.Regexp{streetFirstRe, streetLastRe, compoundStreetRe} {
+		for _, loc := range re.FindAllStringIndex(text, -1) {
+			if !overlaps(loc) {
+				add(EntityAddress, loc, strings.Join(strings.Fields(text[loc[0]:loc[1]]), " "))
+			}
+		}
+	}
+	for _, loc := range phoneRe.FindAllStringIndex(text, -1) {
+		value := text[loc[0]:loc[1]]
+		phone := normalizePhone(value)
+		digits := len(strings.TrimPrefix(phone, "+"))
+		if digits < minPhoneDigits || digits > maxPhoneDigits || overlaps(loc) {
+			continue
+		}
+		if digits < minBarePhoneDigits && len(value) == digits {
+			continue
+		}
+		// Dates and times have enough digits to pass for a number
+		if wholeMatch(isoDateRe, value) || wholeMatch(numericDateRe, value) || wholeMatch(clockTimeRe, value) {
+			continue
+		}
+		add(EntityPhone, loc, phone)
+	}
+
+	sort.Slice(entities, func(i, j int) bool { return entities[i].Start < entities[j].Start })
+	return entities
+}
+
+// Store the entities of a message
+func (store *MessageStore) IndexEntities(msg Message) error {
+	for _, e := range extractEntities(msg.Content) {
+		_, err := store.db.Exec(
+			`INSERT OR IGNORE INTO extracted_entities
+			(message_id, chat_jid, sender, type, value, normalized, span_start, span_end, timestamp)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			msg.ID, msg.ChatJID, msg.Sender, e.Type, e.Value, e.Normalized, e.Start, e.End, msg.Time,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Extract the entities of all stored messages, once
+func (store *MessageStore) BackfillEntities() error {
+	var done bool
+	if _, err := store.GetSetting("entities_indexed", &done); err != nil || done {
+		return err
+	}
+
+	rows, err := store.db.Query(
+		"SELECT " + messageColumns + " FROM messages WHERE content GLOB '*[0-9@]*'",
+	)
+	if err != nil {
+		return err
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		if err := store.IndexEntities(msg); err != nil {
+			return err
+		}
+	}
+	bridgeLog.Infof("Extracted the entities of %d stored messages", len(messages))
+	return store.StoreSetting("entities_indexed", true)
+}
+
+// Extract the entities of a new message unless disabled
+func handleEntityExtraction(messageStore *MessageStore, msg Message) {
+	if msg.Content == "" || !envBool("WHATSAPP_EXTRACT_ENTITIES", true) {
+		return
+	}
+	if err := messageStore.IndexEntities(msg); err != nil {
+		bridgeLog.Warnf("Failed to store extracted entities: %v", err)
+	}
+}
+
+// EntityFilter describes which entities ListEntities returns
+type EntityFilter struct {
+	ChatJID string
+	Sender  string
+	Types   []string
+	Query   string // Substring of the value or normalized value
+	After   *time.Time
+	Before  *time.Time
+	Limit   int
+	Offset  int
+}
+
+// List extracted entities matching a filter, newest first
+func (store *MessageStore) ListEntities(f EntityFilter) ([]ExtractedEntity, error) {
+	var conditions []string
+	var args []interface{}
+	if f.ChatJID != "" {
+		conditions = append(conditions, "e.chat_jid = ?")
+		args = append(args, f.ChatJID)
+	}
+	if f.Sender != "" {
+		conditions = append(conditions, "e.sender = ?")
+		args = append(args, f.Sender)
+	}
+	if len(f.Types) > 0 {
+		conditions = append(conditions, "e.type IN (?"+strings.Repeat(", ?", len(f.Types)-1)+")")
+		for _, t := range f.Types {
+			args = append(args, t)
+		}
+	}
+	if f.Query != "" {
+		conditions = append(conditions, "(LOWER(e.value) LIKE LOWER(?) OR e.normalized LIKE LOWER(?))")
+		args = append(args, "%"+f.Query+"%", "%"+f.Query+"%")
+	}
+	if f.After != nil {
+		conditions = append(conditions, "e.timestamp > ?")
+		args = append(args, f.After.Local())
+	}
+	if f.Before != nil {
+		conditions = append(conditions, "e.timestamp < ?")
+		args = append(args, f.Before.Local())
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, f.Limit, f.Offset)
+
+	rows, err := store.db.Query(
+		`SELECT e.id, e.message_id, e.chat_jid, COALESCE(c.name, ''), e.sender, e.type, e.value, e.normalized,
+			e.span_start, e.span_end, e.timestamp
+		FROM extracted_entities e LEFT JOIN chats c ON c.jid = e.chat_jid`+where+`
+		ORDER BY e.timestamp DESC, e.span_start LIMIT ? OFFSET ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entities := []ExtractedEntity{}
+	for rows.Next() {
+		var e ExtractedEntity
+		if err := rows.Scan(&e.ID, &e.MessageID, &e.ChatJID, &e.ChatName, &e.Sender, &e.Type, &e.Value, &e.Normalized,
+			&e.Start, &e.End, &e.Time); err != nil {
+			return nil, err
+		}
+		entities = append(entities, e)
+	}
+	return entities, rows.Err()
+}
+
+// ListEntitiesResponse represents the response for the extracted entities API
+type ListEntitiesResponse struct {
+	Success  bool              `json:"success"`
+	Entities []ExtractedEntity `json:"entities"`
+	Page
+}
+
+// Register the REST handler listing the entities extracted from messages
+func registerEntityHandlers(messageStore *MessageStore) {
+	goSafe("extracting entities of stored messages", func() {
+		if err := messageStore.BackfillEntities(); err != nil {
+			bridgeLog.Warnf("Failed to extract entities of stored messages: %v", err)
+		}
+	})
+
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/extracted/entities",
+		Summary: "List phone numbers, emails, IBANs and addresses found in messages, with their position in the text, newest first",
+		Tag:     "extracted",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "chat_jid", Description: "Only entities found in this chat"},
+			{Name: "sender", Description: "Only entities sent by this sender"},
+			{Name: "type", Description: "Comma-separated entity types: phone, email, iban, address"},
+			{Name: "query", Description: "Text to search for in the value, e.g. part of a number"},
+			{Name: "after_time", Description: "Only entities sent after this time" + timeFormatsHint},
+			{Name: "before_time", Description: "Only entities sent before this time" + timeFormatsHint},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ListEntitiesResponse{},
+	})
+	http.HandleFunc("GET /api/extracted/entities", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		f := EntityFilter{ChatJID: q.Get("chat_jid"), Sender: q.Get("sender"), Query: q.Get("query"), Types: splitList(q.Get("type"))}
+		for _, t := range f.Types {
+			if t != EntityPhone && t != EntityEmail && t != EntityIBAN && t != EntityAddress {
+				writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("Unknown entity type %s, use phone, email, iban or address", t), nil)
+				return
+			}
+		}
+		var err error
+		if f.Limit, f.Offset, err = parsePagination(r); err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if f.After, err = parseTimeParam(r, "after_time"); err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if f.Before, err = parseTimeParam(r, "before_time"); err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		limit := f.Limit
+		f.Limit++
+		entities, err := messageStore.ListEntities(f)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list extracted entities: %v", err), nil)
+			return
+		}
+		entities, page := trimPage(entities, f.Offset, limit)
+		writeJSON(w, http.StatusOK, ListEntitiesResponse{Success: true, Entities: entities, Page: page})
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// ErrorCode is a machine-readable error code returned by the REST API
+type ErrorCode string
+
+// Error codes shared by all endpoints
+const (
+	ErrCodeInvalidRequest    ErrorCode = "invalid_request"
+	ErrCodeMethodNotAllowed  ErrorCode = "method_not_allowed"
+	ErrCodeUnauthorized      ErrorCode = "unauthorized"
+	ErrCodeForbidden         ErrorCode = "forbidden"
+	ErrCodeNotFound          ErrorCode = "not_found"
+	ErrCodeConflict          ErrorCode = "conflict"
+	ErrCodePayloadTooLarge   ErrorCode = "payload_too_large"
+	ErrCodeNotConnected      ErrorCode = "not_connected"
+	ErrCodeUnsupportedMedia  ErrorCode = "unsupported_media"
+	ErrCodeMediaUnavailable  ErrorCode = "media_unavailable"
+	ErrCodeMediaRetryPending ErrorCode = "media_retry_pending"
+	ErrCodeUploadFailed      ErrorCode = "upload_failed"
+	ErrCodeDownloadFailed    ErrorCode = "download_failed"
+	ErrCodeSendFailed        ErrorCode = "send_failed"
+	ErrCodeTimeout           ErrorCode = "timeout"
+	ErrCodeInternal          ErrorCode = "internal_error"
+)
+
+// HTTP status and default retryability of every error code
+var errorCodeInfo = map[ErrorCode]struct {
+	status    int
+	retryable bool
+}{
+	ErrCodeInvalidRequest:    {http.StatusBadRequest, false},
+	ErrCodeMethodNotAllowed:  {http.StatusMethodNotAllowed, false},
+	ErrCodeUnauthorized:      {http.StatusUnauthorized, false},
+	ErrCodeForbidden:         {http.StatusForbidden, false},
+	ErrCodeNotFound:          {http.StatusNotFound, false},
+	ErrCodeConflict:          {http.StatusConflict, false},
+	ErrCodePayloadTooLarge:   {http.StatusRequestEntityTooLarge, false},
+	ErrCodeNotConnected:      {http.StatusServiceUnavailable, true},
+	ErrCodeUnsupportedMedia:  {http.StatusUnsupportedMediaType, false},
+	ErrCodeMediaUnavailable:  {http.StatusGone, false},
+	ErrCodeMediaRetryPending: {http.StatusAccepted, true},
+	ErrCodeUploadFailed:      {http.StatusBadGateway, true},
+	ErrCodeDownloadFailed:    {http.StatusBadGateway, true},
+	ErrCodeSendFailed:        {http.StatusBadGateway, true},
+	ErrCodeTimeout:           {http.StatusGatewayTimeout, true},
+	ErrCodeInternal:          {http.StatusInternalServerError, false},
+}
+
+// ErrorResponse is the error envelope returned by every endpoint
+type ErrorResponse struct {
+	Success   bool        `json:"success"`
+	Code      ErrorCode   `json:"code"`
+	Message   string      `json:"message"`
+	Retryable bool        `json:"retryable"`
+	Details   interface{} `json:"details,omitempty"`
+}
+
+// StatusResponse is the envelope for successful operations that return no data
+type StatusResponse struct {
+	Success bool   `json:"success"`
+	Message string `json:"message"`
+}
+
+// APIError is an error carrying the code to report to API clients
+type APIError struct {
+	Code    ErrorCode
+	Message string
+	Details interface{}
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+// Create an APIError with a formatted message
+func newAPIError(code ErrorCode, format string, args ...interface{}) *APIError {
+	return &APIError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Get the HTTP status for an error code
+func statusForCode(code ErrorCode) int {
+	if info, ok := errorCodeInfo[code]; ok {
+		return info.status
+	}
+	return http.StatusInternalServerError
+}
+
+// Write a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Write an error envelope for the given code
+func writeError(w http.ResponseWriter, code ErrorCode, message string, details interface{}) {
+	writeJSON(w, statusForCode(code), ErrorResponse{
+		Success:   false,
+		Code:      code,
+		Message:   message,
+		Retryable: errorCodeInfo[code].retryable,
+		Details:   details,
+	})
+}
+
+// Write an error envelope for any error, using its code if it is an APIError.
+// The prefix describes the failed operation, e.g. "Failed to download media".
+func writeAPIError(w http.ResponseWriter, prefix string, err error) {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		apiErr = newCallError(ErrCodeInternal, err, "%v", err)
+	}
+
+	message := apiErr.Message
+	if prefix != "" {
+		message = fmt.Sprintf("%s: %s", prefix, message)
+	}
+	writeError(w, apiErr.Code, message, apiErr.Details)
+}
+
+// Reject requests whose method doesn't match, returns false if the request was rejected
+func requireMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method != method {
+		writeError(w, ErrCodeMethodNotAllowed, "Method not allowed", nil)
+		return false
+	}
+	return true
+}
+
+// Decode a JSON request body, returns false if the body was invalid and an error was written
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, ErrCodePayloadTooLarge, fmt.Sprintf("Request body is larger than %d bytes", tooLarge.Limit), nil)
+			return false
+		}
+		writeError(w, ErrCodeInvalidRequest, "Invalid request format", map[string]string{"error": err.Error()})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Maximum number of messages in one export
+const maxExportMessages = 1000
+
+// MessageRef identifies a stored message
+type MessageRef struct {
+	ChatJID   string `json:"chat_jid"`
+	MessageID string `json:"message_id"`
+}
+
+// ExportRequest represents the request body for the message export API
+type ExportRequest struct {
+	Messages      []MessageRef `json:"messages"`
+	SkipMedia     bool         `json:"skip_media,omitempty"` // Only the transcript, without downloading media
+	AllowViewOnce bool         `json:"allow_view_once,omitempty"`
+	Title         string       `json:"title,omitempty"` // Heading of the HTML transcript
+}
+
+// ExportedMessage is a message as written to an export's transcript
+type ExportedMessage struct {
+	Message
+	ChatName   string    `json:"chat_name"`
+	SenderName string    `json:"sender_name"`
+	MediaFile  string    `json:"media_file,omitempty"` // Path of the media inside the archive
+	MediaError ErrorCode `json:"media_error,omitempty"`
+}
+
+// ExportTranscript is the transcript.json of an export
+type ExportTranscript struct {
+	Title      string            `json:"title,omitempty"`
+	ExportedAt time.Time         `json:"exported_at"`
+	Messages   []ExportedMessage `json:"messages"` // Chronological
+	Missing    []MessageRef      `json:"missing,omitempty"`
+}
+
+// Get stored messages by reference, in chronological order, along with the
+// references that matched no message
+func (store *MessageStore) GetMessagesByRef(refs []MessageRef) ([]Message, []MessageRef, error) {
+	stmt, err := store.db.Prepare("SELECT " + messageColumns + " FROM messages WHERE id = ? AND chat_jid = ?")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer stmt.Close()
+
+	messages := []Message{}
+	var missing []MessageRef
+	seen := map[MessageRef]bool{}
+	for _, ref := range refs {
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		rows, err := stmt.Query(ref.MessageID, ref.ChatJID)
+		if err != nil {
+			return nil, nil, err
+		}
+		found, err := scanMessages(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(found) == 0 {
+			missing = append(missing, ref)
+			continue
+		}
+		messages = append(messages, found[0])
+	}
+	sort.SliceStable(messages, func(i, j int) bool { return messages[i].Time.Before(messages[j].Time) })
+	return messages, missing, nil
+}
+
+// HTML rendering of an export's transcript, linking the media in the archive
+var exportHTML = template.Must(template.New("export").Funcs(template.FuncMap{
+	"isImage": func(m ExportedMessage) bool { return m.MediaType == "image" && m.MediaFile != "" },
+	"time":    func(t time.Time) string { return t.Local().Format("2006-01-02 15:04:05") },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{if .Title}}{{.Title}}{{else}}WhatsApp export{{end}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; }
+.msg { border-bottom: 1px solid #ddd; padding: .5em 0; }
+.meta { color: #666; font-size: .85em; }
+.content { white-space: pre-wrap; }
+img { max-width: 100%; }
+</style>
+</head>
+<body>
+<h1>{{if .Title}}{{.Title}}{{else}}WhatsApp export{{end}}</h1>
+<p class="meta">Exported {{time .ExportedAt}}, {{len .Messages}} messages</p>
+{{range .Messages}}<div class="msg">
+<div class="meta"><b>{{.SenderName}}</b> in {{.ChatName}}, {{time .Time}} &middot; {{.ID}}</div>
+{{if isImage .}}<img src="{{.MediaFile}}" alt="{{.Filename}}">
+{{else if .MediaFile}}<div><a href="{{.MediaFile}}">{{.MediaType}}: {{.Filename}}</a></div>
+{{else if .MediaType}}<div class="meta">[{{.MediaType}}{{if .Filename}}: {{.Filename}}{{end}}{{if .MediaError}}, not exported: {{.MediaError}}{{end}}]</div>
+{{end}}{{if .Content}}<div class="content">{{.Content}}</div>{{end}}
+</div>
+{{end}}{{if .Missing}}<h2>Not found</h2>
+<ul>{{range .Missing}}<li>{{.MessageID}} in {{.ChatJID}}</li>{{end}}</ul>
+{{end}}</body>
+</html>
+`))
+
+// Stream an export as a zip archive holding transcript.json, transcript.html
+// and the media of the messages under media/
+func writeExportZip(ctx context.Context, w http.ResponseWriter, client *whatsmeow.Client, messageStore *MessageStore, req ExportRequest, messages []Message, missing []MessageRef) error {
+	exportedAt := time.Now()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "whatsapp-export-"+exportedAt.Format("20060102-150405")+".zip"))
+	zw := zip.NewWriter(w)
+
+	transcript := ExportTranscript{Title: req.Title, ExportedAt: exportedAt, Messages: []ExportedMessage{}, Missing: missing}
+	names := &senderNames{store: messageStore, names: map[string]string{}}
+	chatNames := map[string]string{}
+	for _, m := range messages {
+		// Stop downloading once the client has gone away
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, ok := chatNames[m.ChatJID]; !ok {
+			chatNames[m.ChatJID] = messageStore.chatName(m.ChatJID)
+		}
+		exported := ExportedMessage{Message: m, ChatName: chatNames[m.ChatJID], SenderName: names.name(m)}
+
+		if _, err := whatsmeowMediaType(m.MediaType); err == nil && !req.SkipMedia {
+			file := downloadBulkFile(ctx, client, messageStore, m, req.AllowViewOnce)
+			if file.Path != "" {
+				exported.MediaFile = "media/" + m.ID + "_" + filepath.Base(file.Path)
+				if err := addFileToZip(zw, exported.MediaFile, file.Path); err != nil {
+					return err
+				}
+			} else {
+				exported.MediaError = file.ErrorCode
+			}
+		}
+		transcript.Messages = append(transcript.Messages, exported)
+	}
+
+	entry, err := zw.Create("transcript.json")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(entry)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(transcript); err != nil {
+		return err
+	}
+	if entry, err = zw.Create("transcript.html"); err != nil {
+		return err
+	}
+	if err := exportHTML.Execute(entry, transcript); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Register the REST handler exporting selected messages
+func registerExportHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:  http.MethodPost,
+		Path:    "/api/export/messages",
+		Summary: "Export selected messages, e.g. search results, as a zip archive streaming a JSON and an HTML transcript plus their media files",
+		Tag:     "media",
+		Scope:   ScopeReadMessages,
+		Audit:   true,
+		Request: ExportRequest{},
+	})
+	http.HandleFunc("POST /api/export/messages", func(w http.ResponseWriter, r *http.Request) {
+		var req ExportRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if len(req.Messages) == 0 {
+			writeError(w, ErrCodeInvalidRequest, "messages is required", nil)
+			return
+		}
+		if len(req.Messages) > maxExportMessages {
+			writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("At most %d messages can be exported at once", maxExportMessages), nil)
+			return
+		}
+		for _, ref := range req.Messages {
+			if strings.TrimSpace(ref.ChatJID) == "" || strings.TrimSpace(ref.MessageID) == "" {
+				writeError(w, ErrCodeInvalidRequest, "Every message needs a chat_jid and a message_id", nil)
+				return
+			}
+		}
+
+		messages, missing, err := messageStore.GetMessagesByRef(req.Messages)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to get messages: %v", err), nil)
+			return
+		}
+		if len(messages) == 0 {
+			writeError(w, ErrCodeNotFound, "None of the messages were found", missing)
+			return
+		}
+		// The archive is streamed, so a failure past this point can only cut it short
+		if err := writeExportZip(r.Context(), w, client, messageStore, req, messages, missing); err != nil {
+			bridgeLog.Warnf("Failed to stream export of %d messages: %v", len(messages), err)
+		}
+	})
+}
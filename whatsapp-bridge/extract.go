@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Sources of extracted events
+const (
+	EventSourceText = "text"
+	EventSourceICS  = "ics"
+)
+
+// ExtractedEvent is a calendar entry candidate found in a message
+type ExtractedEvent struct {
+	ID        int64      `json:"id"`
+	MessageID string     `json:"message_id"`
+	ChatJID   string     `json:"chat_jid"`
+	ChatName  string     `json:"chat_name,omitempty"`
+	Source    string     `json:"source"`
+	Title     string     `json:"title"`
+	Start     time.Time  `json:"start"`
+	End       *time.Time `json:"end,omitempty"`
+	AllDay    bool       `json:"all_day"`
+	Location  string     `json:"location,omitempty"`
+	Phrase    string     `json:"phrase,omitempty"` // The text the date was found in
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Store extracted events, ignoring ones already stored for the same message and start
+func (store *MessageStore) StoreExtractedEvents(events []ExtractedEvent) error {
+	for _, e := range events {
+		var end interface{}
+		if e.End != nil {
+			end = e.End.Local()
+		}
+		_, err := store.db.Exec(
+			`INSERT OR IGNORE INTO extracted_events
+			(message_id, chat_jid, source, title, start_time, end_time, all_day, location, phrase, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			e.MessageID, e.ChatJID, e.Source, e.Title, e.Start.Local(), end, e.AllDay, e.Location, e.Phrase, time.Now(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// List extracted events starting in a time range, soonest first
+func (store *MessageStore) ListExtractedEvents(chatJID string, after, before *time.Time, limit, offset int) ([]ExtractedEvent, error) {
+	var conditions []string
+	var args []interface{}
+	if chatJID != "" {
+		conditions = append(conditions, "e.chat_jid = ?")
+		args = append(args, chatJID)
+	}
+	if after != nil {
+		conditions = append(conditions, "e.start_time >= ?")
+		args = append(args, after.Local())
+	}
+	if before != nil {
+		conditions = append(conditions, "e.start_time < ?")
+		args = append(args, before.Local())
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit, offset)
+
+	rows, err := store.db.Query(
+		`SELECT e.id, e.message_id, e.chat_jid, COALESCE(c.name, ''), e.source, e.title, e.start_time, e.end_time,
+			e.all_day, COALESCE(e.location, ''), COALESCE(e.phrase, ''), e.created_at
+		FROM extracted_events e LEFT JOIN chats c ON c.jid = e.chat_jid`+where+`
+		ORDER BY e.start_time LIMIT ? OFFSET ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []ExtractedEvent{}
+	for rows.Next() {
+		var e ExtractedEvent
+		var end *time.Time
+		if err := rows.Scan(&e.ID, &e.MessageID, &e.ChatJID, &e.ChatName, &e.Source, &e.Title, &e.Start, &end,
+			&e.AllDay, &e.Location, &e.Phrase, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.End = end
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// Date and time patterns recognized in message text
+var (
+	monthPattern = `(jan|feb|mar|apr|may|jun|jul|aug|sep|oct|nov|dec)(?:uary|ruary|ch|il|e|y|ust|tember|t|ober|ember)?\.?`
+	ordinal      = `(?:st|nd|rd|th)?`
+
+	isoDateRe       = regexp.MustCompile(`\b(\d{4})-(\d{2})-(\d{2})\b`)
+	numericDateRe   = regexp.MustCompile(`\b(\d{1,2})/(\d{1,2})(?:/(\d{2,4}))?\b|\b(\d{1,2})\.(\d{1,2})\.(\d{2,4})\b`)
+	dayMonthRe      = regexp.MustCompile(`\b(\d{1,2})` + ordinal + `(?:\s+of)?\s+` + monthPattern + `(?:,?\s+(\d{4}))?\b`)
+	monthDayRe      = regexp.MustCompile(`\b` + monthPattern + `\s+(\d{1,2})` + ordinal + `(?:,?\s+(\d{4}))?\b`)
+	relativeDayRe   = regexp.MustCompile(`\b(today|tonight|tomorrow|(?:next\s+)?(?:monday|tuesday|wednesday|thursday|friday|saturday|sunday))\b`)
+	clockTimeRe     = regexp.MustCompile(`\b(\d{1,2})[:.h](\d{2})\s*(am|pm)?\b`)
+	meridiemTimeRe  = regexp.MustCompile(`\b(\d{1,2})\s*(am|pm)\b`)
+	namedTimeRe     = regexp.MustCompile(`\b(noon|midday|midnight)\b`)
+	explicitTimeRe  = regexp.MustCompile(`\bat\s+(\d{1,2}(?:[:.h]\d{2})?\s*(?:am|pm)?|noon|midnight)\b`)
+	weekdaysByName  = map[string]time.Weekday{"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday, "thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday}
+	monthsByPrefix  = map[string]time.Month{"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12}
+	timeSearchRange = 25 // Characters around a date searched for its time
+)
+
+// dateMention is a date found in a text, at the byte range [start, end)
+type dateMention struct {
+	date       time.Time
+	start, end int
+}
+
+// Build a date from its parts, guessing the year when it is missing so the date
+// isn't in the past. Returns false for impossible dates.
+func mentionedDate(year, month, day int, ref time.Time) (time.Time, bool) {
+	if month < 1 || month > 12 || day < 1 || day > 31 {
+		return time.Time{}, false
+	}
+	guessYear := year == 0
+	if guessYear {
+		year = ref.Year()
+	} else if year < 100 {
+		year += 2000
+	}
+	date := time.Date(year, time.Month(month), day, 0, 0, 0, 0, ref.Location())
+	if date.Day() != day {
+		return time.Time{}, false
+	}
+	if guessYear && date.Before(ref.AddDate(0, 0, -1)) {
+		date = date.AddDate(1, 0, 0)
+	}
+	return date, true
+}
+
+// Find the dates mentioned in a lowercase text
+func findDates(text string, ref time.Time) []dateMention {
+	var mentions []dateMention
+	add := func(date time.Time, ok bool, loc []int) {
+		if ok {
+			mentions = append(mentions, dateMention{date, loc[0], loc[1]})
+		}
+	}
+	atoi := func(s string) int {
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	dayFirst := envString("WHATSAPP_DATE_ORDER", "dmy") != "mdy"
+
+	for _, m := range isoDateRe.FindAllStringSubmatchIndex(text, -1) {
+		date, ok := mentionedDate(atoi(text[m[2]:m[3]]), atoi(text[m[4]:m[5]]), atoi(text[m[6]:m[7]]), ref)
+		add(date, ok, m)
+	}
+	for _, m := range numericDateRe.FindAllStringSubmatchIndex(text, -1) {
+		// Either the slash or the dotted alternative matched
+		groups := m[2:8]
+		if groups[0] < 0 {
+			groups = m[8:14]
+		}
+		day, month := atoi(text[groups[0]:groups[1]]), atoi(text[groups[2]:groups[3]])
+		if !dayFirst {
+			day, month = month, day
+		}
+		year := 0
+		if groups[4] >= 0 {
+			year = atoi(text[groups[4]:groups[5]])
+		}
+		date, ok := mentionedDate(year, month, day, ref)
+		add(date, ok, m)
+	}
+	for _, m := range dayMonthRe.FindAllStringSubmatchIndex(text, -1) {
+		year := 0
+		if m[6] >= 0 {
+			year = atoi(text[m[6]:m[7]])
+		}
+		date, ok := mentionedDate(year, int(monthsByPrefix[text[m[4]:m[5]]]), atoi(text[m[2]:m[3]]), ref)
+		add(date, ok, m)
+	}
+	for _, m := range monthDayRe.FindAllStringSubmatchIndex(text, -1) {
+		year := 0
+		if m[6] >= 0 {
+			year = atoi(text[m[6]:m[7]])
+		}
+		date, ok := mentionedDate(year, int(monthsByPrefix[text[m[2]:m[3]]]), atoi(text[m[4]:m[5]]), ref)
+		add(date, ok, m)
+	}
+
+	today := time.Date(ref.Year(), ref.Month(), ref.Day(), 0, 0, 0, 0, ref.Location())
+	for _, m := range relativeDayRe.FindAllStringIndex(text, -1) {
+		word := text[m[0]:m[1]]
+		switch word {
+		case "today", "tonight":
+			add(today, true, m)
+		case "tomorrow":
+			add(today.AddDate(0, 0, 1), true, m)
+		default:
+			// A weekday means its next occurrence, a week ahead when it is today
+			fields := strings.Fields(word)
+			weekday := weekdaysByName[fields[len(fields)-1]]
+			days := (int(weekday) - int(today.Weekday()) + 7) % 7
+			if days == 0 {
+				days = 7
+			}
+			add(today.AddDate(0, 0, days), true, m)
+		}
+	}
+
+	// Drop mentions overlapping an earlier, longer one (e.g. "5/10" inside "2026-05-10")
+	var result []dateMention
+	for _, m := range mentions {
+		overlaps := false
+		for _, other := range result {
+			if m.start < other.end && other.start < m.end {
+				overlaps = true
+				break
+			}
+		}
+		if !overlaps {
+			result = append(result, m)
+		}
+	}
+	return result
+}
+
+// Parse the time of day a lowercase fragment mentions, as hours and minutes
+func findTime(text string) (hour, minute int, ok bool) {
+	toHour := func(h int, meridiem string) int {
+		switch {
+		case meridiem == "pm" && h < 12:
+			return h + 12
+		case meridiem == "am" && h == 12:
+			return 0
+		}
+		return h
+	}
+	if m := clockTimeRe.FindStringSubmatch(text); m != nil {
+		h, _ := strconv.Atoi(m[1])
+		minute, _ := strconv.Atoi(m[2])
+		h = toHour(h, m[3])
+		if h < 24 && minute < 60 {
+			return h, minute, true
+		}
+	}
+	if m := meridiemTimeRe.FindStringSubmatch(text); m != nil {
+		h, _ := strconv.Atoi(m[1])
+		if h >= 1 && h <= 12 {
+			return toHour(h, m[2]), 0, true
+		}
+	}
+	if m := namedTimeRe.FindStringSubmatch(text); m != nil {
+		if m[1] == "midnight" {
+			return 0, 0, true
+		}
+		return 12, 0, true
+	}
+	return 0, 0, false
+}
+
+// Find event candidates in a message text sent at ref
+func extractTextEvents(text string, ref time.Time) []ExtractedEvent {
+	lower := strings.ToLower(text)
+	var events []ExtractedEvent
+
+	for _, mention := range findDates(lower, ref) {
+		// Look for a time right around the date
+		from, to := max(mention.start-timeSearchRange, 0), min(mention.end+timeSearchRange, len(lower))
+		window := strings.ToValidUTF8(lower[from:to], "")
+		event := ExtractedEvent{Source: EventSourceText, Start: mention.date, AllDay: true}
+		if hour, minute, ok := findTime(window); ok {
+			event.Start = mention.date.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+			event.AllDay = false
+		}
+		// Past dates aren't worth proposing as calendar entries
+		if event.Start.Before(ref.AddDate(0, 0, -1)) {
+			continue
+		}
+		event.Phrase = strings.TrimSpace(strings.ToValidUTF8(text[max(mention.start-timeSearchRange, 0):min(mention.end+timeSearchRange, len(text))], ""))
+		events = append(events, event)
+	}
+
+	// "Let's meet at 7pm" without a date means the next time it is 7pm
+	if len(events) == 0 {
+		if m := explicitTimeRe.FindStringIndex(lower); m != nil {
+			if hour, minute, ok := findTime(lower[m[0]:m[1]]); ok {
+				start := time.Date(ref.Year(), ref.Month(), ref.Day(), hour, minute, 0, 0, ref.Location())
+				if start.Before(ref) {
+					start = start.AddDate(0, 0, 1)
+				}
+				events = append(events, ExtractedEvent{Source: EventSourceText, Start: start, Phrase: text[m[0]:m[1]]})
+			}
+		}
+	}
+
+	for i := range events {
+		events[i].Title = truncateText(text, 80)
+	}
+	return events
+}
+
+// Parse an iCalendar date or date-time value
+func parseICSTime(value string, params map[string]string) (time.Time, bool, error) {
+	loc := time.Local
+	if tzid := params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	switch {
+	case params["VALUE"] == "DATE" || len(value) == 8:
+		t, err := time.ParseInLocation("20060102", value, time.Local)
+		return t, true, err
+	case strings.HasSuffix(value, "Z"):
+		t, err := time.Parse("20060102T150405Z", value)
+		return t, false, err
+	default:
+		t, err := time.ParseInLocation("20060102T150405", value, loc)
+		return t, false, err
+	}
+}
+
+// Undo iCalendar text escaping
+var icsUnescaper = strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`)
+
+// Parse the events of an iCalendar file
+func parseICS(path string) ([]ExtractedEvent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Unfold continuation lines first
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var events []ExtractedEvent
+	var current *ExtractedEvent
+	for _, line := range lines {
+		nameAndParams, value, found := strings.Cut(line, ":")
+		if !found {
+			continue
+		}
+		parts := strings.Split(nameAndParams, ";")
+		name := strings.ToUpper(parts[0])
+		params := make(map[string]string)
+		for _, p := range parts[1:] {
+			if k, v, ok := strings.Cut(p, "="); ok {
+				params[strings.ToUpper(k)] = strings.Trim(v, `"`)
+			}
+		}
+
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			current = &ExtractedEvent{Source: EventSourceICS}
+		case name == "END" && value == "VEVENT" && current != nil:
+			if !current.Start.IsZero() {
+				events = append(events, *current)
+			}
+			current = nil
+		case current == nil:
+		case name == "SUMMARY":
+			current.Title = icsUnescaper.Replace(value)
+		case name == "LOCATION":
+			current.Location = icsUnescaper.Replace(value)
+		case name == "DTSTART":
+			if t, allDay, err := parseICSTime(value, params); err == nil {
+				current.Start, current.AllDay = t, allDay
+			}
+		case name == "DTEND":
+			if t, _, err := parseICSTime(value, params); err == nil {
+				current.End = &t
+			}
+		}
+	}
+	return events, nil
+}
+
+// Whether a message's file is an iCalendar file
+func isICSFile(mediaType, filename string) bool {
+	return mediaType == "document" && strings.HasSuffix(strings.ToLower(filename), ".ics")
+}
+
+// Extract calendar entry candidates from a new message and store them. .ics
+// files are downloaded and parsed in the background.
+func handleEventExtraction(client *whatsmeow.Client, messageStore *MessageStore, msg Message) {
+	if !envBool("WHATSAPP_EXTRACT_EVENTS", true) {
+		return
+	}
+
+	if msg.Content != "" {
+		events := extractTextEvents(msg.Content, msg.Time.Local())
+		for i := range events {
+			events[i].MessageID, events[i].ChatJID = msg.ID, msg.ChatJID
+		}
+		if err := messageStore.StoreExtractedEvents(events); err != nil {
+			bridgeLog.Warnf("Failed to store extracted events: %v", err)
+		}
+	}
+
+	if isICSFile(msg.MediaType, msg.Filename) {
+		goSafe("extracting events from a calendar file", func() {
+			_, _, _, path, err := downloadMedia(context.Background(), client, messageStore, msg.ID, msg.ChatJID)
+			if err != nil {
+				bridgeLog.Warnf("Failed to download calendar file %s: %v", msg.Filename, err)
+				return
+			}
+			events, err := parseICS(path)
+			if err != nil {
+				bridgeLog.Warnf("Failed to parse calendar file %s: %v", msg.Filename, err)
+				return
+			}
+			for i := range events {
+				events[i].MessageID, events[i].ChatJID = msg.ID, msg.ChatJID
+				if events[i].Title == "" {
+					events[i].Title = msg.Filename
+				}
+			}
+			if err := messageStore.StoreExtractedEvents(events); err != nil {
+				bridgeLog.Warnf("Failed to store extracted events: %v", err)
+			}
+		})
+	}
+}
+
+// ListExtractedEventsResponse represents the response for the extracted events API
+type ListExtractedEventsResponse struct {
+	Success bool             `json:"success"`
+	Events  []ExtractedEvent `json:"events"`
+	Page
+}
+
+// Register the REST handler listing the events extracted from messages
+func registerExtractHandlers(messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/extracted/events",
+		Summary: "List calendar entry candidates found in messages (dates, times and .ics files), soonest first",
+		Tag:     "extracted",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "chat_jid", Description: "Only events found in this chat"},
+			{Name: "after_time", Description: "Only events starting at or after this time" + timeFormatsHint},
+			{Name: "before_time", Description: "Only events starting before this time" + timeFormatsHint},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ListExtractedEventsResponse{},
+	})
+	http.HandleFunc("GET /api/extracted/events", func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		after, err := parseTimeParam(r, "after_time")
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		before, err := parseTimeParam(r, "before_time")
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		events, err := messageStore.ListExtractedEvents(r.URL.Query().Get("chat_jid"), after, before, limit+1, offset)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list extracted events: %v", err), nil)
+			return
+		}
+		events, page := trimPage(events, offset, limit)
+		writeJSON(w, http.StatusOK, ListExtractedEventsResponse{Success: true, Events: events, Page: page})
+	})
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Per chat freshness, kept up to date as messages, read receipts and read
+// markers come in so the overview never has to scan messages
+const chatFreshnessSchema = `
+	CREATE TABLE chat_freshness (
+		chat_jid TEXT PRIMARY KEY,
+		last_incoming TIMESTAMP,
+		last_outgoing TIMESTAMP,
+		last_read TIMESTAMP,
+		unread_count INTEGER NOT NULL DEFAULT 0,
+		updated_at TIMESTAMP
+	);
+	CREATE INDEX idx_chat_freshness_updated ON chat_freshness(updated_at);
+	CREATE INDEX IF NOT EXISTS idx_messages_chat_timestamp ON messages(chat_jid, timestamp);
+`
+
+// Recompute the latest messages and unread count of chat_freshness rows from
+// the stored messages, keeping how far each chat was read
+const refreshChatFreshnessSQL = `UPDATE chat_freshness SET
+	last_incoming = (SELECT MAX(timestamp) FROM messages m WHERE m.chat_jid = chat_freshness.chat_jid AND m.is_from_me = 0),
+	last_outgoing = (SELECT MAX(timestamp) FROM messages m WHERE m.chat_jid = chat_freshness.chat_jid AND m.is_from_me = 1),
+	unread_count = (SELECT COUNT(*) FROM messages m WHERE m.chat_jid = chat_freshness.chat_jid AND m.is_from_me = 0
+		AND (chat_freshness.last_read IS NULL OR m.timestamp > chat_freshness.last_read)),
+	updated_at = ?`
+
+// Count the chats with unread messages
+const countUnreadChatsSQL = "SELECT COUNT(*) FROM chat_freshness WHERE unread_count > 0"
+
+// Create the freshness table if it doesn't exist yet, filling it from the
+// stored messages. Nothing tells how far chats were read before, so they
+// count as read up to their latest message.
+func initChatFreshness(db *sql.DB) error {
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'chat_freshness'").Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return nil
+	}
+
+	bridgeLog.Infof("Building chat freshness index...")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(chatFreshnessSchema); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO chat_freshness (chat_jid, last_read) SELECT chat_jid, MAX(timestamp) FROM messages GROUP BY chat_jid"); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(refreshChatFreshnessSQL, time.Now()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Record a newly stored message in the freshness of its chat. Sending a
+// message means the chat was read up to it.
+func recordChatFreshness(tx *sql.Tx, chatJID string, timestamp time.Time, isFromMe bool) error {
+	if !isFromMe {
+		_, err := tx.Exec(`INSERT INTO chat_freshness (chat_jid, last_incoming, unread_count, updated_at) VALUES (?, ?, 1, ?)
+			ON CONFLICT (chat_jid) DO UPDATE SET
+				last_incoming = CASE WHEN last_incoming IS NULL OR last_incoming < excluded.last_incoming THEN excluded.last_incoming ELSE last_incoming END,
+				unread_count = unread_count + CASE WHEN last_read IS NULL OR last_read < excluded.last_incoming THEN 1 ELSE 0 END,
+				updated_at = excluded.updated_at`,
+			chatJID, timestamp, time.Now(),
+		)
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO chat_freshness (chat_jid, last_outgoing, last_read, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (chat_jid) DO UPDATE SET
+			last_outgoing = CASE WHEN last_outgoing IS NULL OR last_outgoing < excluded.last_outgoing THEN excluded.last_outgoing ELSE last_outgoing END,
+			last_read = CASE WHEN last_read IS NULL OR last_read < excluded.last_read THEN excluded.last_read ELSE last_read END`,
+		chatJID, timestamp, timestamp, time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(refreshChatFreshnessSQL+" WHERE chat_jid = ?", time.Now(), chatJID)
+	return err
+}
+
+// Mark a chat as read up to a time, recounting what came in after it
+func (store *MessageStore) MarkChatRead(chatJID string, readAt time.Time) error {
+	_, err := store.db.Exec(`INSERT INTO chat_freshness (chat_jid, last_read) VALUES (?, ?)
+		ON CONFLICT (chat_jid) DO UPDATE SET
+			last_read = CASE WHEN last_read IS NULL OR last_read < excluded.last_read THEN excluded.last_read ELSE last_read END`,
+		chatJID, readAt.Local(),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = store.db.Exec(refreshChatFreshnessSQL+" WHERE chat_jid = ?", time.Now(), chatJID)
+	return err
+}
+
+// Mark a chat as unread like the app does, without forgetting how far it was
+// read
+func (store *MessageStore) MarkChatUnread(chatJID string) error {
+	_, err := store.db.Exec(`INSERT INTO chat_freshness (chat_jid, unread_count, updated_at) VALUES (?, 1, ?)
+		ON CONFLICT (chat_jid) DO UPDATE SET unread_count = MAX(unread_count, 1), updated_at = excluded.updated_at`,
+		chatJID, time.Now(),
+	)
+	return err
+}
+
+// Set the unread count a history sync reports for a chat, by reading the
+// chat up to the incoming message before the unread ones
+func (store *MessageStore) SetChatUnreadCount(chatJID string, unread int) error {
+	var readAt sql.NullTime
+	err := store.db.QueryRow(
+		"SELECT timestamp FROM messages WHERE chat_jid = ? AND is_from_me = 0 ORDER BY timestamp DESC LIMIT 1 OFFSET ?",
+		chatJID, unread,
+	).Scan(&readAt)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if !readAt.Valid {
+		// Everything stored is unread, only the recount is needed
+		_, err = store.db.Exec("INSERT OR IGNORE INTO chat_freshness (chat_jid) VALUES (?)", chatJID)
+		if err != nil {
+			return err
+		}
+		_, err = store.db.Exec(refreshChatFreshnessSQL+" WHERE chat_jid = ?", time.Now(), chatJID)
+		return err
+	}
+	return store.MarkChatRead(chatJID, readAt.Time)
+}
+
+// sqlExecer runs statements on either the database or a transaction
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Recompute the freshness of the chats whose messages were moved or deleted,
+// or of every chat if none are given
+func refreshChatFreshness(db sqlExecer, chatJIDs ...string) error {
+	if len(chatJIDs) == 0 {
+		_, err := db.Exec(refreshChatFreshnessSQL, time.Now())
+		return err
+	}
+	for _, jid := range chatJIDs {
+		if _, err := db.Exec(refreshChatFreshnessSQL+" WHERE chat_jid = ?", time.Now(), jid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Follow chats being read on our other devices
+func handleOwnReadReceipt(messageStore *MessageStore, evt *events.Receipt) {
+	if !evt.IsFromMe || (evt.Type != types.ReceiptTypeRead && evt.Type != types.ReceiptTypeReadSelf) {
+		return
+	}
+	if err := messageStore.MarkChatRead(evt.Chat.String(), evt.Timestamp); err != nil {
+		bridgeLog.Warnf("Failed to mark %s as read: %v", evt.Chat, err)
+	}
+}
+
+// Follow chats being marked as read or unread on our other devices
+func handleMarkChatAsRead(messageStore *MessageStore, evt *events.MarkChatAsRead) {
+	var err error
+	if evt.Action.GetRead() {
+		err = messageStore.MarkChatRead(evt.JID.String(), evt.Timestamp)
+	} else {
+		err = messageStore.MarkChatUnread(evt.JID.String())
+	}
+	if err != nil {
+		bridgeLog.Warnf("Failed to update read state of %s: %v", evt.JID, err)
+	}
+}
+
+// ChatOverview is the freshness of a chat
+type ChatOverview struct {
+	JID           string     `json:"jid"`
+	Name          string     `json:"name"`
+	LastIncoming  *time.Time `json:"last_incoming,omitempty"`
+	LastOutgoing  *time.Time `json:"last_outgoing,omitempty"`
+	LastRead      *time.Time `json:"last_read,omitempty"`
+	UnreadCount   int        `json:"unread_count"`
+	PriorityScore float64    `json:"priority_score"` // How urgently the chat needs a reply, see PriorityWeights
+	UpdatedAt     *time.Time `json:"updated_at,omitempty"`
+}
+
+// List chat freshness, most recently active chats first. With changedSince
+// only the chats updated after it are listed.
+func (store *MessageStore) ChatOverviews(unreadOnly bool, changedSince *time.Time, limit, offset int) ([]ChatOverview, error) {
+	query, args := chatOverviewsQuery(unreadOnly, changedSince, limit, offset)
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	chats := []ChatOverview{}
+	for rows.Next() {
+		var chat ChatOverview
+		var incoming, outgoing, read, updated sql.NullTime
+		if err := rows.Scan(&chat.JID, &chat.Name, &incoming, &outgoing, &read, &chat.UnreadCount, &updated); err != nil {
+			return nil, err
+		}
+		chat.LastIncoming = nullTimePtr(incoming)
+		chat.LastOutgoing = nullTimePtr(outgoing)
+		chat.LastRead = nullTimePtr(read)
+		chat.UpdatedAt = nullTimePtr(updated)
+		if chat.Name == "" {
+			chat.Name = chat.JID
+		}
+		chats = append(chats, chat)
+	}
+	return chats, rows.Err()
+}
+
+// Build the SELECT of ChatOverviews
+func chatOverviewsQuery(unreadOnly bool, changedSince *time.Time, limit, offset int) (string, []interface{}) {
+	query := `SELECT f.chat_jid, COALESCE(c.name, ''), f.last_incoming, f.last_outgoing, f.last_read, f.unread_count, f.updated_at
+		FROM chat_freshness f LEFT JOIN chats c ON c.jid = f.chat_jid WHERE 1=1`
+	var args []interface{}
+	if unreadOnly {
+		query += " AND f.unread_count > 0"
+	}
+	if changedSince != nil {
+		query += " AND f.updated_at > ?"
+		args = append(args, changedSince.Local())
+	}
+	query += " ORDER BY c.last_message_time DESC, f.chat_jid LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+	return query, args
+}
+
+// Get the time of a nullable column, nil if it is NULL
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// ChatOverviewResponse represents the response for the chat overview API
+type ChatOverviewResponse struct {
+	Success     bool           `json:"success"`
+	Chats       []ChatOverview `json:"chats"`
+	UnreadChats int            `json:"unread_chats"`
+	AsOf        time.Time      `json:"as_of"` // Pass as changed_since to the next poll
+	Page
+}
+
+// Register the REST handler for the chat overview
+func registerFreshnessHandlers(messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/chats/overview",
+		Summary: "List the last incoming, outgoing and read times and unread count of chats, cheap enough to poll frequently",
+		Tag:     "chats",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "unread_only", Description: "Only list chats with unread messages", Type: "boolean"},
+			{Name: "changed_since", Description: "Only list chats updated after this time, e.g. the as_of of the previous poll"},
+			{Name: "sort", Description: "recent (default) for the most recently active chats first, priority for the highest priority_score first"},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ChatOverviewResponse{},
+	})
+	http.HandleFunc("GET /api/chats/overview", func(w http.ResponseWriter, r *http.Request) {
+		asOf := time.Now()
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		changedSince, err := parseTimeParam(r, "changed_since")
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		unreadOnly, _ := strconv.ParseBool(r.URL.Query().Get("unread_only"))
+		sortBy := r.URL.Query().Get("sort")
+		if sortBy != "" && sortBy != "recent" && sortBy != "priority" {
+			writeError(w, ErrCodeInvalidRequest, "sort must be recent or priority", nil)
+			return
+		}
+		scorer, err := messageStore.newChatScorer(loadPriorityWeights())
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to load VIP contacts: %v", err), nil)
+			return
+		}
+
+		// Ranking by priority needs every chat, the score isn't stored
+		var chats []ChatOverview
+		if sortBy == "priority" {
+			chats, err = messageStore.ChatOverviews(unreadOnly, changedSince, -1, 0)
+		} else {
+			chats, err = messageStore.ChatOverviews(unreadOnly, changedSince, limit+1, offset)
+		}
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list chats: %v", err), nil)
+			return
+		}
+		var page Page
+		if sortBy == "priority" {
+			scorer.rank(chats)
+			total := len(chats)
+			chats = chats[min(offset, total):min(offset+limit, total)]
+			page = countedPage(offset, len(chats), total)
+		} else {
+			for i := range chats {
+				chats[i].PriorityScore = scorer.score(chats[i])
+			}
+			chats, page = trimPage(chats, offset, limit)
+		}
+		var unreadChats int
+		if err := messageStore.db.QueryRow(countUnreadChatsSQL).Scan(&unreadChats); err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to count unread chats: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, ChatOverviewResponse{Success: true, Chats: chats, UnreadChats: unreadChats, AsOf: asOf, Page: page})
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Default command transcoding a GIF into an MP4 WhatsApp clients can play,
+// {input} and {output} are replaced with the file paths. H.264 needs even
+// dimensions.
+const defaultGIFCommand = "ffmpeg -y -loglevel error -i {input} -movflags +faststart -pix_fmt yuv420p -vf scale=trunc(iw/2)*2:trunc(ih/2)*2 -an {output}"
+
+// Largest side of the thumbnail shown before a GIF or video is downloaded
+const videoThumbnailSize = 100
+
+// Make a JPEG thumbnail of an image, scaled to fit a square of the given size
+func jpegThumbnail(img image.Image, size int) ([]byte, error) {
+	b := img.Bounds()
+	scale := float64(size) / float64(max(b.Dx(), b.Dy(), 1))
+	w, h := max(int(float64(b.Dx())*scale), 1), max(int(float64(b.Dy())*scale), 1)
+	thumb := image.NewRGBA(image.Rect(0, 0, w, h))
+	// Transparent pixels are shown on white
+	draw.Draw(thumb, thumb.Bounds(), image.White, image.Point{}, draw.Src)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			src := b.Min.Add(image.Pt(x*b.Dx()/w, y*b.Dy()/h))
+			draw.Draw(thumb, image.Rect(x, y, x+1, y+1), img, src, draw.Over)
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, thumb, &jpeg.Options{Quality: 70}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Transcode a GIF into an MP4 with the GIF command
+func transcodeGIF(data []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "gif")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	input, output := filepath.Join(dir, "input.gif"), filepath.Join(dir, "output.mp4")
+	if err := os.WriteFile(input, data, 0600); err != nil {
+		return nil, err
+	}
+	vars := map[string]string{"input": input, "output": output}
+	if _, err := runCommandTemplate("WHATSAPP_GIF_COMMAND", defaultGIFCommand, vars, 2*time.Minute); err != nil {
+		return nil, err
+	}
+	return os.ReadFile(output)
+}
+
+// Turn an animated GIF into a looping video message: WhatsApp clients only
+// animate GIFs sent as MP4 videos flagged for GIF playback. Static GIFs are
+// left as images, and so are animated ones if transcoding fails.
+func prepareAnimatedGIF(out *outgoingMessage) {
+	anim, err := gif.DecodeAll(bytes.NewReader(out.MediaData))
+	if err != nil || len(anim.Image) < 2 {
+		return
+	}
+
+	var delay int
+	for _, d := range anim.Delay {
+		delay += d
+	}
+	mp4, err := transcodeGIF(out.MediaData)
+	if err != nil {
+		bridgeLog.Warnf("Failed to transcode GIF %s, sending it as an image: %v", filepath.Base(out.MediaPath), err)
+		return
+	}
+
+	// The first frame covers the whole canvas in practice, draw it on one anyway
+	first := image.NewRGBA(image.Rect(0, 0, anim.Config.Width, anim.Config.Height))
+	draw.Draw(first, anim.Image[0].Bounds(), anim.Image[0], anim.Image[0].Bounds().Min, draw.Over)
+	thumbnail, err := jpegThumbnail(first, videoThumbnailSize)
+	if err != nil {
+		bridgeLog.Warnf("Failed to make a thumbnail of GIF %s: %v", filepath.Base(out.MediaPath), err)
+	}
+
+	out.MediaData = mp4
+	out.MediaType = whatsmeow.MediaVideo
+	out.MimeType = "video/mp4"
+	out.GIFPlayback = true
+	out.Thumbnail = thumbnail
+	out.Width, out.Height = uint32(anim.Config.Width), uint32(anim.Config.Height)
+	// Delays are in hundredths of a second
+	out.Seconds = uint32(max((delay+99)/100, 1))
+}
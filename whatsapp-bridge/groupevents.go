@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/proto/waCommon"
+	"go.mau.fi/whatsmeow/proto/waE2E" // The legacy aliases lack the maybe response
+	"go.mau.fi/whatsmeow/proto/waWeb"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// Media type of stored group event messages
+const mediaTypeEvent = "event"
+
+// RSVP responses to a group event
+const (
+	EventResponseGoing    = "going"
+	EventResponseNotGoing = "not_going"
+	EventResponseMaybe    = "maybe"
+)
+
+// EventLocation is where a group event takes place
+type EventLocation struct {
+	Name      string   `json:"name,omitempty"`
+	Address   string   `json:"address,omitempty"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+}
+
+// EventRSVP is a group member's response to an event
+type EventRSVP struct {
+	Responder   string    `json:"responder"`
+	Response    string    `json:"response"`
+	ExtraGuests int       `json:"extra_guests,omitempty"`
+	Time        time.Time `json:"timestamp"`
+}
+
+// GroupEvent is an event created in a group with WhatsApp Events
+type GroupEvent struct {
+	ChatJID            string         `json:"chat_jid"`
+	MessageID          string         `json:"message_id"`
+	Creator            string         `json:"creator,omitempty"`
+	Name               string         `json:"name"`
+	Description        string         `json:"description,omitempty"`
+	StartTime          time.Time      `json:"start_time"`
+	EndTime            *time.Time     `json:"end_time,omitempty"`
+	Location           *EventLocation `json:"location,omitempty"`
+	JoinLink           string         `json:"join_link,omitempty"` // Call link of events held as a call
+	Canceled           bool           `json:"canceled,omitempty"`
+	ExtraGuestsAllowed bool           `json:"extra_guests_allowed,omitempty"`
+	CreatedAt          time.Time      `json:"created_at"`
+	Going              int            `json:"going"`     // Members going, extra guests included
+	NotGoing           int            `json:"not_going"` // Members not going
+	Maybe              int            `json:"maybe"`     // Members who might go
+	Responses          []EventRSVP    `json:"responses"`
+}
+
+// Extract the group event a message creates or edits, nil if it isn't an event message
+func extractGroupEvent(m *waProto.Message) *GroupEvent {
+	ev := m.GetEventMessage()
+	if ev == nil {
+		return nil
+	}
+	e := GroupEvent{
+		Name:               ev.GetName(),
+		Description:        ev.GetDescription(),
+		StartTime:          time.Unix(ev.GetStartTime(), 0),
+		JoinLink:           ev.GetJoinLink(),
+		Canceled:           ev.GetIsCanceled(),
+		ExtraGuestsAllowed: ev.GetExtraGuestsAllowed(),
+	}
+	if end := ev.GetEndTime(); end > 0 {
+		t := time.Unix(end, 0)
+		e.EndTime = &t
+	}
+	if loc := ev.GetLocation(); loc != nil {
+		e.Location = &EventLocation{Name: loc.GetName(), Address: loc.GetAddress()}
+		if loc.DegreesLatitude != nil && loc.DegreesLongitude != nil {
+			e.Location.Latitude, e.Location.Longitude = loc.DegreesLatitude, loc.DegreesLongitude
+		}
+	}
+	return &e
+}
+
+// Describe an event as message content, so it shows up in listings and search
+func (e *GroupEvent) Summary() string {
+	var b strings.Builder
+	if e.Canceled {
+		b.WriteString("Event cancelled: ")
+	} else {
+		b.WriteString("Event: ")
+	}
+	fmt.Fprintf(&b, "%s (%s)", e.Name, e.StartTime.Local().Format("2006-01-02 15:04"))
+	if e.Location != nil && e.Location.Name != "" {
+		b.WriteString(" at " + e.Location.Name)
+	}
+	if e.Description != "" {
+		b.WriteString(" - " + e.Description)
+	}
+	return b.String()
+}
+
+// Build the event message of a group event, with the message secret members'
+// responses are encrypted with
+func (e *GroupEvent) toMessage() *waProto.Message {
+	ev := &waProto.EventMessage{
+		Name:               proto.String(e.Name),
+		StartTime:          proto.Int64(e.StartTime.Unix()),
+		ExtraGuestsAllowed: proto.Bool(e.ExtraGuestsAllowed),
+		IsCanceled:         proto.Bool(false),
+	}
+	if e.Description != "" {
+		ev.Description = proto.String(e.Description)
+	}
+	if e.EndTime != nil {
+		ev.EndTime = proto.Int64(e.EndTime.Unix())
+	}
+	if loc := e.Location; loc != nil {
+		ev.Location = &waProto.LocationMessage{Name: proto.String(loc.Name), Address: proto.String(loc.Address)}
+		if loc.Latitude != nil && loc.Longitude != nil {
+			ev.Location.DegreesLatitude, ev.Location.DegreesLongitude = loc.Latitude, loc.Longitude
+		}
+	}
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &waProto.Message{
+		EventMessage:       ev,
+		MessageContextInfo: &waProto.MessageContextInfo{MessageSecret: secret},
+	}
+}
+
+// Name a WhatsApp RSVP response, "" if unknown
+func eventResponseName(r waE2E.EventResponseMessage_EventResponseType) string {
+	switch r {
+	case waE2E.EventResponseMessage_GOING:
+		return EventResponseGoing
+	case waE2E.EventResponseMessage_NOT_GOING:
+		return EventResponseNotGoing
+	case waE2E.EventResponseMessage_MAYBE:
+		return EventResponseMaybe
+	}
+	return ""
+}
+
+// Store a group event, updating it when the event was edited. The creator and
+// creation time of an already stored event are kept.
+func (store *MessageStore) StoreGroupEvent(e *GroupEvent) error {
+	var location EventLocation
+	if e.Location != nil {
+		location = *e.Location
+	}
+	_, err := store.db.Exec(
+		`INSERT INTO group_events (message_id, chat_jid, creator, name, description, start_time, end_time, location_name,
+			location_address, latitude, longitude, join_link, canceled, extra_guests_allowed, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (message_id, chat_jid) DO UPDATE SET
+			creator = COALESCE(NULLIF(group_events.creator, ''), excluded.creator),
+			name = excluded.name, description = excluded.description, start_time = excluded.start_time,
+			end_time = excluded.end_time, location_name = excluded.location_name, location_address = excluded.location_address,
+			latitude = excluded.latitude, longitude = excluded.longitude, join_link = excluded.join_link,
+			canceled = excluded.canceled, extra_guests_allowed = excluded.extra_guests_allowed, updated_at = excluded.updated_at`,
+		e.MessageID, e.ChatJID, e.Creator, e.Name, e.Description, e.StartTime, e.EndTime, location.Name,
+		location.Address, location.Latitude, location.Longitude, e.JoinLink, e.Canceled, e.ExtraGuestsAllowed, e.CreatedAt, time.Now(),
+	)
+	return err
+}
+
+// Store a member's response to an event, unless a later one is already known
+func (store *MessageStore) StoreEventResponse(eventID, chatJID string, rsvp EventRSVP) error {
+	_, err := store.db.Exec(
+		`INSERT INTO group_event_responses (message_id, chat_jid, responder, response, extra_guests, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (message_id, chat_jid, responder) DO UPDATE SET
+			response = excluded.response, extra_guests = excluded.extra_guests, timestamp = excluded.timestamp
+		WHERE excluded.timestamp >= group_event_responses.timestamp`,
+		eventID, chatJID, rsvp.Responder, rsvp.Response, rsvp.ExtraGuests, rsvp.Time,
+	)
+	return err
+}
+
+// Record the event a stored message creates
+func handleGroupEvent(messageStore *MessageStore, id, chatJID, creator string, timestamp time.Time, e *GroupEvent) {
+	if e == nil {
+		return
+	}
+	e.ChatJID, e.MessageID, e.Creator, e.CreatedAt = chatJID, id, creator, timestamp
+	if err := messageStore.StoreGroupEvent(e); err != nil {
+		bridgeLog.Warnf("Failed to store event of message %s: %v", id, err)
+	}
+}
+
+// Record the responses history sync carries along with an event message
+func handleHistoryEventResponses(client *whatsmeow.Client, messageStore *MessageStore, info *waWeb.WebMessageInfo, chat types.JID) {
+	for _, r := range info.GetEventResponses() {
+		response := eventResponseName(r.GetEventResponseMessage().GetResponse())
+		if response == "" {
+			continue
+		}
+		responder := eventResponder(client, r.GetEventResponseMessageKey(), chat)
+		rsvp := EventRSVP{
+			Responder:   responder,
+			Response:    response,
+			ExtraGuests: int(r.GetEventResponseMessage().GetExtraGuestCount()),
+			Time:        time.UnixMilli(r.GetTimestampMS()),
+		}
+		if err := messageStore.StoreEventResponse(info.GetKey().GetID(), chat.String(), rsvp); err != nil {
+			bridgeLog.Warnf("Failed to store response to event %s: %v", info.GetKey().GetID(), err)
+		}
+	}
+}
+
+// Get who sent a message from its key
+func eventResponder(client *whatsmeow.Client, key *waCommon.MessageKey, chat types.JID) string {
+	switch {
+	case key.GetFromMe() && client.Store.ID != nil:
+		return client.Store.ID.ToNonAD().String()
+	case key.GetParticipant() != "":
+		if jid, err := types.ParseJID(key.GetParticipant()); err == nil {
+			return jid.ToNonAD().String()
+		}
+		return key.GetParticipant()
+	}
+	return chat.ToNonAD().String()
+}
+
+// Decrypt a member's response to an event. Responses are encrypted with a key
+// derived from the secret of the event message, the way whatsmeow decrypts
+// poll votes, which it offers no function for yet.
+func decryptEventResponse(client *whatsmeow.Client, msg *events.Message, enc *waProto.EncEventResponseMessage) (*waProto.EventResponseMessage, error) {
+	key := enc.GetEventCreationMessageKey()
+	creator := msg.Info.Sender
+	if !key.GetFromMe() {
+		jid := key.GetParticipant()
+		if jid == "" {
+			jid = key.GetRemoteJID()
+		}
+		var err error
+		if creator, err = types.ParseJID(jid); err != nil {
+			return nil, fmt.Errorf("invalid event creator %q: %v", jid, err)
+		}
+	}
+	secret, creator, err := client.Store.MsgSecrets.GetMessageSecret(context.Background(), msg.Info.Chat, creator, key.GetID())
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("secret of event %s is unknown", key.GetID())
+	}
+
+	responder := msg.Info.Sender.ToNonAD().String()
+	info := key.GetID() + creator.ToNonAD().String() + responder + string(whatsmeow.EncSecretEventResponse)
+	aesKey, err := hkdf.Key(sha256.New, secret, nil, info, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, enc.GetEncIV(), enc.GetEncPayload(), []byte(key.GetID()+"\x00"+responder))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %v", err)
+	}
+	var response waProto.EventResponseMessage
+	if err := proto.Unmarshal(plaintext, &response); err != nil {
+		return nil, err
+	}
+	return &response, nil
+}
+
+// Record a member's live response to an event
+func handleEventResponse(client *whatsmeow.Client, messageStore *MessageStore, msg *events.Message, enc *waProto.EncEventResponseMessage) {
+	eventID := enc.GetEventCreationMessageKey().GetID()
+	response, err := decryptEventResponse(client, msg, enc)
+	if err != nil {
+		bridgeLog.Warnf("Failed to decrypt response to event %s: %v", eventID, err)
+		return
+	}
+	name := eventResponseName(response.GetResponse())
+	if name == "" {
+		return
+	}
+	rsvp := EventRSVP{
+		Responder:   msg.Info.Sender.ToNonAD().String(),
+		Response:    name,
+		ExtraGuests: int(response.GetExtraGuestCount()),
+		Time:        msg.Info.Timestamp,
+	}
+	if ms := response.GetTimestampMS(); ms > 0 {
+		rsvp.Time = time.UnixMilli(ms)
+	}
+	if err := messageStore.StoreEventResponse(eventID, msg.Info.Chat.String(), rsvp); err != nil {
+		bridgeLog.Warnf("Failed to store response to event %s: %v", eventID, err)
+	}
+}
+
+// Apply an edit or cancellation of an event by its creator
+func handleEventEdit(client *whatsmeow.Client, messageStore *MessageStore, msg *events.Message, enc *waProto.SecretEncryptedMessage) {
+	eventID := enc.GetTargetMessageKey().GetID()
+	edited, err := client.DecryptSecretEncryptedMessage(context.Background(), msg)
+	if err != nil {
+		bridgeLog.Warnf("Failed to decrypt edit of event %s: %v", eventID, err)
+		return
+	}
+	e := extractGroupEvent(edited)
+	if e == nil {
+		return
+	}
+	e.ChatJID, e.MessageID, e.CreatedAt = msg.Info.Chat.String(), eventID, msg.Info.Timestamp
+	if err := messageStore.StoreGroupEvent(e); err != nil {
+		bridgeLog.Warnf("Failed to store edit of event %s: %v", eventID, err)
+	}
+}
+
+// List group events with their responses, of one chat or all chats, by start time
+func (store *MessageStore) ListGroupEvents(chatJID string, upcoming bool, limit, offset int) ([]GroupEvent, error) {
+	var conditions []string
+	var args []interface{}
+	if chatJID != "" {
+		conditions = append(conditions, "chat_jid = ?")
+		args = append(args, chatJID)
+	}
+	if upcoming {
+		conditions = append(conditions, "canceled = 0 AND COALESCE(end_time, start_time) >= ?")
+		args = append(args, time.Now())
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	order := "DESC"
+	if upcoming {
+		order = "ASC"
+	}
+	args = append(args, limit, offset)
+
+	rows, err := store.db.Query(
+		`SELECT message_id, chat_jid, COALESCE(creator, ''), COALESCE(name, ''), COALESCE(description, ''), start_time, end_time,
+			COALESCE(location_name, ''), COALESCE(location_address, ''), latitude, longitude, COALESCE(join_link, ''),
+			canceled, extra_guests_allowed, created_at
+		FROM group_events`+where+` ORDER BY start_time `+order+` LIMIT ? OFFSET ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groupEvents := []GroupEvent{}
+	for rows.Next() {
+		var e GroupEvent
+		var location EventLocation
+		if err := rows.Scan(&e.MessageID, &e.ChatJID, &e.Creator, &e.Name, &e.Description, &e.StartTime, &e.EndTime,
+			&location.Name, &location.Address, &location.Latitude, &location.Longitude, &e.JoinLink,
+			&e.Canceled, &e.ExtraGuestsAllowed, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if location != (EventLocation{}) {
+			e.Location = &location
+		}
+		groupEvents = append(groupEvents, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range groupEvents {
+		if err := store.loadEventResponses(&groupEvents[i]); err != nil {
+			return nil, err
+		}
+	}
+	return groupEvents, nil
+}
+
+// Load the responses of an event and count them
+func (store *MessageStore) loadEventResponses(e *GroupEvent) error {
+	rows, err := store.db.Query(
+		`SELECT responder, response, COALESCE(extra_guests, 0), timestamp FROM group_event_responses
+		WHERE message_id = ? AND chat_jid = ? ORDER BY timestamp`,
+		e.MessageID, e.ChatJID,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	e.Responses = []EventRSVP{}
+	for rows.Next() {
+		var r EventRSVP
+		if err := rows.Scan(&r.Responder, &r.Response, &r.ExtraGuests, &r.Time); err != nil {
+			return err
+		}
+		switch r.Response {
+		case EventResponseGoing:
+			e.Going += 1 + r.ExtraGuests
+		case EventResponseNotGoing:
+			e.NotGoing++
+		case EventResponseMaybe:
+			e.Maybe++
+		}
+		e.Responses = append(e.Responses, r)
+	}
+	return rows.Err()
+}
+
+// SendEventRequest represents the request body for the send event API
+type SendEventRequest struct {
+	Recipient          string         `json:"recipient"` // A group
+	Name               string         `json:"name"`
+	Description        string         `json:"description,omitempty"`
+	StartTime          string         `json:"start_time"`         // RFC3339, or YYYY-MM-DD HH:MM in WHATSAPP_TIMEZONE
+	EndTime            string         `json:"end_time,omitempty"` // Same formats as start_time
+	Location           *EventLocation `json:"location,omitempty"`
+	ExtraGuestsAllowed bool           `json:"extra_guests_allowed,omitempty"` // Let members bring guests
+}
+
+// ListGroupEventsResponse represents the response for the group events API
+type ListGroupEventsResponse struct {
+	Success bool         `json:"success"`
+	Events  []GroupEvent `json:"events"`
+	Page
+}
+
+// Register the REST handlers listing and creating group events
+func registerGroupEventHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/group_events",
+		Summary: "List events created in groups with their members' RSVP responses, latest first or soonest first with upcoming=true",
+		Tag:     "messages",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "chat_jid", Description: "Only events of this group"},
+			{Name: "upcoming", Description: "Only events not cancelled and not over yet, soonest first", Type: "boolean"},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ListGroupEventsResponse{},
+	})
+	http.HandleFunc("GET /api/group_events", func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		query := r.URL.Query()
+		groupEvents, err := messageStore.ListGroupEvents(query.Get("chat_jid"), query.Get("upcoming") == "true", limit+1, offset)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list group events: %v", err), nil)
+			return
+		}
+		groupEvents, page := trimPage(groupEvents, offset, limit)
+		writeJSON(w, http.StatusOK, ListGroupEventsResponse{Success: true, Events: groupEvents, Page: page})
+	})
+
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/send/event",
+		Summary:  "Create an event in a group, which members can respond to as going, not going or maybe",
+		Tag:      "messages",
+		Scope:    ScopeSendMessages,
+		Audit:    true,
+		Request:  SendEventRequest{},
+		Response: SendInteractiveResponse{},
+	})
+	http.HandleFunc("POST /api/send/event", func(w http.ResponseWriter, r *http.Request) {
+		var req SendEventRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if req.Recipient == "" || strings.TrimSpace(req.Name) == "" {
+			writeError(w, ErrCodeInvalidRequest, "Recipient and name are required", nil)
+			return
+		}
+		start, err := parseTimeField("start_time", req.StartTime)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if start == nil {
+			writeError(w, ErrCodeInvalidRequest, "start_time is required", nil)
+			return
+		}
+		end, err := parseTimeField("end_time", req.EndTime)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if end != nil && end.Before(*start) {
+			writeError(w, ErrCodeInvalidRequest, "end_time must not be before start_time", nil)
+			return
+		}
+		if loc := req.Location; loc != nil && (loc.Latitude == nil) != (loc.Longitude == nil) {
+			writeError(w, ErrCodeInvalidRequest, "Give both latitude and longitude of the location, or neither", nil)
+			return
+		}
+		chat, _, err := resolveRecipient(messageStore, req.Recipient)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if chat.Server != types.GroupServer {
+			writeError(w, ErrCodeInvalidRequest, "Events can only be created in groups", nil)
+			return
+		}
+
+		e := &GroupEvent{
+			Name:               strings.TrimSpace(req.Name),
+			Description:        req.Description,
+			StartTime:          *start,
+			EndTime:            end,
+			Location:           req.Location,
+			ExtraGuestsAllowed: req.ExtraGuestsAllowed,
+		}
+		id, err := sendInteractiveMessage(r.Context(), client, messageStore, chat.String(), e.toMessage())
+		if err != nil {
+			writeAPIError(w, "Failed to send event", err)
+			return
+		}
+		var creator string
+		if client.Store.ID != nil {
+			creator = client.Store.ID.ToNonAD().String()
+		}
+		handleGroupEvent(messageStore, id, chat.String(), creator, time.Now(), e)
+		writeJSON(w, http.StatusOK, SendInteractiveResponse{Success: true, Message: fmt.Sprintf("Event sent to %s", chat), MessageID: id})
+	})
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// REST handlers register on the default mux, so every test shares one
+// message store, fake client and server
+var (
+	testStore  *MessageStore
+	testClient *fakeClient
+	testServer *httptest.Server
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+// Set up the shared bridge in a throwaway data directory and run the tests
+func runTests(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "whatsapp-bridge-test")
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("WHATSAPP_DATA_DIR", dir)
+
+	// The fake client needn't be rate limited
+	for _, class := range []string{opSend, opMedia, opQuery, opAppState, opPresence} {
+		os.Setenv("WHATSAPP_RATE_"+strings.ToUpper(class), "0")
+	}
+
+	testStore, err = NewMessageStore()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer testStore.Close()
+
+	testClient = newFakeClient()
+	registerMessageHandlers(testClient, testStore)
+	testServer = httptest.NewServer(withRecovery(http.DefaultServeMux))
+	defer testServer.Close()
+
+	return m.Run()
+}
+
+// Start a test with a connected fake client that hasn't been asked anything
+func setupTest(t *testing.T) *fakeClient {
+	t.Helper()
+	testClient.reset()
+	return testClient
+}
+
+// POST a JSON body to the test server, decoding the response into v
+func postJSON(t *testing.T, path string, body, v interface{}) int {
+	t.Helper()
+	data, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(testServer.URL+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("Failed to decode response of %s: %v", path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// Check that a request failed with the given status and error code
+func expectError(t *testing.T, status int, resp ErrorResponse, wantStatus int, wantCode ErrorCode) {
+	t.Helper()
+	if status != wantStatus || resp.Code != wantCode || resp.Success {
+		t.Fatalf("Got status %d and code %q (%s), want %d and %q", status, resp.Code, resp.Message, wantStatus, wantCode)
+	}
+}
+
+// Store a message as if it had been received, failing the test if it can't be
+func storeTestMessage(t *testing.T, m Message, url string, mediaKey []byte, fileLength uint64) {
+	t.Helper()
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+	testStore.StoreChat(m.ChatJID, "", m.Time)
+	err := testStore.StoreMessage(sourceLive, m.ID, m.ChatJID, m.Sender, m.Content, m.Time, m.IsFromMe,
+		m.MediaType, m.Filename, url, mediaKey, []byte("file-sha256"), []byte("file-enc-sha256"), fileLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+var updateGolden = flag.Bool("update", false, "Rewrite the golden files of the history sync tests")
+
+// Media filenames made up from the time of the sync
+var generatedFilename = regexp.MustCompile(`_\d{8}_\d{6}`)
+
+// goldenChat is a stored chats row
+type goldenChat struct {
+	JID             string    `json:"jid"`
+	Name            string    `json:"name"`
+	LastMessageTime time.Time `json:"last_message_time"`
+}
+
+// goldenMessage is a stored messages row
+type goldenMessage struct {
+	ID         string    `json:"id"`
+	ChatJID    string    `json:"chat_jid"`
+	Sender     string    `json:"sender"`
+	Content    string    `json:"content,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+	IsFromMe   bool      `json:"is_from_me"`
+	MediaType  string    `json:"media_type,omitempty"`
+	Filename   string    `json:"filename,omitempty"`
+	URL        string    `json:"url,omitempty"`
+	FileLength uint64    `json:"file_length,omitempty"`
+}
+
+// historyGolden is everything a history sync stored for the chats it held
+type historyGolden struct {
+	Chats    []goldenChat    `json:"chats"`
+	Messages []goldenMessage `json:"messages"`
+	Unread   map[string]int  `json:"unread,omitempty"` // Unread count of chats by JID
+}
+
+// Load the stored rows of the given chats
+func loadHistoryGolden(t *testing.T, chatJIDs []string) historyGolden {
+	t.Helper()
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(chatJIDs)), ", ")
+	args := make([]interface{}, len(chatJIDs))
+	for i, jid := range chatJIDs {
+		args[i] = jid
+	}
+	golden := historyGolden{Chats: []goldenChat{}, Messages: []goldenMessage{}, Unread: map[string]int{}}
+
+	rows, err := testStore.db.Query("SELECT jid, COALESCE(name, ''), last_message_time FROM chats WHERE jid IN ("+placeholders+") ORDER BY jid", args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var c goldenChat
+		if err := rows.Scan(&c.JID, &c.Name, &c.LastMessageTime); err != nil {
+			t.Fatal(err)
+		}
+		c.LastMessageTime = c.LastMessageTime.UTC()
+		golden.Chats = append(golden.Chats, c)
+	}
+	rows.Close()
+
+	rows, err = testStore.db.Query(`SELECT id, chat_jid, sender, COALESCE(content, ''), timestamp, is_from_me,
+		COALESCE(media_type, ''), COALESCE(filename, ''), COALESCE(url, ''), COALESCE(file_length, 0)
+		FROM messages WHERE chat_jid IN (`+placeholders+`) ORDER BY chat_jid, timestamp, id`, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var m goldenMessage
+		if err := rows.Scan(&m.ID, &m.ChatJID, &m.Sender, &m.Content, &m.Timestamp, &m.IsFromMe, &m.MediaType, &m.Filename, &m.URL, &m.FileLength); err != nil {
+			t.Fatal(err)
+		}
+		m.Timestamp = m.Timestamp.UTC()
+		m.Filename = generatedFilename.ReplaceAllString(m.Filename, "_YYYYMMDD_HHMMSS")
+		golden.Messages = append(golden.Messages, m)
+	}
+	rows.Close()
+
+	rows, err = testStore.db.Query("SELECT chat_jid, unread_count FROM chat_freshness WHERE chat_jid IN ("+placeholders+")", args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jid string
+		var unread sql.NullInt64
+		if err := rows.Scan(&jid, &unread); err != nil {
+			t.Fatal(err)
+		}
+		golden.Unread[jid] = int(unread.Int64)
+	}
+	return golden
+}
+
+// Feed each fixture in testdata/historysync to handleHistorySync and compare
+// what got stored with its .golden file. Run with -update after a deliberate
+// change to rewrite the golden files.
+func TestHistorySyncGolden(t *testing.T) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "historysync", "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fixture := range fixtures {
+		if strings.HasSuffix(fixture, ".golden.json") {
+			continue
+		}
+		name := strings.TrimSuffix(filepath.Base(fixture), ".json")
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(fixture)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Fixtures leave out required fields to cover what the phone may omit
+			var historySync waProto.HistorySync
+			if err := (protojson.UnmarshalOptions{AllowPartial: true}).Unmarshal(data, &historySync); err != nil {
+				t.Fatalf("Failed to parse fixture: %v", err)
+			}
+
+			handleHistorySync(newOfflineClient(t), testStore, &events.HistorySync{Data: &historySync}, waLog.Noop)
+
+			var chatJIDs []string
+			for _, conversation := range historySync.GetConversations() {
+				chatJIDs = append(chatJIDs, conversation.GetID())
+			}
+			got, err := json.MarshalIndent(loadHistoryGolden(t, chatJIDs), "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			goldenPath := strings.TrimSuffix(fixture, ".json") + ".golden.json"
+			if *updateGolden {
+				if err := os.WriteFile(goldenPath, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("Failed to read golden file, run with -update to create it: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Stored rows differ from %s, run with -update if the change is intended.\nGot:\n%s", goldenPath, got)
+			}
+		})
+	}
+}
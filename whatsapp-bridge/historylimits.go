@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	waStore "go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// HistoryLimits bounds how much history is kept, 0 meaning no limit
+type HistoryLimits struct {
+	MaxDays            int  `json:"max_days,omitempty"`              // Messages older than this many days
+	MaxMessagesPerChat int  `json:"max_messages_per_chat,omitempty"` // Messages of a chat beyond its latest ones
+	SkipGroups         bool `json:"skip_groups,omitempty"`           // Group history, live group messages are still stored
+}
+
+// Get the history limits set in WHATSAPP_HISTORY_DAYS,
+// WHATSAPP_HISTORY_MESSAGES_PER_CHAT and WHATSAPP_HISTORY_SKIP_GROUPS
+func configuredHistoryLimits() HistoryLimits {
+	return HistoryLimits{
+		MaxDays:            max(envInt("WHATSAPP_HISTORY_DAYS", 0), 0),
+		MaxMessagesPerChat: max(envInt("WHATSAPP_HISTORY_MESSAGES_PER_CHAT", 0), 0),
+		SkipGroups:         envBool("WHATSAPP_HISTORY_SKIP_GROUPS", false),
+	}
+}
+
+// Start of the history to keep, zero if there is no day limit
+func (l HistoryLimits) cutoff(now time.Time) time.Time {
+	if l.MaxDays <= 0 {
+		return time.Time{}
+	}
+	return now.AddDate(0, 0, -l.MaxDays)
+}
+
+// Ask the phone for no more history than the day limit when pairing. It only
+// applies to devices paired afterwards; history sync filtering covers the rest.
+func applyHistorySyncConfig(limits HistoryLimits) {
+	if limits.MaxDays <= 0 {
+		return
+	}
+	days := proto.Uint32(uint32(limits.MaxDays))
+	waStore.DeviceProps.HistorySyncConfig.FullSyncDaysLimit = days
+	waStore.DeviceProps.HistorySyncConfig.RecentSyncDaysLimit = days
+}
+
+// Count the messages of a chat still allowed by the per chat limit of a
+// history sync, -1 if there is no limit
+func (store *MessageStore) historyRoom(chatJID string, limits HistoryLimits) int {
+	if limits.MaxMessagesPerChat <= 0 {
+		return -1
+	}
+	var stored int
+	store.db.QueryRow("SELECT COUNT(*) FROM messages WHERE chat_jid = ?", chatJID).Scan(&stored)
+	return max(limits.MaxMessagesPerChat-stored, 0)
+}
+
+// Check whether the history of a chat is skipped entirely
+func (l HistoryLimits) skipsChat(jid types.JID) bool {
+	return l.SkipGroups && jid.Server == types.GroupServer
+}
+
+// HistoryTrimResult reports the messages a trim removed, or would remove
+type HistoryTrimResult struct {
+	Limits         HistoryLimits `json:"limits"`
+	TooOld         int64         `json:"too_old"`
+	OverChatLimit  int64         `json:"over_chat_limit"`
+	GroupMessages  int64         `json:"group_messages"`
+	DetailsRemoved int64         `json:"details_removed,omitempty"` // Tags, mentions, links and such of removed messages
+	DryRun         bool          `json:"dry_run,omitempty"`
+}
+
+// Conditions selecting the messages each limit removes. Starred messages are
+// always kept.
+const (
+	trimTooOld      = "timestamp < ? AND COALESCE(is_starred, 0) = 0"
+	trimGroups      = "chat_jid LIKE '%@g.us' AND COALESCE(is_starred, 0) = 0"
+	trimOverPerChat = `rowid IN (SELECT rowid FROM (
+		SELECT rowid, is_starred, ROW_NUMBER() OVER (PARTITION BY chat_jid ORDER BY timestamp DESC, rowid DESC) AS n FROM messages
+	) WHERE n > ? AND COALESCE(is_starred, 0) = 0)`
+)
+
+// Remove stored messages beyond history limits. A dry run rolls the removal
+// back, so it counts each message once like a real run.
+func (store *MessageStore) TrimHistory(limits HistoryLimits, dryRun bool) (*HistoryTrimResult, error) {
+	result := &HistoryTrimResult{Limits: limits, DryRun: dryRun}
+	tx, err := store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	run := func(condition string, args ...interface{}) (int64, error) {
+		r, err := tx.Exec("DELETE FROM messages WHERE "+condition, args...)
+		if err != nil {
+			return 0, err
+		}
+		return r.RowsAffected()
+	}
+
+	if limits.SkipGroups {
+		if result.GroupMessages, err = run(trimGroups); err != nil {
+			return nil, fmt.Errorf("failed to trim group messages: %v", err)
+		}
+	}
+	if cutoff := limits.cutoff(time.Now()); !cutoff.IsZero() {
+		if result.TooOld, err = run(trimTooOld, cutoff.Local()); err != nil {
+			return nil, fmt.Errorf("failed to trim old messages: %v", err)
+		}
+	}
+	if limits.MaxMessagesPerChat > 0 {
+		if result.OverChatLimit, err = run(trimOverPerChat, limits.MaxMessagesPerChat); err != nil {
+			return nil, fmt.Errorf("failed to trim chats: %v", err)
+		}
+	}
+	if dryRun {
+		return result, nil
+	}
+	if err := refreshChatFreshness(tx); err != nil {
+		return nil, fmt.Errorf("failed to recount unread messages: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	removed := result.TooOld + result.OverChatLimit + result.GroupMessages
+	if !dryRun && removed > 0 {
+		for _, check := range integrityChecks {
+			if check.name == "orphaned_message_details" {
+				if result.DetailsRemoved, err = check.repair(store); err != nil {
+					return nil, fmt.Errorf("failed to remove details of trimmed messages: %v", err)
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// Trim the message store to the configured history limits, for the
+// -trim-history flag
+func runTrimHistory() int {
+	limits := configuredHistoryLimits()
+	if limits == (HistoryLimits{}) {
+		fmt.Println("No history limits configured, set WHATSAPP_HISTORY_DAYS, WHATSAPP_HISTORY_MESSAGES_PER_CHAT or WHATSAPP_HISTORY_SKIP_GROUPS")
+		return exitFatal
+	}
+	messageStore, err := NewMessageStore()
+	if err != nil {
+		fmt.Printf("Failed to open message store: %v\n", err)
+		return exitFatal
+	}
+	defer messageStore.Close()
+	result, err := messageStore.TrimHistory(limits, false)
+	if err != nil {
+		fmt.Println(err)
+		return exitFatal
+	}
+	fmt.Printf("Removed %d messages older than the day limit, %d over the per chat limit and %d from groups\n",
+		result.TooOld, result.OverChatLimit, result.GroupMessages)
+	return 0
+}
+
+// TrimHistoryRequest represents the request body for the history trim API,
+// limits default to the configured ones
+type TrimHistoryRequest struct {
+	HistoryLimits
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// TrimHistoryResponse represents the response for the history trim API
+type TrimHistoryResponse struct {
+	Success bool               `json:"success"`
+	Message string             `json:"message"`
+	Result  *HistoryTrimResult `json:"result"`
+}
+
+// Register the admin REST handler trimming stored history
+func registerHistoryLimitHandlers(messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/admin/history/trim",
+		Summary:  "Delete stored messages older than max_days, beyond the latest max_messages_per_chat of each chat or, with skip_groups, from groups; starred messages are kept",
+		Tag:      "admin",
+		Scope:    ScopeAdmin,
+		Audit:    true,
+		Request:  TrimHistoryRequest{},
+		Response: TrimHistoryResponse{},
+	})
+	http.HandleFunc("POST /api/admin/history/trim", func(w http.ResponseWriter, r *http.Request) {
+		var req TrimHistoryRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		limits := req.HistoryLimits
+		if limits == (HistoryLimits{}) {
+			limits = configuredHistoryLimits()
+		}
+		if limits == (HistoryLimits{}) {
+			writeError(w, ErrCodeInvalidRequest, "No history limits given or configured", nil)
+			return
+		}
+		if limits.MaxDays < 0 || limits.MaxMessagesPerChat < 0 {
+			writeError(w, ErrCodeInvalidRequest, "Limits must not be negative", nil)
+			return
+		}
+
+		result, err := messageStore.TrimHistory(limits, req.DryRun)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to trim history: %v", err), nil)
+			return
+		}
+		removed := result.TooOld + result.OverChatLimit + result.GroupMessages
+		message := fmt.Sprintf("%d messages removed", removed)
+		if req.DryRun {
+			message = fmt.Sprintf("%d messages would be removed", removed)
+		} else {
+			bridgeLog.Infof("History trim removed %d messages", removed)
+		}
+		writeJSON(w, http.StatusOK, TrimHistoryResponse{Success: true, Message: message, Result: result})
+	})
+}
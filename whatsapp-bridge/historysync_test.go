@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+	"google.golang.org/protobuf/proto"
+)
+
+// Phone number of the account of the offline client
+const testOwnUser = "15550000000"
+
+// Create a WhatsApp client that is logged in as testOwnUser on a throwaway
+// session database but never connects. History sync ingestion only reads
+// the session store, so it runs against this instead of the fake client.
+func newOfflineClient(t *testing.T) *whatsmeow.Client {
+	t.Helper()
+	ctx := context.Background()
+	address := "file:" + filepath.Join(t.TempDir(), "session.db") + "?_foreign_keys=on"
+	container, err := sqlstore.New(ctx, "sqlite3", address, waLog.Noop)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { container.Close() })
+
+	device := container.NewDevice()
+	device.ID = &types.JID{User: testOwnUser, Server: types.DefaultUserServer}
+	device.Account = &waProto.ADVSignedDeviceIdentity{
+		Details:             []byte{},
+		AccountSignature:    make([]byte, 64),
+		AccountSignatureKey: make([]byte, 32),
+		DeviceSignature:     make([]byte, 64),
+	}
+	if err := container.PutDevice(ctx, device); err != nil {
+		t.Fatal(err)
+	}
+	return whatsmeow.NewClient(device, waLog.Noop)
+}
+
+// Build a history sync message
+func historyMessage(id string, fromMe bool, participant string, ts time.Time, msg *waProto.Message) *waProto.HistorySyncMsg {
+	key := &waProto.MessageKey{ID: proto.String(id), FromMe: proto.Bool(fromMe)}
+	if participant != "" {
+		key.Participant = proto.String(participant)
+	}
+	return &waProto.HistorySyncMsg{Message: &waProto.WebMessageInfo{
+		Key:              key,
+		Message:          msg,
+		MessageTimestamp: proto.Uint64(uint64(ts.Unix())),
+	}}
+}
+
+// Get the stored messages of a chat by ID
+func storedMessages(t *testing.T, chatJID string) map[string]Message {
+	t.Helper()
+	messages, err := testStore.GetMessages(chatJID, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byID := map[string]Message{}
+	for _, m := range messages {
+		byID[m.ID] = m
+	}
+	return byID
+}
+
+func TestHistorySyncIngestion(t *testing.T) {
+	client := newOfflineClient(t)
+	now := time.Now().Truncate(time.Second)
+	group := "120363000000000001@g.us"
+	direct := "15551238001@s.whatsapp.net"
+
+	handleHistorySync(client, testStore, &events.HistorySync{Data: &waProto.HistorySync{
+		SyncType: waProto.HistorySync_INITIAL_BOOTSTRAP.Enum(),
+		Conversations: []*waProto.Conversation{
+			{
+				ID:          proto.String(group),
+				Name:        proto.String("Book club"),
+				UnreadCount: proto.Uint32(1),
+				// Newest first, like the phone sends them
+				Messages: []*waProto.HistorySyncMsg{
+					historyMessage("H3", false, "15551238002@s.whatsapp.net", now, &waProto.Message{
+						ImageMessage: &waProto.ImageMessage{
+							Mimetype:      proto.String("image/jpeg"),
+							URL:           proto.String("https://mmg.whatsapp.net/v/t62/h3.enc?ccb=11-4"),
+							MediaKey:      []byte("media-key"),
+							FileSHA256:    []byte("file-sha256"),
+							FileEncSHA256: []byte("file-enc-sha256"),
+							FileLength:    proto.Uint64(5),
+						},
+					}),
+					historyMessage("H2", true, "", now.Add(-time.Minute), &waProto.Message{Conversation: proto.String("see you there")}),
+					historyMessage("H1", false, "15551238002@s.whatsapp.net", now.Add(-2*time.Minute), &waProto.Message{Conversation: proto.String("meeting at 7")}),
+				},
+			},
+			{
+				ID: proto.String(direct),
+				Messages: []*waProto.HistorySyncMsg{
+					historyMessage("H5", false, "", now, &waProto.Message{Conversation: proto.String("hi")}),
+					// Messages without content or media are skipped
+					historyMessage("H4", false, "", now.Add(-time.Minute), &waProto.Message{}),
+				},
+			},
+		},
+	}}, waLog.Noop)
+
+	messages := storedMessages(t, group)
+	if len(messages) != 3 {
+		t.Fatalf("Stored %d messages of the group, want 3", len(messages))
+	}
+	if m := messages["H1"]; m.Content != "meeting at 7" || m.Sender != "15551238002@s.whatsapp.net" || m.IsFromMe {
+		t.Errorf("Got H1 %+v", m)
+	}
+	if m := messages["H2"]; m.Sender != testOwnUser || !m.IsFromMe {
+		t.Errorf("Got H2 %+v, want it sent by the account", m)
+	}
+	if m := messages["H3"]; m.MediaType != "image" || !m.Time.Equal(now) {
+		t.Errorf("Got H3 %+v", m)
+	}
+	_, _, url, mediaKey, _, _, fileLength, err := testStore.GetMediaInfo("H3", group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url == "" || string(mediaKey) != "media-key" || fileLength != 5 {
+		t.Errorf("Got media info %q, %q, %d, want what the message gave", url, mediaKey, fileLength)
+	}
+
+	var name string
+	if err := testStore.db.QueryRow("SELECT name FROM chats WHERE jid = ?", group).Scan(&name); err != nil {
+		t.Fatal(err)
+	}
+	if name != "Book club" {
+		t.Errorf("Named the group %q, want Book club", name)
+	}
+
+	messages = storedMessages(t, direct)
+	if len(messages) != 1 || messages["H5"].Sender != "15551238001" {
+		t.Errorf("Got direct messages %+v, want only H5 from the contact", messages)
+	}
+}
+
+func TestHistorySyncLimits(t *testing.T) {
+	client := newOfflineClient(t)
+	t.Setenv("WHATSAPP_HISTORY_DAYS", "7")
+	t.Setenv("WHATSAPP_HISTORY_SKIP_GROUPS", "true")
+	now := time.Now().Truncate(time.Second)
+	chat := "15551238101@s.whatsapp.net"
+	group := "120363000000000002@g.us"
+
+	sync := func(syncType waProto.HistorySync_HistorySyncType) {
+		handleHistorySync(client, testStore, &events.HistorySync{Data: &waProto.HistorySync{
+			SyncType: syncType.Enum(),
+			Conversations: []*waProto.Conversation{
+				{
+					ID: proto.String(chat),
+					Messages: []*waProto.HistorySyncMsg{
+						historyMessage("L2", false, "", now, &waProto.Message{Conversation: proto.String("recent")}),
+						historyMessage("L1", false, "", now.AddDate(0, 0, -30), &waProto.Message{Conversation: proto.String("old")}),
+					},
+				},
+				{
+					ID:       proto.String(group),
+					Name:     proto.String("Skipped"),
+					Messages: []*waProto.HistorySyncMsg{historyMessage("L3", false, "15551238102@s.whatsapp.net", now, &waProto.Message{Conversation: proto.String("hello")})},
+				},
+			},
+		}}, waLog.Noop)
+	}
+
+	sync(waProto.HistorySync_RECENT)
+	if messages := storedMessages(t, chat); len(messages) != 1 || messages["L2"].Content != "recent" {
+		t.Errorf("Got %+v, want only the message within the day limit", messages)
+	}
+	if messages := storedMessages(t, group); len(messages) != 0 {
+		t.Errorf("Stored %d messages of a group while groups are skipped", len(messages))
+	}
+
+	// History asked for on demand is kept whatever the limits
+	sync(waProto.HistorySync_ON_DEMAND)
+	if messages := storedMessages(t, chat); len(messages) != 2 {
+		t.Errorf("Stored %d messages on demand, want 2", len(messages))
+	}
+}
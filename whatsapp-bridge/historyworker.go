@@ -0,0 +1,94 @@
+package main
+
+import (
+	"sync"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// historySyncQueue hands HistorySync events to background workers, so writing
+// bulk history doesn't block keepalives, receipts and live messages in the
+// event handler. The queue is unbounded: the events are already in memory and
+// dropping one would lose history for good.
+type historySyncQueue struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	pending   []*events.HistorySync
+	active    int
+	processed int
+}
+
+// HistorySyncStats describes the state of the history sync queue
+type HistorySyncStats struct {
+	Pending   int `json:"pending"`
+	Active    int `json:"active"`
+	Processed int `json:"processed"`
+}
+
+// Queue of the running bridge, nil until the workers are started
+var historyQueue *historySyncQueue
+
+// Start the workers ingesting history sync events
+func startHistorySyncWorkers(client *whatsmeow.Client, messageStore *MessageStore, logger waLog.Logger, workers int) *historySyncQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	q := &historySyncQueue{}
+	q.cond = sync.NewCond(&q.mu)
+
+	for i := 0; i < workers; i++ {
+		goSafe("processing history syncs", func() {
+			for {
+				evt := q.next()
+				func() {
+					defer q.done()
+					defer recoverPanic("processing history sync")
+					handleHistorySync(client, messageStore, evt, logger)
+				}()
+			}
+		})
+	}
+	return q
+}
+
+// Add a history sync event to the queue without blocking
+func (q *historySyncQueue) enqueue(evt *events.HistorySync) {
+	q.mu.Lock()
+	q.pending = append(q.pending, evt)
+	pending := len(q.pending)
+	q.mu.Unlock()
+	q.cond.Signal()
+
+	bridgeLog.Infof("Queued history sync event with %d conversations (%d pending)", len(evt.Data.Conversations), pending)
+}
+
+// Wait for the next event to process
+func (q *historySyncQueue) next() *events.HistorySync {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending) == 0 {
+		q.cond.Wait()
+	}
+	evt := q.pending[0]
+	q.pending[0] = nil
+	q.pending = q.pending[1:]
+	q.active++
+	return evt
+}
+
+// Mark an event taken with next as processed
+func (q *historySyncQueue) done() {
+	q.mu.Lock()
+	q.active--
+	q.processed++
+	q.mu.Unlock()
+}
+
+// Get the current queue state
+func (q *historySyncQueue) stats() HistorySyncStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return HistorySyncStats{Pending: len(q.pending), Active: q.active, Processed: q.processed}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// The same person can send as their phone number or as their LID, and the
+// sender column holds whatever the message came with: a bare user, a phone
+// JID or a LID JID. Queries attribute both to one identity through lid_map,
+// keyed by the phone number when it is known, while the raw sender is kept.
+
+// SQL for the user part of a sender column
+func senderUserSQL(column string) string {
+	return "(CASE WHEN instr(" + column + ", '@') > 0 THEN substr(" + column + ", 1, instr(" + column + ", '@') - 1) ELSE " + column + " END)"
+}
+
+// SQL for the canonical identity of a sender column: the phone number user of
+// a LID sender if it is known, otherwise the user part as is
+func senderIDSQL(column string) string {
+	user := senderUserSQL(column)
+	return `COALESCE((SELECT substr(l.pn, 1, instr(l.pn, '@') - 1) FROM lid_map l
+		WHERE l.lid = ` + user + ` || '@lid' AND ` + column + ` NOT LIKE '%@` + types.DefaultUserServer + `'), ` + user + `)`
+}
+
+// SQL for the LID user of a sender column, whether it sent as its LID or as a
+// phone number with a known LID, or empty if unknown
+func senderLIDSQL(column string) string {
+	user := senderUserSQL(column)
+	return `COALESCE((SELECT substr(l.lid, 1, instr(l.lid, '@') - 1) FROM lid_map l
+		WHERE l.lid = ` + user + ` || '@lid' AND ` + column + ` NOT LIKE '%@` + types.DefaultUserServer + `'),
+		(SELECT substr(l.lid, 1, instr(l.lid, '@') - 1) FROM lid_map l
+		WHERE l.pn = ` + user + ` || '@` + types.DefaultUserServer + `' AND ` + column + ` NOT LIKE '%@` + types.HiddenUserServer + `' LIMIT 1), '')`
+}
+
+// Get every sender value the messages of a person can be stored under, given
+// their phone number, LID or either as a JID
+func (store *MessageStore) SenderAliases(sender string) ([]string, error) {
+	user := sender
+	if i := strings.IndexByte(user, '@'); i >= 0 {
+		user = user[:i]
+	}
+	if i := strings.IndexByte(user, ':'); i >= 0 {
+		user = user[:i]
+	}
+	users := []string{user}
+
+	// A value may name either side of a mapping
+	var pn, lid sql.NullString
+	err := store.db.QueryRow(
+		"SELECT pn, lid FROM lid_map WHERE lid = ? OR pn = ? LIMIT 1",
+		user+"@"+types.HiddenUserServer, user+"@"+types.DefaultUserServer,
+	).Scan(&pn, &lid)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	for _, jid := range []sql.NullString{pn, lid} {
+		if other, _, ok := strings.Cut(jid.String, "@"); ok && other != user {
+			users = append(users, other)
+		}
+	}
+
+	var aliases []string
+	for _, u := range users {
+		aliases = append(aliases, u, u+"@"+types.DefaultUserServer, u+"@"+types.HiddenUserServer)
+	}
+	return aliases, nil
+}
+
+// Get the phone number JID of a LID through lid_map, or the JID itself if it
+// isn't a LID or its phone number is unknown
+func (store *MessageStore) PhoneJID(jid types.JID) types.JID {
+	if jid.Server != types.HiddenUserServer {
+		return jid
+	}
+	var pn string
+	store.db.QueryRow("SELECT pn FROM lid_map WHERE lid = ?", jid.ToNonAD().String()).Scan(&pn)
+	if parsed, err := types.ParseJID(pn); err == nil && pn != "" {
+		return parsed
+	}
+	return jid
+}
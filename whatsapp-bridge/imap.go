@@ -0,0 +1,1264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Limits of the IMAP archive
+const (
+	imapIdleTimeout = 30 * time.Minute // Autologout of idle sessions, the least RFC 3501 allows
+	imapIdlePoll    = 30 * time.Second // How often IDLE looks for new messages
+	imapMaxLine     = 64 << 10         // Longest command line, and literal in a command
+	imapMailCache   = 1000             // Rendered emails kept per selected mailbox
+)
+
+// Capabilities of the IMAP archive
+const imapCapabilities = "IMAP4rev1 LITERAL+ IDLE UNSELECT ID"
+
+// Reply to commands that would change the archive
+const imapReadOnly = "[CANNOT] The WhatsApp archive is read-only"
+
+// imapServer serves the message store as a read-only IMAP archive, with the
+// chats as mailboxes and their messages as emails
+type imapServer struct {
+	store   *MessageStore
+	tokens  []*APIToken
+	ownUser func() string // Phone number of the account, for the address of own messages
+}
+
+// Start the IMAP archive on WHATSAPP_IMAP_ADDR, if set. Logins take an API
+// token with the read:messages scope as the password. TLS is used when
+// WHATSAPP_IMAP_TLS_CERT and WHATSAPP_IMAP_TLS_KEY are set.
+func startIMAPServer(client *whatsmeow.Client, messageStore *MessageStore) {
+	addr := envString("WHATSAPP_IMAP_ADDR", "")
+	if addr == "" {
+		return
+	}
+	tokens, err := loadAPITokens()
+	if err != nil {
+		bridgeLog.Warnf("IMAP archive not started: %v", err)
+		return
+	}
+	listener, secure, err := listenIMAP(addr)
+	if err != nil {
+		bridgeLog.Warnf("IMAP archive not started: %v", err)
+		return
+	}
+	if len(tokens) == 0 {
+		bridgeLog.Warnf("no API tokens configured, the IMAP archive accepts any login")
+	}
+	if host, _, _ := net.SplitHostPort(addr); !secure && !isLoopbackHost(host) {
+		bridgeLog.Warnf("the IMAP archive on %s is unencrypted, set WHATSAPP_IMAP_TLS_CERT and WHATSAPP_IMAP_TLS_KEY", addr)
+	}
+
+	server := &imapServer{store: messageStore, tokens: tokens, ownUser: func() string {
+		if client.Store.ID != nil {
+			return client.Store.ID.User
+		}
+		return ""
+	}}
+	bridgeLog.Infof("Serving the read-only IMAP archive on %s", addr)
+	goSafe("serving the IMAP archive", func() { server.serve(listener) })
+}
+
+// Listen for IMAP connections, over TLS if a certificate is configured
+func listenIMAP(addr string) (net.Listener, bool, error) {
+	cert, key := envString("WHATSAPP_IMAP_TLS_CERT", ""), envString("WHATSAPP_IMAP_TLS_KEY", "")
+	if cert == "" && key == "" {
+		listener, err := net.Listen("tcp", addr)
+		return listener, false, err
+	}
+	pair, err := tls.LoadX509KeyPair(dataPath(cert), dataPath(key))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to load the TLS certificate: %v", err)
+	}
+	listener, err := tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS12})
+	return listener, true, err
+}
+
+// Whether a listen host only takes local connections
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Accept connections until the listener is closed
+func (s *imapServer) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			bridgeLog.Warnf("IMAP archive failed to accept a connection: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		goSafe(fmt.Sprintf("serving IMAP connection from %s", conn.RemoteAddr()), func() {
+			defer conn.Close()
+			session := &imapSession{server: s, conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+			session.run()
+		})
+	}
+}
+
+// Check the password of a login, which is an API token allowed to read messages
+func (s *imapServer) authenticate(password string) (string, bool) {
+	if len(s.tokens) == 0 {
+		return "anonymous", true
+	}
+	for _, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(password)) == 1 {
+			return t.Name, t.HasScope(ScopeReadMessages)
+		}
+	}
+	return "", false
+}
+
+// imapMailbox is the mailbox selected in a session, with a snapshot of its
+// messages that grows as new ones arrive
+type imapMailbox struct {
+	folder      imapFolder
+	uidValidity uint32
+	uidNext     uint32
+	messages    []imapMessage
+	names       *senderNames
+	mails       map[uint32]*imapMail
+}
+
+// imapSession is a connection of a mail client
+type imapSession struct {
+	server   *imapServer
+	conn     net.Conn
+	r        *bufio.Reader
+	w        *bufio.Writer
+	user     string // Name of the token logged in with, empty before login
+	selected *imapMailbox
+}
+
+// Errors of reading commands
+var (
+	errIMAPLineTooLong = errors.New("line too long")
+	errIMAPSyntax      = errors.New("syntax error")
+)
+
+// Serve the commands of a client until it logs out or the connection ends
+func (s *imapSession) run() {
+	s.untagged("OK [CAPABILITY %s] WhatsApp archive ready", imapCapabilities)
+	for {
+		s.w.Flush()
+		s.conn.SetReadDeadline(time.Now().Add(imapIdleTimeout))
+		args, err := s.readCommand()
+		if errors.Is(err, errIMAPLineTooLong) {
+			s.untagged("BYE Line too long")
+			s.w.Flush()
+			return
+		} else if errors.Is(err, errIMAPSyntax) {
+			tag := "*"
+			if len(args) > 0 && args[0].kind == imapAtom {
+				tag = args[0].value
+			}
+			s.tagged(tag, "BAD", "%v", err)
+			continue
+		} else if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				s.untagged("BYE Autologout, idle for too long")
+				s.w.Flush()
+			}
+			return
+		}
+		if len(args) < 2 || args[0].kind != imapAtom || args[1].kind != imapAtom {
+			s.tagged("*", "BAD", "Expected a tag and a command")
+			continue
+		}
+		if !s.dispatch(args[0].value, strings.ToUpper(args[1].value), args[2:]) {
+			s.w.Flush()
+			return
+		}
+	}
+}
+
+// Run a command, returning false when the session ends
+func (s *imapSession) dispatch(tag, command string, args []imapArg) bool {
+	switch command {
+	case "CAPABILITY":
+		s.untagged("CAPABILITY %s", imapCapabilities)
+		s.tagged(tag, "OK", "CAPABILITY completed")
+		return true
+	case "NOOP", "CHECK":
+		if s.selected != nil {
+			s.refresh()
+		}
+		s.tagged(tag, "OK", "%s completed", command)
+		return true
+	case "LOGOUT":
+		s.untagged("BYE Logging out")
+		s.tagged(tag, "OK", "LOGOUT completed")
+		return false
+	case "ID":
+		s.untagged(`ID ("name" "whatsapp-bridge")`)
+		s.tagged(tag, "OK", "ID completed")
+		return true
+	case "LOGIN":
+		s.login(tag, args)
+		return true
+	case "AUTHENTICATE", "STARTTLS":
+		s.tagged(tag, "NO", "%s is not supported, use LOGIN", command)
+		return true
+	}
+
+	if s.user == "" {
+		s.tagged(tag, "NO", "Log in first")
+		return true
+	}
+	switch command {
+	case "SELECT", "EXAMINE":
+		s.selectMailbox(tag, command, args)
+	case "LIST", "LSUB":
+		s.list(tag, command, args)
+	case "STATUS":
+		s.status(tag, args)
+	case "SUBSCRIBE", "UNSUBSCRIBE":
+		// Every mailbox is subscribed, clients ask anyway
+		s.tagged(tag, "OK", "%s completed", command)
+	case "IDLE":
+		return s.idle(tag)
+	case "CREATE", "DELETE", "RENAME", "APPEND":
+		s.tagged(tag, "NO", imapReadOnly)
+	default:
+		if s.selected == nil {
+			s.tagged(tag, "BAD", "Unknown command or no mailbox selected")
+			return true
+		}
+		s.selectedCommand(tag, command, args)
+	}
+	return true
+}
+
+// Run a command of the selected state
+func (s *imapSession) selectedCommand(tag, command string, args []imapArg) {
+	byUID := false
+	if command == "UID" {
+		if len(args) == 0 || args[0].kind != imapAtom {
+			s.tagged(tag, "BAD", "UID needs a command")
+			return
+		}
+		byUID, command, args = true, strings.ToUpper(args[0].value), args[1:]
+	}
+	switch command {
+	case "FETCH":
+		s.fetch(tag, args, byUID)
+	case "SEARCH":
+		s.search(tag, args, byUID)
+	case "CLOSE", "UNSELECT":
+		if byUID {
+			s.tagged(tag, "BAD", "Unknown UID command")
+			return
+		}
+		s.selected = nil
+		s.tagged(tag, "OK", "%s completed", command)
+	case "STORE", "COPY", "MOVE", "EXPUNGE":
+		s.tagged(tag, "NO", imapReadOnly)
+	default:
+		s.tagged(tag, "BAD", "Unknown command %s", command)
+	}
+}
+
+// Write an untagged response
+func (s *imapSession) untagged(format string, args ...interface{}) {
+	fmt.Fprintf(s.w, "* "+format+"\r\n", args...)
+}
+
+// Write the tagged completion of a command
+func (s *imapSession) tagged(tag, status, format string, args ...interface{}) {
+	fmt.Fprintf(s.w, "%s %s %s\r\n", tag, status, fmt.Sprintf(format, args...))
+}
+
+// Log in with any user name and an API token as the password
+func (s *imapSession) login(tag string, args []imapArg) {
+	if s.user != "" {
+		s.tagged(tag, "BAD", "Already logged in")
+		return
+	}
+	if len(args) != 2 || !args[0].isString() || !args[1].isString() {
+		s.tagged(tag, "BAD", "LOGIN needs a user name and a password")
+		return
+	}
+	name, ok := s.server.authenticate(args[1].value)
+	if !ok {
+		// Slow down guessing
+		time.Sleep(time.Second)
+		s.tagged(tag, "NO", "[AUTHENTICATIONFAILED] The password must be an API token allowed to read messages")
+		return
+	}
+	s.user = name
+	bridgeLog.Infof("IMAP archive login as %s from %s", name, s.conn.RemoteAddr())
+	s.tagged(tag, "OK", "[CAPABILITY %s] LOGIN completed", imapCapabilities)
+}
+
+// Find a mailbox by its name as a client sent it
+func (s *imapSession) findFolder(encoded string) (imapFolder, bool, error) {
+	name, err := decodeMailboxName(encoded)
+	if err != nil {
+		return imapFolder{}, false, err
+	}
+	if strings.EqualFold(name, "INBOX") {
+		return imapFolder{Name: "INBOX"}, true, nil
+	}
+	folders, err := s.server.store.imapFolders()
+	if err != nil {
+		return imapFolder{}, false, err
+	}
+	for _, f := range folders {
+		if f.Name == name {
+			return f, true, nil
+		}
+	}
+	return imapFolder{}, false, nil
+}
+
+// Open a mailbox, always read-only
+func (s *imapSession) selectMailbox(tag, command string, args []imapArg) {
+	s.selected = nil
+	if len(args) < 1 || !args[0].isString() {
+		s.tagged(tag, "BAD", "%s needs a mailbox", command)
+		return
+	}
+	folder, ok, err := s.findFolder(args[0].value)
+	if err != nil {
+		s.tagged(tag, "NO", "Failed to find the mailbox: %v", err)
+		return
+	} else if !ok {
+		s.tagged(tag, "NO", "[NONEXISTENT] No such mailbox")
+		return
+	}
+
+	mailbox := &imapMailbox{folder: folder, uidValidity: 1, uidNext: 1, mails: map[uint32]*imapMail{},
+		names: &senderNames{store: s.server.store, names: map[string]string{}}}
+	if folder.ChatJID != "" {
+		if mailbox.uidValidity, mailbox.uidNext, err = s.server.store.assignIMAPUIDs(folder.ChatJID); err == nil {
+			mailbox.messages, err = s.server.store.imapMessages(folder.ChatJID, 0)
+		}
+		if err != nil {
+			s.tagged(tag, "NO", "Failed to open the mailbox: %v", err)
+			return
+		}
+	}
+	s.selected = mailbox
+
+	s.untagged(`FLAGS (\Seen \Flagged)`)
+	s.untagged("%d EXISTS", len(mailbox.messages))
+	s.untagged("0 RECENT")
+	s.untagged("OK [UIDVALIDITY %d] UIDs valid", mailbox.uidValidity)
+	s.untagged("OK [UIDNEXT %d] Predicted next UID", mailbox.uidNext)
+	s.untagged("OK [PERMANENTFLAGS ()] No flags can be changed")
+	s.tagged(tag, "OK", "[READ-ONLY] %s completed", command)
+}
+
+// Look for messages that arrived since the mailbox was opened, telling the
+// client if there are any
+func (s *imapSession) refresh() {
+	mailbox := s.selected
+	if mailbox.folder.ChatJID == "" {
+		return
+	}
+	_, next, err := s.server.store.assignIMAPUIDs(mailbox.folder.ChatJID)
+	if err != nil || next == mailbox.uidNext {
+		return
+	}
+	var last uint32
+	if n := len(mailbox.messages); n > 0 {
+		last = mailbox.messages[n-1].UID
+	}
+	added, err := s.server.store.imapMessages(mailbox.folder.ChatJID, last)
+	if err != nil {
+		bridgeLog.Warnf("IMAP archive failed to load new messages of %s: %v", mailbox.folder.ChatJID, err)
+		return
+	}
+	mailbox.uidNext = next
+	if len(added) > 0 {
+		mailbox.messages = append(mailbox.messages, added...)
+		s.untagged("%d EXISTS", len(mailbox.messages))
+	}
+}
+
+// List the mailboxes matching a pattern. Chats are listed under a folder of
+// their kind, which can't be selected itself.
+func (s *imapSession) list(tag, command string, args []imapArg) {
+	if len(args) != 2 || !args[0].isString() || !args[1].isString() {
+		s.tagged(tag, "BAD", "%s needs a reference and a pattern", command)
+		return
+	}
+	if args[1].value == "" {
+		s.untagged(`%s (\Noselect) "%s" ""`, command, imapDelimiter)
+		s.tagged(tag, "OK", "%s completed", command)
+		return
+	}
+	pattern, err := decodeMailboxName(args[0].value + args[1].value)
+	if err != nil {
+		s.tagged(tag, "BAD", "Invalid mailbox name: %v", err)
+		return
+	}
+	folders, err := s.server.store.imapFolders()
+	if err != nil {
+		s.tagged(tag, "NO", "Failed to list the mailboxes: %v", err)
+		return
+	}
+
+	type entry struct{ name, attributes string }
+	entries := []entry{{"INBOX", `\HasNoChildren`}}
+	parents := map[string]bool{}
+	for _, f := range folders {
+		parent := strings.SplitN(f.Name, imapDelimiter, 2)[0]
+		if !parents[parent] {
+			parents[parent] = true
+			entries = append(entries, entry{parent, `\Noselect \HasChildren`})
+		}
+		entries = append(entries, entry{f.Name, `\HasNoChildren`})
+	}
+	for _, e := range entries {
+		if matchMailboxPattern(pattern, e.name) {
+			s.untagged("%s (%s) \"%s\" %s", command, e.attributes, imapDelimiter, imapString(encodeMailboxName(e.name)))
+		}
+	}
+	s.tagged(tag, "OK", "%s completed", command)
+}
+
+// Match a mailbox name against a LIST pattern, where * matches anything and
+// % anything but the delimiter. INBOX matches in any case.
+func matchMailboxPattern(pattern, name string) bool {
+	if name == "INBOX" && strings.EqualFold(pattern, "INBOX") {
+		return true
+	}
+	if pattern == "" {
+		return name == ""
+	}
+	switch pattern[0] {
+	case '*':
+		for i := 0; i <= len(name); i++ {
+			if matchMailboxPattern(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	case '%':
+		for i := 0; i <= len(name); i++ {
+			if matchMailboxPattern(pattern[1:], name[i:]) {
+				return true
+			}
+			if i < len(name) && name[i] == imapDelimiter[0] {
+				return false
+			}
+		}
+		return false
+	}
+	return name != "" && name[0] == pattern[0] && matchMailboxPattern(pattern[1:], name[1:])
+}
+
+// Report the counts of a mailbox without selecting it
+func (s *imapSession) status(tag string, args []imapArg) {
+	if len(args) != 2 || !args[0].isString() || args[1].kind != imapList {
+		s.tagged(tag, "BAD", "STATUS needs a mailbox and a list of items")
+		return
+	}
+	folder, ok, err := s.findFolder(args[0].value)
+	if err != nil {
+		s.tagged(tag, "NO", "Failed to find the mailbox: %v", err)
+		return
+	} else if !ok {
+		s.tagged(tag, "NO", "[NONEXISTENT] No such mailbox")
+		return
+	}
+
+	validity, next, count := uint32(1), uint32(1), 0
+	if folder.ChatJID != "" {
+		if validity, next, err = s.server.store.assignIMAPUIDs(folder.ChatJID); err == nil {
+			count, err = s.server.store.countIMAPMessages(folder.ChatJID)
+		}
+		if err != nil {
+			s.tagged(tag, "NO", "Failed to count the messages: %v", err)
+			return
+		}
+	}
+
+	var items []string
+	for _, item := range args[1].list {
+		switch name := strings.ToUpper(item.value); name {
+		case "MESSAGES":
+			items = append(items, fmt.Sprintf("MESSAGES %d", count))
+		case "RECENT", "UNSEEN":
+			items = append(items, name+" 0")
+		case "UIDNEXT":
+			items = append(items, fmt.Sprintf("UIDNEXT %d", next))
+		case "UIDVALIDITY":
+			items = append(items, fmt.Sprintf("UIDVALIDITY %d", validity))
+		default:
+			s.tagged(tag, "BAD", "Unknown status item %s", item.value)
+			return
+		}
+	}
+	s.untagged("STATUS %s (%s)", imapString(args[0].value), strings.Join(items, " "))
+	s.tagged(tag, "OK", "STATUS completed")
+}
+
+// Wait for DONE, telling the client about new messages in the meantime
+func (s *imapSession) idle(tag string) bool {
+	fmt.Fprint(s.w, "+ idling\r\n")
+	s.w.Flush()
+
+	done := make(chan error, 1)
+	goSafe("reading the end of an IMAP IDLE", func() {
+		s.conn.SetReadDeadline(time.Now().Add(imapIdleTimeout))
+		line, err := s.readLine()
+		if err == nil && !strings.EqualFold(line, "DONE") {
+			err = errIMAPSyntax
+		}
+		done <- err
+	})
+
+	ticker := time.NewTicker(imapIdlePoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			if errors.Is(err, errIMAPSyntax) {
+				s.tagged(tag, "BAD", "Expected DONE")
+				return true
+			} else if err != nil {
+				return false
+			}
+			s.tagged(tag, "OK", "IDLE terminated")
+			return true
+		case <-ticker.C:
+			if s.selected != nil {
+				s.refresh()
+				s.w.Flush()
+			}
+		}
+	}
+}
+
+// Get the mailbox indexes of the messages in a sequence set, or a UID set
+func (m *imapMailbox) resolve(set string, byUID bool) ([]int, error) {
+	var largest uint32
+	if n := len(m.messages); n > 0 {
+		largest = uint32(n)
+		if byUID {
+			largest = m.messages[n-1].UID
+		}
+	}
+	ranges, err := parseSequenceSet(set, largest)
+	if err != nil {
+		return nil, err
+	}
+	var indexes []int
+	for i, msg := range m.messages {
+		n := uint32(i + 1)
+		if byUID {
+			n = msg.UID
+		}
+		for _, r := range ranges {
+			if n >= r[0] && n <= r[1] {
+				indexes = append(indexes, i)
+				break
+			}
+		}
+	}
+	return indexes, nil
+}
+
+// Parse a sequence set like 1:5,7,9:* into ranges, * being the largest number
+func parseSequenceSet(set string, largest uint32) ([][2]uint32, error) {
+	number := func(s string) (uint32, error) {
+		if s == "*" {
+			return largest, nil
+		}
+		n, err := strconv.ParseUint(s, 10, 32)
+		if err != nil || n == 0 {
+			return 0, fmt.Errorf("invalid sequence set %q", set)
+		}
+		return uint32(n), nil
+	}
+	var ranges [][2]uint32
+	for _, part := range strings.Split(set, ",") {
+		from, to, isRange := strings.Cut(part, ":")
+		if !isRange {
+			to = from
+		}
+		a, err := number(from)
+		if err != nil {
+			return nil, err
+		}
+		b, err := number(to)
+		if err != nil {
+			return nil, err
+		}
+		if a > b {
+			a, b = b, a
+		}
+		ranges = append(ranges, [2]uint32{a, b})
+	}
+	return ranges, nil
+}
+
+// Get a message of the mailbox as an email, rendering it on first use
+func (s *imapSession) mail(index int) *imapMail {
+	mailbox := s.selected
+	msg := mailbox.messages[index]
+	if rendered, ok := mailbox.mails[msg.UID]; ok {
+		return rendered
+	}
+	if len(mailbox.mails) >= imapMailCache {
+		mailbox.mails = map[uint32]*imapMail{}
+	}
+	rendered := renderIMAPMail(msg, mailbox.names.name(msg.Message), mailbox.folder.ChatName, s.server.ownUser())
+	mailbox.mails[msg.UID] = rendered
+	return rendered
+}
+
+// Flags of a message. Everything in the archive counts as seen.
+func imapFlags(msg imapMessage) string {
+	if msg.Flagged {
+		return `(\Seen \Flagged)`
+	}
+	return `(\Seen)`
+}
+
+// imapFetchItem is an item a FETCH asks for
+type imapFetchItem struct {
+	name    string   // Name of the item in the response
+	kind    string   // Item, or BODY[] for sections
+	section string   // Section of BODY[], like HEADER.FIELDS or 1
+	fields  []string // Header fields of HEADER.FIELDS sections
+	partial bool
+	offset  int
+	length  int
+}
+
+// Parse the items of a FETCH, expanding the macros
+func parseFetchItems(arg imapArg) ([]imapFetchItem, error) {
+	var names []string
+	switch arg.kind {
+	case imapList:
+		for _, a := range arg.list {
+			if a.kind != imapAtom {
+				return nil, fmt.Errorf("invalid fetch item")
+			}
+			names = append(names, a.value)
+		}
+	case imapAtom:
+		switch strings.ToUpper(arg.value) {
+		case "ALL":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"}
+		case "FAST":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE"}
+		case "FULL":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY"}
+		default:
+			names = []string{arg.value}
+		}
+	default:
+		return nil, fmt.Errorf("invalid fetch items")
+	}
+
+	var items []imapFetchItem
+	for _, name := range names {
+		upper := strings.ToUpper(name)
+		switch upper {
+		case "UID", "FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODYSTRUCTURE", "BODY":
+			items = append(items, imapFetchItem{name: upper, kind: upper})
+			continue
+		case "RFC822":
+			items = append(items, imapFetchItem{name: upper, kind: "BODY[]"})
+			continue
+		case "RFC822.HEADER":
+			items = append(items, imapFetchItem{name: upper, kind: "BODY[]", section: "HEADER"})
+			continue
+		case "RFC822.TEXT":
+			items = append(items, imapFetchItem{name: upper, kind: "BODY[]", section: "TEXT"})
+			continue
+		}
+
+		rest, ok := strings.CutPrefix(upper, "BODY.PEEK[")
+		if !ok {
+			if rest, ok = strings.CutPrefix(upper, "BODY["); !ok {
+				return nil, fmt.Errorf("unknown fetch item %s", name)
+			}
+		}
+		end := strings.LastIndex(rest, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid fetch item %s", name)
+		}
+		item := imapFetchItem{kind: "BODY[]", section: rest[:end]}
+		item.name = "BODY[" + item.section + "]"
+		if spec, fields, ok := strings.Cut(item.section, " "); ok {
+			item.section = spec
+			for _, f := range strings.Fields(strings.Trim(fields, "()")) {
+				item.fields = append(item.fields, strings.Trim(f, `"`))
+			}
+		}
+		if partial := rest[end+1:]; partial != "" {
+			var offset, length int
+			if _, err := fmt.Sscanf(partial, "<%d.%d>", &offset, &length); err != nil || offset < 0 || length < 0 {
+				return nil, fmt.Errorf("invalid partial %s", partial)
+			}
+			item.partial, item.offset, item.length = true, offset, length
+			item.name += fmt.Sprintf("<%d>", offset)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Send the items asked for of the messages in a set
+func (s *imapSession) fetch(tag string, args []imapArg, byUID bool) {
+	if len(args) < 2 || args[0].kind != imapAtom {
+		s.tagged(tag, "BAD", "FETCH needs a sequence set and items")
+		return
+	}
+	indexes, err := s.selected.resolve(args[0].value, byUID)
+	if err != nil {
+		s.tagged(tag, "BAD", "%v", err)
+		return
+	}
+	items, err := parseFetchItems(args[1])
+	if err != nil {
+		s.tagged(tag, "BAD", "%v", err)
+		return
+	}
+	if byUID {
+		hasUID := false
+		for _, item := range items {
+			hasUID = hasUID || item.kind == "UID"
+		}
+		if !hasUID {
+			items = append([]imapFetchItem{{name: "UID", kind: "UID"}}, items...)
+		}
+	}
+
+	for _, i := range indexes {
+		msg := s.selected.messages[i]
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "* %d FETCH (", i+1)
+		for j, item := range items {
+			if j > 0 {
+				buf.WriteByte(' ')
+			}
+			switch item.kind {
+			case "UID":
+				fmt.Fprintf(&buf, "UID %d", msg.UID)
+			case "FLAGS":
+				fmt.Fprintf(&buf, "FLAGS %s", imapFlags(msg))
+			case "INTERNALDATE":
+				fmt.Fprintf(&buf, `INTERNALDATE "%s"`, msg.Time.Format("02-Jan-2006 15:04:05 -0700"))
+			case "RFC822.SIZE":
+				fmt.Fprintf(&buf, "RFC822.SIZE %d", s.mail(i).size())
+			case "ENVELOPE":
+				fmt.Fprintf(&buf, "ENVELOPE %s", s.mail(i).envelope)
+			case "BODYSTRUCTURE":
+				fmt.Fprintf(&buf, "BODYSTRUCTURE %s", s.mail(i).bodyStructure(true))
+			case "BODY":
+				fmt.Fprintf(&buf, "BODY %s", s.mail(i).bodyStructure(false))
+			default:
+				data, err := s.mail(i).section(item.section, item.fields)
+				if err != nil {
+					s.tagged(tag, "NO", "Failed to fetch %s of message %d: %v", item.name, msg.UID, err)
+					return
+				}
+				if item.partial {
+					data = data[min(item.offset, len(data)):min(item.offset+item.length, len(data))]
+				}
+				fmt.Fprintf(&buf, "%s {%d}\r\n", item.name, len(data))
+				buf.Write(data)
+			}
+		}
+		buf.WriteString(")\r\n")
+		s.w.Write(buf.Bytes())
+	}
+	s.tagged(tag, "OK", "FETCH completed")
+}
+
+// Send the numbers of the messages matching search criteria
+func (s *imapSession) search(tag string, args []imapArg, byUID bool) {
+	if len(args) >= 2 && args[0].kind == imapAtom && strings.EqualFold(args[0].value, "CHARSET") {
+		if charset := strings.ToUpper(args[1].value); charset != "UTF-8" && charset != "US-ASCII" {
+			s.tagged(tag, "NO", "[BADCHARSET (UTF-8 US-ASCII)] Unsupported charset")
+			return
+		}
+		args = args[2:]
+	}
+	parser := &imapSearchParser{session: s, args: args}
+	criteria, err := parser.parseAll()
+	if err != nil {
+		s.tagged(tag, "BAD", "%v", err)
+		return
+	}
+
+	var matches []string
+	for i, msg := range s.selected.messages {
+		if criteria(i) {
+			n := uint32(i + 1)
+			if byUID {
+				n = msg.UID
+			}
+			matches = append(matches, strconv.FormatUint(uint64(n), 10))
+		}
+	}
+	if len(matches) == 0 {
+		s.untagged("SEARCH")
+	} else {
+		s.untagged("SEARCH %s", strings.Join(matches, " "))
+	}
+	s.tagged(tag, "OK", "SEARCH completed")
+}
+
+// imapSearchParser turns SEARCH criteria into a function of the mailbox
+// index of a message
+type imapSearchParser struct {
+	session *imapSession
+	args    []imapArg
+	pos     int
+}
+
+// Parse all criteria, which must all match
+func (p *imapSearchParser) parseAll() (func(int) bool, error) {
+	var criteria []func(int) bool
+	for p.pos < len(p.args) {
+		c, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		criteria = append(criteria, c)
+	}
+	return func(i int) bool {
+		for _, c := range criteria {
+			if !c(i) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// Take the next argument as a string
+func (p *imapSearchParser) next(key string) (string, error) {
+	if p.pos >= len(p.args) || !p.args[p.pos].isString() {
+		return "", fmt.Errorf("%s needs an argument", key)
+	}
+	p.pos++
+	return p.args[p.pos-1].value, nil
+}
+
+// Parse one search key
+func (p *imapSearchParser) parse() (func(int) bool, error) {
+	arg := p.args[p.pos]
+	p.pos++
+	if arg.kind == imapList {
+		sub := &imapSearchParser{session: p.session, args: arg.list}
+		return sub.parseAll()
+	}
+
+	mailbox := p.session.selected
+	msg := func(i int) imapMessage { return mailbox.messages[i] }
+	constant := func(v bool) func(int) bool { return func(int) bool { return v } }
+	contains := func(haystack, needle string) bool {
+		return strings.Contains(strings.ToLower(haystack), strings.ToLower(needle))
+	}
+
+	key := strings.ToUpper(arg.value)
+	switch key {
+	case "ALL", "SEEN", "OLD", "UNANSWERED", "UNDELETED", "UNDRAFT":
+		return constant(true), nil
+	case "UNSEEN", "NEW", "RECENT", "ANSWERED", "DELETED", "DRAFT":
+		return constant(false), nil
+	case "FLAGGED":
+		return func(i int) bool { return msg(i).Flagged }, nil
+	case "UNFLAGGED":
+		return func(i int) bool { return !msg(i).Flagged }, nil
+	case "KEYWORD", "UNKEYWORD":
+		if _, err := p.next(key); err != nil {
+			return nil, err
+		}
+		return constant(key == "UNKEYWORD"), nil
+	case "BEFORE", "ON", "SINCE", "SENTBEFORE", "SENTON", "SENTSINCE":
+		value, err := p.next(key)
+		if err != nil {
+			return nil, err
+		}
+		date, err := time.Parse("2-Jan-2006", value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid date %q", value)
+		}
+		return func(i int) bool {
+			y, m, d := msg(i).Time.Date()
+			day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+			switch strings.TrimPrefix(key, "SENT") {
+			case "BEFORE":
+				return day.Before(date)
+			case "ON":
+				return day.Equal(date)
+			}
+			return !day.Before(date)
+		}, nil
+	case "FROM":
+		value, err := p.next(key)
+		if err != nil {
+			return nil, err
+		}
+		return func(i int) bool {
+			m := msg(i)
+			return contains(mailbox.names.name(m.Message), value) || contains(m.Sender, value) || contains(m.SenderID, value)
+		}, nil
+	case "TO":
+		value, err := p.next(key)
+		if err != nil {
+			return nil, err
+		}
+		matches := contains(mailbox.folder.ChatName, value) || contains(mailbox.folder.ChatJID, value)
+		return constant(matches), nil
+	case "CC", "BCC":
+		if _, err := p.next(key); err != nil {
+			return nil, err
+		}
+		return constant(false), nil
+	case "SUBJECT", "BODY", "TEXT":
+		value, err := p.next(key)
+		if err != nil {
+			return nil, err
+		}
+		return func(i int) bool { return contains(relayText(msg(i).Message), value) }, nil
+	case "HEADER":
+		field, err := p.next(key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.next(key)
+		if err != nil {
+			return nil, err
+		}
+		return func(i int) bool {
+			header := filterHeader(p.session.mail(i).header, []string{field}, false)
+			return len(header) > 2 && contains(string(header), value)
+		}, nil
+	case "LARGER", "SMALLER":
+		value, err := p.next(key)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid size %q", value)
+		}
+		return func(i int) bool {
+			size := p.session.mail(i).size()
+			return (key == "LARGER" && size > n) || (key == "SMALLER" && size < n)
+		}, nil
+	case "UID":
+		value, err := p.next(key)
+		if err != nil {
+			return nil, err
+		}
+		return p.inSet(value, true)
+	case "NOT":
+		if p.pos >= len(p.args) {
+			return nil, fmt.Errorf("NOT needs a search key")
+		}
+		c, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		return func(i int) bool { return !c(i) }, nil
+	case "OR":
+		if p.pos+1 >= len(p.args) {
+			return nil, fmt.Errorf("OR needs two search keys")
+		}
+		a, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		b, err := p.parse()
+		if err != nil {
+			return nil, err
+		}
+		return func(i int) bool { return a(i) || b(i) }, nil
+	}
+	if arg.kind == imapAtom && strings.Trim(arg.value, "0123456789:,*") == "" {
+		return p.inSet(arg.value, false)
+	}
+	return nil, fmt.Errorf("unsupported search key %s", arg.value)
+}
+
+// Match the messages in a sequence or UID set
+func (p *imapSearchParser) inSet(set string, byUID bool) (func(int) bool, error) {
+	indexes, err := p.session.selected.resolve(set, byUID)
+	if err != nil {
+		return nil, err
+	}
+	in := make(map[int]bool, len(indexes))
+	for _, i := range indexes {
+		in[i] = true
+	}
+	return func(i int) bool { return in[i] }, nil
+}
+
+// Kinds of command arguments
+const (
+	imapAtom = iota
+	imapQuoted
+	imapLiteral
+	imapList
+)
+
+// imapArg is an argument of a command: an atom, a string or a list
+type imapArg struct {
+	kind  int
+	value string
+	list  []imapArg
+}
+
+// Whether an argument can be read as an astring
+func (a imapArg) isString() bool {
+	return a.kind != imapList
+}
+
+// Read a line without its line break
+func (s *imapSession) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := s.r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > imapMaxLine {
+			return "", errIMAPLineTooLong
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// Read a command and its arguments, asking for literals as they come
+func (s *imapSession) readCommand() ([]imapArg, error) {
+	line, err := s.readLine()
+	if err != nil {
+		return nil, err
+	}
+	p := &imapLineParser{session: s, line: line}
+	return p.parseArgs(false)
+}
+
+// imapLineParser splits command lines into arguments
+type imapLineParser struct {
+	session *imapSession
+	line    string
+	pos     int
+}
+
+// Parse arguments up to the end of the command, or of a list
+func (p *imapLineParser) parseArgs(nested bool) ([]imapArg, error) {
+	var args []imapArg
+	for {
+		for p.pos < len(p.line) && p.line[p.pos] == ' ' {
+			p.pos++
+		}
+		if p.pos >= len(p.line) {
+			if nested {
+				return args, fmt.Errorf("%w: unclosed list", errIMAPSyntax)
+			}
+			return args, nil
+		}
+
+		switch p.line[p.pos] {
+		case ')':
+			if !nested {
+				return args, fmt.Errorf("%w: unexpected )", errIMAPSyntax)
+			}
+			p.pos++
+			return args, nil
+		case '(':
+			p.pos++
+			list, err := p.parseArgs(true)
+			if err != nil {
+				return args, err
+			}
+			args = append(args, imapArg{kind: imapList, list: list})
+		case '"':
+			value, err := p.parseQuoted()
+			if err != nil {
+				return args, err
+			}
+			args = append(args, imapArg{kind: imapQuoted, value: value})
+		case '{':
+			value, err := p.parseLiteral()
+			if err != nil {
+				return args, err
+			}
+			args = append(args, imapArg{kind: imapLiteral, value: value})
+		default:
+			args = append(args, imapArg{kind: imapAtom, value: p.parseAtom()})
+		}
+	}
+}
+
+// Parse a quoted string
+func (p *imapLineParser) parseQuoted() (string, error) {
+	var b strings.Builder
+	for p.pos++; p.pos < len(p.line); p.pos++ {
+		switch c := p.line[p.pos]; c {
+		case '"':
+			p.pos++
+			return b.String(), nil
+		case '\\':
+			p.pos++
+			if p.pos < len(p.line) {
+				b.WriteByte(p.line[p.pos])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("%w: unterminated string", errIMAPSyntax)
+}
+
+// Parse a literal ending the line, reading its data and the rest of the command
+func (p *imapLineParser) parseLiteral() (string, error) {
+	end := strings.IndexByte(p.line[p.pos:], '}')
+	if end < 0 || p.pos+end != len(p.line)-1 {
+		return "", fmt.Errorf("%w: literals must end the line", errIMAPSyntax)
+	}
+	spec := p.line[p.pos+1 : p.pos+end]
+	nonSync := strings.HasSuffix(spec, "+")
+	size, err := strconv.Atoi(strings.TrimSuffix(spec, "+"))
+	if err != nil || size < 0 {
+		return "", fmt.Errorf("%w: invalid literal", errIMAPSyntax)
+	}
+	if size > imapMaxLine {
+		return "", errIMAPLineTooLong
+	}
+	if !nonSync {
+		fmt.Fprint(p.session.w, "+ Ready for literal data\r\n")
+		p.session.w.Flush()
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(p.session.r, data); err != nil {
+		return "", err
+	}
+	if p.line, err = p.session.readLine(); err != nil {
+		return "", err
+	}
+	p.pos = 0
+	return string(data), nil
+}
+
+// Parse an atom. Brackets are kept whole, with what is between them, so
+// BODY[HEADER.FIELDS (DATE)] is one atom.
+func (p *imapLineParser) parseAtom() string {
+	start, depth := p.pos, 0
+	for ; p.pos < len(p.line); p.pos++ {
+		c := p.line[p.pos]
+		if c == '[' {
+			depth++
+		} else if c == ']' && depth > 0 {
+			depth--
+		} else if depth == 0 && (c == ' ' || c == '(' || c == ')') {
+			break
+		}
+	}
+	return p.line[start:p.pos]
+}
+
+// Format a string for a response, quoted if it can be and as a literal if not
+func imapString(s string) string {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < 0x20 || c > 0x7e {
+			return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+		}
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// Base64 alphabet of the modified UTF-7 of mailbox names
+var mailboxBase64 = base64.NewEncoding("ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+,").WithPadding(base64.NoPadding)
+
+// Encode a mailbox name in the modified UTF-7 of RFC 3501
+func encodeMailboxName(name string) string {
+	var b strings.Builder
+	var run []rune
+	flush := func() {
+		if len(run) == 0 {
+			return
+		}
+		units := utf16.Encode(run)
+		data := make([]byte, 0, 2*len(units))
+		for _, u := range units {
+			data = append(data, byte(u>>8), byte(u))
+		}
+		b.WriteString("&" + mailboxBase64.EncodeToString(data) + "-")
+		run = run[:0]
+	}
+	for _, r := range name {
+		if r < 0x20 || r > 0x7e {
+			run = append(run, r)
+			continue
+		}
+		flush()
+		if r == '&' {
+			b.WriteString("&-")
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	flush()
+	return b.String()
+}
+
+// Decode a mailbox name from modified UTF-7
+func decodeMailboxName(name string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(name); {
+		if name[i] != '&' {
+			b.WriteByte(name[i])
+			i++
+			continue
+		}
+		end := strings.IndexByte(name[i:], '-')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated shift in %q", name)
+		}
+		encoded := name[i+1 : i+end]
+		i += end + 1
+		if encoded == "" {
+			b.WriteByte('&')
+			continue
+		}
+		data, err := mailboxBase64.DecodeString(encoded)
+		if err != nil || len(data)%2 != 0 {
+			return "", fmt.Errorf("invalid modified UTF-7 in %q", name)
+		}
+		units := make([]uint16, len(data)/2)
+		for j := range units {
+			units[j] = uint16(data[2*j])<<8 | uint16(data[2*j+1])
+		}
+		b.WriteString(string(utf16.Decode(units)))
+	}
+	return b.String(), nil
+}
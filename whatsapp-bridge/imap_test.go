@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// imapTestClient speaks IMAP to the archive in tests
+type imapTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+	tags int
+}
+
+// Start an IMAP archive on a loopback port and connect to it
+func dialTestIMAP(t *testing.T, tokens []*APIToken) *imapTestClient {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := &imapServer{store: testStore, tokens: tokens, ownUser: func() string { return "15550000000" }}
+	go server.serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	c := &imapTestClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	if greeting, _ := c.r.ReadString('\n'); !strings.HasPrefix(greeting, "* OK") {
+		t.Fatalf("Greeting %q", greeting)
+	}
+	return c
+}
+
+// Run a command, returning its responses with literals inlined and the
+// tagged completion
+func (c *imapTestClient) do(command string) (string, string) {
+	c.t.Helper()
+	c.tags++
+	tag := fmt.Sprintf("T%d", c.tags)
+	fmt.Fprintf(c.conn, "%s %s\r\n", tag, command)
+	var responses strings.Builder
+	literal := regexp.MustCompile(`\{(\d+)\}\r\n$`)
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("%s: %v", command, err)
+		}
+		if strings.HasPrefix(line, tag+" ") {
+			return responses.String(), strings.TrimSpace(strings.TrimPrefix(line, tag+" "))
+		}
+		responses.WriteString(line)
+		if m := literal.FindStringSubmatch(line); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			data := make([]byte, n)
+			if _, err := io.ReadFull(c.r, data); err != nil {
+				c.t.Fatal(err)
+			}
+			responses.Write(data)
+		}
+	}
+}
+
+// Run a command that must succeed
+func (c *imapTestClient) ok(command string) string {
+	c.t.Helper()
+	responses, status := c.do(command)
+	if !strings.HasPrefix(status, "OK") {
+		c.t.Fatalf("%s: %s", command, status)
+	}
+	return responses
+}
+
+func TestIMAPArchive(t *testing.T) {
+	chat := "15551270001@s.whatsapp.net"
+	start := time.Date(2026, 3, 1, 10, 0, 0, 0, time.Local)
+	storeTestMessage(t, Message{ID: "IMAP1", ChatJID: chat, Sender: "15551270001", Content: "Lunch tomorrow?", Time: start}, "", nil, 0)
+	storeTestMessage(t, Message{ID: "IMAP2", ChatJID: chat, Sender: "15551270001", Content: "the report", MediaType: "document", Filename: "report.pdf", Time: start.Add(time.Minute)}, "", nil, 0)
+	testStore.StoreChat(chat, "Zoë", start.Add(time.Minute))
+	testStore.SetStarred(chat, "IMAP1", true)
+	if err := os.MkdirAll(mediaDirForChat(chat), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(mediaDirForChat(chat), "report.pdf"), []byte(strings.Repeat("%PDF-1.7\n", 50)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := dialTestIMAP(t, []*APIToken{
+		{Name: "mail", Token: "read-token", Scopes: []string{ScopeReadMessages}},
+		{Name: "sender", Token: "send-token", Scopes: []string{ScopeSendMessages}},
+	})
+	if _, status := c.do("LOGIN me send-token"); !strings.HasPrefix(status, "NO") {
+		t.Errorf("Login with a token that can't read messages: %s", status)
+	}
+	c.ok(`LOGIN me "read-token"`)
+
+	folder := encodeMailboxName("Chats/Zoë")
+	list := c.ok(`LIST "" "*"`)
+	if !strings.Contains(list, `"Chats/Zo&AOs-"`) || !strings.Contains(list, `(\Noselect \HasChildren) "/" "Chats"`) {
+		t.Errorf("LIST doesn't show the chat as %s:\n%s", folder, list)
+	}
+	if list := c.ok(`LIST "" "%"`); strings.Contains(list, folder) {
+		t.Errorf("LIST %% shows the nested chat:\n%s", list)
+	}
+
+	selected := c.ok("SELECT " + folder)
+	if !strings.Contains(selected, "* 2 EXISTS") {
+		t.Fatalf("SELECT:\n%s", selected)
+	}
+
+	fetched := c.ok("UID FETCH 1:* (FLAGS RFC822.SIZE BODY.PEEK[])")
+	sizes := regexp.MustCompile(`RFC822\.SIZE (\d+) BODY\[\] \{(\d+)\}`).FindAllStringSubmatch(fetched, -1)
+	if len(sizes) != 2 {
+		t.Fatalf("FETCH:\n%s", fetched)
+	}
+	for _, m := range sizes {
+		if m[1] != m[2] {
+			t.Errorf("RFC822.SIZE %s doesn't match the %s bytes of the message", m[1], m[2])
+		}
+	}
+	for _, want := range []string{`UID 1 FLAGS (\Seen \Flagged)`, "Subject: Lunch tomorrow?", "To: =?utf-8?q?Zo=C3=AB?= <15551270001@s.whatsapp.net>", "filename=report.pdf", "JVBERi0xLjcK"} {
+		if !strings.Contains(fetched, want) {
+			t.Errorf("FETCH doesn't have %q:\n%s", want, fetched)
+		}
+	}
+
+	structure := c.ok("FETCH 2 (BODYSTRUCTURE)")
+	if !strings.Contains(structure, `("APPLICATION" "PDF" ("NAME" "report.pdf") NIL NIL "BASE64"`) {
+		t.Errorf("BODYSTRUCTURE:\n%s", structure)
+	}
+	if part := c.ok("UID FETCH 2 (BODY.PEEK[2]<0.12>)"); !strings.Contains(part, "BODY[2]<0> {12}\r\nJVBERi0xLjcK") {
+		t.Errorf("Partial fetch of the attachment:\n%s", part)
+	}
+
+	if found := c.ok("UID SEARCH TEXT report"); !strings.Contains(found, "* SEARCH 2\r\n") {
+		t.Errorf("SEARCH TEXT:\n%s", found)
+	}
+	if found := c.ok("SEARCH OR FLAGGED SINCE 2-Mar-2026 NOT UID 2"); !strings.Contains(found, "* SEARCH 1\r\n") {
+		t.Errorf("SEARCH OR:\n%s", found)
+	}
+	if _, status := c.do(`STORE 1 +FLAGS (\Deleted)`); !strings.HasPrefix(status, "NO") {
+		t.Errorf("STORE was not refused: %s", status)
+	}
+
+	// New messages get the next UID and show up on NOOP
+	storeTestMessage(t, Message{ID: "IMAP3", ChatJID: chat, Sender: "15551270001", Content: "Earlier, from the history", Time: start.Add(-time.Hour)}, "", nil, 0)
+	testStore.StoreChat(chat, "Zoë", start.Add(time.Minute))
+	if noop := c.ok("NOOP"); !strings.Contains(noop, "* 3 EXISTS") {
+		t.Errorf("NOOP:\n%s", noop)
+	}
+	if uids := c.ok("FETCH 1:* (UID)"); !strings.Contains(uids, "* 1 FETCH (UID 1)") || !strings.Contains(uids, "* 3 FETCH (UID 3)") {
+		t.Errorf("UIDs changed:\n%s", uids)
+	}
+	if status := c.ok("STATUS " + folder + " (MESSAGES UIDNEXT)"); !strings.Contains(status, "(MESSAGES 3 UIDNEXT 4)") {
+		t.Errorf("STATUS:\n%s", status)
+	}
+	c.ok("LOGOUT")
+}
+
+func TestMailboxNameEncoding(t *testing.T) {
+	for _, name := range []string{"Groups/Family", "Chats/Zoë & Ann", "Chats/日本語", "Chats/🎉 Party"} {
+		encoded := encodeMailboxName(name)
+		if strings.ContainsFunc(encoded, func(r rune) bool { return r > 0x7e }) {
+			t.Errorf("%q encodes to %q, which isn't ASCII", name, encoded)
+		}
+		if decoded, err := decodeMailboxName(encoded); err != nil || decoded != name {
+			t.Errorf("%q encodes to %q, which decodes to %q (%v)", name, encoded, decoded, err)
+		}
+	}
+	if got := encodeMailboxName("Zoë & Ann"); got != "Zo&AOs- &- Ann" {
+		t.Errorf("Encoded as %q", got)
+	}
+}
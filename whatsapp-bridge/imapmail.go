@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Folders the chats of the IMAP archive are listed under, by kind
+const (
+	imapChatsFolder    = "Chats"
+	imapGroupsFolder   = "Groups"
+	imapChannelsFolder = "Channels"
+)
+
+// Separator of the levels of IMAP mailbox names
+const imapDelimiter = "/"
+
+// imapFolder is a chat as a mailbox of the IMAP archive
+type imapFolder struct {
+	Name     string // Full mailbox name, like "Groups/Family"
+	ChatJID  string // Empty for INBOX, which holds no messages
+	ChatName string
+}
+
+// Get the folder chats of a kind are listed under
+func imapParentFolder(chatJID string) string {
+	jid, err := types.ParseJID(chatJID)
+	switch {
+	case err != nil:
+		return imapChatsFolder
+	case jid.Server == types.GroupServer:
+		return imapGroupsFolder
+	case jid.Server == types.NewsletterServer:
+		return imapChannelsFolder
+	}
+	return imapChatsFolder
+}
+
+// List the chats with stored messages as mailboxes, named after the chat.
+// Names that would clash get the user of the chat JID appended.
+func (store *MessageStore) imapFolders() ([]imapFolder, error) {
+	rows, err := store.db.Query(`SELECT jid, COALESCE(name, '') FROM chats
+		WHERE EXISTS (SELECT 1 FROM messages WHERE messages.chat_jid = chats.jid) ORDER BY jid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var folders []imapFolder
+	taken := map[string]bool{}
+	for rows.Next() {
+		var jid, name string
+		if err := rows.Scan(&jid, &name); err != nil {
+			return nil, err
+		}
+		user := strings.SplitN(jid, "@", 2)[0]
+		leaf := strings.Map(func(r rune) rune {
+			if r < 0x20 || r == 0x7f {
+				return -1
+			}
+			if r == '/' {
+				return '-'
+			}
+			return r
+		}, strings.TrimSpace(name))
+		if leaf == "" {
+			leaf = user
+		}
+		full := imapParentFolder(jid) + imapDelimiter + leaf
+		if taken[strings.ToLower(full)] {
+			full += " (" + user + ")"
+		}
+		taken[strings.ToLower(full)] = true
+		if name == "" {
+			name = user
+		}
+		folders = append(folders, imapFolder{Name: full, ChatJID: jid, ChatName: name})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(folders, func(i, j int) bool { return folders[i].Name < folders[j].Name })
+	return folders, nil
+}
+
+// Assign IMAP UIDs to the messages of a chat that have none yet, in the order
+// they were sent, and get the UID validity and next UID of its mailbox. UIDs
+// are kept in the database so they stay the same across sessions.
+func (store *MessageStore) assignIMAPUIDs(chatJID string) (uint32, uint32, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("INSERT OR IGNORE INTO imap_mailboxes (chat_jid, uid_validity, uid_next) VALUES (?, ?, 1)",
+		chatJID, time.Now().Unix()); err != nil {
+		return 0, 0, err
+	}
+	var validity, next uint32
+	if err := tx.QueryRow("SELECT uid_validity, uid_next FROM imap_mailboxes WHERE chat_jid = ?", chatJID).Scan(&validity, &next); err != nil {
+		return 0, 0, err
+	}
+
+	rows, err := tx.Query(`SELECT messages.id FROM messages
+		LEFT JOIN imap_uids ON imap_uids.mailbox_jid = messages.chat_jid AND imap_uids.message_id = messages.id
+		WHERE messages.chat_jid = ? AND imap_uids.uid IS NULL
+		ORDER BY messages.timestamp, messages.id`, chatJID)
+	if err != nil {
+		return 0, 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+	if len(ids) == 0 {
+		return validity, next, nil
+	}
+
+	for _, id := range ids {
+		if _, err := tx.Exec("INSERT INTO imap_uids (mailbox_jid, message_id, uid) VALUES (?, ?, ?)", chatJID, id, next); err != nil {
+			return 0, 0, err
+		}
+		next++
+	}
+	if _, err := tx.Exec("UPDATE imap_mailboxes SET uid_next = ? WHERE chat_jid = ?", next, chatJID); err != nil {
+		return 0, 0, err
+	}
+	return validity, next, tx.Commit()
+}
+
+// imapMessage is a stored message with its place in a mailbox
+type imapMessage struct {
+	UID     uint32
+	Flagged bool // Starred in WhatsApp
+	Message
+}
+
+// Get the messages of a chat with a UID above afterUID, in UID order
+func (store *MessageStore) imapMessages(chatJID string, afterUID uint32) ([]imapMessage, error) {
+	rows, err := store.db.Query(`SELECT imap_uids.uid, COALESCE(messages.is_starred, 0), `+messageColumns+` FROM imap_uids
+		JOIN messages ON messages.id = imap_uids.message_id AND messages.chat_jid = imap_uids.mailbox_jid
+		WHERE imap_uids.mailbox_jid = ? AND imap_uids.uid > ? ORDER BY imap_uids.uid`, chatJID, afterUID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []imapMessage
+	for rows.Next() {
+		var m imapMessage
+		if err := rows.Scan(&m.UID, &m.Flagged, &m.ID, &m.ChatJID, &m.Sender, &m.Content, &m.Time, &m.IsFromMe, &m.MediaType, &m.Filename,
+			&m.ViewOnce, &m.Revoked, &m.Selected, &m.OCRText, &m.Language, &m.SenderID, &m.SenderLID); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
+}
+
+// Count the messages of a chat that have a UID
+func (store *MessageStore) countIMAPMessages(chatJID string) (int, error) {
+	var n int
+	err := store.db.QueryRow(`SELECT COUNT(*) FROM imap_uids
+		JOIN messages ON messages.id = imap_uids.message_id AND messages.chat_jid = imap_uids.mailbox_jid
+		WHERE imap_uids.mailbox_jid = ?`, chatJID).Scan(&n)
+	return n, err
+}
+
+// MIME header of the text part of an email with an attachment
+const imapTextPartHeader = "Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n"
+
+// imapMail is a message rendered as an email: a text part with the media
+// file attached if it was downloaded. The base64 of the file is only made
+// when a client fetches it, so sizes and structure are cheap to give.
+type imapMail struct {
+	header    []byte // Top-level header, ending with the blank line
+	text      []byte // Quoted-printable text
+	textLines int
+	envelope  string // ENVELOPE of the message, in IMAP syntax
+
+	// Set when the media file is attached
+	boundary   string
+	fileHeader []byte
+	file       string
+	fileSize   int64
+	fileType   string
+	fileName   string
+}
+
+// Render a message of a chat as an email. The sender is shown by name, with
+// the phone number as the address.
+func renderIMAPMail(m imapMessage, senderName, chatName, ownUser string) *imapMail {
+	user := m.SenderID
+	if user == "" {
+		user = m.Sender
+	}
+	if m.IsFromMe {
+		user = ownUser
+	}
+	if user == "" {
+		user = "me"
+	}
+	from := mail.Address{Name: senderName, Address: user + "@" + types.DefaultUserServer}
+	to := mail.Address{Name: chatName, Address: m.ChatJID}
+
+	rendered := &imapMail{}
+	path := filepath.Join(mediaDirForChat(m.ChatJID), m.Filename)
+	text := relayText(m.Message)
+	if info, err := os.Stat(path); err == nil && m.MediaType != "" && m.Filename != "" && !m.ViewOnce && info.Mode().IsRegular() {
+		rendered.file, rendered.fileSize, rendered.fileName = path, info.Size(), m.Filename
+		rendered.fileType = mime.TypeByExtension(filepath.Ext(m.Filename))
+		if mediaType, _, err := mime.ParseMediaType(rendered.fileType); err == nil && !strings.HasPrefix(mediaType, "message/") {
+			rendered.fileType = mediaType
+		} else {
+			rendered.fileType = "application/octet-stream"
+		}
+		text = strings.TrimSpace(m.Content)
+	}
+
+	subject := truncateRunes(strings.TrimSpace(strings.SplitN(text, "\n", 2)[0]), 60)
+	if subject == "" {
+		subject = "[" + m.MediaType + "]"
+	}
+	messageID := fmt.Sprintf("<%s@%s>", m.ID, strings.ReplaceAll(m.ChatJID, "@", "."))
+
+	var qp bytes.Buffer
+	writer := quotedprintable.NewWriter(&qp)
+	writer.Write([]byte(text))
+	writer.Close()
+	if qp.Len() > 0 && !bytes.HasSuffix(qp.Bytes(), []byte("\r\n")) {
+		qp.WriteString("\r\n")
+	}
+	rendered.text = qp.Bytes()
+	rendered.textLines = bytes.Count(rendered.text, []byte("\n"))
+
+	var header bytes.Buffer
+	field := func(key, value string) { fmt.Fprintf(&header, "%s: %s\r\n", key, value) }
+	date := m.Time.Format(time.RFC1123Z)
+	encodedSubject := mime.QEncoding.Encode("utf-8", subject)
+	field("Date", date)
+	field("From", from.String())
+	field("To", to.String())
+	field("Subject", encodedSubject)
+	field("Message-ID", messageID)
+	field("X-WhatsApp-Chat", m.ChatJID)
+	field("X-WhatsApp-Message-ID", m.ID)
+	field("MIME-Version", "1.0")
+	if rendered.file == "" {
+		field("Content-Type", "text/plain; charset=utf-8")
+		field("Content-Transfer-Encoding", "quoted-printable")
+	} else {
+		sum := sha256.Sum256([]byte(m.ChatJID + "/" + m.ID))
+		// Quoted-printable and base64 never produce "=_", so it can't show up in the parts
+		rendered.boundary = "=_" + hex.EncodeToString(sum[:12])
+		field("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": rendered.boundary}))
+		rendered.fileHeader = []byte(fmt.Sprintf("Content-Type: %s\r\nContent-Disposition: %s\r\nContent-Transfer-Encoding: base64\r\n\r\n",
+			mime.FormatMediaType(rendered.fileType, map[string]string{"name": rendered.fileName}),
+			mime.FormatMediaType("attachment", map[string]string{"filename": rendered.fileName})))
+	}
+	header.WriteString("\r\n")
+	rendered.header = header.Bytes()
+
+	address := func(a mail.Address) string {
+		at := strings.LastIndex(a.Address, "@")
+		return fmt.Sprintf("((%s NIL %s %s))", imapString(mime.QEncoding.Encode("utf-8", a.Name)), imapString(a.Address[:at]), imapString(a.Address[at+1:]))
+	}
+	rendered.envelope = fmt.Sprintf("(%s %s %s %s %s %s NIL NIL NIL %s)",
+		imapString(date), imapString(encodedSubject), address(from), address(from), address(from), address(to), imapString(messageID))
+	return rendered
+}
+
+// Number of lines writeBase64Lines writes for n bytes
+func base64LineCount(n int64) int64 {
+	return max((n+2)/3*4+75, 76) / 76
+}
+
+// Length of what writeBase64Lines writes for n bytes
+func base64LinesSize(n int64) int64 {
+	return (n+2)/3*4 + 2*base64LineCount(n)
+}
+
+// Delimiters around the parts of a multipart email
+func (m *imapMail) partDelimiters() (first, middle, last string) {
+	return "--" + m.boundary + "\r\n", "\r\n--" + m.boundary + "\r\n", "\r\n--" + m.boundary + "--\r\n"
+}
+
+// Size of the whole email
+func (m *imapMail) size() int64 {
+	if m.file == "" {
+		return int64(len(m.header) + len(m.text))
+	}
+	first, middle, last := m.partDelimiters()
+	return int64(len(m.header)+len(first)+len(imapTextPartHeader)+len(m.text)+len(middle)+len(m.fileHeader)+len(last)) +
+		base64LinesSize(m.fileSize)
+}
+
+// Read and encode the attached file
+func (m *imapMail) encodedFile() ([]byte, error) {
+	data, err := os.ReadFile(m.file)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Grow(int(base64LinesSize(int64(len(data)))))
+	writeBase64Lines(&buf, data)
+	return buf.Bytes(), nil
+}
+
+// Get the body of the email, everything after its header
+func (m *imapMail) body() ([]byte, error) {
+	if m.file == "" {
+		return m.text, nil
+	}
+	file, err := m.encodedFile()
+	if err != nil {
+		return nil, err
+	}
+	first, middle, last := m.partDelimiters()
+	var buf bytes.Buffer
+	buf.WriteString(first)
+	buf.WriteString(imapTextPartHeader)
+	buf.Write(m.text)
+	buf.WriteString(middle)
+	buf.Write(m.fileHeader)
+	buf.Write(file)
+	buf.WriteString(last)
+	return buf.Bytes(), nil
+}
+
+// Get a section of the email as FETCH BODY[section] names it. Fields are the
+// header fields of HEADER.FIELDS and HEADER.FIELDS.NOT.
+func (m *imapMail) section(section string, fields []string) ([]byte, error) {
+	switch section {
+	case "":
+		body, err := m.body()
+		if err != nil {
+			return nil, err
+		}
+		return append(append([]byte{}, m.header...), body...), nil
+	case "HEADER":
+		return m.header, nil
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		return filterHeader(m.header, fields, section == "HEADER.FIELDS.NOT"), nil
+	case "TEXT":
+		return m.body()
+	case "1":
+		return m.text, nil
+	case "1.MIME":
+		if m.file == "" {
+			return filterHeader(m.header, []string{"Content-Type", "Content-Transfer-Encoding"}, false), nil
+		}
+		return []byte(imapTextPartHeader), nil
+	case "2":
+		if m.file != "" {
+			return m.encodedFile()
+		}
+	case "2.MIME":
+		if m.file != "" {
+			return m.fileHeader, nil
+		}
+	}
+	return nil, fmt.Errorf("no section %s", section)
+}
+
+// Keep the header fields named, or all but those if not is set
+func filterHeader(header []byte, fields []string, not bool) []byte {
+	var buf bytes.Buffer
+	for _, line := range strings.Split(string(header), "\r\n") {
+		name, _, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		named := false
+		for _, f := range fields {
+			if strings.EqualFold(f, name) {
+				named = true
+				break
+			}
+		}
+		if named != not {
+			buf.WriteString(line + "\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
+
+// Get the BODYSTRUCTURE of the email, or BODY without extension data
+func (m *imapMail) bodyStructure(extended bool) string {
+	text := fmt.Sprintf(`("TEXT" "PLAIN" ("CHARSET" "utf-8") NIL NIL "QUOTED-PRINTABLE" %d %d)`, len(m.text), m.textLines)
+	if m.file == "" {
+		return text
+	}
+
+	mediaType, subtype, _ := strings.Cut(strings.ToUpper(m.fileType), "/")
+	file := fmt.Sprintf(`(%s %s ("NAME" %s) NIL NIL "BASE64" %d`, imapString(mediaType), imapString(subtype), imapString(m.fileName), base64LinesSize(m.fileSize))
+	if mediaType == "TEXT" {
+		file += fmt.Sprintf(" %d", base64LineCount(m.fileSize))
+	}
+	if extended {
+		file += fmt.Sprintf(` NIL ("ATTACHMENT" ("FILENAME" %s)) NIL`, imapString(m.fileName))
+	}
+	file += ")"
+
+	structure := "(" + text + file + ` "MIXED"`
+	if extended {
+		structure += fmt.Sprintf(` ("BOUNDARY" %s) NIL NIL`, imapString(m.boundary))
+	}
+	return structure + ")"
+}
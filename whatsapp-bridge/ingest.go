@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Settings key of the ingestion filters
+const ingestFiltersKey = "ingest_filters"
+
+// IngestFilters excludes chats from message storage entirely
+type IngestFilters struct {
+	ExcludeChats       []string `json:"exclude_chats"`       // JIDs of chats never to store
+	ExcludeNewsletters bool     `json:"exclude_newsletters"` // Skip all channels (@newsletter)
+	ExcludeBroadcasts  bool     `json:"exclude_broadcasts"`  // Skip status updates and broadcast lists
+}
+
+// Check whether messages of a chat should be dropped instead of stored
+func (f *IngestFilters) excludes(chat types.JID) bool {
+	if f.ExcludeNewsletters && chat.Server == types.NewsletterServer {
+		return true
+	}
+	if f.ExcludeBroadcasts && chat.Server == types.BroadcastServer {
+		return true
+	}
+	chatJID := chat.String()
+	for _, excluded := range f.ExcludeChats {
+		if excluded == chatJID {
+			return true
+		}
+	}
+	return false
+}
+
+// Get a JSON setting, returns false if it isn't set
+func (store *MessageStore) GetSetting(key string, v interface{}) (bool, error) {
+	var value string
+	err := store.db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal([]byte(value), v)
+}
+
+// Store a JSON setting
+func (store *MessageStore) StoreSetting(key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = store.db.Exec("INSERT OR REPLACE INTO settings (key, value) VALUES (?, ?)", key, string(value))
+	return err
+}
+
+// Delete the stored messages and chat of an excluded chat, returning the number of deleted messages
+func (store *MessageStore) PurgeChat(chatJID string) (int64, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM messages WHERE chat_jid = ?", chatJID)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM message_tags WHERE chat_jid = ?", chatJID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM mentions WHERE chat_jid = ?", chatJID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM payments WHERE chat_jid = ?", chatJID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM chats WHERE jid = ?", chatJID); err != nil {
+		return 0, err
+	}
+	n, _ := result.RowsAffected()
+	return n, tx.Commit()
+}
+
+// Active ingestion filters, checked for every incoming message
+var (
+	ingestFilters   = &IngestFilters{ExcludeChats: []string{}}
+	ingestFiltersMu sync.RWMutex
+)
+
+// Load the stored ingestion filters into memory
+func loadIngestFilters(messageStore *MessageStore) error {
+	filters := &IngestFilters{ExcludeChats: []string{}}
+	if _, err := messageStore.GetSetting(ingestFiltersKey, filters); err != nil {
+		return err
+	}
+	ingestFiltersMu.Lock()
+	ingestFilters = filters
+	ingestFiltersMu.Unlock()
+	return nil
+}
+
+// Check whether a chat is excluded from storage by the ingestion filters
+func isIngestExcluded(chat types.JID) bool {
+	ingestFiltersMu.RLock()
+	defer ingestFiltersMu.RUnlock()
+	return ingestFilters.excludes(chat)
+}
+
+// IngestFiltersRequest represents the request body for updating the ingestion filters
+type IngestFiltersRequest struct {
+	IngestFilters
+	PurgeExisting bool `json:"purge_existing,omitempty"` // Also delete already stored messages of excluded chats
+}
+
+// IngestFiltersResponse represents the response for the ingestion filter APIs
+type IngestFiltersResponse struct {
+	Success        bool           `json:"success"`
+	Filters        *IngestFilters `json:"filters"`
+	PurgedMessages int64          `json:"purged_messages,omitempty"`
+}
+
+// Register the REST handlers for configuring which chats are stored
+func registerIngestHandlers(messageStore *MessageStore) {
+	if err := loadIngestFilters(messageStore); err != nil {
+		bridgeLog.Warnf("Failed to load ingestion filters: %v", err)
+	}
+
+	// Handler for reading the ingestion filters
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/config/ingest_filters",
+		Summary:  "Get the filters excluding chats from message storage",
+		Tag:      "config",
+		Scope:    ScopeAdmin,
+		Response: IngestFiltersResponse{},
+	})
+	http.HandleFunc("GET /api/config/ingest_filters", func(w http.ResponseWriter, r *http.Request) {
+		ingestFiltersMu.RLock()
+		filters := *ingestFilters
+		ingestFiltersMu.RUnlock()
+		writeJSON(w, http.StatusOK, IngestFiltersResponse{Success: true, Filters: &filters})
+	})
+
+	// Handler for replacing the ingestion filters
+	documentAPI(apiOperation{
+		Method:   http.MethodPut,
+		Path:     "/api/config/ingest_filters",
+		Summary:  "Replace the filters excluding chats from message storage",
+		Tag:      "config",
+		Scope:    ScopeAdmin,
+		Audit:    true,
+		Request:  IngestFiltersRequest{},
+		Response: IngestFiltersResponse{},
+	})
+	http.HandleFunc("PUT /api/config/ingest_filters", func(w http.ResponseWriter, r *http.Request) {
+		var req IngestFiltersRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+
+		filters := req.IngestFilters
+		if filters.ExcludeChats == nil {
+			filters.ExcludeChats = []string{}
+		}
+		for i, chat := range filters.ExcludeChats {
+			jid, err := types.ParseJID(chat)
+			if err != nil || !strings.Contains(chat, "@") {
+				writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("Invalid chat JID %q", chat), nil)
+				return
+			}
+			filters.ExcludeChats[i] = jid.String()
+		}
+
+		if err := messageStore.StoreSetting(ingestFiltersKey, filters); err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to store ingestion filters: %v", err), nil)
+			return
+		}
+		ingestFiltersMu.Lock()
+		ingestFilters = &filters
+		ingestFiltersMu.Unlock()
+
+		// Drop what was stored before the chats were excluded
+		var purged int64
+		if req.PurgeExisting {
+			// A negative limit lists all chats
+			chats, err := messageStore.ListChats("", -1, 0)
+			if err != nil {
+				writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list chats: %v", err), nil)
+				return
+			}
+			for _, chat := range chats {
+				jid, err := types.ParseJID(chat.JID)
+				if err != nil || !filters.excludes(jid) {
+					continue
+				}
+				n, err := messageStore.PurgeChat(chat.JID)
+				if err != nil {
+					writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to purge %s: %v", chat.JID, err), nil)
+					return
+				}
+				purged += n
+			}
+		}
+
+		writeJSON(w, http.StatusOK, IngestFiltersResponse{Success: true, Filters: &filters, PurgedMessages: purged})
+	})
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Number of example rows reported for each integrity issue
+const integritySamples = 20
+
+// Timestamps before WhatsApp existed are bogus
+var earliestMessageTime = time.Date(2009, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Tables holding rows about messages, which are orphaned once the message is gone
+var messageDetailTables = []string{"message_tags", "mentions", "payments", "links", "message_embeddings", "message_receipts", "media_retries", "extracted_entities", "message_translations", "group_events", "group_event_responses"}
+
+// Chats with messages whose freshness row is missing or doesn't match them
+const staleChatFreshnessSQL = `SELECT m.chat_jid FROM (
+		SELECT chat_jid, MAX(CASE WHEN is_from_me = 0 THEN timestamp END) AS incoming, MAX(CASE WHEN is_from_me = 1 THEN timestamp END) AS outgoing
+		FROM messages GROUP BY chat_jid
+	) m LEFT JOIN chat_freshness f ON f.chat_jid = m.chat_jid
+	WHERE f.chat_jid IS NULL OR f.last_incoming IS NOT m.incoming OR f.last_outgoing IS NOT m.outgoing`
+
+// IntegrityIssue is the outcome of one integrity check
+type IntegrityIssue struct {
+	Check       string   `json:"check"`
+	Description string   `json:"description"`
+	Count       int      `json:"count"`
+	Samples     []string `json:"samples,omitempty"`
+	Repairable  bool     `json:"repairable"`
+	Repaired    int64    `json:"repaired,omitempty"`
+}
+
+// integrityCheck finds one kind of cruft in the store and, if it can be
+// fixed without guessing, repairs it
+type integrityCheck struct {
+	name        string
+	description string
+	find        func(store *MessageStore) ([]string, error)
+	repair      func(store *MessageStore) (int64, error)
+}
+
+// Collect the first column of a query's rows as strings
+func queryStrings(store *MessageStore, query string, args ...interface{}) ([]string, error) {
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var values []string
+	for rows.Next() {
+		var v sql.NullString
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v.String)
+	}
+	return values, rows.Err()
+}
+
+// Check whether a contact JID is a well-formed user JID
+func validContactJID(s string) bool {
+	jid, err := types.ParseJID(s)
+	if err != nil || jid.User == "" || jid.String() != s {
+		return false
+	}
+	if jid.Server != types.DefaultUserServer && jid.Server != types.HiddenUserServer {
+		return false
+	}
+	return strings.Trim(jid.User, "0123456789") == ""
+}
+
+// Find the contacts whose JID isn't a well-formed user JID
+func malformedContacts(store *MessageStore) ([]string, error) {
+	jids, err := queryStrings(store, "SELECT jid FROM contacts UNION SELECT jid FROM contact_overrides UNION SELECT jid FROM contact_attributes")
+	if err != nil {
+		return nil, err
+	}
+	var malformed []string
+	for _, jid := range jids {
+		if !validContactJID(jid) {
+			malformed = append(malformed, jid)
+		}
+	}
+	return malformed, nil
+}
+
+// Find the media messages whose file wasn't downloaded and can't be anymore
+func unrecoverableMedia(store *MessageStore) ([]string, error) {
+	rows, err := store.db.Query(
+		`SELECT id, chat_jid, COALESCE(filename, '') FROM messages
+		WHERE media_type IN ('image', 'video', 'audio', 'document')
+		AND (COALESCE(url, '') = '' OR media_key IS NULL OR length(media_key) = 0)`,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var missing []string
+	for rows.Next() {
+		var id, chatJID, filename string
+		if err := rows.Scan(&id, &chatJID, &filename); err != nil {
+			return nil, err
+		}
+		if filename != "" {
+			if _, err := os.Stat(filepath.Join(mediaDirForChat(chatJID), filename)); err == nil {
+				continue
+			}
+		}
+		missing = append(missing, chatJID+"/"+id)
+	}
+	return missing, rows.Err()
+}
+
+// Find the rows of archived media whose file is gone, as "chat_jid/filename"
+func missingArchivedMedia(store *MessageStore) ([]string, error) {
+	files, err := queryStrings(store, "SELECT chat_jid || '/' || filename FROM archived_media")
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, f := range files {
+		chatJID, filename, _ := strings.Cut(f, "/")
+		if _, err := os.Stat(filepath.Join(mediaDirForChat(chatJID), filename)); os.IsNotExist(err) {
+			missing = append(missing, f)
+		}
+	}
+	return missing, nil
+}
+
+// Find the message archives whose file is gone
+func missingArchives(store *MessageStore) ([]string, error) {
+	paths, err := queryStrings(store, "SELECT path FROM message_archives")
+	if err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			missing = append(missing, path)
+		}
+	}
+	return missing, nil
+}
+
+// Condition of message detail rows whose message is gone
+const orphanedDetailCondition = " WHERE NOT EXISTS (SELECT 1 FROM messages m WHERE m.id = %[1]s.message_id AND m.chat_jid = %[1]s.chat_jid)"
+
+// The integrity checks, in the order they are reported
+var integrityChecks = []integrityCheck{
+	{
+		name:        "messages_missing_chat",
+		description: "Chats that messages belong to but have no chat row; repair recreates the chat rows",
+		find: func(store *MessageStore) ([]string, error) {
+			return queryStrings(store, "SELECT DISTINCT chat_jid FROM messages WHERE chat_jid NOT IN (SELECT jid FROM chats)")
+		},
+		repair: func(store *MessageStore) (int64, error) {
+			result, err := store.db.Exec(`INSERT INTO chats (jid, last_message_time)
+				SELECT chat_jid, MAX(timestamp) FROM messages WHERE chat_jid NOT IN (SELECT jid FROM chats) GROUP BY chat_jid`)
+			if err != nil {
+				return 0, err
+			}
+			return result.RowsAffected()
+		},
+	},
+	{
+		name:        "orphaned_message_details",
+		description: "Tags, mentions, payments, links, embeddings, receipts, media retries, extracted entities and group events of messages that no longer exist, as table/chat_jid/message_id; repair deletes them",
+		find: func(store *MessageStore) ([]string, error) {
+			var orphaned []string
+			for _, table := range messageDetailTables {
+				rows, err := queryStrings(store, fmt.Sprintf("SELECT '%[1]s/' || chat_jid || '/' || message_id FROM %[1]s"+orphanedDetailCondition, table))
+				if err != nil {
+					return nil, err
+				}
+				orphaned = append(orphaned, rows...)
+			}
+			return orphaned, nil
+		},
+		repair: func(store *MessageStore) (int64, error) {
+			var total int64
+			for _, table := range messageDetailTables {
+				result, err := store.db.Exec(fmt.Sprintf("DELETE FROM %[1]s"+orphanedDetailCondition, table))
+				if err != nil {
+					return total, err
+				}
+				n, _ := result.RowsAffected()
+				total += n
+			}
+			return total, nil
+		},
+	},
+	{
+		name:        "malformed_contact_jids",
+		description: "Contacts, overrides and attributes whose JID isn't a phone number or LID user JID; repair deletes them",
+		find:        malformedContacts,
+		repair: func(store *MessageStore) (int64, error) {
+			malformed, err := malformedContacts(store)
+			if err != nil {
+				return 0, err
+			}
+			var total int64
+			for _, jid := range malformed {
+				for _, table := range []string{"contacts", "contact_overrides", "contact_attributes"} {
+					result, err := store.db.Exec("DELETE FROM "+table+" WHERE jid = ?", jid)
+					if err != nil {
+						return total, err
+					}
+					n, _ := result.RowsAffected()
+					total += n
+				}
+			}
+			return total, nil
+		},
+	},
+	{
+		name:        "unrecoverable_media",
+		description: "Media messages, as chat_jid/message_id, whose file was never downloaded and which lack the keys to download it",
+		find:        unrecoverableMedia,
+	},
+	{
+		name:        "missing_archived_media",
+		description: "Media of archived messages, as chat_jid/filename, whose file is gone; repair forgets them",
+		find:        missingArchivedMedia,
+		repair: func(store *MessageStore) (int64, error) {
+			missing, err := missingArchivedMedia(store)
+			if err != nil {
+				return 0, err
+			}
+			for i, f := range missing {
+				chatJID, filename, _ := strings.Cut(f, "/")
+				if _, err := store.db.Exec("DELETE FROM archived_media WHERE chat_jid = ? AND filename = ?", chatJID, filename); err != nil {
+					return int64(i), err
+				}
+			}
+			return int64(len(missing)), nil
+		},
+	},
+	{
+		name:        "missing_archives",
+		description: "Message archives whose file is gone; repair forgets them",
+		find:        missingArchives,
+		repair: func(store *MessageStore) (int64, error) {
+			missing, err := missingArchives(store)
+			if err != nil {
+				return 0, err
+			}
+			for i, path := range missing {
+				if _, err := store.db.Exec("DELETE FROM message_archives WHERE path = ?", path); err != nil {
+					return int64(i), err
+				}
+			}
+			return int64(len(missing)), nil
+		},
+	},
+	{
+		name:        "message_timestamp_anomalies",
+		description: "Messages, as chat_jid/message_id, without a timestamp, dated before 2009 or more than a day in the future",
+		find: func(store *MessageStore) ([]string, error) {
+			return queryStrings(store,
+				"SELECT chat_jid || '/' || id FROM messages WHERE timestamp IS NULL OR timestamp < ? OR timestamp > ? ORDER BY timestamp",
+				earliestMessageTime.Local(), time.Now().Add(24*time.Hour).Local())
+		},
+	},
+	{
+		name:        "stale_chat_times",
+		description: "Chats whose last message time doesn't match their latest stored message; repair updates it",
+		find: func(store *MessageStore) ([]string, error) {
+			return queryStrings(store, `SELECT c.jid FROM chats c JOIN (SELECT chat_jid, MAX(timestamp) AS latest FROM messages GROUP BY chat_jid) m
+				ON m.chat_jid = c.jid WHERE c.last_message_time IS NULL OR c.last_message_time < m.latest`)
+		},
+		repair: func(store *MessageStore) (int64, error) {
+			result, err := store.db.Exec(`UPDATE chats SET last_message_time = (SELECT MAX(timestamp) FROM messages WHERE chat_jid = chats.jid)
+				WHERE last_message_time IS NULL OR last_message_time < (SELECT MAX(timestamp) FROM messages WHERE chat_jid = chats.jid)`)
+			if err != nil {
+				return 0, err
+			}
+			return result.RowsAffected()
+		},
+	},
+	{
+		name:        "stale_chat_freshness",
+		description: "Chats whose freshness row is missing or out of date with their stored messages; repair recounts it",
+		find: func(store *MessageStore) ([]string, error) {
+			return queryStrings(store, staleChatFreshnessSQL)
+		},
+		repair: func(store *MessageStore) (int64, error) {
+			stale, err := queryStrings(store, staleChatFreshnessSQL)
+			if err != nil {
+				return 0, err
+			}
+			_, err = store.db.Exec("INSERT OR IGNORE INTO chat_freshness (chat_jid, last_read) SELECT chat_jid, MAX(timestamp) FROM messages GROUP BY chat_jid")
+			if err != nil {
+				return 0, err
+			}
+			return int64(len(stale)), refreshChatFreshness(store.db, stale...)
+		},
+	},
+}
+
+// Run every integrity check, repairing the issues of the checks named in
+// repair, or of every repairable check if it holds "all"
+func runIntegrityChecks(store *MessageStore, repair []string) ([]IntegrityIssue, error) {
+	issues := []IntegrityIssue{}
+	for _, check := range integrityChecks {
+		found, err := check.find(store)
+		if err != nil {
+			return nil, fmt.Errorf("check %s failed: %v", check.name, err)
+		}
+		issue := IntegrityIssue{
+			Check:       check.name,
+			Description: check.description,
+			Count:       len(found),
+			Samples:     found[:min(len(found), integritySamples)],
+			Repairable:  check.repair != nil,
+		}
+		if len(found) > 0 && check.repair != nil && (slices.Contains(repair, "all") || slices.Contains(repair, check.name)) {
+			if issue.Repaired, err = check.repair(store); err != nil {
+				return nil, fmt.Errorf("repair %s failed: %v", check.name, err)
+			}
+			bridgeLog.Infof("Integrity repair %s fixed %d rows", check.name, issue.Repaired)
+		}
+		issues = append(issues, issue)
+	}
+	return issues, nil
+}
+
+// IntegrityRequest represents the request body for the integrity repair API
+type IntegrityRequest struct {
+	Repair []string `json:"repair"` // Names of the checks whose issues to repair, or "all"
+}
+
+// IntegrityResponse represents the response for the integrity APIs
+type IntegrityResponse struct {
+	Success bool             `json:"success"`
+	Message string           `json:"message"`
+	Issues  []IntegrityIssue `json:"issues"`
+}
+
+// Summarize an integrity report
+func integritySummary(issues []IntegrityIssue) string {
+	var found, repaired int64
+	for _, issue := range issues {
+		found += int64(issue.Count)
+		repaired += issue.Repaired
+	}
+	if repaired > 0 {
+		return fmt.Sprintf("%d issues found, %d rows repaired", found, repaired)
+	}
+	return fmt.Sprintf("%d issues found", found)
+}
+
+// Register the admin REST handlers checking and repairing the store's integrity
+func registerIntegrityHandlers(messageStore *MessageStore) {
+	// Handler for the integrity report
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/admin/integrity",
+		Summary:  "Scan the message store for orphaned rows, malformed contact JIDs, missing media and archive files and timestamp anomalies",
+		Tag:      "admin",
+		Scope:    ScopeAdmin,
+		Response: IntegrityResponse{},
+	})
+	http.HandleFunc("GET /api/admin/integrity", func(w http.ResponseWriter, r *http.Request) {
+		issues, err := runIntegrityChecks(messageStore, nil)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Integrity check failed: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, IntegrityResponse{Success: true, Message: integritySummary(issues), Issues: issues})
+	})
+
+	// Handler for repairing integrity issues
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/admin/integrity",
+		Summary:  "Scan the message store and repair the issues of the given checks, or of all repairable checks with \"all\"",
+		Tag:      "admin",
+		Scope:    ScopeAdmin,
+		Audit:    true,
+		Request:  IntegrityRequest{},
+		Response: IntegrityResponse{},
+	})
+	http.HandleFunc("POST /api/admin/integrity", func(w http.ResponseWriter, r *http.Request) {
+		var req IntegrityRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if len(req.Repair) == 0 {
+			writeError(w, ErrCodeInvalidRequest, "repair must name at least one check, or \"all\"", nil)
+			return
+		}
+		for _, name := range req.Repair {
+			known := name == "all" || slices.ContainsFunc(integrityChecks, func(c integrityCheck) bool { return c.name == name && c.repair != nil })
+			if !known {
+				writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("%s isn't a repairable check", name), nil)
+				return
+			}
+		}
+		issues, err := runIntegrityChecks(messageStore, req.Repair)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Integrity repair failed: %v", err), nil)
+			return
+		}
+		message := integritySummary(issues)
+		bridgeLog.Infof("Integrity repair complete: %s", message)
+		writeJSON(w, http.StatusOK, IntegrityResponse{Success: true, Message: message, Issues: issues})
+	})
+}
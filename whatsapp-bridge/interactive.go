@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Limits of interactive messages enforced by WhatsApp
+const (
+	maxButtons  = 3
+	maxListRows = 10
+)
+
+// InteractiveButton is a quick-reply button
+type InteractiveButton struct {
+	ID    string `json:"id"`    // Returned as selected_option when tapped
+	Title string `json:"title"` // Shown on the button
+}
+
+// SendButtonsRequest represents the request body for sending a message with quick-reply buttons
+type SendButtonsRequest struct {
+	Recipient string              `json:"recipient"`
+	Text      string              `json:"text"`
+	Header    string              `json:"header,omitempty"`
+	Footer    string              `json:"footer,omitempty"`
+	Buttons   []InteractiveButton `json:"buttons"` // Up to 3
+}
+
+// ListRow is an option of a list message
+type ListRow struct {
+	ID          string `json:"id"` // Returned as selected_option when chosen
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+}
+
+// ListSection groups the options of a list message
+type ListSection struct {
+	Title string    `json:"title,omitempty"`
+	Rows  []ListRow `json:"rows"`
+}
+
+// SendListRequest represents the request body for sending a list message
+type SendListRequest struct {
+	Recipient  string        `json:"recipient"`
+	Title      string        `json:"title,omitempty"`
+	Text       string        `json:"text"`
+	Footer     string        `json:"footer,omitempty"`
+	ButtonText string        `json:"button_text"` // Label of the button opening the list
+	Sections   []ListSection `json:"sections"`    // Up to 10 rows in all
+}
+
+// SendInteractiveResponse represents the response for the interactive message APIs
+type SendInteractiveResponse struct {
+	Success   bool   `json:"success"`
+	Message   string `json:"message"`
+	MessageID string `json:"message_id"`
+}
+
+// Get the option a reply to buttons or a list selected and its text, which
+// falls back to the option ID. Both are empty for other messages.
+func interactiveSelection(m *waProto.Message) (id, text string) {
+	switch {
+	case m.GetButtonsResponseMessage() != nil:
+		reply := m.GetButtonsResponseMessage()
+		id, text = reply.GetSelectedButtonID(), reply.GetSelectedDisplayText()
+	case m.GetListResponseMessage() != nil:
+		reply := m.GetListResponseMessage()
+		id, text = reply.GetSingleSelectReply().GetSelectedRowID(), reply.GetTitle()
+	case m.GetTemplateButtonReplyMessage() != nil:
+		reply := m.GetTemplateButtonReplyMessage()
+		id, text = reply.GetSelectedID(), reply.GetSelectedDisplayText()
+	}
+	if text == "" {
+		text = id
+	}
+	return id, text
+}
+
+// Record the option a stored reply to buttons or a list selected
+func (store *MessageStore) SetSelectedOption(id, chatJID, option string) error {
+	_, err := store.db.Exec("UPDATE messages SET selected_option = ? WHERE id = ? AND chat_jid = ?", option, id, chatJID)
+	return err
+}
+
+// Record the selected option of a message, if it is a reply to buttons or a list
+func handleInteractiveResponse(messageStore *MessageStore, id, chatJID string, m *waProto.Message) {
+	option, _ := interactiveSelection(m)
+	if option == "" {
+		return
+	}
+	if err := messageStore.SetSelectedOption(id, chatJID, option); err != nil {
+		bridgeLog.Warnf("Failed to store selected option of message %s: %v", id, err)
+	}
+}
+
+// Check that option IDs are given and unique, as replies are matched by them
+func validateOptionIDs(ids []string) error {
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if id == "" {
+			return newAPIError(ErrCodeInvalidRequest, "Every option needs an id")
+		}
+		if seen[id] {
+			return newAPIError(ErrCodeInvalidRequest, "Option id %q is used twice", id)
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// Build a message with quick-reply buttons
+func (req SendButtonsRequest) toMessage() (*waProto.Message, error) {
+	if req.Text == "" {
+		return nil, newAPIError(ErrCodeInvalidRequest, "Text is required")
+	}
+	if len(req.Buttons) == 0 || len(req.Buttons) > maxButtons {
+		return nil, newAPIError(ErrCodeInvalidRequest, "Between 1 and %d buttons are required", maxButtons)
+	}
+	var ids []string
+	buttons := make([]*waProto.ButtonsMessage_Button, len(req.Buttons))
+	for i, b := range req.Buttons {
+		if b.Title == "" {
+			return nil, newAPIError(ErrCodeInvalidRequest, "Every button needs a title")
+		}
+		ids = append(ids, b.ID)
+		buttons[i] = &waProto.ButtonsMessage_Button{
+			ButtonID:   proto.String(b.ID),
+			ButtonText: &waProto.ButtonsMessage_Button_ButtonText{DisplayText: proto.String(b.Title)},
+			Type:       waProto.ButtonsMessage_Button_RESPONSE.Enum(),
+		}
+	}
+	if err := validateOptionIDs(ids); err != nil {
+		return nil, err
+	}
+
+	msg := &waProto.ButtonsMessage{
+		ContentText: proto.String(req.Text),
+		FooterText:  proto.String(req.Footer),
+		Buttons:     buttons,
+		HeaderType:  waProto.ButtonsMessage_EMPTY.Enum(),
+	}
+	if req.Header != "" {
+		msg.HeaderType = waProto.ButtonsMessage_TEXT.Enum()
+		msg.Header = &waProto.ButtonsMessage_Text{Text: req.Header}
+	}
+	return &waProto.Message{ButtonsMessage: msg}, nil
+}
+
+// Build a list message
+func (req SendListRequest) toMessage() (*waProto.Message, error) {
+	if req.Text == "" || req.ButtonText == "" {
+		return nil, newAPIError(ErrCodeInvalidRequest, "Text and button_text are required")
+	}
+	var ids []string
+	sections := make([]*waProto.ListMessage_Section, len(req.Sections))
+	for i, s := range req.Sections {
+		if len(s.Rows) == 0 {
+			return nil, newAPIError(ErrCodeInvalidRequest, "Every section needs at least one row")
+		}
+		rows := make([]*waProto.ListMessage_Row, len(s.Rows))
+		for j, row := range s.Rows {
+			if row.Title == "" {
+				return nil, newAPIError(ErrCodeInvalidRequest, "Every row needs a title")
+			}
+			ids = append(ids, row.ID)
+			rows[j] = &waProto.ListMessage_Row{
+				RowID:       proto.String(row.ID),
+				Title:       proto.String(row.Title),
+				Description: proto.String(row.Description),
+			}
+		}
+		sections[i] = &waProto.ListMessage_Section{Title: proto.String(s.Title), Rows: rows}
+	}
+	if len(ids) == 0 || len(ids) > maxListRows {
+		return nil, newAPIError(ErrCodeInvalidRequest, "Between 1 and %d rows are required", maxListRows)
+	}
+	if err := validateOptionIDs(ids); err != nil {
+		return nil, err
+	}
+
+	return &waProto.Message{ListMessage: &waProto.ListMessage{
+		Title:       proto.String(req.Title),
+		Description: proto.String(req.Text),
+		FooterText:  proto.String(req.Footer),
+		ButtonText:  proto.String(req.ButtonText),
+		ListType:    waProto.ListMessage_SINGLE_SELECT.Enum(),
+		Sections:    sections,
+	}}, nil
+}
+
+// Send an interactive message, returning its ID
+func sendInteractiveMessage(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, recipient string, msg *waProto.Message) (string, error) {
+	if !client.IsConnected() {
+		return "", newAPIError(ErrCodeNotConnected, "Not connected to WhatsApp")
+	}
+	jid, _, err := resolveRecipient(messageStore, recipient)
+	if err != nil {
+		return "", err
+	}
+
+	id := client.GenerateMessageID()
+	payload := map[string]interface{}{"recipient": jid.String(), "message_id": id}
+	err = journal(messageStore, OpKindInteractive, jid.String(), payload, func() error {
+		return throttle(opSend, func() error {
+			ctx, cancel := callContext(ctx, callSend)
+			defer cancel()
+			_, err := client.SendMessage(ctx, jid, msg, whatsmeow.SendRequestExtra{ID: id})
+			return err
+		})
+	})
+	if err != nil {
+		return "", newCallError(ErrCodeSendFailed, err, "Error sending message: %v", err)
+	}
+	return id, nil
+}
+
+// Register the REST handlers for sending buttons and list messages
+func registerInteractiveHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	// Handler for sending quick-reply buttons
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/send/buttons",
+		Summary:  "Send a message with up to 3 quick-reply buttons; replies are stored with the button id as selected_option. Not every WhatsApp client shows buttons.",
+		Tag:      "messages",
+		Scope:    ScopeSendMessages,
+		Audit:    true,
+		Request:  SendButtonsRequest{},
+		Response: SendInteractiveResponse{},
+	})
+	http.HandleFunc("POST /api/send/buttons", func(w http.ResponseWriter, r *http.Request) {
+		var req SendButtonsRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if req.Recipient == "" {
+			writeError(w, ErrCodeInvalidRequest, "Recipient is required", nil)
+			return
+		}
+		msg, err := req.toMessage()
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		id, err := sendInteractiveMessage(r.Context(), client, messageStore, req.Recipient, msg)
+		if err != nil {
+			writeAPIError(w, "Failed to send buttons", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, SendInteractiveResponse{Success: true, Message: fmt.Sprintf("Buttons sent to %s", req.Recipient), MessageID: id})
+	})
+
+	// Handler for sending list messages
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/send/list",
+		Summary:  "Send a list message with up to 10 options; replies are stored with the row id as selected_option. Not every WhatsApp client shows lists.",
+		Tag:      "messages",
+		Scope:    ScopeSendMessages,
+		Audit:    true,
+		Request:  SendListRequest{},
+		Response: SendInteractiveResponse{},
+	})
+	http.HandleFunc("POST /api/send/list", func(w http.ResponseWriter, r *http.Request) {
+		var req SendListRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if req.Recipient == "" {
+			writeError(w, ErrCodeInvalidRequest, "Recipient is required", nil)
+			return
+		}
+		msg, err := req.toMessage()
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		id, err := sendInteractiveMessage(r.Context(), client, messageStore, req.Recipient, msg)
+		if err != nil {
+			writeAPIError(w, "Failed to send list", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, SendInteractiveResponse{Success: true, Message: fmt.Sprintf("List sent to %s", req.Recipient), MessageID: id})
+	})
+}
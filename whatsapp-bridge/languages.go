@@ -0,0 +1,243 @@
+package main
+
+import (
+	"database/sql"
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Common short words of the languages written in Latin script, enough to
+// tell them apart in chat messages
+var languageStopwords = map[string][]string{
+	"en": {"the", "and", "is", "are", "you", "to", "of", "it", "that", "this", "for", "with", "have", "was", "not", "what", "my", "your", "we", "they", "will", "can", "just", "be", "thanks", "hi"},
+	"it": {"il", "lo", "la", "che", "di", "non", "è", "per", "una", "sono", "ho", "ma", "con", "mi", "ti", "ci", "anche", "questo", "come", "perché", "cosa", "sei", "della", "gli", "molto", "grazie", "ciao"},
+	"es": {"el", "los", "las", "que", "de", "no", "es", "por", "una", "con", "para", "pero", "como", "está", "muy", "gracias", "hola", "qué", "yo", "también", "esto", "eso", "del", "se"},
+	"fr": {"le", "les", "des", "est", "pas", "une", "que", "pour", "avec", "je", "tu", "vous", "nous", "mais", "dans", "ce", "qui", "sur", "très", "merci", "bonjour", "oui", "du", "et"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ich", "du", "wir", "sie", "mit", "auf", "für", "ein", "eine", "aber", "auch", "noch", "schon", "danke", "ja", "nein", "den", "dem", "zu"},
+	"pt": {"não", "você", "que", "de", "uma", "com", "para", "mas", "como", "está", "muito", "obrigado", "obrigada", "olá", "eu", "também", "isso", "do", "da", "em", "os", "as", "é", "tudo"},
+	"nl": {"de", "het", "een", "en", "is", "niet", "ik", "je", "jij", "wij", "met", "op", "voor", "maar", "ook", "nog", "dank", "ja", "nee", "van", "dat", "dit", "zijn"},
+}
+
+// Letters only used by one of the Latin script languages
+var languageLetters = map[rune]string{'ñ': "es", 'ã': "pt", 'õ': "pt", 'ß': "de", 'ĳ': "nl"}
+
+// Stopword sets by language, built from languageStopwords
+var stopwordSets = func() map[string]map[string]bool {
+	sets := map[string]map[string]bool{}
+	for lang, words := range languageStopwords {
+		sets[lang] = map[string]bool{}
+		for _, word := range words {
+			sets[lang][word] = true
+		}
+	}
+	return sets
+}()
+
+// Detect the language of a text as an ISO 639-1 code, empty if the text is
+// too short or ambiguous to tell. Other scripts than Latin are told apart by
+// their letters, Latin script languages by their common words.
+func detectLanguage(text string) string {
+	scripts := map[string]int{}
+	letters := 0
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		switch {
+		case unicode.Is(unicode.Latin, r):
+			scripts["latin"]++
+		case unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r):
+			scripts["ja"]++
+		case unicode.Is(unicode.Han, r):
+			scripts["han"]++
+		case unicode.Is(unicode.Hangul, r):
+			scripts["ko"]++
+		case unicode.Is(unicode.Cyrillic, r):
+			scripts["cyrillic"]++
+		case unicode.Is(unicode.Arabic, r):
+			scripts["arabic"]++
+		case unicode.Is(unicode.Greek, r):
+			scripts["el"]++
+		case unicode.Is(unicode.Hebrew, r):
+			scripts["he"]++
+		case unicode.Is(unicode.Devanagari, r):
+			scripts["hi"]++
+		case unicode.Is(unicode.Thai, r):
+			scripts["th"]++
+		case unicode.Is(unicode.Georgian, r):
+			scripts["ka"]++
+		case unicode.Is(unicode.Armenian, r):
+			scripts["hy"]++
+		}
+	}
+	if letters < 2 {
+		return ""
+	}
+
+	script, most := "", 0
+	for s, n := range scripts {
+		if n > most || n == most && s < script {
+			script, most = s, n
+		}
+	}
+	// Kanji are written between kana in Japanese
+	if script == "han" && scripts["ja"] > 0 {
+		script = "ja"
+	}
+	switch script {
+	case "latin":
+		return detectLatinLanguage(text)
+	case "han":
+		return "zh"
+	case "cyrillic":
+		if strings.ContainsAny(strings.ToLower(text), "іїєґ") {
+			return "uk"
+		}
+		return "ru"
+	case "arabic":
+		if strings.ContainsAny(text, "پچژگ") {
+			return "fa"
+		}
+		return "ar"
+	}
+	return script
+}
+
+// Detect the language of a Latin script text by its common words, empty
+// unless one language clearly wins
+func detectLatinLanguage(text string) string {
+	scores := map[string]int{}
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	for _, word := range words {
+		for lang, set := range stopwordSets {
+			if set[word] {
+				scores[lang]++
+			}
+		}
+		for _, r := range word {
+			if lang, ok := languageLetters[r]; ok {
+				scores[lang]++
+			}
+		}
+	}
+
+	best, bestScore, runnerUp := "", 0, 0
+	for lang, score := range scores {
+		switch {
+		case score > bestScore:
+			runnerUp = bestScore
+			best, bestScore = lang, score
+		case score > runnerUp:
+			runnerUp = score
+		}
+	}
+	if bestScore < 2 || bestScore == runnerUp {
+		return ""
+	}
+	return best
+}
+
+// Store the detected language of a message's content in a transaction,
+// empty when it couldn't be told
+func recordLanguage(tx *sql.Tx, id, chatJID, content string) error {
+	_, err := tx.Exec("UPDATE messages SET language = ? WHERE id = ? AND chat_jid = ?", detectLanguage(content), id, chatJID)
+	return err
+}
+
+// Detect the language of stored messages that were never checked
+func (store *MessageStore) BackfillLanguages() error {
+	total := 0
+	for {
+		rows, err := store.db.Query("SELECT id, chat_jid, content FROM messages WHERE language IS NULL AND COALESCE(content, '') != '' LIMIT 1000")
+		if err != nil {
+			return err
+		}
+		type pending struct{ id, chatJID, content string }
+		var batch []pending
+		for rows.Next() {
+			var p pending
+			if err := rows.Scan(&p.id, &p.chatJID, &p.content); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, p)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		tx, err := store.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, p := range batch {
+			if err := recordLanguage(tx, p.id, p.chatJID, p.content); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		total += len(batch)
+	}
+	if total > 0 {
+		bridgeLog.Infof("Detected the language of %d stored messages", total)
+	}
+	return nil
+}
+
+// LanguageShare is how many messages of a chat are in a language
+type LanguageShare struct {
+	Language string  `json:"language"` // ISO 639-1 code
+	Messages int     `json:"messages"`
+	Share    float64 `json:"share"` // Fraction of the chat's messages in a detected language
+}
+
+// Get the distribution of the detected languages of the messages of chats,
+// most used first, by chat JID
+func (store *MessageStore) ChatLanguages(chatJIDs []string) (map[string][]LanguageShare, error) {
+	languages := map[string][]LanguageShare{}
+	if len(chatJIDs) == 0 {
+		return languages, nil
+	}
+	args := make([]interface{}, len(chatJIDs))
+	for i, jid := range chatJIDs {
+		args[i] = jid
+	}
+	rows, err := store.db.Query(
+		`SELECT chat_jid, language, COUNT(*) FROM messages
+		WHERE chat_jid IN (?`+strings.Repeat(", ?", len(chatJIDs)-1)+`) AND COALESCE(language, '') != ''
+		GROUP BY chat_jid, language ORDER BY chat_jid, COUNT(*) DESC, language`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := map[string]int{}
+	for rows.Next() {
+		var chatJID string
+		var l LanguageShare
+		if err := rows.Scan(&chatJID, &l.Language, &l.Messages); err != nil {
+			return nil, err
+		}
+		languages[chatJID] = append(languages[chatJID], l)
+		totals[chatJID] += l.Messages
+	}
+	for chatJID, shares := range languages {
+		for i := range shares {
+			shares[i].Share = math.Round(float64(shares[i].Messages)/float64(totals[chatJID])*1000) / 1000
+		}
+	}
+	return languages, rows.Err()
+}
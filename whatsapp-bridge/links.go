@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// URLs in message text, trailing punctuation is trimmed separately
+var linkRe = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"]+`)
+
+// Page title in the start of an HTML document
+var htmlTitleRe = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+
+// Bytes of a page read when looking for its title
+const maxTitleFetchBytes = 256 << 10
+
+// Link is a URL seen in a message
+type Link struct {
+	ID        int64      `json:"id"`
+	URL       string     `json:"url"`
+	Domain    string     `json:"domain"`
+	Title     string     `json:"title,omitempty"`
+	MessageID string     `json:"message_id"`
+	ChatJID   string     `json:"chat_jid"`
+	ChatName  string     `json:"chat_name,omitempty"`
+	Sender    string     `json:"sender"`
+	Time      time.Time  `json:"timestamp"`
+	FetchedAt *time.Time `json:"fetched_at,omitempty"`
+}
+
+// Find the URLs in a text
+func extractLinks(text string) []string {
+	var links []string
+	seen := make(map[string]bool)
+	for _, link := range linkRe.FindAllString(text, -1) {
+		link = strings.TrimRight(link, ".,;:!?'")
+		// Keep a closing parenthesis only if the URL opened one
+		for strings.HasSuffix(link, ")") && strings.Count(link, "(") < strings.Count(link, ")") {
+			link = strings.TrimSuffix(link, ")")
+		}
+		if !seen[link] {
+			seen[link] = true
+			links = append(links, link)
+		}
+	}
+	return links
+}
+
+// Store the links of a message. The link preview title WhatsApp attached to the
+// message, if any, is used for the previewed URL. Returns the IDs of new links
+// without a title.
+func (store *MessageStore) IndexLinks(msg Message, previewURL, previewTitle string) ([]int64, error) {
+	var untitled []int64
+	links := extractLinks(msg.Content)
+	for _, link := range links {
+		parsed, err := url.Parse(link)
+		if err != nil || parsed.Host == "" {
+			continue
+		}
+		title := ""
+		if previewTitle != "" && (link == previewURL || len(links) == 1) {
+			title = previewTitle
+		}
+
+		result, err := store.db.Exec(
+			`INSERT OR IGNORE INTO links (url, domain, title, message_id, chat_jid, sender, timestamp)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			link, strings.TrimPrefix(strings.ToLower(parsed.Hostname()), "www."), title, msg.ID, msg.ChatJID, msg.Sender, msg.Time,
+		)
+		if err != nil {
+			return untitled, err
+		}
+		if n, _ := result.RowsAffected(); n > 0 && title == "" {
+			id, _ := result.LastInsertId()
+			untitled = append(untitled, id)
+		}
+	}
+	return untitled, nil
+}
+
+// Index the links of all stored messages, once
+func (store *MessageStore) BackfillLinks() error {
+	var done bool
+	if _, err := store.GetSetting("links_indexed", &done); err != nil || done {
+		return err
+	}
+
+	rows, err := store.db.Query(
+		"SELECT " + messageColumns + " FROM messages WHERE content LIKE '%http://%' OR content LIKE '%https://%'",
+	)
+	if err != nil {
+		return err
+	}
+	messages, err := scanMessages(rows)
+	if err != nil {
+		return err
+	}
+	for _, msg := range messages {
+		if _, err := store.IndexLinks(msg, "", ""); err != nil {
+			return err
+		}
+	}
+	bridgeLog.Infof("Indexed the links of %d stored messages", len(messages))
+	return store.StoreSetting("links_indexed", true)
+}
+
+// LinkFilter describes which links ListLinks returns
+type LinkFilter struct {
+	ChatJID string
+	Sender  string
+	Domain  string
+	Query   string // Substring of the URL or title
+	After   *time.Time
+	Before  *time.Time
+	Limit   int
+	Offset  int
+}
+
+// List links matching a filter, newest first
+func (store *MessageStore) ListLinks(f LinkFilter) ([]Link, error) {
+	var conditions []string
+	var args []interface{}
+	if f.ChatJID != "" {
+		conditions = append(conditions, "l.chat_jid = ?")
+		args = append(args, f.ChatJID)
+	}
+	if f.Sender != "" {
+		conditions = append(conditions, "l.sender = ?")
+		args = append(args, f.Sender)
+	}
+	if f.Domain != "" {
+		conditions = append(conditions, "(l.domain = ? OR l.domain LIKE ?)")
+		domain := strings.TrimPrefix(strings.ToLower(f.Domain), "www.")
+		args = append(args, domain, "%."+domain)
+	}
+	if f.Query != "" {
+		conditions = append(conditions, "(LOWER(l.url) LIKE LOWER(?) OR LOWER(l.title) LIKE LOWER(?))")
+		args = append(args, "%"+f.Query+"%", "%"+f.Query+"%")
+	}
+	if f.After != nil {
+		conditions = append(conditions, "l.timestamp > ?")
+		args = append(args, f.After.Local())
+	}
+	if f.Before != nil {
+		conditions = append(conditions, "l.timestamp < ?")
+		args = append(args, f.Before.Local())
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, f.Limit, f.Offset)
+
+	rows, err := store.db.Query(
+		`SELECT l.id, l.url, l.domain, COALESCE(l.title, ''), l.message_id, l.chat_jid, COALESCE(c.name, ''),
+			l.sender, l.timestamp, l.fetched_at
+		FROM links l LEFT JOIN chats c ON c.jid = l.chat_jid`+where+`
+		ORDER BY l.timestamp DESC LIMIT ? OFFSET ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	links := []Link{}
+	for rows.Next() {
+		var l Link
+		if err := rows.Scan(&l.ID, &l.URL, &l.Domain, &l.Title, &l.MessageID, &l.ChatJID, &l.ChatName,
+			&l.Sender, &l.Time, &l.FetchedAt); err != nil {
+			return nil, err
+		}
+		links = append(links, l)
+	}
+	return links, rows.Err()
+}
+
+// Refuse connections to loopback, private and link-local addresses, so links in
+// messages can't make the bridge probe the local network
+func publicAddressOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("refusing to connect to non-public address %s", host)
+	}
+	return nil
+}
+
+// HTTP client for fetching page titles
+var titleClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: 5 * time.Second, Control: publicAddressOnly}).DialContext,
+	},
+}
+
+// Fetch the title of a web page
+func fetchPageTitle(link string) (string, error) {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, link, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "text/html")
+	resp, err := titleClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "" && !strings.Contains(ct, "html") {
+		return "", nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxTitleFetchBytes))
+	if err != nil {
+		return "", err
+	}
+	m := htmlTitleRe.FindSubmatch(body)
+	if m == nil {
+		return "", nil
+	}
+	return truncateText(html.UnescapeString(string(m[1])), 300), nil
+}
+
+// Fetch and store the titles of links in the background
+func fetchLinkTitles(messageStore *MessageStore, ids []int64) {
+	goSafe("fetching link titles", func() {
+		for _, id := range ids {
+			func() {
+				defer recoverPanic("fetching title of link %d", id)
+				var link string
+				if err := messageStore.db.QueryRow("SELECT url FROM links WHERE id = ?", id).Scan(&link); err != nil {
+					return
+				}
+				title, err := fetchPageTitle(link)
+				if err != nil {
+					bridgeLog.Warnf("Failed to fetch title of %s: %v", link, err)
+				}
+				if _, err := messageStore.db.Exec("UPDATE links SET title = ?, fetched_at = ? WHERE id = ?", title, time.Now(), id); err != nil {
+					bridgeLog.Warnf("Failed to store title of %s: %v", link, err)
+				}
+			}()
+		}
+	})
+}
+
+// Index the links of a new message. Page titles are fetched only if enabled,
+// as it reveals to the linked sites that the link was received.
+func handleLinks(messageStore *MessageStore, msg Message, previewURL, previewTitle string, live bool) {
+	untitled, err := messageStore.IndexLinks(msg, previewURL, previewTitle)
+	if err != nil {
+		bridgeLog.Warnf("Failed to index links: %v", err)
+	}
+	if live && len(untitled) > 0 && envBool("WHATSAPP_FETCH_LINK_TITLES", false) {
+		fetchLinkTitles(messageStore, untitled)
+	}
+}
+
+// Document is a file received or sent in a message
+type Document struct {
+	Message
+	ChatName   string `json:"chat_name,omitempty"`
+	FileLength uint64 `json:"file_length"`
+	DocumentInfo
+}
+
+// List messages with files matching a filter, newest first. Without a media
+// type filter, only documents are listed.
+func (store *MessageStore) ListDocuments(f MessageFilter) ([]Document, error) {
+	if f.MediaType == "" {
+		f.MediaType = "document"
+	} else if f.MediaType == "any" {
+		f.MediaType = ""
+		f.HasMedia = true
+	}
+	if err := store.resolveSender(&f); err != nil {
+		return nil, err
+	}
+	where, args := f.where()
+	args = append(args, f.Limit, f.Offset)
+
+	rows, err := store.db.Query(
+		`SELECT messages.id, messages.chat_jid, messages.sender, COALESCE(messages.content, ''), messages.timestamp,
+			messages.is_from_me, COALESCE(messages.media_type, ''), COALESCE(messages.filename, ''),
+			COALESCE(c.name, ''), COALESCE(messages.file_length, 0), COALESCE(messages.document_pages, 0),
+			COALESCE(messages.document_title, '')
+		FROM messages LEFT JOIN chats c ON c.jid = messages.chat_jid`+where+`
+		ORDER BY messages.timestamp DESC LIMIT ? OFFSET ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	documents := []Document{}
+	for rows.Next() {
+		var d Document
+		if err := rows.Scan(&d.ID, &d.ChatJID, &d.Sender, &d.Content, &d.Time, &d.IsFromMe, &d.MediaType, &d.Filename,
+			&d.ChatName, &d.FileLength, &d.PageCount, &d.Title); err != nil {
+			return nil, err
+		}
+		documents = append(documents, d)
+	}
+	return documents, rows.Err()
+}
+
+// ListLinksResponse represents the response for the links API
+type ListLinksResponse struct {
+	Success bool   `json:"success"`
+	Links   []Link `json:"links"`
+	Page
+}
+
+// ListDocumentsResponse represents the response for the documents API
+type ListDocumentsResponse struct {
+	Success   bool       `json:"success"`
+	Documents []Document `json:"documents"`
+	Page
+}
+
+// Register the REST handlers listing the links and files seen in messages
+func registerLinkHandlers(messageStore *MessageStore) {
+	goSafe("indexing links of stored messages", func() {
+		if err := messageStore.BackfillLinks(); err != nil {
+			bridgeLog.Warnf("Failed to index links of stored messages: %v", err)
+		}
+	})
+
+	// Handler for listing links
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/links",
+		Summary: "List the URLs seen in messages, newest first",
+		Tag:     "links",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "chat_jid", Description: "Only links from this chat"},
+			{Name: "sender", Description: "Only links from this sender"},
+			{Name: "domain", Description: "Only links to this domain or its subdomains"},
+			{Name: "query", Description: "Text to search for in the URL or page title"},
+			{Name: "after_time", Description: "Only links sent after this time" + timeFormatsHint},
+			{Name: "before_time", Description: "Only links sent before this time" + timeFormatsHint},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ListLinksResponse{},
+	})
+	http.HandleFunc("GET /api/links", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		f := LinkFilter{ChatJID: q.Get("chat_jid"), Sender: q.Get("sender"), Domain: q.Get("domain"), Query: q.Get("query")}
+		var err error
+		if f.Limit, f.Offset, err = parsePagination(r); err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if f.After, err = parseTimeParam(r, "after_time"); err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if f.Before, err = parseTimeParam(r, "before_time"); err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		limit := f.Limit
+		f.Limit++
+		links, err := messageStore.ListLinks(f)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list links: %v", err), nil)
+			return
+		}
+		links, page := trimPage(links, f.Offset, limit)
+		writeJSON(w, http.StatusOK, ListLinksResponse{Success: true, Links: links, Page: page})
+	})
+
+	// Handler for listing files
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/documents",
+		Summary:  "List files sent in messages, newest first, e.g. to find a PDF someone sent last month",
+		Tag:      "links",
+		Scope:    ScopeReadMessages,
+		Params:   documentFilterParams,
+		Response: ListDocumentsResponse{},
+	})
+	http.HandleFunc("GET /api/documents", func(w http.ResponseWriter, r *http.Request) {
+		f, err := parseMessageFilter(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		limit := f.Limit
+		f.Limit++
+		documents, err := messageStore.ListDocuments(f)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list documents: %v", err), nil)
+			return
+		}
+		documents, page := trimPage(documents, f.Offset, limit)
+		writeJSON(w, http.StatusOK, ListDocumentsResponse{Success: true, Documents: documents, Page: page})
+	})
+}
+
+// Query parameters accepted by the documents API
+var documentFilterParams = []apiParam{
+	{Name: "chat_jid", Description: "Only files from this chat"},
+	{Name: "sender", Description: "Only files from this sender"},
+	{Name: "filename", Description: "Case-insensitive text to search for in the file name, e.g. .pdf"},
+	{Name: "query", Description: "Case-insensitive text to search for in the caption"},
+	{Name: "media_type", Description: "Media type of the files (document, image, video, audio or any), document by default"},
+	{Name: "after_time", Description: "Only files sent after this time" + timeFormatsHint},
+	{Name: "before_time", Description: "Only files sent before this time" + timeFormatsHint},
+	{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+	{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// Limits of a live location share
+const (
+	defaultLiveLocationMinutes = 60
+	maxLiveLocationMinutes     = 8 * 60 // The longest WhatsApp clients offer
+)
+
+// LiveLocation is a live location shared to a chat. WhatsApp has no message
+// for changing or ending a share, so positions are sent as edits of the
+// first message, and the share ends when the bridge stops sending them.
+type LiveLocation struct {
+	ID        int64      `json:"id"`
+	ChatJID   string     `json:"chat_jid"`
+	MessageID string     `json:"message_id"`
+	Caption   string     `json:"caption,omitempty"`
+	Latitude  float64    `json:"latitude"`
+	Longitude float64    `json:"longitude"`
+	Accuracy  uint32     `json:"accuracy_meters,omitempty"`
+	Sequence  int64      `json:"sequence"` // Number of position updates sent
+	StartedAt time.Time  `json:"started_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	StoppedAt *time.Time `json:"stopped_at,omitempty"`
+	Active    bool       `json:"active"`
+}
+
+// LivePosition is a position of a live location
+type LivePosition struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Accuracy  uint32  `json:"accuracy_meters,omitempty"`
+	Speed     float32 `json:"speed_mps,omitempty"`
+	Heading   uint32  `json:"heading_degrees,omitempty"` // Clockwise from magnetic north
+}
+
+// Check that a position is on the globe
+func (p LivePosition) validate() error {
+	if p.Latitude < -90 || p.Latitude > 90 || p.Longitude < -180 || p.Longitude > 180 {
+		return newAPIError(ErrCodeInvalidRequest, "latitude must be within ±90 and longitude within ±180")
+	}
+	if p.Heading >= 360 {
+		return newAPIError(ErrCodeInvalidRequest, "heading_degrees must be below 360")
+	}
+	return nil
+}
+
+// Build the live location message of a position
+func (p LivePosition) toMessage(caption string, sequence int64, offset time.Duration) *waProto.Message {
+	return &waProto.Message{LiveLocationMessage: &waProto.LiveLocationMessage{
+		DegreesLatitude:                   proto.Float64(p.Latitude),
+		DegreesLongitude:                  proto.Float64(p.Longitude),
+		AccuracyInMeters:                  proto.Uint32(p.Accuracy),
+		SpeedInMps:                        proto.Float32(p.Speed),
+		DegreesClockwiseFromMagneticNorth: proto.Uint32(p.Heading),
+		Caption:                           proto.String(caption),
+		SequenceNumber:                    proto.Int64(sequence),
+		TimeOffset:                        proto.Uint32(uint32(offset.Seconds())),
+	}}
+}
+
+const liveLocationColumns = `id, chat_jid, message_id, COALESCE(caption, ''), latitude, longitude, COALESCE(accuracy, 0),
+	sequence, started_at, expires_at, updated_at, stopped_at`
+
+// Scan a live location row selected with liveLocationColumns
+func scanLiveLocation(row interface{ Scan(...interface{}) error }) (*LiveLocation, error) {
+	var l LiveLocation
+	var stoppedAt sql.NullTime
+	if err := row.Scan(&l.ID, &l.ChatJID, &l.MessageID, &l.Caption, &l.Latitude, &l.Longitude, &l.Accuracy,
+		&l.Sequence, &l.StartedAt, &l.ExpiresAt, &l.UpdatedAt, &stoppedAt); err != nil {
+		return nil, err
+	}
+	if stoppedAt.Valid {
+		l.StoppedAt = &stoppedAt.Time
+	}
+	l.Active = l.StoppedAt == nil && time.Now().Before(l.ExpiresAt)
+	return &l, nil
+}
+
+// Store a new live location share, setting its ID
+func (store *MessageStore) StoreLiveLocation(l *LiveLocation) error {
+	result, err := store.db.Exec(
+		`INSERT INTO live_locations (chat_jid, message_id, caption, latitude, longitude, accuracy, sequence, started_at, expires_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		l.ChatJID, l.MessageID, l.Caption, l.Latitude, l.Longitude, l.Accuracy, l.Sequence, l.StartedAt, l.ExpiresAt, l.UpdatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	l.ID, err = result.LastInsertId()
+	return err
+}
+
+// Get a live location share, sql.ErrNoRows if it doesn't exist
+func (store *MessageStore) GetLiveLocation(id int64) (*LiveLocation, error) {
+	return scanLiveLocation(store.db.QueryRow("SELECT "+liveLocationColumns+" FROM live_locations WHERE id = ?", id))
+}
+
+// Record a position sent for a live location share
+func (store *MessageStore) updateLiveLocation(id int64, p LivePosition, sequence int64, stop bool) error {
+	now := time.Now()
+	var stoppedAt interface{}
+	if stop {
+		stoppedAt = now
+	}
+	_, err := store.db.Exec(
+		`UPDATE live_locations SET latitude = ?, longitude = ?, accuracy = ?, sequence = ?, updated_at = ?,
+			stopped_at = COALESCE(stopped_at, ?)
+		WHERE id = ?`,
+		p.Latitude, p.Longitude, p.Accuracy, sequence, now, stoppedAt, id,
+	)
+	return err
+}
+
+// List live location shares, newest first, optionally only those still active
+func (store *MessageStore) ListLiveLocations(activeOnly bool, limit, offset int) ([]*LiveLocation, error) {
+	query := "SELECT " + liveLocationColumns + " FROM live_locations"
+	var args []interface{}
+	if activeOnly {
+		query += " WHERE stopped_at IS NULL AND expires_at > ?"
+		args = append(args, time.Now())
+	}
+	query += " ORDER BY started_at DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	shares := []*LiveLocation{}
+	for rows.Next() {
+		l, err := scanLiveLocation(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, l)
+	}
+	return shares, rows.Err()
+}
+
+// Send a new position of a live location share as an edit of its message
+func sendLivePosition(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, l *LiveLocation, p LivePosition, stop bool) error {
+	chat, err := types.ParseJID(l.ChatJID)
+	if err != nil {
+		return err
+	}
+	sequence := l.Sequence + 1
+	edit := client.BuildEdit(chat, types.MessageID(l.MessageID), p.toMessage(l.Caption, sequence, time.Since(l.StartedAt)))
+	if _, err := sendInteractiveMessage(ctx, client, messageStore, l.ChatJID, edit); err != nil {
+		return err
+	}
+	return messageStore.updateLiveLocation(l.ID, p, sequence, stop)
+}
+
+// StartLiveLocationRequest represents the request body for starting a live location share
+type StartLiveLocationRequest struct {
+	Recipient       string `json:"recipient"`
+	Caption         string `json:"caption,omitempty"`
+	DurationMinutes int    `json:"duration_minutes,omitempty"` // 60 by default, at most 480
+	LivePosition
+}
+
+// LivePositionRequest represents the request body for updating or stopping a live location share
+type LivePositionRequest struct {
+	LivePosition
+}
+
+// ListLiveLocationsResponse represents the response for the live location list API
+type ListLiveLocationsResponse struct {
+	Success       bool            `json:"success"`
+	LiveLocations []*LiveLocation `json:"live_locations"`
+	Page
+}
+
+// LiveLocationResponse represents the response for the single live location APIs
+type LiveLocationResponse struct {
+	Success      bool          `json:"success"`
+	LiveLocation *LiveLocation `json:"live_location"`
+}
+
+// Load the live location share of an {id} route, writing an error if it can't be
+func liveLocationFromPath(w http.ResponseWriter, r *http.Request, messageStore *MessageStore) *LiveLocation {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, ErrCodeInvalidRequest, "Live location ID must be an integer", nil)
+		return nil
+	}
+	l, err := messageStore.GetLiveLocation(id)
+	if err == sql.ErrNoRows {
+		writeError(w, ErrCodeNotFound, fmt.Sprintf("Live location %d not found", id), nil)
+		return nil
+	}
+	if err != nil {
+		writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to load live location: %v", err), nil)
+		return nil
+	}
+	return l
+}
+
+// Respond with a live location share after changing it
+func writeLiveLocation(w http.ResponseWriter, messageStore *MessageStore, id int64) {
+	l, err := messageStore.GetLiveLocation(id)
+	if err != nil {
+		writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to load live location: %v", err), nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, LiveLocationResponse{Success: true, LiveLocation: l})
+}
+
+// Register the REST handlers sharing live locations
+func registerLiveLocationHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	idParam := apiParam{Name: "id", In: "path", Description: "ID of the live location share", Required: true, Type: "integer"}
+
+	// Handler for listing live location shares
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/live_locations",
+		Summary: "List live location shares, newest first",
+		Tag:     "messages",
+		Scope:   ScopeSendMessages,
+		Params: []apiParam{
+			{Name: "active", Description: "Only shares that are still running", Type: "boolean"},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ListLiveLocationsResponse{},
+	})
+	http.HandleFunc("GET /api/live_locations", func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		shares, err := messageStore.ListLiveLocations(r.URL.Query().Get("active") == "true", limit+1, offset)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list live locations: %v", err), nil)
+			return
+		}
+		shares, page := trimPage(shares, offset, limit)
+		writeJSON(w, http.StatusOK, ListLiveLocationsResponse{Success: true, LiveLocations: shares, Page: page})
+	})
+
+	// Handler for starting a live location share
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/live_locations",
+		Summary:  "Start sharing a live location to a chat for a duration; positions are then sent with the position endpoint",
+		Tag:      "messages",
+		Scope:    ScopeSendMessages,
+		Audit:    true,
+		Request:  StartLiveLocationRequest{},
+		Response: LiveLocationResponse{},
+	})
+	http.HandleFunc("POST /api/live_locations", func(w http.ResponseWriter, r *http.Request) {
+		var req StartLiveLocationRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if req.Recipient == "" {
+			writeError(w, ErrCodeInvalidRequest, "Recipient is required", nil)
+			return
+		}
+		if err := req.validate(); err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if req.DurationMinutes == 0 {
+			req.DurationMinutes = defaultLiveLocationMinutes
+		}
+		if req.DurationMinutes < 0 || req.DurationMinutes > maxLiveLocationMinutes {
+			writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("duration_minutes must be between 1 and %d", maxLiveLocationMinutes), nil)
+			return
+		}
+		chat, _, err := resolveRecipient(messageStore, req.Recipient)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		id, err := sendInteractiveMessage(r.Context(), client, messageStore, chat.String(), req.toMessage(req.Caption, 0, 0))
+		if err != nil {
+			writeAPIError(w, "Failed to share live location", err)
+			return
+		}
+		now := time.Now()
+		l := &LiveLocation{
+			ChatJID:   chat.String(),
+			MessageID: id,
+			Caption:   req.Caption,
+			Latitude:  req.Latitude,
+			Longitude: req.Longitude,
+			Accuracy:  req.Accuracy,
+			StartedAt: now,
+			ExpiresAt: now.Add(time.Duration(req.DurationMinutes) * time.Minute),
+			UpdatedAt: now,
+		}
+		if err := messageStore.StoreLiveLocation(l); err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Live location was shared but could not be stored: %v", err), nil)
+			return
+		}
+		writeLiveLocation(w, messageStore, l.ID)
+	})
+
+	// Handler for sending a new position
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/live_locations/{id}/position",
+		Summary:  "Send a new position of a running live location share",
+		Tag:      "messages",
+		Scope:    ScopeSendMessages,
+		Params:   []apiParam{idParam},
+		Request:  LivePositionRequest{},
+		Response: LiveLocationResponse{},
+	})
+	http.HandleFunc("POST /api/live_locations/{id}/position", func(w http.ResponseWriter, r *http.Request) {
+		l := liveLocationFromPath(w, r, messageStore)
+		if l == nil {
+			return
+		}
+		var req LivePositionRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if err := req.validate(); err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if !l.Active {
+			writeError(w, ErrCodeConflict, fmt.Sprintf("Live location %d has ended", l.ID), nil)
+			return
+		}
+		if err := sendLivePosition(r.Context(), client, messageStore, l, req.LivePosition, false); err != nil {
+			writeAPIError(w, "Failed to send position", err)
+			return
+		}
+		writeLiveLocation(w, messageStore, l.ID)
+	})
+
+	// Handler for stopping a share
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/live_locations/{id}/stop",
+		Summary:  "Stop a live location share, sending its last position; without a body the last known position is sent again",
+		Tag:      "messages",
+		Scope:    ScopeSendMessages,
+		Audit:    true,
+		Params:   []apiParam{idParam},
+		Request:  LivePositionRequest{},
+		Response: LiveLocationResponse{},
+	})
+	http.HandleFunc("POST /api/live_locations/{id}/stop", func(w http.ResponseWriter, r *http.Request) {
+		l := liveLocationFromPath(w, r, messageStore)
+		if l == nil {
+			return
+		}
+		req := LivePositionRequest{LivePosition{Latitude: l.Latitude, Longitude: l.Longitude, Accuracy: l.Accuracy}}
+		if r.ContentLength != 0 && !decodeJSON(w, r, &req) {
+			return
+		}
+		if err := req.validate(); err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if !l.Active {
+			// Already over, nothing to send
+			if err := messageStore.updateLiveLocation(l.ID, LivePosition{Latitude: l.Latitude, Longitude: l.Longitude, Accuracy: l.Accuracy}, l.Sequence, true); err != nil {
+				writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to stop live location: %v", err), nil)
+				return
+			}
+			writeLiveLocation(w, messageStore, l.ID)
+			return
+		}
+		if err := sendLivePosition(r.Context(), client, messageStore, l, req.LivePosition, true); err != nil {
+			writeAPIError(w, "Failed to send last position", err)
+			return
+		}
+		writeLiveLocation(w, messageStore, l.ID)
+	})
+}
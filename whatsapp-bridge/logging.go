@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Log levels, in increasing severity
+const (
+	levelDebug = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// Names of the log levels as configured and printed
+var logLevelNames = map[int]string{
+	levelDebug: "DEBUG",
+	levelInfo:  "INFO",
+	levelWarn:  "WARN",
+	levelError: "ERROR",
+}
+
+// Parse a log level name, defaulting to INFO
+func parseLogLevel(name string) int {
+	switch strings.ToUpper(strings.TrimSpace(name)) {
+	case "DEBUG":
+		return levelDebug
+	case "WARN", "WARNING":
+		return levelWarn
+	case "ERROR":
+		return levelError
+	}
+	return levelInfo
+}
+
+// logOutput is where all loggers write, shared so the level, format and
+// destination are configured in one place
+type logOutput struct {
+	mu     sync.Mutex
+	level  int
+	json   bool
+	writer io.Writer
+}
+
+// The output of all loggers; stdout at INFO until initLogging configures it
+var logOut = &logOutput{level: levelInfo, writer: os.Stdout}
+
+// Logger of the bridge's own messages
+var bridgeLog waLog.Logger = &bridgeLogger{module: "Bridge", out: logOut}
+
+// Configure logging from the environment: WHATSAPP_LOG_LEVEL (DEBUG, INFO,
+// WARN or ERROR), WHATSAPP_LOG_FORMAT (text or json) and WHATSAPP_LOG_FILE to
+// also write to a file rotated at WHATSAPP_LOG_MAX_SIZE_MB, keeping
+// WHATSAPP_LOG_MAX_BACKUPS old files. WHATSAPP_LOG_BUFFER_LINES recent lines
+// from WHATSAPP_LOG_BUFFER_LEVEL up are kept in memory for /api/admin/logs.
+func initLogging() error {
+	logTail.configure(envInt("WHATSAPP_LOG_BUFFER_LINES", defaultLogBufferLines), parseLogLevel(envString("WHATSAPP_LOG_BUFFER_LEVEL", "DEBUG")))
+
+	logOut.mu.Lock()
+	defer logOut.mu.Unlock()
+
+	logOut.level = parseLogLevel(envString("WHATSAPP_LOG_LEVEL", "INFO"))
+	logOut.json = strings.EqualFold(envString("WHATSAPP_LOG_FORMAT", "text"), "json")
+	logOut.writer = os.Stdout
+
+	if path := dataPath(envString("WHATSAPP_LOG_FILE", "")); path != "" {
+		file, err := newRotatingFile(path, int64(envInt("WHATSAPP_LOG_MAX_SIZE_MB", 10))<<20, envInt("WHATSAPP_LOG_MAX_BACKUPS", 5))
+		if err != nil {
+			return fmt.Errorf("failed to open log file: %v", err)
+		}
+		logOut.writer = io.MultiWriter(os.Stdout, file)
+	}
+	return nil
+}
+
+// Write a log line
+func (o *logOutput) write(level int, module, msg string) {
+	now := time.Now()
+	logTail.add(now, level, module, msg)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if level < o.level {
+		return
+	}
+
+	if o.json {
+		line, _ := json.Marshal(map[string]string{
+			"time":    now.Format(time.RFC3339Nano),
+			"level":   logLevelNames[level],
+			"module":  module,
+			"message": msg,
+		})
+		o.writer.Write(append(line, '\n'))
+		return
+	}
+	fmt.Fprintf(o.writer, "%s [%s %s] %s\n", now.Format("15:04:05.000"), module, logLevelNames[level], msg)
+}
+
+// bridgeLogger is a waLog.Logger writing to the shared log output, so the
+// bridge and the WhatsApp client log the same way
+type bridgeLogger struct {
+	module string
+	out    *logOutput
+}
+
+func (l *bridgeLogger) Debugf(msg string, args ...interface{}) {
+	l.out.write(levelDebug, l.module, fmt.Sprintf(msg, args...))
+}
+
+func (l *bridgeLogger) Infof(msg string, args ...interface{}) {
+	l.out.write(levelInfo, l.module, fmt.Sprintf(msg, args...))
+}
+
+func (l *bridgeLogger) Warnf(msg string, args ...interface{}) {
+	l.out.write(levelWarn, l.module, fmt.Sprintf(msg, args...))
+}
+
+func (l *bridgeLogger) Errorf(msg string, args ...interface{}) {
+	l.out.write(levelError, l.module, fmt.Sprintf(msg, args...))
+}
+
+func (l *bridgeLogger) Sub(module string) waLog.Logger {
+	return &bridgeLogger{module: l.module + "/" + module, out: l.out}
+}
+
+// Create a logger for a module
+func newLogger(module string) waLog.Logger {
+	return &bridgeLogger{module: module, out: logOut}
+}
+
+// rotatingFile is a log file that is moved aside once it reaches a size,
+// keeping a number of older files as path.1, path.2, ...
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	backups  int
+	file     *os.File
+	size     int64
+}
+
+// Open a rotating log file, appending to it if it exists
+func newRotatingFile(path string, maxBytes int64, backups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxBytes: maxBytes, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Open the current log file
+func (r *rotatingFile) open() error {
+	file, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file, r.size = file, info.Size()
+	return nil
+}
+
+// Shift the old files up by one, dropping the oldest, and start a new file
+func (r *rotatingFile) rotate() error {
+	r.file.Close()
+	for i := r.backups; i > 0; i-- {
+		from := r.path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", r.path, i-1)
+		}
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", r.path, i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if r.backups <= 0 {
+		os.Remove(r.path)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxBytes > 0 && r.size+int64(len(p)) > r.maxBytes && r.size > 0 {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
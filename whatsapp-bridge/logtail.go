@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default number of recent log lines kept in memory for /api/admin/logs
+const defaultLogBufferLines = 1000
+
+// How often a followed log stream sends a comment so proxies keep it open
+const logStreamHeartbeat = 30 * time.Second
+
+// LogEntry is a log line kept in memory
+type LogEntry struct {
+	Seq     int64     `json:"seq"` // Increases by one per captured line
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Module  string    `json:"module"`
+	Message string    `json:"message"`
+}
+
+// logRing keeps the most recent log lines, at its own level so WhatsApp
+// client debug logs can be captured while stdout stays at INFO, and hands
+// new lines to followers
+type logRing struct {
+	mu        sync.Mutex
+	level     int
+	entries   []LogEntry // Ring of at most size entries, oldest at start once full
+	size      int
+	start     int
+	seq       int64
+	followers map[chan LogEntry]struct{}
+}
+
+// Recent log lines, capturing everything until initLogging configures it
+var logTail = &logRing{level: levelDebug, size: defaultLogBufferLines}
+
+// Set the number of lines kept and the lowest level captured; 0 lines disables the buffer
+func (l *logRing) configure(size, level int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	kept := l.snapshotLocked()
+	if len(kept) > size {
+		kept = kept[len(kept)-size:]
+	}
+	l.size, l.level, l.entries, l.start = max(size, 0), level, kept, 0
+}
+
+// Whether lines are kept at all
+func (l *logRing) enabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.size > 0
+}
+
+// Keep a log line
+func (l *logRing) add(t time.Time, level int, module, msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size == 0 || level < l.level {
+		return
+	}
+	l.seq++
+	entry := LogEntry{Seq: l.seq, Time: t, Level: logLevelNames[level], Module: module, Message: msg}
+	if len(l.entries) < l.size {
+		l.entries = append(l.entries, entry)
+	} else {
+		l.entries[l.start] = entry
+		l.start = (l.start + 1) % l.size
+	}
+	for ch := range l.followers {
+		// A follower that can't keep up misses lines rather than blocking logging
+		select {
+		case ch <- entry:
+		default:
+		}
+	}
+}
+
+// Copy the kept lines, oldest first
+func (l *logRing) snapshotLocked() []LogEntry {
+	out := make([]LogEntry, 0, len(l.entries))
+	out = append(out, l.entries[l.start:]...)
+	return append(out, l.entries[:l.start]...)
+}
+
+// Get the kept lines, oldest first
+func (l *logRing) snapshot() []LogEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.snapshotLocked()
+}
+
+// Start following new lines, returning the kept ones too so none fall in between
+func (l *logRing) follow() ([]LogEntry, chan LogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ch := make(chan LogEntry, 256)
+	if l.followers == nil {
+		l.followers = map[chan LogEntry]struct{}{}
+	}
+	l.followers[ch] = struct{}{}
+	return l.snapshotLocked(), ch
+}
+
+// Stop following new lines
+func (l *logRing) unfollow(ch chan LogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.followers, ch)
+}
+
+// logFilter selects log lines
+type logFilter struct {
+	level  int
+	module string // Module name prefix, case-insensitive
+	after  int64  // Only lines with a higher seq
+}
+
+// Whether a log line passes the filter
+func (f logFilter) match(e LogEntry) bool {
+	return parseLogLevel(e.Level) >= f.level && e.Seq > f.after &&
+		strings.HasPrefix(strings.ToLower(e.Module), strings.ToLower(f.module))
+}
+
+// ListLogsResponse represents the response for the log tail API
+type ListLogsResponse struct {
+	Success bool       `json:"success"`
+	Lines   []LogEntry `json:"lines"`
+	LastSeq int64      `json:"last_seq"` // Pass as after_seq to get only newer lines
+}
+
+// Register the REST handler tailing the in-memory log
+func registerLogTailHandlers() {
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/admin/logs",
+		Summary: "Tail recent log lines kept in memory, WhatsApp client debug logs included (WHATSAPP_LOG_BUFFER_LINES, WHATSAPP_LOG_BUFFER_LEVEL); with follow=true new lines are streamed as server-sent events",
+		Tag:     "admin",
+		Scope:   ScopeAdmin,
+		Params: []apiParam{
+			{Name: "level", Description: "Lowest level of the lines (DEBUG, INFO, WARN or ERROR), DEBUG by default"},
+			{Name: "module", Description: "Only lines of modules starting with this, like Client or Bridge"},
+			{Name: "lines", Description: "Most recent matching lines to return, 100 by default", Type: "integer"},
+			{Name: "after_seq", Description: "Only lines after this sequence number", Type: "integer"},
+			{Name: "follow", Description: "Keep the connection open and stream new lines as text/event-stream", Type: "boolean"},
+		},
+		Response: ListLogsResponse{},
+	})
+	http.HandleFunc("GET /api/admin/logs", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter := logFilter{level: levelDebug, module: query.Get("module")}
+		if v := query.Get("level"); v != "" {
+			filter.level = parseLogLevel(v)
+		}
+		lines := 100
+		if v := query.Get("lines"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				writeError(w, ErrCodeInvalidRequest, "lines must be a non-negative integer", nil)
+				return
+			}
+			lines = n
+		}
+		// Browsers reconnecting to an event stream say where they left off
+		after := query.Get("after_seq")
+		if after == "" {
+			after = r.Header.Get("Last-Event-ID")
+		}
+		if v := after; v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				writeError(w, ErrCodeInvalidRequest, "after_seq must be an integer", nil)
+				return
+			}
+			filter.after = n
+		}
+		if !logTail.enabled() {
+			writeError(w, ErrCodeConflict, "The log buffer is disabled, set WHATSAPP_LOG_BUFFER_LINES to enable it", nil)
+			return
+		}
+
+		follow := query.Get("follow") == "true"
+		var kept []LogEntry
+		var ch chan LogEntry
+		if follow {
+			kept, ch = logTail.follow()
+			defer logTail.unfollow(ch)
+		} else {
+			kept = logTail.snapshot()
+		}
+
+		matched := []LogEntry{}
+		for _, e := range kept {
+			if filter.match(e) {
+				matched = append(matched, e)
+			}
+		}
+		if len(matched) > lines {
+			matched = matched[len(matched)-lines:]
+		}
+		var lastSeq int64
+		if len(kept) > 0 {
+			lastSeq = kept[len(kept)-1].Seq
+		}
+
+		if !follow {
+			writeJSON(w, http.StatusOK, ListLogsResponse{Success: true, Lines: matched, LastSeq: lastSeq})
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, ErrCodeInternal, "Streaming is not supported by this connection", nil)
+			return
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		send := func(e LogEntry) {
+			data, _ := json.Marshal(e)
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", e.Seq, data)
+		}
+		for _, e := range matched {
+			send(e)
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(logStreamHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+				flusher.Flush()
+			case e := <-ch:
+				if filter.match(e) {
+					send(e)
+					flusher.Flush()
+				}
+			}
+		}
+	})
+}
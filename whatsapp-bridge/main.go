@@ -4,7 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"encoding/binary"
-	"encoding/json"
+	"flag"
 	"fmt"
 	"math"
 	"math/rand"
@@ -17,6 +17,7 @@ import (
 	"syscall"
 	"time"
 
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/mdp/qrterminal"
 
@@ -33,12 +34,21 @@ import (
 
 // Message represents a chat message for our client
 type Message struct {
-	Time      time.Time
-	Sender    string
-	Content   string
-	IsFromMe  bool
-	MediaType string
-	Filename  string
+	ID        string    `json:"id"`
+	ChatJID   string    `json:"chat_jid"`
+	Time      time.Time `json:"timestamp"`
+	Sender    string    `json:"sender"`
+	SenderID  string    `json:"sender_id,omitempty"`  // Phone number user when known, the same for LID and phone senders
+	SenderLID string    `json:"sender_lid,omitempty"` // LID user of the sender when known
+	Content   string    `json:"content"`
+	IsFromMe  bool      `json:"is_from_me"`
+	MediaType string    `json:"media_type,omitempty"`
+	Filename  string    `json:"filename,omitempty"`
+	ViewOnce  bool      `json:"is_view_once,omitempty"`
+	Revoked   bool      `json:"is_revoked,omitempty"`
+	Selected  string    `json:"selected_option,omitempty"` // Option ID chosen by a reply to buttons or a list
+	OCRText   string    `json:"ocr_text,omitempty"`        // Text recognized in the image
+	Language  string    `json:"language,omitempty"`        // Detected language of the content, ISO 639-1
 }
 
 // Database handler for storing message history
@@ -49,12 +59,15 @@ type MessageStore struct {
 // Initialize message store
 func NewMessageStore() (*MessageStore, error) {
 	// Create directory for database if it doesn't exist
-	if err := os.MkdirAll("store", 0755); err != nil {
+	if err := os.MkdirAll(storeDir(), 0755); err != nil {
 		return nil, fmt.Errorf("failed to create store directory: %v", err)
 	}
 
-	// Open SQLite database for messages
-	db, err := sql.Open("sqlite3", "file:store/messages.db?_foreign_keys=on")
+	// Open SQLite database for messages. History sync workers write concurrently
+	// with live messages, so wait for locks instead of failing right away.
+	// Recursive triggers make INSERT OR REPLACE fire the delete triggers keeping
+	// the search index in sync.
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(storeDir(), "messages.db")+"?_foreign_keys=on&_busy_timeout=10000&_recursive_triggers=on")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open message database: %v", err)
 	}
@@ -84,15 +97,496 @@ func NewMessageStore() (*MessageStore, error) {
 			PRIMARY KEY (id, chat_jid),
 			FOREIGN KEY (chat_jid) REFERENCES chats(jid)
 		);
+
+		CREATE TABLE IF NOT EXISTS audit_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			timestamp TIMESTAMP,
+			caller TEXT,
+			method TEXT,
+			endpoint TEXT,
+			arguments TEXT,
+			status INTEGER,
+			success BOOLEAN,
+			result TEXT,
+			remote_addr TEXT,
+			duration_ms INTEGER
+		);
+		CREATE INDEX IF NOT EXISTS idx_audit_log_timestamp ON audit_log(timestamp);
+
+		CREATE TABLE IF NOT EXISTS media_retries (
+			message_id TEXT,
+			chat_jid TEXT,
+			status TEXT,
+			direct_path TEXT,
+			error TEXT,
+			requested_at TIMESTAMP,
+			updated_at TIMESTAMP,
+			PRIMARY KEY (message_id, chat_jid)
+		);
+
+		CREATE TABLE IF NOT EXISTS outbox (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			created_at TIMESTAMP,
+			caller TEXT,
+			recipient TEXT,
+			message TEXT,
+			media_path TEXT,
+			status TEXT,
+			error TEXT,
+			decided_by TEXT,
+			decided_at TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_outbox_status ON outbox(status);
+
+		CREATE TABLE IF NOT EXISTS watches (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT,
+			chat_jid TEXT,
+			keywords TEXT,
+			pattern TEXT,
+			alert_chat TEXT,
+			webhook_url TEXT,
+			tag TEXT,
+			enabled BOOLEAN,
+			created_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS reminders (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			chat_jid TEXT,
+			message_id TEXT,
+			note TEXT,
+			remind_at TIMESTAMP,
+			status TEXT,
+			notify_self BOOLEAN,
+			webhook_url TEXT,
+			created_at TIMESTAMP,
+			fired_at TIMESTAMP,
+			completed_at TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_reminders_status ON reminders(status, remind_at);
+
+		CREATE TABLE IF NOT EXISTS message_tags (
+			message_id TEXT,
+			chat_jid TEXT,
+			tag TEXT,
+			created_at TIMESTAMP,
+			PRIMARY KEY (message_id, chat_jid, tag)
+		);
+		CREATE INDEX IF NOT EXISTS idx_message_tags_tag ON message_tags(tag);
+
+		CREATE INDEX IF NOT EXISTS idx_messages_media_type ON messages(media_type, timestamp);
+
+		CREATE TABLE IF NOT EXISTS links (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			url TEXT,
+			domain TEXT,
+			title TEXT,
+			message_id TEXT,
+			chat_jid TEXT,
+			sender TEXT,
+			timestamp TIMESTAMP,
+			fetched_at TIMESTAMP,
+			UNIQUE (message_id, chat_jid, url)
+		);
+		CREATE INDEX IF NOT EXISTS idx_links_timestamp ON links(timestamp);
+		CREATE INDEX IF NOT EXISTS idx_links_domain ON links(domain);
+
+		CREATE TABLE IF NOT EXISTS extracted_events (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id TEXT,
+			chat_jid TEXT,
+			source TEXT,
+			title TEXT,
+			start_time TIMESTAMP,
+			end_time TIMESTAMP,
+			all_day BOOLEAN,
+			location TEXT,
+			phrase TEXT,
+			created_at TIMESTAMP,
+			UNIQUE (message_id, chat_jid, source, start_time)
+		);
+		CREATE INDEX IF NOT EXISTS idx_extracted_events_start ON extracted_events(start_time);
+
+		CREATE TABLE IF NOT EXISTS tasks (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id TEXT,
+			chat_jid TEXT,
+			sender TEXT,
+			title TEXT,
+			status TEXT,
+			created_at TIMESTAMP,
+			completed_at TIMESTAMP,
+			completed_by TEXT,
+			updated_at TIMESTAMP,
+			revision INTEGER,
+			UNIQUE (message_id, chat_jid, title)
+		);
+		CREATE INDEX IF NOT EXISTS idx_tasks_revision ON tasks(revision);
+		CREATE INDEX IF NOT EXISTS idx_tasks_chat ON tasks(chat_jid, status);
+
+		CREATE TABLE IF NOT EXISTS message_archives (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			chat_jid TEXT,
+			path TEXT,
+			first_timestamp TIMESTAMP,
+			last_timestamp TIMESTAMP,
+			message_count INTEGER,
+			size_bytes INTEGER,
+			created_at TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_message_archives_chat ON message_archives(chat_jid);
+
+		CREATE TABLE IF NOT EXISTS archived_media (
+			chat_jid TEXT,
+			filename TEXT,
+			PRIMARY KEY (chat_jid, filename)
+		);
+
+		CREATE TABLE IF NOT EXISTS group_participants (
+			group_jid TEXT,
+			participant_jid TEXT,
+			phone_number TEXT,
+			lid TEXT,
+			is_admin BOOLEAN,
+			is_super_admin BOOLEAN,
+			display_name TEXT,
+			updated_at TIMESTAMP,
+			PRIMARY KEY (group_jid, participant_jid)
+		);
+
+		CREATE TABLE IF NOT EXISTS contacts (
+			jid TEXT PRIMARY KEY,
+			first_name TEXT,
+			full_name TEXT,
+			push_name TEXT,
+			business_name TEXT,
+			updated_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS contact_attributes (
+			jid TEXT,
+			key TEXT,
+			value TEXT,
+			updated_at TIMESTAMP,
+			PRIMARY KEY (jid, key)
+		);
+
+		CREATE TABLE IF NOT EXISTS contact_overrides (
+			jid TEXT PRIMARY KEY,
+			name TEXT NOT NULL,
+			updated_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS lid_map (
+			lid TEXT PRIMARY KEY,
+			pn TEXT,
+			updated_at TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_lid_map_pn ON lid_map(pn);
+
+		CREATE TABLE IF NOT EXISTS pinned_messages (
+			chat_jid TEXT,
+			message_id TEXT,
+			pinned_by TEXT,
+			pinned_at TIMESTAMP,
+			expires_at TIMESTAMP,
+			PRIMARY KEY (chat_jid, message_id)
+		);
+
+		CREATE TABLE IF NOT EXISTS mentions (
+			chat_jid TEXT,
+			message_id TEXT,
+			kind TEXT,
+			timestamp TIMESTAMP,
+			PRIMARY KEY (chat_jid, message_id, kind)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_mentions_timestamp ON mentions(timestamp);
+
+		CREATE TABLE IF NOT EXISTS payments (
+			chat_jid TEXT,
+			message_id TEXT,
+			timestamp TIMESTAMP,
+			kind TEXT,
+			amount REAL,
+			currency TEXT,
+			status TEXT,
+			note TEXT,
+			request_message_id TEXT,
+			PRIMARY KEY (chat_jid, message_id)
+		);
+
+		CREATE INDEX IF NOT EXISTS idx_payments_timestamp ON payments(timestamp);
+
+		CREATE TABLE IF NOT EXISTS saved_views (
+			name TEXT PRIMARY KEY,
+			description TEXT,
+			definition TEXT,
+			created_at TIMESTAMP,
+			updated_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS message_receipts (
+			message_id TEXT,
+			chat_jid TEXT,
+			participant TEXT,
+			delivered_at TIMESTAMP,
+			read_at TIMESTAMP,
+			played_at TIMESTAMP,
+			PRIMARY KEY (message_id, chat_jid, participant)
+		);
+
+		CREATE TABLE IF NOT EXISTS ops_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			created_at TIMESTAMP,
+			kind TEXT,
+			target TEXT,
+			payload TEXT,
+			status TEXT,
+			error TEXT,
+			finished_at TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_ops_log_status ON ops_log(status);
+
+		CREATE TABLE IF NOT EXISTS message_embeddings (
+			message_id TEXT,
+			chat_jid TEXT,
+			model TEXT,
+			vector BLOB,
+			created_at TIMESTAMP,
+			PRIMARY KEY (message_id, chat_jid)
+		);
+		CREATE INDEX IF NOT EXISTS idx_message_embeddings_chat ON message_embeddings(chat_jid);
+
+		CREATE TABLE IF NOT EXISTS conversation_segments (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			chat_jid TEXT,
+			start_time TIMESTAMP,
+			end_time TIMESTAMP,
+			first_message_id TEXT,
+			last_message_id TEXT,
+			message_count INTEGER,
+			participants TEXT,
+			updated_at TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_conversation_segments_chat ON conversation_segments(chat_jid, start_time);
+
+		CREATE TABLE IF NOT EXISTS settings (
+			key TEXT PRIMARY KEY,
+			value TEXT
+		);
+
+		CREATE TABLE IF NOT EXISTS extracted_entities (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			message_id TEXT,
+			chat_jid TEXT,
+			sender TEXT,
+			type TEXT,
+			value TEXT,
+			normalized TEXT,
+			span_start INTEGER,
+			span_end INTEGER,
+			timestamp TIMESTAMP,
+			UNIQUE (message_id, chat_jid, type, span_start)
+		);
+		CREATE INDEX IF NOT EXISTS idx_extracted_entities_type ON extracted_entities(type, timestamp);
+		CREATE INDEX IF NOT EXISTS idx_extracted_entities_normalized ON extracted_entities(normalized);
+
+		CREATE TABLE IF NOT EXISTS message_translations (
+			message_id TEXT,
+			chat_jid TEXT,
+			target_language TEXT,
+			source_text TEXT,
+			source_language TEXT,
+			text TEXT,
+			translated_at TIMESTAMP,
+			PRIMARY KEY (message_id, chat_jid, target_language)
+		);
+
+		CREATE TABLE IF NOT EXISTS group_events (
+			message_id TEXT,
+			chat_jid TEXT,
+			creator TEXT,
+			name TEXT,
+			description TEXT,
+			start_time TIMESTAMP,
+			end_time TIMESTAMP,
+			location_name TEXT,
+			location_address TEXT,
+			latitude REAL,
+			longitude REAL,
+			join_link TEXT,
+			canceled BOOLEAN DEFAULT 0,
+			extra_guests_allowed BOOLEAN DEFAULT 0,
+			created_at TIMESTAMP,
+			updated_at TIMESTAMP,
+			PRIMARY KEY (message_id, chat_jid)
+		);
+		CREATE INDEX IF NOT EXISTS idx_group_events_start ON group_events(start_time);
+
+		CREATE TABLE IF NOT EXISTS group_event_responses (
+			message_id TEXT,
+			chat_jid TEXT,
+			responder TEXT,
+			response TEXT,
+			extra_guests INTEGER DEFAULT 0,
+			timestamp TIMESTAMP,
+			PRIMARY KEY (message_id, chat_jid, responder)
+		);
+
+		CREATE TABLE IF NOT EXISTS newsletter_posts (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			newsletter_jid TEXT,
+			message_id TEXT,
+			server_id INTEGER,
+			text TEXT,
+			media_type TEXT,
+			filename TEXT,
+			status TEXT,
+			error TEXT,
+			timestamp TIMESTAMP
+		);
+		CREATE INDEX IF NOT EXISTS idx_newsletter_posts_newsletter ON newsletter_posts(newsletter_jid, timestamp);
+
+		CREATE TABLE IF NOT EXISTS live_locations (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			chat_jid TEXT,
+			message_id TEXT,
+			caption TEXT,
+			latitude REAL,
+			longitude REAL,
+			accuracy INTEGER,
+			sequence INTEGER DEFAULT 0,
+			started_at TIMESTAMP,
+			expires_at TIMESTAMP,
+			updated_at TIMESTAMP,
+			stopped_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS contact_dates (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			contact_jid TEXT,
+			kind TEXT,
+			month INTEGER,
+			day INTEGER,
+			year INTEGER,
+			label TEXT,
+			source TEXT,
+			message_id TEXT,
+			chat_jid TEXT,
+			updated_at TIMESTAMP,
+			reminded_year INTEGER DEFAULT 0,
+			UNIQUE (contact_jid, kind)
+		);
+
+		CREATE TABLE IF NOT EXISTS chat_merges (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			from_jid TEXT,
+			to_jid TEXT,
+			messages_moved INTEGER,
+			duplicates_dropped INTEGER,
+			merged_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS notification_routes (
+			chat_jid TEXT PRIMARY KEY,
+			target TEXT NOT NULL,
+			webhook_url TEXT,
+			topic TEXT,
+			notify_muted BOOLEAN DEFAULT 0,
+			updated_at TIMESTAMP
+		);
+
+		CREATE TABLE IF NOT EXISTS imap_mailboxes (
+			chat_jid TEXT PRIMARY KEY,
+			uid_validity INTEGER NOT NULL,
+			uid_next INTEGER NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS imap_uids (
+			mailbox_jid TEXT,
+			message_id TEXT,
+			uid INTEGER NOT NULL,
+			PRIMARY KEY (mailbox_jid, message_id)
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_imap_uids_uid ON imap_uids(mailbox_jid, uid);
 	`)
 	if err != nil {
 		db.Close()
 		return nil, fmt.Errorf("failed to create tables: %v", err)
 	}
 
+	// Columns added after their table was created
+	for _, c := range []struct{ table, column, definition string }{
+		{"messages", "is_starred", "BOOLEAN DEFAULT 0"},
+		{"messages", "is_view_once", "BOOLEAN DEFAULT 0"},
+		{"messages", "is_revoked", "BOOLEAN DEFAULT 0"},
+		{"messages", "revoked_at", "TIMESTAMP"},
+		{"outbox", "deliver_by", "TIMESTAMP"},
+		{"outbox", "attempts", "INTEGER DEFAULT 0"},
+		{"watches", "notify_muted", "BOOLEAN DEFAULT 0"},
+		{"watches", "sender", "TEXT"},
+		{"watches", "media_type", "TEXT"},
+		{"watches", "email_to", "TEXT"},
+		{"messages", "selected_option", "TEXT"},
+		{"messages", "ocr_text", "TEXT"},
+		{"messages", "ocr_at", "TIMESTAMP"},
+		{"messages", "document_text", "TEXT"},
+		{"messages", "document_text_at", "TIMESTAMP"},
+		{"messages", "language", "TEXT"},
+		{"messages", "document_pages", "INTEGER"},
+		{"messages", "document_title", "TEXT"},
+	} {
+		if err := addColumnIfMissing(db, c.table, c.column, c.definition); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to add column %s.%s: %v", c.table, c.column, err)
+		}
+	}
+
+	if err := initSearchIndex(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create search index: %v", err)
+	}
+	if err := initChatFreshness(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create chat freshness index: %v", err)
+	}
+	if err := initOCRIndex(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create OCR search index: %v", err)
+	}
+	if err := initDocumentIndex(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create document search index: %v", err)
+	}
+
 	return &MessageStore{db: db}, nil
 }
 
+// Add a column to an existing table unless it is there already
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("SELECT name FROM pragma_table_info('%s')", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
 // Close the database connection
 func (store *MessageStore) Close() error {
 	return store.db.Close()
@@ -107,27 +601,64 @@ func (store *MessageStore) StoreChat(jid, name string, lastMessageTime time.Time
 	return err
 }
 
-// Store a message in the database
-func (store *MessageStore) StoreMessage(id, chatJID, sender, content string, timestamp time.Time, isFromMe bool,
+// Store a message in the database, merging it into the copy already stored
+// if the same message was seen before, and count the outcome for its source
+func (store *MessageStore) StoreMessage(source, id, chatJID, sender, content string, timestamp time.Time, isFromMe bool,
 	mediaType, filename, url string, mediaKey, fileSHA256, fileEncSHA256 []byte, fileLength uint64) error {
 	// Only store if there's actual content or media
 	if content == "" && mediaType == "" {
 		return nil
 	}
 
-	_, err := store.db.Exec(
-		`INSERT OR REPLACE INTO messages 
-		(id, chat_jid, sender, content, timestamp, is_from_me, media_type, filename, url, media_key, file_sha256, file_enc_sha256, file_length) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM messages WHERE id = ? AND chat_jid = ?)", id, chatJID).Scan(&exists); err != nil {
+		return err
+	}
+	result, err := tx.Exec(mergeMessageSQL,
 		id, chatJID, sender, content, timestamp, isFromMe, mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	changed, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		if err := recordChatFreshness(tx, chatJID, timestamp, isFromMe); err != nil {
+			return err
+		}
+	}
+	if content != "" && changed > 0 {
+		if err := recordLanguage(tx, id, chatJID, content); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	switch {
+	case !exists:
+		ingestStats.record(source, ingestInserted)
+	case changed > 0:
+		ingestStats.record(source, ingestMerged)
+	default:
+		ingestStats.record(source, ingestDuplicate)
+	}
+	return nil
 }
 
 // Get messages from a chat
 func (store *MessageStore) GetMessages(chatJID string, limit int) ([]Message, error) {
 	rows, err := store.db.Query(
-		"SELECT sender, content, timestamp, is_from_me, media_type, filename FROM messages WHERE chat_jid = ? ORDER BY timestamp DESC LIMIT ?",
+		"SELECT id, chat_jid, sender, content, timestamp, is_from_me, media_type, filename FROM messages WHERE chat_jid = ? ORDER BY timestamp DESC LIMIT ?",
 		chatJID, limit,
 	)
 	if err != nil {
@@ -139,7 +670,7 @@ func (store *MessageStore) GetMessages(chatJID string, limit int) ([]Message, er
 	for rows.Next() {
 		var msg Message
 		var timestamp time.Time
-		err := rows.Scan(&msg.Sender, &msg.Content, &timestamp, &msg.IsFromMe, &msg.MediaType, &msg.Filename)
+		err := rows.Scan(&msg.ID, &msg.ChatJID, &msg.Sender, &msg.Content, &timestamp, &msg.IsFromMe, &msg.MediaType, &msg.Filename)
 		if err != nil {
 			return nil, err
 		}
@@ -185,14 +716,25 @@ func extractTextContent(msg *waProto.Message) string {
 		return extendedText.GetText()
 	}
 
+	// Replies to buttons and lists carry the text of the chosen option
+	if _, text := interactiveSelection(msg); text != "" {
+		return text
+	}
+
 	// For now, we're ignoring non-text messages
 	return ""
 }
 
 // SendMessageResponse represents the response for the send message API
 type SendMessageResponse struct {
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	Success         bool            `json:"success"`
+	Message         string          `json:"message"`
+	DryRun          bool            `json:"dry_run,omitempty"`
+	Preview         *MessagePreview `json:"preview,omitempty"`
+	PendingApproval bool            `json:"pending_approval,omitempty"`
+	OutboxID        int64           `json:"outbox_id,omitempty"` // Outbox entry of a message held for approval or presence
+	WaitingOnline   bool            `json:"waiting_for_online,omitempty"`
+	QueuedForRetry  bool            `json:"queued_for_retry,omitempty"`
 }
 
 // SendMessageRequest represents the request body for the send message API
@@ -200,102 +742,233 @@ type SendMessageRequest struct {
 	Recipient string `json:"recipient"`
 	Message   string `json:"message"`
 	MediaPath string `json:"media_path,omitempty"`
+	// Token of a file uploaded with POST /api/media/upload, instead of media_path
+	MediaToken string `json:"media_token,omitempty"`
+	// URL to download the media from, instead of media_path
+	MediaURL string `json:"media_url,omitempty"`
+	DryRun   bool   `json:"dry_run,omitempty"` // Validate and prepare the message without sending it
+
+	// Fill in {{first_name}}, {{full_name}}, {{name}}, {{phone}}, {{last_seen}} and
+	// custom contact attributes from the recipient's contact before sending
+	Template bool `json:"template,omitempty"`
+
+	// Hold the message until the recipient shows as online, for at most MaxWaitMinutes
+	SendWhenOnline bool `json:"send_when_online,omitempty"`
+	MaxWaitMinutes int  `json:"max_wait_minutes,omitempty"`
+
+	// Keep the message and send it after reconnecting if the connection is down
+	RetryOnFailure bool `json:"retry_on_failure,omitempty"`
 }
 
-// Function to send a WhatsApp message
-func sendWhatsAppMessage(client *whatsmeow.Client, recipient string, message string, mediaPath string) (bool, string) {
-	if !client.IsConnected() {
-		return false, "Not connected to WhatsApp"
-	}
+// MessagePreview describes the message a dry run would have sent
+type MessagePreview struct {
+	Recipient     string `json:"recipient"`
+	RecipientName string `json:"recipient_name,omitempty"`
+	Type          string `json:"type"`
+	Text          string `json:"text,omitempty"`
+	Filename      string `json:"filename,omitempty"`
+	MimeType      string `json:"mime_type,omitempty"`
+	FileLength    uint64 `json:"file_length,omitempty"`
+	Seconds       uint32 `json:"seconds,omitempty"`
+	PageCount     uint32 `json:"page_count,omitempty"`
+	Title         string `json:"title,omitempty"`
+}
 
-	// Create JID for recipient
-	var recipientJID types.JID
-	var err error
+// outgoingMessage is a validated message with its recipient resolved and its media
+// read from disk, ready to be uploaded and sent
+type outgoingMessage struct {
+	Recipient     types.JID
+	RecipientName string
+	Text          string
+	MediaPath     string
+	MediaData     []byte
+	MediaType     whatsmeow.MediaType
+	MimeType      string
+	Seconds       uint32
+	Waveform      []byte
+	GIFPlayback   bool   // Video transcoded from an animated GIF, played looping
+	Thumbnail     []byte // JPEG shown before the media is downloaded
+	Width         uint32 // Of the video, or of the thumbnail of a document
+	Height        uint32
+	PageCount     uint32                // Of a PDF
+	Title         string                // Of a PDF, if its metadata has one
+	ID            types.MessageID       // Generated when sending unless set
+	ServerID      types.MessageServerID // Given by WhatsApp to newsletter posts once sent
+}
 
+// Resolve a recipient given as a JID, a phone number or a contact name or alias.
+// The contact's name is returned when the recipient was given by name.
+func resolveRecipient(messageStore *MessageStore, recipient string) (types.JID, string, error) {
 	// Check if recipient is a JID
-	isJID := strings.Contains(recipient, "@")
-
-	if isJID {
+	if strings.Contains(recipient, "@") {
 		// Parse the JID string
-		recipientJID, err = types.ParseJID(recipient)
+		recipientJID, err := types.ParseJID(recipient)
 		if err != nil {
-			return false, fmt.Sprintf("Error parsing JID: %v", err)
-		}
-	} else {
-		// Create JID from phone number
-		recipientJID = types.JID{
-			User:   recipient,
-			Server: "s.whatsapp.net", // For personal chats
+			return types.JID{}, "", newAPIError(ErrCodeInvalidRequest, "Error parsing JID: %v", err)
 		}
+		return recipientJID, "", nil
 	}
 
-	msg := &waProto.Message{}
+	// Create JID from phone number
+	if strings.Trim(recipient, "+0123456789 -()") == "" {
+		jid, err := parseContactJID(recipient)
+		return jid, "", err
+	}
 
-	// Check if we have media to send
-	if mediaPath != "" {
-		// Read media file
-		mediaData, err := os.ReadFile(mediaPath)
-		if err != nil {
-			return false, fmt.Sprintf("Error reading media file: %v", err)
+	// Anything else is the name of a contact
+	return messageStore.ResolveContactName(recipient)
+}
+
+// Validate a message, resolve its recipient and prepare its media without sending anything
+func prepareWhatsAppMessage(messageStore *MessageStore, recipient string, message string, mediaPath string) (*outgoingMessage, error) {
+	recipientJID, recipientName, err := resolveRecipient(messageStore, recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &outgoingMessage{Recipient: recipientJID, RecipientName: recipientName, Text: message, MediaPath: mediaPath}
+	if mediaPath == "" {
+		return out, nil
+	}
+
+	// Read media file
+	out.MediaData, err = os.ReadFile(mediaPath)
+	if err != nil {
+		return nil, newAPIError(ErrCodeInvalidRequest, "Error reading media file: %v", err)
+	}
+
+	// Determine media type and mime type based on file extension
+	fileExt := strings.ToLower(mediaPath[strings.LastIndex(mediaPath, ".")+1:])
+
+	// Handle different media types
+	switch fileExt {
+	// Image types
+	case "jpg", "jpeg":
+		out.MediaType = whatsmeow.MediaImage
+		out.MimeType = "image/jpeg"
+	case "png":
+		out.MediaType = whatsmeow.MediaImage
+		out.MimeType = "image/png"
+	case "gif":
+		out.MediaType = whatsmeow.MediaImage
+		out.MimeType = "image/gif"
+		prepareAnimatedGIF(out)
+	case "webp":
+		out.MediaType = whatsmeow.MediaImage
+		out.MimeType = "image/webp"
+
+	// Audio types
+	case "ogg":
+		out.MediaType = whatsmeow.MediaAudio
+		out.MimeType = "audio/ogg; codecs=opus"
+
+	// Video types
+	case "mp4":
+		out.MediaType = whatsmeow.MediaVideo
+		out.MimeType = "video/mp4"
+	case "avi":
+		out.MediaType = whatsmeow.MediaVideo
+		out.MimeType = "video/avi"
+	case "mov":
+		out.MediaType = whatsmeow.MediaVideo
+		out.MimeType = "video/quicktime"
+
+	// Document types (for any other file type)
+	case "pdf":
+		out.MediaType = whatsmeow.MediaDocument
+		out.MimeType = "application/pdf"
+		preparePDF(out)
+	default:
+		out.MediaType = whatsmeow.MediaDocument
+		out.MimeType = "application/octet-stream"
+	}
+
+	if out.MediaType == whatsmeow.MediaVideo && !out.GIFPlayback {
+		prepareVideo(out)
+	}
+
+	// Analyze ogg audio files for their duration and waveform
+	if out.MediaType == whatsmeow.MediaAudio {
+		out.Seconds = 30 // Default fallback
+		if strings.Contains(out.MimeType, "ogg") {
+			out.Seconds, out.Waveform, err = analyzeOggOpus(out.MediaData)
+			if err != nil {
+				return nil, newAPIError(ErrCodeUnsupportedMedia, "Failed to analyze Ogg Opus file: %v", err)
+			}
+		} else {
+			bridgeLog.Warnf("Not an Ogg Opus file: %s", out.MimeType)
 		}
+	}
 
-		// Determine media type and mime type based on file extension
-		fileExt := strings.ToLower(mediaPath[strings.LastIndex(mediaPath, ".")+1:])
-		var mediaType whatsmeow.MediaType
-		var mimeType string
-
-		// Handle different media types
-		switch fileExt {
-		// Image types
-		case "jpg", "jpeg":
-			mediaType = whatsmeow.MediaImage
-			mimeType = "image/jpeg"
-		case "png":
-			mediaType = whatsmeow.MediaImage
-			mimeType = "image/png"
-		case "gif":
-			mediaType = whatsmeow.MediaImage
-			mimeType = "image/gif"
-		case "webp":
-			mediaType = whatsmeow.MediaImage
-			mimeType = "image/webp"
-
-		// Audio types
-		case "ogg":
-			mediaType = whatsmeow.MediaAudio
-			mimeType = "audio/ogg; codecs=opus"
-
-		// Video types
-		case "mp4":
-			mediaType = whatsmeow.MediaVideo
-			mimeType = "video/mp4"
-		case "avi":
-			mediaType = whatsmeow.MediaVideo
-			mimeType = "video/avi"
-		case "mov":
-			mediaType = whatsmeow.MediaVideo
-			mimeType = "video/quicktime"
-
-		// Document types (for any other file type)
-		default:
-			mediaType = whatsmeow.MediaDocument
-			mimeType = "application/octet-stream"
+	return out, nil
+}
+
+// Describe a prepared message, for dry runs
+func (out *outgoingMessage) Preview() *MessagePreview {
+	preview := &MessagePreview{Recipient: out.Recipient.String(), RecipientName: out.RecipientName, Type: "text", Text: out.Text}
+	if out.MediaPath == "" {
+		return preview
+	}
+
+	switch out.MediaType {
+	case whatsmeow.MediaImage:
+		preview.Type = "image"
+	case whatsmeow.MediaAudio:
+		// Voice notes carry no caption
+		preview.Type = "audio"
+		preview.Text = ""
+		preview.Seconds = out.Seconds
+	case whatsmeow.MediaVideo:
+		preview.Type = "video"
+		if out.GIFPlayback {
+			preview.Type = "gif"
 		}
+		preview.Seconds = out.Seconds
+	default:
+		preview.Type = "document"
+	}
+	preview.Filename = filepath.Base(out.MediaPath)
+	preview.MimeType = out.MimeType
+	preview.FileLength = uint64(len(out.MediaData))
+	preview.PageCount = out.PageCount
+	preview.Title = out.Title
+	return preview
+}
 
-		// Upload media to WhatsApp servers
-		resp, err := client.Upload(context.Background(), mediaData, mediaType)
+// Upload the media of a prepared message and send it
+func sendPreparedMessage(ctx context.Context, client waClient, messageStore *MessageStore, out *outgoingMessage) error {
+	if !client.IsConnected() {
+		return newAPIError(ErrCodeNotConnected, "Not connected to WhatsApp")
+	}
+
+	msg := &waProto.Message{}
+	var resp whatsmeow.UploadResponse
+
+	// Check if we have media to send
+	if out.MediaPath != "" {
+		// Upload media to WhatsApp servers, newsletter media is not encrypted
+		err := throttle(opMedia, func() (err error) {
+			ctx, cancel := callContext(ctx, callMedia)
+			defer cancel()
+			if out.Recipient.Server == types.NewsletterServer {
+				resp, err = client.UploadNewsletter(ctx, out.MediaData, out.MediaType)
+			} else {
+				resp, err = client.Upload(ctx, out.MediaData, out.MediaType)
+			}
+			return err
+		})
 		if err != nil {
-			return false, fmt.Sprintf("Error uploading media: %v", err)
+			return newCallError(ErrCodeUploadFailed, err, "Error uploading media: %v", err)
 		}
 
-		fmt.Println("Media uploaded", resp)
+		bridgeLog.Debugf("Media uploaded: %+v", resp)
 
 		// Create the appropriate message type based on media type
-		switch mediaType {
+		switch out.MediaType {
 		case whatsmeow.MediaImage:
 			msg.ImageMessage = &waProto.ImageMessage{
-				Caption:       proto.String(message),
-				Mimetype:      proto.String(mimeType),
+				Caption:       proto.String(out.Text),
+				Mimetype:      proto.String(out.MimeType),
 				URL:           &resp.URL,
 				DirectPath:    &resp.DirectPath,
 				MediaKey:      resp.MediaKey,
@@ -304,39 +977,22 @@ func sendWhatsAppMessage(client *whatsmeow.Client, recipient string, message str
 				FileLength:    &resp.FileLength,
 			}
 		case whatsmeow.MediaAudio:
-			// Handle ogg audio files
-			var seconds uint32 = 30 // Default fallback
-			var waveform []byte = nil
-
-			// Try to analyze the ogg file
-			if strings.Contains(mimeType, "ogg") {
-				analyzedSeconds, analyzedWaveform, err := analyzeOggOpus(mediaData)
-				if err == nil {
-					seconds = analyzedSeconds
-					waveform = analyzedWaveform
-				} else {
-					return false, fmt.Sprintf("Failed to analyze Ogg Opus file: %v", err)
-				}
-			} else {
-				fmt.Printf("Not an Ogg Opus file: %s\n", mimeType)
-			}
-
 			msg.AudioMessage = &waProto.AudioMessage{
-				Mimetype:      proto.String(mimeType),
+				Mimetype:      proto.String(out.MimeType),
 				URL:           &resp.URL,
 				DirectPath:    &resp.DirectPath,
 				MediaKey:      resp.MediaKey,
 				FileEncSHA256: resp.FileEncSHA256,
 				FileSHA256:    resp.FileSHA256,
 				FileLength:    &resp.FileLength,
-				Seconds:       proto.Uint32(seconds),
+				Seconds:       proto.Uint32(out.Seconds),
 				PTT:           proto.Bool(true),
-				Waveform:      waveform,
+				Waveform:      out.Waveform,
 			}
 		case whatsmeow.MediaVideo:
 			msg.VideoMessage = &waProto.VideoMessage{
-				Caption:       proto.String(message),
-				Mimetype:      proto.String(mimeType),
+				Caption:       proto.String(out.Text),
+				Mimetype:      proto.String(out.MimeType),
 				URL:           &resp.URL,
 				DirectPath:    &resp.DirectPath,
 				MediaKey:      resp.MediaKey,
@@ -344,11 +1000,25 @@ func sendWhatsAppMessage(client *whatsmeow.Client, recipient string, message str
 				FileSHA256:    resp.FileSHA256,
 				FileLength:    &resp.FileLength,
 			}
+			if out.Seconds > 0 {
+				msg.VideoMessage.Seconds = proto.Uint32(out.Seconds)
+			}
+			if out.Width > 0 && out.Height > 0 {
+				msg.VideoMessage.Width = proto.Uint32(out.Width)
+				msg.VideoMessage.Height = proto.Uint32(out.Height)
+			}
+			msg.VideoMessage.JPEGThumbnail = out.Thumbnail
+			msg.VideoMessage.GifPlayback = proto.Bool(out.GIFPlayback)
 		case whatsmeow.MediaDocument:
+			title := out.Title
+			if title == "" {
+				title = filepath.Base(out.MediaPath)
+			}
 			msg.DocumentMessage = &waProto.DocumentMessage{
-				Title:         proto.String(mediaPath[strings.LastIndex(mediaPath, "/")+1:]),
-				Caption:       proto.String(message),
-				Mimetype:      proto.String(mimeType),
+				Title:         proto.String(title),
+				FileName:      proto.String(filepath.Base(out.MediaPath)),
+				Caption:       proto.String(out.Text),
+				Mimetype:      proto.String(out.MimeType),
 				URL:           &resp.URL,
 				DirectPath:    &resp.DirectPath,
 				MediaKey:      resp.MediaKey,
@@ -356,19 +1026,51 @@ func sendWhatsAppMessage(client *whatsmeow.Client, recipient string, message str
 				FileSHA256:    resp.FileSHA256,
 				FileLength:    &resp.FileLength,
 			}
+			if out.PageCount > 0 {
+				msg.DocumentMessage.PageCount = proto.Uint32(out.PageCount)
+			}
+			if len(out.Thumbnail) > 0 {
+				msg.DocumentMessage.JPEGThumbnail = out.Thumbnail
+				msg.DocumentMessage.ThumbnailWidth = proto.Uint32(out.Width)
+				msg.DocumentMessage.ThumbnailHeight = proto.Uint32(out.Height)
+			}
 		}
 	} else {
-		msg.Conversation = proto.String(message)
+		msg.Conversation = proto.String(out.Text)
 	}
 
-	// Send message
-	_, err = client.SendMessage(context.Background(), recipientJID, msg)
+	// Send message, under an ID chosen up front so it can be made again after a crash
+	if out.ID == "" {
+		out.ID = client.GenerateMessageID()
+	}
+	payload := sendOp{Recipient: out.Recipient.String(), Message: out.Text, MediaPath: out.MediaPath, MessageID: out.ID}
+	err := journal(messageStore, OpKindSend, out.Recipient.String(), payload, func() error {
+		return throttle(opSend, func() error {
+			ctx, cancel := callContext(ctx, callSend)
+			defer cancel()
+			sent, err := client.SendMessage(ctx, out.Recipient, msg, whatsmeow.SendRequestExtra{ID: out.ID, MediaHandle: resp.Handle})
+			out.ServerID = sent.ServerID
+			return err
+		})
+	})
+	if err != nil {
+		return newCallError(ErrCodeSendFailed, err, "Error sending message: %v", err)
+	}
+	return nil
+}
 
+// Function to send a WhatsApp message
+func sendWhatsAppMessage(ctx context.Context, client waClient, messageStore *MessageStore, recipient string, message string, mediaPath string) (string, error) {
+	out, err := prepareWhatsAppMessage(messageStore, recipient, message, mediaPath)
 	if err != nil {
-		return false, fmt.Sprintf("Error sending message: %v", err)
+		return "", err
 	}
 
-	return true, fmt.Sprintf("Message sent to %s", recipient)
+	if err := sendPreparedMessage(ctx, client, messageStore, out); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Message sent to %s", recipient), nil
 }
 
 // Extract media info from a message
@@ -410,6 +1112,33 @@ func extractMediaInfo(msg *waProto.Message) (mediaType string, filename string,
 
 // Handle regular incoming messages with media support
 func handleMessage(client *whatsmeow.Client, messageStore *MessageStore, msg *events.Message, logger waLog.Logger) {
+	// Drop messages of chats excluded from storage
+	if isIngestExcluded(msg.Info.Chat) {
+		return
+	}
+
+	// Pins carry no content of their own, only track them
+	if pin := msg.Message.GetPinInChatMessage(); pin != nil {
+		handlePinMessage(messageStore, msg, pin)
+		return
+	}
+
+	// Responses to events and edits of them are encrypted, only track them
+	if enc := msg.Message.GetEncEventResponseMessage(); enc != nil {
+		handleEventResponse(client, messageStore, msg, enc)
+		return
+	}
+	if enc := msg.Message.GetSecretEncryptedMessage(); enc.GetSecretEncType() == waProto.SecretEncryptedMessage_EVENT_EDIT {
+		handleEventEdit(client, messageStore, msg, enc)
+		return
+	}
+
+	// Deletions for everyone either flag or remove the original
+	if protocol := msg.Message.GetProtocolMessage(); protocol.GetType() == waProto.ProtocolMessage_REVOKE {
+		handleRevoke(messageStore, msg, protocol)
+		return
+	}
+
 	// Save message to database
 	chatJID := msg.Info.Chat.String()
 	sender := msg.Info.Sender.User
@@ -429,6 +1158,21 @@ func handleMessage(client *whatsmeow.Client, messageStore *MessageStore, msg *ev
 	// Extract media info
 	mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength := extractMediaInfo(msg.Message)
 
+	// Payments carry no text or media, they are stored as a summary
+	payment := extractPayment(msg.Message, nil)
+	if payment != nil {
+		content, mediaType = payment.Summary(), mediaTypePayment
+	}
+
+	// So are group events
+	event := extractGroupEvent(msg.Message)
+	if event != nil {
+		content, mediaType = event.Summary(), mediaTypeEvent
+	}
+
+	// Shared contacts are not stored, but their birthdays are
+	handleSharedContacts(messageStore, msg.Message, msg.Info.ID, chatJID)
+
 	// Skip if there's no content and no media
 	if content == "" && mediaType == "" {
 		return
@@ -436,6 +1180,7 @@ func handleMessage(client *whatsmeow.Client, messageStore *MessageStore, msg *ev
 
 	// Store message in database
 	err = messageStore.StoreMessage(
+		sourceLive,
 		msg.Info.ID,
 		chatJID,
 		sender,
@@ -463,17 +1208,95 @@ func handleMessage(client *whatsmeow.Client, messageStore *MessageStore, msg *ev
 
 		// Log based on message type
 		if mediaType != "" {
-			fmt.Printf("[%s] %s %s: [%s: %s] %s\n", timestamp, direction, sender, mediaType, filename, content)
+			bridgeLog.Infof("[%s] %s %s: [%s: %s] %s", timestamp, direction, sender, mediaType, filename, logContent(content))
 		} else if content != "" {
-			fmt.Printf("[%s] %s %s: %s\n", timestamp, direction, sender, content)
+			bridgeLog.Infof("[%s] %s %s: %s", timestamp, direction, sender, logContent(content))
 		}
 	}
+
+	// View-once media is flagged so it isn't handed out by accident
+	if err == nil {
+		handleViewOnce(client, messageStore, msg, mediaType)
+	}
+
+	stored := Message{
+		ID:        msg.Info.ID,
+		ChatJID:   chatJID,
+		Time:      msg.Info.Timestamp,
+		Sender:    sender,
+		Content:   content,
+		MediaType: mediaType,
+		Filename:  filename,
+	}
+
+	// Tag and alert on messages matching a watch
+	if err == nil && !msg.Info.IsFromMe {
+		handleWatches(client, messageStore, stored, name)
+	}
+
+	// Forward to the downstream automation the chat is routed to
+	if err == nil && !msg.Info.IsFromMe {
+		routeMessage(client, messageStore, stored, name)
+	}
+
+	// Remember which option replies to buttons and lists chose
+	if err == nil {
+		handleInteractiveResponse(messageStore, msg.Info.ID, chatJID, msg.Message)
+		handlePayment(messageStore, msg.Info.ID, chatJID, msg.Info.Timestamp, payment)
+		handleGroupEvent(messageStore, msg.Info.ID, chatJID, msg.Info.Sender.ToNonAD().String(), msg.Info.Timestamp, event)
+	}
+
+	// Keep track of group messages mentioning or replying to me
+	if err == nil && !msg.Info.IsFromMe && msg.Info.IsGroup {
+		handleMentions(client, messageStore, stored, msg.Message, name)
+	}
+
+	// Collect dates and calendar files assistants can turn into calendar entries,
+	// and to-do items
+	if err == nil {
+		handleEventExtraction(client, messageStore, stored)
+		handleTaskExtraction(messageStore, stored, messageContextInfo(msg.Message).GetStanzaID())
+	}
+
+	// Queue the text for semantic search
+	if err == nil {
+		handleEmbedding(stored)
+	}
+
+	// Index the links, with the title of WhatsApp's link preview
+	if err == nil && content != "" {
+		preview := msg.Message.GetExtendedTextMessage()
+		handleLinks(messageStore, stored, preview.GetMatchedText(), preview.GetTitle(), true)
+	}
+
+	// Pull phone numbers, emails, IBANs and addresses out of the text
+	if err == nil {
+		handleEntityExtraction(messageStore, stored)
+	}
+
+	// Remember birthdays told in messages or wished by me
+	if err == nil {
+		handleContactDates(messageStore, stored, msg.Info.Sender.ToNonAD(), msg.Info.IsGroup)
+		handleDocumentInfo(messageStore, msg.Message.GetDocumentMessage(), msg.Info.ID, chatJID)
+	}
+
+	// Download received images and documents so their text gets indexed
+	if err == nil && !msg.Info.IsFromMe {
+		handleOCR(client, messageStore, stored)
+		handleDocumentText(client, messageStore, stored)
+	}
+
+	// Let the owner control the bridge with commands in their self-chat
+	if msg.Info.IsFromMe && isSelfChat(client, msg.Info.Chat) {
+		handleSelfCommand(client, messageStore, content)
+	}
 }
 
 // DownloadMediaRequest represents the request body for the download media API
 type DownloadMediaRequest struct {
-	MessageID string `json:"message_id"`
-	ChatJID   string `json:"chat_jid"`
+	MessageID     string `json:"message_id"`
+	ChatJID       string `json:"chat_jid"`
+	AllowViewOnce bool   `json:"allow_view_once,omitempty"` // Required to download view-once media
 }
 
 // DownloadMediaResponse represents the response for the download media API
@@ -554,7 +1377,7 @@ func (d *MediaDownloader) GetMediaType() whatsmeow.MediaType {
 }
 
 // Function to download media from a message
-func downloadMedia(client *whatsmeow.Client, messageStore *MessageStore, messageID, chatJID string) (bool, string, string, string, error) {
+func downloadMedia(ctx context.Context, client waClient, messageStore *MessageStore, messageID, chatJID string) (bool, string, string, string, error) {
 	// Query the database for the message
 	var mediaType, filename, url string
 	var mediaKey, fileSHA256, fileEncSHA256 []byte
@@ -562,7 +1385,7 @@ func downloadMedia(client *whatsmeow.Client, messageStore *MessageStore, message
 	var err error
 
 	// First, check if we already have this file
-	chatDir := fmt.Sprintf("store/%s", strings.ReplaceAll(chatJID, ":", "_"))
+	chatDir := mediaDirForChat(chatJID)
 	localPath := ""
 
 	// Get media info from the database
@@ -576,13 +1399,13 @@ func downloadMedia(client *whatsmeow.Client, messageStore *MessageStore, message
 		).Scan(&mediaType, &filename)
 
 		if err != nil {
-			return false, "", "", "", fmt.Errorf("failed to find message: %v", err)
+			return false, "", "", "", newAPIError(ErrCodeNotFound, "failed to find message: %v", err)
 		}
 	}
 
 	// Check if this is a media message
 	if mediaType == "" {
-		return false, "", "", "", fmt.Errorf("not a media message")
+		return false, "", "", "", newAPIError(ErrCodeInvalidRequest, "not a media message")
 	}
 
 	// Create directory for the chat if it doesn't exist
@@ -607,27 +1430,18 @@ func downloadMedia(client *whatsmeow.Client, messageStore *MessageStore, message
 
 	// If we don't have all the media info we need, we can't download
 	if url == "" || len(mediaKey) == 0 || len(fileSHA256) == 0 || len(fileEncSHA256) == 0 || fileLength == 0 {
-		return false, "", "", "", fmt.Errorf("incomplete media information for download")
+		return false, "", "", "", newAPIError(ErrCodeMediaUnavailable, "incomplete media information for download")
 	}
 
-	fmt.Printf("Attempting to download media for message %s in chat %s...\n", messageID, chatJID)
+	bridgeLog.Infof("Attempting to download media for message %s in chat %s...", messageID, chatJID)
 
 	// Extract direct path from URL
 	directPath := extractDirectPathFromURL(url)
 
 	// Create a downloader that implements DownloadableMessage
-	var waMediaType whatsmeow.MediaType
-	switch mediaType {
-	case "image":
-		waMediaType = whatsmeow.MediaImage
-	case "video":
-		waMediaType = whatsmeow.MediaVideo
-	case "audio":
-		waMediaType = whatsmeow.MediaAudio
-	case "document":
-		waMediaType = whatsmeow.MediaDocument
-	default:
-		return false, "", "", "", fmt.Errorf("unsupported media type: %s", mediaType)
+	waMediaType, err := whatsmeowMediaType(mediaType)
+	if err != nil {
+		return false, "", "", "", newAPIError(ErrCodeUnsupportedMedia, "%v", err)
 	}
 
 	downloader := &MediaDownloader{
@@ -640,10 +1454,34 @@ func downloadMedia(client *whatsmeow.Client, messageStore *MessageStore, message
 		MediaType:     waMediaType,
 	}
 
+	// If the sender re-uploaded the media after a retry request, use the refreshed path
+	if retry, err := messageStore.GetMediaRetry(messageID, chatJID); err == nil && retry.Status == mediaRetrySuccess && retry.DirectPath != "" {
+		downloader.URL = ""
+		downloader.DirectPath = retry.DirectPath
+	}
+
 	// Download the media using whatsmeow client
-	mediaData, err := client.Download(context.Background(), downloader)
+	var mediaData []byte
+	err = throttle(opMedia, func() (err error) {
+		ctx, cancel := callContext(ctx, callMedia)
+		defer cancel()
+		mediaData, err = client.Download(ctx, downloader)
+		return err
+	})
 	if err != nil {
-		return false, "", "", "", fmt.Errorf("failed to download media: %v", err)
+		// Expired media can be refreshed by asking the sender's phone to re-upload it
+		if isMediaExpiredError(err) {
+			status, retryErr := requestMediaRetry(ctx, client, messageStore, messageID, chatJID, mediaKey)
+			if retryErr != nil {
+				return false, "", "", "", newAPIError(ErrCodeMediaUnavailable, "media expired and retry request failed: %v", retryErr)
+			}
+			return false, "", "", "", &APIError{
+				Code:    ErrCodeMediaRetryPending,
+				Message: fmt.Sprintf("media for message %s has expired, re-upload requested from sender", messageID),
+				Details: map[string]string{"message_id": messageID, "chat_jid": chatJID, "retry_status": status},
+			}
+		}
+		return false, "", "", "", newCallError(ErrCodeDownloadFailed, err, "failed to download media: %v", err)
 	}
 
 	// Save the downloaded media to file
@@ -651,10 +1489,20 @@ func downloadMedia(client *whatsmeow.Client, messageStore *MessageStore, message
 		return false, "", "", "", fmt.Errorf("failed to save media file: %v", err)
 	}
 
-	fmt.Printf("Successfully downloaded %s media to %s (%d bytes)\n", mediaType, absPath, len(mediaData))
+	bridgeLog.Infof("Successfully downloaded %s media to %s (%d bytes)", mediaType, absPath, len(mediaData))
+	queueOCR(messageStore, messageID, chatJID, mediaType, absPath)
+	queueDocumentText(messageID, chatJID, mediaType, absPath)
+	if mediaType == "document" {
+		goSafe("reading PDF metadata", func() { recordPDFInfo(messageStore, messageID, chatJID, absPath) })
+	}
 	return true, mediaType, filename, absPath, nil
 }
 
+// Get the directory where downloaded media for a chat is stored
+func mediaDirForChat(chatJID string) string {
+	return filepath.Join(storeDir(), strings.ReplaceAll(chatJID, ":", "_"))
+}
+
 // Extract direct path from a WhatsApp media URL
 func extractDirectPathFromURL(url string) string {
 	// The direct path is typically in the URL, we need to extract it
@@ -675,135 +1523,366 @@ func extractDirectPathFromURL(url string) string {
 	return "/" + pathPart
 }
 
-// Start a REST API server to expose the WhatsApp client functionality
-func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port int) {
+// Register the REST handlers for sending messages and downloading their media
+func registerMessageHandlers(client waClient, messageStore *MessageStore) {
+	approval := loadApprovalConfig()
+
 	// Handler for sending messages
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/send",
+		Summary:  "Send a text message or media file to a contact or group; media is given by a server-local media_path, the media_token of an upload or a media_url to download",
+		Tag:      "messages",
+		Scope:    ScopeSendMessages,
+		Audit:    true,
+		Request:  SendMessageRequest{},
+		Response: SendMessageResponse{},
+	})
 	http.HandleFunc("/api/send", func(w http.ResponseWriter, r *http.Request) {
 		// Only allow POST requests
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		if !requireMethod(w, r, http.MethodPost) {
 			return
 		}
 
 		// Parse the request body
 		var req SendMessageRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request format", http.StatusBadRequest)
+		if !decodeJSON(w, r, &req) {
 			return
 		}
 
 		// Validate request
 		if req.Recipient == "" {
-			http.Error(w, "Recipient is required", http.StatusBadRequest)
+			writeError(w, ErrCodeInvalidRequest, "Recipient is required", nil)
+			return
+		}
+
+		mediaPath, err := resolveMediaSource(req.MediaPath, req.MediaToken, req.MediaURL)
+		if err != nil {
+			writeAPIError(w, "", err)
 			return
 		}
+		req.MediaPath = mediaPath
 
 		if req.Message == "" && req.MediaPath == "" {
-			http.Error(w, "Message or media path is required", http.StatusBadRequest)
+			writeError(w, ErrCodeInvalidRequest, "Message or media is required", nil)
 			return
 		}
 
-		fmt.Println("Received request to send message", req.Message, req.MediaPath)
+		bridgeLog.Infof("Received request to send message %s %s", logContent(req.Message), req.MediaPath)
+
+		if req.Template {
+			recipientJID, _, err := resolveRecipient(messageStore, req.Recipient)
+			if err != nil {
+				writeAPIError(w, "", err)
+				return
+			}
+			if req.Message, err = messageStore.renderMessageTemplate(recipientJID, req.Message); err != nil {
+				writeAPIError(w, "", err)
+				return
+			}
+		}
+
+		out, err := prepareWhatsAppMessage(messageStore, req.Recipient, req.Message, req.MediaPath)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		recipient := req.Recipient
+		if out.RecipientName != "" {
+			// Queue the resolved contact, not the name it was given by
+			recipient = fmt.Sprintf("%s (%s)", out.RecipientName, out.Recipient)
+			req.Recipient = out.Recipient.String()
+		}
+
+		// In dry-run mode, validate and prepare everything but stop short of sending
+		if req.DryRun {
+			writeJSON(w, http.StatusOK, SendMessageResponse{
+				Success: true,
+				Message: fmt.Sprintf("Dry run: message to %s was not sent", recipient),
+				DryRun:  true,
+				Preview: out.Preview(),
+			})
+			return
+		}
+
+		// Hold the message in the outbox if a human has to approve it first
+		if approval.requiresApproval(tokenFromContext(r.Context()), out.Recipient) {
+			id, err := queueForApproval(r.Context(), client, messageStore, approval, callerName(r), req)
+			if err != nil {
+				writeAPIError(w, "", err)
+				return
+			}
+			writeJSON(w, http.StatusAccepted, SendMessageResponse{
+				Success:         true,
+				Message:         fmt.Sprintf("Message to %s is pending approval", recipient),
+				PendingApproval: true,
+				OutboxID:        id,
+			})
+			return
+		}
+
+		// Hold the message until the recipient comes online
+		if req.SendWhenOnline {
+			id, err := queueUntilOnline(r.Context(), client, messageStore, callerName(r), out.Recipient, req)
+			if err != nil {
+				writeAPIError(w, "", err)
+				return
+			}
+			writeJSON(w, http.StatusAccepted, SendMessageResponse{
+				Success:       true,
+				Message:       fmt.Sprintf("Message to %s will be sent when they come online", recipient),
+				WaitingOnline: true,
+				OutboxID:      id,
+			})
+			return
+		}
 
 		// Send the message
-		success, message := sendWhatsAppMessage(client, req.Recipient, req.Message, req.MediaPath)
-		fmt.Println("Message sent", success, message)
-		// Set response headers
-		w.Header().Set("Content-Type", "application/json")
-
-		// Set appropriate status code
-		if !success {
-			w.WriteHeader(http.StatusInternalServerError)
+		err = sendPreparedMessage(r.Context(), client, messageStore, out)
+		bridgeLog.Infof("Message sent %t %s", err == nil, recipient)
+		if err != nil && retryEnabled(req.RetryOnFailure) && isConnectionError(client, err) {
+			id, storeErr := messageStore.StoreRetryMessage(callerName(r), req.Recipient, req.Message, req.MediaPath, err.Error())
+			if storeErr == nil {
+				writeJSON(w, http.StatusAccepted, SendMessageResponse{
+					Success:        true,
+					Message:        fmt.Sprintf("Not connected, message to %s will be sent after reconnecting", recipient),
+					QueuedForRetry: true,
+					OutboxID:       id,
+				})
+				return
+			}
+			bridgeLog.Warnf("Failed to queue message for retry: %v", storeErr)
 		}
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		message := fmt.Sprintf("Message sent to %s", recipient)
 
 		// Send response
-		json.NewEncoder(w).Encode(SendMessageResponse{
-			Success: success,
+		writeJSON(w, http.StatusOK, SendMessageResponse{
+			Success: true,
 			Message: message,
 		})
 	})
 
 	// Handler for downloading media
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/download",
+		Summary:  "Download the media of a stored message to the local store",
+		Tag:      "media",
+		Scope:    ScopeReadMessages,
+		Request:  DownloadMediaRequest{},
+		Response: DownloadMediaResponse{},
+	})
 	http.HandleFunc("/api/download", func(w http.ResponseWriter, r *http.Request) {
 		// Only allow POST requests
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		if !requireMethod(w, r, http.MethodPost) {
 			return
 		}
 
 		// Parse the request body
 		var req DownloadMediaRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Invalid request format", http.StatusBadRequest)
+		if !decodeJSON(w, r, &req) {
 			return
 		}
 
 		// Validate request
 		if req.MessageID == "" || req.ChatJID == "" {
-			http.Error(w, "Message ID and Chat JID are required", http.StatusBadRequest)
+			writeError(w, ErrCodeInvalidRequest, "Message ID and Chat JID are required", nil)
 			return
 		}
 
-		// Download the media
-		success, mediaType, filename, path, err := downloadMedia(client, messageStore, req.MessageID, req.ChatJID)
+		if err := checkViewOnceAccess(messageStore, req.MessageID, req.ChatJID, req.AllowViewOnce); err != nil {
+			writeAPIError(w, "Failed to download media", err)
+			return
+		}
 
-		// Set response headers
-		w.Header().Set("Content-Type", "application/json")
+		// Download the media
+		success, mediaType, filename, path, err := downloadMedia(r.Context(), client, messageStore, req.MessageID, req.ChatJID)
 
 		// Handle download result
-		if !success || err != nil {
-			errMsg := "Unknown error"
-			if err != nil {
-				errMsg = err.Error()
-			}
-
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(DownloadMediaResponse{
-				Success: false,
-				Message: fmt.Sprintf("Failed to download media: %s", errMsg),
-			})
+		if err != nil {
+			writeAPIError(w, "Failed to download media", err)
+			return
+		} else if !success {
+			writeError(w, ErrCodeInternal, "Failed to download media: Unknown error", nil)
 			return
 		}
 
 		// Send successful response
-		json.NewEncoder(w).Encode(DownloadMediaResponse{
+		writeJSON(w, http.StatusOK, DownloadMediaResponse{
 			Success:  true,
 			Message:  fmt.Sprintf("Successfully downloaded %s media", mediaType),
 			Filename: filename,
 			Path:     path,
 		})
 	})
+}
+
+// Start a REST API server to expose the WhatsApp client functionality
+func startRESTServer(client *whatsmeow.Client, messageStore *MessageStore, port int) {
+	// Sending messages and downloading media
+	registerMessageHandlers(client, messageStore)
+
+	// Media helpers (re-upload, ...)
+	registerMediaHandlers(client, messageStore)
+
+	// Read endpoints for chats and messages
+	registerQueryHandlers(client, messageStore)
+	registerTranscriptHandlers(messageStore)
+	registerSegmentHandlers(messageStore)
+	registerReplyHandlers(messageStore)
+	registerReminderHandlers(messageStore)
+	registerViewHandlers(messageStore)
+	registerBulkMediaHandlers(client, messageStore)
+	registerExportHandlers(client, messageStore)
+	registerChatHistoryHandlers(client, messageStore)
+	registerEmbeddingsHandlers(messageStore)
+
+	// Admin and maintenance endpoints
+	registerAdminHandlers(messageStore)
+	registerSQLQueryHandlers()
+	registerChatMergeHandlers(messageStore)
+	registerIntegrityHandlers(messageStore)
+	registerLogTailHandlers()
+	registerHistoryLimitHandlers(messageStore)
+	registerOutboxHandlers(client, messageStore)
+	registerWatchHandlers(messageStore)
+	registerRoutingHandlers(messageStore)
+	registerMatrixHandlers(client, messageStore)
+	registerIngestHandlers(messageStore)
+	registerArchiveHandlers(messageStore)
+	registerParticipantHandlers(client, messageStore)
+	registerBootstrapHandlers()
+	registerContactHandlers(client, messageStore)
+	registerContactStatsHandlers(messageStore)
+	registerTemplateHandlers(messageStore)
+	registerDirectoryHandlers(messageStore)
+	registerSearchHandlers(messageStore)
+	registerExtractHandlers(messageStore)
+	registerTaskHandlers(messageStore)
+	registerEntityHandlers(messageStore)
+	registerTranslateHandlers(messageStore)
+	registerContactDateHandlers(messageStore)
+	registerLinkHandlers(messageStore)
+	registerStarHandlers(client, messageStore)
+	registerOCRHandlers(client, messageStore)
+	registerDocumentHandlers(client, messageStore)
+	registerUploadHandlers()
+	registerStickerHandlers(client, messageStore)
+	registerContactCardHandlers(client, messageStore)
+	registerLiveLocationHandlers(client, messageStore)
+	registerGroupEventHandlers(client, messageStore)
+	registerNewsletterHandlers(client, messageStore)
+	registerPinHandlers(client, messageStore)
+	registerInteractiveHandlers(client, messageStore)
+	registerPaymentHandlers(messageStore)
+	registerMentionHandlers(messageStore)
+	registerReceiptHandlers(client, messageStore)
+	registerFreshnessHandlers(messageStore)
+	registerPriorityHandlers(messageStore)
+	registerThrottleHandlers()
+	registerOpsHandlers(messageStore)
+	registerIngestStatsHandlers()
+	registerConfigHandlers()
+	registerBackupHandlers()
+	registerHealthHandlers(client)
+	registerReloginHandlers(client)
+	registerDeviceHandlers(client)
+
+	// Audit log of mutating operations
+	registerAuditHandlers(messageStore)
+
+	// Embedded web UI for browsing stored chats
+	registerWebUIHandlers()
+
+	// API documentation, registered last so it covers every endpoint above
+	registerOpenAPIHandlers()
 
 	// Start the server
 	serverAddr := fmt.Sprintf(":%d", port)
-	fmt.Printf("Starting REST API server on %s...\n", serverAddr)
+	bridgeLog.Infof("Starting REST API server on %s...", serverAddr)
+
+	// Load API tokens, refusing to serve an open API when the configuration is broken
+	tokens, err := loadAPITokens()
+	if err != nil {
+		bridgeLog.Warnf("REST API server not started: %v", err)
+		return
+	}
+
+	// Wrap the routes with the configured middleware
+	mux := http.DefaultServeMux
+	handler := withRecovery(withCORS(loadCORSConfig(), withOperation(mux, withAuth(tokens, withBodyLimit(withAudit(messageStore, mux))))))
 
 	// Run server in a goroutine so it doesn't block
-	go func() {
-		if err := http.ListenAndServe(serverAddr, nil); err != nil {
-			fmt.Printf("REST API server error: %v\n", err)
+	goSafe("serving the REST API", func() {
+		if err := http.ListenAndServe(serverAddr, handler); err != nil {
+			bridgeLog.Warnf("REST API server error: %v", err)
 		}
-	}()
+	})
 }
 
 func main() {
-	// Set up logger
-	logger := waLog.Stdout("Client", "INFO", true)
+	os.Exit(run())
+}
+
+// Run the bridge until it is stopped, returning the exit code
+func run() int {
+	// Load settings, then set up logging as they say
+	if err := loadConfigFile(); err != nil {
+		fmt.Println(err)
+		return exitFatal
+	}
+	daemon := flag.Bool("daemon", envBool("WHATSAPP_DAEMON", false), "Run under a service manager: never wait for a QR scan, notify systemd and exit with distinct codes")
+	pidFile := flag.String("pid-file", envString("WHATSAPP_PID_FILE", ""), "Write the process ID to this file while running")
+	healthcheck := flag.Bool("healthcheck", false, "Check whether a running bridge is ready and exit, for container health checks")
+	trimHistory := flag.Bool("trim-history", false, "Delete stored messages beyond the configured history limits and exit")
+	flag.Parse()
+	if *healthcheck {
+		return runHealthcheck(envInt("WHATSAPP_PORT", 8080))
+	}
+	if *trimHistory {
+		return runTrimHistory()
+	}
+
+	if err := initLogging(); err != nil {
+		fmt.Println(err)
+		return exitFatal
+	}
+	logger := newLogger("Client")
 	logger.Infof("Starting WhatsApp client...")
+	if configPath != "" {
+		logger.Infof("Loaded settings from %s", configPath)
+	}
+	if *pidFile != "" {
+		*pidFile = dataPath(*pidFile)
+		if err := writePIDFile(*pidFile); err != nil {
+			logger.Errorf("Failed to write PID file: %v", err)
+			return exitFatal
+		}
+		defer removePIDFile(*pidFile)
+	}
 
 	// Create database connection for storing session data
-	dbLog := waLog.Stdout("Database", "INFO", true)
+	dbLog := newLogger("Database")
 
 	// Create directory for database if it doesn't exist
-	if err := os.MkdirAll("store", 0755); err != nil {
+	if err := os.MkdirAll(storeDir(), 0755); err != nil {
 		logger.Errorf("Failed to create store directory: %v", err)
-		return
+		return exitFatal
 	}
 
-	container, err := sqlstore.New(context.Background(), "sqlite3", "file:store/whatsapp.db?_foreign_keys=on", dbLog)
+	dialect, address, err := sessionDatabase()
+	if err != nil {
+		logger.Errorf("Invalid session database: %v", err)
+		return exitFatal
+	}
+	container, err := sqlstore.New(context.Background(), dialect, address, dbLog)
 	if err != nil {
 		logger.Errorf("Failed to connect to database: %v", err)
-		return
+		return exitFatal
 	}
 
 	// Get device store - This contains session information
@@ -815,55 +1894,153 @@ func main() {
 			logger.Infof("Created new device")
 		} else {
 			logger.Errorf("Failed to get device: %v", err)
-			return
+			return exitFatal
 		}
 	}
 
-	// Create client instance
+	// Create client instance, asking for no more history than configured on pairing
+	applyHistorySyncConfig(configuredHistoryLimits())
 	client := whatsmeow.NewClient(deviceStore, logger)
 	if client == nil {
 		logger.Errorf("Failed to create WhatsApp client")
-		return
+		return exitFatal
 	}
 
 	// Initialize message store
 	messageStore, err := NewMessageStore()
 	if err != nil {
 		logger.Errorf("Failed to initialize message store: %v", err)
-		return
+		return exitFatal
 	}
 	defer messageStore.Close()
 
+	// Start the workers writing history syncs to the message store
+	historyQueue = startHistorySyncWorkers(client, messageStore, logger, envInt("WHATSAPP_HISTORY_WORKERS", 2))
+
+	// Register the commands available in the self-chat
+	registerSelfCommands()
+	registerOutboxCommands()
+
 	// Setup event handling for messages and history sync
 	client.AddEventHandler(func(evt interface{}) {
+		// A bad event is logged and skipped, the next ones are handled as usual
+		defer recoverPanic("handling %T event", evt)
+
+		// Any event shows the session is alive
+		watchdog.seen()
+
 		switch v := evt.(type) {
 		case *events.Message:
 			// Process regular messages
 			handleMessage(client, messageStore, v, logger)
 
 		case *events.HistorySync:
-			// Process history sync events
-			handleHistorySync(client, messageStore, v, logger)
+			// Process history sync events in the background, they can take minutes
+			historyQueue.enqueue(v)
+
+		case *events.MediaRetry:
+			// Process re-uploads of expired media requested by downloadMedia
+			handleMediaRetry(client, messageStore, v, logger)
+
+		case *events.Contact:
+			// Keep contact names up to date as they change
+			handleContactChange(client, messageStore, v.JID)
+
+		case *events.PushName:
+			handleContactChange(client, messageStore, v.JID)
+
+		case *events.BusinessName:
+			handleContactChange(client, messageStore, v.JID)
+
+		case *events.Receipt:
+			// Track who received and read our messages
+			handleReceipt(client, messageStore, v)
+			handleOwnReadReceipt(messageStore, v)
+
+		case *events.MarkChatAsRead:
+			// Keep unread counts in sync with the phone
+			handleMarkChatAsRead(messageStore, v)
+
+		case *events.Star:
+			// Keep stars set on the phone in sync
+			handleStarEvent(messageStore, v)
 
 		case *events.Connected:
 			logger.Infof("Connected to WhatsApp")
+			watchdog.setStatus(healthOK)
+			sdNotify("STATUS=Connected to WhatsApp")
+			// Contacts and groups of an account paired again are synced from scratch
+			if watchdog.authenticated() {
+				startBootstrap(client, messageStore)
+			}
+			// Presence subscriptions don't survive reconnects
+			goSafe("resubscribing to presence", func() {
+				applyPresenceMode(client)
+				subscribeWaitingRecipients(client, messageStore)
+			})
+			// Send what failed while we were disconnected
+			goSafe("retrying failed sends", func() { retryFailedSends(context.Background(), client, messageStore) })
+
+		case *events.Presence:
+			// Deliver messages waiting for the recipient to come online
+			handlePresence(client, messageStore, v)
+
+		case *events.Disconnected:
+			watchdog.setStatus(healthDisconnected)
+			sdNotify("STATUS=Disconnected from WhatsApp, reconnecting")
 
 		case *events.LoggedOut:
-			logger.Warnf("Device logged out, please scan QR code to log in again")
+			// Stay up so the bridge can be paired again through the REST API
+			watchdog.setStatus(healthDisconnected)
+			handleLoggedOut(v)
 		}
 	})
 
+	// Start REST API server right away, endpoints needing the connection report
+	// not_connected until it is up
+	startRESTServer(client, messageStore, envInt("WHATSAPP_PORT", 8080))
+	startIMAPServer(client, messageStore)
+
+	// Take scheduled backups, which don't need the connection either
+	goSafe("running the backup scheduler", runBackupScheduler)
+
+	// Embed new messages for semantic search if an embeddings endpoint is set
+	goSafe("embedding messages", func() { runEmbeddingsWorker(messageStore) })
+
+	// Recognize the text in downloaded images if an OCR engine is set
+	goSafe("recognizing text in images", func() { runOCRWorker(messageStore) })
+
+	// Extract the text of downloaded documents if enabled
+	goSafe("extracting text of documents", func() { runDocumentWorker(messageStore) })
+
+	// Detect the language of messages stored before it was detected on ingestion
+	goSafe("detecting the language of stored messages", func() {
+		if err := messageStore.BackfillLanguages(); err != nil {
+			bridgeLog.Warnf("Failed to detect the language of stored messages: %v", err)
+		}
+	})
+
+	// Split long chats into topic segments in the background
+	goSafe("segmenting chats", func() { runSegmentAnalyzer(messageStore) })
+	goSafe("announcing reminders", func() { runReminderWorker(client, messageStore) })
+	goSafe("announcing contact dates", func() { runContactDateWorker(client, messageStore) })
+	goSafe("cleaning up uploads", func() { runUploadCleanup(messageStore) })
+
 	// Create channel to track connection success
 	connected := make(chan bool, 1)
 
 	// Connect to WhatsApp
-	if client.Store.ID == nil {
+	if client.Store.ID == nil && *daemon {
+		logger.Errorf("Not paired with a phone, run the bridge without --daemon once to scan the QR code")
+		sdNotify("STATUS=Not paired, a QR code scan is required")
+		return exitAuthRequired
+	} else if client.Store.ID == nil {
 		// No ID stored, this is a new client, need to pair with phone
 		qrChan, _ := client.GetQRChannel(context.Background())
 		err = client.Connect()
 		if err != nil {
 			logger.Errorf("Failed to connect: %v", err)
-			return
+			return exitFatal
 		}
 
 		// Print QR code for pairing with phone
@@ -883,14 +2060,14 @@ func main() {
 			fmt.Println("\nSuccessfully connected and authenticated!")
 		case <-time.After(3 * time.Minute):
 			logger.Errorf("Timeout waiting for QR code scan")
-			return
+			return exitAuthRequired
 		}
 	} else {
 		// Already logged in, just connect
 		err = client.Connect()
 		if err != nil {
 			logger.Errorf("Failed to connect: %v", err)
-			return
+			return exitFatal
 		}
 		connected <- true
 	}
@@ -900,13 +2077,19 @@ func main() {
 
 	if !client.IsConnected() {
 		logger.Errorf("Failed to establish stable connection")
-		return
+		return exitFatal
 	}
 
 	fmt.Println("\n✓ Connected to WhatsApp! Type 'help' for commands.")
+	sdNotify("READY=1\nSTATUS=Connected to WhatsApp")
+	goSafe("feeding the systemd watchdog", runSystemdWatchdog)
 
-	// Start REST API server
-	startRESTServer(client, messageStore, 8080)
+	// Sync contacts, LIDs and group participants in the background, this can take
+	// minutes for large accounts
+	startBootstrap(client, messageStore)
+	goSafe("sending messages whose wait ran out", func() { runPresenceFallback(client, messageStore) })
+	goSafe("checking the WhatsApp session", func() { runWatchdog(client) })
+	goSafe("reconciling interrupted operations", func() { reconcileOps(client, messageStore) })
 
 	// Create a channel to keep the main goroutine alive
 	exitChan := make(chan os.Signal, 1)
@@ -918,12 +2101,19 @@ func main() {
 	<-exitChan
 
 	fmt.Println("Disconnecting...")
+	sdNotify("STOPPING=1")
 	// Disconnect client
 	client.Disconnect()
+	return exitOK
 }
 
 // GetChatName determines the appropriate name for a chat based on JID and other info
 func GetChatName(client *whatsmeow.Client, messageStore *MessageStore, jid types.JID, chatJID string, conversation interface{}, sender string, logger waLog.Logger) string {
+	// Names set locally win over everything WhatsApp knows
+	if override := messageStore.GetNameOverride(chatJID); override != "" {
+		return override
+	}
+
 	// First, check if chat already exists in database with a name
 	var existingName string
 	err := messageStore.db.QueryRow("SELECT name FROM chats WHERE jid = ?", chatJID).Scan(&existingName)
@@ -973,7 +2163,13 @@ func GetChatName(client *whatsmeow.Client, messageStore *MessageStore, jid types
 
 		// If we didn't get a name, try group info
 		if name == "" {
-			groupInfo, err := client.GetGroupInfo(context.Background(), jid)
+			var groupInfo *types.GroupInfo
+			err := throttle(opQuery, func() (err error) {
+				ctx, cancel := callContext(context.Background(), callQuery)
+				defer cancel()
+				groupInfo, err = client.GetGroupInfo(ctx, jid)
+				return err
+			})
 			if err == nil && groupInfo.Name != "" {
 				name = groupInfo.Name
 			} else {
@@ -1007,8 +2203,15 @@ func GetChatName(client *whatsmeow.Client, messageStore *MessageStore, jid types
 
 // Handle history sync events
 func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, historySync *events.HistorySync, logger waLog.Logger) {
-	fmt.Printf("Received history sync event with %d conversations\n", len(historySync.Data.Conversations))
+	bridgeLog.Infof("Received history sync event with %d conversations", len(historySync.Data.Conversations))
 
+	// History asked for on demand is kept whatever the limits on synced history
+	onDemand := historySync.Data.GetSyncType() == waProto.HistorySync_ON_DEMAND
+	limits := configuredHistoryLimits()
+	if onDemand {
+		limits = HistoryLimits{}
+	}
+	cutoff := limits.cutoff(time.Now())
 	syncedCount := 0
 	for _, conversation := range historySync.Data.Conversations {
 		// Parse JID from the conversation
@@ -1025,11 +2228,16 @@ func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 			continue
 		}
 
+		if isIngestExcluded(jid) || limits.skipsChat(jid) {
+			continue
+		}
+
 		// Get appropriate chat name by passing the history sync conversation directly
 		name := GetChatName(client, messageStore, jid, chatJID, conversation, "", logger)
 
 		// Process messages
 		messages := conversation.Messages
+		var stored []Message
 		if len(messages) > 0 {
 			// Update chat with latest message timestamp
 			latestMsg := messages[0]
@@ -1044,24 +2252,25 @@ func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 			} else {
 				continue
 			}
+			// Nothing of the chat is recent enough to keep
+			if timestamp.Before(cutoff) {
+				continue
+			}
 
 			messageStore.StoreChat(chatJID, name, timestamp)
+			room := messageStore.historyRoom(chatJID, limits)
 
 			// Store messages
 			for _, msg := range messages {
+				if room == 0 {
+					break
+				}
 				if msg == nil || msg.Message == nil {
 					continue
 				}
 
 				// Extract text content
-				var content string
-				if msg.Message.Message != nil {
-					if conv := msg.Message.Message.GetConversation(); conv != "" {
-						content = conv
-					} else if ext := msg.Message.Message.GetExtendedTextMessage(); ext != nil {
-						content = ext.GetText()
-					}
-				}
+				content := extractTextContent(msg.Message.Message)
 
 				// Extract media info
 				var mediaType, filename, url string
@@ -1071,9 +2280,19 @@ func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 				if msg.Message.Message != nil {
 					mediaType, filename, url, mediaKey, fileSHA256, fileEncSHA256, fileLength = extractMediaInfo(msg.Message.Message)
 				}
+				payment := extractPayment(msg.Message.GetMessage(), msg.Message.GetPaymentInfo())
+				if payment != nil {
+					content, mediaType = payment.Summary(), mediaTypePayment
+				}
+				event := extractGroupEvent(msg.Message.GetMessage())
+				if event != nil {
+					content, mediaType = event.Summary(), mediaTypeEvent
+				}
 
 				// Log the message content for debugging
-				logger.Infof("Message content: %v, Media Type: %v", content, mediaType)
+				logger.Debugf("Message content: %v, Media Type: %v", logContent(content), mediaType)
+
+				handleSharedContacts(messageStore, msg.Message.GetMessage(), msg.Message.GetKey().GetID(), chatJID)
 
 				// Skip messages with no content and no media
 				if content == "" && mediaType == "" {
@@ -1111,8 +2330,12 @@ func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 				} else {
 					continue
 				}
+				if timestamp.Before(cutoff) {
+					continue
+				}
 
 				err = messageStore.StoreMessage(
+					sourceHistory,
 					msgID,
 					chatJID,
 					sender,
@@ -1131,56 +2354,80 @@ func handleHistorySync(client *whatsmeow.Client, messageStore *MessageStore, his
 					logger.Warnf("Failed to store history message: %v", err)
 				} else {
 					syncedCount++
+					room--
+					stored = append(stored, Message{ID: msgID, ChatJID: chatJID, Time: timestamp, IsFromMe: isFromMe, MediaType: mediaType, Filename: filename})
+					handleInteractiveResponse(messageStore, msgID, chatJID, msg.Message.GetMessage())
+					handlePayment(messageStore, msgID, chatJID, timestamp, payment)
+					if event != nil {
+						handleGroupEvent(messageStore, msgID, chatJID, eventResponder(client, msg.Message.GetKey(), jid), timestamp, event)
+						handleHistoryEventResponses(client, messageStore, msg.Message, jid)
+					}
+					handleDocumentInfo(messageStore, msg.Message.GetMessage().GetDocumentMessage(), msgID, chatJID)
+					if content != "" {
+						preview := msg.Message.GetMessage().GetExtendedTextMessage()
+						textMsg := Message{ID: msgID, ChatJID: chatJID, Sender: sender, Content: content, Time: timestamp, IsFromMe: isFromMe}
+						handleLinks(messageStore, textMsg, preview.GetMatchedText(), preview.GetTitle(), false)
+						handleEntityExtraction(messageStore, textMsg)
+						senderJID := jid
+						if strings.Contains(sender, "@") {
+							senderJID, _ = types.ParseJID(sender)
+						}
+						handleContactDates(messageStore, textMsg, senderJID.ToNonAD(), jid.Server == types.GroupServer)
+					}
 					// Log successful message storage
 					if mediaType != "" {
 						logger.Infof("Stored message: [%s] %s -> %s: [%s: %s] %s",
-							timestamp.Format("2006-01-02 15:04:05"), sender, chatJID, mediaType, filename, content)
+							timestamp.Format("2006-01-02 15:04:05"), sender, chatJID, mediaType, filename, logContent(content))
 					} else {
 						logger.Infof("Stored message: [%s] %s -> %s: %s",
-							timestamp.Format("2006-01-02 15:04:05"), sender, chatJID, content)
+							timestamp.Format("2006-01-02 15:04:05"), sender, chatJID, logContent(content))
 					}
 				}
 			}
 		}
+		if onDemand {
+			deliverChatHistory(chatJID, stored)
+		} else if conversation.UnreadCount != nil {
+			// The phone knows how much of the chat was read
+			if err := messageStore.SetChatUnreadCount(chatJID, int(conversation.GetUnreadCount())); err != nil {
+				logger.Warnf("Failed to store unread count of %s: %v", chatJID, err)
+			}
+		}
 	}
 
-	fmt.Printf("History sync complete. Stored %d messages.\n", syncedCount)
+	bridgeLog.Infof("History sync complete. Stored %d messages.", syncedCount)
 }
 
-// Request history sync from the server
-func requestHistorySync(client *whatsmeow.Client) {
-	if client == nil {
-		fmt.Println("Client is not initialized. Cannot request history sync.")
-		return
-	}
-
-	if !client.IsConnected() {
-		fmt.Println("Client is not connected. Please ensure you are connected to WhatsApp first.")
-		return
+// Ask the phone for up to count messages of a chat older than the oldest one
+// stored; they arrive as an on-demand history sync
+func requestHistorySync(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, chat types.JID, count int) error {
+	if client == nil || !client.IsConnected() || client.Store.ID == nil {
+		return newAPIError(ErrCodeNotConnected, "Not connected to WhatsApp")
 	}
 
-	if client.Store.ID == nil {
-		fmt.Println("Client is not logged in. Please scan the QR code first.")
-		return
+	var oldest types.MessageInfo
+	err := messageStore.db.QueryRow(
+		"SELECT id, is_from_me, timestamp FROM messages WHERE chat_jid = ? ORDER BY timestamp ASC, rowid ASC LIMIT 1", chat.String(),
+	).Scan(&oldest.ID, &oldest.IsFromMe, &oldest.Timestamp)
+	if err == sql.ErrNoRows {
+		return newAPIError(ErrCodeNotFound, "no stored messages of %s to continue the history from", chat)
+	} else if err != nil {
+		return err
 	}
-
-	// Build and send a history sync request
-	historyMsg := client.BuildHistorySyncRequest(nil, 100)
-	if historyMsg == nil {
-		fmt.Println("Failed to build history sync request.")
-		return
-	}
-
-	_, err := client.SendMessage(context.Background(), types.JID{
-		Server: "s.whatsapp.net",
-		User:   "status",
-	}, historyMsg)
-
+	oldest.Chat = chat
+
+	historyMsg := client.BuildHistorySyncRequest(&oldest, count)
+	err = throttle(opSend, func() error {
+		ctx, cancel := callContext(ctx, callSend)
+		defer cancel()
+		_, err := client.SendMessage(ctx, client.Store.ID.ToNonAD(), historyMsg, whatsmeow.SendRequestExtra{Peer: true})
+		return err
+	})
 	if err != nil {
-		fmt.Printf("Failed to request history sync: %v\n", err)
-	} else {
-		fmt.Println("History sync requested. Waiting for server response...")
+		return newAPIError(ErrCodeSendFailed, "failed to request history: %v", err)
 	}
+	bridgeLog.Infof("Requested %d messages of %s older than %s", count, chat, oldest.Timestamp.Format(time.RFC3339))
+	return nil
 }
 
 // analyzeOggOpus tries to extract duration and generate a simple waveform from an Ogg Opus file
@@ -1242,7 +2489,7 @@ func analyzeOggOpus(data []byte) (duration uint32, waveform []byte, err error) {
 					preSkip = binary.LittleEndian.Uint16(pageData[headPos+10 : headPos+12])
 					sampleRate = binary.LittleEndian.Uint32(pageData[headPos+12 : headPos+16])
 					foundOpusHead = true
-					fmt.Printf("Found OpusHead: sampleRate=%d, preSkip=%d\n", sampleRate, preSkip)
+					bridgeLog.Debugf("Found OpusHead: sampleRate=%d, preSkip=%d", sampleRate, preSkip)
 				}
 			}
 		}
@@ -1257,7 +2504,7 @@ func analyzeOggOpus(data []byte) (duration uint32, waveform []byte, err error) {
 	}
 
 	if !foundOpusHead {
-		fmt.Println("Warning: OpusHead not found, using default values")
+		bridgeLog.Warnf("OpusHead not found, using default values")
 	}
 
 	// Calculate duration based on granule position
@@ -1265,11 +2512,11 @@ func analyzeOggOpus(data []byte) (duration uint32, waveform []byte, err error) {
 		// Formula for duration: (lastGranule - preSkip) / sampleRate
 		durationSeconds := float64(lastGranule-uint64(preSkip)) / float64(sampleRate)
 		duration = uint32(math.Ceil(durationSeconds))
-		fmt.Printf("Calculated Opus duration from granule: %f seconds (lastGranule=%d)\n",
+		bridgeLog.Debugf("Calculated Opus duration from granule: %f seconds (lastGranule=%d)",
 			durationSeconds, lastGranule)
 	} else {
 		// Fallback to rough estimation if granule position not found
-		fmt.Println("Warning: No valid granule position found, using estimation")
+		bridgeLog.Warnf("No valid granule position found, using estimation")
 		durationEstimate := float64(len(data)) / 2000.0 // Very rough approximation
 		duration = uint32(durationEstimate)
 	}
@@ -1284,7 +2531,7 @@ func analyzeOggOpus(data []byte) (duration uint32, waveform []byte, err error) {
 	// Generate waveform
 	waveform = placeholderWaveform(duration)
 
-	fmt.Printf("Ogg Opus analysis: size=%d bytes, calculated duration=%d sec, waveform=%d bytes\n",
+	bridgeLog.Debugf("Ogg Opus analysis: size=%d bytes, calculated duration=%d sec, waveform=%d bytes",
 		len(data), duration, len(waveform))
 
 	return duration, waveform, nil
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Key of the WhatsApp details added to the content of Matrix events, namespaced
+// as the spec asks for custom fields
+const matrixSourceKey = "io.github.jacopone.whatsapp_mcp.source"
+
+// MatrixEvent is a WhatsApp message or sender as a Matrix client event
+type MatrixEvent struct {
+	Type           string                 `json:"type"`
+	EventID        string                 `json:"event_id"`
+	RoomID         string                 `json:"room_id"`
+	Sender         string                 `json:"sender"`
+	OriginServerTS int64                  `json:"origin_server_ts"`
+	StateKey       *string                `json:"state_key,omitempty"`
+	Content        map[string]interface{} `json:"content"`
+}
+
+// MatrixTransaction is the body a homeserver PUTs to an application service
+type MatrixTransaction struct {
+	Events []MatrixEvent `json:"events"`
+}
+
+// Server name Matrix IDs are made in, WHATSAPP_MATRIX_DOMAIN. Matrix output
+// is off without it.
+func matrixDomain() string {
+	return envString("WHATSAPP_MATRIX_DOMAIN", "")
+}
+
+// Get the Matrix localpart of a WhatsApp user or chat, made of the characters
+// localparts allow
+func matrixLocalpart(user string) string {
+	localpart := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || strings.ContainsRune("._=-", r) {
+			return r
+		}
+		return '_'
+	}, strings.ToLower(user))
+	return envString("WHATSAPP_MATRIX_USER_PREFIX", "whatsapp_") + localpart
+}
+
+// Get the Matrix user of the sender of a message, as a bridge would puppet it
+func matrixUserID(msg Message, ownUser string) string {
+	user := msg.SenderID
+	if user == "" {
+		user = msg.Sender
+	}
+	if msg.IsFromMe && ownUser != "" {
+		user = ownUser
+	}
+	return "@" + matrixLocalpart(user) + ":" + matrixDomain()
+}
+
+// Get the Matrix room of a chat. Room IDs are opaque, so the bridge on the
+// other end maps them to its rooms.
+func matrixRoomID(chatJID string) string {
+	return "!" + matrixLocalpart(strings.SplitN(chatJID, "@", 2)[0]) + ":" + matrixDomain()
+}
+
+// Make a stable event ID, so a message sent twice is the same event
+func matrixEventID(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "/")))
+	return "$" + base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Convert messages of a chat to Matrix events. The first message of each
+// sender not in members is preceded by a member event giving their name.
+func matrixEvents(messages []Message, names *senderNames, ownUser string, members map[string]bool) []MatrixEvent {
+	events := make([]MatrixEvent, 0, len(messages))
+	for _, msg := range messages {
+		roomID := matrixRoomID(msg.ChatJID)
+		sender := matrixUserID(msg, ownUser)
+		ts := msg.Time.UnixMilli()
+
+		if key := roomID + " " + sender; !members[key] {
+			members[key] = true
+			stateKey := sender
+			events = append(events, MatrixEvent{
+				Type:           "m.room.member",
+				EventID:        matrixEventID(roomID, sender),
+				RoomID:         roomID,
+				Sender:         sender,
+				OriginServerTS: ts,
+				StateKey:       &stateKey,
+				Content:        map[string]interface{}{"membership": "join", "displayname": names.name(msg)},
+			})
+		}
+
+		// Media goes as its label, uploading it needs the content repository of the homeserver
+		msgtype := "m.text"
+		if msg.MediaType != "" {
+			msgtype = "m.notice"
+		}
+		events = append(events, MatrixEvent{
+			Type:           "m.room.message",
+			EventID:        matrixEventID(msg.ChatJID, msg.ID),
+			RoomID:         roomID,
+			Sender:         sender,
+			OriginServerTS: ts,
+			Content: map[string]interface{}{
+				"msgtype": msgtype,
+				"body":    relayText(msg),
+				matrixSourceKey: map[string]interface{}{
+					"chat_jid":   msg.ChatJID,
+					"message_id": msg.ID,
+					"sender":     msg.Sender,
+					"media_type": msg.MediaType,
+				},
+			},
+		})
+	}
+	return events
+}
+
+// Senders the relay worker told the Matrix side about, by room
+var matrixRelayMembers = map[string]bool{}
+
+// Transactions are numbered from the start of the process, so their IDs
+// never repeat and a retried transaction keeps its ID
+var (
+	matrixTxnStart = time.Now().UnixMilli()
+	matrixTxnSeq   atomic.Int64
+)
+
+// PUT a message to an application service as a homeserver would, signed
+// with WHATSAPP_MATRIX_HS_TOKEN. Only the relay worker calls this.
+func relayMatrix(baseURL string, names *senderNames, msg Message, ownUser string) error {
+	body, err := json.Marshal(MatrixTransaction{Events: matrixEvents([]Message{msg}, names, ownUser, matrixRelayMembers)})
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/_matrix/app/v1/transactions/wa-%d-%d", strings.TrimSuffix(baseURL, "/"), matrixTxnStart, matrixTxnSeq.Add(1))
+	token := envString("WHATSAPP_MATRIX_HS_TOKEN", "")
+	return postRelay(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+			if token != "" {
+				req.Header.Set("Authorization", "Bearer "+token)
+			}
+		}
+		return req, err
+	})
+}
+
+// MatrixEventsResponse represents the response for the Matrix export API. Its
+// events can be replayed to an application service as a transaction.
+type MatrixEventsResponse struct {
+	Success bool   `json:"success"`
+	ChatJID string `json:"chat_jid"`
+	RoomID  string `json:"room_id"`
+	MatrixTransaction
+}
+
+// Register the REST handler exporting chats as Matrix events
+func registerMatrixHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/chats/{jid}/matrix",
+		Summary: "Export the messages of a chat as Matrix events, oldest first, in the transaction format homeservers send to application services",
+		Tag:     "chats",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "jid", In: "path", Description: "Chat JID", Required: true},
+			{Name: "after_time", Description: "Only messages after this time" + timeFormatsHint},
+			{Name: "before_time", Description: "Only messages before this time" + timeFormatsHint},
+			{Name: "limit", Description: "Maximum number of messages, the most recent ones", Type: "integer"},
+			{Name: "offset", Description: "Number of most recent messages to skip", Type: "integer"},
+		},
+		Response: MatrixEventsResponse{},
+	})
+	http.HandleFunc("GET /api/chats/{jid}/matrix", func(w http.ResponseWriter, r *http.Request) {
+		if matrixDomain() == "" {
+			writeError(w, ErrCodeInvalidRequest, "Matrix output needs the server name of the homeserver, set WHATSAPP_MATRIX_DOMAIN", nil)
+			return
+		}
+		f, err := parseMessageFilter(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		f.ChatJID = r.PathValue("jid")
+		if f.Revoked == "" {
+			f.Revoked = revokedExclude
+		}
+		messages, err := messageStore.QueryMessages(f)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to load messages: %v", err), nil)
+			return
+		}
+		slices.Reverse(messages)
+
+		ownUser := ""
+		if client.Store.ID != nil {
+			ownUser = client.Store.ID.User
+		}
+		names := &senderNames{store: messageStore, names: map[string]string{}}
+		writeJSON(w, http.StatusOK, MatrixEventsResponse{
+			Success:           true,
+			ChatJID:           f.ChatJID,
+			RoomID:            matrixRoomID(f.ChatJID),
+			MatrixTransaction: MatrixTransaction{Events: matrixEvents(messages, names, ownUser, map[string]bool{})},
+		})
+	})
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelayToMatrix(t *testing.T) {
+	t.Setenv("WHATSAPP_MATRIX_DOMAIN", "example.org")
+	t.Setenv("WHATSAPP_MATRIX_HS_TOKEN", "hs-secret")
+
+	type transaction struct {
+		path, auth string
+		body       MatrixTransaction
+	}
+	received := make(chan transaction, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		txn := transaction{path: r.Method + " " + r.URL.Path, auth: r.Header.Get("Authorization")}
+		json.NewDecoder(r.Body).Decode(&txn.body)
+		received <- txn
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	chat := "120363000000000301@g.us"
+	if _, err := (NotificationRouteRequest{Target: routeMatrix, WebhookURL: server.URL}).toRoute(chat); err != nil {
+		t.Fatal(err)
+	}
+	setRoutes(t, &NotificationRoute{ChatJID: chat, Target: routeMatrix, WebhookURL: server.URL + "/"})
+	sent := time.Date(2026, 3, 1, 10, 0, 0, 0, time.UTC)
+	routeMessage(nil, testStore, Message{ID: "MX1", ChatJID: chat, Sender: "15551310001", Content: "hello", Time: sent}, "Family")
+	routeMessage(nil, testStore, Message{ID: "MX2", ChatJID: chat, Sender: "15551310001", Content: "look", MediaType: "image", Filename: "cat.jpg", Time: sent}, "Family")
+
+	var txns []transaction
+	for len(txns) < 2 {
+		select {
+		case txn := <-received:
+			txns = append(txns, txn)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Application service got %d of 2 transactions", len(txns))
+		}
+	}
+	if !strings.HasPrefix(txns[0].path, "PUT /_matrix/app/v1/transactions/") || txns[0].path == txns[1].path {
+		t.Errorf("Transactions went to %q and %q, want distinct transaction IDs", txns[0].path, txns[1].path)
+	}
+	if txns[0].auth != "Bearer hs-secret" {
+		t.Errorf("Authorization %q", txns[0].auth)
+	}
+
+	first := txns[0].body.Events
+	if len(first) != 2 || first[0].Type != "m.room.member" || first[1].Type != "m.room.message" {
+		t.Fatalf("First transaction %+v, want a member then a message event", first)
+	}
+	sender := "@whatsapp_15551310001:example.org"
+	if first[0].StateKey == nil || *first[0].StateKey != sender || first[0].Content["displayname"] != "15551310001" {
+		t.Errorf("Member event %+v", first[0])
+	}
+	msg := first[1]
+	if msg.Sender != sender || msg.RoomID != "!whatsapp_120363000000000301:example.org" || msg.OriginServerTS != sent.UnixMilli() || msg.Content["body"] != "hello" {
+		t.Errorf("Message event %+v", msg)
+	}
+	if source, _ := msg.Content[matrixSourceKey].(map[string]interface{}); source["message_id"] != "MX1" || source["chat_jid"] != chat {
+		t.Errorf("Message event doesn't carry its WhatsApp source: %v", msg.Content)
+	}
+
+	second := txns[1].body.Events
+	if len(second) != 1 || second[0].Content["msgtype"] != "m.notice" || second[0].Content["body"] != "[image: cat.jpg] look" {
+		t.Errorf("Second transaction %+v, want only the media label", second)
+	}
+}
+
+func TestMatrixRouteNeedsDomain(t *testing.T) {
+	t.Setenv("WHATSAPP_MATRIX_DOMAIN", "")
+	if _, err := (NotificationRouteRequest{Target: routeMatrix, WebhookURL: "http://localhost:29318"}).toRoute("*"); err == nil {
+		t.Error("Matrix route was accepted without WHATSAPP_MATRIX_DOMAIN")
+	}
+}
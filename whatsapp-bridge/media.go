@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/proto/waMmsRetry"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// Media retry statuses stored in the media_retries table
+const (
+	mediaRetryRequested = "requested"
+	mediaRetrySuccess   = "success"
+	mediaRetryNotFound  = "not_found"
+	mediaRetryFailed    = "failed"
+)
+
+// How long to wait for the sender's phone before sending another retry request
+const mediaRetryResendAfter = 2 * time.Minute
+
+// whatsmeowMediaType maps the media type stored in the database to the whatsmeow media type
+func whatsmeowMediaType(mediaType string) (whatsmeow.MediaType, error) {
+	switch mediaType {
+	case "image":
+		return whatsmeow.MediaImage, nil
+	case "video":
+		return whatsmeow.MediaVideo, nil
+	case "audio":
+		return whatsmeow.MediaAudio, nil
+	case "document":
+		return whatsmeow.MediaDocument, nil
+	default:
+		return "", fmt.Errorf("unsupported media type: %s", mediaType)
+	}
+}
+
+// ReuploadMediaRequest represents the request body for the media re-upload API
+type ReuploadMediaRequest struct {
+	MessageID     string `json:"message_id"`
+	ChatJID       string `json:"chat_jid"`
+	AllowViewOnce bool   `json:"allow_view_once,omitempty"` // Required to re-upload view-once media
+}
+
+// ReuploadMediaResponse represents the response for the media re-upload API
+type ReuploadMediaResponse struct {
+	Success       bool   `json:"success"`
+	Message       string `json:"message"`
+	MediaType     string `json:"media_type,omitempty"`
+	Filename      string `json:"filename,omitempty"`
+	URL           string `json:"url,omitempty"`
+	DirectPath    string `json:"direct_path,omitempty"`
+	MediaKey      []byte `json:"media_key,omitempty"`
+	FileSHA256    []byte `json:"file_sha256,omitempty"`
+	FileEncSHA256 []byte `json:"file_enc_sha256,omitempty"`
+	FileLength    uint64 `json:"file_length,omitempty"`
+}
+
+// Re-upload the media of a stored message so it can be forwarded with fresh URL/keys.
+// The stored media info is left untouched since the original keys are still needed
+// to decrypt the message's own media (e.g. for media retry requests).
+func reuploadMedia(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, messageID, chatJID string) (*ReuploadMediaResponse, error) {
+	if !client.IsConnected() {
+		return nil, newAPIError(ErrCodeNotConnected, "not connected to WhatsApp")
+	}
+
+	// Make sure we have a local copy of the media, downloading it if needed
+	success, mediaType, filename, path, err := downloadMedia(ctx, client, messageStore, messageID, chatJID)
+	if err != nil {
+		return nil, err
+	}
+	if !success {
+		return nil, newAPIError(ErrCodeMediaUnavailable, "failed to obtain original media")
+	}
+
+	waMediaType, err := whatsmeowMediaType(mediaType)
+	if err != nil {
+		return nil, newAPIError(ErrCodeUnsupportedMedia, "%v", err)
+	}
+
+	mediaData, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read media file: %v", err)
+	}
+
+	var resp whatsmeow.UploadResponse
+	err = throttle(opMedia, func() (err error) {
+		ctx, cancel := callContext(ctx, callMedia)
+		defer cancel()
+		resp, err = client.Upload(ctx, mediaData, waMediaType)
+		return err
+	})
+	if err != nil {
+		return nil, newCallError(ErrCodeUploadFailed, err, "failed to upload media: %v", err)
+	}
+
+	bridgeLog.Infof("Re-uploaded %s media for message %s in chat %s (%d bytes)", mediaType, messageID, chatJID, len(mediaData))
+
+	return &ReuploadMediaResponse{
+		Success:       true,
+		Message:       fmt.Sprintf("Successfully re-uploaded %s media", mediaType),
+		MediaType:     mediaType,
+		Filename:      filename,
+		URL:           resp.URL,
+		DirectPath:    resp.DirectPath,
+		MediaKey:      resp.MediaKey,
+		FileSHA256:    resp.FileSHA256,
+		FileEncSHA256: resp.FileEncSHA256,
+		FileLength:    resp.FileLength,
+	}, nil
+}
+
+// MediaRetry represents the state of a media retry request
+type MediaRetry struct {
+	MessageID   string    `json:"message_id"`
+	ChatJID     string    `json:"chat_jid"`
+	Status      string    `json:"status"`
+	DirectPath  string    `json:"direct_path,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	RequestedAt time.Time `json:"requested_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// MediaRetryStatusResponse represents the response for the media retry status API
+type MediaRetryStatusResponse struct {
+	Success bool        `json:"success"`
+	Message string      `json:"message"`
+	Retry   *MediaRetry `json:"retry,omitempty"`
+}
+
+// Store the state of a media retry request
+func (store *MessageStore) StoreMediaRetry(messageID, chatJID, status, directPath, errMsg string) error {
+	now := time.Now()
+	_, err := store.db.Exec(
+		`INSERT INTO media_retries (message_id, chat_jid, status, direct_path, error, requested_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (message_id, chat_jid) DO UPDATE SET
+			status = excluded.status,
+			direct_path = excluded.direct_path,
+			error = excluded.error,
+			requested_at = CASE WHEN excluded.status = 'requested' THEN excluded.requested_at ELSE media_retries.requested_at END,
+			updated_at = excluded.updated_at`,
+		messageID, chatJID, status, directPath, errMsg, now, now,
+	)
+	return err
+}
+
+// Get the state of a media retry request
+func (store *MessageStore) GetMediaRetry(messageID, chatJID string) (*MediaRetry, error) {
+	var retry MediaRetry
+	var directPath, errMsg sql.NullString
+	err := store.db.QueryRow(
+		"SELECT message_id, chat_jid, status, direct_path, error, requested_at, updated_at FROM media_retries WHERE message_id = ? AND chat_jid = ?",
+		messageID, chatJID,
+	).Scan(&retry.MessageID, &retry.ChatJID, &retry.Status, &directPath, &errMsg, &retry.RequestedAt, &retry.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	retry.DirectPath = directPath.String
+	retry.Error = errMsg.String
+	return &retry, nil
+}
+
+// Check whether a download error means the media URL has expired on the server
+func isMediaExpiredError(err error) bool {
+	return errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith404) || errors.Is(err, whatsmeow.ErrMediaDownloadFailedWith410)
+}
+
+// Parse a stored sender into a JID, stored senders may be a bare user or a full JID
+func parseSenderJID(sender string) (types.JID, error) {
+	if strings.Contains(sender, "@") {
+		return types.ParseJID(sender)
+	}
+	return types.NewJID(sender, types.DefaultUserServer), nil
+}
+
+// Ask the sender's phone to re-upload expired media, returns the current retry status
+func requestMediaRetry(ctx context.Context, client waClient, messageStore *MessageStore, messageID, chatJID string, mediaKey []byte) (string, error) {
+	// Don't flood the sender with requests while one is still in flight
+	if retry, err := messageStore.GetMediaRetry(messageID, chatJID); err == nil &&
+		retry.Status == mediaRetryRequested && time.Since(retry.RequestedAt) < mediaRetryResendAfter {
+		return retry.Status, nil
+	}
+
+	chat, err := types.ParseJID(chatJID)
+	if err != nil {
+		return "", fmt.Errorf("invalid chat JID: %v", err)
+	}
+
+	var sender string
+	var isFromMe bool
+	err = messageStore.db.QueryRow(
+		"SELECT sender, is_from_me FROM messages WHERE id = ? AND chat_jid = ?",
+		messageID, chatJID,
+	).Scan(&sender, &isFromMe)
+	if err != nil {
+		return "", fmt.Errorf("failed to find message: %v", err)
+	}
+
+	info := &types.MessageInfo{
+		ID: messageID,
+		MessageSource: types.MessageSource{
+			Chat:     chat,
+			IsFromMe: isFromMe,
+			IsGroup:  chat.Server == types.GroupServer,
+		},
+	}
+	if info.IsGroup && sender != "" {
+		if senderJID, err := parseSenderJID(sender); err == nil {
+			info.Sender = senderJID
+		}
+	}
+
+	err = throttle(opSend, func() error {
+		ctx, cancel := callContext(ctx, callSend)
+		defer cancel()
+		return client.SendMediaRetryReceipt(ctx, info, mediaKey)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err := messageStore.StoreMediaRetry(messageID, chatJID, mediaRetryRequested, "", ""); err != nil {
+		return "", fmt.Errorf("failed to store retry status: %v", err)
+	}
+
+	bridgeLog.Infof("Requested media re-upload for message %s in chat %s", messageID, chatJID)
+	return mediaRetryRequested, nil
+}
+
+// Handle the sender's answer to a media retry request
+func handleMediaRetry(client *whatsmeow.Client, messageStore *MessageStore, evt *events.MediaRetry, logger waLog.Logger) {
+	chatJID := evt.ChatID.String()
+
+	_, _, _, mediaKey, _, _, _, err := messageStore.GetMediaInfo(evt.MessageID, chatJID)
+	if err != nil || len(mediaKey) == 0 {
+		logger.Warnf("Received media retry for unknown message %s in %s", evt.MessageID, chatJID)
+		return
+	}
+
+	notif, err := whatsmeow.DecryptMediaRetryNotification(evt, mediaKey)
+	if err != nil {
+		status := mediaRetryFailed
+		if errors.Is(err, whatsmeow.ErrMediaNotAvailableOnPhone) {
+			status = mediaRetryNotFound
+		}
+		logger.Warnf("Media retry for message %s failed: %v", evt.MessageID, err)
+		messageStore.StoreMediaRetry(evt.MessageID, chatJID, status, "", err.Error())
+		return
+	}
+
+	switch notif.GetResult() {
+	case waMmsRetry.MediaRetryNotification_SUCCESS:
+		if err := messageStore.StoreMediaRetry(evt.MessageID, chatJID, mediaRetrySuccess, notif.GetDirectPath(), ""); err != nil {
+			logger.Warnf("Failed to store media retry result: %v", err)
+			return
+		}
+		logger.Infof("Media for message %s was re-uploaded by the sender", evt.MessageID)
+
+		// Fetch the refreshed media right away so it's cached before it can expire again
+		goSafe("downloading re-uploaded media", func() {
+			if _, _, _, _, err := downloadMedia(context.Background(), client, messageStore, evt.MessageID, chatJID); err != nil {
+				logger.Warnf("Failed to download re-uploaded media for message %s: %v", evt.MessageID, err)
+			}
+		})
+	case waMmsRetry.MediaRetryNotification_NOT_FOUND:
+		messageStore.StoreMediaRetry(evt.MessageID, chatJID, mediaRetryNotFound, "", "media is no longer available on the sender's phone")
+	default:
+		messageStore.StoreMediaRetry(evt.MessageID, chatJID, mediaRetryFailed, "", fmt.Sprintf("media retry failed: %s", notif.GetResult()))
+	}
+}
+
+// Register the media related REST handlers
+func registerMediaHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	// Handler for re-uploading stored media
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/media/reupload",
+		Summary:  "Re-upload the media of a stored message and return fresh URL/keys",
+		Tag:      "media",
+		Scope:    ScopeSendMessages,
+		Audit:    true,
+		Request:  ReuploadMediaRequest{},
+		Response: ReuploadMediaResponse{},
+	})
+	http.HandleFunc("/api/media/reupload", func(w http.ResponseWriter, r *http.Request) {
+		// Only allow POST requests
+		if !requireMethod(w, r, http.MethodPost) {
+			return
+		}
+
+		// Parse the request body
+		var req ReuploadMediaRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+
+		// Validate request
+		if req.MessageID == "" || req.ChatJID == "" {
+			writeError(w, ErrCodeInvalidRequest, "Message ID and Chat JID are required", nil)
+			return
+		}
+
+		if err := checkViewOnceAccess(messageStore, req.MessageID, req.ChatJID, req.AllowViewOnce); err != nil {
+			writeAPIError(w, "Failed to re-upload media", err)
+			return
+		}
+		resp, err := reuploadMedia(r.Context(), client, messageStore, req.MessageID, req.ChatJID)
+		if err != nil {
+			writeAPIError(w, "Failed to re-upload media", err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	})
+
+	// Handler for checking the status of a media retry request
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/media/retry_status",
+		Summary: "Get the status of a re-upload request for expired media",
+		Tag:     "media",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "message_id", Description: "ID of the media message", Required: true},
+			{Name: "chat_jid", Description: "JID of the chat containing the message", Required: true},
+		},
+		Response: MediaRetryStatusResponse{},
+	})
+	http.HandleFunc("/api/media/retry_status", func(w http.ResponseWriter, r *http.Request) {
+		// Only allow GET requests
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		messageID := r.URL.Query().Get("message_id")
+		chatJID := r.URL.Query().Get("chat_jid")
+		if messageID == "" || chatJID == "" {
+			writeError(w, ErrCodeInvalidRequest, "Message ID and Chat JID are required", nil)
+			return
+		}
+
+		retry, err := messageStore.GetMediaRetry(messageID, chatJID)
+		if err == sql.ErrNoRows {
+			writeError(w, ErrCodeNotFound, "No media retry has been requested for this message", nil)
+			return
+		} else if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to get media retry status: %v", err), nil)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, MediaRetryStatusResponse{
+			Success: true,
+			Message: fmt.Sprintf("Media retry is %s", retry.Status),
+			Retry:   retry,
+		})
+	})
+}
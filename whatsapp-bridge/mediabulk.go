@@ -0,0 +1,313 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Formats of a bulk media download
+const (
+	bulkFormatManifest = "manifest" // Download in the background, poll for the manifest
+	bulkFormatZip      = "zip"      // Stream the files as a zip archive while they download
+)
+
+// BulkMediaFile is the outcome of downloading the media of one message
+type BulkMediaFile struct {
+	MessageID string    `json:"message_id"`
+	Time      time.Time `json:"timestamp"`
+	MediaType string    `json:"media_type"`
+	Filename  string    `json:"filename"`
+	Path      string    `json:"path,omitempty"`
+	ErrorCode ErrorCode `json:"error_code,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// BulkMediaRequest represents the request body for downloading the media of a chat
+type BulkMediaRequest struct {
+	MediaType     string `json:"media_type,omitempty"`  // image, video, audio or document; all media by default
+	AfterTime     string `json:"after_time,omitempty"`  // Only media sent after this time
+	BeforeTime    string `json:"before_time,omitempty"` // Only media sent before this time
+	Limit         int    `json:"limit,omitempty"`       // At most this many of the latest media, all by default
+	AllowViewOnce bool   `json:"allow_view_once,omitempty"`
+	Format        string `json:"format,omitempty"` // manifest (default) or zip
+}
+
+// BulkMediaResponse represents the response for the bulk media download APIs
+type BulkMediaResponse struct {
+	Success  bool            `json:"success"`
+	Message  string          `json:"message,omitempty"`
+	ChatJID  string          `json:"chat_jid"`
+	Status   SyncStatus      `json:"status"`
+	Manifest []BulkMediaFile `json:"manifest"`
+}
+
+// bulkMediaDownload is the latest bulk download of a chat's media
+type bulkMediaDownload struct {
+	job      *syncJob
+	mu       sync.Mutex
+	manifest []BulkMediaFile
+}
+
+// Record the outcome of one file
+func (d *bulkMediaDownload) add(f BulkMediaFile) {
+	d.mu.Lock()
+	d.manifest = append(d.manifest, f)
+	d.mu.Unlock()
+}
+
+// Get a snapshot of the files handled so far
+func (d *bulkMediaDownload) files() []BulkMediaFile {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]BulkMediaFile{}, d.manifest...)
+}
+
+// Bulk downloads by chat JID
+var (
+	bulkMediaMu        sync.Mutex
+	bulkMediaDownloads = map[string]*bulkMediaDownload{}
+)
+
+// Get the bulk download of a chat, creating it if create is set
+func bulkMediaFor(chatJID string, create bool) *bulkMediaDownload {
+	bulkMediaMu.Lock()
+	defer bulkMediaMu.Unlock()
+	d := bulkMediaDownloads[chatJID]
+	if d == nil && create {
+		d = &bulkMediaDownload{job: newSyncJob("media " + chatJID)}
+		bulkMediaDownloads[chatJID] = d
+	}
+	return d
+}
+
+// Find the stored messages of a chat with downloadable media, newest first
+func (store *MessageStore) chatMediaMessages(chatJID string, req BulkMediaRequest) ([]Message, error) {
+	f := MessageFilter{ChatJID: chatJID, MediaType: req.MediaType, HasMedia: req.MediaType == "", Revoked: revokedExclude}
+	var err error
+	if f.After, err = parseTimeField("after_time", req.AfterTime); err != nil {
+		return nil, err
+	}
+	if f.Before, err = parseTimeField("before_time", req.BeforeTime); err != nil {
+		return nil, err
+	}
+
+	var messages []Message
+	for f.Offset = 0; ; f.Offset += maxPageSize {
+		f.Limit = maxPageSize
+		page, err := store.QueryMessages(f)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range page {
+			if _, err := whatsmeowMediaType(m.MediaType); err == nil {
+				messages = append(messages, m)
+			}
+		}
+		if len(page) < maxPageSize || (req.Limit > 0 && len(messages) >= req.Limit) {
+			break
+		}
+	}
+	if req.Limit > 0 && len(messages) > req.Limit {
+		messages = messages[:req.Limit]
+	}
+	return messages, nil
+}
+
+// Download the media of one message, recording a failure instead of returning it
+func downloadBulkFile(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, m Message, allowViewOnce bool) BulkMediaFile {
+	file := BulkMediaFile{MessageID: m.ID, Time: m.Time, MediaType: m.MediaType, Filename: m.Filename}
+	err := checkViewOnceAccess(messageStore, m.ID, m.ChatJID, allowViewOnce)
+	if err == nil {
+		_, _, _, file.Path, err = downloadMedia(ctx, client, messageStore, m.ID, m.ChatJID)
+	}
+	if err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			file.ErrorCode = apiErr.Code
+		} else {
+			file.ErrorCode = ErrCodeInternal
+		}
+		file.Error = err.Error()
+	}
+	return file
+}
+
+// Download the media of messages in the background, one at a time. Returns
+// false if the chat's media are already downloading.
+func runBulkMediaDownload(client *whatsmeow.Client, messageStore *MessageStore, d *bulkMediaDownload, messages []Message, allowViewOnce bool) bool {
+	return d.job.start(func(j *syncJob) error {
+		d.mu.Lock()
+		d.manifest = nil
+		d.mu.Unlock()
+		j.setTotal(len(messages))
+		ctx := j.context()
+		for _, m := range messages {
+			if ctx.Err() != nil {
+				return errJobStopped
+			}
+			d.add(downloadBulkFile(ctx, client, messageStore, m, allowViewOnce))
+			j.advance(1)
+		}
+		return nil
+	})
+}
+
+// Stream the media of messages as a zip archive, ending with a manifest.json
+// listing every file and why any is missing
+func writeBulkMediaZip(ctx context.Context, w http.ResponseWriter, client *whatsmeow.Client, messageStore *MessageStore, chatJID string, messages []Message, allowViewOnce bool) {
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", strings.ReplaceAll(chatJID, ":", "_")+"-media.zip"))
+	zw := zip.NewWriter(w)
+
+	manifest := []BulkMediaFile{}
+	for _, m := range messages {
+		// Stop downloading once the client has gone away
+		if ctx.Err() != nil {
+			return
+		}
+		file := downloadBulkFile(ctx, client, messageStore, m, allowViewOnce)
+		if file.Path != "" {
+			if err := addFileToZip(zw, m.ID+"_"+filepath.Base(file.Path), file.Path); err != nil {
+				bridgeLog.Warnf("Failed to stream media of message %s: %v", m.ID, err)
+				return
+			}
+			file.Path = m.ID + "_" + filepath.Base(file.Path)
+		}
+		manifest = append(manifest, file)
+	}
+
+	entry, err := zw.Create("manifest.json")
+	if err == nil {
+		err = json.NewEncoder(entry).Encode(manifest)
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		bridgeLog.Warnf("Failed to finish media archive of %s: %v", chatJID, err)
+	}
+}
+
+// Copy a file into a zip archive
+func addFileToZip(zw *zip.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	entry, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, f)
+	return err
+}
+
+// Register the REST handlers downloading all media of a chat
+func registerBulkMediaHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	jidParam := apiParam{Name: "jid", In: "path", Description: "Chat JID", Required: true}
+
+	// Handler for starting a bulk download
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/chats/{jid}/download_media",
+		Summary:  "Download all (or filtered) media of a chat: in the background with a manifest to poll, or as a zip stream with format=zip",
+		Tag:      "media",
+		Scope:    ScopeReadMessages,
+		Params:   []apiParam{jidParam},
+		Request:  BulkMediaRequest{},
+		Response: BulkMediaResponse{},
+	})
+	http.HandleFunc("POST /api/chats/{jid}/download_media", func(w http.ResponseWriter, r *http.Request) {
+		chatJID := r.PathValue("jid")
+		var req BulkMediaRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if req.Format != "" && req.Format != bulkFormatManifest && req.Format != bulkFormatZip {
+			writeError(w, ErrCodeInvalidRequest, "format must be manifest or zip", nil)
+			return
+		}
+		if req.MediaType != "" {
+			if _, err := whatsmeowMediaType(req.MediaType); err != nil {
+				writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("Invalid media_type: %v", err), nil)
+				return
+			}
+		}
+		messages, err := messageStore.chatMediaMessages(chatJID, req)
+		if err != nil {
+			writeAPIError(w, "Failed to list media", err)
+			return
+		}
+
+		if req.Format == bulkFormatZip {
+			writeBulkMediaZip(r.Context(), w, client, messageStore, chatJID, messages, req.AllowViewOnce)
+			return
+		}
+
+		d := bulkMediaFor(chatJID, true)
+		if !runBulkMediaDownload(client, messageStore, d, messages, req.AllowViewOnce) {
+			writeError(w, ErrCodeConflict, fmt.Sprintf("Media of %s are already downloading", chatJID), d.job.Status())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, BulkMediaResponse{
+			Success:  true,
+			Message:  fmt.Sprintf("Downloading %d media files", len(messages)),
+			ChatJID:  chatJID,
+			Status:   d.job.Status(),
+			Manifest: d.files(),
+		})
+	})
+
+	// Handler for following a bulk download
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/chats/{jid}/download_media",
+		Summary:  "Get the progress and manifest of the latest bulk media download of a chat",
+		Tag:      "media",
+		Scope:    ScopeReadMessages,
+		Params:   []apiParam{jidParam},
+		Response: BulkMediaResponse{},
+	})
+	http.HandleFunc("GET /api/chats/{jid}/download_media", func(w http.ResponseWriter, r *http.Request) {
+		chatJID := r.PathValue("jid")
+		d := bulkMediaFor(chatJID, false)
+		if d == nil {
+			writeError(w, ErrCodeNotFound, fmt.Sprintf("No media download was started for %s", chatJID), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, BulkMediaResponse{Success: true, ChatJID: chatJID, Status: d.job.Status(), Manifest: d.files()})
+	})
+
+	// Handler for stopping a bulk download
+	documentAPI(apiOperation{
+		Method:   http.MethodDelete,
+		Path:     "/api/chats/{jid}/download_media",
+		Summary:  "Stop the running bulk media download of a chat, aborting the file being downloaded; the files done so far stay in the manifest",
+		Tag:      "media",
+		Scope:    ScopeReadMessages,
+		Params:   []apiParam{jidParam},
+		Response: BulkMediaResponse{},
+	})
+	http.HandleFunc("DELETE /api/chats/{jid}/download_media", func(w http.ResponseWriter, r *http.Request) {
+		chatJID := r.PathValue("jid")
+		d := bulkMediaFor(chatJID, false)
+		if d == nil || !d.job.stop() {
+			writeError(w, ErrCodeNotFound, fmt.Sprintf("No media download is running for %s", chatJID), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, BulkMediaResponse{Success: true, Message: "Stopping the download", ChatJID: chatJID, Status: d.job.Status(), Manifest: d.files()})
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Content types accepted from media URLs by default, a trailing / matches a whole family
+var defaultMediaURLTypes = []string{"image/", "video/", "audio/", "application/", "text/plain", "text/csv"}
+
+// File extensions for content types, for URLs whose path has none. The media
+// type of a sent file is told by its extension.
+var mediaTypeExtensions = map[string]string{
+	"image/jpeg":      ".jpg",
+	"image/png":       ".png",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"audio/ogg":       ".ogg",
+	"video/mp4":       ".mp4",
+	"video/quicktime": ".mov",
+	"application/pdf": ".pdf",
+	"text/plain":      ".txt",
+}
+
+// Get the HTTP client fetching media URLs. Only public addresses are reached
+// unless WHATSAPP_MEDIA_URL_ALLOW_PRIVATE is set, so send requests can't make
+// the bridge probe the local network.
+func mediaURLClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if !envBool("WHATSAPP_MEDIA_URL_ALLOW_PRIVATE", false) {
+		dialer.Control = publicAddressOnly
+	}
+	return &http.Client{
+		Timeout:   time.Duration(max(envInt("WHATSAPP_MEDIA_URL_TIMEOUT_SECONDS", 60), 1)) * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+}
+
+// Check whether a content type is allowed for media URLs
+func mediaTypeAllowed(contentType string, allowed []string) bool {
+	for _, a := range allowed {
+		if a == contentType || strings.HasSuffix(a, "/") && strings.HasPrefix(contentType, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// Pick the name to store a fetched file under, from the Content-Disposition
+// header or the URL path, adding an extension for the content type if needed
+func mediaURLFilename(u *url.URL, resp *http.Response, contentType string) string {
+	name := ""
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil {
+		name = params["filename"]
+	}
+	if name == "" {
+		name = path.Base(u.Path)
+	}
+	name = sanitizeUploadFilename(name)
+	if filepath.Ext(name) == "" {
+		if ext, ok := mediaTypeExtensions[contentType]; ok {
+			name += ext
+		} else if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	return name
+}
+
+// Download the media at a URL to send it, returning the path of the file.
+// It is kept in the uploads directory, removed with expired uploads.
+func fetchMediaURL(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", newAPIError(ErrCodeInvalidRequest, "media_url must be an http or https URL")
+	}
+	maxBytes := int64(envInt("WHATSAPP_MEDIA_URL_MAX_BYTES", envInt("WHATSAPP_UPLOAD_MAX_BYTES", defaultUploadMaxBytes)))
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", newAPIError(ErrCodeInvalidRequest, "Invalid media_url: %v", err)
+	}
+	req.Header.Set("User-Agent", "whatsapp-bridge")
+	resp, err := mediaURLClient().Do(req)
+	if err != nil {
+		return "", newAPIError(ErrCodeDownloadFailed, "Failed to fetch media_url: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", newAPIError(ErrCodeDownloadFailed, "Fetching media_url returned HTTP %d", resp.StatusCode)
+	}
+	if resp.ContentLength > maxBytes {
+		return "", newAPIError(ErrCodePayloadTooLarge, "Media at media_url is larger than %d bytes", maxBytes)
+	}
+
+	allowed := envList("WHATSAPP_MEDIA_URL_TYPES", defaultMediaURLTypes)
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if contentType != "" && contentType != "application/octet-stream" && !mediaTypeAllowed(contentType, allowed) {
+		return "", newAPIError(ErrCodeUnsupportedMedia, "media_url has content type %s, which is not allowed", contentType)
+	}
+
+	_, dir, err := newUploadDir()
+	if err != nil {
+		return "", err
+	}
+	filePath := filepath.Join(dir, mediaURLFilename(u, resp, contentType))
+	size, sniffed, err := writeUpload(filePath, io.LimitReader(resp.Body, maxBytes+1))
+	if err == nil && size > maxBytes {
+		err = newAPIError(ErrCodePayloadTooLarge, "Media at media_url is larger than %d bytes", maxBytes)
+	} else if err == nil && size == 0 {
+		err = newAPIError(ErrCodeDownloadFailed, "media_url returned no content")
+	} else if err != nil {
+		err = newAPIError(ErrCodeDownloadFailed, "Failed to fetch media_url: %v", err)
+	}
+	// Servers may answer with an error or login page labelled as media
+	if err == nil && strings.HasPrefix(sniffed, "text/html") {
+		err = newAPIError(ErrCodeUnsupportedMedia, "media_url returned a web page, not media")
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	bridgeLog.Infof("Fetched %d bytes of media from %s", size, u.Host)
+	return filePath, nil
+}
+
+// Get the path of the media of a send request, given as a server-local path,
+// the token of an upload or a URL to download. At most one may be set.
+func resolveMediaSource(mediaPath, mediaToken, mediaURL string) (string, error) {
+	sources := 0
+	for _, source := range []string{mediaPath, mediaToken, mediaURL} {
+		if source != "" {
+			sources++
+		}
+	}
+	switch {
+	case sources > 1:
+		return "", newAPIError(ErrCodeInvalidRequest, "Give only one of media_path, media_token and media_url")
+	case mediaToken != "":
+		return resolveMediaToken(mediaToken)
+	case mediaURL != "":
+		return fetchMediaURL(mediaURL)
+	}
+	return mediaPath, nil
+}
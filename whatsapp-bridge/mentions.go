@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+// Ways a group message can be addressed to me
+const (
+	MentionKindMention = "mention" // I was @mentioned
+	MentionKindReply   = "reply"   // It quotes one of my messages
+)
+
+// Mention is a group message that mentions or replies to me
+type Mention struct {
+	ChatJID   string    `json:"chat_jid"`
+	ChatName  string    `json:"chat_name"`
+	MessageID string    `json:"message_id"`
+	Kind      string    `json:"kind"`
+	Time      time.Time `json:"timestamp"`
+	Message   *Message  `json:"message,omitempty"`
+}
+
+// Get the context info of a message, which holds its mentions and the message it quotes
+func messageContextInfo(m *waProto.Message) *waProto.ContextInfo {
+	switch {
+	case m.GetExtendedTextMessage() != nil:
+		return m.GetExtendedTextMessage().GetContextInfo()
+	case m.GetImageMessage() != nil:
+		return m.GetImageMessage().GetContextInfo()
+	case m.GetVideoMessage() != nil:
+		return m.GetVideoMessage().GetContextInfo()
+	case m.GetAudioMessage() != nil:
+		return m.GetAudioMessage().GetContextInfo()
+	case m.GetDocumentMessage() != nil:
+		return m.GetDocumentMessage().GetContextInfo()
+	case m.GetStickerMessage() != nil:
+		return m.GetStickerMessage().GetContextInfo()
+	}
+	return nil
+}
+
+// Find the ways a message is addressed to me
+func mentionKinds(client *whatsmeow.Client, m *waProto.Message) []string {
+	info := messageContextInfo(m)
+	if info == nil {
+		return nil
+	}
+	var kinds []string
+	for _, jid := range info.GetMentionedJID() {
+		if isOwnJID(client, jid) {
+			kinds = append(kinds, MentionKindMention)
+			break
+		}
+	}
+	if info.GetQuotedMessage() != nil && isOwnJID(client, info.GetParticipant()) {
+		kinds = append(kinds, MentionKindReply)
+	}
+	return kinds
+}
+
+// Record that a message mentions or replies to me
+func (store *MessageStore) StoreMention(chatJID, messageID, kind string, timestamp time.Time) error {
+	_, err := store.db.Exec(
+		"INSERT OR IGNORE INTO mentions (chat_jid, message_id, kind, timestamp) VALUES (?, ?, ?, ?)",
+		chatJID, messageID, kind, timestamp,
+	)
+	return err
+}
+
+// List mentions and replies to me, of one chat or all chats and optionally of one kind, latest first
+func (store *MessageStore) ListMentions(chatJID, kind string, after *time.Time, limit, offset int) ([]Mention, error) {
+	var conditions []string
+	var args []interface{}
+	if chatJID != "" {
+		conditions = append(conditions, "m.chat_jid = ?")
+		args = append(args, chatJID)
+	}
+	if kind != "" {
+		conditions = append(conditions, "m.kind = ?")
+		args = append(args, kind)
+	}
+	if after != nil {
+		conditions = append(conditions, "m.timestamp > ?")
+		args = append(args, after.Local())
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit, offset)
+
+	rows, err := store.db.Query(
+		`SELECT m.chat_jid, COALESCE(c.name, ''), m.message_id, m.kind, m.timestamp
+		FROM mentions m LEFT JOIN chats c ON c.jid = m.chat_jid`+where+`
+		ORDER BY m.timestamp DESC LIMIT ? OFFSET ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mentions := []Mention{}
+	for rows.Next() {
+		var mention Mention
+		if err := rows.Scan(&mention.ChatJID, &mention.ChatName, &mention.MessageID, &mention.Kind, &mention.Time); err != nil {
+			return nil, err
+		}
+		mentions = append(mentions, mention)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Attach the messages we have stored
+	for i := range mentions {
+		rows, err := store.db.Query("SELECT "+messageColumns+" FROM messages WHERE id = ? AND chat_jid = ?", mentions[i].MessageID, mentions[i].ChatJID)
+		if err != nil {
+			return nil, err
+		}
+		messages, err := scanMessages(rows)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) > 0 {
+			mentions[i].Message = &messages[0]
+		}
+	}
+	return mentions, nil
+}
+
+// MentionAlert is the payload POSTed to WHATSAPP_MENTIONS_WEBHOOK_URL
+type MentionAlert struct {
+	Event    string  `json:"event"` // Always "group.mention"
+	Kind     string  `json:"kind"`
+	ChatName string  `json:"chat_name"`
+	Message  Message `json:"message"`
+}
+
+// Record a group message mentioning or replying to me and announce it. Like
+// WhatsApp itself, this also happens in muted groups.
+func handleMentions(client *whatsmeow.Client, messageStore *MessageStore, msg Message, raw *waProto.Message, chatName string) {
+	kinds := mentionKinds(client, raw)
+	for _, kind := range kinds {
+		if err := messageStore.StoreMention(msg.ChatJID, msg.ID, kind, msg.Time); err != nil {
+			bridgeLog.Warnf("Failed to store %s of message %s: %v", kind, msg.ID, err)
+		}
+	}
+
+	webhookURL := envString("WHATSAPP_MENTIONS_WEBHOOK_URL", "")
+	if len(kinds) == 0 || webhookURL == "" {
+		return
+	}
+	// A mention that is also a reply is announced once, as a mention
+	alert := MentionAlert{Event: "group.mention", Kind: kinds[0], ChatName: chatName, Message: msg}
+	goSafe("calling the mentions webhook", func() {
+		if err := postWebhook(webhookURL, alert); err != nil {
+			bridgeLog.Warnf("Failed to call mentions webhook: %v", err)
+		}
+	})
+}
+
+// ListMentionsResponse represents the response for the mentions API
+type ListMentionsResponse struct {
+	Success  bool      `json:"success"`
+	Mentions []Mention `json:"mentions"`
+	Page
+}
+
+// Register the REST handler for the feed of group messages addressed to me
+func registerMentionHandlers(messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/mentions",
+		Summary: "List group messages that @mention me or reply to my messages, latest first",
+		Tag:     "messages",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "chat_jid", Description: "Only mentions in this group"},
+			{Name: "kind", Description: "Only mentions of this kind (mention, reply)"},
+			{Name: "after_time", Description: "Only mentions after this time" + timeFormatsHint},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ListMentionsResponse{},
+	})
+	http.HandleFunc("GET /api/mentions", func(w http.ResponseWriter, r *http.Request) {
+		kind := r.URL.Query().Get("kind")
+		if kind != "" && kind != MentionKindMention && kind != MentionKindReply {
+			writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("Invalid kind %q, use mention or reply", kind), nil)
+			return
+		}
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		after, err := parseTimeParam(r, "after_time")
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		mentions, err := messageStore.ListMentions(r.URL.Query().Get("chat_jid"), kind, after, limit+1, offset)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list mentions: %v", err), nil)
+			return
+		}
+		mentions, page := trimPage(mentions, offset, limit)
+		writeJSON(w, http.StatusOK, ListMentionsResponse{Success: true, Mentions: mentions, Page: page})
+	})
+}
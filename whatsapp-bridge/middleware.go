@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+// Log a panic with its stack instead of letting it kill the bridge and the
+// WhatsApp session with it. Deferred directly, what describes the work that
+// panicked.
+func recoverPanic(what string, args ...interface{}) {
+	if err := recover(); err != nil {
+		bridgeLog.Errorf("Panic %s: %v\n%s", fmt.Sprintf(what, args...), err, debug.Stack())
+	}
+}
+
+// Run a function in a goroutine, recovering from panics
+func goSafe(what string, fn func()) {
+	go func() {
+		defer recoverPanic("%s", what)
+		fn()
+	}()
+}
+
+// Turn panics in handlers into internal_error responses. A handler that
+// already started its response gets it cut short.
+func withRecovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			if err == http.ErrAbortHandler {
+				// Deliberate aborts are left to net/http
+				panic(err)
+			}
+			bridgeLog.Errorf("Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+			writeError(w, ErrCodeInternal, "Internal error while handling the request", nil)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Context key for the documented operation a request is routed to
+type apiOperationKey struct{}
+
+// Get the documented operation of a request, nil for undocumented routes
+func operationFromContext(ctx context.Context) *apiOperation {
+	op, _ := ctx.Value(apiOperationKey{}).(*apiOperation)
+	return op
+}
+
+// Find the documented operation a request will be routed to. The mux routes
+// HEAD requests to GET handlers, so they get the GET operation.
+func operationForRequest(mux *http.ServeMux, r *http.Request) *apiOperation {
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	_, pattern := mux.Handler(r)
+	// Patterns may carry a method prefix, e.g. "GET /api/messages/{id}/receipts"
+	if _, path, ok := strings.Cut(pattern, " "); ok {
+		pattern = path
+	}
+
+	for i := range apiOperations {
+		if apiOperations[i].Path == pattern && apiOperations[i].Method == method {
+			return &apiOperations[i]
+		}
+	}
+	return nil
+}
+
+// Resolve the documented operation of each request so later middleware can use
+// its metadata (scope, auditing, ...)
+func withOperation(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if op := operationForRequest(mux, r); op != nil {
+			r = r.WithContext(context.WithValue(r.Context(), apiOperationKey{}, op))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Default limit of request bodies, enough for any JSON request
+const defaultMaxBodyBytes = 1 << 20
+
+// Limit the size of request bodies to the limit of their operation, or the
+// WHATSAPP_MAX_BODY_BYTES default. Handlers reading past it get an
+// *http.MaxBytesError.
+func withBodyLimit(next http.Handler) http.Handler {
+	defaultLimit := int64(envInt("WHATSAPP_MAX_BODY_BYTES", defaultMaxBodyBytes))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultLimit
+		if op := operationFromContext(r.Context()); op != nil && op.MaxBody > 0 {
+			limit = op.MaxBody
+		}
+		if r.ContentLength > limit {
+			writeError(w, ErrCodePayloadTooLarge, fmt.Sprintf("Request body is larger than %d bytes", limit), nil)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Check whether a browser origin is allowed by the CORS configuration
+func (c CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap a handler with CORS headers and preflight handling
+func withCORS(cfg CORSConfig, next http.Handler) http.Handler {
+	if len(cfg.AllowedOrigins) == 0 {
+		return next
+	}
+
+	methods := strings.Join(cfg.AllowedMethods, ", ")
+	headers := strings.Join(cfg.AllowedHeaders, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			// Not a browser cross-origin request
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !cfg.allowsOrigin(origin) {
+			if r.Method == http.MethodOptions {
+				writeError(w, ErrCodeForbidden, "Origin not allowed", nil)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+
+		// Answer preflight requests directly, they never reach the handlers
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(cfg.MaxAge))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Query ID of the GraphQL mutation updating a newsletter, whatsmeow has no function for it
+const mutationUpdateNewsletter = "7150902998257522"
+
+// Largest side of a newsletter picture
+const newsletterPictureSize = 640
+
+// Newsletter is a WhatsApp channel
+type Newsletter struct {
+	JID         string    `json:"jid"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	InviteLink  string    `json:"invite_link,omitempty"`
+	Subscribers int       `json:"subscribers"`
+	Role        string    `json:"role,omitempty"` // owner, admin, subscriber or guest
+	PictureURL  string    `json:"picture_url,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Convert whatsmeow's newsletter metadata
+func newsletterFromMetadata(m *types.NewsletterMetadata) Newsletter {
+	n := Newsletter{
+		JID:         m.ID.String(),
+		Name:        m.ThreadMeta.Name.Text,
+		Description: m.ThreadMeta.Description.Text,
+		Subscribers: m.ThreadMeta.SubscriberCount,
+		CreatedAt:   m.ThreadMeta.CreationTime.Time,
+	}
+	if m.ThreadMeta.InviteCode != "" {
+		n.InviteLink = "https://whatsapp.com/channel/" + m.ThreadMeta.InviteCode
+	}
+	if m.ViewerMeta != nil {
+		n.Role = string(m.ViewerMeta.Role)
+	}
+	if m.ThreadMeta.Picture != nil {
+		n.PictureURL = m.ThreadMeta.Picture.URL
+	}
+	return n
+}
+
+// NewsletterPost is a post published to a newsletter through the bridge
+type NewsletterPost struct {
+	ID            int64     `json:"id"`
+	NewsletterJID string    `json:"newsletter_jid"`
+	MessageID     string    `json:"message_id"`
+	ServerID      int       `json:"server_id,omitempty"` // Given by WhatsApp once published
+	Text          string    `json:"text,omitempty"`
+	MediaType     string    `json:"media_type,omitempty"`
+	Filename      string    `json:"filename,omitempty"`
+	Status        string    `json:"status"` // sent or failed
+	Error         string    `json:"error,omitempty"`
+	Time          time.Time `json:"timestamp"`
+}
+
+// Statuses of newsletter posts
+const (
+	NewsletterPostSent   = "sent"
+	NewsletterPostFailed = "failed"
+)
+
+// Record a newsletter post, setting its ID
+func (store *MessageStore) StoreNewsletterPost(p *NewsletterPost) error {
+	result, err := store.db.Exec(
+		`INSERT INTO newsletter_posts (newsletter_jid, message_id, server_id, text, media_type, filename, status, error, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.NewsletterJID, p.MessageID, p.ServerID, p.Text, p.MediaType, p.Filename, p.Status, p.Error, p.Time,
+	)
+	if err != nil {
+		return err
+	}
+	p.ID, err = result.LastInsertId()
+	return err
+}
+
+// List the posts published to a newsletter, latest first
+func (store *MessageStore) ListNewsletterPosts(newsletterJID string, limit, offset int) ([]NewsletterPost, error) {
+	rows, err := store.db.Query(
+		`SELECT id, newsletter_jid, COALESCE(message_id, ''), COALESCE(server_id, 0), COALESCE(text, ''), COALESCE(media_type, ''),
+			COALESCE(filename, ''), status, COALESCE(error, ''), timestamp
+		FROM newsletter_posts WHERE newsletter_jid = ? ORDER BY timestamp DESC, id DESC LIMIT ? OFFSET ?`,
+		newsletterJID, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	posts := []NewsletterPost{}
+	for rows.Next() {
+		var p NewsletterPost
+		if err := rows.Scan(&p.ID, &p.NewsletterJID, &p.MessageID, &p.ServerID, &p.Text, &p.MediaType,
+			&p.Filename, &p.Status, &p.Error, &p.Time); err != nil {
+			return nil, err
+		}
+		posts = append(posts, p)
+	}
+	return posts, rows.Err()
+}
+
+// Parse the newsletter JID of a {jid} route
+func newsletterJIDFromPath(r *http.Request) (types.JID, error) {
+	jid, err := types.ParseJID(r.PathValue("jid"))
+	if err != nil || jid.Server != types.NewsletterServer {
+		return types.JID{}, newAPIError(ErrCodeInvalidRequest, "%q is not a newsletter JID (...@newsletter)", r.PathValue("jid"))
+	}
+	return jid, nil
+}
+
+// Read a newsletter picture from a media source as a JPEG, WhatsApp only takes those
+func newsletterPicture(mediaPath, mediaToken, mediaURL string) ([]byte, error) {
+	path, err := resolveMediaSource(mediaPath, mediaToken, mediaURL)
+	if err != nil || path == "" {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, newAPIError(ErrCodeInvalidRequest, "Error reading picture: %v", err)
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, newAPIError(ErrCodeUnsupportedMedia, "Picture is not a JPEG, PNG or GIF image: %v", err)
+	}
+	size := img.Bounds().Size()
+	return jpegThumbnail(img, min(max(size.X, size.Y), newsletterPictureSize))
+}
+
+// NewsletterRequest represents the request body for creating or updating a newsletter.
+// The picture is given like the media of a message.
+type NewsletterRequest struct {
+	Name         string  `json:"name,omitempty"`
+	Description  *string `json:"description,omitempty"` // An empty description clears it
+	PicturePath  string  `json:"picture_path,omitempty"`
+	PictureToken string  `json:"picture_token,omitempty"` // Token of a file uploaded with POST /api/media/upload
+	PictureURL   string  `json:"picture_url,omitempty"`
+}
+
+// NewsletterPostRequest represents the request body for publishing a newsletter post
+type NewsletterPostRequest struct {
+	Message    string `json:"message,omitempty"`
+	MediaPath  string `json:"media_path,omitempty"`
+	MediaToken string `json:"media_token,omitempty"`
+	MediaURL   string `json:"media_url,omitempty"`
+}
+
+// NewsletterResponse represents the response for the single newsletter APIs
+type NewsletterResponse struct {
+	Success    bool       `json:"success"`
+	Newsletter Newsletter `json:"newsletter"`
+}
+
+// ListNewslettersResponse represents the response for the newsletter list API
+type ListNewslettersResponse struct {
+	Success     bool         `json:"success"`
+	Newsletters []Newsletter `json:"newsletters"`
+}
+
+// NewsletterPostResponse represents the response for the newsletter post API
+type NewsletterPostResponse struct {
+	Success bool           `json:"success"`
+	Post    NewsletterPost `json:"post"`
+}
+
+// ListNewsletterPostsResponse represents the response for the newsletter post history API
+type ListNewsletterPostsResponse struct {
+	Success bool             `json:"success"`
+	Posts   []NewsletterPost `json:"posts"`
+	Page
+}
+
+// Register the REST handlers managing and publishing to newsletters
+func registerNewsletterHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	jidParam := apiParam{Name: "jid", In: "path", Description: "JID of the newsletter (...@newsletter)", Required: true}
+
+	// Handler for listing followed and owned newsletters
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/newsletters",
+		Summary:  "List the newsletters (channels) the account follows or administers, with its role in each",
+		Tag:      "newsletters",
+		Scope:    ScopeReadMessages,
+		Response: ListNewslettersResponse{},
+	})
+	http.HandleFunc("GET /api/newsletters", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := callContext(r.Context(), callQuery)
+		defer cancel()
+		subscribed, err := client.GetSubscribedNewsletters(ctx)
+		if err != nil {
+			writeAPIError(w, "Failed to list newsletters", err)
+			return
+		}
+		newsletters := []Newsletter{}
+		for _, m := range subscribed {
+			newsletters = append(newsletters, newsletterFromMetadata(m))
+		}
+		writeJSON(w, http.StatusOK, ListNewslettersResponse{Success: true, Newsletters: newsletters})
+	})
+
+	// Handler for creating a newsletter
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/newsletters",
+		Summary:  "Create a newsletter (channel) owned by the account",
+		Tag:      "newsletters",
+		Scope:    ScopeManageGroups,
+		Audit:    true,
+		Request:  NewsletterRequest{},
+		Response: NewsletterResponse{},
+	})
+	http.HandleFunc("POST /api/newsletters", func(w http.ResponseWriter, r *http.Request) {
+		var req NewsletterRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		params := whatsmeow.CreateNewsletterParams{Name: strings.TrimSpace(req.Name)}
+		if params.Name == "" {
+			writeError(w, ErrCodeInvalidRequest, "Name is required", nil)
+			return
+		}
+		if req.Description != nil {
+			params.Description = *req.Description
+		}
+		picture, err := newsletterPicture(req.PicturePath, req.PictureToken, req.PictureURL)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		params.Picture = picture
+		ctx, cancel := callContext(r.Context(), callQuery)
+		defer cancel()
+		created, err := client.CreateNewsletter(ctx, params)
+		if err != nil {
+			writeAPIError(w, "Failed to create newsletter", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, NewsletterResponse{Success: true, Newsletter: newsletterFromMetadata(created)})
+	})
+
+	// Handler for updating the name, description and picture of a newsletter
+	documentAPI(apiOperation{
+		Method:   http.MethodPatch,
+		Path:     "/api/newsletters/{jid}",
+		Summary:  "Update the name, description or picture of an owned newsletter; fields left out are kept",
+		Tag:      "newsletters",
+		Scope:    ScopeManageGroups,
+		Audit:    true,
+		Params:   []apiParam{jidParam},
+		Request:  NewsletterRequest{},
+		Response: NewsletterResponse{},
+	})
+	http.HandleFunc("PATCH /api/newsletters/{jid}", func(w http.ResponseWriter, r *http.Request) {
+		jid, err := newsletterJIDFromPath(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		var req NewsletterRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		updates := map[string]any{}
+		if name := strings.TrimSpace(req.Name); name != "" {
+			updates["name"] = name
+		}
+		if req.Description != nil {
+			updates["description"] = *req.Description
+		}
+		picture, err := newsletterPicture(req.PicturePath, req.PictureToken, req.PictureURL)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if picture != nil {
+			updates["picture"] = picture // Sent base64 encoded, like whatsmeow does when creating
+		}
+		if len(updates) == 0 {
+			writeError(w, ErrCodeInvalidRequest, "Give a name, description or picture to update", nil)
+			return
+		}
+		ctx, cancel := callContext(r.Context(), callQuery)
+		defer cancel()
+		data, err := client.DangerousInternals().SendMexIQ(ctx, mutationUpdateNewsletter, map[string]any{
+			"newsletter_id": jid.String(),
+			"updates":       updates,
+		})
+		if err != nil {
+			writeAPIError(w, "Failed to update newsletter", err)
+			return
+		}
+		var resp struct {
+			Newsletter *types.NewsletterMetadata `json:"xwa2_newsletter_update"`
+		}
+		if err := json.Unmarshal(data, &resp); err != nil || resp.Newsletter == nil {
+			// The update went through, fetch the newsletter instead
+			if resp.Newsletter, err = client.GetNewsletterInfo(ctx, jid); err != nil {
+				writeAPIError(w, "Newsletter was updated but could not be loaded", err)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, NewsletterResponse{Success: true, Newsletter: newsletterFromMetadata(resp.Newsletter)})
+	})
+
+	// Handler for publishing a post
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/newsletters/{jid}/posts",
+		Summary:  "Publish a text or media post to an owned newsletter; every attempt is kept in the post history",
+		Tag:      "newsletters",
+		Scope:    ScopeSendMessages,
+		Audit:    true,
+		Params:   []apiParam{jidParam},
+		Request:  NewsletterPostRequest{},
+		Response: NewsletterPostResponse{},
+	})
+	http.HandleFunc("POST /api/newsletters/{jid}/posts", func(w http.ResponseWriter, r *http.Request) {
+		jid, err := newsletterJIDFromPath(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		var req NewsletterPostRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		mediaPath, err := resolveMediaSource(req.MediaPath, req.MediaToken, req.MediaURL)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if req.Message == "" && mediaPath == "" {
+			writeError(w, ErrCodeInvalidRequest, "Message or media is required", nil)
+			return
+		}
+		out, err := prepareWhatsAppMessage(messageStore, jid.String(), req.Message, mediaPath)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		sendErr := sendPreparedMessage(r.Context(), client, messageStore, out)
+		post := NewsletterPost{
+			NewsletterJID: jid.String(),
+			MessageID:     out.ID,
+			ServerID:      int(out.ServerID),
+			Text:          req.Message,
+			MediaType:     out.Preview().Type,
+			Status:        NewsletterPostSent,
+			Time:          time.Now(),
+		}
+		if mediaPath != "" {
+			post.Filename = filepath.Base(mediaPath)
+		}
+		if sendErr != nil {
+			post.Status, post.Error = NewsletterPostFailed, sendErr.Error()
+		}
+		if err := messageStore.StoreNewsletterPost(&post); err != nil {
+			bridgeLog.Warnf("Failed to store post to newsletter %s: %v", jid, err)
+		}
+		if sendErr != nil {
+			writeAPIError(w, "Failed to publish post", sendErr)
+			return
+		}
+		writeJSON(w, http.StatusOK, NewsletterPostResponse{Success: true, Post: post})
+	})
+
+	// Handler for the post history
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/newsletters/{jid}/posts",
+		Summary: "List the posts published to a newsletter through the bridge, failed attempts included, latest first",
+		Tag:     "newsletters",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			jidParam,
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ListNewsletterPostsResponse{},
+	})
+	http.HandleFunc("GET /api/newsletters/{jid}/posts", func(w http.ResponseWriter, r *http.Request) {
+		jid, err := newsletterJIDFromPath(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		posts, err := messageStore.ListNewsletterPosts(jid.String(), limit+1, offset)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list newsletter posts: %v", err), nil)
+			return
+		}
+		posts, page := trimPage(posts, offset, limit)
+		writeJSON(w, http.StatusOK, ListNewsletterPostsResponse{Success: true, Posts: posts, Page: page})
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Reasons events of a chat aren't forwarded to notification systems
+const (
+	suppressedExcluded = "excluded" // The ingestion filters exclude the chat
+	suppressedMuted    = "muted"    // The chat is muted in WhatsApp
+)
+
+// Check why events of a chat shouldn't be forwarded to webhooks and alert
+// chats, empty if they should. Muting comes from the app state synced from the
+// phone, so it follows whatever the user set there. WHATSAPP_NOTIFY_MUTED
+// forwards events of muted chats anyway.
+func notificationSuppression(client *whatsmeow.Client, chat types.JID) string {
+	if isIngestExcluded(chat) {
+		return suppressedExcluded
+	}
+	if client == nil || client.Store == nil || client.Store.ChatSettings == nil || envBool("WHATSAPP_NOTIFY_MUTED", false) {
+		return ""
+	}
+	settings, err := client.Store.ChatSettings.GetChatSettings(context.Background(), chat.ToNonAD())
+	if err != nil {
+		bridgeLog.Warnf("Failed to get chat settings of %s: %v", chat, err)
+		return ""
+	}
+	if settings.Found && settings.MutedUntil.After(time.Now()) {
+		return suppressedMuted
+	}
+	return ""
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// OCR engines
+const (
+	ocrEngineTesseract = "tesseract"
+	ocrEngineHTTP      = "http"
+)
+
+// Largest image sent to an OCR engine
+const maxOCRImageBytes = 20 << 20
+
+// Full-text index over the text recognized in images, kept in sync with the
+// messages table like messages_fts
+const ocrIndexSchema = `
+	CREATE VIRTUAL TABLE messages_ocr_fts USING fts4(content="messages", ocr_text, tokenize=unicode61 "remove_diacritics=1");
+
+	CREATE TRIGGER messages_ocr_fts_delete BEFORE DELETE ON messages WHEN old.ocr_text IS NOT NULL BEGIN
+		DELETE FROM messages_ocr_fts WHERE docid = old.rowid;
+	END;
+	CREATE TRIGGER messages_ocr_fts_update_before BEFORE UPDATE OF ocr_text ON messages WHEN old.ocr_text IS NOT NULL BEGIN
+		DELETE FROM messages_ocr_fts WHERE docid = old.rowid;
+	END;
+	CREATE TRIGGER messages_ocr_fts_update_after AFTER UPDATE OF ocr_text ON messages WHEN new.ocr_text IS NOT NULL BEGIN
+		INSERT INTO messages_ocr_fts(docid, ocr_text) VALUES (new.rowid, new.ocr_text);
+	END;
+`
+
+// Statement rebuilding the recognized text index from the messages table
+const rebuildOCRIndex = "INSERT INTO messages_ocr_fts(messages_ocr_fts) VALUES('rebuild')"
+
+// Create the recognized text index if it doesn't exist yet
+func initOCRIndex(db *sql.DB) error {
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'messages_ocr_fts'").Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(ocrIndexSchema); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(rebuildOCRIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ocrConfig is how text is recognized in images: the tesseract command line
+// tool, or an HTTP service receiving the image as the request body and
+// answering with {"text": "..."} or plain text
+type ocrConfig struct {
+	Engine       string
+	Command      string
+	Languages    string
+	URL          string
+	APIKey       string
+	Timeout      time.Duration
+	AutoDownload bool // Download received images to recognize their text right away
+}
+
+// Get the OCR settings, ok is false if OCR is off
+func loadOCRConfig() (ocrConfig, bool) {
+	cfg := ocrConfig{
+		Engine:       envString("WHATSAPP_OCR_ENGINE", ""),
+		Command:      envString("WHATSAPP_OCR_COMMAND", "tesseract"),
+		Languages:    envString("WHATSAPP_OCR_LANGUAGES", "eng"),
+		URL:          envString("WHATSAPP_OCR_URL", ""),
+		APIKey:       envString("WHATSAPP_OCR_API_KEY", ""),
+		Timeout:      time.Duration(max(envInt("WHATSAPP_OCR_TIMEOUT_SECONDS", 60), 1)) * time.Second,
+		AutoDownload: envBool("WHATSAPP_OCR_AUTO_DOWNLOAD", false),
+	}
+	if cfg.Engine == "" && cfg.URL != "" {
+		cfg.Engine = ocrEngineHTTP
+	}
+	return cfg, cfg.Engine == ocrEngineTesseract || cfg.Engine == ocrEngineHTTP && cfg.URL != ""
+}
+
+// Recognize the text in an image file
+func recognizeText(cfg ocrConfig, path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	if cfg.Engine == ocrEngineTesseract {
+		var stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, cfg.Command, path, "stdout", "-l", cfg.Languages)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("%s failed: %v: %s", cfg.Command, err, strings.TrimSpace(stderr.String()))
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	image, err := io.ReadAll(io.LimitReader(f, maxOCRImageBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(image) > maxOCRImageBytes {
+		return "", fmt.Errorf("image is larger than %d MB", maxOCRImageBytes>>20)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(image))
+	if err != nil {
+		return "", fmt.Errorf("invalid OCR URL: %v", err)
+	}
+	req.Header.Set("Content-Type", http.DetectContentType(image))
+	req.Header.Set("User-Agent", "whatsapp-bridge")
+	if cfg.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 300 {
+		return "", fmt.Errorf("OCR service returned HTTP %d: %s", resp.StatusCode, truncateText(strings.TrimSpace(string(body)), 200))
+	}
+	if strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		var result struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return "", fmt.Errorf("invalid OCR response: %v", err)
+		}
+		return strings.TrimSpace(result.Text), nil
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+// Store the text recognized in the image of a message
+func (store *MessageStore) StoreOCRText(messageID, chatJID, text string) error {
+	_, err := store.db.Exec("UPDATE messages SET ocr_text = ?, ocr_at = ? WHERE id = ? AND chat_jid = ?", text, time.Now(), messageID, chatJID)
+	return err
+}
+
+// Check whether the text of a message's image was recognized already
+func (store *MessageStore) hasOCRText(messageID, chatJID string) bool {
+	var done bool
+	store.db.QueryRow("SELECT ocr_at IS NOT NULL FROM messages WHERE id = ? AND chat_jid = ?", messageID, chatJID).Scan(&done)
+	return done
+}
+
+// ocrJob is a downloaded image waiting for its text to be recognized
+type ocrJob struct {
+	messageID, chatJID, path string
+}
+
+// Downloaded images waiting for the OCR worker
+var ocrQueue = make(chan ocrJob, 256)
+
+// Queue a downloaded image for text recognition, unless OCR is off or the
+// image is view-once
+func queueOCR(messageStore *MessageStore, messageID, chatJID, mediaType, path string) {
+	if mediaType != "image" {
+		return
+	}
+	if _, ok := loadOCRConfig(); !ok {
+		return
+	}
+	if viewOnce, _ := messageStore.IsViewOnce(messageID, chatJID); viewOnce {
+		return
+	}
+	select {
+	case ocrQueue <- ocrJob{messageID, chatJID, path}:
+	default:
+		bridgeLog.Warnf("OCR queue is full, skipping image of message %s", messageID)
+	}
+}
+
+// Recognize the text of queued images one at a time. Does nothing unless
+// WHATSAPP_OCR_ENGINE or WHATSAPP_OCR_URL is set.
+func runOCRWorker(messageStore *MessageStore) {
+	cfg, ok := loadOCRConfig()
+	if !ok {
+		return
+	}
+	bridgeLog.Infof("Recognizing text in downloaded images with %s", cfg.Engine)
+	for job := range ocrQueue {
+		func() {
+			defer recoverPanic("recognizing text in image of message %s", job.messageID)
+			if messageStore.hasOCRText(job.messageID, job.chatJID) {
+				return
+			}
+			text, err := recognizeText(cfg, job.path)
+			if err != nil {
+				// Left for the OCR API to retry
+				bridgeLog.Warnf("Failed to recognize text in image of message %s: %v", job.messageID, err)
+				return
+			}
+			if err := messageStore.StoreOCRText(job.messageID, job.chatJID, text); err != nil {
+				bridgeLog.Warnf("Failed to store text of image of message %s: %v", job.messageID, err)
+			}
+		}()
+	}
+}
+
+// Download a received image so its text gets recognized, if enabled
+func handleOCR(client *whatsmeow.Client, messageStore *MessageStore, msg Message) {
+	if msg.MediaType != "image" {
+		return
+	}
+	if cfg, ok := loadOCRConfig(); !ok || !cfg.AutoDownload {
+		return
+	}
+	goSafe("downloading an image for OCR", func() {
+		// downloadMedia queues the image
+		if _, _, _, _, err := downloadMedia(context.Background(), client, messageStore, msg.ID, msg.ChatJID); err != nil {
+			bridgeLog.Warnf("Failed to download image of message %s for OCR: %v", msg.ID, err)
+		}
+	})
+}
+
+// OCRRequest represents the request body for the OCR API
+type OCRRequest struct {
+	ChatJID       string `json:"chat_jid"`
+	Force         bool   `json:"force,omitempty"` // Recognize the text again even if it was before
+	AllowViewOnce bool   `json:"allow_view_once,omitempty"`
+}
+
+// OCRResponse represents the response for the OCR API
+type OCRResponse struct {
+	Success   bool   `json:"success"`
+	MessageID string `json:"message_id"`
+	ChatJID   string `json:"chat_jid"`
+	Text      string `json:"text"`
+	Cached    bool   `json:"cached,omitempty"` // The text was recognized before
+}
+
+// Register the REST handler recognizing the text of an image on demand
+func registerOCRHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/messages/{id}/ocr",
+		Summary:  "Recognize the text in the image of a message, downloading it if needed; the text is stored with the message and searchable",
+		Tag:      "media",
+		Scope:    ScopeReadMessages,
+		Params:   []apiParam{{Name: "id", In: "path", Description: "ID of the message", Required: true}},
+		Request:  OCRRequest{},
+		Response: OCRResponse{},
+	})
+	http.HandleFunc("POST /api/messages/{id}/ocr", func(w http.ResponseWriter, r *http.Request) {
+		var req OCRRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		messageID := r.PathValue("id")
+		if req.ChatJID == "" {
+			writeError(w, ErrCodeInvalidRequest, "chat_jid is required", nil)
+			return
+		}
+		cfg, ok := loadOCRConfig()
+		if !ok {
+			writeError(w, ErrCodeInvalidRequest, "OCR is off, set WHATSAPP_OCR_ENGINE=tesseract or WHATSAPP_OCR_URL", nil)
+			return
+		}
+		if err := checkViewOnceAccess(messageStore, messageID, req.ChatJID, req.AllowViewOnce); err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		resp := OCRResponse{Success: true, MessageID: messageID, ChatJID: req.ChatJID}
+		if !req.Force && messageStore.hasOCRText(messageID, req.ChatJID) {
+			messageStore.db.QueryRow("SELECT COALESCE(ocr_text, '') FROM messages WHERE id = ? AND chat_jid = ?", messageID, req.ChatJID).Scan(&resp.Text)
+			resp.Cached = true
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+
+		_, mediaType, _, path, err := downloadMedia(r.Context(), client, messageStore, messageID, req.ChatJID)
+		if err != nil {
+			writeAPIError(w, "Failed to download image", err)
+			return
+		}
+		if mediaType != "image" {
+			writeError(w, ErrCodeUnsupportedMedia, fmt.Sprintf("Message %s is %s media, not an image", messageID, mediaType), nil)
+			return
+		}
+		if resp.Text, err = recognizeText(cfg, path); err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to recognize text: %v", err), nil)
+			return
+		}
+		if err := messageStore.StoreOCRText(messageID, req.ChatJID, resp.Text); err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to store recognized text: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
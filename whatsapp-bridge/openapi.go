@@ -0,0 +1,298 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// apiParam documents a query or path parameter of a REST endpoint
+type apiParam struct {
+	Name        string
+	In          string // "query" (default) or "path"
+	Description string
+	Required    bool
+	Type        string // OpenAPI scalar type, defaults to "string"
+}
+
+// apiOperation documents a REST endpoint for the generated OpenAPI spec
+type apiOperation struct {
+	Method   string
+	Path     string
+	Summary  string
+	Tag      string
+	Scope    string // Capability scope a token needs to call the endpoint
+	Audit    bool   // Record calls in the audit log (mutating operations)
+	Public   bool   // Callable without a token, like the health probes
+	Hidden   bool   // Left out of the spec, like the pages serving the docs and web UI
+	MaxBody  int64  // Largest request body accepted, the WHATSAPP_MAX_BODY_BYTES default if 0
+	Params   []apiParam
+	Request  interface{} // Zero value of the JSON request body type, if any
+	Response interface{} // Zero value of the JSON response body type
+}
+
+// All documented REST endpoints, filled in by the register*Handlers functions
+var apiOperations []apiOperation
+
+// Add endpoints to the OpenAPI spec
+func documentAPI(ops ...apiOperation) {
+	apiOperations = append(apiOperations, ops...)
+}
+
+// openAPISchemaBuilder converts Go types into OpenAPI schemas, collecting named structs as components
+type openAPISchemaBuilder struct {
+	components map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Build the schema for a Go type, returning a $ref for named structs
+func (b *openAPISchemaBuilder) schemaFor(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		// encoding/json renders []byte as base64
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": b.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.structSchema(t)
+		}
+		if _, ok := b.components[t.Name()]; !ok {
+			// Reserve the name first so recursive types terminate
+			b.components[t.Name()] = nil
+			b.components[t.Name()] = b.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		// interface{} and anything else we can't describe precisely
+		return map[string]interface{}{}
+	}
+}
+
+// Build an object schema from a struct's exported, JSON-tagged fields
+func (b *openAPISchemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+
+		// Fields of untagged embedded structs are promoted, as encoding/json does
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			embedded := b.structSchema(field.Type)
+			for k, v := range embedded["properties"].(map[string]interface{}) {
+				properties[k] = v
+			}
+			if req, ok := embedded["required"].([]string); ok {
+				required = append(required, req...)
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		properties[name] = b.schemaFor(field.Type)
+		if !strings.Contains(opts, "omitempty") && field.Type.Kind() != reflect.Ptr {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// Generate the OpenAPI 3.0 document for all documented endpoints
+func buildOpenAPISpec() map[string]interface{} {
+	builder := &openAPISchemaBuilder{components: make(map[string]interface{})}
+	paths := make(map[string]map[string]interface{})
+
+	ops := make([]apiOperation, len(apiOperations))
+	copy(ops, apiOperations)
+	sort.SliceStable(ops, func(i, j int) bool { return ops[i].Path < ops[j].Path })
+
+	for _, op := range ops {
+		if op.Hidden {
+			continue
+		}
+		operation := map[string]interface{}{
+			"summary":     op.Summary,
+			"operationId": operationID(op),
+		}
+		if op.Tag != "" {
+			operation["tags"] = []string{op.Tag}
+		}
+		if op.Scope != "" && !op.Public {
+			operation["security"] = []map[string][]string{{"bearerAuth": {}}}
+			operation["x-required-scope"] = op.Scope
+		}
+
+		if len(op.Params) > 0 {
+			var params []map[string]interface{}
+			for _, p := range op.Params {
+				in := p.In
+				if in == "" {
+					in = "query"
+				}
+				typ := p.Type
+				if typ == "" {
+					typ = "string"
+				}
+				params = append(params, map[string]interface{}{
+					"name":        p.Name,
+					"in":          in,
+					"description": p.Description,
+					"required":    p.Required || in == "path",
+					"schema":      map[string]interface{}{"type": typ},
+				})
+			}
+			operation["parameters"] = params
+		}
+
+		if op.Request != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": builder.schemaFor(reflect.TypeOf(op.Request)),
+					},
+				},
+			}
+		}
+
+		response := map[string]interface{}{"description": "Successful response"}
+		if op.Response != nil {
+			response["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": builder.schemaFor(reflect.TypeOf(op.Response)),
+				},
+			}
+		}
+		operation["responses"] = map[string]interface{}{
+			"200": response,
+			"default": map[string]interface{}{
+				"description": "Error envelope with a machine-readable code",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": builder.schemaFor(reflect.TypeOf(ErrorResponse{})),
+					},
+				},
+			},
+		}
+
+		if paths[op.Path] == nil {
+			paths[op.Path] = make(map[string]interface{})
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "WhatsApp Bridge REST API",
+			"description": "REST API exposed by the whatsmeow based WhatsApp bridge.",
+			"version":     "1.0.0",
+		},
+		"servers": []map[string]interface{}{{"url": "/"}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": builder.components,
+			"securitySchemes": map[string]interface{}{
+				"bearerAuth": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// Derive a stable operation ID such as "postApiMediaReupload" from method and path
+func operationID(op apiOperation) string {
+	var sb strings.Builder
+	sb.WriteString(strings.ToLower(op.Method))
+	for _, part := range strings.FieldsFunc(op.Path, func(r rune) bool {
+		return r == '/' || r == '_' || r == '-' || r == '{' || r == '}'
+	}) {
+		sb.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+	return sb.String()
+}
+
+// Swagger UI page loading the spec from /api/openapi.json
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <title>WhatsApp Bridge API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    window.ui = SwaggerUIBundle({ url: "/api/openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
+
+// Register the OpenAPI spec and Swagger UI handlers
+func registerOpenAPIHandlers() {
+	documentAPI(
+		apiOperation{Method: http.MethodGet, Path: "/api/openapi.json", Public: true, Hidden: true},
+		apiOperation{Method: http.MethodGet, Path: "/api/docs", Public: true, Hidden: true},
+	)
+
+	// Handler for the generated OpenAPI document
+	http.HandleFunc("/api/openapi.json", func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		writeJSON(w, http.StatusOK, buildOpenAPISpec())
+	})
+
+	// Handler for the interactive API documentation
+	http.HandleFunc("/api/docs", func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(swaggerUIPage))
+	})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Status of a mutation in the ops log
+const (
+	OpPending     = "pending"     // Recorded, the WhatsApp call hasn't returned yet
+	OpDone        = "done"        // WhatsApp accepted it
+	OpFailed      = "failed"      // WhatsApp rejected it
+	OpInterrupted = "interrupted" // The bridge stopped before the call returned
+	OpRetried     = "retried"     // Interrupted and made again after a restart
+)
+
+// Kinds of mutations recorded in the ops log
+const (
+	OpKindSend        = "send"
+	OpKindPin         = "pin"
+	OpKindStar        = "star"
+	OpKindMute        = "mute"
+	OpKindContact     = "contact"
+	OpKindInteractive = "interactive"
+)
+
+// Operations still pending from before this start were interrupted by a crash
+var opsLogStart = time.Now()
+
+// OpsLogEntry is a mutation recorded before it was made
+type OpsLogEntry struct {
+	ID         int64           `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Kind       string          `json:"kind"`
+	Target     string          `json:"target"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	Status     string          `json:"status"`
+	Error      string          `json:"error,omitempty"`
+	FinishedAt *time.Time      `json:"finished_at,omitempty"`
+}
+
+// sendOp is the payload of a send, enough to make it again with the same
+// message ID so recipients that already got it don't get it twice
+type sendOp struct {
+	Recipient string `json:"recipient"`
+	Message   string `json:"message,omitempty"`
+	MediaPath string `json:"media_path,omitempty"`
+	MessageID string `json:"message_id"`
+}
+
+// Record a mutation about to be made
+func (store *MessageStore) BeginOp(kind, target string, payload interface{}) (int64, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	result, err := store.db.Exec(
+		"INSERT INTO ops_log (created_at, kind, target, payload, status) VALUES (?, ?, ?, ?, ?)",
+		time.Now(), kind, target, string(data), OpPending,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Record the outcome of a mutation
+func (store *MessageStore) FinishOp(id int64, status, errMsg string) error {
+	_, err := store.db.Exec(
+		"UPDATE ops_log SET status = ?, error = ?, finished_at = ? WHERE id = ?",
+		status, errMsg, time.Now(), id,
+	)
+	return err
+}
+
+// List ops log entries, newest first, optionally only those with a status
+func (store *MessageStore) ListOps(status string, before *time.Time, limit, offset int) ([]OpsLogEntry, error) {
+	query := `SELECT id, created_at, kind, COALESCE(target, ''), COALESCE(payload, ''), status,
+		COALESCE(error, ''), finished_at FROM ops_log WHERE 1 = 1`
+	var args []interface{}
+	if status != "" {
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	if before != nil {
+		query += " AND created_at < ?"
+		args = append(args, *before)
+	}
+	query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []OpsLogEntry{}
+	for rows.Next() {
+		var e OpsLogEntry
+		var payload string
+		var finishedAt sql.NullTime
+		if err := rows.Scan(&e.ID, &e.CreatedAt, &e.Kind, &e.Target, &payload, &e.Status, &e.Error, &finishedAt); err != nil {
+			return nil, err
+		}
+		if payload != "" {
+			e.Payload = json.RawMessage(payload)
+		}
+		if finishedAt.Valid {
+			e.FinishedAt = &finishedAt.Time
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Make a mutation, recording it in the ops log first so a crash before
+// WhatsApp answers is noticed on the next start
+func journal(messageStore *MessageStore, kind, target string, payload interface{}, call func() error) error {
+	id, err := messageStore.BeginOp(kind, target, payload)
+	if err != nil {
+		return newAPIError(ErrCodeInternal, "Failed to record %s in the ops log: %v", kind, err)
+	}
+
+	err = call()
+	status, errMsg := OpDone, ""
+	if err != nil {
+		status, errMsg = OpFailed, err.Error()
+	}
+	if finishErr := messageStore.FinishOp(id, status, errMsg); finishErr != nil {
+		bridgeLog.Warnf("Failed to record outcome of op #%d: %v", id, finishErr)
+	}
+	return err
+}
+
+// Deal with mutations a crash interrupted: sends are made again under their
+// original message ID unless WHATSAPP_OPS_RETRY_INTERRUPTED is false, other
+// mutations are only reported
+func reconcileOps(client *whatsmeow.Client, messageStore *MessageStore) {
+	pending, err := messageStore.ListOps(OpPending, &opsLogStart, -1, 0)
+	if err != nil {
+		bridgeLog.Warnf("Failed to list interrupted operations: %v", err)
+		return
+	}
+	retry := envBool("WHATSAPP_OPS_RETRY_INTERRUPTED", true)
+
+	// Oldest first, so interrupted sends go out in their original order
+	for i := len(pending) - 1; i >= 0; i-- {
+		reconcileOp(client, messageStore, pending[i], retry)
+	}
+}
+
+// Deal with one interrupted mutation
+func reconcileOp(client *whatsmeow.Client, messageStore *MessageStore, op OpsLogEntry, retry bool) {
+	defer recoverPanic("reconciling op #%d", op.ID)
+	var payload sendOp
+	if op.Kind != OpKindSend || !retry || json.Unmarshal(op.Payload, &payload) != nil {
+		bridgeLog.Warnf("%s of %s (op #%d) was interrupted, it may not have been applied", op.Kind, op.Target, op.ID)
+		if err := messageStore.FinishOp(op.ID, OpInterrupted, "interrupted by a restart"); err != nil {
+			bridgeLog.Warnf("Failed to update op #%d: %v", op.ID, err)
+		}
+		return
+	}
+
+	err := resendInterrupted(client, messageStore, payload)
+	status, errMsg := OpRetried, ""
+	if err != nil {
+		status, errMsg = OpInterrupted, fmt.Sprintf("retry after restart failed: %v", err)
+		bridgeLog.Warnf("Failed to retry interrupted send to %s (op #%d): %v", op.Target, op.ID, err)
+	} else {
+		bridgeLog.Infof("Retried interrupted send to %s (op #%d)", op.Target, op.ID)
+	}
+	if err := messageStore.FinishOp(op.ID, status, errMsg); err != nil {
+		bridgeLog.Warnf("Failed to update op #%d: %v", op.ID, err)
+	}
+}
+
+// Make an interrupted send again with its original message ID
+func resendInterrupted(client *whatsmeow.Client, messageStore *MessageStore, payload sendOp) error {
+	out, err := prepareWhatsAppMessage(messageStore, payload.Recipient, payload.Message, payload.MediaPath)
+	if err != nil {
+		return err
+	}
+	out.ID = types.MessageID(payload.MessageID)
+	return sendPreparedMessage(context.Background(), client, messageStore, out)
+}
+
+// ListOpsResponse represents the response for the ops log API
+type ListOpsResponse struct {
+	Success bool          `json:"success"`
+	Ops     []OpsLogEntry `json:"ops"`
+	Page
+}
+
+// Register the REST handler listing the ops log
+func registerOpsHandlers(messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/ops",
+		Summary: "List the mutations made through WhatsApp and their outcome, newest first",
+		Tag:     "admin",
+		Scope:   ScopeAdmin,
+		Params: []apiParam{
+			{Name: "status", Description: "Only operations with this status (pending, done, failed, interrupted, retried)"},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ListOpsResponse{},
+	})
+	http.HandleFunc("GET /api/ops", func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		ops, err := messageStore.ListOps(r.URL.Query().Get("status"), nil, limit+1, offset)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list ops log: %v", err), nil)
+			return
+		}
+		// Payloads hold message content, which is redacted like in the logs
+		for i := range ops {
+			if len(ops[i].Payload) > 0 {
+				ops[i].Payload = json.RawMessage(redactJSONContent(string(ops[i].Payload), false))
+			}
+		}
+
+		ops, page := trimPage(ops, offset, limit)
+		writeJSON(w, http.StatusOK, ListOpsResponse{Success: true, Ops: ops, Page: page})
+	})
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// Outbox message statuses
+const (
+	OutboxPending  = "pending"
+	OutboxApproved = "approved" // Approved and being delivered
+	OutboxRejected = "rejected"
+	OutboxSent     = "sent"
+	OutboxFailed   = "failed"
+	OutboxWaiting  = "waiting" // Waiting for the recipient to come online
+	OutboxRetry    = "retry"   // Failed while disconnected, retried after reconnecting
+)
+
+// OutboxMessage is an outbound message waiting for (or past) human approval or
+// the recipient coming online
+type OutboxMessage struct {
+	ID        int64      `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	Caller    string     `json:"caller"`
+	Recipient string     `json:"recipient"`
+	Message   string     `json:"message,omitempty"`
+	MediaPath string     `json:"media_path,omitempty"`
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	DecidedBy string     `json:"decided_by,omitempty"`
+	DecidedAt *time.Time `json:"decided_at,omitempty"`
+	DeliverBy *time.Time `json:"deliver_by,omitempty"` // Sent anyway if the recipient isn't online by then
+	Attempts  int        `json:"attempts,omitempty"`   // Send attempts of a message queued for retry
+}
+
+const outboxColumns = `id, created_at, caller, recipient, COALESCE(message, ''), COALESCE(media_path, ''),
+	status, COALESCE(error, ''), COALESCE(decided_by, ''), decided_at, deliver_by, COALESCE(attempts, 0)`
+
+// Scan an outbox row selected with outboxColumns
+func scanOutboxMessage(row interface{ Scan(...interface{}) error }) (*OutboxMessage, error) {
+	var m OutboxMessage
+	var decidedAt, deliverBy sql.NullTime
+	if err := row.Scan(&m.ID, &m.CreatedAt, &m.Caller, &m.Recipient, &m.Message, &m.MediaPath,
+		&m.Status, &m.Error, &m.DecidedBy, &decidedAt, &deliverBy, &m.Attempts); err != nil {
+		return nil, err
+	}
+	if decidedAt.Valid {
+		m.DecidedAt = &decidedAt.Time
+	}
+	if deliverBy.Valid {
+		m.DeliverBy = &deliverBy.Time
+	}
+	return &m, nil
+}
+
+// Queue a message in the outbox, returning its ID
+func (store *MessageStore) StoreOutboxMessage(caller, recipient, message, mediaPath string) (int64, error) {
+	result, err := store.db.Exec(
+		"INSERT INTO outbox (created_at, caller, recipient, message, media_path, status) VALUES (?, ?, ?, ?, ?, ?)",
+		time.Now(), caller, recipient, message, mediaPath, OutboxPending,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Get an outbox message by ID
+func (store *MessageStore) GetOutboxMessage(id int64) (*OutboxMessage, error) {
+	return scanOutboxMessage(store.db.QueryRow("SELECT "+outboxColumns+" FROM outbox WHERE id = ?", id))
+}
+
+// List outbox messages, newest first, optionally only those with a status
+func (store *MessageStore) ListOutbox(status string, limit, offset int) ([]OutboxMessage, error) {
+	query := "SELECT " + outboxColumns + " FROM outbox"
+	var args []interface{}
+	if status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY id DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []OutboxMessage{}
+	for rows.Next() {
+		m, err := scanOutboxMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, *m)
+	}
+	return messages, rows.Err()
+}
+
+// Record a decision on a pending outbox message. Returns false if the message
+// was no longer pending, so two approvers can't both deliver it.
+func (store *MessageStore) DecideOutboxMessage(id int64, status, decidedBy, reason string) (bool, error) {
+	result, err := store.db.Exec(
+		"UPDATE outbox SET status = ?, decided_by = ?, decided_at = ?, error = ? WHERE id = ? AND status = ?",
+		status, decidedBy, time.Now(), reason, id, OutboxPending,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Move an outbox message from one status to another. Returns false if it no
+// longer had the expected status, so it's only ever delivered once.
+func (store *MessageStore) TransitionOutboxMessage(id int64, from, to string) (bool, error) {
+	result, err := store.db.Exec("UPDATE outbox SET status = ? WHERE id = ? AND status = ?", to, id, from)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Record the delivery result of an approved outbox message
+func (store *MessageStore) UpdateOutboxStatus(id int64, status, errMsg string) error {
+	_, err := store.db.Exec("UPDATE outbox SET status = ?, error = ? WHERE id = ?", status, errMsg, id)
+	return err
+}
+
+// Check whether a message from a caller to a recipient must wait for approval
+func (cfg ApprovalConfig) requiresApproval(token *APIToken, recipient types.JID) bool {
+	if token != nil && token.RequireApproval {
+		return true
+	}
+	for _, r := range cfg.Recipients {
+		if r == "*" || r == recipient.String() || r == recipient.User {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether a chat is the account owner's "message yourself" chat
+func isSelfChat(client *whatsmeow.Client, chat types.JID) bool {
+	if client.Store.ID == nil {
+		return false
+	}
+	return chat.User == client.Store.ID.User || (!client.Store.LID.IsEmpty() && chat.User == client.Store.LID.User)
+}
+
+// Send a text message to the account owner's self-chat
+func sendSelfMessage(ctx context.Context, client *whatsmeow.Client, text string) error {
+	if client.Store.ID == nil || !client.IsConnected() {
+		return fmt.Errorf("not connected to WhatsApp")
+	}
+	return throttle(opSend, func() error {
+		ctx, cancel := callContext(ctx, callSend)
+		defer cancel()
+		_, err := client.SendMessage(ctx, client.Store.ID.ToNonAD(), &waProto.Message{
+			Conversation: proto.String(text),
+		})
+		return err
+	})
+}
+
+// Queue a message for approval, announcing it in the self-chat if configured
+func queueForApproval(ctx context.Context, client waClient, messageStore *MessageStore, cfg ApprovalConfig, caller string, req SendMessageRequest) (int64, error) {
+	id, err := messageStore.StoreOutboxMessage(caller, req.Recipient, req.Message, req.MediaPath)
+	if err != nil {
+		return 0, newAPIError(ErrCodeInternal, "Failed to queue message: %v", err)
+	}
+	bridgeLog.Infof("Message #%d from %s to %s queued for approval", id, caller, req.Recipient)
+
+	if cfg.Notify {
+		text := fmt.Sprintf("Message #%d from %s to %s awaits approval:\n%s", id, caller, req.Recipient, req.Message)
+		if req.MediaPath != "" {
+			text += fmt.Sprintf("\n[file: %s]", req.MediaPath)
+		}
+		text += fmt.Sprintf("\n\nReply /approve %d or /reject %d", id, id)
+		// Only a logged in WhatsApp client has a self-chat to announce it in
+		if live, ok := client.(*whatsmeow.Client); ok {
+			if err := sendSelfMessage(ctx, live, text); err != nil {
+				bridgeLog.Warnf("Failed to announce outbox message #%d: %v", id, err)
+			}
+		}
+	}
+	return id, nil
+}
+
+// Approve a pending outbox message and deliver it
+func approveOutboxMessage(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, id int64, decidedBy string) (*OutboxMessage, error) {
+	if err := decideOutbox(messageStore, id, OutboxApproved, decidedBy, ""); err != nil {
+		return nil, err
+	}
+
+	m, err := messageStore.GetOutboxMessage(id)
+	if err != nil {
+		return nil, newAPIError(ErrCodeInternal, "Failed to load outbox message: %v", err)
+	}
+
+	deliverOutboxMessage(ctx, client, messageStore, m)
+	return m, nil
+}
+
+// Send an outbox message claimed for delivery and record the result
+func deliverOutboxMessage(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, m *OutboxMessage) {
+	status, errMsg := OutboxSent, ""
+	if _, err := sendWhatsAppMessage(ctx, client, messageStore, m.Recipient, m.Message, m.MediaPath); err != nil {
+		status, errMsg = OutboxFailed, err.Error()
+	}
+	if err := messageStore.UpdateOutboxStatus(m.ID, status, errMsg); err != nil {
+		bridgeLog.Warnf("Failed to update outbox message #%d: %v", m.ID, err)
+	}
+	m.Status, m.Error = status, errMsg
+}
+
+// Reject a pending outbox message
+func rejectOutboxMessage(messageStore *MessageStore, id int64, decidedBy, reason string) (*OutboxMessage, error) {
+	if err := decideOutbox(messageStore, id, OutboxRejected, decidedBy, reason); err != nil {
+		return nil, err
+	}
+	m, err := messageStore.GetOutboxMessage(id)
+	if err != nil {
+		return nil, newAPIError(ErrCodeInternal, "Failed to load outbox message: %v", err)
+	}
+	return m, nil
+}
+
+// Move a pending outbox message to a decided status, reporting why it couldn't be
+func decideOutbox(messageStore *MessageStore, id int64, status, decidedBy, reason string) error {
+	ok, err := messageStore.DecideOutboxMessage(id, status, decidedBy, reason)
+	if err != nil {
+		return newAPIError(ErrCodeInternal, "Failed to update outbox message: %v", err)
+	}
+	if ok {
+		return nil
+	}
+
+	m, err := messageStore.GetOutboxMessage(id)
+	if err == sql.ErrNoRows {
+		return newAPIError(ErrCodeNotFound, "Outbox message %d not found", id)
+	} else if err != nil {
+		return newAPIError(ErrCodeInternal, "Failed to load outbox message: %v", err)
+	}
+	return newAPIError(ErrCodeConflict, "Outbox message %d is already %s", id, m.Status)
+}
+
+// Count outbox messages with a status
+func (store *MessageStore) CountOutbox(status string) (int, error) {
+	var n int
+	err := store.db.QueryRow("SELECT COUNT(*) FROM outbox WHERE status = ?", status).Scan(&n)
+	return n, err
+}
+
+// Parse the outbox ID argument of /approve and /reject
+func outboxIDArg(args []string) (int64, error) {
+	if len(args) == 0 {
+		return 0, fmt.Errorf("an outbox message ID is required")
+	}
+	id, err := strconv.ParseInt(strings.TrimPrefix(args[0], "#"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid outbox message ID %s", args[0])
+	}
+	return id, nil
+}
+
+// Register the self-chat commands for deciding on queued messages
+func registerOutboxCommands() {
+	registerSelfCommand(
+		selfCommand{
+			Name:        "approve",
+			Usage:       "<id>",
+			Description: "Approve and deliver a message held for approval",
+			Run: func(cc *commandContext, args []string) (string, error) {
+				id, err := outboxIDArg(args)
+				if err != nil {
+					return "", err
+				}
+				m, err := approveOutboxMessage(context.Background(), cc.client, cc.messageStore, id, "self-chat")
+				if err != nil {
+					return "", err
+				}
+				if m.Status == OutboxFailed {
+					return fmt.Sprintf("Message #%d approved but failed to send: %s", id, m.Error), nil
+				}
+				return fmt.Sprintf("Message #%d sent to %s", id, m.Recipient), nil
+			},
+		},
+		selfCommand{
+			Name:        "reject",
+			Usage:       "<id> [reason]",
+			Description: "Reject a message held for approval",
+			Run: func(cc *commandContext, args []string) (string, error) {
+				id, err := outboxIDArg(args)
+				if err != nil {
+					return "", err
+				}
+				if _, err := rejectOutboxMessage(cc.messageStore, id, "self-chat", strings.Join(args[1:], " ")); err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("Message #%d rejected", id), nil
+			},
+		},
+	)
+}
+
+// ListOutboxResponse represents the response for the list outbox API
+type ListOutboxResponse struct {
+	Success  bool            `json:"success"`
+	Messages []OutboxMessage `json:"messages"`
+	Page
+}
+
+// OutboxMessageResponse represents the response for the outbox message APIs
+type OutboxMessageResponse struct {
+	Success bool           `json:"success"`
+	Message *OutboxMessage `json:"message"`
+}
+
+// RejectOutboxRequest represents the optional request body for rejecting a message
+type RejectOutboxRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// Parse the {id} path value of an outbox route
+func outboxIDFromPath(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return 0, newAPIError(ErrCodeInvalidRequest, "Outbox ID must be an integer")
+	}
+	return id, nil
+}
+
+// Register the REST handlers for reviewing and deciding on queued messages
+func registerOutboxHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	idParam := apiParam{Name: "id", In: "path", Description: "ID of the outbox message", Required: true, Type: "integer"}
+
+	// Handler for listing queued messages
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/outbox",
+		Summary: "List outbound messages held for approval, the recipient coming online or a retry, newest first",
+		Tag:     "outbox",
+		Scope:   ScopeSendMessages,
+		Params: []apiParam{
+			{Name: "status", Description: "Only messages with this status (pending, waiting, retry, rejected, sent, failed)"},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ListOutboxResponse{},
+	})
+	http.HandleFunc("GET /api/outbox", func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		messages, err := messageStore.ListOutbox(r.URL.Query().Get("status"), limit+1, offset)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list outbox: %v", err), nil)
+			return
+		}
+
+		messages, page := trimPage(messages, offset, limit)
+		writeJSON(w, http.StatusOK, ListOutboxResponse{Success: true, Messages: messages, Page: page})
+	})
+
+	// Handler for checking on a single queued message
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/outbox/{id}",
+		Summary:  "Get an outbound message held for approval",
+		Tag:      "outbox",
+		Scope:    ScopeSendMessages,
+		Params:   []apiParam{idParam},
+		Response: OutboxMessageResponse{},
+	})
+	http.HandleFunc("GET /api/outbox/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := outboxIDFromPath(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		m, err := messageStore.GetOutboxMessage(id)
+		if err == sql.ErrNoRows {
+			writeError(w, ErrCodeNotFound, fmt.Sprintf("Outbox message %d not found", id), nil)
+			return
+		} else if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to load outbox message: %v", err), nil)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, OutboxMessageResponse{Success: true, Message: m})
+	})
+
+	// Handler for approving and delivering a queued message
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/outbox/{id}/approve",
+		Summary:  "Approve a pending outbound message and deliver it",
+		Tag:      "outbox",
+		Scope:    ScopeAdmin,
+		Audit:    true,
+		Params:   []apiParam{idParam},
+		Response: OutboxMessageResponse{},
+	})
+	http.HandleFunc("POST /api/outbox/{id}/approve", func(w http.ResponseWriter, r *http.Request) {
+		id, err := outboxIDFromPath(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		m, err := approveOutboxMessage(r.Context(), client, messageStore, id, callerName(r))
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if m.Status == OutboxFailed {
+			writeError(w, ErrCodeSendFailed, fmt.Sprintf("Message approved but failed to send: %s", m.Error), m)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, OutboxMessageResponse{Success: true, Message: m})
+	})
+
+	// Handler for rejecting a queued message
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/outbox/{id}/reject",
+		Summary:  "Reject a pending outbound message",
+		Tag:      "outbox",
+		Scope:    ScopeAdmin,
+		Audit:    true,
+		Params:   []apiParam{idParam},
+		Request:  RejectOutboxRequest{},
+		Response: OutboxMessageResponse{},
+	})
+	http.HandleFunc("POST /api/outbox/{id}/reject", func(w http.ResponseWriter, r *http.Request) {
+		id, err := outboxIDFromPath(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		// The body with the reason is optional
+		var req RejectOutboxRequest
+		if r.ContentLength != 0 && !decodeJSON(w, r, &req) {
+			return
+		}
+
+		m, err := rejectOutboxMessage(messageStore, id, callerName(r), req.Reason)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, OutboxMessageResponse{Success: true, Message: m})
+	})
+}
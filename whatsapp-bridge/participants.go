@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Number of groups whose participants are written per transaction
+const participantWriteBatch = 25
+
+// Background job syncing the participants of all joined groups
+var participantSync = newSyncJob("participants")
+
+// Replace the stored participants of a batch of groups in a single transaction
+func (store *MessageStore) ReplaceGroupParticipants(groups []*types.GroupInfo) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.Prepare(
+		`INSERT OR REPLACE INTO group_participants
+		(group_jid, participant_jid, phone_number, lid, is_admin, is_super_admin, display_name, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+	)
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	now := time.Now()
+	for _, group := range groups {
+		groupJID := group.JID.String()
+		if _, err := tx.Exec("DELETE FROM group_participants WHERE group_jid = ?", groupJID); err != nil {
+			return err
+		}
+		for _, p := range group.Participants {
+			phone, lid := "", ""
+			if !p.PhoneNumber.IsEmpty() {
+				phone = p.PhoneNumber.String()
+			}
+			if !p.LID.IsEmpty() {
+				lid = p.LID.String()
+			}
+			if _, err := insert.Exec(groupJID, p.JID.String(), phone, lid, p.IsAdmin, p.IsSuperAdmin, p.DisplayName, now); err != nil {
+				return err
+			}
+		}
+		if group.Name != "" {
+			if _, err := tx.Exec("UPDATE chats SET name = ? WHERE jid = ? AND jid NOT IN (SELECT jid FROM contact_overrides)",
+				group.Name, groupJID); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// Sync the participants of all joined groups. Group infos are fetched by a bounded,
+// rate-limited worker pool and written by a single writer in batches.
+func PopulateGroupParticipants(client *whatsmeow.Client, messageStore *MessageStore, job *syncJob) error {
+	if !client.IsConnected() {
+		return fmt.Errorf("not connected to WhatsApp")
+	}
+
+	// The joined groups list usually includes the participants already
+	var groups []*types.GroupInfo
+	err := throttle(opQuery, func() (err error) {
+		ctx, cancel := callContext(context.Background(), callQuery)
+		defer cancel()
+		groups, err = client.GetJoinedGroups(ctx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get joined groups: %v", err)
+	}
+	job.setTotal(len(groups))
+
+	limiter := newRateLimiter(envInt("WHATSAPP_PARTICIPANT_SYNC_RATE", 5))
+	defer limiter.stop()
+
+	work := make(chan *types.GroupInfo)
+	results := make(chan *types.GroupInfo, participantWriteBatch)
+
+	var wg sync.WaitGroup
+	for i := 0; i < max(envInt("WHATSAPP_PARTICIPANT_SYNC_WORKERS", 4), 1); i++ {
+		wg.Add(1)
+		goSafe("fetching group participants", func() {
+			defer wg.Done()
+			for group := range work {
+				func() {
+					defer recoverPanic("fetching participants of %s", group.JID)
+					if len(group.Participants) == 0 {
+						limiter.wait()
+						var info *types.GroupInfo
+						err := throttle(opQuery, func() (err error) {
+							ctx, cancel := callContext(context.Background(), callQuery)
+							defer cancel()
+							info, err = client.GetGroupInfo(ctx, group.JID)
+							return err
+						})
+						if err != nil {
+							bridgeLog.Warnf("Failed to get participants of %s: %v", group.JID, err)
+							job.advance(1)
+							return
+						}
+						group = info
+					}
+					results <- group
+				}()
+			}
+		})
+	}
+
+	goSafe("queueing groups for participant sync", func() {
+		for _, group := range groups {
+			work <- group
+		}
+		close(work)
+		wg.Wait()
+		close(results)
+	})
+
+	// Write the results in batches
+	var batch []*types.GroupInfo
+	var writeErr error
+	flush := func() {
+		if len(batch) == 0 || writeErr != nil {
+			return
+		}
+		if err := messageStore.ReplaceGroupParticipants(batch); err != nil {
+			writeErr = fmt.Errorf("failed to store participants: %v", err)
+		}
+		job.advance(len(batch))
+		batch = batch[:0]
+	}
+	for group := range results {
+		batch = append(batch, group)
+		if len(batch) >= participantWriteBatch {
+			flush()
+		}
+	}
+	flush()
+
+	return writeErr
+}
+
+// SyncStatusResponse represents the response for the sync status APIs
+type SyncStatusResponse struct {
+	Success bool       `json:"success"`
+	Message string     `json:"message,omitempty"`
+	Status  SyncStatus `json:"status"`
+}
+
+// Register the REST handlers for triggering and monitoring the participant sync
+func registerParticipantHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	// Handler for the participant sync status
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/sync/participants",
+		Summary:  "Get the status of the group participant sync",
+		Tag:      "sync",
+		Scope:    ScopeReadMessages,
+		Response: SyncStatusResponse{},
+	})
+	http.HandleFunc("GET /api/sync/participants", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, SyncStatusResponse{Success: true, Status: participantSync.Status()})
+	})
+
+	// Handler for starting the participant sync
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/sync/participants",
+		Summary:  "Sync the participants of all joined groups in the background",
+		Tag:      "sync",
+		Scope:    ScopeManageGroups,
+		Audit:    true,
+		Response: SyncStatusResponse{},
+	})
+	http.HandleFunc("POST /api/sync/participants", func(w http.ResponseWriter, r *http.Request) {
+		started := participantSync.start(func(j *syncJob) error {
+			return PopulateGroupParticipants(client, messageStore, j)
+		})
+		if !started {
+			writeError(w, ErrCodeConflict, "Participant sync is already running", participantSync.Status())
+			return
+		}
+		writeJSON(w, http.StatusAccepted, SyncStatusResponse{
+			Success: true,
+			Message: "Participant sync started",
+			Status:  participantSync.Status(),
+		})
+	})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/proto/waWeb"
+)
+
+// Media type of stored payment messages
+const mediaTypePayment = "payment"
+
+// Kinds of payment messages
+const (
+	PaymentKindSend    = "send"    // Money sent
+	PaymentKindRequest = "request" // Money requested
+	PaymentKindDecline = "decline" // A request was declined
+	PaymentKindCancel  = "cancel"  // A request was cancelled by its sender
+	PaymentKindInvite  = "invite"  // An invitation to set up payments
+)
+
+// Payment is the metadata of a payment message, as far as WhatsApp shares it
+type Payment struct {
+	ChatJID          string    `json:"chat_jid"`
+	MessageID        string    `json:"message_id"`
+	Time             time.Time `json:"timestamp"`
+	Kind             string    `json:"kind"`
+	Amount           *float64  `json:"amount,omitempty"`
+	Currency         string    `json:"currency,omitempty"` // ISO 4217 code
+	Status           string    `json:"status,omitempty"`   // Only known for messages from history sync
+	Note             string    `json:"note,omitempty"`
+	RequestMessageID string    `json:"request_message_id,omitempty"` // Request a payment, decline or cancel refers to
+}
+
+// Get the amount of a WhatsApp money value
+func moneyAmount(m *waProto.Money) *float64 {
+	if m == nil || m.GetValue() == 0 {
+		return nil
+	}
+	amount := float64(m.GetValue()) / math.Pow10(int(m.GetOffset()))
+	return &amount
+}
+
+// Get the amount of a value in thousandths
+func amount1000(v uint64) *float64 {
+	if v == 0 {
+		return nil
+	}
+	amount := float64(v) / 1000
+	return &amount
+}
+
+// Extract the payment a message carries, nil if it isn't a payment message.
+// Messages from history sync come with payment info holding the amount and
+// status of sent money, which live messages lack.
+func extractPayment(m *waProto.Message, info *waWeb.PaymentInfo) *Payment {
+	var p Payment
+	switch {
+	case m.GetRequestPaymentMessage() != nil:
+		req := m.GetRequestPaymentMessage()
+		p.Kind = PaymentKindRequest
+		p.Note = extractTextContent(req.GetNoteMessage())
+		p.Amount, p.Currency = moneyAmount(req.GetAmount()), req.GetAmount().GetCurrencyCode()
+		if p.Amount == nil {
+			p.Amount = amount1000(req.GetAmount1000())
+		}
+		if p.Currency == "" {
+			p.Currency = req.GetCurrencyCodeIso4217()
+		}
+	case m.GetSendPaymentMessage() != nil:
+		send := m.GetSendPaymentMessage()
+		p.Kind = PaymentKindSend
+		p.Note = extractTextContent(send.GetNoteMessage())
+		p.RequestMessageID = send.GetRequestMessageKey().GetID()
+	case m.GetDeclinePaymentRequestMessage() != nil:
+		p.Kind = PaymentKindDecline
+		p.RequestMessageID = m.GetDeclinePaymentRequestMessage().GetKey().GetID()
+	case m.GetCancelPaymentRequestMessage() != nil:
+		p.Kind = PaymentKindCancel
+		p.RequestMessageID = m.GetCancelPaymentRequestMessage().GetKey().GetID()
+	case m.GetPaymentInviteMessage() != nil:
+		p.Kind = PaymentKindInvite
+	default:
+		return nil
+	}
+
+	if info != nil {
+		if p.Amount == nil {
+			p.Amount = moneyAmount(info.GetPrimaryAmount())
+		}
+		if p.Amount == nil {
+			p.Amount = amount1000(info.GetAmount1000())
+		}
+		if p.Currency == "" {
+			p.Currency = info.GetPrimaryAmount().GetCurrencyCode()
+		}
+		if p.Currency == "" {
+			p.Currency = info.GetCurrency()
+		}
+		if info.GetStatus() != waWeb.PaymentInfo_UNKNOWN_STATUS {
+			p.Status = strings.ToLower(info.GetStatus().String())
+		}
+	}
+	return &p
+}
+
+// Describe a payment as message content, so it shows up in listings and search
+func (p *Payment) Summary() string {
+	var b strings.Builder
+	switch p.Kind {
+	case PaymentKindSend:
+		b.WriteString("Payment sent")
+	case PaymentKindRequest:
+		b.WriteString("Payment requested")
+	case PaymentKindDecline:
+		b.WriteString("Payment request declined")
+	case PaymentKindCancel:
+		b.WriteString("Payment request cancelled")
+	case PaymentKindInvite:
+		b.WriteString("Payment invite")
+	}
+	if p.Amount != nil {
+		fmt.Fprintf(&b, ": %.2f %s", *p.Amount, p.Currency)
+	}
+	if p.Status != "" {
+		fmt.Fprintf(&b, " (%s)", p.Status)
+	}
+	if p.Note != "" {
+		b.WriteString(" - " + p.Note)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// Store the metadata of a payment message, replacing what was stored before
+func (store *MessageStore) StorePayment(p *Payment) error {
+	_, err := store.db.Exec(
+		`INSERT OR REPLACE INTO payments (chat_jid, message_id, timestamp, kind, amount, currency, status, note, request_message_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		p.ChatJID, p.MessageID, p.Time, p.Kind, p.Amount, p.Currency, p.Status, p.Note, p.RequestMessageID,
+	)
+	return err
+}
+
+// Record the payment of a stored message, if it carries one
+func handlePayment(messageStore *MessageStore, id, chatJID string, timestamp time.Time, p *Payment) {
+	if p == nil {
+		return
+	}
+	p.ChatJID, p.MessageID, p.Time = chatJID, id, timestamp
+	if err := messageStore.StorePayment(p); err != nil {
+		bridgeLog.Warnf("Failed to store payment of message %s: %v", id, err)
+	}
+}
+
+// List payment messages, of one chat or all chats and optionally of one kind, latest first
+func (store *MessageStore) ListPayments(chatJID, kind string, after, before *time.Time, limit, offset int) ([]Payment, error) {
+	var conditions []string
+	var args []interface{}
+	if chatJID != "" {
+		conditions = append(conditions, "chat_jid = ?")
+		args = append(args, chatJID)
+	}
+	if kind != "" {
+		conditions = append(conditions, "kind = ?")
+		args = append(args, kind)
+	}
+	if after != nil {
+		conditions = append(conditions, "timestamp > ?")
+		args = append(args, after.Local())
+	}
+	if before != nil {
+		conditions = append(conditions, "timestamp < ?")
+		args = append(args, before.Local())
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit, offset)
+
+	rows, err := store.db.Query(
+		`SELECT chat_jid, message_id, timestamp, kind, amount, COALESCE(currency, ''), COALESCE(status, ''), COALESCE(note, ''),
+			COALESCE(request_message_id, '')
+		FROM payments`+where+` ORDER BY timestamp DESC LIMIT ? OFFSET ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	payments := []Payment{}
+	for rows.Next() {
+		var p Payment
+		if err := rows.Scan(&p.ChatJID, &p.MessageID, &p.Time, &p.Kind, &p.Amount, &p.Currency, &p.Status, &p.Note,
+			&p.RequestMessageID); err != nil {
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
+
+// ListPaymentsResponse represents the response for the payments API
+type ListPaymentsResponse struct {
+	Success  bool      `json:"success"`
+	Payments []Payment `json:"payments"`
+	Page
+}
+
+// Register the REST handler listing payment messages
+func registerPaymentHandlers(messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/payments",
+		Summary: "List payment messages (sent money, requests, declines, cancellations and invites) with their amount and status where WhatsApp shares them, latest first",
+		Tag:     "messages",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "chat_jid", Description: "Only payments in this chat"},
+			{Name: "kind", Description: "Only payments of this kind (send, request, decline, cancel, invite)"},
+			{Name: "after_time", Description: "Only payments after this time" + timeFormatsHint},
+			{Name: "before_time", Description: "Only payments before this time" + timeFormatsHint},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ListPaymentsResponse{},
+	})
+	http.HandleFunc("GET /api/payments", func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		after, err := parseTimeParam(r, "after_time")
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		before, err := parseTimeParam(r, "before_time")
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		query := r.URL.Query()
+		payments, err := messageStore.ListPayments(query.Get("chat_jid"), query.Get("kind"), after, before, limit+1, offset)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list payments: %v", err), nil)
+			return
+		}
+		payments, page := trimPage(payments, offset, limit)
+		writeJSON(w, http.StatusOK, ListPaymentsResponse{Success: true, Payments: payments, Page: page})
+	})
+}
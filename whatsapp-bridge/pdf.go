@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+// Default command printing the metadata of a PDF, {input} is replaced with
+// the file path. The Pages and Title lines of pdfinfo's output are read.
+const defaultPDFInfoCommand = "pdfinfo {input}"
+
+// Default command rendering the first page of a PDF to {output}.jpg, {input}
+// is replaced with the file path and {output} with a path without extension
+const defaultPDFThumbnailCommand = "pdftoppm -jpeg -f 1 -l 1 -scale-to 480 -singlefile {input} {output}"
+
+// Largest side of the first page thumbnail of a PDF
+const documentThumbnailSize = 240
+
+// Read the page count and title of a PDF
+func pdfInfo(path string) (pages uint32, title string, err error) {
+	out, err := runCommandTemplate("WHATSAPP_PDF_INFO_COMMAND", defaultPDFInfoCommand, map[string]string{"input": path}, 30*time.Second)
+	if err != nil {
+		return 0, "", err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Pages":
+			n, _ := strconv.ParseUint(value, 10, 32)
+			pages = uint32(n)
+		case "Title":
+			title = value
+		}
+	}
+	return pages, title, scanner.Err()
+}
+
+// Render the first page of a PDF as a JPEG thumbnail, returning its size too
+func pdfThumbnail(path string) ([]byte, image.Point, error) {
+	dir, err := os.MkdirTemp("", "pdf")
+	if err != nil {
+		return nil, image.Point{}, err
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "page")
+	vars := map[string]string{"input": path, "output": output}
+	if _, err := runCommandTemplate("WHATSAPP_PDF_THUMBNAIL_COMMAND", defaultPDFThumbnailCommand, vars, time.Minute); err != nil {
+		return nil, image.Point{}, err
+	}
+	f, err := os.Open(output + ".jpg")
+	if os.IsNotExist(err) {
+		f, err = os.Open(output)
+	}
+	if err != nil {
+		return nil, image.Point{}, err
+	}
+	defer f.Close()
+	page, err := jpeg.Decode(f)
+	if err != nil {
+		return nil, image.Point{}, err
+	}
+	thumbnail, err := jpegThumbnail(page, documentThumbnailSize)
+	if err != nil {
+		return nil, image.Point{}, err
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(thumbnail))
+	return thumbnail, image.Pt(cfg.Width, cfg.Height), err
+}
+
+// Fill in the page count, title and first page thumbnail of an outgoing PDF
+// so recipients see a rich preview. A PDF that can't be read is sent without them.
+func preparePDF(out *outgoingMessage) {
+	name := filepath.Base(out.MediaPath)
+	pages, title, err := pdfInfo(out.MediaPath)
+	if err != nil {
+		bridgeLog.Warnf("Failed to read metadata of PDF %s: %v", name, err)
+	}
+	out.PageCount, out.Title = pages, title
+
+	thumbnail, size, err := pdfThumbnail(out.MediaPath)
+	if err != nil {
+		bridgeLog.Warnf("Failed to make a thumbnail of PDF %s: %v", name, err)
+		return
+	}
+	out.Thumbnail = thumbnail
+	out.Width, out.Height = uint32(size.X), uint32(size.Y)
+}
+
+// DocumentInfo is the metadata of a document
+type DocumentInfo struct {
+	PageCount uint32 `json:"page_count,omitempty"`
+	Title     string `json:"title,omitempty"`
+}
+
+// Store the metadata of the document of a message, keeping what is known
+// when a field is missing
+func (store *MessageStore) StoreDocumentInfo(messageID, chatJID string, info DocumentInfo) error {
+	if info.PageCount == 0 && info.Title == "" {
+		return nil
+	}
+	_, err := store.db.Exec(
+		`UPDATE messages SET document_pages = COALESCE(NULLIF(?, 0), document_pages),
+			document_title = COALESCE(NULLIF(?, ''), document_title)
+		WHERE id = ? AND chat_jid = ?`,
+		info.PageCount, info.Title, messageID, chatJID,
+	)
+	return err
+}
+
+// Record the page count and title a received document message carries
+func handleDocumentInfo(messageStore *MessageStore, doc *waProto.DocumentMessage, messageID, chatJID string) {
+	if doc == nil {
+		return
+	}
+	// The title is the file name unless the sender's client set a real one
+	title := doc.GetTitle()
+	if title == doc.GetFileName() {
+		title = ""
+	}
+	info := DocumentInfo{PageCount: doc.GetPageCount(), Title: title}
+	if err := messageStore.StoreDocumentInfo(messageID, chatJID, info); err != nil {
+		bridgeLog.Warnf("Failed to store document metadata of message %s: %v", messageID, err)
+	}
+}
+
+// Read the metadata of a downloaded PDF, for documents whose message didn't carry it
+func recordPDFInfo(messageStore *MessageStore, messageID, chatJID, path string) {
+	if !strings.EqualFold(filepath.Ext(path), ".pdf") {
+		return
+	}
+	var pages int
+	messageStore.db.QueryRow("SELECT COALESCE(document_pages, 0) FROM messages WHERE id = ? AND chat_jid = ?", messageID, chatJID).Scan(&pages)
+	if pages > 0 {
+		return
+	}
+	count, title, err := pdfInfo(path)
+	if err != nil {
+		bridgeLog.Debugf("Failed to read metadata of PDF of message %s: %v", messageID, err)
+		return
+	}
+	if err := messageStore.StoreDocumentInfo(messageID, chatJID, DocumentInfo{PageCount: count, Title: title}); err != nil {
+		bridgeLog.Warnf("Failed to store document metadata of message %s: %v", messageID, err)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// How long a message can stay pinned, as offered by the WhatsApp apps
+var pinDurations = map[string]time.Duration{
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+}
+
+// Pin duration used when none is given, the default of the WhatsApp apps
+const defaultPinDuration = "7d"
+
+// PinnedMessage is a message currently pinned in a chat
+type PinnedMessage struct {
+	ChatJID   string    `json:"chat_jid"`
+	MessageID string    `json:"message_id"`
+	PinnedBy  string    `json:"pinned_by"`
+	PinnedAt  time.Time `json:"pinned_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Message   *Message  `json:"message,omitempty"`
+}
+
+// Record a message as pinned in its chat, replacing an earlier pin of it
+func (store *MessageStore) StorePin(pin PinnedMessage) error {
+	_, err := store.db.Exec(
+		`INSERT OR REPLACE INTO pinned_messages (chat_jid, message_id, pinned_by, pinned_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)`,
+		pin.ChatJID, pin.MessageID, pin.PinnedBy, pin.PinnedAt, pin.ExpiresAt,
+	)
+	return err
+}
+
+// Forget the pin of a message, returns false if it wasn't pinned
+func (store *MessageStore) DeletePin(chatJID, messageID string) (bool, error) {
+	result, err := store.db.Exec("DELETE FROM pinned_messages WHERE chat_jid = ? AND message_id = ?", chatJID, messageID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// List the pins that haven't expired yet, of one chat or all chats, latest first
+func (store *MessageStore) ListPins(chatJID string) ([]PinnedMessage, error) {
+	query := "SELECT chat_jid, message_id, pinned_by, pinned_at, expires_at FROM pinned_messages WHERE expires_at > ?"
+	args := []interface{}{time.Now()}
+	if chatJID != "" {
+		query += " AND chat_jid = ?"
+		args = append(args, chatJID)
+	}
+	rows, err := store.db.Query(query+" ORDER BY pinned_at DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pins := []PinnedMessage{}
+	for rows.Next() {
+		var pin PinnedMessage
+		if err := rows.Scan(&pin.ChatJID, &pin.MessageID, &pin.PinnedBy, &pin.PinnedAt, &pin.ExpiresAt); err != nil {
+			return nil, err
+		}
+		pins = append(pins, pin)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Attach the pinned messages we have stored
+	for i := range pins {
+		rows, err := store.db.Query("SELECT "+messageColumns+" FROM messages WHERE id = ? AND chat_jid = ?", pins[i].MessageID, pins[i].ChatJID)
+		if err != nil {
+			return nil, err
+		}
+		messages, err := scanMessages(rows)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) > 0 {
+			pins[i].Message = &messages[0]
+		}
+	}
+	return pins, nil
+}
+
+// Track pins and unpins made in a chat, by us on other devices or by others
+func handlePinMessage(messageStore *MessageStore, msg *events.Message, pin *waProto.PinInChatMessage) {
+	chatJID := msg.Info.Chat.String()
+	messageID := pin.GetKey().GetID()
+	if messageID == "" {
+		return
+	}
+
+	switch pin.GetType() {
+	case waProto.PinInChatMessage_PIN_FOR_ALL:
+		pinnedAt := msg.Info.Timestamp
+		if ms := pin.GetSenderTimestampMS(); ms > 0 {
+			pinnedAt = time.UnixMilli(ms)
+		}
+		duration := time.Duration(msg.Message.GetMessageContextInfo().GetMessageAddOnDurationInSecs()) * time.Second
+		if duration <= 0 {
+			duration = pinDurations[defaultPinDuration]
+		}
+		err := messageStore.StorePin(PinnedMessage{
+			ChatJID:   chatJID,
+			MessageID: messageID,
+			PinnedBy:  msg.Info.Sender.User,
+			PinnedAt:  pinnedAt,
+			ExpiresAt: pinnedAt.Add(duration),
+		})
+		if err != nil {
+			bridgeLog.Warnf("Failed to store pin of message %s: %v", messageID, err)
+		}
+	case waProto.PinInChatMessage_UNPIN_FOR_ALL:
+		if _, err := messageStore.DeletePin(chatJID, messageID); err != nil {
+			bridgeLog.Warnf("Failed to remove pin of message %s: %v", messageID, err)
+		}
+	}
+}
+
+// Pin or unpin a message for everyone in its chat
+func pinMessage(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, chatJID, messageID string, pinned bool, duration time.Duration) error {
+	if !client.IsConnected() {
+		return newAPIError(ErrCodeNotConnected, "Not connected to WhatsApp")
+	}
+	chat, senderJID, _, err := storedMessageKey(client, messageStore, chatJID, messageID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	pinType := waProto.PinInChatMessage_UNPIN_FOR_ALL
+	if pinned {
+		pinType = waProto.PinInChatMessage_PIN_FOR_ALL
+	}
+	msg := &waProto.Message{
+		PinInChatMessage: &waProto.PinInChatMessage{
+			Key:               client.BuildMessageKey(chat, senderJID, messageID),
+			Type:              pinType.Enum(),
+			SenderTimestampMS: proto.Int64(now.UnixMilli()),
+		},
+	}
+	if pinned {
+		msg.MessageContextInfo = &waProto.MessageContextInfo{
+			MessageAddOnDurationInSecs: proto.Uint32(uint32(duration.Seconds())),
+		}
+	}
+	payload := map[string]interface{}{"chat_jid": chatJID, "message_id": messageID, "pinned": pinned}
+	err = journal(messageStore, OpKindPin, chatJID, payload, func() error {
+		return throttle(opSend, func() error {
+			ctx, cancel := callContext(ctx, callSend)
+			defer cancel()
+			_, err := client.SendMessage(ctx, chat, msg)
+			return err
+		})
+	})
+	if err != nil {
+		return newCallError(ErrCodeSendFailed, err, "Failed to send pin: %v", err)
+	}
+
+	if !pinned {
+		_, err = messageStore.DeletePin(chatJID, messageID)
+		return err
+	}
+	return messageStore.StorePin(PinnedMessage{
+		ChatJID:   chatJID,
+		MessageID: messageID,
+		PinnedBy:  client.Store.ID.User,
+		PinnedAt:  now,
+		ExpiresAt: now.Add(duration),
+	})
+}
+
+// PinMessageRequest represents the request body for pinning a message
+type PinMessageRequest struct {
+	ChatJID   string `json:"chat_jid"`
+	MessageID string `json:"message_id"`
+	Pinned    *bool  `json:"pinned,omitempty"`   // Defaults to true
+	Duration  string `json:"duration,omitempty"` // 24h, 7d or 30d, defaults to 7d
+}
+
+// ListPinsResponse represents the response for the pinned messages API
+type ListPinsResponse struct {
+	Success bool            `json:"success"`
+	Pins    []PinnedMessage `json:"pins"`
+}
+
+// Register the REST handlers for pinning messages
+func registerPinHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	// Handler for pinning and unpinning messages
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/messages/pin",
+		Summary:  "Pin or unpin a message for everyone in its chat",
+		Tag:      "messages",
+		Scope:    ScopeSendMessages,
+		Audit:    true,
+		Request:  PinMessageRequest{},
+		Response: StatusResponse{},
+	})
+	http.HandleFunc("POST /api/messages/pin", func(w http.ResponseWriter, r *http.Request) {
+		var req PinMessageRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if req.ChatJID == "" || req.MessageID == "" {
+			writeError(w, ErrCodeInvalidRequest, "Message ID and Chat JID are required", nil)
+			return
+		}
+		pinned := req.Pinned == nil || *req.Pinned
+		if req.Duration == "" {
+			req.Duration = defaultPinDuration
+		}
+		duration, ok := pinDurations[req.Duration]
+		if !ok {
+			writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("Invalid pin duration %q", req.Duration), map[string][]string{"duration": {"24h", "7d", "30d"}})
+			return
+		}
+
+		if err := pinMessage(r.Context(), client, messageStore, req.ChatJID, req.MessageID, pinned, duration); err != nil {
+			writeAPIError(w, "Failed to pin message", err)
+			return
+		}
+		action := "pinned"
+		if !pinned {
+			action = "unpinned"
+		}
+		writeJSON(w, http.StatusOK, StatusResponse{Success: true, Message: fmt.Sprintf("Message %s %s", req.MessageID, action)})
+	})
+
+	// Handler for listing the pinned messages
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/messages/pinned",
+		Summary: "List the messages currently pinned, per chat or across all chats",
+		Tag:     "messages",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "chat_jid", Description: "Only pins of this chat"},
+		},
+		Response: ListPinsResponse{},
+	})
+	http.HandleFunc("GET /api/messages/pinned", func(w http.ResponseWriter, r *http.Request) {
+		pins, err := messageStore.ListPins(r.URL.Query().Get("chat_jid"))
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list pinned messages: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, ListPinsResponse{Success: true, Pins: pins})
+	})
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Default and maximum time a message waits for its recipient to come online
+const (
+	defaultOnlineWait = 60 * time.Minute
+	maxOnlineWait     = 7 * 24 * time.Hour
+)
+
+// How often messages whose wait has run out are sent anyway
+const onlineWaitCheckInterval = time.Minute
+
+// Ways the bridge shows itself online, set with WHATSAPP_PRESENCE. WhatsApp
+// must be acknowledged every message, but while the bridge isn't online the
+// receipts it sends are inactive ones, which don't mark messages delivered.
+const (
+	presenceAuto    = "auto"    // Online once waiting for someone to come online (the default)
+	presenceOnline  = "online"  // Online whenever connected, messages show as delivered at once
+	presenceOffline = "offline" // Never online, send_when_online then sends when the wait runs out
+)
+
+// Get how the bridge shows itself online
+func presenceMode() string {
+	switch mode := envString("WHATSAPP_PRESENCE", presenceAuto); mode {
+	case presenceAuto, presenceOnline, presenceOffline:
+		return mode
+	default:
+		bridgeLog.Warnf("Unknown WHATSAPP_PRESENCE %q, using %s", mode, presenceAuto)
+		return presenceAuto
+	}
+}
+
+// Set the presence of the bridge after connecting, as WHATSAPP_PRESENCE asks
+func applyPresenceMode(client *whatsmeow.Client) {
+	var presence types.Presence
+	switch presenceMode() {
+	case presenceOnline:
+		presence = types.PresenceAvailable
+	case presenceOffline:
+		presence = types.PresenceUnavailable
+	default:
+		return
+	}
+	err := throttle(opPresence, func() error {
+		ctx, cancel := callContext(context.Background(), callQuery)
+		defer cancel()
+		return client.SendPresence(ctx, presence)
+	})
+	if err != nil {
+		bridgeLog.Warnf("Failed to set presence to %s: %v", presence, err)
+	}
+}
+
+// Store a message in the outbox until the recipient shows as online
+func (store *MessageStore) StoreWaitingMessage(caller, recipient, message, mediaPath string, deliverBy time.Time) (int64, error) {
+	result, err := store.db.Exec(
+		"INSERT INTO outbox (created_at, caller, recipient, message, media_path, status, deliver_by) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		time.Now(), caller, recipient, message, mediaPath, OutboxWaiting, deliverBy,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Queue a message until the recipient comes online and subscribe to their presence
+func queueUntilOnline(ctx context.Context, client waClient, messageStore *MessageStore, caller string, recipient types.JID, req SendMessageRequest) (int64, error) {
+	if recipient.Server == types.GroupServer {
+		return 0, newAPIError(ErrCodeInvalidRequest, "send_when_online only works for individual recipients")
+	}
+	wait := defaultOnlineWait
+	if req.MaxWaitMinutes > 0 {
+		wait = time.Duration(req.MaxWaitMinutes) * time.Minute
+	}
+	if wait > maxOnlineWait {
+		return 0, newAPIError(ErrCodeInvalidRequest, "max_wait_minutes can be at most %d", int(maxOnlineWait.Minutes()))
+	}
+
+	id, err := messageStore.StoreWaitingMessage(caller, recipient.String(), req.Message, req.MediaPath, time.Now().Add(wait))
+	if err != nil {
+		return 0, newAPIError(ErrCodeInternal, "Failed to queue message: %v", err)
+	}
+	bridgeLog.Infof("Message #%d to %s waits up to %s for them to come online", id, recipient, wait)
+
+	if err := subscribePresence(ctx, client, recipient); err != nil {
+		// The fallback still delivers it once the wait runs out
+		bridgeLog.Warnf("Failed to subscribe to presence of %s: %v", recipient, err)
+	}
+	return id, nil
+}
+
+// Subscribe to the presence of a user. WhatsApp only sends presence updates
+// to clients that are available themselves, so this marks the bridge online
+// unless WHATSAPP_PRESENCE keeps it offline.
+func subscribePresence(ctx context.Context, client waClient, jid types.JID) error {
+	if !client.IsConnected() {
+		return fmt.Errorf("not connected to WhatsApp")
+	}
+	return throttle(opPresence, func() error {
+		ctx, cancel := callContext(ctx, callQuery)
+		defer cancel()
+		if presenceMode() != presenceOffline {
+			if err := client.SendPresence(ctx, types.PresenceAvailable); err != nil {
+				return err
+			}
+		}
+		return client.SubscribePresence(ctx, jid)
+	})
+}
+
+// Resubscribe to the presence of everyone messages are waiting for
+func subscribeWaitingRecipients(client *whatsmeow.Client, messageStore *MessageStore) {
+	waiting, err := messageStore.ListOutbox(OutboxWaiting, -1, 0)
+	if err != nil {
+		bridgeLog.Warnf("Failed to list messages waiting for presence: %v", err)
+		return
+	}
+	subscribed := make(map[string]bool)
+	for _, m := range waiting {
+		if subscribed[m.Recipient] {
+			continue
+		}
+		subscribed[m.Recipient] = true
+		jid, err := types.ParseJID(m.Recipient)
+		if err != nil {
+			continue
+		}
+		if err := subscribePresence(context.Background(), client, jid); err != nil {
+			bridgeLog.Warnf("Failed to subscribe to presence of %s: %v", jid, err)
+		}
+	}
+}
+
+// Claim a waiting message and send it
+func deliverWaitingMessage(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, m OutboxMessage, reason string) {
+	claimed, err := messageStore.TransitionOutboxMessage(m.ID, OutboxWaiting, OutboxApproved)
+	if err != nil || !claimed {
+		return
+	}
+	bridgeLog.Infof("Sending message #%d to %s, %s", m.ID, m.Recipient, reason)
+	deliverOutboxMessage(ctx, client, messageStore, &m)
+}
+
+// Send the messages waiting for a user who just came online
+func handlePresence(client *whatsmeow.Client, messageStore *MessageStore, evt *events.Presence) {
+	if evt.Unavailable {
+		return
+	}
+	waiting, err := messageStore.ListOutbox(OutboxWaiting, -1, 0)
+	if err != nil {
+		bridgeLog.Warnf("Failed to list messages waiting for presence: %v", err)
+		return
+	}
+	for _, m := range waiting {
+		jid, err := types.ParseJID(m.Recipient)
+		if err != nil || jid.User != evt.From.User {
+			continue
+		}
+		goSafe("delivering waiting message", func() { deliverWaitingMessage(context.Background(), client, messageStore, m, "recipient came online") })
+	}
+}
+
+// Send waiting messages anyway once their maximum wait has run out
+func runPresenceFallback(client *whatsmeow.Client, messageStore *MessageStore) {
+	ticker := time.NewTicker(onlineWaitCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !client.IsConnected() {
+			continue
+		}
+		waiting, err := messageStore.ListOutbox(OutboxWaiting, -1, 0)
+		if err != nil {
+			bridgeLog.Warnf("Failed to list messages waiting for presence: %v", err)
+			continue
+		}
+		for _, m := range waiting {
+			if m.DeliverBy == nil || time.Now().After(*m.DeliverBy) {
+				func() {
+					defer recoverPanic("delivering waiting message %d", m.ID)
+					deliverWaitingMessage(context.Background(), client, messageStore, m, "recipient didn't come online in time")
+				}()
+			}
+		}
+	}
+}
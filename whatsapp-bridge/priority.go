@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Setting holding the VIP contacts added through the API
+const vipContactsSetting = "vip_contacts"
+
+// PriorityWeights control how unread chats are ranked, set under priority in
+// the config file or as WHATSAPP_PRIORITY_* variables
+type PriorityWeights struct {
+	Unread        float64  `json:"unread"`          // Per doubling of the unread count
+	Individual    float64  `json:"individual"`      // Added for direct chats
+	Group         float64  `json:"group"`           // Added for group chats
+	VIP           float64  `json:"vip"`             // Added for chats with a VIP contact
+	HalfLifeHours float64  `json:"half_life_hours"` // The score halves as the last incoming message ages by this much, 0 to disable
+	VIPs          []string `json:"vips,omitempty"`  // VIP contacts from the config, on top of those added through the API
+}
+
+// Load the priority weights from the settings
+func loadPriorityWeights() PriorityWeights {
+	return PriorityWeights{
+		Unread:        envFloat("WHATSAPP_PRIORITY_UNREAD", 1),
+		Individual:    envFloat("WHATSAPP_PRIORITY_INDIVIDUAL", 2),
+		Group:         envFloat("WHATSAPP_PRIORITY_GROUP", 0.5),
+		VIP:           envFloat("WHATSAPP_PRIORITY_VIP", 5),
+		HalfLifeHours: envFloat("WHATSAPP_PRIORITY_HALF_LIFE_HOURS", 24),
+		VIPs:          envList("WHATSAPP_PRIORITY_VIPS", nil),
+	}
+}
+
+// chatScorer scores chats by how urgently they need a reply
+type chatScorer struct {
+	weights PriorityWeights
+	vips    map[string]bool // User parts of VIPs, under both their phone number and LID
+	now     time.Time
+}
+
+// Build a scorer from the configured weights and every VIP contact
+func (store *MessageStore) newChatScorer(weights PriorityWeights) (*chatScorer, error) {
+	vips, err := store.VIPContacts()
+	if err != nil {
+		return nil, err
+	}
+	scorer := &chatScorer{weights: weights, vips: map[string]bool{}, now: time.Now()}
+	for _, vip := range vips {
+		aliases, err := store.SenderAliases(vip.JID)
+		if err != nil {
+			return nil, err
+		}
+		for _, user := range aliases {
+			scorer.vips[user] = true
+		}
+	}
+	return scorer, nil
+}
+
+// Score a chat, 0 if it has nothing unread
+func (s *chatScorer) score(chat ChatOverview) float64 {
+	if chat.UnreadCount <= 0 {
+		return 0
+	}
+	score := s.weights.Unread * math.Log2(1+float64(chat.UnreadCount))
+	jid, err := types.ParseJID(chat.JID)
+	if err == nil && jid.Server == types.GroupServer {
+		score += s.weights.Group
+	} else {
+		score += s.weights.Individual
+	}
+	if err == nil && s.vips[jid.User] {
+		score += s.weights.VIP
+	}
+	if s.weights.HalfLifeHours > 0 && chat.LastIncoming != nil {
+		age := max(s.now.Sub(*chat.LastIncoming).Hours(), 0)
+		score *= math.Pow(0.5, age/s.weights.HalfLifeHours)
+	}
+	return math.Round(score*1000) / 1000
+}
+
+// Rank chats by priority score, highest first
+func (s *chatScorer) rank(chats []ChatOverview) {
+	for i := range chats {
+		chats[i].PriorityScore = s.score(chats[i])
+	}
+	slices.SortStableFunc(chats, func(a, b ChatOverview) int {
+		switch {
+		case a.PriorityScore > b.PriorityScore:
+			return -1
+		case a.PriorityScore < b.PriorityScore:
+			return 1
+		}
+		return 0
+	})
+}
+
+// VIPContact is a contact whose chats rank higher
+type VIPContact struct {
+	JID    string `json:"jid"`
+	Name   string `json:"name,omitempty"`
+	Source string `json:"source"` // api or config
+}
+
+// Get the VIP contacts from the config and those added through the API
+func (store *MessageStore) VIPContacts() ([]VIPContact, error) {
+	var stored []string
+	if _, err := store.GetSetting(vipContactsSetting, &stored); err != nil {
+		return nil, err
+	}
+	vips := []VIPContact{}
+	seen := map[string]bool{}
+	add := func(value, source string) {
+		jid, err := parseContactJID(value)
+		if err != nil || seen[jid.String()] {
+			return
+		}
+		seen[jid.String()] = true
+		vip := VIPContact{JID: jid.String(), Name: store.chatName(jid.String()), Source: source}
+		if vip.Name == vip.JID {
+			vip.Name = ""
+		}
+		vips = append(vips, vip)
+	}
+	for _, value := range loadPriorityWeights().VIPs {
+		add(value, "config")
+	}
+	for _, value := range stored {
+		add(value, "api")
+	}
+	return vips, nil
+}
+
+// Add or remove VIP contacts kept in the store, returning how many changed
+func (store *MessageStore) updateVIPContacts(add, remove []types.JID) (int, error) {
+	var stored []string
+	if _, err := store.GetSetting(vipContactsSetting, &stored); err != nil {
+		return 0, err
+	}
+	changed := 0
+	for _, jid := range add {
+		if !slices.Contains(stored, jid.String()) {
+			stored = append(stored, jid.String())
+			changed++
+		}
+	}
+	for _, jid := range remove {
+		if i := slices.Index(stored, jid.String()); i >= 0 {
+			stored = slices.Delete(stored, i, i+1)
+			changed++
+		}
+	}
+	return changed, store.StoreSetting(vipContactsSetting, stored)
+}
+
+// VIPContactsRequest represents the request body for adding VIP contacts
+type VIPContactsRequest struct {
+	Contacts []string `json:"contacts"` // JIDs or phone numbers
+}
+
+// VIPContactsResponse represents the response for the VIP contact APIs
+type VIPContactsResponse struct {
+	Success  bool         `json:"success"`
+	Message  string       `json:"message,omitempty"`
+	Contacts []VIPContact `json:"contacts"`
+}
+
+// Register the REST handlers managing VIP contacts
+func registerPriorityHandlers(messageStore *MessageStore) {
+	writeVIPs := func(w http.ResponseWriter, status int, message string) {
+		vips, err := messageStore.VIPContacts()
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list VIP contacts: %v", err), nil)
+			return
+		}
+		writeJSON(w, status, VIPContactsResponse{Success: true, Message: message, Contacts: vips})
+	}
+
+	// Handler for listing VIP contacts
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/contacts/vip",
+		Summary:  "List the VIP contacts whose unread chats rank higher, from the config and added through the API",
+		Tag:      "contacts",
+		Scope:    ScopeReadMessages,
+		Response: VIPContactsResponse{},
+	})
+	http.HandleFunc("GET /api/contacts/vip", func(w http.ResponseWriter, r *http.Request) {
+		writeVIPs(w, http.StatusOK, "")
+	})
+
+	// Handler for adding VIP contacts
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/contacts/vip",
+		Summary:  "Add VIP contacts by JID or phone number",
+		Tag:      "contacts",
+		Scope:    ScopeManageContacts,
+		Audit:    true,
+		Request:  VIPContactsRequest{},
+		Response: VIPContactsResponse{},
+	})
+	http.HandleFunc("POST /api/contacts/vip", func(w http.ResponseWriter, r *http.Request) {
+		var req VIPContactsRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if len(req.Contacts) == 0 {
+			writeError(w, ErrCodeInvalidRequest, "contacts is required", nil)
+			return
+		}
+		jids := make([]types.JID, 0, len(req.Contacts))
+		for _, value := range req.Contacts {
+			jid, err := parseContactJID(strings.TrimSpace(value))
+			if err != nil {
+				writeAPIError(w, "", err)
+				return
+			}
+			if jid.Server == types.GroupServer {
+				writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("%s is a group, VIPs are contacts", jid), nil)
+				return
+			}
+			jids = append(jids, jid)
+		}
+		added, err := messageStore.updateVIPContacts(jids, nil)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to store VIP contacts: %v", err), nil)
+			return
+		}
+		writeVIPs(w, http.StatusOK, fmt.Sprintf("%d VIP contacts added", added))
+	})
+
+	// Handler for removing a VIP contact
+	documentAPI(apiOperation{
+		Method:   http.MethodDelete,
+		Path:     "/api/contacts/vip",
+		Summary:  "Remove a VIP contact added through the API",
+		Tag:      "contacts",
+		Scope:    ScopeManageContacts,
+		Audit:    true,
+		Params:   []apiParam{{Name: "contact", Description: "JID or phone number of the contact", Required: true}},
+		Response: VIPContactsResponse{},
+	})
+	http.HandleFunc("DELETE /api/contacts/vip", func(w http.ResponseWriter, r *http.Request) {
+		contact := strings.TrimSpace(r.URL.Query().Get("contact"))
+		if contact == "" {
+			writeError(w, ErrCodeInvalidRequest, "contact is required", nil)
+			return
+		}
+		jid, err := parseContactJID(contact)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		removed, err := messageStore.updateVIPContacts(nil, []types.JID{jid})
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to store VIP contacts: %v", err), nil)
+			return
+		}
+		if removed == 0 {
+			for _, value := range loadPriorityWeights().VIPs {
+				if configured, err := parseContactJID(value); err == nil && configured == jid {
+					writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("%s is a VIP in the config, remove it there", jid), nil)
+					return
+				}
+			}
+			writeError(w, ErrCodeNotFound, fmt.Sprintf("%s is not a VIP contact", jid), nil)
+			return
+		}
+		writeVIPs(w, http.StatusOK, fmt.Sprintf("%s is no longer a VIP contact", jid))
+	})
+}
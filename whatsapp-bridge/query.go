@@ -0,0 +1,727 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Default and maximum page sizes for list endpoints
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// MessageFilter describes which messages QueryMessages returns
+type MessageFilter struct {
+	ChatJID   string
+	Sender    string
+	Query     string // Case-insensitive substring match on the content
+	MediaType string
+	Language  string          // Detected language, ISO 639-1
+	HasMedia  bool            // Only messages with a file of any type
+	Filename  string          // Case-insensitive substring match on the file name
+	Starred   bool            // Only starred messages
+	Revoked   string          // Whether to include, exclude or only list revoked messages
+	Tag       string          // Only messages tagged with this, e.g. by a watch
+	ChatJIDs  []string        // Only messages from any of these chats
+	IDs       []string        // Only messages with any of these IDs
+	AnyOf     []MessageFilter // Only messages matching at least one of these, their paging is ignored
+	After     *time.Time
+	Before    *time.Time
+	Limit     int
+	Offset    int
+
+	senderAliases []string // Every value Sender is stored under, see SenderAliases
+}
+
+// Build the WHERE clause and arguments for a message filter
+func (f MessageFilter) where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	if f.ChatJID != "" {
+		conditions = append(conditions, "messages.chat_jid = ?")
+		args = append(args, f.ChatJID)
+	}
+	if len(f.ChatJIDs) > 0 {
+		conditions = append(conditions, "messages.chat_jid IN (?"+strings.Repeat(", ?", len(f.ChatJIDs)-1)+")")
+		for _, jid := range f.ChatJIDs {
+			args = append(args, jid)
+		}
+	}
+	if len(f.IDs) > 0 {
+		conditions = append(conditions, "messages.id IN (?"+strings.Repeat(", ?", len(f.IDs)-1)+")")
+		for _, id := range f.IDs {
+			args = append(args, id)
+		}
+	}
+	if len(f.senderAliases) > 0 {
+		conditions = append(conditions, "messages.sender IN (?"+strings.Repeat(", ?", len(f.senderAliases)-1)+")")
+		for _, alias := range f.senderAliases {
+			args = append(args, alias)
+		}
+	} else if f.Sender != "" {
+		conditions = append(conditions, "messages.sender = ?")
+		args = append(args, f.Sender)
+	}
+	if f.Query != "" {
+		conditions = append(conditions, "(LOWER(messages.content) LIKE LOWER(?) OR LOWER(messages.ocr_text) LIKE LOWER(?))")
+		args = append(args, "%"+f.Query+"%", "%"+f.Query+"%")
+	}
+	if f.MediaType != "" {
+		conditions = append(conditions, "messages.media_type = ?")
+		args = append(args, f.MediaType)
+	}
+	if f.Language != "" {
+		conditions = append(conditions, "messages.language = ?")
+		args = append(args, f.Language)
+	}
+	if f.HasMedia {
+		conditions = append(conditions, "messages.media_type NOT IN ('', '"+mediaTypePayment+"', '"+mediaTypeEvent+"')")
+	}
+	if f.Starred {
+		conditions = append(conditions, "messages.is_starred = 1")
+	}
+	switch f.Revoked {
+	case revokedExclude:
+		conditions = append(conditions, "COALESCE(messages.is_revoked, 0) = 0")
+	case revokedOnly:
+		conditions = append(conditions, "messages.is_revoked = 1")
+	}
+	if f.Filename != "" {
+		conditions = append(conditions, "LOWER(messages.filename) LIKE LOWER(?)")
+		args = append(args, "%"+f.Filename+"%")
+	}
+	if f.Tag != "" {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM message_tags t WHERE t.message_id = messages.id AND t.chat_jid = messages.chat_jid AND t.tag = ?)")
+		args = append(args, f.Tag)
+	}
+	if len(f.AnyOf) > 0 {
+		var alternatives []string
+		var alternativeArgs []interface{}
+		for _, sub := range f.AnyOf {
+			where, subArgs := sub.where()
+			// An alternative without conditions matches everything
+			if where == "" {
+				alternatives = nil
+				break
+			}
+			alternatives = append(alternatives, "("+strings.TrimPrefix(where, " WHERE ")+")")
+			alternativeArgs = append(alternativeArgs, subArgs...)
+		}
+		if len(alternatives) > 0 {
+			conditions = append(conditions, "("+strings.Join(alternatives, " OR ")+")")
+			args = append(args, alternativeArgs...)
+		}
+	}
+	// Timestamps are stored as text in local time, so compare in the same zone
+	if f.After != nil {
+		conditions = append(conditions, "messages.timestamp > ?")
+		args = append(args, f.After.Local())
+	}
+	if f.Before != nil {
+		conditions = append(conditions, "messages.timestamp < ?")
+		args = append(args, f.Before.Local())
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// Match the sender of a filter whether their messages came from their phone
+// number or their LID
+func (store *MessageStore) resolveSender(f *MessageFilter) error {
+	for i := range f.AnyOf {
+		if err := store.resolveSender(&f.AnyOf[i]); err != nil {
+			return err
+		}
+	}
+	if f.Sender == "" {
+		return nil
+	}
+	aliases, err := store.SenderAliases(f.Sender)
+	if err != nil {
+		return err
+	}
+	f.senderAliases = aliases
+	return nil
+}
+
+// Query messages matching a filter, newest first
+func (store *MessageStore) QueryMessages(f MessageFilter) ([]Message, error) {
+	if err := store.resolveSender(&f); err != nil {
+		return nil, err
+	}
+	query, args := f.query()
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanMessages(rows)
+}
+
+// Build the SELECT of QueryMessages for a filter whose sender is resolved
+func (f MessageFilter) query() (string, []interface{}) {
+	where, args := f.where()
+	args = append(args, f.Limit, f.Offset)
+	return `SELECT ` + messageColumns + ` FROM messages` + where + ` ORDER BY timestamp DESC LIMIT ? OFFSET ?`, args
+}
+
+// Count the messages matching a filter, ignoring its paging
+func (store *MessageStore) CountMessages(f MessageFilter) (int, error) {
+	if err := store.resolveSender(&f); err != nil {
+		return 0, err
+	}
+	where, args := f.where()
+	var n int
+	err := store.db.QueryRow("SELECT COUNT(*) FROM messages"+where, args...).Scan(&n)
+	return n, err
+}
+
+// Query a page of messages matching a filter, newest first, with their total
+func (store *MessageStore) QueryMessagesPage(f MessageFilter) ([]Message, Page, error) {
+	messages, err := store.QueryMessages(f)
+	if err != nil {
+		return nil, Page{}, err
+	}
+	total, err := store.CountMessages(f)
+	if err != nil {
+		return nil, Page{}, err
+	}
+	return messages, countedPage(f.Offset, len(messages), total), nil
+}
+
+// Columns scanMessages expects, in order
+var messageColumns = `id, chat_jid, sender, COALESCE(content, ''), timestamp, is_from_me, COALESCE(media_type, ''), COALESCE(filename, ''), COALESCE(is_view_once, 0), COALESCE(is_revoked, 0), COALESCE(selected_option, ''), COALESCE(ocr_text, ''), COALESCE(language, ''), ` +
+	senderIDSQL("messages.sender") + `, ` + senderLIDSQL("messages.sender")
+
+// Read all messages from a query selecting messageColumns
+func scanMessages(rows *sql.Rows) ([]Message, error) {
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		var msg Message
+		if err := rows.Scan(&msg.ID, &msg.ChatJID, &msg.Sender, &msg.Content, &msg.Time, &msg.IsFromMe, &msg.MediaType, &msg.Filename, &msg.ViewOnce, &msg.Revoked, &msg.Selected, &msg.OCRText, &msg.Language,
+			&msg.SenderID, &msg.SenderLID); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, rows.Err()
+}
+
+// Maximum number of messages returned on each side of a context window
+const maxContextSize = 200
+
+// MessageContext is a window of messages surrounding a message, in chronological order
+type MessageContext struct {
+	Message       Message   `json:"message"`
+	Before        []Message `json:"before"`
+	After         []Message `json:"after"`
+	HasMoreBefore bool      `json:"has_more_before"`
+	HasMoreAfter  bool      `json:"has_more_after"`
+}
+
+// Select up to a number of messages of a chat before and after the message
+// with a rowid, nearest first
+var (
+	messagesBeforeSQL = `SELECT ` + messageColumns + ` FROM messages
+		WHERE chat_jid = ? AND (timestamp < (SELECT timestamp FROM messages WHERE rowid = ?)
+			OR (timestamp = (SELECT timestamp FROM messages WHERE rowid = ?) AND rowid < ?))
+		ORDER BY timestamp DESC, rowid DESC LIMIT ?`
+	messagesAfterSQL = `SELECT ` + messageColumns + ` FROM messages
+		WHERE chat_jid = ? AND (timestamp > (SELECT timestamp FROM messages WHERE rowid = ?)
+			OR (timestamp = (SELECT timestamp FROM messages WHERE rowid = ?) AND rowid > ?))
+		ORDER BY timestamp, rowid LIMIT ?`
+)
+
+// Get the messages surrounding a message. Messages sharing a timestamp are
+// ordered by insertion, so the window never skips or repeats one.
+func (store *MessageStore) GetMessageContext(chatJID, messageID string, before, after int) (*MessageContext, error) {
+	var rowid int64
+	err := store.db.QueryRow("SELECT rowid FROM messages WHERE id = ? AND chat_jid = ?", messageID, chatJID).Scan(&rowid)
+	if err == sql.ErrNoRows {
+		return nil, newAPIError(ErrCodeNotFound, "Message %s not found in chat %s", messageID, chatJID)
+	} else if err != nil {
+		return nil, err
+	}
+
+	rows, err := store.db.Query("SELECT "+messageColumns+" FROM messages WHERE rowid = ?", rowid)
+	if err != nil {
+		return nil, err
+	}
+	target, err := scanMessages(rows)
+	if err != nil || len(target) == 0 {
+		return nil, fmt.Errorf("failed to load message: %v", err)
+	}
+	ctx := &MessageContext{Message: target[0]}
+
+	// Fetch one extra message on each side to know whether there are more
+	rows, err = store.db.Query(messagesBeforeSQL, chatJID, rowid, rowid, rowid, before+1)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Before, err = scanMessages(rows); err != nil {
+		return nil, err
+	}
+	if len(ctx.Before) > before {
+		ctx.Before, ctx.HasMoreBefore = ctx.Before[:before], true
+	}
+	slices.Reverse(ctx.Before)
+
+	rows, err = store.db.Query(messagesAfterSQL, chatJID, rowid, rowid, rowid, after+1)
+	if err != nil {
+		return nil, err
+	}
+	if ctx.After, err = scanMessages(rows); err != nil {
+		return nil, err
+	}
+	if len(ctx.After) > after {
+		ctx.After, ctx.HasMoreAfter = ctx.After[:after], true
+	}
+	return ctx, nil
+}
+
+// Parse an optional context window size query parameter
+func parseContextSize(r *http.Request, name string) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return 20, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, newAPIError(ErrCodeInvalidRequest, "%s must be a non-negative integer", name)
+	}
+	return min(n, maxContextSize), nil
+}
+
+// ChatSummary represents a chat with a preview of its last message
+type ChatSummary struct {
+	JID             string    `json:"jid"`
+	Name            string    `json:"name"`
+	IsGroup         bool      `json:"is_group"`
+	LastMessageTime time.Time `json:"last_message_time"`
+	LastMessage     string    `json:"last_message,omitempty"`
+	LastSender      string    `json:"last_sender,omitempty"`
+	LastSenderID    string    `json:"last_sender_id,omitempty"`
+	LastIsFromMe    bool      `json:"last_is_from_me"`
+	LastMediaType   string    `json:"last_media_type,omitempty"`
+
+	Languages []LanguageShare `json:"languages,omitempty"` // Detected languages of its messages, most used first
+}
+
+// List chats ordered by most recent activity, optionally filtered by name or JID
+func (store *MessageStore) ListChats(query string, limit, offset int) ([]ChatSummary, error) {
+	sqlQuery := `
+		SELECT c.jid, COALESCE(c.name, ''), c.last_message_time,
+			COALESCE(m.content, ''), COALESCE(m.sender, ''), COALESCE(` + senderIDSQL("m.sender") + `, ''), COALESCE(m.is_from_me, 0), COALESCE(m.media_type, '')
+		FROM chats c
+		LEFT JOIN messages m ON m.rowid = (
+			SELECT rowid FROM messages WHERE chat_jid = c.jid ORDER BY timestamp DESC LIMIT 1
+		)`
+	var args []interface{}
+	if query != "" {
+		sqlQuery += " WHERE LOWER(c.name) LIKE LOWER(?) OR c.jid LIKE ?"
+		args = append(args, "%"+query+"%", "%"+query+"%")
+	}
+	sqlQuery += " ORDER BY c.last_message_time DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := store.db.Query(sqlQuery, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chats := []ChatSummary{}
+	for rows.Next() {
+		var chat ChatSummary
+		if err := rows.Scan(&chat.JID, &chat.Name, &chat.LastMessageTime,
+			&chat.LastMessage, &chat.LastSender, &chat.LastSenderID, &chat.LastIsFromMe, &chat.LastMediaType); err != nil {
+			return nil, err
+		}
+		chat.IsGroup = strings.HasSuffix(chat.JID, "@"+types.GroupServer)
+		chats = append(chats, chat)
+	}
+
+	return chats, rows.Err()
+}
+
+// Page locates a page of a list response in the whole list
+type Page struct {
+	Total          int  `json:"total"`
+	TotalEstimated bool `json:"total_estimated,omitempty"` // Total only counts up to the next page, there may be more
+	HasMore        bool `json:"has_more"`
+	NextOffset     *int `json:"next_offset,omitempty"` // Offset of the next page, if there is one
+}
+
+// Describe a page of a list whose total was counted
+func countedPage(offset, returned, total int) Page {
+	page := Page{Total: max(total, offset+returned)}
+	if offset+returned < page.Total {
+		next := offset + returned
+		page.HasMore, page.NextOffset = true, &next
+	}
+	return page
+}
+
+// Cut a page fetched with one item more than limit down to limit, which tells
+// whether more follow without counting them
+func trimPage[T any](items []T, offset, limit int) ([]T, Page) {
+	if len(items) <= limit {
+		page := countedPage(offset, len(items), offset+len(items))
+		// Past the end nothing tells how many came before
+		page.TotalEstimated = len(items) == 0 && offset > 0
+		return items, page
+	}
+	items = items[:limit]
+	page := countedPage(offset, limit, offset+limit+1)
+	page.TotalEstimated = true
+	return items, page
+}
+
+// ListMessagesResponse represents the response for the list messages API
+type ListMessagesResponse struct {
+	Success  bool      `json:"success"`
+	Messages []Message `json:"messages"`
+	Page
+}
+
+// MessageContextResponse represents the response for the message context API
+type MessageContextResponse struct {
+	Success bool `json:"success"`
+	MessageContext
+}
+
+// ListChatsResponse represents the response for the list chats API
+type ListChatsResponse struct {
+	Success bool          `json:"success"`
+	Chats   []ChatSummary `json:"chats"`
+	Page
+}
+
+// Parse limit/offset query parameters, applying the default and maximum page size
+func parsePagination(r *http.Request) (limit, offset int, err error) {
+	limit = defaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			return 0, 0, newAPIError(ErrCodeInvalidRequest, "limit must be a positive integer")
+		}
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, newAPIError(ErrCodeInvalidRequest, "offset must be a non-negative integer")
+		}
+	}
+	return limit, offset, nil
+}
+
+// Formats accepted by time query parameters, for their descriptions
+const timeFormatsHint = " (RFC3339, YYYY-MM-DD or YYYY-MM-DD HH:MM in WHATSAPP_TIMEZONE, or relative like -7d)"
+
+// Layouts of times without a zone, read in WHATSAPP_TIMEZONE
+var localTimeLayouts = []string{
+	"2006-01-02",
+	"2006-01-02 15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02T15:04:05",
+}
+
+// Relative times like -7d, a number of minutes, hours, days or weeks ago
+var relativeTimeRe = regexp.MustCompile(`^-(\d+)([mhdw])$`)
+
+// Get the time zone of times given without one, WHATSAPP_TIMEZONE or the host's
+func queryLocation() (*time.Location, error) {
+	name := envString("WHATSAPP_TIMEZONE", "")
+	if name == "" {
+		return time.Local, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WHATSAPP_TIMEZONE %q: %v", name, err)
+	}
+	return loc, nil
+}
+
+// Parse a time given as RFC3339, as a date or date and time in
+// WHATSAPP_TIMEZONE, or relative to now
+func parseTimeValue(v string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	// An unescaped + in a URL query arrives as a space
+	if t, err := time.Parse(time.RFC3339, strings.Replace(v, " ", "+", 1)); err == nil && strings.Contains(v, "T") {
+		return t, nil
+	}
+	if m := relativeTimeRe.FindStringSubmatch(v); m != nil {
+		n, err := strconv.Atoi(m[1])
+		if err != nil {
+			return time.Time{}, err
+		}
+		switch m[2] {
+		case "m":
+			return now.Add(-time.Duration(n) * time.Minute), nil
+		case "h":
+			return now.Add(-time.Duration(n) * time.Hour), nil
+		case "d":
+			return now.AddDate(0, 0, -n), nil
+		default:
+			return now.AddDate(0, 0, -7*n), nil
+		}
+	}
+	loc, err := queryLocation()
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, layout := range localTimeLayouts {
+		if t, err := time.ParseInLocation(layout, v, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized time %q", v)
+}
+
+// Parse an optional time query parameter, see parseTimeValue
+func parseTimeParam(r *http.Request, name string) (*time.Time, error) {
+	return parseTimeField(name, r.URL.Query().Get(name))
+}
+
+// Parse an optional time given in a request parameter or field, see parseTimeValue
+func parseTimeField(name, v string) (*time.Time, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return nil, nil
+	}
+	t, err := parseTimeValue(v, time.Now())
+	if err != nil {
+		return nil, &APIError{
+			Code:    ErrCodeInvalidRequest,
+			Message: fmt.Sprintf("Invalid %s: %v", name, err),
+			Details: map[string][]string{"formats": {"RFC3339", "YYYY-MM-DD", "YYYY-MM-DD HH:MM[:SS]", "-<n>m|h|d|w"}},
+		}
+	}
+	return &t, nil
+}
+
+// Build a message filter from the query parameters of a request
+func parseMessageFilter(r *http.Request) (MessageFilter, error) {
+	q := r.URL.Query()
+	f := MessageFilter{
+		ChatJID:   q.Get("chat_jid"),
+		Sender:    q.Get("sender"),
+		Query:     q.Get("query"),
+		MediaType: q.Get("media_type"),
+		Language:  strings.ToLower(q.Get("language")),
+		Filename:  q.Get("filename"),
+		Tag:       q.Get("tag"),
+		Revoked:   q.Get("revoked"),
+	}
+	if !slices.Contains([]string{"", revokedInclude, revokedExclude, revokedOnly}, f.Revoked) {
+		return f, newAPIError(ErrCodeInvalidRequest, "revoked must be one of %s, %s or %s", revokedInclude, revokedExclude, revokedOnly)
+	}
+
+	var err error
+	if f.Limit, f.Offset, err = parsePagination(r); err != nil {
+		return f, err
+	}
+	if f.After, err = parseTimeParam(r, "after_time"); err != nil {
+		return f, err
+	}
+	if f.Before, err = parseTimeParam(r, "before_time"); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// Query parameters accepted by the list messages API
+var messageFilterParams = []apiParam{
+	{Name: "chat_jid", Description: "Only messages from this chat"},
+	{Name: "sender", Description: "Only messages from this sender"},
+	{Name: "query", Description: "Case-insensitive text to search for in message content"},
+	{Name: "media_type", Description: "Only messages with this media type (image, video, audio, document)"},
+	{Name: "language", Description: "Only messages detected to be in this language, an ISO 639-1 code such as en or it"},
+	{Name: "filename", Description: "Case-insensitive text to search for in the file name"},
+	{Name: "tag", Description: "Only messages with this tag, e.g. one added by a watch"},
+	{Name: "revoked", Description: "Messages deleted for everyone by their sender: include (default), exclude or only"},
+	{Name: "after_time", Description: "Only messages after this time" + timeFormatsHint},
+	{Name: "before_time", Description: "Only messages before this time" + timeFormatsHint},
+	{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+	{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+}
+
+// Register the read-only REST handlers for chats, messages and media files
+func registerQueryHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	// Handler for listing chats
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/chats",
+		Summary: "List chats ordered by most recent activity, with the distribution of the detected languages of their messages",
+		Tag:     "chats",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "query", Description: "Filter chats by name or JID"},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ListChatsResponse{},
+	})
+	http.HandleFunc("/api/chats", func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		chats, err := messageStore.ListChats(r.URL.Query().Get("query"), limit+1, offset)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list chats: %v", err), nil)
+			return
+		}
+
+		chats, page := trimPage(chats, offset, limit)
+		jids := make([]string, len(chats))
+		for i, chat := range chats {
+			jids[i] = chat.JID
+		}
+		languages, err := messageStore.ChatLanguages(jids)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to count chat languages: %v", err), nil)
+			return
+		}
+		for i := range chats {
+			chats[i].Languages = languages[chats[i].JID]
+		}
+		writeJSON(w, http.StatusOK, ListChatsResponse{Success: true, Chats: chats, Page: page})
+	})
+
+	// Handler for querying messages
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/messages",
+		Summary:  "Query stored messages, newest first",
+		Tag:      "messages",
+		Scope:    ScopeReadMessages,
+		Params:   messageFilterParams,
+		Response: ListMessagesResponse{},
+	})
+	http.HandleFunc("/api/messages", func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		filter, err := parseMessageFilter(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		messages, page, err := messageStore.QueryMessagesPage(filter)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to query messages: %v", err), nil)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, ListMessagesResponse{Success: true, Messages: messages, Page: page})
+	})
+
+	// Handler for the messages surrounding a message
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/messages/context",
+		Summary: "Get a window of messages before and after a message, e.g. around a search hit",
+		Tag:     "messages",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "chat_jid", Description: "JID of the chat containing the message", Required: true},
+			{Name: "message_id", Description: "ID of the message to center the window on", Required: true},
+			{Name: "before", Description: "Number of earlier messages (default 20, max 200)", Type: "integer"},
+			{Name: "after", Description: "Number of later messages (default 20, max 200)", Type: "integer"},
+		},
+		Response: MessageContextResponse{},
+	})
+	http.HandleFunc("GET /api/messages/context", func(w http.ResponseWriter, r *http.Request) {
+		chatJID := r.URL.Query().Get("chat_jid")
+		messageID := r.URL.Query().Get("message_id")
+		if chatJID == "" || messageID == "" {
+			writeError(w, ErrCodeInvalidRequest, "Message ID and Chat JID are required", nil)
+			return
+		}
+		before, err := parseContextSize(r, "before")
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		after, err := parseContextSize(r, "after")
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		ctx, err := messageStore.GetMessageContext(chatJID, messageID, before, after)
+		if err != nil {
+			writeAPIError(w, "Failed to get message context", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, MessageContextResponse{Success: true, MessageContext: *ctx})
+	})
+
+	// Handler for serving the media file of a message, downloading it first if needed
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/media",
+		Summary: "Serve the media file of a stored message",
+		Tag:     "media",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "message_id", Description: "ID of the media message", Required: true},
+			{Name: "chat_jid", Description: "JID of the chat containing the message", Required: true},
+			{Name: "allow_view_once", Description: "Set to true to serve view-once media", Type: "boolean"},
+		},
+	})
+	http.HandleFunc("/api/media", func(w http.ResponseWriter, r *http.Request) {
+		if !requireMethod(w, r, http.MethodGet) {
+			return
+		}
+
+		messageID := r.URL.Query().Get("message_id")
+		chatJID := r.URL.Query().Get("chat_jid")
+		if messageID == "" || chatJID == "" {
+			writeError(w, ErrCodeInvalidRequest, "Message ID and Chat JID are required", nil)
+			return
+		}
+
+		if err := checkViewOnceAccess(messageStore, messageID, chatJID, r.URL.Query().Get("allow_view_once") == "true"); err != nil {
+			writeAPIError(w, "Failed to get media", err)
+			return
+		}
+
+		_, _, _, path, err := downloadMedia(r.Context(), client, messageStore, messageID, chatJID)
+		if err != nil {
+			writeAPIError(w, "Failed to get media", err)
+			return
+		}
+
+		http.ServeFile(w, r, path)
+	})
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Receipt statuses of a participant, in the order they progress
+const (
+	receiptPending   = "pending"
+	receiptDelivered = "delivered"
+	receiptRead      = "read"
+	receiptPlayed    = "played"
+)
+
+// Column recording each receipt type we track
+var receiptColumns = map[types.ReceiptType]string{
+	types.ReceiptTypeDelivered: "delivered_at",
+	types.ReceiptTypeRead:      "read_at",
+	types.ReceiptTypePlayed:    "played_at",
+}
+
+// Record a receipt of a participant for some of our messages, keeping the
+// time each status was first reached
+func (store *MessageStore) StoreReceipt(chatJID, participant string, messageIDs []string, receiptType types.ReceiptType, timestamp time.Time) error {
+	column, ok := receiptColumns[receiptType]
+	if !ok {
+		return nil
+	}
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, id := range messageIDs {
+		_, err := tx.Exec(
+			`INSERT INTO message_receipts (message_id, chat_jid, participant, `+column+`) VALUES (?, ?, ?, ?)
+			ON CONFLICT (message_id, chat_jid, participant) DO UPDATE SET `+column+` = COALESCE(`+column+`, excluded.`+column+`)`,
+			id, chatJID, participant, timestamp,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Track delivery, read and play receipts others send for our messages
+func handleReceipt(client *whatsmeow.Client, messageStore *MessageStore, evt *events.Receipt) {
+	if _, ok := receiptColumns[evt.Type]; !ok {
+		return
+	}
+	// Receipts of our own devices say nothing about the recipients
+	if isOwnJID(client, evt.Sender.String()) {
+		return
+	}
+	err := messageStore.StoreReceipt(evt.Chat.String(), evt.Sender.ToNonAD().String(), evt.MessageIDs, evt.Type, evt.Timestamp)
+	if err != nil {
+		bridgeLog.Warnf("Failed to store %s receipt from %s: %v", evt.Type, evt.Sender, err)
+	}
+}
+
+// ParticipantReceipt is how far one recipient got with a message
+type ParticipantReceipt struct {
+	Participant string     `json:"participant"`
+	Name        string     `json:"name,omitempty"`
+	Status      string     `json:"status"` // pending, delivered, read or played
+	DeliveredAt *time.Time `json:"delivered_at,omitempty"`
+	ReadAt      *time.Time `json:"read_at,omitempty"`
+	PlayedAt    *time.Time `json:"played_at,omitempty"`
+}
+
+// Derive the status from the receipts received so far
+func (r *ParticipantReceipt) updateStatus() {
+	switch {
+	case r.PlayedAt != nil:
+		r.Status = receiptPlayed
+	case r.ReadAt != nil:
+		r.Status = receiptRead
+	case r.DeliveredAt != nil:
+		r.Status = receiptDelivered
+	default:
+		r.Status = receiptPending
+	}
+}
+
+// MessageReceipts is the per-participant receipt table of an outgoing message
+type MessageReceipts struct {
+	MessageID string               `json:"message_id"`
+	ChatJID   string               `json:"chat_jid"`
+	Receipts  []ParticipantReceipt `json:"receipts"`
+	Summary   map[string]int       `json:"summary"`
+}
+
+// Get the receipts of one of our messages. In groups every known participant
+// is listed, those who haven't received the message yet as pending.
+func (store *MessageStore) GetMessageReceipts(client *whatsmeow.Client, messageID, chatJID string) (*MessageReceipts, error) {
+	var isFromMe bool
+	err := store.db.QueryRow("SELECT is_from_me FROM messages WHERE id = ? AND chat_jid = ?", messageID, chatJID).Scan(&isFromMe)
+	if err == sql.ErrNoRows {
+		return nil, newAPIError(ErrCodeNotFound, "Message %s not found in chat %s", messageID, chatJID)
+	} else if err != nil {
+		return nil, err
+	}
+	if !isFromMe {
+		return nil, newAPIError(ErrCodeInvalidRequest, "Receipts are only tracked for messages we sent")
+	}
+
+	// Participants can send receipts as either their phone number or LID
+	byAlias := make(map[string]*ParticipantReceipt)
+	var entries []*ParticipantReceipt
+	rows, err := store.db.Query(
+		"SELECT participant_jid, phone_number, lid, display_name FROM group_participants WHERE group_jid = ?",
+		chatJID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jid, phone, lid, name string
+		if err := rows.Scan(&jid, &phone, &lid, &name); err != nil {
+			return nil, err
+		}
+		if isOwnJID(client, jid) || isOwnJID(client, phone) || isOwnJID(client, lid) {
+			continue
+		}
+		entry := &ParticipantReceipt{Participant: jid, Name: name}
+		if phone != "" {
+			entry.Participant = phone
+		}
+		entries = append(entries, entry)
+		for _, alias := range []string{jid, phone, lid} {
+			if alias != "" {
+				byAlias[alias] = entry
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = store.db.Query(
+		"SELECT participant, delivered_at, read_at, played_at FROM message_receipts WHERE message_id = ? AND chat_jid = ?",
+		messageID, chatJID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var participant string
+		var delivered, read, played sql.NullTime
+		if err := rows.Scan(&participant, &delivered, &read, &played); err != nil {
+			return nil, err
+		}
+		entry, ok := byAlias[participant]
+		if !ok {
+			entry = &ParticipantReceipt{Participant: participant}
+			byAlias[participant] = entry
+			entries = append(entries, entry)
+		}
+		for _, t := range []struct {
+			value sql.NullTime
+			field **time.Time
+		}{{delivered, &entry.DeliveredAt}, {read, &entry.ReadAt}, {played, &entry.PlayedAt}} {
+			if t.value.Valid && (*t.field == nil || t.value.Time.Before(**t.field)) {
+				value := t.value.Time
+				*t.field = &value
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &MessageReceipts{
+		MessageID: messageID,
+		ChatJID:   chatJID,
+		Receipts:  make([]ParticipantReceipt, 0, len(entries)),
+		Summary:   map[string]int{receiptPending: 0, receiptDelivered: 0, receiptRead: 0, receiptPlayed: 0},
+	}
+	for _, entry := range entries {
+		entry.updateStatus()
+		if entry.Name == "" {
+			if c, err := store.GetContact(entry.Participant); err == nil {
+				entry.Name = c.Name
+			}
+		}
+		result.Summary[entry.Status]++
+		result.Receipts = append(result.Receipts, *entry)
+	}
+
+	// Furthest along first, like the message info screen of the app
+	progress := map[string]int{receiptPlayed: 0, receiptRead: 1, receiptDelivered: 2, receiptPending: 3}
+	sort.SliceStable(result.Receipts, func(i, j int) bool {
+		a, b := result.Receipts[i], result.Receipts[j]
+		if a.Status != b.Status {
+			return progress[a.Status] < progress[b.Status]
+		}
+		return a.Participant < b.Participant
+	})
+	return result, nil
+}
+
+// Whether a JID string is our own account, as phone number or LID
+func isOwnJID(client *whatsmeow.Client, jid string) bool {
+	if jid == "" {
+		return false
+	}
+	parsed, err := types.ParseJID(jid)
+	if err != nil {
+		return false
+	}
+	if client.Store.ID != nil && parsed.User == client.Store.ID.User {
+		return true
+	}
+	return !client.Store.LID.IsEmpty() && parsed.User == client.Store.LID.User
+}
+
+// MessageReceiptsResponse represents the response for the message receipts API
+type MessageReceiptsResponse struct {
+	Success bool `json:"success"`
+	MessageReceipts
+}
+
+// Register the REST handler for message receipts
+func registerReceiptHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/messages/{id}/receipts",
+		Summary: "Get who received, read or played one of our messages, per participant",
+		Tag:     "messages",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "id", In: "path", Description: "ID of the message", Required: true},
+			{Name: "chat_jid", Description: "JID of the chat containing the message", Required: true},
+		},
+		Response: MessageReceiptsResponse{},
+	})
+	http.HandleFunc("GET /api/messages/{id}/receipts", func(w http.ResponseWriter, r *http.Request) {
+		chatJID := r.URL.Query().Get("chat_jid")
+		if chatJID == "" {
+			writeError(w, ErrCodeInvalidRequest, "chat_jid is required", nil)
+			return
+		}
+		receipts, err := messageStore.GetMessageReceipts(client, r.PathValue("id"), chatJID)
+		if err != nil {
+			writeAPIError(w, "Failed to get receipts", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, MessageReceiptsResponse{Success: true, MessageReceipts: *receipts})
+	})
+}
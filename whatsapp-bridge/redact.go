@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// How message content appears in logs and the audit log, set with
+// WHATSAPP_LOG_REDACT
+const (
+	redactHash     = "hash"     // A short hash and the length, the default
+	redactTruncate = "truncate" // The first WHATSAPP_LOG_REDACT_CHARS characters
+	redactOff      = "off"      // The full content
+)
+
+// Keys of JSON request and response fields holding message content
+var contentFields = map[string]bool{
+	"message": true,
+	"content": true,
+	"caption": true,
+	"text":    true,
+}
+
+// Get the configured redaction mode, hashing content unless told otherwise
+func redactionMode() string {
+	switch mode := strings.ToLower(envString("WHATSAPP_LOG_REDACT", redactHash)); mode {
+	case redactTruncate, redactOff:
+		return mode
+	}
+	return redactHash
+}
+
+// Message content as it may appear in logs. Hashes let the same content be
+// recognized across log lines without revealing it.
+func logContent(content string) string {
+	if content == "" {
+		return content
+	}
+	switch redactionMode() {
+	case redactOff:
+		return content
+	case redactTruncate:
+		runes := []rune(content)
+		if n := envInt("WHATSAPP_LOG_REDACT_CHARS", 20); len(runes) > n {
+			return string(runes[:max(n, 0)]) + "…"
+		}
+		return content
+	}
+	sum := sha256.Sum256([]byte(content))
+	return fmt.Sprintf("[sha256:%s, %d chars]", hex.EncodeToString(sum[:6]), len([]rune(content)))
+}
+
+// Redact the content fields of a JSON document, keeping everything else.
+// In API responses the top-level message is the status of the envelope and is
+// kept. Text that isn't JSON is redacted as a whole.
+func redactJSONContent(data string, response bool) string {
+	if data == "" || redactionMode() == redactOff {
+		return data
+	}
+	var doc interface{}
+	if err := json.Unmarshal([]byte(data), &doc); err != nil {
+		return logContent(data)
+	}
+	if envelope, ok := doc.(map[string]interface{}); ok && response {
+		for key, field := range envelope {
+			envelope[key] = redactValue(field)
+		}
+	} else {
+		doc = redactValue(doc)
+	}
+	redacted, err := json.Marshal(doc)
+	if err != nil {
+		return logContent(data)
+	}
+	return string(redacted)
+}
+
+// Redact the string content fields of a decoded JSON value, recursively
+func redactValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if s, ok := field.(string); ok && contentFields[key] {
+				v[key] = logContent(s)
+			} else {
+				v[key] = redactValue(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item)
+		}
+	}
+	return v
+}
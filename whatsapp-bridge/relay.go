@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Limits of the chat services messages are relayed to
+const (
+	discordMaxContent  = 2000 // Characters of a Discord message
+	discordMaxUsername = 80   // Characters of the name a Discord webhook posts as
+	slackMaxText       = 4000 // Characters of a Slack message before it is cut
+	relayAttempts      = 3    // Tries per message while the service rate limits
+	relayMaxWait       = time.Minute
+)
+
+// Client for relay webhook calls, with more time than webhookClient as they
+// can carry media
+var relayClient = &http.Client{Timeout: 2 * time.Minute}
+
+// A message waiting to be relayed
+type relayJob struct {
+	route    *NotificationRoute
+	msg      Message
+	chatName string
+}
+
+// Messages are relayed one at a time so they arrive in the order they came in
+var (
+	relayQueue     chan relayJob
+	relayQueueOnce sync.Once
+)
+
+// Queue an incoming message for the Slack or Discord channel or Matrix
+// application service its chat is relayed to, starting the relay worker on first use
+func queueRelay(client *whatsmeow.Client, messageStore *MessageStore, route *NotificationRoute, msg Message, chatName string) {
+	relayQueueOnce.Do(func() {
+		relayQueue = make(chan relayJob, envInt("WHATSAPP_RELAY_QUEUE", 1000))
+		goSafe("relaying messages", func() {
+			for job := range relayQueue {
+				func() {
+					defer recoverPanic("relaying message %s", job.msg.ID)
+					if err := relayMessage(client, messageStore, job); err != nil {
+						bridgeLog.Warnf("Failed to relay message %s of %s to %s: %v", job.msg.ID, job.msg.ChatJID, job.route.Target, err)
+					}
+				}()
+			}
+		})
+	})
+	select {
+	case relayQueue <- relayJob{route: route, msg: msg, chatName: chatName}:
+	default:
+		bridgeLog.Warnf("Relay queue is full, dropping message %s of %s", msg.ID, msg.ChatJID)
+	}
+}
+
+// Largest media file attached to relayed messages, WHATSAPP_RELAY_MAX_MEDIA_MB.
+// Discord rejects larger uploads to webhooks of servers without boosts.
+func relayMaxMediaBytes() int64 {
+	return int64(envInt("WHATSAPP_RELAY_MAX_MEDIA_MB", 8)) << 20
+}
+
+// Relay a message to its route, attaching its media on Discord
+func relayMessage(client *whatsmeow.Client, messageStore *MessageStore, job relayJob) error {
+	names := &senderNames{store: messageStore, names: map[string]string{}}
+	sender := names.name(job.msg)
+	text := relayText(job.msg)
+
+	switch job.route.Target {
+	case routeSlack:
+		return relaySlack(job.route.WebhookURL, sender, job.chatName, text)
+	case routeDiscord:
+		path := forwardableMediaPath(client, messageStore, job.msg, relayMaxMediaBytes())
+		if path != "" {
+			// The label is redundant next to the file itself
+			text = strings.TrimSpace(job.msg.Content)
+		}
+		return relayDiscord(job.route.WebhookURL, sender, job.chatName, text, path)
+	case routeMatrix:
+		ownUser := ""
+		if client != nil && client.Store.ID != nil {
+			ownUser = client.Store.ID.User
+		}
+		return relayMatrix(job.route.WebhookURL, names, job.msg, ownUser)
+	}
+	return fmt.Errorf("unknown relay target %q", job.route.Target)
+}
+
+// Render the text of a relayed message, labeling media the service doesn't
+// get as a file
+func relayText(msg Message) string {
+	text := strings.TrimSpace(msg.Content)
+	if msg.MediaType == "" {
+		return text
+	}
+	label := "[" + msg.MediaType
+	if msg.Filename != "" {
+		label += ": " + msg.Filename
+	}
+	label += "]"
+	if text == "" {
+		return label
+	}
+	return label + " " + text
+}
+
+// Download the media of a message to attach it elsewhere, or return an empty
+// path if there is none, it is view-once, larger than maxBytes or can't be
+// downloaded right now
+func forwardableMediaPath(client *whatsmeow.Client, messageStore *MessageStore, msg Message, maxBytes int64) string {
+	if client == nil || msg.MediaType == "" || msg.MediaType == mediaTypePayment || msg.MediaType == mediaTypeEvent {
+		return ""
+	}
+	if viewOnce, err := messageStore.IsViewOnce(msg.ID, msg.ChatJID); err != nil || viewOnce {
+		return ""
+	}
+	_, _, _, _, _, _, fileLength, err := messageStore.GetMediaInfo(msg.ID, msg.ChatJID)
+	if err != nil || int64(fileLength) > maxBytes {
+		return ""
+	}
+	ok, _, _, path, err := downloadMedia(context.Background(), client, messageStore, msg.ID, msg.ChatJID)
+	if err != nil || !ok {
+		bridgeLog.Warnf("Forwarding message %s without its media: %v", msg.ID, err)
+		return ""
+	}
+	return path
+}
+
+// Cut text to a number of characters, marking that it was cut
+func truncateRunes(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit-1]) + "…"
+}
+
+// Escape the characters Slack treats as markup
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// Post a message to a Slack incoming webhook. Incoming webhooks can't upload
+// files, so media shows as its label.
+func relaySlack(webhookURL, sender, chatName, text string) error {
+	payload, err := json.Marshal(map[string]string{
+		"text": truncateRunes(fmt.Sprintf("*%s* in _%s_\n%s", slackEscaper.Replace(sender), slackEscaper.Replace(chatName), slackEscaper.Replace(text)), slackMaxText),
+	})
+	if err != nil {
+		return err
+	}
+	return postRelay(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, webhookURL, bytes.NewReader(payload))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		return req, err
+	})
+}
+
+// discordPayload is the JSON body of a Discord webhook message
+type discordPayload struct {
+	Username        string                   `json:"username"`
+	Content         string                   `json:"content"`
+	AllowedMentions map[string][]string      `json:"allowed_mentions"`
+	Attachments     []map[string]interface{} `json:"attachments,omitempty"`
+}
+
+// Post a message to a Discord webhook as the sender, with a file if given
+func relayDiscord(webhookURL, sender, chatName, text, filePath string) error {
+	payload := discordPayload{
+		Username: truncateRunes(sender+" · "+chatName, discordMaxUsername),
+		Content:  truncateRunes(text, discordMaxContent),
+		// Nobody on the server gets pinged by whatever was written in WhatsApp
+		AllowedMentions: map[string][]string{"parse": {}},
+	}
+	var file []byte
+	if filePath != "" {
+		var err error
+		if file, err = os.ReadFile(filePath); err != nil {
+			return fmt.Errorf("failed to read media: %v", err)
+		}
+		payload.Attachments = []map[string]interface{}{{"id": 0, "filename": filepath.Base(filePath)}}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	return postRelay(func() (*http.Request, error) {
+		if file == nil {
+			req, err := http.NewRequest(http.MethodPost, webhookURL, bytes.NewReader(body))
+			if err == nil {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			return req, err
+		}
+		var form bytes.Buffer
+		writer := multipart.NewWriter(&form)
+		if err := writer.WriteField("payload_json", string(body)); err != nil {
+			return nil, err
+		}
+		part, err := writer.CreateFormFile("files[0]", filepath.Base(filePath))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write(file); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest(http.MethodPost, webhookURL, &form)
+		if err == nil {
+			req.Header.Set("Content-Type", writer.FormDataContentType())
+		}
+		return req, err
+	})
+}
+
+// POST a relay request, waiting out the rate limit of the service a few times
+func postRelay(newRequest func() (*http.Request, error)) error {
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return fmt.Errorf("invalid relay request: %v", err)
+		}
+		req.Header.Set("User-Agent", "whatsapp-bridge")
+		resp, err := relayClient.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < relayAttempts {
+			time.Sleep(retryAfter(resp.Header.Get("Retry-After")))
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("webhook returned HTTP %d", resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// Parse a Retry-After header in seconds, which Discord gives with decimals,
+// capped at relayMaxWait
+func retryAfter(header string) time.Duration {
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds <= 0 {
+		return time.Second
+	}
+	wait := time.Duration(seconds * float64(time.Second))
+	if wait > relayMaxWait {
+		return relayMaxWait
+	}
+	return wait
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelayToSlack(t *testing.T) {
+	received := make(chan map[string]string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		received <- payload
+	}))
+	defer server.Close()
+
+	chat := "120363000000000201@g.us"
+	setRoutes(t, &NotificationRoute{ChatJID: chat, Target: routeSlack, WebhookURL: server.URL})
+	routeMessage(nil, testStore, Message{ID: "S1", ChatJID: chat, Sender: "15551250001", Content: "a <b> & c", MediaType: "image", Filename: "cat.jpg"}, "Pets")
+
+	select {
+	case payload := <-received:
+		want := "*15551250001* in _Pets_\n[image: cat.jpg] a &lt;b&gt; &amp; c"
+		if payload["text"] != want {
+			t.Errorf("Slack got %q, want %q", payload["text"], want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Slack webhook was not called")
+	}
+}
+
+func TestRelayToDiscord(t *testing.T) {
+	media := filepath.Join(t.TempDir(), "report.pdf")
+	if err := os.WriteFile(media, []byte("%PDF"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var payload discordPayload
+	var file string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil {
+			t.Errorf("Discord got no multipart form: %v", err)
+			return
+		}
+		json.Unmarshal([]byte(r.FormValue("payload_json")), &payload)
+		if f, _, err := r.FormFile("files[0]"); err == nil {
+			data, _ := io.ReadAll(f)
+			file = string(data)
+		}
+	}))
+	defer server.Close()
+
+	long := strings.Repeat("x", 2500)
+	if err := relayDiscord(server.URL, "Alice", strings.Repeat("Chat", 30), "@everyone "+long, media); err != nil {
+		t.Fatal(err)
+	}
+	if n := len([]rune(payload.Content)); n != discordMaxContent {
+		t.Errorf("Content has %d characters, want it cut to %d", n, discordMaxContent)
+	}
+	if n := len([]rune(payload.Username)); n != discordMaxUsername || !strings.HasPrefix(payload.Username, "Alice · ") {
+		t.Errorf("Username %q has %d characters, want the sender cut to %d", payload.Username, n, discordMaxUsername)
+	}
+	if parse, ok := payload.AllowedMentions["parse"]; !ok || len(parse) != 0 {
+		t.Errorf("allowed_mentions = %v, want no mentions parsed", payload.AllowedMentions)
+	}
+	if file != "%PDF" || len(payload.Attachments) != 1 || payload.Attachments[0]["filename"] != "report.pdf" {
+		t.Errorf("Attachment %q %v, want report.pdf", file, payload.Attachments)
+	}
+}
+
+func TestRelayRateLimit(t *testing.T) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0.05")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	if err := relaySlack(server.URL, "Bob", "Chat", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("Webhook was called %d times, want a retry after the rate limit", calls)
+	}
+
+	if got := retryAfter("3600"); got != relayMaxWait {
+		t.Errorf("retryAfter(3600) = %v, want it capped at %v", got, relayMaxWait)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Name the bridge shows under in the linked devices of the phone when paired
+// with a phone number. WhatsApp only accepts common browsers and systems.
+const pairingClientName = "Chrome (Linux)"
+
+// PairingStatus is the progress of pairing started through /api/auth/relogin
+type PairingStatus struct {
+	Active      bool       `json:"active"`
+	QRCode      string     `json:"qr_code,omitempty"`      // Data of the QR code to scan in Linked devices on the phone
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`   // When the QR code is replaced by the next one
+	PairingCode string     `json:"pairing_code,omitempty"` // Code to enter on the phone instead of scanning, if a phone number was given
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	LastError   string     `json:"last_error,omitempty"` // Why the last pairing attempt ended without success
+}
+
+// pairingSession tracks the pairing flow so it can be restarted while the
+// bridge keeps running
+type pairingSession struct {
+	mu         sync.Mutex
+	generation int // Bumped on every start, so a replaced flow can't overwrite the new one
+	cancel     context.CancelFunc
+	status     PairingStatus
+}
+
+// Pairing started through the REST API, if any
+var pairing = &pairingSession{}
+
+// Get the progress of pairing
+func (p *pairingSession) Status() PairingStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+// Record an item of the QR channel of a pairing flow
+func (p *pairingSession) update(generation int, item whatsmeow.QRChannelItem) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if generation != p.generation {
+		return
+	}
+	switch item.Event {
+	case whatsmeow.QRChannelEventCode:
+		expires := time.Now().Add(item.Timeout)
+		p.status.QRCode = item.Code
+		p.status.ExpiresAt = &expires
+	case whatsmeow.QRChannelSuccess.Event:
+		bridgeLog.Infof("Paired with WhatsApp again")
+		p.status = PairingStatus{}
+	default:
+		err := item.Event
+		if item.Error != nil {
+			err = item.Error.Error()
+		}
+		bridgeLog.Warnf("Pairing with WhatsApp ended without success: %s", err)
+		p.status = PairingStatus{LastError: err}
+	}
+}
+
+// Record that a pairing flow failed before its QR channel could tell
+func (p *pairingSession) fail(generation int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if generation == p.generation {
+		p.status = PairingStatus{LastError: err.Error()}
+	}
+}
+
+// Move into the auth required state after the phone or WhatsApp logged the
+// bridge out, keeping the process up so it can be paired again
+func handleLoggedOut(evt *events.LoggedOut) {
+	bridgeLog.Warnf("Logged out of WhatsApp (%s), pair again through POST /api/auth/relogin", evt.Reason)
+	watchdog.setAuthRequired(true)
+	sdNotify("STATUS=Logged out of WhatsApp, pairing is required")
+}
+
+// Start pairing the bridge with a phone, replacing a pairing flow already
+// running. The dead session is deleted first in case whatsmeow couldn't. With
+// a phone number a pairing code is asked for besides the QR codes.
+func startPairing(ctx context.Context, client *whatsmeow.Client, phone string) (PairingStatus, error) {
+	// A session that is only reconnecting must not be thrown away
+	if client.Store.ID != nil && !watchdog.Status().AuthRequired {
+		return PairingStatus{}, newAPIError(ErrCodeConflict, "Already paired as %s", client.Store.ID.User)
+	}
+
+	pairing.mu.Lock()
+	if pairing.cancel != nil {
+		pairing.cancel()
+	}
+	pairing.generation++
+	generation := pairing.generation
+	flowCtx, cancel := context.WithCancel(context.Background())
+	pairing.cancel = cancel
+	started := time.Now()
+	pairing.status = PairingStatus{Active: true, StartedAt: &started}
+	pairing.mu.Unlock()
+
+	fail := func(err error) (PairingStatus, error) {
+		cancel()
+		client.Disconnect()
+		pairing.fail(generation, err)
+		return PairingStatus{}, err
+	}
+
+	client.Disconnect()
+	if client.Store.ID != nil {
+		bridgeLog.Infof("Deleting the logged out session of %s", client.Store.ID.User)
+		if err := client.Store.Delete(ctx); err != nil {
+			return fail(fmt.Errorf("could not delete the logged out session: %w", err))
+		}
+	}
+	watchdog.setAuthRequired(true)
+
+	qrChan, err := client.GetQRChannel(flowCtx)
+	if err != nil {
+		return fail(err)
+	}
+	if err := client.Connect(); err != nil {
+		return fail(newCallError(ErrCodeNotConnected, err, "could not connect to WhatsApp: %v", err))
+	}
+
+	// Answer with the first QR code, the next ones are in GET /api/auth/relogin
+	queryCtx, queryCancel := callContext(ctx, callQuery)
+	defer queryCancel()
+	select {
+	case item, ok := <-qrChan:
+		if !ok || item.Event != whatsmeow.QRChannelEventCode {
+			return fail(newAPIError(ErrCodeInternal, "pairing ended before a QR code arrived: %s", item.Event))
+		}
+		pairing.update(generation, item)
+	case <-queryCtx.Done():
+		return fail(newCallError(ErrCodeTimeout, queryCtx.Err(), "no QR code arrived from WhatsApp"))
+	}
+	goSafe("pairing with WhatsApp", func() {
+		for item := range qrChan {
+			pairing.update(generation, item)
+		}
+	})
+
+	if phone != "" {
+		code, err := client.PairPhone(queryCtx, phone, true, whatsmeow.PairClientChrome, pairingClientName)
+		if err != nil {
+			errCode := ErrCodeInternal
+			if errors.Is(err, whatsmeow.ErrPhoneNumberTooShort) || errors.Is(err, whatsmeow.ErrPhoneNumberIsNotInternational) {
+				errCode = ErrCodeInvalidRequest
+			}
+			return fail(newCallError(errCode, err, "could not get a pairing code for %s: %v", phone, err))
+		}
+		pairing.mu.Lock()
+		if generation == pairing.generation {
+			pairing.status.PairingCode = code
+		}
+		pairing.mu.Unlock()
+	}
+	bridgeLog.Infof("Started pairing with WhatsApp")
+	return pairing.Status(), nil
+}
+
+// ReloginRequest represents the request body for restarting pairing
+type ReloginRequest struct {
+	Phone string `json:"phone,omitempty"` // Phone number of the account in international format, to pair with a code instead of a QR code
+}
+
+// ReloginResponse represents the response for the relogin API
+type ReloginResponse struct {
+	Success bool `json:"success"`
+	PairingStatus
+}
+
+// Register the REST handlers for pairing the bridge again after a logout
+func registerReloginHandlers(client *whatsmeow.Client) {
+	documentAPI(
+		apiOperation{
+			Method:   http.MethodGet,
+			Path:     "/api/auth/relogin",
+			Summary:  "Get the progress of pairing and the current QR code",
+			Tag:      "admin",
+			Scope:    ScopeAdmin,
+			Response: ReloginResponse{},
+		},
+		apiOperation{
+			Method:   http.MethodPost,
+			Path:     "/api/auth/relogin",
+			Summary:  "Start pairing with a phone again after being logged out, without restarting the bridge",
+			Tag:      "admin",
+			Scope:    ScopeAdmin,
+			Audit:    true,
+			Request:  ReloginRequest{},
+			Response: ReloginResponse{},
+		},
+	)
+	http.HandleFunc("/api/auth/relogin", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, ReloginResponse{Success: true, PairingStatus: pairing.Status()})
+
+		case http.MethodPost:
+			var req ReloginRequest
+			if r.ContentLength != 0 && !decodeJSON(w, r, &req) {
+				return
+			}
+			status, err := startPairing(r.Context(), client, req.Phone)
+			if err != nil {
+				writeAPIError(w, "Failed to start pairing", err)
+				return
+			}
+			writeJSON(w, http.StatusOK, ReloginResponse{Success: true, PairingStatus: status})
+
+		default:
+			writeError(w, ErrCodeMethodNotAllowed, "Method not allowed", nil)
+		}
+	})
+}
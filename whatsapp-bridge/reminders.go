@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Status of a reminder
+const (
+	ReminderPending = "pending" // Waiting for its time
+	ReminderDue     = "due"     // Its time came and it was announced, waiting to be completed
+	ReminderDone    = "done"    // Completed
+)
+
+// How often the reminder worker looks for due reminders
+const reminderCheckInterval = 30 * time.Second
+
+// Reminder is a follow-up on a chat or message at a given time
+type Reminder struct {
+	ID          int64      `json:"id"`
+	ChatJID     string     `json:"chat_jid"`
+	MessageID   string     `json:"message_id,omitempty"` // Message to follow up on, the whole chat when empty
+	Note        string     `json:"note,omitempty"`
+	RemindAt    time.Time  `json:"remind_at"`
+	Status      string     `json:"status"`
+	NotifySelf  bool       `json:"notify_self"`           // Send a message to my self-chat when due
+	WebhookURL  string     `json:"webhook_url,omitempty"` // URL to POST to when due, instead of WHATSAPP_REMINDER_WEBHOOK_URL
+	CreatedAt   time.Time  `json:"created_at"`
+	FiredAt     *time.Time `json:"fired_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// ReminderRequest represents the request body for creating a reminder
+type ReminderRequest struct {
+	ChatJID    string     `json:"chat_jid"`
+	MessageID  string     `json:"message_id,omitempty"`
+	Note       string     `json:"note,omitempty"`
+	RemindAt   *time.Time `json:"remind_at,omitempty"`
+	InMinutes  int        `json:"in_minutes,omitempty"` // Instead of remind_at
+	NotifySelf bool       `json:"notify_self,omitempty"`
+	WebhookURL string     `json:"webhook_url,omitempty"`
+}
+
+// SnoozeReminderRequest represents the request body for snoozing a reminder
+type SnoozeReminderRequest struct {
+	RemindAt  *time.Time `json:"remind_at,omitempty"`
+	InMinutes int        `json:"in_minutes,omitempty"` // Instead of remind_at
+}
+
+// Get the time a request asks for, either absolute or in minutes from now
+func reminderTime(at *time.Time, inMinutes int) (time.Time, error) {
+	switch {
+	case at != nil && inMinutes != 0:
+		return time.Time{}, newAPIError(ErrCodeInvalidRequest, "Give either remind_at or in_minutes, not both")
+	case at != nil:
+		return *at, nil
+	case inMinutes > 0:
+		return time.Now().Add(time.Duration(inMinutes) * time.Minute), nil
+	}
+	return time.Time{}, newAPIError(ErrCodeInvalidRequest, "remind_at or a positive in_minutes is required")
+}
+
+const reminderColumns = `id, chat_jid, COALESCE(message_id, ''), COALESCE(note, ''), remind_at, status, COALESCE(notify_self, 0),
+	COALESCE(webhook_url, ''), created_at, fired_at, completed_at`
+
+// Scan a reminder row selected with reminderColumns
+func scanReminder(row interface{ Scan(...interface{}) error }) (*Reminder, error) {
+	var rem Reminder
+	var firedAt, completedAt sql.NullTime
+	if err := row.Scan(&rem.ID, &rem.ChatJID, &rem.MessageID, &rem.Note, &rem.RemindAt, &rem.Status, &rem.NotifySelf,
+		&rem.WebhookURL, &rem.CreatedAt, &firedAt, &completedAt); err != nil {
+		return nil, err
+	}
+	if firedAt.Valid {
+		rem.FiredAt = &firedAt.Time
+	}
+	if completedAt.Valid {
+		rem.CompletedAt = &completedAt.Time
+	}
+	return &rem, nil
+}
+
+// Store a new reminder, setting its ID
+func (store *MessageStore) StoreReminder(rem *Reminder) error {
+	rem.Status = ReminderPending
+	rem.CreatedAt = time.Now()
+	// Timestamps are compared as text, so store them in local time like messages
+	rem.RemindAt = rem.RemindAt.Local()
+	result, err := store.db.Exec(
+		`INSERT INTO reminders (chat_jid, message_id, note, remind_at, status, notify_self, webhook_url, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		rem.ChatJID, rem.MessageID, rem.Note, rem.RemindAt, rem.Status, rem.NotifySelf, rem.WebhookURL, rem.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	rem.ID, err = result.LastInsertId()
+	return err
+}
+
+// Get a reminder, sql.ErrNoRows if it doesn't exist
+func (store *MessageStore) GetReminder(id int64) (*Reminder, error) {
+	return scanReminder(store.db.QueryRow("SELECT "+reminderColumns+" FROM reminders WHERE id = ?", id))
+}
+
+// List reminders by time, optionally only those with a status
+func (store *MessageStore) ListReminders(status string, limit, offset int) ([]*Reminder, error) {
+	query := "SELECT " + reminderColumns + " FROM reminders"
+	var args []interface{}
+	if status != "" {
+		query += " WHERE status = ?"
+		args = append(args, status)
+	}
+	query += " ORDER BY remind_at LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reminders := []*Reminder{}
+	for rows.Next() {
+		rem, err := scanReminder(rows)
+		if err != nil {
+			return nil, err
+		}
+		reminders = append(reminders, rem)
+	}
+	return reminders, rows.Err()
+}
+
+// Move a reminder to a new time, pending again. Returns false if it doesn't exist.
+func (store *MessageStore) SnoozeReminder(id int64, remindAt time.Time) (bool, error) {
+	result, err := store.db.Exec(
+		"UPDATE reminders SET remind_at = ?, status = ?, fired_at = NULL, completed_at = NULL WHERE id = ?",
+		remindAt.Local(), ReminderPending, id,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Mark a reminder done. Returns false if it doesn't exist.
+func (store *MessageStore) CompleteReminder(id int64) (bool, error) {
+	result, err := store.db.Exec(
+		"UPDATE reminders SET status = ?, completed_at = ? WHERE id = ?",
+		ReminderDone, time.Now(), id,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Mark the pending reminders whose time has come as due and return them
+func (store *MessageStore) claimDueReminders(now time.Time) ([]*Reminder, error) {
+	rows, err := store.db.Query(
+		"SELECT "+reminderColumns+" FROM reminders WHERE status = ? AND remind_at <= ? ORDER BY remind_at",
+		ReminderPending, now.Local(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	var due []*Reminder
+	for rows.Next() {
+		rem, err := scanReminder(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		due = append(due, rem)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var claimed []*Reminder
+	for _, rem := range due {
+		// Snoozed or completed in the meantime otherwise
+		result, err := store.db.Exec(
+			"UPDATE reminders SET status = ?, fired_at = ? WHERE id = ? AND status = ?",
+			ReminderDue, now, rem.ID, ReminderPending,
+		)
+		if err != nil {
+			return claimed, err
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			rem.Status, rem.FiredAt = ReminderDue, &now
+			claimed = append(claimed, rem)
+		}
+	}
+	return claimed, nil
+}
+
+// ReminderAlert is the payload POSTed to webhooks when a reminder is due
+type ReminderAlert struct {
+	Event    string    `json:"event"` // Always "reminder.due"
+	Reminder *Reminder `json:"reminder"`
+	ChatName string    `json:"chat_name"`
+	Message  *Message  `json:"message,omitempty"` // The message followed up on, if it is still stored
+}
+
+// Announce a due reminder through its webhook and self-chat
+func announceReminder(client *whatsmeow.Client, messageStore *MessageStore, rem *Reminder) {
+	alert := ReminderAlert{Event: "reminder.due", Reminder: rem, ChatName: messageStore.chatName(rem.ChatJID)}
+	if rem.MessageID != "" {
+		if rows, err := messageStore.db.Query("SELECT "+messageColumns+" FROM messages WHERE id = ? AND chat_jid = ?", rem.MessageID, rem.ChatJID); err == nil {
+			if messages, err := scanMessages(rows); err == nil && len(messages) > 0 {
+				alert.Message = &messages[0]
+			}
+		}
+	}
+	bridgeLog.Infof("Reminder #%d for %s is due", rem.ID, alert.ChatName)
+
+	webhookURL := rem.WebhookURL
+	if webhookURL == "" {
+		webhookURL = envString("WHATSAPP_REMINDER_WEBHOOK_URL", "")
+	}
+	if webhookURL != "" {
+		if err := postWebhook(webhookURL, alert); err != nil {
+			bridgeLog.Warnf("Failed to call webhook for reminder #%d: %v", rem.ID, err)
+		}
+	}
+
+	if rem.NotifySelf {
+		text := fmt.Sprintf("⏰ Reminder #%d: follow up on %s", rem.ID, alert.ChatName)
+		if rem.Note != "" {
+			text += "\n" + rem.Note
+		}
+		if alert.Message != nil && alert.Message.Content != "" {
+			text += "\n\n> " + truncateText(alert.Message.Content, 300)
+		}
+		if err := sendSelfMessage(context.Background(), client, text); err != nil {
+			bridgeLog.Warnf("Failed to send reminder #%d to self-chat: %v", rem.ID, err)
+		}
+	}
+}
+
+// Announce reminders as they become due
+func runReminderWorker(client *whatsmeow.Client, messageStore *MessageStore) {
+	ticker := time.NewTicker(reminderCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		due, err := messageStore.claimDueReminders(time.Now())
+		if err != nil {
+			bridgeLog.Warnf("Failed to check due reminders: %v", err)
+		}
+		for _, rem := range due {
+			func() {
+				defer recoverPanic("announcing reminder %d", rem.ID)
+				announceReminder(client, messageStore, rem)
+			}()
+		}
+	}
+}
+
+// ListRemindersResponse represents the response for the list reminders API
+type ListRemindersResponse struct {
+	Success   bool        `json:"success"`
+	Reminders []*Reminder `json:"reminders"`
+	Page
+}
+
+// ReminderResponse represents the response for the single reminder APIs
+type ReminderResponse struct {
+	Success  bool      `json:"success"`
+	Reminder *Reminder `json:"reminder"`
+}
+
+// Parse the {id} path value of a reminder route
+func reminderIDFromPath(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return 0, newAPIError(ErrCodeInvalidRequest, "Reminder ID must be an integer")
+	}
+	return id, nil
+}
+
+// Respond with a reminder after changing it, or not_found
+func writeReminder(w http.ResponseWriter, messageStore *MessageStore, id int64, found bool, err error) {
+	if err != nil {
+		writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to update reminder: %v", err), nil)
+		return
+	}
+	if !found {
+		writeError(w, ErrCodeNotFound, fmt.Sprintf("Reminder %d not found", id), nil)
+		return
+	}
+	rem, err := messageStore.GetReminder(id)
+	if err != nil {
+		writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to load reminder: %v", err), nil)
+		return
+	}
+	writeJSON(w, http.StatusOK, ReminderResponse{Success: true, Reminder: rem})
+}
+
+// Register the REST handlers for follow-up reminders
+func registerReminderHandlers(messageStore *MessageStore) {
+	idParam := apiParam{Name: "id", In: "path", Description: "ID of the reminder", Required: true, Type: "integer"}
+
+	// Handler for listing reminders
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/reminders",
+		Summary: "List follow-up reminders by time",
+		Tag:     "reminders",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "status", Description: "Only reminders with this status (pending, due, done)"},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ListRemindersResponse{},
+	})
+	http.HandleFunc("GET /api/reminders", func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		reminders, err := messageStore.ListReminders(r.URL.Query().Get("status"), limit+1, offset)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list reminders: %v", err), nil)
+			return
+		}
+		reminders, page := trimPage(reminders, offset, limit)
+		writeJSON(w, http.StatusOK, ListRemindersResponse{Success: true, Reminders: reminders, Page: page})
+	})
+
+	// Handler for creating a reminder
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/reminders",
+		Summary:  "Flag a chat or message to follow up on at a given time",
+		Tag:      "reminders",
+		Scope:    ScopeReadMessages,
+		Audit:    true,
+		Request:  ReminderRequest{},
+		Response: ReminderResponse{},
+	})
+	http.HandleFunc("POST /api/reminders", func(w http.ResponseWriter, r *http.Request) {
+		var req ReminderRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if req.ChatJID == "" {
+			writeError(w, ErrCodeInvalidRequest, "chat_jid is required", nil)
+			return
+		}
+		if _, err := types.ParseJID(req.ChatJID); err != nil {
+			writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("Invalid chat_jid: %v", err), nil)
+			return
+		}
+		if req.WebhookURL != "" {
+			if u, err := url.Parse(req.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				writeError(w, ErrCodeInvalidRequest, "webhook_url must be an http(s) URL", nil)
+				return
+			}
+		}
+		remindAt, err := reminderTime(req.RemindAt, req.InMinutes)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		rem := &Reminder{
+			ChatJID:    req.ChatJID,
+			MessageID:  req.MessageID,
+			Note:       strings.TrimSpace(req.Note),
+			RemindAt:   remindAt,
+			NotifySelf: req.NotifySelf,
+			WebhookURL: req.WebhookURL,
+		}
+		if err := messageStore.StoreReminder(rem); err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to store reminder: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusCreated, ReminderResponse{Success: true, Reminder: rem})
+	})
+
+	// Handler for snoozing a reminder
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/reminders/{id}/snooze",
+		Summary:  "Move a reminder to a later time, making it pending again",
+		Tag:      "reminders",
+		Scope:    ScopeReadMessages,
+		Audit:    true,
+		Params:   []apiParam{idParam},
+		Request:  SnoozeReminderRequest{},
+		Response: ReminderResponse{},
+	})
+	http.HandleFunc("POST /api/reminders/{id}/snooze", func(w http.ResponseWriter, r *http.Request) {
+		id, err := reminderIDFromPath(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		var req SnoozeReminderRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		remindAt, err := reminderTime(req.RemindAt, req.InMinutes)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		found, err := messageStore.SnoozeReminder(id, remindAt)
+		writeReminder(w, messageStore, id, found, err)
+	})
+
+	// Handler for completing a reminder
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/reminders/{id}/complete",
+		Summary:  "Mark a reminder as done",
+		Tag:      "reminders",
+		Scope:    ScopeReadMessages,
+		Audit:    true,
+		Params:   []apiParam{idParam},
+		Response: ReminderResponse{},
+	})
+	http.HandleFunc("POST /api/reminders/{id}/complete", func(w http.ResponseWriter, r *http.Request) {
+		id, err := reminderIDFromPath(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		found, err := messageStore.CompleteReminder(id)
+		writeReminder(w, messageStore, id, found, err)
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Get the time of my last message in a chat, nil if I never wrote there
+func (store *MessageStore) lastReplyTime(chatJID string) (*time.Time, error) {
+	var t time.Time
+	err := store.db.QueryRow(
+		"SELECT timestamp FROM messages WHERE chat_jid = ? AND is_from_me = 1 ORDER BY timestamp DESC LIMIT 1",
+		chatJID,
+	).Scan(&t)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// UnansweredResponse represents the response for the suggested replies API
+type UnansweredResponse struct {
+	Success      bool       `json:"success"`
+	ChatJID      string     `json:"chat_jid"`
+	LastReply    *time.Time `json:"last_reply,omitempty"`    // My last message in the chat
+	WaitingSince *time.Time `json:"waiting_since,omitempty"` // The oldest message listed
+	Messages     []Message  `json:"messages"`                // Incoming messages since my last one, newest first
+	Page
+}
+
+// Register the REST handler listing the messages of a chat waiting for a reply
+func registerReplyHandlers(messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/chats/{jid}/suggested-replies",
+		Summary: "List the incoming messages of a chat that came after my last message there, newest first, to find chats needing a response",
+		Tag:     "chats",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "jid", In: "path", Description: "Chat JID", Required: true},
+			{Name: "after_time", Description: "Only messages after this time, to ignore old unanswered messages" + timeFormatsHint},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: UnansweredResponse{},
+	})
+	http.HandleFunc("GET /api/chats/{jid}/suggested-replies", func(w http.ResponseWriter, r *http.Request) {
+		chatJID := r.PathValue("jid")
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		after, err := parseTimeParam(r, "after_time")
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		lastReply, err := messageStore.lastReplyTime(chatJID)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to find last reply: %v", err), nil)
+			return
+		}
+		// Everything after my last message is incoming
+		if lastReply != nil && (after == nil || lastReply.After(*after)) {
+			after = lastReply
+		}
+
+		messages, page, err := messageStore.QueryMessagesPage(MessageFilter{
+			ChatJID: chatJID,
+			Revoked: revokedExclude,
+			After:   after,
+			Limit:   limit,
+			Offset:  offset,
+		})
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list messages: %v", err), nil)
+			return
+		}
+
+		resp := UnansweredResponse{Success: true, ChatJID: chatJID, LastReply: lastReply, Messages: messages, Page: page}
+		if len(messages) > 0 {
+			resp.WaitingSince = &messages[len(messages)-1].Time
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
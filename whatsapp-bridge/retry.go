@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Store a message whose send failed for lack of a connection, to be retried
+// after reconnecting
+func (store *MessageStore) StoreRetryMessage(caller, recipient, message, mediaPath, errMsg string) (int64, error) {
+	result, err := store.db.Exec(
+		"INSERT INTO outbox (created_at, caller, recipient, message, media_path, status, error, attempts) VALUES (?, ?, ?, ?, ?, ?, ?, 1)",
+		time.Now(), caller, recipient, message, mediaPath, OutboxRetry, errMsg,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// Record a failed retry, counting the attempt
+func (store *MessageStore) RecordRetryAttempt(id int64, status, errMsg string) error {
+	_, err := store.db.Exec(
+		"UPDATE outbox SET status = ?, error = ?, attempts = COALESCE(attempts, 0) + 1 WHERE id = ?",
+		status, errMsg, id,
+	)
+	return err
+}
+
+// Whether a send failed because the connection to WhatsApp is down, as opposed
+// to the message itself being rejected
+func isConnectionError(client waClient, err error) bool {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.Code == ErrCodeNotConnected {
+		return true
+	}
+	return !client.IsConnected()
+}
+
+// Whether failed sends should be kept for a retry, for all sends or on request
+func retryEnabled(requested bool) bool {
+	return requested || envBool("WHATSAPP_RETRY_FAILED_SENDS", false)
+}
+
+// Retry the sends that failed while disconnected, oldest first. Messages that
+// fail again for lack of a connection stay queued until they run out of attempts.
+func retryFailedSends(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore) {
+	queued, err := messageStore.ListOutbox(OutboxRetry, -1, 0)
+	if err != nil {
+		bridgeLog.Warnf("Failed to list messages to retry: %v", err)
+		return
+	}
+	maxAttempts := envInt("WHATSAPP_RETRY_MAX_ATTEMPTS", 5)
+
+	for i := len(queued) - 1; i >= 0; i-- {
+		m := queued[i]
+		claimed, err := messageStore.TransitionOutboxMessage(m.ID, OutboxRetry, OutboxApproved)
+		if err != nil || !claimed {
+			continue
+		}
+
+		_, err = sendWhatsAppMessage(ctx, client, messageStore, m.Recipient, m.Message, m.MediaPath)
+		if err == nil {
+			bridgeLog.Infof("Retried message #%d to %s was sent", m.ID, m.Recipient)
+			if err := messageStore.UpdateOutboxStatus(m.ID, OutboxSent, ""); err != nil {
+				bridgeLog.Warnf("Failed to update outbox message #%d: %v", m.ID, err)
+			}
+			continue
+		}
+
+		status := OutboxFailed
+		if isConnectionError(client, err) && m.Attempts+1 < maxAttempts {
+			status = OutboxRetry
+		}
+		bridgeLog.Warnf("Retry of message #%d to %s failed (%s): %v", m.ID, m.Recipient, status, err)
+		if err := messageStore.RecordRetryAttempt(m.ID, status, err.Error()); err != nil {
+			bridgeLog.Warnf("Failed to update outbox message #%d: %v", m.ID, err)
+		}
+		// No point in trying the rest on a connection that just dropped again
+		if status == OutboxRetry {
+			return
+		}
+	}
+}
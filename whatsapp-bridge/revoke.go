@@ -0,0 +1,136 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Values of the revoked message filter
+const (
+	revokedInclude = "include" // Revoked messages are listed like any other
+	revokedExclude = "exclude"
+	revokedOnly    = "only"
+)
+
+// Flag a stored message as revoked by its sender, keeping its content
+func (store *MessageStore) MarkRevoked(messageID, chatJID string, revokedAt time.Time) (bool, error) {
+	result, err := store.db.Exec(
+		"UPDATE messages SET is_revoked = 1, revoked_at = ? WHERE id = ? AND chat_jid = ?",
+		revokedAt, messageID, chatJID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// Tables holding rows derived from a message, keyed by its message_id and chat_jid
+var messageDerivedTables = []string{
+	"message_tags", "links", "extracted_events", "group_events", "group_event_responses",
+	"mentions", "payments", "message_receipts", "pinned_messages", "media_retries", "live_locations", "contact_dates",
+	"message_translations", "extracted_entities", "message_embeddings", "tasks",
+}
+
+// Remove a message and everything derived from it, including its copy in the
+// chat's archive and its downloaded media
+func (store *MessageStore) DeleteMessage(messageID, chatJID string) (bool, error) {
+	var mediaType, filename string
+	store.db.QueryRow(
+		"SELECT COALESCE(media_type, ''), COALESCE(filename, '') FROM messages WHERE id = ? AND chat_jid = ?", messageID, chatJID,
+	).Scan(&mediaType, &filename)
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	deleted, err := deleteMessageRows(tx, messageID, chatJID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return false, err
+	}
+
+	archived, err := removeArchivedMessage(store, messageID, chatJID)
+	if err != nil {
+		return deleted, err
+	}
+	if archived != nil {
+		deleted = true
+		if mediaType == "" {
+			mediaType, filename = archived.MediaType, archived.Filename
+		}
+	}
+	if mediaType != "" {
+		store.removeMediaFile(chatJID, filename)
+	}
+	return deleted, nil
+}
+
+// Remove the downloaded media file of a deleted message, unless another
+// message of the chat, stored or archived, has a file of the same name
+func (store *MessageStore) removeMediaFile(chatJID, filename string) {
+	if filename == "" || filepath.Base(filename) != filename {
+		return
+	}
+	var used int
+	store.db.QueryRow(
+		`SELECT (SELECT COUNT(*) FROM messages WHERE chat_jid = ? AND filename = ?) +
+		(SELECT COUNT(*) FROM archived_media WHERE chat_jid = ? AND filename = ?)`,
+		chatJID, filename, chatJID, filename,
+	).Scan(&used)
+	if used > 0 {
+		return
+	}
+	if err := os.Remove(filepath.Join(mediaDirForChat(chatJID), filename)); err != nil && !os.IsNotExist(err) {
+		bridgeLog.Warnf("Failed to remove media file %s of %s: %v", filename, chatJID, err)
+	}
+}
+
+// Delete the row of a message and the rows derived from it in a transaction
+func deleteMessageRows(tx *sql.Tx, messageID, chatJID string) (bool, error) {
+	for _, table := range messageDerivedTables {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE message_id = ? AND chat_jid = ?", messageID, chatJID); err != nil {
+			return false, err
+		}
+	}
+	// The UID is never handed out again, so mail clients drop the message
+	if _, err := tx.Exec("DELETE FROM imap_uids WHERE message_id = ? AND mailbox_jid = ?", messageID, chatJID); err != nil {
+		return false, err
+	}
+	result, err := tx.Exec("DELETE FROM messages WHERE id = ? AND chat_jid = ?", messageID, chatJID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// Apply a revoke ("delete for everyone") to the stored message. By default the
+// original is kept and flagged, with WHATSAPP_KEEP_REVOKED=false it is removed
+// so the archive reflects the deletion.
+func handleRevoke(messageStore *MessageStore, msg *events.Message, protocol *waProto.ProtocolMessage) {
+	messageID := protocol.GetKey().GetID()
+	if messageID == "" {
+		return
+	}
+	chatJID := msg.Info.Chat.String()
+
+	var err error
+	if envBool("WHATSAPP_KEEP_REVOKED", true) {
+		_, err = messageStore.MarkRevoked(messageID, chatJID, msg.Info.Timestamp)
+	} else {
+		_, err = messageStore.DeleteMessage(messageID, chatJID)
+	}
+	if err != nil {
+		bridgeLog.Warnf("Failed to apply revoke of message %s: %v", messageID, err)
+	}
+}
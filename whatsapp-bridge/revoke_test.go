@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDeleteMessageRemovesDerivedRows(t *testing.T) {
+	chat := "15551330001@s.whatsapp.net"
+	storeTestMessage(t, Message{ID: "DEL1", ChatJID: chat, Sender: "15551330001", Content: "see you at 8"}, "", nil, 0)
+	for _, table := range messageDerivedTables {
+		if _, err := testStore.db.Exec("INSERT INTO "+table+" (message_id, chat_jid) VALUES (?, ?)", "DEL1", chat); err != nil {
+			t.Fatalf("%s: %v", table, err)
+		}
+	}
+	if _, err := testStore.db.Exec("INSERT INTO imap_uids (mailbox_jid, message_id, uid) VALUES (?, ?, ?)", chat, "DEL1", 1330001); err != nil {
+		t.Fatal(err)
+	}
+
+	if deleted, err := testStore.DeleteMessage("DEL1", chat); err != nil || !deleted {
+		t.Fatalf("DeleteMessage = %v, %v", deleted, err)
+	}
+	for _, table := range append([]string{"messages", "imap_uids"}, messageDerivedTables...) {
+		column := "message_id"
+		if table == "messages" {
+			column = "id"
+		}
+		var n int
+		if err := testStore.db.QueryRow("SELECT COUNT(*) FROM " + table + " WHERE " + column + " = 'DEL1'").Scan(&n); err != nil {
+			t.Fatalf("%s: %v", table, err)
+		}
+		if n != 0 {
+			t.Errorf("%s keeps %d rows of the deleted message", table, n)
+		}
+	}
+}
+
+func TestDeleteMessageRemovesMediaAndArchivedCopy(t *testing.T) {
+	chat := "15551330002@s.whatsapp.net"
+	sent := time.Date(2025, 2, 1, 9, 0, 0, 0, time.Local)
+	storeTestMessage(t, Message{ID: "DEL2", ChatJID: chat, Sender: "15551330002", MediaType: "image", Filename: "old.jpg", Time: sent}, "", nil, 0)
+	storeTestMessage(t, Message{ID: "DEL3", ChatJID: chat, Sender: "15551330002", Content: "nice", Time: sent.Add(time.Minute)}, "", nil, 0)
+	storeTestMessage(t, Message{ID: "DEL4", ChatJID: chat, Sender: "15551330002", MediaType: "image", Filename: "new.jpg", Time: sent.AddDate(0, 6, 0)}, "", nil, 0)
+	dir := mediaDirForChat(chat)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"old.jpg", "new.jpg"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("jpeg"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := archiveChat(testStore, chat, sent.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"DEL2", "DEL4"} {
+		if deleted, err := testStore.DeleteMessage(id, chat); err != nil || !deleted {
+			t.Fatalf("DeleteMessage(%s) = %v, %v", id, deleted, err)
+		}
+	}
+	for _, name := range []string{"old.jpg", "new.jpg"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("Media file %s of a deleted message is still there", name)
+		}
+	}
+	archives, _ := testStore.ListArchives(chat)
+	if len(archives) != 1 || archives[0].MessageCount != 1 {
+		t.Fatalf("Archives after the delete %+v, want one holding only DEL3", archives)
+	}
+	if messages, err := readArchiveFile(archives[0].Path); err != nil || len(messages) != 1 || messages[0].ID != "DEL3" {
+		t.Errorf("Archive holds %+v, %v", messages, err)
+	}
+	var protected int
+	testStore.db.QueryRow("SELECT COUNT(*) FROM archived_media WHERE chat_jid = ?", chat).Scan(&protected)
+	if protected != 0 {
+		t.Errorf("%d media of deleted messages still protected as archived", protected)
+	}
+
+	if deleted, err := testStore.DeleteMessage("DEL3", chat); err != nil || !deleted {
+		t.Fatalf("Deleting the last archived message = %v, %v", deleted, err)
+	}
+	if archives, _ := testStore.ListArchives(chat); len(archives) != 0 {
+		t.Errorf("Empty archive kept: %+v", archives)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Targets incoming messages of a chat can be routed to
+const (
+	routeWebhook = "webhook" // POST the message to a URL
+	routeSSE     = "sse"     // Publish the message to a topic of /api/events
+	routeSlack   = "slack"   // Mirror the message to a Slack channel through an incoming webhook
+	routeDiscord = "discord" // Mirror the message to a Discord channel through a channel webhook
+	routeMatrix  = "matrix"  // PUT the message as Matrix events to an application service or bridge
+	routeNone    = "none"    // Don't forward the messages, overriding the default route
+)
+
+// Chat JID of the route applying to chats without one of their own
+const defaultRouteChat = "*"
+
+// How often an event stream sends a comment so proxies keep it open
+const eventStreamHeartbeat = 30 * time.Second
+
+// Names of event stream topics
+var topicPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// NotificationRoute sends the incoming messages of a chat to a downstream
+// automation
+type NotificationRoute struct {
+	ChatJID     string    `json:"chat_jid"` // "*" for the default route
+	Target      string    `json:"target"`   // webhook, sse, slack, discord, matrix or none
+	WebhookURL  string    `json:"webhook_url,omitempty"`
+	Topic       string    `json:"topic,omitempty"`
+	NotifyMuted bool      `json:"notify_muted"` // Forward messages of chats muted in WhatsApp too
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// NotificationRouteRequest represents the request body for setting a route
+type NotificationRouteRequest struct {
+	Target      string `json:"target"`
+	WebhookURL  string `json:"webhook_url,omitempty"` // Required for webhook, slack, discord and matrix routes
+	Topic       string `json:"topic,omitempty"`       // Required for sse routes
+	NotifyMuted bool   `json:"notify_muted,omitempty"`
+}
+
+// Validate a route request for a chat and turn it into a route
+func (req NotificationRouteRequest) toRoute(chatJID string) (*NotificationRoute, error) {
+	if chatJID != defaultRouteChat {
+		jid, err := types.ParseJID(chatJID)
+		if err != nil {
+			return nil, newAPIError(ErrCodeInvalidRequest, "Invalid chat JID: %v", err)
+		}
+		chatJID = jid.ToNonAD().String()
+	}
+	route := &NotificationRoute{ChatJID: chatJID, Target: req.Target, NotifyMuted: req.NotifyMuted}
+	switch req.Target {
+	case routeWebhook, routeSlack, routeDiscord, routeMatrix:
+		if u, err := url.Parse(req.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, newAPIError(ErrCodeInvalidRequest, "webhook_url must be an http(s) URL")
+		}
+		if req.Target == routeMatrix && matrixDomain() == "" {
+			return nil, newAPIError(ErrCodeInvalidRequest, "matrix routes need the server name of the homeserver, set WHATSAPP_MATRIX_DOMAIN")
+		}
+		route.WebhookURL = req.WebhookURL
+	case routeSSE:
+		if !topicPattern.MatchString(req.Topic) {
+			return nil, newAPIError(ErrCodeInvalidRequest, "topic must be 1 to 64 letters, digits, dots, dashes or underscores")
+		}
+		route.Topic = req.Topic
+	case routeNone:
+	default:
+		return nil, newAPIError(ErrCodeInvalidRequest, "target must be %s, %s, %s, %s, %s or %s", routeWebhook, routeSSE, routeSlack, routeDiscord, routeMatrix, routeNone)
+	}
+	return route, nil
+}
+
+// List all notification routes, the default route first
+func (store *MessageStore) ListNotificationRoutes() ([]*NotificationRoute, error) {
+	rows, err := store.db.Query(`SELECT chat_jid, target, COALESCE(webhook_url, ''), COALESCE(topic, ''), notify_muted, updated_at
+		FROM notification_routes ORDER BY chat_jid != '*', chat_jid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	routes := []*NotificationRoute{}
+	for rows.Next() {
+		var r NotificationRoute
+		if err := rows.Scan(&r.ChatJID, &r.Target, &r.WebhookURL, &r.Topic, &r.NotifyMuted, &r.UpdatedAt); err != nil {
+			return nil, err
+		}
+		routes = append(routes, &r)
+	}
+	return routes, rows.Err()
+}
+
+// Create or replace the route of a chat
+func (store *MessageStore) SetNotificationRoute(r *NotificationRoute) error {
+	r.UpdatedAt = time.Now()
+	_, err := store.db.Exec(
+		`INSERT OR REPLACE INTO notification_routes (chat_jid, target, webhook_url, topic, notify_muted, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)`,
+		r.ChatJID, r.Target, r.WebhookURL, r.Topic, r.NotifyMuted, r.UpdatedAt,
+	)
+	return err
+}
+
+// Delete the route of a chat, returns false if it has none
+func (store *MessageStore) DeleteNotificationRoute(chatJID string) (bool, error) {
+	result, err := store.db.Exec("DELETE FROM notification_routes WHERE chat_jid = ?", chatJID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// In-memory copy of the routes by chat JID, so routing doesn't hit the
+// database for every message
+var (
+	activeRoutes   map[string]*NotificationRoute
+	activeRoutesMu sync.RWMutex
+)
+
+// Reload the in-memory routes after they changed
+func reloadNotificationRoutes(messageStore *MessageStore) error {
+	routes, err := messageStore.ListNotificationRoutes()
+	if err != nil {
+		return err
+	}
+	byChat := make(map[string]*NotificationRoute, len(routes))
+	for _, r := range routes {
+		byChat[r.ChatJID] = r
+	}
+	activeRoutesMu.Lock()
+	activeRoutes = byChat
+	activeRoutesMu.Unlock()
+	return nil
+}
+
+// Get the route of a chat, falling back to the default route, or nil if its
+// messages aren't routed anywhere
+func routeFor(chatJID string) *NotificationRoute {
+	activeRoutesMu.RLock()
+	defer activeRoutesMu.RUnlock()
+	route, ok := activeRoutes[chatJID]
+	if !ok {
+		route = activeRoutes[defaultRouteChat]
+	}
+	if route == nil || route.Target == routeNone {
+		return nil
+	}
+	return route
+}
+
+// RoutedMessage is the payload routes deliver for an incoming message
+type RoutedMessage struct {
+	Event    string  `json:"event"`
+	Seq      int64   `json:"seq,omitempty"` // Increases by one per event published to topics
+	Topic    string  `json:"topic,omitempty"`
+	ChatName string  `json:"chat_name"`
+	Message  Message `json:"message"`
+}
+
+// eventTopics hands routed messages to the followers of /api/events topics
+type eventTopics struct {
+	mu        sync.Mutex
+	seq       int64
+	followers map[string]map[chan RoutedMessage]struct{}
+}
+
+// Topics of routed messages
+var routedEvents = &eventTopics{followers: map[string]map[chan RoutedMessage]struct{}{}}
+
+// Publish an event to the followers of its topic
+func (t *eventTopics) publish(event RoutedMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seq++
+	event.Seq = t.seq
+	for ch := range t.followers[event.Topic] {
+		// A follower that can't keep up misses events rather than blocking message handling
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Start following a topic
+func (t *eventTopics) follow(topic string) chan RoutedMessage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ch := make(chan RoutedMessage, 256)
+	if t.followers[topic] == nil {
+		t.followers[topic] = map[chan RoutedMessage]struct{}{}
+	}
+	t.followers[topic][ch] = struct{}{}
+	return ch
+}
+
+// Stop following a topic
+func (t *eventTopics) unfollow(topic string, ch chan RoutedMessage) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.followers[topic], ch)
+	if len(t.followers[topic]) == 0 {
+		delete(t.followers, topic)
+	}
+}
+
+// Forward an incoming message to the route of its chat. Chats excluded from
+// ingestion are never forwarded, muted ones only if the route says so.
+func routeMessage(client *whatsmeow.Client, messageStore *MessageStore, msg Message, chatName string) {
+	route := routeFor(msg.ChatJID)
+	if route == nil {
+		return
+	}
+	if chat, err := types.ParseJID(msg.ChatJID); err == nil {
+		suppressed := notificationSuppression(client, chat)
+		if suppressed == suppressedExcluded || (suppressed == suppressedMuted && !route.NotifyMuted) {
+			return
+		}
+	}
+
+	event := RoutedMessage{Event: "message", ChatName: chatName, Message: msg}
+	switch route.Target {
+	case routeSSE:
+		event.Topic = route.Topic
+		routedEvents.publish(event)
+	case routeWebhook:
+		// Deliver in the background so slow webhooks don't hold up message handling
+		goSafe("routing a message to a webhook", func() {
+			if err := postWebhook(route.WebhookURL, event); err != nil {
+				bridgeLog.Warnf("Failed to route message %s of %s to its webhook: %v", msg.ID, msg.ChatJID, err)
+			}
+		})
+	case routeSlack, routeDiscord, routeMatrix:
+		queueRelay(client, messageStore, route, msg, chatName)
+	}
+}
+
+// ListNotificationRoutesResponse represents the response for the list routes API
+type ListNotificationRoutesResponse struct {
+	Success bool                 `json:"success"`
+	Routes  []*NotificationRoute `json:"routes"`
+	Topics  []string             `json:"topics"` // Topics with followers right now
+}
+
+// NotificationRouteResponse represents the response for setting a route
+type NotificationRouteResponse struct {
+	Success bool               `json:"success"`
+	Route   *NotificationRoute `json:"route"`
+}
+
+// Register the REST handlers for routing messages to downstream automations
+func registerRoutingHandlers(messageStore *MessageStore) {
+	if err := reloadNotificationRoutes(messageStore); err != nil {
+		bridgeLog.Warnf("Failed to load notification routes: %v", err)
+	}
+
+	jidParam := apiParam{Name: "jid", In: "path", Description: "Chat JID, or * for the default route of chats without one", Required: true}
+
+	// Handler for listing routes
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/notify/routes",
+		Summary:  "List where the incoming messages of chats are routed",
+		Tag:      "watches",
+		Scope:    ScopeReadMessages,
+		Response: ListNotificationRoutesResponse{},
+	})
+	http.HandleFunc("GET /api/notify/routes", func(w http.ResponseWriter, r *http.Request) {
+		routes, err := messageStore.ListNotificationRoutes()
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list routes: %v", err), nil)
+			return
+		}
+		routedEvents.mu.Lock()
+		topics := make([]string, 0, len(routedEvents.followers))
+		for topic := range routedEvents.followers {
+			topics = append(topics, topic)
+		}
+		routedEvents.mu.Unlock()
+		sort.Strings(topics)
+		writeJSON(w, http.StatusOK, ListNotificationRoutesResponse{Success: true, Routes: routes, Topics: topics})
+	})
+
+	// Handler for setting the route of a chat
+	documentAPI(apiOperation{
+		Method:   http.MethodPut,
+		Path:     "/api/notify/routes/{jid}",
+		Summary:  "Route the incoming messages of a chat to a webhook, an event stream topic or nowhere, taking effect right away",
+		Tag:      "watches",
+		Scope:    ScopeAdmin,
+		Audit:    true,
+		Params:   []apiParam{jidParam},
+		Request:  NotificationRouteRequest{},
+		Response: NotificationRouteResponse{},
+	})
+	http.HandleFunc("PUT /api/notify/routes/{jid}", func(w http.ResponseWriter, r *http.Request) {
+		var req NotificationRouteRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		route, err := req.toRoute(r.PathValue("jid"))
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if err := messageStore.SetNotificationRoute(route); err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to store route: %v", err), nil)
+			return
+		}
+		if err := reloadNotificationRoutes(messageStore); err != nil {
+			bridgeLog.Warnf("Failed to reload notification routes: %v", err)
+		}
+		writeJSON(w, http.StatusOK, NotificationRouteResponse{Success: true, Route: route})
+	})
+
+	// Handler for removing the route of a chat
+	documentAPI(apiOperation{
+		Method:   http.MethodDelete,
+		Path:     "/api/notify/routes/{jid}",
+		Summary:  "Remove the route of a chat, which then follows the default route",
+		Tag:      "watches",
+		Scope:    ScopeAdmin,
+		Audit:    true,
+		Params:   []apiParam{jidParam},
+		Response: StatusResponse{},
+	})
+	http.HandleFunc("DELETE /api/notify/routes/{jid}", func(w http.ResponseWriter, r *http.Request) {
+		chatJID := r.PathValue("jid")
+		if chatJID != defaultRouteChat {
+			if jid, err := types.ParseJID(chatJID); err == nil {
+				chatJID = jid.ToNonAD().String()
+			}
+		}
+		found, err := messageStore.DeleteNotificationRoute(chatJID)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to remove route: %v", err), nil)
+			return
+		}
+		if !found {
+			writeError(w, ErrCodeNotFound, fmt.Sprintf("No route for %s", chatJID), nil)
+			return
+		}
+		if err := reloadNotificationRoutes(messageStore); err != nil {
+			bridgeLog.Warnf("Failed to reload notification routes: %v", err)
+		}
+		writeJSON(w, http.StatusOK, StatusResponse{Success: true, Message: fmt.Sprintf("Route of %s removed", chatJID)})
+	})
+
+	// Handler for following a topic of routed messages
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/events",
+		Summary: "Stream the messages routed to a topic as server-sent events",
+		Tag:     "watches",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "topic", Description: "Topic to follow, as set in sse routes", Required: true},
+		},
+		Response: RoutedMessage{},
+	})
+	http.HandleFunc("GET /api/events", func(w http.ResponseWriter, r *http.Request) {
+		topic := r.URL.Query().Get("topic")
+		if !topicPattern.MatchString(topic) {
+			writeError(w, ErrCodeInvalidRequest, "A valid topic is required", nil)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeError(w, ErrCodeInternal, "Streaming is not supported by this connection", nil)
+			return
+		}
+		ch := routedEvents.follow(topic)
+		defer routedEvents.unfollow(topic, ch)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(eventStreamHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+				flusher.Flush()
+			case event := <-ch:
+				data, _ := json.Marshal(event)
+				fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Seq, event.Event, data)
+				flusher.Flush()
+			}
+		}
+	})
+}
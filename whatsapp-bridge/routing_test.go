@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Replace the notification routes for a test, removing them when it ends
+func setRoutes(t *testing.T, routes ...*NotificationRoute) {
+	t.Helper()
+	reset := func() {
+		testStore.db.Exec("DELETE FROM notification_routes")
+		reloadNotificationRoutes(testStore)
+	}
+	reset()
+	t.Cleanup(reset)
+	for _, r := range routes {
+		if err := testStore.SetNotificationRoute(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := reloadNotificationRoutes(testStore); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRouteToTopic(t *testing.T) {
+	work := "120363000000000101@g.us"
+	family := "120363000000000102@g.us"
+	setRoutes(t,
+		&NotificationRoute{ChatJID: defaultRouteChat, Target: routeSSE, Topic: "everything"},
+		&NotificationRoute{ChatJID: work, Target: routeSSE, Topic: "work"},
+		&NotificationRoute{ChatJID: family, Target: routeNone},
+	)
+	workEvents := routedEvents.follow("work")
+	defer routedEvents.unfollow("work", workEvents)
+	otherEvents := routedEvents.follow("everything")
+	defer routedEvents.unfollow("everything", otherEvents)
+
+	routeMessage(nil, testStore, Message{ID: "R1", ChatJID: work, Content: "standup"}, "Work")
+	routeMessage(nil, testStore, Message{ID: "R2", ChatJID: family, Content: "dinner"}, "Family")
+	routeMessage(nil, testStore, Message{ID: "R3", ChatJID: "15551240001@s.whatsapp.net", Content: "hi"}, "Friend")
+
+	if event := <-workEvents; event.Message.ID != "R1" || event.ChatName != "Work" || event.Topic != "work" {
+		t.Errorf("Got %+v on the work topic, want R1", event)
+	}
+	if event := <-otherEvents; event.Message.ID != "R3" {
+		t.Errorf("Got %+v on the default topic, want R3", event)
+	}
+	select {
+	case event := <-otherEvents:
+		t.Errorf("Got %+v, want nothing from a chat routed nowhere", event)
+	default:
+	}
+}
+
+func TestRouteToWebhook(t *testing.T) {
+	received := make(chan RoutedMessage, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event RoutedMessage
+		json.NewDecoder(r.Body).Decode(&event)
+		received <- event
+	}))
+	defer server.Close()
+
+	chat := "120363000000000103@g.us"
+	setRoutes(t, &NotificationRoute{ChatJID: chat, Target: routeWebhook, WebhookURL: server.URL})
+	routeMessage(nil, testStore, Message{ID: "R4", ChatJID: chat, Content: "deploy done"}, "Ops")
+
+	select {
+	case event := <-received:
+		if event.Event != "message" || event.Message.ID != "R4" {
+			t.Errorf("Webhook got %+v, want R4", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Webhook was not called")
+	}
+
+	// Chats without a route and no default route go nowhere
+	routeMessage(nil, testStore, Message{ID: "R5", ChatJID: "120363000000000104@g.us", Content: "unrouted"}, "Other")
+	select {
+	case event := <-received:
+		t.Errorf("Webhook got %+v from a chat without a route", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRouteRequestValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		jid  string
+		req  NotificationRouteRequest
+	}{
+		{"bad target", "*", NotificationRouteRequest{Target: "email"}},
+		{"webhook without URL", "*", NotificationRouteRequest{Target: routeWebhook}},
+		{"bad topic", "*", NotificationRouteRequest{Target: routeSSE, Topic: "two words"}},
+		{"bad chat", "1.2.3@s.whatsapp.net", NotificationRouteRequest{Target: routeNone}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.req.toRoute(tt.jid); err == nil {
+				t.Error("Accepted an invalid route")
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// Markers wrapped around the matched text in search snippets
+const (
+	highlightStart = "**"
+	highlightEnd   = "**"
+)
+
+// Full-text index over message contents. It is an external content table keyed
+// by the messages rowid and kept in sync by triggers; it has to be rebuilt when
+// VACUUM renumbers the rowids.
+const searchIndexSchema = `
+	CREATE VIRTUAL TABLE messages_fts USING fts4(content="messages", content, tokenize=unicode61 "remove_diacritics=1");
+
+	CREATE TRIGGER messages_fts_insert AFTER INSERT ON messages BEGIN
+		INSERT INTO messages_fts(docid, content) VALUES (new.rowid, new.content);
+	END;
+	CREATE TRIGGER messages_fts_delete BEFORE DELETE ON messages BEGIN
+		DELETE FROM messages_fts WHERE docid = old.rowid;
+	END;
+	CREATE TRIGGER messages_fts_update_before BEFORE UPDATE OF content ON messages BEGIN
+		DELETE FROM messages_fts WHERE docid = old.rowid;
+	END;
+	CREATE TRIGGER messages_fts_update_after AFTER UPDATE OF content ON messages BEGIN
+		INSERT INTO messages_fts(docid, content) VALUES (new.rowid, new.content);
+	END;
+`
+
+// Statement rebuilding the full-text index from the messages table
+const rebuildSearchIndex = "INSERT INTO messages_fts(messages_fts) VALUES('rebuild')"
+
+// Create the full-text index if it doesn't exist yet, indexing the stored messages
+func initSearchIndex(db *sql.DB) error {
+	var exists int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'messages_fts'").Scan(&exists); err != nil {
+		return err
+	}
+	if exists > 0 {
+		return nil
+	}
+
+	bridgeLog.Infof("Building message search index...")
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(searchIndexSchema); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(rebuildSearchIndex); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Turn free text into an FTS query matching all of its words, the last one as
+// a prefix so results show up while typing
+func ftsQuery(text string) string {
+	words := strings.Fields(text)
+	terms := make([]string, 0, len(words))
+	for i, word := range words {
+		word = strings.Trim(strings.ReplaceAll(word, `"`, ""), "*")
+		if word == "" {
+			continue
+		}
+		term := `"` + word + `"`
+		if i == len(words)-1 {
+			term = `"` + word + `*"`
+		}
+		terms = append(terms, term)
+	}
+	return strings.Join(terms, " ")
+}
+
+// Relevance of a full-text match from its matchinfo('pnx') blob, a tf-idf sum
+// over the query phrases
+func ftsScore(matchinfo []byte) float64 {
+	if len(matchinfo) < 8 {
+		return 0
+	}
+	value := func(i int) float64 {
+		return float64(binary.LittleEndian.Uint32(matchinfo[i*4:]))
+	}
+	phrases, rows := int(value(0)), value(1)
+	score := 0.0
+	for p := 0; p < phrases && (2+3*p+3)*4 <= len(matchinfo); p++ {
+		hits, docs := value(2+3*p), value(2+3*p+2)
+		if hits > 0 && docs > 0 {
+			score += hits * math.Log(1+rows/docs)
+		}
+	}
+	return score
+}
+
+// SearchResult is a message, chat or contact found by the unified search
+type SearchResult struct {
+	Type    string   `json:"type"` // message, contact, group or chat
+	Score   float64  `json:"score"`
+	JID     string   `json:"jid"`
+	Name    string   `json:"name,omitempty"`
+	Snippet string   `json:"snippet"`
+	Match   string   `json:"match,omitempty"`
+	Message *Message `json:"message,omitempty"`
+}
+
+// Full-text indexes searched for messages, and what a hit in each matched
+var messageSearchIndexes = []struct{ table, match string }{
+	{"messages_fts", ""},
+	{"messages_ocr_fts", "ocr"},           // Text recognized in images
+	{"messages_document_fts", "document"}, // Text extracted from documents
+}
+
+// Search messages by full text, including the text of their images and
+// documents, best matches first
+func (store *MessageStore) SearchMessages(query, chatJID string, limit int) ([]SearchResult, error) {
+	match := ftsQuery(query)
+	if match == "" {
+		return []SearchResult{}, nil
+	}
+
+	results := []SearchResult{}
+	seen := map[string]int{} // Index in results by chat and message ID
+	for _, index := range messageSearchIndexes {
+		where := index.table + " MATCH ?"
+		args := []interface{}{highlightStart, highlightEnd, match}
+		if chatJID != "" {
+			where += " AND m.chat_jid = ?"
+			args = append(args, chatJID)
+		}
+
+		// Score in Go, so fetch more candidates than needed and keep the best
+		args = append(args, limit*5)
+		rows, err := store.db.Query(
+			`SELECT m.id, m.chat_jid, COALESCE(c.name, ''), m.sender, COALESCE(m.content, ''), m.timestamp, m.is_from_me,
+				COALESCE(m.media_type, ''), COALESCE(m.filename, ''), COALESCE(m.ocr_text, ''),
+				snippet(`+index.table+`, ?, ?, '…', -1, 16), matchinfo(`+index.table+`, 'pnx')
+			FROM `+index.table+`
+			JOIN messages m ON m.rowid = `+index.table+`.docid
+			LEFT JOIN chats c ON c.jid = m.chat_jid
+			WHERE `+where+`
+			ORDER BY m.timestamp DESC LIMIT ?`,
+			args...,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var msg Message
+			var chatName, snippet string
+			var matchinfo []byte
+			if err := rows.Scan(&msg.ID, &msg.ChatJID, &chatName, &msg.Sender, &msg.Content, &msg.Time, &msg.IsFromMe,
+				&msg.MediaType, &msg.Filename, &msg.OCRText, &snippet, &matchinfo); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			// Squash tf-idf into 0..0.9 so exact name matches stay on top
+			score := ftsScore(matchinfo)
+			result := SearchResult{
+				Type:    "message",
+				Score:   0.9 * score / (1 + score),
+				JID:     msg.ChatJID,
+				Name:    chatName,
+				Snippet: snippet,
+				Match:   index.match,
+				Message: &msg,
+			}
+			// Keep the best of the matches in a caption and its attachment
+			key := msg.ChatJID + "/" + msg.ID
+			if i, ok := seen[key]; ok {
+				if result.Score > results[i].Score {
+					results[i] = result
+				}
+				continue
+			}
+			seen[key] = len(results)
+			results = append(results, result)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	sortSearchResults(results)
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// Order search results by score, newest message first between equals
+func sortSearchResults(results []SearchResult) {
+	sort.SliceStable(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Message != nil && b.Message != nil {
+			return a.Message.Time.After(b.Message.Time)
+		}
+		return false
+	})
+}
+
+// Weight of a directory match rank in the unified search score
+var matchRankWeights = map[int]float64{
+	matchOverride:  1,
+	matchExact:     1,
+	matchPrefix:    0.8,
+	matchSubstring: 0.6,
+	matchFuzzy:     0.4,
+}
+
+// Wrap the part of a name matching a folded query in highlight markers
+func highlightName(name, query string) string {
+	// Fold rune by rune so positions map back to the original name
+	original := []rune(name)
+	var folded []rune
+	var origin []int
+	for i, r := range original {
+		for _, f := range foldText(string(r)) {
+			folded = append(folded, f)
+			origin = append(origin, i)
+		}
+	}
+
+	start := strings.Index(string(folded), query)
+	if start < 0 || query == "" {
+		return name
+	}
+	// Convert the byte offset in the folded string to a rune offset
+	startRune := len([]rune(string(folded)[:start]))
+	endRune := startRune + len([]rune(query)) - 1
+	if endRune >= len(origin) {
+		return name
+	}
+	from, to := origin[startRune], origin[endRune]+1
+	return string(original[:from]) + highlightStart + string(original[from:to]) + highlightEnd + string(original[to:])
+}
+
+// Search messages, chats and contacts in one ranked list
+func (store *MessageStore) Search(query string, types map[string]bool, chatJID string, limit int) ([]SearchResult, error) {
+	results := []SearchResult{}
+
+	if types["messages"] {
+		messages, err := store.SearchMessages(query, chatJID, limit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search messages: %v", err)
+		}
+		results = append(results, messages...)
+	}
+
+	if types["chats"] || types["contacts"] {
+		entries, err := store.SearchDirectory(query, limit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search contacts and chats: %v", err)
+		}
+		folded := foldText(query)
+		for _, entry := range entries {
+			if entry.Type == "contact" && !types["contacts"] || entry.Type != "contact" && !types["chats"] {
+				continue
+			}
+			results = append(results, SearchResult{
+				Type:    entry.Type,
+				Score:   matchRankWeights[entry.match.rank] * (0.5 + 0.5*entry.match.score),
+				JID:     entry.JID,
+				Name:    entry.Name,
+				Snippet: highlightName(entry.Name, folded),
+				Match:   entry.Match,
+			})
+		}
+	}
+
+	sortSearchResults(results)
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	for i := range results {
+		results[i].Score = math.Round(results[i].Score*1000) / 1000
+	}
+	return results, nil
+}
+
+// SearchResponse represents the response for the unified search API
+type SearchResponse struct {
+	Success bool           `json:"success"`
+	Results []SearchResult `json:"results"`
+}
+
+// Entity types the unified search covers
+var searchTypes = []string{"messages", "chats", "contacts"}
+
+// Register the REST handler for the unified search
+func registerSearchHandlers(messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/search",
+		Summary: "Search messages, chats and contacts in one ranked list with highlighted snippets",
+		Tag:     "search",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "query", Description: "Words to search for, the last one also matches as a prefix", Required: true},
+			{Name: "types", Description: "Comma-separated entity types to search: messages, chats, contacts (default all)"},
+			{Name: "chat_jid", Description: "Only search messages of this chat"},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+		},
+		Response: SearchResponse{},
+	})
+	http.HandleFunc("GET /api/search", func(w http.ResponseWriter, r *http.Request) {
+		query := strings.TrimSpace(r.URL.Query().Get("query"))
+		if query == "" {
+			writeError(w, ErrCodeInvalidRequest, "query is required", nil)
+			return
+		}
+		limit, _, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		types := make(map[string]bool)
+		requested := splitList(r.URL.Query().Get("types"))
+		if len(requested) == 0 {
+			requested = searchTypes
+		}
+		for _, t := range requested {
+			if !slices.Contains(searchTypes, t) {
+				writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("Unknown search type %q", t), map[string][]string{"types": searchTypes})
+				return
+			}
+			types[t] = true
+		}
+
+		results, err := messageStore.Search(query, types, r.URL.Query().Get("chat_jid"), limit)
+		if err != nil {
+			writeError(w, ErrCodeInternal, err.Error(), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, SearchResponse{Success: true, Results: results})
+	})
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Segmentation of long chats into topic spans, so agents can summarize one
+// discussion at a time instead of an arbitrary page of messages
+var segmentJob = newSyncJob("segments")
+
+// Participant name of the account itself in segments
+const segmentSelf = "me"
+
+// ConversationSegment is a span of a chat likely to be about one topic
+type ConversationSegment struct {
+	ID             int64     `json:"id"`
+	ChatJID        string    `json:"chat_jid"`
+	StartTime      time.Time `json:"start_time"`
+	EndTime        time.Time `json:"end_time"`
+	FirstMessageID string    `json:"first_message_id"`
+	LastMessageID  string    `json:"last_message_id"`
+	MessageCount   int       `json:"message_count"`
+	Participants   []string  `json:"participants"` // Sender IDs, "me" for the account itself
+}
+
+// A message as seen by the segmentation
+type segmentMessage struct {
+	ID     string
+	Time   time.Time
+	Sender string
+}
+
+// Split messages in chronological order into segments. A silence of gap
+// starts a new segment, and so does a shorter pause of at least a quarter of
+// gap followed by someone who didn't take part in the current segment.
+func splitSegments(chatJID string, messages []segmentMessage, gap time.Duration) []ConversationSegment {
+	var segments []ConversationSegment
+	var current *ConversationSegment
+	var prev time.Time
+	for _, m := range messages {
+		pause := m.Time.Sub(prev)
+		if current == nil || pause >= gap || (pause >= gap/4 && !slices.Contains(current.Participants, m.Sender)) {
+			segments = append(segments, ConversationSegment{ChatJID: chatJID, StartTime: m.Time, FirstMessageID: m.ID})
+			current = &segments[len(segments)-1]
+		}
+		current.EndTime = m.Time
+		current.LastMessageID = m.ID
+		current.MessageCount++
+		if !slices.Contains(current.Participants, m.Sender) {
+			current.Participants = append(current.Participants, m.Sender)
+		}
+		prev = m.Time
+	}
+	return segments
+}
+
+// Bring the segments of a chat up to date. The last segment may still be
+// growing, so it is recomputed along with the messages that came after it.
+func (store *MessageStore) UpdateSegments(chatJID string, gap time.Duration) error {
+	var lastID int64
+	var lastStart time.Time
+	var lastMessageID string
+	err := store.db.QueryRow(
+		"SELECT id, start_time, last_message_id FROM conversation_segments WHERE chat_jid = ? ORDER BY start_time DESC, id DESC LIMIT 1",
+		chatJID,
+	).Scan(&lastID, &lastStart, &lastMessageID)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	var newest string
+	if err := store.db.QueryRow(
+		"SELECT id FROM messages WHERE chat_jid = ? ORDER BY timestamp DESC, rowid DESC LIMIT 1", chatJID,
+	).Scan(&newest); err != nil {
+		return err
+	}
+	if newest == lastMessageID {
+		return nil
+	}
+
+	rows, err := store.db.Query(
+		`SELECT id, timestamp, CASE WHEN is_from_me THEN '`+segmentSelf+`' ELSE `+senderIDSQL("messages.sender")+` END
+		FROM messages WHERE chat_jid = ? AND timestamp >= ? ORDER BY timestamp, rowid`,
+		chatJID, lastStart.Local(),
+	)
+	if err != nil {
+		return err
+	}
+	var messages []segmentMessage
+	for rows.Next() {
+		var m segmentMessage
+		if err := rows.Scan(&m.ID, &m.Time, &m.Sender); err != nil {
+			rows.Close()
+			return err
+		}
+		messages = append(messages, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if lastID != 0 {
+		if _, err := tx.Exec("DELETE FROM conversation_segments WHERE id = ?", lastID); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	for _, s := range splitSegments(chatJID, messages, gap) {
+		participants, _ := json.Marshal(s.Participants)
+		if _, err := tx.Exec(
+			`INSERT INTO conversation_segments
+			(chat_jid, start_time, end_time, first_message_id, last_message_id, message_count, participants, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			chatJID, s.StartTime, s.EndTime, s.FirstMessageID, s.LastMessageID, s.MessageCount, string(participants), now,
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Segment every chat with at least WHATSAPP_SEGMENT_MIN_MESSAGES messages
+func analyzeSegments(messageStore *MessageStore, job *syncJob) error {
+	gap := time.Duration(max(envInt("WHATSAPP_SEGMENT_GAP_MINUTES", 60), 1)) * time.Minute
+	rows, err := messageStore.db.Query(
+		"SELECT chat_jid FROM messages GROUP BY chat_jid HAVING COUNT(*) >= ?",
+		envInt("WHATSAPP_SEGMENT_MIN_MESSAGES", 50),
+	)
+	if err != nil {
+		return err
+	}
+	var chats []string
+	for rows.Next() {
+		var chat string
+		if err := rows.Scan(&chat); err != nil {
+			rows.Close()
+			return err
+		}
+		chats = append(chats, chat)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	job.setTotal(len(chats))
+	for _, chat := range chats {
+		if err := messageStore.UpdateSegments(chat, gap); err != nil {
+			return fmt.Errorf("failed to segment %s: %v", chat, err)
+		}
+		job.advance(1)
+	}
+	return nil
+}
+
+// Segment long chats every WHATSAPP_SEGMENT_INTERVAL_MINUTES, 0 disables it
+func runSegmentAnalyzer(messageStore *MessageStore) {
+	interval := time.Duration(envInt("WHATSAPP_SEGMENT_INTERVAL_MINUTES", 30)) * time.Minute
+	if interval <= 0 {
+		return
+	}
+	for {
+		func() {
+			defer recoverPanic("segmenting chats")
+			segmentJob.runAndWait(func(j *syncJob) error {
+				return analyzeSegments(messageStore, j)
+			})
+		}()
+		time.Sleep(interval)
+	}
+}
+
+// List the segments of a chat, newest first
+func (store *MessageStore) ListSegments(chatJID string, limit, offset int) ([]ConversationSegment, error) {
+	rows, err := store.db.Query(
+		`SELECT id, chat_jid, start_time, end_time, first_message_id, last_message_id, message_count, COALESCE(participants, '')
+		FROM conversation_segments WHERE chat_jid = ? ORDER BY start_time DESC, id DESC LIMIT ? OFFSET ?`,
+		chatJID, limit, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	segments := []ConversationSegment{}
+	for rows.Next() {
+		var s ConversationSegment
+		var participants string
+		if err := rows.Scan(&s.ID, &s.ChatJID, &s.StartTime, &s.EndTime, &s.FirstMessageID, &s.LastMessageID,
+			&s.MessageCount, &participants); err != nil {
+			return nil, err
+		}
+		json.Unmarshal([]byte(participants), &s.Participants)
+		segments = append(segments, s)
+	}
+	return segments, rows.Err()
+}
+
+// ListSegmentsResponse represents the response for the conversation segments API
+type ListSegmentsResponse struct {
+	Success  bool                  `json:"success"`
+	Status   SyncStatus            `json:"status"`
+	Segments []ConversationSegment `json:"segments"`
+	Page
+}
+
+// Register the REST handler listing the topic segments of a chat
+func registerSegmentHandlers(messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/chats/{jid}/segments",
+		Summary: "List the topic spans of a chat found by the background analyzer, newest first",
+		Tag:     "chats",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "jid", In: "path", Description: "Chat JID", Required: true},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ListSegmentsResponse{},
+	})
+	http.HandleFunc("GET /api/chats/{jid}/segments", func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		segments, err := messageStore.ListSegments(r.PathValue("jid"), limit+1, offset)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list segments: %v", err), nil)
+			return
+		}
+		segments, page := trimPage(segments, offset, limit)
+		writeJSON(w, http.StatusOK, ListSegmentsResponse{Success: true, Status: segmentJob.Status(), Segments: segments, Page: page})
+	})
+}
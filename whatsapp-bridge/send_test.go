@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestSendText(t *testing.T) {
+	client := setupTest(t)
+
+	var resp SendMessageResponse
+	status := postJSON(t, "/api/send", SendMessageRequest{Recipient: "15551230001", Message: "hello"}, &resp)
+	if status != 200 || !resp.Success {
+		t.Fatalf("Got status %d: %+v", status, resp)
+	}
+
+	sent := client.sentMessages()
+	if len(sent) != 1 {
+		t.Fatalf("Sent %d messages, want 1", len(sent))
+	}
+	if want := types.NewJID("15551230001", types.DefaultUserServer); sent[0].To != want {
+		t.Errorf("Sent to %s, want %s", sent[0].To, want)
+	}
+	if got := sent[0].Message.GetConversation(); got != "hello" {
+		t.Errorf("Sent %q, want hello", got)
+	}
+	if sent[0].Extra.ID == "" {
+		t.Error("Message was sent without an ID chosen up front")
+	}
+
+	// The send is journaled under the same ID so it can be made again after a crash
+	ops, err := testStore.ListOps("", nil, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || ops[0].Kind != OpKindSend || ops[0].Status != OpDone {
+		t.Fatalf("Got ops %+v, want one finished send", ops)
+	}
+}
+
+func TestSendImage(t *testing.T) {
+	client := setupTest(t)
+	path := filepath.Join(t.TempDir(), "photo.jpg")
+	if err := os.WriteFile(path, []byte("not really a jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var resp SendMessageResponse
+	status := postJSON(t, "/api/send", SendMessageRequest{Recipient: "15551230002", Message: "look", MediaPath: path}, &resp)
+	if status != 200 || !resp.Success {
+		t.Fatalf("Got status %d: %+v", status, resp)
+	}
+
+	client.with(func(c *fakeClient) {
+		if len(c.uploads) != 1 || c.uploads[0] != whatsmeow.MediaImage {
+			t.Fatalf("Got uploads %v, want one image", c.uploads)
+		}
+	})
+	sent := client.sentMessages()
+	if len(sent) != 1 {
+		t.Fatalf("Sent %d messages, want 1", len(sent))
+	}
+	image := sent[0].Message.GetImageMessage()
+	if image == nil {
+		t.Fatalf("Sent %v, want an image", sent[0].Message)
+	}
+	if image.GetCaption() != "look" || image.GetMimetype() != "image/jpeg" || image.GetDirectPath() != "/v/t62/fake-1.enc" {
+		t.Errorf("Got caption %q, type %q and path %q", image.GetCaption(), image.GetMimetype(), image.GetDirectPath())
+	}
+}
+
+func TestSendDryRun(t *testing.T) {
+	client := setupTest(t)
+
+	var resp SendMessageResponse
+	status := postJSON(t, "/api/send", SendMessageRequest{Recipient: "15551230003", Message: "draft", DryRun: true}, &resp)
+	if status != 200 || !resp.DryRun || resp.Preview == nil {
+		t.Fatalf("Got status %d: %+v", status, resp)
+	}
+	if sent := client.sentMessages(); len(sent) != 0 {
+		t.Fatalf("Dry run sent %d messages", len(sent))
+	}
+}
+
+func TestSendValidation(t *testing.T) {
+	setupTest(t)
+	tests := []struct {
+		name string
+		req  SendMessageRequest
+	}{
+		{"no recipient", SendMessageRequest{Message: "hello"}},
+		{"no message", SendMessageRequest{Recipient: "15551230004"}},
+		{"missing media", SendMessageRequest{Recipient: "15551230004", MediaPath: "/does/not/exist.jpg"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp ErrorResponse
+			status := postJSON(t, "/api/send", tt.req, &resp)
+			expectError(t, status, resp, 400, ErrCodeInvalidRequest)
+		})
+	}
+	if sent := testClient.sentMessages(); len(sent) != 0 {
+		t.Fatalf("Invalid requests sent %d messages", len(sent))
+	}
+}
+
+func TestSendNotConnected(t *testing.T) {
+	client := setupTest(t)
+	client.with(func(c *fakeClient) { c.disconnected = true })
+
+	var resp ErrorResponse
+	status := postJSON(t, "/api/send", SendMessageRequest{Recipient: "15551230005", Message: "hello"}, &resp)
+	expectError(t, status, resp, 503, ErrCodeNotConnected)
+	if !resp.Retryable {
+		t.Error("Not being connected should be retryable")
+	}
+}
+
+func TestSendQueuedForRetry(t *testing.T) {
+	client := setupTest(t)
+	client.with(func(c *fakeClient) { c.disconnected = true })
+
+	var resp SendMessageResponse
+	req := SendMessageRequest{Recipient: "15551230006", Message: "later", RetryOnFailure: true}
+	status := postJSON(t, "/api/send", req, &resp)
+	if status != 202 || !resp.QueuedForRetry || resp.OutboxID == 0 {
+		t.Fatalf("Got status %d: %+v", status, resp)
+	}
+}
+
+func TestSendFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   ErrorCode
+	}{
+		{"rejected", errors.New("server returned error 479"), 502, ErrCodeSendFailed},
+		{"timed out", context.DeadlineExceeded, 504, ErrCodeTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := setupTest(t)
+			client.with(func(c *fakeClient) { c.sendErr = tt.err })
+
+			var resp ErrorResponse
+			status := postJSON(t, "/api/send", SendMessageRequest{Recipient: "15551230007", Message: "hello"}, &resp)
+			expectError(t, status, resp, tt.status, tt.code)
+
+			ops, err := testStore.ListOps("", nil, 1, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ops) != 1 || ops[0].Status != OpFailed {
+				t.Fatalf("Got ops %+v, want one failed send", ops)
+			}
+		})
+	}
+}
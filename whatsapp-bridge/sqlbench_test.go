@@ -0,0 +1,357 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The SQL benchmarks run against a generated dataset, building the default
+// one takes a minute or two: go test -run '^$' -bench . -bench.messages 1000000
+var benchMessages = flag.Int("bench.messages", 1_000_000, "Number of messages generated for the SQL benchmarks")
+
+// Shape of the generated dataset. A tenth of the messages go to the hot chat,
+// the rest are spread over the other chats, every fifth of which is a group.
+const (
+	benchChats     = 2000
+	benchHotChat   = "15557000000@s.whatsapp.net"
+	benchSpan      = 2 * 365 * 24 * time.Hour // Time covered by the messages
+	benchUnreadPct = 1                        // Newest percentage of the messages left unread
+)
+
+var benchWords = strings.Fields(`the a to and of in is it you that for on are with this be at
+	have not but what all were when we there can an your which their said if do will each about
+	how up out them then she many some so these would other into has more her two like him see
+	time could no make than first been its who now people my made over did down only way find use
+	may water long little very after words called just where most know get through back much go
+	good new write our used me man too any day same right look think also around another came come
+	work three must because does part even place well such here take why help put different away
+	again off went old number great tell men say small every found still between name should home
+	big give air line set own under read last never us left end along while might next sound below`)
+
+var (
+	benchOnce  sync.Once
+	benchStore *MessageStore
+	benchErr   error
+)
+
+// Get the store of the benchmark dataset, generating it on first use
+func benchDataset(b *testing.B) *MessageStore {
+	b.Helper()
+	benchOnce.Do(func() {
+		start := time.Now()
+		benchStore, benchErr = generateBenchDataset(*benchMessages)
+		if benchErr == nil {
+			fmt.Printf("Generated %d messages in %d chats in %s\n", *benchMessages, benchChats, time.Since(start).Round(time.Second))
+		}
+	})
+	if benchErr != nil {
+		b.Fatal(benchErr)
+	}
+	return benchStore
+}
+
+// JID of the nth chat of the benchmark dataset, the first being the hot chat
+func benchChatJID(n int) string {
+	if n%5 == 4 {
+		return fmt.Sprintf("1203637%011d@g.us", n)
+	}
+	return fmt.Sprintf("1555700%04d@s.whatsapp.net", n)
+}
+
+// Create a message store in the test data directory holding n generated
+// messages, read up to all but the newest benchUnreadPct percent
+func generateBenchDataset(n int) (*MessageStore, error) {
+	previous, set := os.LookupEnv("WHATSAPP_STORE_DIR")
+	os.Setenv("WHATSAPP_STORE_DIR", filepath.Join(dataDir(), "bench"))
+	store, err := NewMessageStore()
+	if set {
+		os.Setenv("WHATSAPP_STORE_DIR", previous)
+	} else {
+		os.Unsetenv("WHATSAPP_STORE_DIR")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for chat := 0; chat < benchChats; chat++ {
+		if _, err := store.db.Exec("INSERT INTO chats (jid, name) VALUES (?, ?)", benchChatJID(chat), fmt.Sprintf("Chat %d", chat)); err != nil {
+			return nil, err
+		}
+	}
+
+	r := rand.New(rand.NewPCG(1, 2))
+	first := time.Now().Add(-benchSpan)
+	step := benchSpan / time.Duration(max(n, 1))
+	mediaTypes := []string{"image", "video", "audio", "document"}
+
+	var tx *sql.Tx
+	var insert *sql.Stmt
+	for i := 0; i < n; i++ {
+		// Commit in batches so the journal stays small
+		if i%50_000 == 0 {
+			if tx != nil {
+				if err := tx.Commit(); err != nil {
+					return nil, err
+				}
+			}
+			if tx, err = store.db.Begin(); err != nil {
+				return nil, err
+			}
+			if insert, err = tx.Prepare(`INSERT INTO messages (id, chat_jid, sender, content, timestamp, is_from_me, media_type, filename)
+				VALUES (?, ?, ?, ?, ?, ?, ?, ?)`); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+
+		chat := 0
+		if i%10 != 0 {
+			chat = 1 + r.IntN(benchChats-1)
+		}
+		chatJID := benchChatJID(chat)
+		sender := strings.SplitN(chatJID, "@", 2)[0]
+		if strings.HasSuffix(chatJID, "@g.us") {
+			sender = fmt.Sprintf("1555800%04d", r.IntN(50))
+		}
+		fromMe := r.IntN(3) == 0
+		if fromMe {
+			sender = testOwnUser
+		}
+		words := make([]string, 3+r.IntN(15))
+		for j := range words {
+			words[j] = benchWords[r.IntN(len(benchWords))]
+		}
+		var mediaType, filename string
+		if i%20 == 0 {
+			mediaType = mediaTypes[r.IntN(len(mediaTypes))]
+			filename = fmt.Sprintf("%s_%d", mediaType, i)
+		}
+		ts := first.Add(time.Duration(i) * step)
+		if _, err := insert.Exec(fmt.Sprintf("BENCH%07d", i), chatJID, sender, strings.Join(words, " "), ts, fromMe, mediaType, filename); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+	}
+
+	readUpTo := first.Add(time.Duration(n-n*benchUnreadPct/100) * step)
+	tx, err = store.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("UPDATE chats SET last_message_time = (SELECT MAX(timestamp) FROM messages WHERE chat_jid = chats.jid)"); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec("INSERT INTO chat_freshness (chat_jid, last_read) SELECT jid, ? FROM chats", readUpTo); err != nil {
+		return nil, err
+	}
+	if err := refreshChatFreshness(tx); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Get the ID of a message of the hot chat halfway through its history
+func benchMiddleMessage(b *testing.B, store *MessageStore) string {
+	b.Helper()
+	var id string
+	err := store.db.QueryRow("SELECT id FROM messages WHERE chat_jid = ? ORDER BY timestamp LIMIT 1 OFFSET (SELECT COUNT(*) / 2 FROM messages WHERE chat_jid = ?)",
+		benchHotChat, benchHotChat).Scan(&id)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return id
+}
+
+func BenchmarkQueryMessages(b *testing.B) {
+	store := benchDataset(b)
+	lastWeek := time.Now().AddDate(0, 0, -7)
+	filters := []struct {
+		name   string
+		filter MessageFilter
+	}{
+		{"chat", MessageFilter{ChatJID: benchHotChat, Limit: 50}},
+		{"quiet_chat", MessageFilter{ChatJID: benchChatJID(benchChats - 1), Limit: 50}},
+		{"media_type", MessageFilter{MediaType: "image", Limit: 50}},
+		{"has_media", MessageFilter{HasMedia: true, Limit: 50}},
+		{"sender", MessageFilter{Sender: "15558000007", Limit: 50}},
+		{"recent", MessageFilter{After: &lastWeek, Limit: 50}},
+		{"text", MessageFilter{Query: "water", Limit: 50}},
+		{"chat_text", MessageFilter{ChatJID: benchHotChat, Query: "water", Limit: 50}},
+	}
+	for _, tt := range filters {
+		b.Run(tt.name, func(b *testing.B) {
+			for b.Loop() {
+				if _, err := store.QueryMessages(tt.filter); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkUnreadAggregation(b *testing.B) {
+	store := benchDataset(b)
+	b.Run("refresh_chat", func(b *testing.B) {
+		for b.Loop() {
+			if err := refreshChatFreshness(store.db, benchHotChat); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("refresh_all", func(b *testing.B) {
+		for b.Loop() {
+			if err := refreshChatFreshness(store.db); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("count_unread_chats", func(b *testing.B) {
+		for b.Loop() {
+			var n int
+			if err := store.db.QueryRow(countUnreadChatsSQL).Scan(&n); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("overview", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := store.ChatOverviews(false, nil, 51, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("overview_unread", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := store.ChatOverviews(true, nil, 51, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// The web UI pages through a chat with /api/messages and jumps to search
+// hits with /api/messages/context
+func BenchmarkConversationView(b *testing.B) {
+	store := benchDataset(b)
+	for _, offset := range []int{0, 1000, 50_000} {
+		b.Run(fmt.Sprintf("page_offset_%d", offset), func(b *testing.B) {
+			for b.Loop() {
+				if _, _, err := store.QueryMessagesPage(MessageFilter{ChatJID: benchHotChat, Limit: 50, Offset: offset}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+	messageID := benchMiddleMessage(b, store)
+	b.Run("context", func(b *testing.B) {
+		for b.Loop() {
+			if _, err := store.GetMessageContext(benchHotChat, messageID, 20, 20); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// Get the details of the query plan of a statement, one step per line
+func explainQueryPlan(t *testing.T, db *sql.DB, query string, args ...interface{}) string {
+	t.Helper()
+	rows, err := db.Query("EXPLAIN QUERY PLAN "+query, args...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var steps []string
+	for rows.Next() {
+		var id, parent, unused int
+		var detail string
+		if err := rows.Scan(&id, &parent, &unused, &detail); err != nil {
+			t.Fatal(err)
+		}
+		steps = append(steps, detail)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(steps, "\n")
+}
+
+// Check that the hot queries are answered from indexes, so a schema change
+// that drops or shadows one fails here before it shows in the benchmarks
+func TestQueryPlans(t *testing.T) {
+	chatJID := "15557000001@s.whatsapp.net"
+	lastWeek := time.Now().AddDate(0, 0, -7)
+	chatQuery, chatArgs := MessageFilter{ChatJID: chatJID, Limit: 50}.query()
+	chatWhere, chatWhereArgs := MessageFilter{ChatJID: chatJID}.where()
+	mediaQuery, mediaArgs := MessageFilter{MediaType: "image", Limit: 50}.query()
+	overviewQuery, overviewArgs := chatOverviewsQuery(true, nil, 51, 0)
+	changedQuery, changedArgs := chatOverviewsQuery(false, &lastWeek, 51, 0)
+	contextArgs := []interface{}{chatJID, 1, 1, 1, 21}
+
+	tests := []struct {
+		name  string
+		query string
+		args  []interface{}
+		uses  []string // Steps the plan must have
+		avoid []string // Steps the plan must not have
+	}{
+		{"chat messages", chatQuery, chatArgs,
+			[]string{"SEARCH messages USING INDEX idx_messages_chat_timestamp (chat_jid=?)"},
+			[]string{"SCAN messages", "TEMP B-TREE"}},
+		{"chat message count", "SELECT COUNT(*) FROM messages" + chatWhere, chatWhereArgs,
+			[]string{"SEARCH messages USING COVERING INDEX idx_messages_chat_timestamp (chat_jid=?)"},
+			[]string{"SCAN messages"}},
+		{"media messages", mediaQuery, mediaArgs,
+			[]string{"SEARCH messages USING INDEX idx_messages_media_type (media_type=?)"},
+			[]string{"SCAN messages", "TEMP B-TREE"}},
+		{"messages before", messagesBeforeSQL, contextArgs,
+			[]string{"SEARCH messages USING INDEX idx_messages_chat_timestamp (chat_jid=?)", "SEARCH messages USING INTEGER PRIMARY KEY (rowid=?)"},
+			[]string{"SCAN messages", "TEMP B-TREE"}},
+		{"messages after", messagesAfterSQL, contextArgs,
+			[]string{"SEARCH messages USING INDEX idx_messages_chat_timestamp (chat_jid=?)", "SEARCH messages USING INTEGER PRIMARY KEY (rowid=?)"},
+			[]string{"SCAN messages", "TEMP B-TREE"}},
+		{"refresh chat freshness", refreshChatFreshnessSQL + " WHERE chat_jid = ?", []interface{}{time.Now(), chatJID},
+			[]string{"SEARCH chat_freshness USING INDEX sqlite_autoindex_chat_freshness_1 (chat_jid=?)", "SEARCH m USING INDEX idx_messages_chat_timestamp (chat_jid=?)"},
+			[]string{"SCAN m"}},
+		{"refresh all chat freshness", refreshChatFreshnessSQL, []interface{}{time.Now()},
+			[]string{"SEARCH m USING INDEX idx_messages_chat_timestamp (chat_jid=?)"},
+			[]string{"SCAN m"}},
+		{"unread overview", overviewQuery, overviewArgs,
+			[]string{"SEARCH c USING INDEX sqlite_autoindex_chats_1 (jid=?)"},
+			[]string{"SCAN c", "messages"}},
+		{"changed overview", changedQuery, changedArgs,
+			[]string{"SEARCH f USING INDEX idx_chat_freshness_updated (updated_at>?)", "SEARCH c USING INDEX sqlite_autoindex_chats_1 (jid=?)"},
+			[]string{"SCAN", "messages"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := explainQueryPlan(t, testStore.db, tt.query, tt.args...)
+			for _, step := range tt.uses {
+				if !strings.Contains(plan, step) {
+					t.Errorf("Plan lacks %q:\n%s", step, plan)
+				}
+			}
+			for _, step := range tt.avoid {
+				if strings.Contains(plan, step) {
+					t.Errorf("Plan has %q:\n%s", step, plan)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Hard cap on the rows a query can return, whatever the request asks for
+const maxQueryRows = 10000
+
+// Leading SQL comments and whitespace
+var leadingSQLCommentRe = regexp.MustCompile(`^(\s+|--[^\n]*(\n|$)|/\*(.|\n)*?\*/)*`)
+
+// Check that a statement is a single SELECT (or WITH … SELECT) and return it
+// without its trailing semicolon. This only gives clear errors; the query runs
+// on a read-only connection, which is what actually blocks writes.
+func validateSelectSQL(query string) (string, error) {
+	query = leadingSQLCommentRe.ReplaceAllString(query, "")
+	query = strings.TrimRight(strings.TrimSpace(query), "; \t\n")
+	if query == "" {
+		return "", newAPIError(ErrCodeInvalidRequest, "sql is required")
+	}
+	if strings.Contains(query, ";") {
+		return "", newAPIError(ErrCodeInvalidRequest, "Only a single statement is allowed")
+	}
+	first := strings.ToUpper(strings.Fields(query)[0])
+	if first != "SELECT" && first != "WITH" {
+		return "", newAPIError(ErrCodeInvalidRequest, "Only SELECT statements are allowed")
+	}
+	return query, nil
+}
+
+// SQLQueryRequest represents the request body for the SQL query API
+type SQLQueryRequest struct {
+	SQL     string        `json:"sql"`                // A single SELECT statement
+	Params  []interface{} `json:"params,omitempty"`   // Values for ? placeholders
+	MaxRows int           `json:"max_rows,omitempty"` // Defaults to WHATSAPP_ADMIN_QUERY_MAX_ROWS
+}
+
+// SQLQueryResponse represents the response for the SQL query API
+type SQLQueryResponse struct {
+	Success   bool            `json:"success"`
+	Columns   []string        `json:"columns"`
+	Rows      [][]interface{} `json:"rows"`
+	Truncated bool            `json:"truncated"` // More rows than max_rows matched
+	ElapsedMS int64           `json:"elapsed_ms"`
+}
+
+// Run a read-only query against the message store, on its own read-only
+// connection and within WHATSAPP_ADMIN_QUERY_TIMEOUT_SECONDS
+func runReadOnlyQuery(query string, params []interface{}, maxRows int) (*SQLQueryResponse, error) {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(storeDir(), "messages.db")+"?mode=ro&_query_only=on&_busy_timeout=5000")
+	if err != nil {
+		return nil, newAPIError(ErrCodeInternal, "Failed to open message database: %v", err)
+	}
+	defer db.Close()
+
+	timeout := time.Duration(max(envInt("WHATSAPP_ADMIN_QUERY_TIMEOUT_SECONDS", 10), 1)) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	rows, err := db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, queryError(ctx, err, timeout)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, newAPIError(ErrCodeInternal, "Failed to read columns: %v", err)
+	}
+	resp := &SQLQueryResponse{Success: true, Columns: columns, Rows: [][]interface{}{}}
+	for rows.Next() {
+		if len(resp.Rows) == maxRows {
+			resp.Truncated = true
+			break
+		}
+		values := make([]interface{}, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return nil, queryError(ctx, err, timeout)
+		}
+		// Text comes back as bytes, which JSON would encode as base64
+		for i, v := range values {
+			if b, ok := v.([]byte); ok && utf8.Valid(b) {
+				values[i] = string(b)
+			}
+		}
+		resp.Rows = append(resp.Rows, values)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, queryError(ctx, err, timeout)
+	}
+	resp.ElapsedMS = time.Since(start).Milliseconds()
+	return resp, nil
+}
+
+// Turn a query failure into an API error, telling timeouts apart from bad SQL
+func queryError(ctx context.Context, err error, timeout time.Duration) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return newAPIError(ErrCodeInvalidRequest, "Query took longer than %s and was interrupted", timeout)
+	}
+	return newAPIError(ErrCodeInvalidRequest, "Query failed: %v", err)
+}
+
+// Register the REST handler for ad-hoc read-only SQL queries
+func registerSQLQueryHandlers() {
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/admin/query",
+		Summary:  "Run a single read-only SELECT statement against the message store, with row and time limits",
+		Tag:      "admin",
+		Scope:    ScopeAdmin,
+		Audit:    true,
+		Request:  SQLQueryRequest{},
+		Response: SQLQueryResponse{},
+	})
+	http.HandleFunc("POST /api/admin/query", func(w http.ResponseWriter, r *http.Request) {
+		var req SQLQueryRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		query, err := validateSelectSQL(req.SQL)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		maxRows := req.MaxRows
+		if maxRows <= 0 {
+			maxRows = envInt("WHATSAPP_ADMIN_QUERY_MAX_ROWS", 1000)
+		}
+		maxRows = min(max(maxRows, 1), maxQueryRows)
+
+		resp, err := runReadOnlyQuery(query, req.Params, maxRows)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		bridgeLog.Infof("Admin query returned %d rows in %dms", len(resp.Rows), resp.ElapsedMS)
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/appstate"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Mark a stored message as starred or not, returns false if it isn't stored
+func (store *MessageStore) SetStarred(chatJID, messageID string, starred bool) (bool, error) {
+	result, err := store.db.Exec(
+		"UPDATE messages SET is_starred = ? WHERE id = ? AND chat_jid = ?",
+		starred, messageID, chatJID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// Keep the starred flag in sync with stars set on other devices
+func handleStarEvent(messageStore *MessageStore, evt *events.Star) {
+	starred := evt.Action.GetStarred()
+	if _, err := messageStore.SetStarred(evt.ChatJID.String(), evt.MessageID, starred); err != nil {
+		bridgeLog.Warnf("Failed to update star of message %s: %v", evt.MessageID, err)
+	}
+}
+
+// Look up the chat, sender and direction of a stored message, as needed to
+// address it in app state patches and protocol messages
+func storedMessageKey(client *whatsmeow.Client, messageStore *MessageStore, chatJID, messageID string) (types.JID, types.JID, bool, error) {
+	chat, err := types.ParseJID(chatJID)
+	if err != nil {
+		return types.JID{}, types.JID{}, false, newAPIError(ErrCodeInvalidRequest, "Invalid chat JID: %v", err)
+	}
+
+	var sender string
+	var isFromMe bool
+	err = messageStore.db.QueryRow(
+		"SELECT sender, is_from_me FROM messages WHERE id = ? AND chat_jid = ?",
+		messageID, chatJID,
+	).Scan(&sender, &isFromMe)
+	if err == sql.ErrNoRows {
+		return types.JID{}, types.JID{}, false, newAPIError(ErrCodeNotFound, "Message %s not found in chat %s", messageID, chatJID)
+	} else if err != nil {
+		return types.JID{}, types.JID{}, false, err
+	}
+
+	// The sender is only meaningful for messages of others in groups
+	senderJID := chat
+	if isFromMe {
+		senderJID = client.Store.ID.ToNonAD()
+	} else if chat.Server == types.GroupServer {
+		if senderJID, err = parseSenderJID(sender); err != nil {
+			return types.JID{}, types.JID{}, false, newAPIError(ErrCodeInternal, "Invalid sender %s stored for message: %v", sender, err)
+		}
+	}
+	return chat, senderJID, isFromMe, nil
+}
+
+// Star or unstar a message on all devices
+func starMessage(ctx context.Context, client *whatsmeow.Client, messageStore *MessageStore, chatJID, messageID string, starred bool) error {
+	if !client.IsConnected() {
+		return newAPIError(ErrCodeNotConnected, "Not connected to WhatsApp")
+	}
+	chat, senderJID, isFromMe, err := storedMessageKey(client, messageStore, chatJID, messageID)
+	if err != nil {
+		return err
+	}
+
+	patch := appstate.BuildStar(chat, senderJID, messageID, isFromMe, starred)
+	payload := map[string]interface{}{"chat_jid": chatJID, "message_id": messageID, "starred": starred}
+	err = journal(messageStore, OpKindStar, chatJID, payload, func() error {
+		return throttle(opAppState, func() error {
+			ctx, cancel := callContext(ctx, callQuery)
+			defer cancel()
+			return client.SendAppState(ctx, patch)
+		})
+	})
+	if err != nil {
+		return newCallError(ErrCodeSendFailed, err, "Failed to sync star: %v", err)
+	}
+	if _, err := messageStore.SetStarred(chatJID, messageID, starred); err != nil {
+		return err
+	}
+	return nil
+}
+
+// StarMessageRequest represents the request body for starring a message
+type StarMessageRequest struct {
+	ChatJID   string `json:"chat_jid"`
+	MessageID string `json:"message_id"`
+	Starred   *bool  `json:"starred,omitempty"` // Defaults to true
+}
+
+// Register the REST handlers for starring messages
+func registerStarHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	// Handler for starring and unstarring messages
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/messages/star",
+		Summary:  "Star or unstar a message, synced to the phone and other devices",
+		Tag:      "messages",
+		Scope:    ScopeSendMessages,
+		Audit:    true,
+		Request:  StarMessageRequest{},
+		Response: StatusResponse{},
+	})
+	http.HandleFunc("POST /api/messages/star", func(w http.ResponseWriter, r *http.Request) {
+		var req StarMessageRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if req.ChatJID == "" || req.MessageID == "" {
+			writeError(w, ErrCodeInvalidRequest, "Message ID and Chat JID are required", nil)
+			return
+		}
+		starred := req.Starred == nil || *req.Starred
+
+		if err := starMessage(r.Context(), client, messageStore, req.ChatJID, req.MessageID, starred); err != nil {
+			writeAPIError(w, "Failed to star message", err)
+			return
+		}
+		action := "starred"
+		if !starred {
+			action = "unstarred"
+		}
+		writeJSON(w, http.StatusOK, StatusResponse{Success: true, Message: fmt.Sprintf("Message %s %s", req.MessageID, action)})
+	})
+
+	// Handler for listing starred messages
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/messages/starred",
+		Summary: "List starred messages, newest first",
+		Tag:     "messages",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "chat_jid", Description: "Only starred messages from this chat"},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: ListMessagesResponse{},
+	})
+	http.HandleFunc("GET /api/messages/starred", func(w http.ResponseWriter, r *http.Request) {
+		f := MessageFilter{ChatJID: r.URL.Query().Get("chat_jid"), Starred: true}
+		var err error
+		if f.Limit, f.Offset, err = parsePagination(r); err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		messages, page, err := messageStore.QueryMessagesPage(f)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list starred messages: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, ListMessagesResponse{Success: true, Messages: messages, Page: page})
+	})
+}
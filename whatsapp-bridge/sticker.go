@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// Stickers are square images of this size
+const stickerSize = 512
+
+// Largest static sticker WhatsApp clients accept
+const maxStickerBytes = 100 << 10
+
+// WebP qualities tried in turn until the sticker is small enough
+var stickerQualities = []int{80, 60, 40, 20}
+
+// Default command encoding a PNG into WebP, {input}, {output} and {quality}
+// are replaced with the file paths and the quality
+const defaultStickerCommand = "cwebp -quiet -q {quality} -alpha_q 100 {input} -o {output}"
+
+// stickerMetadata is the pack information WhatsApp clients read from the
+// EXIF data of a sticker
+type stickerMetadata struct {
+	PackID    string   `json:"sticker-pack-id"`
+	PackName  string   `json:"sticker-pack-name"`
+	Publisher string   `json:"sticker-pack-publisher"`
+	Emojis    []string `json:"emojis,omitempty"`
+}
+
+// Fit an image into a transparent square of the sticker size, keeping its
+// aspect ratio. Each pixel is the average of the source pixels it covers.
+func fitSticker(src image.Image) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, stickerSize, stickerSize))
+	b := src.Bounds()
+	if b.Dx() == 0 || b.Dy() == 0 {
+		return dst
+	}
+	scale := float64(stickerSize) / float64(max(b.Dx(), b.Dy()))
+	w := max(int(float64(b.Dx())*scale+0.5), 1)
+	h := max(int(float64(b.Dy())*scale+0.5), 1)
+	offX, offY := (stickerSize-w)/2, (stickerSize-h)/2
+
+	for y := 0; y < h; y++ {
+		y0 := b.Min.Y + y*b.Dy()/h
+		y1 := max(b.Min.Y+(y+1)*b.Dy()/h, y0+1)
+		for x := 0; x < w; x++ {
+			x0 := b.Min.X + x*b.Dx()/w
+			x1 := max(b.Min.X+(x+1)*b.Dx()/w, x0+1)
+			// Average premultiplied colors so transparent pixels don't darken edges
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			c := color.RGBA64{uint16(r / n), uint16(g / n), uint16(bl / n), uint16(a / n)}
+			dst.Set(offX+x, offY+y, c)
+		}
+	}
+	return dst
+}
+
+// Encode a sticker image to WebP with the sticker command, lowering the
+// quality until it fits the sticker size limit
+func encodeStickerWebP(img image.Image) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "sticker")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	input, output := filepath.Join(dir, "sticker.png"), filepath.Join(dir, "sticker.webp")
+	f, err := os.Create(input)
+	if err != nil {
+		return nil, err
+	}
+	err = png.Encode(f, img)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var data []byte
+	for _, quality := range stickerQualities {
+		vars := map[string]string{"input": input, "output": output, "quality": strconv.Itoa(quality)}
+		if _, err := runCommandTemplate("WHATSAPP_STICKER_COMMAND", defaultStickerCommand, vars, 30*time.Second); err != nil {
+			return nil, err
+		}
+		if data, err = os.ReadFile(output); err != nil {
+			return nil, err
+		}
+		if len(data) <= maxStickerBytes {
+			break
+		}
+	}
+	return data, nil
+}
+
+// A chunk of a RIFF container
+type riffChunk struct {
+	id   string
+	data []byte
+}
+
+// Split a WebP file into its chunks
+func parseWebP(data []byte) ([]riffChunk, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, fmt.Errorf("not a WebP file")
+	}
+	var chunks []riffChunk
+	for rest := data[12:]; len(rest) >= 8; {
+		size := int(binary.LittleEndian.Uint32(rest[4:8]))
+		if size > len(rest)-8 {
+			return nil, fmt.Errorf("truncated WebP chunk %s", rest[0:4])
+		}
+		chunks = append(chunks, riffChunk{id: string(rest[0:4]), data: rest[8 : 8+size]})
+		// Chunks are padded to an even size
+		rest = rest[min(8+size+size%2, len(rest)):]
+	}
+	return chunks, nil
+}
+
+// Build the EXIF block carrying sticker metadata: a little-endian TIFF
+// header with a single entry holding the JSON
+func stickerEXIF(meta stickerMetadata) ([]byte, error) {
+	payload, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	exif := []byte{0x49, 0x49, 0x2A, 0x00, 0x08, 0x00, 0x00, 0x00, 0x01, 0x00, 0x41, 0x57, 0x07, 0x00}
+	exif = binary.LittleEndian.AppendUint32(exif, uint32(len(payload)))
+	exif = append(exif, 0x16, 0x00, 0x00, 0x00)
+	return append(exif, payload...), nil
+}
+
+// Attach sticker metadata to a WebP file, converting it to the extended
+// format that can carry EXIF data. Reports whether the sticker is animated.
+func addStickerMetadata(data []byte, meta stickerMetadata) ([]byte, bool, error) {
+	chunks, err := parseWebP(data)
+	if err != nil {
+		return nil, false, err
+	}
+	exif, err := stickerEXIF(meta)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var vp8x []byte
+	var body []riffChunk
+	for _, c := range chunks {
+		switch c.id {
+		case "VP8X":
+			vp8x = append([]byte(nil), c.data...)
+		case "EXIF":
+			// Replaced by the sticker metadata
+		default:
+			body = append(body, c)
+		}
+	}
+	if len(vp8x) < 10 {
+		// Simple format files hold a single image, the canvas is its size
+		if len(body) == 0 {
+			return nil, false, fmt.Errorf("no image data")
+		}
+		width, height, alpha, err := webpImageSize(body[0])
+		if err != nil {
+			return nil, false, err
+		}
+		vp8x = make([]byte, 10)
+		if alpha {
+			vp8x[0] = 0x10
+		}
+		putUint24(vp8x[4:], width-1)
+		putUint24(vp8x[7:], height-1)
+	}
+	vp8x[0] |= 0x08 // EXIF
+	animated := vp8x[0]&0x02 != 0
+
+	var out bytes.Buffer
+	out.WriteString("RIFF\x00\x00\x00\x00WEBP")
+	for _, c := range append([]riffChunk{{"VP8X", vp8x}}, append(body, riffChunk{"EXIF", exif})...) {
+		out.WriteString(c.id)
+		binary.Write(&out, binary.LittleEndian, uint32(len(c.data)))
+		out.Write(c.data)
+		if len(c.data)%2 == 1 {
+			out.WriteByte(0)
+		}
+	}
+	result := out.Bytes()
+	binary.LittleEndian.PutUint32(result[4:8], uint32(len(result)-8))
+	return result, animated, nil
+}
+
+// Read the size of the image in a VP8 or VP8L chunk, and whether it may
+// have transparency
+func webpImageSize(c riffChunk) (width, height uint32, alpha bool, err error) {
+	switch {
+	case c.id == "VP8L" && len(c.data) >= 5 && c.data[0] == 0x2f:
+		bits := binary.LittleEndian.Uint32(c.data[1:5])
+		return bits&0x3fff + 1, bits>>14&0x3fff + 1, true, nil
+	case c.id == "VP8 " && len(c.data) >= 10:
+		return uint32(binary.LittleEndian.Uint16(c.data[6:8]) & 0x3fff), uint32(binary.LittleEndian.Uint16(c.data[8:10]) & 0x3fff), false, nil
+	}
+	return 0, 0, false, fmt.Errorf("unknown WebP image chunk %q", c.id)
+}
+
+// Write a 24-bit little-endian integer
+func putUint24(b []byte, v uint32) {
+	b[0], b[1], b[2] = byte(v), byte(v>>8), byte(v>>16)
+}
+
+// Turn an image file into a sticker: WebP files are kept as they are, other
+// images are fitted into a 512x512 transparent square and encoded to WebP
+func makeSticker(path string, meta stickerMetadata) ([]byte, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false, newAPIError(ErrCodeInvalidRequest, "Error reading media file: %v", err)
+	}
+	if _, err := parseWebP(data); err != nil {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, false, newAPIError(ErrCodeUnsupportedMedia, "Stickers can be made from PNG, JPEG, GIF or WebP images: %v", err)
+		}
+		if data, err = encodeStickerWebP(fitSticker(img)); err != nil {
+			return nil, false, newAPIError(ErrCodeInternal, "Failed to encode sticker: %v", err)
+		}
+	}
+	data, animated, err := addStickerMetadata(data, meta)
+	if err != nil {
+		return nil, false, newAPIError(ErrCodeUnsupportedMedia, "Invalid WebP sticker: %v", err)
+	}
+	return data, animated, nil
+}
+
+// SendStickerRequest represents the request body for the send sticker API
+type SendStickerRequest struct {
+	Recipient  string   `json:"recipient"`
+	MediaPath  string   `json:"media_path,omitempty"`  // PNG, JPEG, GIF or WebP image
+	MediaToken string   `json:"media_token,omitempty"` // Token of an uploaded image, instead of media_path
+	MediaURL   string   `json:"media_url,omitempty"`   // URL to download the image from, instead of media_path
+	PackName   string   `json:"pack_name,omitempty"`   // Shown with the sticker, WHATSAPP_STICKER_PACK by default
+	Publisher  string   `json:"publisher,omitempty"`   // WHATSAPP_STICKER_PUBLISHER by default
+	Emojis     []string `json:"emojis,omitempty"`      // Emojis the sticker stands for
+}
+
+// Register the REST handler sending stickers
+func registerStickerHandlers(client *whatsmeow.Client, messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/send/sticker",
+		Summary:  "Send an image as a sticker; PNG, JPEG and GIF images are fitted into a transparent 512x512 square and encoded to WebP with WHATSAPP_STICKER_COMMAND (cwebp by default), and sticker pack metadata is attached",
+		Tag:      "messages",
+		Scope:    ScopeSendMessages,
+		Audit:    true,
+		Request:  SendStickerRequest{},
+		Response: SendInteractiveResponse{},
+	})
+	http.HandleFunc("POST /api/send/sticker", func(w http.ResponseWriter, r *http.Request) {
+		var req SendStickerRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if req.Recipient == "" {
+			writeError(w, ErrCodeInvalidRequest, "Recipient is required", nil)
+			return
+		}
+		path, err := resolveMediaSource(req.MediaPath, req.MediaToken, req.MediaURL)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if path == "" {
+			writeError(w, ErrCodeInvalidRequest, "An image is required", nil)
+			return
+		}
+		if !client.IsConnected() {
+			writeError(w, ErrCodeNotConnected, "Not connected to WhatsApp", nil)
+			return
+		}
+
+		meta := stickerMetadata{
+			PackID:    "whatsapp-bridge",
+			PackName:  req.PackName,
+			Publisher: req.Publisher,
+			Emojis:    req.Emojis,
+		}
+		if meta.PackName == "" {
+			meta.PackName = envString("WHATSAPP_STICKER_PACK", "WhatsApp Bridge")
+		}
+		if meta.Publisher == "" {
+			meta.Publisher = envString("WHATSAPP_STICKER_PUBLISHER", "")
+		}
+		data, animated, err := makeSticker(path, meta)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		var resp whatsmeow.UploadResponse
+		err = throttle(opMedia, func() (err error) {
+			ctx, cancel := callContext(r.Context(), callMedia)
+			defer cancel()
+			resp, err = client.Upload(ctx, data, whatsmeow.MediaImage)
+			return err
+		})
+		if err != nil {
+			writeAPIError(w, "", newCallError(ErrCodeUploadFailed, err, "Error uploading sticker: %v", err))
+			return
+		}
+		msg := &waProto.Message{StickerMessage: &waProto.StickerMessage{
+			URL:           &resp.URL,
+			DirectPath:    &resp.DirectPath,
+			MediaKey:      resp.MediaKey,
+			FileEncSHA256: resp.FileEncSHA256,
+			FileSHA256:    resp.FileSHA256,
+			FileLength:    &resp.FileLength,
+			Mimetype:      proto.String("image/webp"),
+			Width:         proto.Uint32(stickerSize),
+			Height:        proto.Uint32(stickerSize),
+			IsAnimated:    proto.Bool(animated),
+		}}
+		id, err := sendInteractiveMessage(r.Context(), client, messageStore, req.Recipient, msg)
+		if err != nil {
+			writeAPIError(w, "Failed to send sticker", err)
+			return
+		}
+		writeJSON(w, http.StatusOK, SendInteractiveResponse{Success: true, Message: fmt.Sprintf("Sticker sent to %s", req.Recipient), MessageID: id})
+	})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Background sync job states
+const (
+	SyncIdle    = "idle"
+	SyncRunning = "running"
+	SyncDone    = "done"
+	SyncFailed  = "failed"
+)
+
+// SyncStatus reports the progress of a background sync job
+type SyncStatus struct {
+	Name       string     `json:"name"`
+	State      string     `json:"state"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Done       int        `json:"done"`
+	Total      int        `json:"total"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// syncJob runs a long sync step in the background, at most once at a time
+type syncJob struct {
+	mu     sync.Mutex
+	status SyncStatus
+	ctx    context.Context // Canceled when the run finishes or is stopped
+	cancel context.CancelFunc
+}
+
+// Create an idle sync job
+func newSyncJob(name string) *syncJob {
+	return &syncJob{status: SyncStatus{Name: name, State: SyncIdle}}
+}
+
+// Get a snapshot of the job's status
+func (j *syncJob) Status() SyncStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.status
+}
+
+// Mark the job as running, returns false if it already is
+func (j *syncJob) begin() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status.State == SyncRunning {
+		return false
+	}
+	now := time.Now()
+	j.status = SyncStatus{Name: j.status.Name, State: SyncRunning, StartedAt: &now}
+	j.ctx, j.cancel = context.WithCancel(context.Background())
+	return true
+}
+
+// Get the context of the current run, for the calls the job makes
+func (j *syncJob) context() context.Context {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.ctx == nil {
+		return context.Background()
+	}
+	return j.ctx
+}
+
+// Ask the current run to stop, returns false if the job isn't running
+func (j *syncJob) stop() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.status.State != SyncRunning {
+		return false
+	}
+	j.cancel()
+	return true
+}
+
+// Record the outcome of a run
+func (j *syncJob) finish(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.cancel()
+	finished := time.Now()
+	j.status.FinishedAt = &finished
+	if err != nil {
+		j.status.State = SyncFailed
+		j.status.Error = err.Error()
+		bridgeLog.Warnf("%s sync failed: %v", j.status.Name, err)
+	} else {
+		j.status.State = SyncDone
+		bridgeLog.Infof("%s sync done in %s", j.status.Name, finished.Sub(*j.status.StartedAt).Round(time.Millisecond))
+	}
+}
+
+// Error a job returns when it was stopped through its API
+var errJobStopped = errors.New("stopped on request")
+
+// Start running fn in the background. Returns false if the job is already running.
+func (j *syncJob) start(fn func(j *syncJob) error) bool {
+	if !j.begin() {
+		return false
+	}
+	go func() {
+		// A panicking job fails instead of taking the bridge down
+		err := errors.New("job panicked, see the log")
+		defer func() { j.finish(err) }()
+		defer recoverPanic("running background job")
+		err = fn(j)
+	}()
+	return true
+}
+
+// Run fn and wait for it to finish. Returns false if the job was already running.
+func (j *syncJob) runAndWait(fn func(j *syncJob) error) (bool, error) {
+	if !j.begin() {
+		return false, nil
+	}
+	// A panicking job fails instead of staying marked as running
+	err := errors.New("job panicked, see the log")
+	defer func() { j.finish(err) }()
+	err = fn(j)
+	return true, err
+}
+
+// Set the number of items the job will process
+func (j *syncJob) setTotal(total int) {
+	j.mu.Lock()
+	j.status.Total = total
+	j.mu.Unlock()
+}
+
+// Record processed items
+func (j *syncJob) advance(n int) {
+	j.mu.Lock()
+	j.status.Done += n
+	j.mu.Unlock()
+}
+
+// rateLimiter spaces out calls to at most a number per second
+type rateLimiter struct {
+	ticker *time.Ticker
+}
+
+// Create a rate limiter, perSecond <= 0 disables limiting
+func newRateLimiter(perSecond int) *rateLimiter {
+	if perSecond <= 0 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{ticker: time.NewTicker(time.Second / time.Duration(perSecond))}
+}
+
+// Wait for the next allowed call
+func (l *rateLimiter) wait() {
+	if l.ticker != nil {
+		<-l.ticker.C
+	}
+}
+
+// Release the limiter's resources
+func (l *rateLimiter) stop() {
+	if l.ticker != nil {
+		l.ticker.Stop()
+	}
+}
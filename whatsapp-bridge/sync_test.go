@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSyncJobStop(t *testing.T) {
+	job := newSyncJob("test")
+	if job.stop() {
+		t.Fatal("Stopped a job that isn't running")
+	}
+	started := make(chan struct{})
+	job.start(func(j *syncJob) error {
+		close(started)
+		<-j.context().Done()
+		return errJobStopped
+	})
+	<-started
+	if !job.stop() {
+		t.Fatal("Couldn't stop the running job")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for job.Status().State == SyncRunning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := job.Status(); status.State != SyncFailed || status.Error != errJobStopped.Error() {
+		t.Errorf("Stopped job %+v", status)
+	}
+	if !errors.Is(job.context().Err(), context.Canceled) {
+		t.Error("Job context outlived its run")
+	}
+}
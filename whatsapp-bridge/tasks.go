@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// States of an extracted task
+const (
+	TaskOpen   = "open"
+	TaskClosed = "closed"
+)
+
+// Task is a to-do item found in a message. Revision grows with every change
+// to any task, so feed readers only fetch what changed since their last poll.
+type Task struct {
+	ID          int64      `json:"id"`
+	UID         string     `json:"uid"` // Stable identifier for task managers, like the UID of a VTODO
+	MessageID   string     `json:"message_id"`
+	ChatJID     string     `json:"chat_jid"`
+	ChatName    string     `json:"chat_name,omitempty"`
+	Sender      string     `json:"sender"`
+	Title       string     `json:"title"`
+	Status      string     `json:"status"`      // open or closed
+	ICalStatus  string     `json:"ical_status"` // NEEDS-ACTION or COMPLETED, as in a VTODO
+	Created     time.Time  `json:"created"`
+	Completed   *time.Time `json:"completed,omitempty"`
+	CompletedBy string     `json:"completed_by,omitempty"` // ID of the message that closed the task
+	Updated     time.Time  `json:"updated"`
+	Revision    int64      `json:"revision"`
+}
+
+// Markers starting a line that adds a task and one that closes it, set as
+// comma-separated lists in WHATSAPP_TASK_MARKERS and WHATSAPP_TASK_DONE_MARKERS.
+// A reply made of just a marker reopens or closes the tasks of the quoted message.
+func taskMarkers() (open, done []string) {
+	split := func(list string) []string {
+		var markers []string
+		for _, m := range strings.Split(list, ",") {
+			if m = strings.ToLower(strings.TrimSpace(m)); m != "" {
+				markers = append(markers, m)
+			}
+		}
+		return markers
+	}
+	return split(envString("WHATSAPP_TASK_MARKERS", "TODO:,TODO,[ ],[],☐")),
+		split(envString("WHATSAPP_TASK_DONE_MARKERS", "DONE:,DONE,[x],☑,☑️,✅,✔,✔️"))
+}
+
+// Bullets and numbering a task line may start with
+var taskBullets = []string{"- ", "* ", "• ", "+ "}
+
+// Strip a list bullet or number off a line
+func stripTaskBullet(line string) string {
+	for _, b := range taskBullets {
+		if strings.HasPrefix(line, b) {
+			return strings.TrimSpace(line[len(b):])
+		}
+	}
+	if i := strings.IndexFunc(line, func(r rune) bool { return r < '0' || r > '9' }); i > 0 && i < len(line)-1 && (line[i] == '.' || line[i] == ')') && line[i+1] == ' ' {
+		return strings.TrimSpace(line[i+2:])
+	}
+	return line
+}
+
+// Get the text after the first marker starting a line, which must not run on
+// into a word ("TODOs" isn't "TODO")
+func cutTaskMarker(line string, markers []string) (string, bool) {
+	lower := strings.ToLower(line)
+	for _, m := range markers {
+		if !strings.HasPrefix(lower, m) {
+			continue
+		}
+		rest := line[len(m):]
+		last := []rune(m)[len([]rune(m))-1]
+		if next := []rune(rest + " ")[0]; (unicode.IsLetter(last) || unicode.IsDigit(last)) && (unicode.IsLetter(next) || unicode.IsDigit(next)) {
+			continue
+		}
+		// Emoji markers may come with a variation selector
+		return strings.TrimSpace(strings.TrimLeftFunc(rest, func(r rune) bool {
+			return unicode.IsSpace(r) || strings.ContainsRune(":-–—\uFE0F", r)
+		})), true
+	}
+	return "", false
+}
+
+// Find the tasks a message adds and closes, one per marked line
+func parseTaskLines(text string) (added, done []string) {
+	open, closed := taskMarkers()
+	for _, line := range strings.Split(text, "\n") {
+		line = stripTaskBullet(strings.TrimSpace(line))
+		if title, ok := cutTaskMarker(line, closed); ok && title != "" {
+			done = append(done, title)
+		} else if title, ok := cutTaskMarker(line, open); ok && title != "" {
+			added = append(added, title)
+		}
+	}
+	return added, done
+}
+
+// Tell whether a reply is just a marker, closing (or reopening) the tasks of
+// the message it quotes
+func taskReplyStatus(text string) string {
+	text = strings.ToLower(strings.TrimRight(strings.TrimSpace(text), ".!"))
+	if text == "" {
+		return ""
+	}
+	open, done := taskMarkers()
+	for _, m := range done {
+		if text == strings.TrimRight(m, ":") {
+			return TaskClosed
+		}
+	}
+	for _, m := range open {
+		if text == strings.TrimRight(m, ":") {
+			return TaskOpen
+		}
+	}
+	return ""
+}
+
+// Next revision, evaluated in the statement changing the tasks
+const nextTaskRevision = `(SELECT COALESCE(MAX(revision), 0) + 1 FROM tasks)`
+
+// Add a task from a message, reopening a closed one of the chat with the same
+// title instead. An open task with the same title is left alone.
+func (store *MessageStore) AddTask(msg Message, title string) error {
+	now := time.Now()
+	result, err := store.db.Exec(
+		`UPDATE tasks SET status = ?, completed_at = NULL, completed_by = NULL, updated_at = ?, revision = `+nextTaskRevision+`
+		WHERE id = (SELECT id FROM tasks WHERE chat_jid = ? AND title = ? COLLATE NOCASE AND status = ? ORDER BY created_at DESC LIMIT 1)
+		AND NOT EXISTS (SELECT 1 FROM tasks WHERE chat_jid = ? AND title = ? COLLATE NOCASE AND status = ?)`,
+		TaskOpen, now, msg.ChatJID, title, TaskClosed, msg.ChatJID, title, TaskOpen,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		return nil
+	}
+	_, err = store.db.Exec(
+		`INSERT OR IGNORE INTO tasks (message_id, chat_jid, sender, title, status, created_at, updated_at, revision)
+		SELECT ?, ?, ?, ?, ?, ?, ?, `+nextTaskRevision+`
+		WHERE NOT EXISTS (SELECT 1 FROM tasks WHERE chat_jid = ? AND title = ? COLLATE NOCASE AND status = ?)`,
+		msg.ID, msg.ChatJID, msg.Sender, title, TaskOpen, msg.Time.Local(), now, msg.ChatJID, title, TaskOpen,
+	)
+	return err
+}
+
+// Close the open task of a chat with a title, returning whether there was one.
+// AddTask keeps a single open task per title.
+func (store *MessageStore) CloseTaskByTitle(msg Message, title string) (bool, error) {
+	result, err := store.db.Exec(
+		`UPDATE tasks SET status = ?, completed_at = ?, completed_by = ?, updated_at = ?, revision = `+nextTaskRevision+`
+		WHERE chat_jid = ? AND title = ? COLLATE NOCASE AND status = ?`,
+		TaskClosed, msg.Time.Local(), msg.ID, time.Now(), msg.ChatJID, title, TaskOpen,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Close or reopen the tasks added by a message, as told by a reply to it.
+// Each task is changed on its own so it gets a revision of its own.
+func (store *MessageStore) SetMessageTasksStatus(reply Message, quotedID, status string) error {
+	rows, err := store.db.Query("SELECT id FROM tasks WHERE chat_jid = ? AND message_id = ? AND status != ? ORDER BY id", reply.ChatJID, quotedID, status)
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	completedAt, completedBy := interface{}(nil), interface{}(nil)
+	if status == TaskClosed {
+		completedAt, completedBy = reply.Time.Local(), reply.ID
+	}
+	for _, id := range ids {
+		if _, err := store.db.Exec(
+			`UPDATE tasks SET status = ?, completed_at = ?, completed_by = ?, updated_at = ?, revision = `+nextTaskRevision+` WHERE id = ?`,
+			status, completedAt, completedBy, time.Now(), id,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TaskFilter describes which tasks ListTasks returns
+type TaskFilter struct {
+	ChatJID string
+	Status  string
+	Since   int64 // Only tasks changed after this revision
+	Limit   int
+	Offset  int
+}
+
+// List tasks in the order they last changed
+func (store *MessageStore) ListTasks(f TaskFilter) ([]Task, error) {
+	conditions := []string{"t.revision > ?"}
+	args := []interface{}{f.Since}
+	if f.ChatJID != "" {
+		conditions = append(conditions, "t.chat_jid = ?")
+		args = append(args, f.ChatJID)
+	}
+	if f.Status != "" {
+		conditions = append(conditions, "t.status = ?")
+		args = append(args, f.Status)
+	}
+	args = append(args, f.Limit, f.Offset)
+
+	rows, err := store.db.Query(
+		`SELECT t.id, t.message_id, t.chat_jid, COALESCE(c.name, ''), COALESCE(t.sender, ''), t.title, t.status,
+			t.created_at, t.completed_at, COALESCE(t.completed_by, ''), t.updated_at, t.revision
+		FROM tasks t LEFT JOIN chats c ON c.jid = t.chat_jid
+		WHERE `+strings.Join(conditions, " AND ")+`
+		ORDER BY t.revision, t.id LIMIT ? OFFSET ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tasks := []Task{}
+	for rows.Next() {
+		var t Task
+		var completed *time.Time
+		if err := rows.Scan(&t.ID, &t.MessageID, &t.ChatJID, &t.ChatName, &t.Sender, &t.Title, &t.Status,
+			&t.Created, &completed, &t.CompletedBy, &t.Updated, &t.Revision); err != nil {
+			return nil, err
+		}
+		t.Completed = completed
+		t.UID = fmt.Sprintf("whatsapp-task-%d", t.ID)
+		t.ICalStatus = "NEEDS-ACTION"
+		if t.Status == TaskClosed {
+			t.ICalStatus = "COMPLETED"
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
+
+// Get the revision of the latest change to any task
+func (store *MessageStore) taskRevision() (int64, error) {
+	var revision int64
+	err := store.db.QueryRow("SELECT COALESCE(MAX(revision), 0) FROM tasks").Scan(&revision)
+	return revision, err
+}
+
+// Add, close and reopen tasks as told by a new message. quotedID is the ID of
+// the message it replies to, if any.
+func handleTaskExtraction(messageStore *MessageStore, msg Message, quotedID string) {
+	if msg.Content == "" || !envBool("WHATSAPP_EXTRACT_TASKS", true) {
+		return
+	}
+
+	if quotedID != "" {
+		if status := taskReplyStatus(msg.Content); status != "" {
+			if err := messageStore.SetMessageTasksStatus(msg, quotedID, status); err != nil {
+				bridgeLog.Warnf("Failed to update the tasks of message %s: %v", quotedID, err)
+			}
+			return
+		}
+	}
+
+	added, done := parseTaskLines(msg.Content)
+	for _, title := range done {
+		if _, err := messageStore.CloseTaskByTitle(msg, title); err != nil {
+			bridgeLog.Warnf("Failed to close task %q: %v", title, err)
+		}
+	}
+	for _, title := range added {
+		if err := messageStore.AddTask(msg, title); err != nil {
+			bridgeLog.Warnf("Failed to store task %q: %v", title, err)
+		}
+	}
+}
+
+// TaskFeedResponse represents the response for the task feed API
+type TaskFeedResponse struct {
+	Success   bool   `json:"success"`
+	Tasks     []Task `json:"tasks"`
+	SyncToken string `json:"sync_token"` // Pass as since on the next poll to get only later changes
+	Page
+}
+
+// Register the REST handler serving the task feed
+func registerTaskHandlers(messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/extracted/tasks",
+		Summary: "Feed of the to-do items found in messages, in the order they changed. Poll it with the sync_token of the last response as since to get only new, closed and reopened tasks; the ETag header allows conditional requests.",
+		Tag:     "extracted",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "since", Description: "sync_token of a previous response, only tasks changed after it"},
+			{Name: "status", Description: "Only open or closed tasks"},
+			{Name: "chat_jid", Description: "Only tasks found in this chat"},
+			{Name: "limit", Description: "Maximum number of results", Type: "integer"},
+			{Name: "offset", Description: "Number of results to skip", Type: "integer"},
+		},
+		Response: TaskFeedResponse{},
+	})
+	http.HandleFunc("GET /api/extracted/tasks", func(w http.ResponseWriter, r *http.Request) {
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		f := TaskFilter{ChatJID: r.URL.Query().Get("chat_jid"), Status: r.URL.Query().Get("status"), Limit: limit + 1, Offset: offset}
+		if f.Status != "" && f.Status != TaskOpen && f.Status != TaskClosed {
+			writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("status must be %s or %s", TaskOpen, TaskClosed), nil)
+			return
+		}
+		if v := r.URL.Query().Get("since"); v != "" {
+			if f.Since, err = strconv.ParseInt(v, 10, 64); err != nil || f.Since < 0 {
+				writeError(w, ErrCodeInvalidRequest, "since must be the sync_token of a previous response", nil)
+				return
+			}
+		}
+
+		revision, err := messageStore.taskRevision()
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list tasks: %v", err), nil)
+			return
+		}
+		// The same query gets the same answer until a task changes
+		etag := fmt.Sprintf(`"%d-%08x"`, revision, crc32.ChecksumIEEE([]byte(r.URL.RawQuery)))
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		tasks, err := messageStore.ListTasks(f)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list tasks: %v", err), nil)
+			return
+		}
+		// While pages remain, resume after the last task returned, or before
+		// it if the next one changed in the same revision
+		syncToken := revision
+		if len(tasks) > limit {
+			syncToken = tasks[limit-1].Revision
+			if tasks[limit].Revision == syncToken {
+				syncToken--
+			}
+		}
+		tasks, page := trimPage(tasks, offset, limit)
+		writeJSON(w, http.StatusOK, TaskFeedResponse{Success: true, Tasks: tasks, SyncToken: strconv.FormatInt(syncToken, 10), Page: page})
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+var registerTaskHandlersOnce sync.Once
+
+// Fetch the task feed of the test server
+func getTaskFeed(t *testing.T, query, etag string) (*http.Response, TaskFeedResponse) {
+	t.Helper()
+	registerTaskHandlersOnce.Do(func() { registerTaskHandlers(testStore) })
+	req, _ := http.NewRequest(http.MethodGet, testServer.URL+"/api/extracted/tasks?"+query, nil)
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var feed TaskFeedResponse
+	if resp.StatusCode == http.StatusOK {
+		json.NewDecoder(resp.Body).Decode(&feed)
+	}
+	return resp, feed
+}
+
+func TestParseTaskLines(t *testing.T) {
+	added, done := parseTaskLines("Plan for Saturday\nTODO: book the table\n- [ ] buy flowers\n☑️ call mum\n1. [x] pick up the keys\nTODOs are piling up\n[ ]")
+	if want := []string{"book the table", "buy flowers"}; !reflect.DeepEqual(added, want) {
+		t.Errorf("Added %q, want %q", added, want)
+	}
+	if want := []string{"call mum", "pick up the keys"}; !reflect.DeepEqual(done, want) {
+		t.Errorf("Done %q, want %q", done, want)
+	}
+	for text, want := range map[string]string{"Done!": TaskClosed, "✅": TaskClosed, "todo": TaskOpen, "done with it": ""} {
+		if got := taskReplyStatus(text); got != want {
+			t.Errorf("Reply %q sets %q, want %q", text, got, want)
+		}
+	}
+}
+
+func TestTaskFeed(t *testing.T) {
+	testStore.db.Exec("DELETE FROM tasks")
+	t.Cleanup(func() { testStore.db.Exec("DELETE FROM tasks") })
+	chat := "120363000000000401@g.us"
+	start := time.Date(2026, 3, 1, 10, 0, 0, 0, time.Local)
+	message := func(id, text string, minutes int, quotedID string) {
+		msg := Message{ID: id, ChatJID: chat, Sender: "15551320001", Content: text, Time: start.Add(time.Duration(minutes) * time.Minute)}
+		storeTestMessage(t, msg, "", nil, 0)
+		handleTaskExtraction(testStore, msg, quotedID)
+	}
+
+	message("T1", "TODO: renew passport", 0, "")
+	message("T2", "TODO: Renew passport\n- [ ] water plants", 1, "") // The passport is already open
+	resp, feed := getTaskFeed(t, "chat_jid="+chat, "")
+	if len(feed.Tasks) != 2 || feed.Tasks[0].Title != "renew passport" || feed.Tasks[0].ICalStatus != "NEEDS-ACTION" {
+		t.Fatalf("Feed %+v", feed.Tasks)
+	}
+	if again, _ := getTaskFeed(t, "chat_jid="+chat, resp.Header.Get("ETag")); again.StatusCode != http.StatusNotModified {
+		t.Errorf("Unchanged feed answered %d, want 304", again.StatusCode)
+	}
+
+	// Closing by title and by replying, then reopening
+	message("T3", "[x] water plants", 2, "")
+	message("T4", "done", 3, "T1")
+	message("T5", "todo", 4, "T1")
+	_, changes := getTaskFeed(t, "since="+feed.SyncToken, "")
+	if len(changes.Tasks) != 2 {
+		t.Fatalf("Changes since %s: %+v", feed.SyncToken, changes.Tasks)
+	}
+	plants, passport := changes.Tasks[0], changes.Tasks[1]
+	if plants.Title != "water plants" || plants.Status != TaskClosed || plants.CompletedBy != "T3" || plants.Completed == nil {
+		t.Errorf("Task closed by title %+v", plants)
+	}
+	if passport.Status != TaskOpen || passport.Completed != nil || passport.Revision <= plants.Revision {
+		t.Errorf("Task reopened by a reply %+v", passport)
+	}
+
+	if _, none := getTaskFeed(t, "since="+changes.SyncToken, ""); len(none.Tasks) != 0 || none.SyncToken != changes.SyncToken {
+		t.Errorf("Feed after the last change %+v", none)
+	}
+	if _, open := getTaskFeed(t, "status=open&limit=1", ""); len(open.Tasks) != 1 || open.Tasks[0].Title != "renew passport" || open.HasMore {
+		t.Errorf("Open tasks %+v", open)
+	}
+}
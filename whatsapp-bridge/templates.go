@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// A {{variable}} in a message template
+var templateVarRe = regexp.MustCompile(`{{\s*([A-Za-z0-9_]+)\s*}}`)
+
+// Valid names of custom contact attributes
+var attributeKeyRe = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// Variables filled in from the contact itself, which custom attributes can't shadow
+var builtinTemplateVars = []string{"first_name", "full_name", "name", "phone", "last_seen"}
+
+// Get the custom attributes of a contact
+func (store *MessageStore) GetContactAttributes(jid string) (map[string]string, error) {
+	rows, err := store.db.Query("SELECT key, value FROM contact_attributes WHERE jid = ?", jid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	attributes := map[string]string{}
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return nil, err
+		}
+		attributes[key] = value
+	}
+	return attributes, rows.Err()
+}
+
+// Set custom attributes of a contact, an empty value removes the attribute
+func (store *MessageStore) SetContactAttributes(jid string, attributes map[string]string) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	now := time.Now()
+	for key, value := range attributes {
+		if value == "" {
+			_, err = tx.Exec("DELETE FROM contact_attributes WHERE jid = ? AND key = ?", jid, key)
+		} else {
+			_, err = tx.Exec(
+				"INSERT OR REPLACE INTO contact_attributes (jid, key, value, updated_at) VALUES (?, ?, ?, ?)",
+				jid, key, value, now,
+			)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Get the values of the template variables for a recipient. The contact may
+// be stored under their phone number or their LID.
+func (store *MessageStore) templateValues(jid types.JID) (map[string]string, error) {
+	values := map[string]string{}
+	if jid.Server == types.GroupServer {
+		return values, nil
+	}
+	jid = jid.ToNonAD()
+
+	// Their contact and attributes may be stored under either JID, the phone
+	// number's win
+	phone := store.PhoneJID(jid)
+	if phone.Server == types.DefaultUserServer {
+		values["phone"] = "+" + phone.User
+	}
+	for _, candidate := range []types.JID{phone, jid} {
+		if contact, err := store.GetContact(candidate.String()); err == nil && values["name"] == "" {
+			values["name"] = contact.Name
+			values["full_name"] = contact.FullName
+			values["first_name"] = contact.FirstName
+			if values["first_name"] == "" {
+				if fields := strings.Fields(contact.Name); len(fields) > 0 {
+					values["first_name"] = fields[0]
+				}
+			}
+		}
+		attributes, err := store.GetContactAttributes(candidate.String())
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range attributes {
+			if _, set := values[key]; !set {
+				values[key] = value
+			}
+		}
+	}
+
+	// The last time they wrote, WhatsApp's own last seen isn't stored
+	aliases, err := store.SenderAliases(jid.String())
+	if err != nil {
+		return nil, err
+	}
+	var lastSeen time.Time
+	args := make([]interface{}, len(aliases))
+	for i, alias := range aliases {
+		args[i] = alias
+	}
+	rows, err := store.db.Query(
+		"SELECT timestamp FROM messages WHERE COALESCE(is_from_me, 0) = 0 AND sender IN (?"+strings.Repeat(", ?", len(aliases)-1)+") ORDER BY timestamp DESC LIMIT 1",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if rows.Next() {
+		rows.Scan(&lastSeen)
+	}
+	rows.Close()
+	if !lastSeen.IsZero() {
+		values["last_seen"] = lastSeen.Local().Format("2006-01-02 15:04")
+	}
+	return values, nil
+}
+
+// Fill in the {{variables}} of a message for its recipient. Variables without
+// a value are an error rather than being left blank.
+func (store *MessageStore) renderMessageTemplate(recipient types.JID, text string) (string, error) {
+	values, err := store.templateValues(recipient)
+	if err != nil {
+		return "", newAPIError(ErrCodeInternal, "Failed to look up template variables: %v", err)
+	}
+	var unresolved []string
+	rendered := templateVarRe.ReplaceAllStringFunc(text, func(match string) string {
+		name := templateVarRe.FindStringSubmatch(match)[1]
+		if value := values[name]; value != "" {
+			return value
+		}
+		if !slices.Contains(unresolved, name) {
+			unresolved = append(unresolved, name)
+		}
+		return match
+	})
+	if len(unresolved) > 0 {
+		return "", &APIError{
+			Code:    ErrCodeInvalidRequest,
+			Message: fmt.Sprintf("Template variables without a value for %s: %s", recipient, strings.Join(unresolved, ", ")),
+			Details: map[string][]string{"unresolved": unresolved},
+		}
+	}
+	return rendered, nil
+}
+
+// ContactAttributesRequest represents the request body for setting contact attributes
+type ContactAttributesRequest struct {
+	Attributes map[string]string `json:"attributes"` // An empty value removes the attribute
+}
+
+// ContactAttributesResponse represents the response for the contact attributes API
+type ContactAttributesResponse struct {
+	Success    bool              `json:"success"`
+	JID        string            `json:"jid"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+// Register the REST handlers for the custom attributes of contacts
+func registerTemplateHandlers(messageStore *MessageStore) {
+	jidParam := apiParam{Name: "jid", In: "path", Description: "JID or phone number of the contact", Required: true}
+
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/contacts/{jid}/attributes",
+		Summary:  "Get the custom attributes of a contact, usable as {{variables}} in message templates",
+		Tag:      "contacts",
+		Scope:    ScopeReadMessages,
+		Params:   []apiParam{jidParam},
+		Response: ContactAttributesResponse{},
+	})
+	http.HandleFunc("GET /api/contacts/{jid}/attributes", func(w http.ResponseWriter, r *http.Request) {
+		jid, err := parseContactJID(r.PathValue("jid"))
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		attributes, err := messageStore.GetContactAttributes(jid.String())
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to get contact attributes: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, ContactAttributesResponse{Success: true, JID: jid.String(), Attributes: attributes})
+	})
+
+	documentAPI(apiOperation{
+		Method:   http.MethodPut,
+		Path:     "/api/contacts/{jid}/attributes",
+		Summary:  "Set custom attributes of a contact, an empty value removes one",
+		Tag:      "contacts",
+		Scope:    ScopeManageContacts,
+		Audit:    true,
+		Params:   []apiParam{jidParam},
+		Request:  ContactAttributesRequest{},
+		Response: ContactAttributesResponse{},
+	})
+	http.HandleFunc("PUT /api/contacts/{jid}/attributes", func(w http.ResponseWriter, r *http.Request) {
+		jid, err := parseContactJID(r.PathValue("jid"))
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		var req ContactAttributesRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		for key := range req.Attributes {
+			if !attributeKeyRe.MatchString(key) {
+				writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("Invalid attribute name %q, use lowercase letters, digits and underscores", key), nil)
+				return
+			}
+			if slices.Contains(builtinTemplateVars, key) {
+				writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("%s is filled in from the contact and can't be set", key), nil)
+				return
+			}
+		}
+		if err := messageStore.SetContactAttributes(jid.String(), req.Attributes); err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to set contact attributes: %v", err), nil)
+			return
+		}
+		attributes, _ := messageStore.GetContactAttributes(jid.String())
+		writeJSON(w, http.StatusOK, ContactAttributesResponse{Success: true, JID: jid.String(), Attributes: attributes})
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// Classes of WhatsApp calls sharing a rate limit
+const (
+	opSend     = "send"     // Messages and receipts
+	opMedia    = "media"    // Media uploads and downloads
+	opQuery    = "query"    // Group, contact and app state lookups
+	opAppState = "appstate" // App state patches like stars, mutes and contacts
+	opPresence = "presence" // Presence updates and subscriptions
+)
+
+// Bounds of the pause after WhatsApp reports a rate limit
+const (
+	minThrottleBackoff = 5 * time.Second
+	maxThrottleBackoff = 5 * time.Minute
+)
+
+// Default calls per minute and burst size of each class, overridden with
+// WHATSAPP_RATE_<CLASS> and WHATSAPP_RATE_<CLASS>_BURST; a rate of 0 disables the limit
+var throttleDefaults = map[string][2]int{
+	opSend:     {30, 5},
+	opMedia:    {30, 5},
+	opQuery:    {60, 10},
+	opAppState: {30, 5},
+	opPresence: {20, 5},
+}
+
+// throttleClass is a token bucket for one class of calls that pauses
+// altogether while WhatsApp is rate limiting it
+type throttleClass struct {
+	mu          sync.Mutex
+	perMinute   int
+	burst       int
+	tokens      float64
+	updated     time.Time
+	backoff     time.Duration
+	pausedUntil time.Time
+}
+
+// Rate limits of all call classes, created on first use
+var (
+	throttleMu      sync.Mutex
+	throttleClasses = make(map[string]*throttleClass)
+)
+
+// Get the rate limit of a class of calls
+func throttleFor(class string) *throttleClass {
+	throttleMu.Lock()
+	defer throttleMu.Unlock()
+	if c, ok := throttleClasses[class]; ok {
+		return c
+	}
+	defaults := throttleDefaults[class]
+	env := "WHATSAPP_RATE_" + strings.ToUpper(class)
+	c := &throttleClass{
+		perMinute: envInt(env, defaults[0]),
+		burst:     max(envInt(env+"_BURST", defaults[1]), 1),
+		updated:   time.Now(),
+	}
+	c.tokens = float64(c.burst)
+	throttleClasses[class] = c
+	return c
+}
+
+// Reserve the next call and return how long to wait before making it
+func (c *throttleClass) reserve() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	var delay time.Duration
+	if c.perMinute > 0 {
+		perSecond := float64(c.perMinute) / 60
+		c.tokens = math.Min(float64(c.burst), c.tokens+now.Sub(c.updated).Seconds()*perSecond)
+		c.updated = now
+		// Tokens go negative for calls queued behind others
+		c.tokens--
+		if c.tokens < 0 {
+			delay = time.Duration(-c.tokens / perSecond * float64(time.Second))
+		}
+	}
+	if pause := c.pausedUntil.Sub(now); pause > delay {
+		delay = pause
+	}
+	return delay
+}
+
+// Adapt to the outcome of a call: back off exponentially while WhatsApp rate
+// limits us, and recover gradually once calls succeed again
+func (c *throttleClass) report(class string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if isRateLimitError(err) {
+		c.backoff = max(2*c.backoff, minThrottleBackoff)
+		if c.backoff > maxThrottleBackoff {
+			c.backoff = maxThrottleBackoff
+		}
+		c.pausedUntil = time.Now().Add(c.backoff)
+		bridgeLog.Infof("WhatsApp rate limited %s calls, pausing them for %s", class, c.backoff)
+		return
+	}
+	if err == nil && c.backoff > 0 {
+		c.backoff /= 2
+		if c.backoff < minThrottleBackoff {
+			c.backoff = 0
+		}
+	}
+}
+
+// Whether WhatsApp rejected a call for being made too often
+func isRateLimitError(err error) bool {
+	if err == nil {
+		return false
+	}
+	var iqErr *whatsmeow.IQError
+	if errors.As(err, &iqErr) && (iqErr.Code == 429 || iqErr.Code == 419) {
+		return true
+	}
+	return strings.Contains(err.Error(), "rate-overlimit")
+}
+
+// Make a WhatsApp call under the rate limit of its class
+func throttle(class string, call func() error) error {
+	c := throttleFor(class)
+	if delay := c.reserve(); delay > 0 {
+		time.Sleep(delay)
+	}
+	err := call()
+	c.report(class, err)
+	return err
+}
+
+// ThrottleStatus is the state of the rate limit of a class of calls
+type ThrottleStatus struct {
+	Class       string     `json:"class"`
+	PerMinute   int        `json:"per_minute"`
+	Burst       int        `json:"burst"`
+	Backoff     string     `json:"backoff,omitempty"`
+	PausedUntil *time.Time `json:"paused_until,omitempty"`
+}
+
+// ThrottleStatusResponse represents the response for the rate limit status API
+type ThrottleStatusResponse struct {
+	Success bool             `json:"success"`
+	Classes []ThrottleStatus `json:"classes"`
+}
+
+// Register the REST handler reporting the rate limits
+func registerThrottleHandlers() {
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/throttle",
+		Summary:  "Get the rate limit of each class of WhatsApp calls and any backoff in effect",
+		Tag:      "admin",
+		Scope:    ScopeAdmin,
+		Response: ThrottleStatusResponse{},
+	})
+	http.HandleFunc("GET /api/throttle", func(w http.ResponseWriter, r *http.Request) {
+		classes := []ThrottleStatus{}
+		for _, class := range []string{opSend, opMedia, opQuery, opAppState, opPresence} {
+			c := throttleFor(class)
+			c.mu.Lock()
+			status := ThrottleStatus{Class: class, PerMinute: c.perMinute, Burst: c.burst}
+			if c.backoff > 0 {
+				status.Backoff = c.backoff.String()
+			}
+			if time.Now().Before(c.pausedUntil) {
+				pausedUntil := c.pausedUntil
+				status.PausedUntil = &pausedUntil
+			}
+			c.mu.Unlock()
+			classes = append(classes, status)
+		}
+		writeJSON(w, http.StatusOK, ThrottleStatusResponse{Success: true, Classes: classes})
+	})
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Kinds of WhatsApp calls, each limited by its own WHATSAPP_<KIND>_TIMEOUT_SECONDS
+const (
+	callQuery = "query" // Info queries, presence and app state
+	callSend  = "send"  // Sending messages
+	callMedia = "media" // Uploading and downloading media
+)
+
+// Default time limit in seconds of every kind of call
+var callTimeoutDefaults = map[string]int{
+	callQuery: 30,
+	callSend:  60,
+	callMedia: 300,
+}
+
+// Get how long a kind of WhatsApp call may take
+func callTimeout(kind string) time.Duration {
+	seconds := envInt("WHATSAPP_"+strings.ToUpper(kind)+"_TIMEOUT_SECONDS", callTimeoutDefaults[kind])
+	return time.Duration(max(seconds, 1)) * time.Second
+}
+
+// Derive the context of a WhatsApp call from the request or job making it, so
+// the call gives up once it takes too long or the client goes away
+func callContext(parent context.Context, kind string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, callTimeout(kind))
+}
+
+// Create an APIError for a failed WhatsApp call, reporting calls that ran out
+// of time as timeouts rather than with the given code
+func newCallError(code ErrorCode, err error, format string, args ...interface{}) *APIError {
+	if errors.Is(err, context.DeadlineExceeded) {
+		code = ErrCodeTimeout
+	}
+	return newAPIError(code, format, args...)
+}
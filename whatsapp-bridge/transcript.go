@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Defaults of the transcript chunking
+const (
+	defaultTranscriptChars   = 4000
+	defaultTranscriptOverlap = 2
+	charsPerToken            = 4 // Rough average for English text, used to turn a token budget into characters
+)
+
+// TranscriptChunk is a run of consecutive messages rendered as text, within the character budget
+type TranscriptChunk struct {
+	Index           int       `json:"index"`
+	Text            string    `json:"text"`
+	Chars           int       `json:"chars"`
+	EstimatedTokens int       `json:"estimated_tokens"`
+	Messages        int       `json:"messages"`
+	FirstMessageID  string    `json:"first_message_id"`
+	LastMessageID   string    `json:"last_message_id"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+}
+
+// A message rendered for a transcript
+type transcriptBlock struct {
+	msg  Message
+	text string
+}
+
+// Resolves sender names for a transcript, looking each sender up once
+type senderNames struct {
+	store *MessageStore
+	names map[string]string
+}
+
+// Get the display name of the sender of a message
+func (n *senderNames) name(msg Message) string {
+	if msg.IsFromMe {
+		return "Me"
+	}
+	id := msg.SenderID
+	if id == "" {
+		id = msg.Sender
+	}
+	if name, ok := n.names[id]; ok {
+		return name
+	}
+	name := id
+	if contact, err := n.store.GetContact(types.NewJID(id, types.DefaultUserServer).String()); err == nil && contact.Name != "" {
+		name = contact.Name
+	}
+	n.names[id] = name
+	return name
+}
+
+// Render a message as a "Name [time]: text" block
+func renderTranscriptBlock(msg Message, name string) string {
+	text := strings.TrimSpace(msg.Content)
+	if msg.MediaType != "" {
+		media := "[" + msg.MediaType
+		if msg.Filename != "" {
+			media += ": " + msg.Filename
+		}
+		media += "]"
+		text = strings.TrimSpace(media + " " + text)
+	}
+	return fmt.Sprintf("%s [%s]: %s", name, msg.Time.Local().Format("2006-01-02 15:04"), text)
+}
+
+// Split a block longer than the budget into pieces that fit, on rune boundaries
+func splitBlock(text string, maxChars int) []string {
+	var pieces []string
+	for utf8.RuneCountInString(text) > maxChars {
+		cut := 0
+		for i := 0; i < maxChars; i++ {
+			_, size := utf8.DecodeRuneInString(text[cut:])
+			cut += size
+		}
+		pieces = append(pieces, text[:cut])
+		text = text[cut:]
+	}
+	return append(pieces, text)
+}
+
+// Group rendered messages into chunks of at most maxChars characters, each
+// starting with the last overlap messages of the previous chunk so a model
+// reading one chunk keeps some context
+func chunkTranscript(blocks []transcriptBlock, maxChars, overlap int) []TranscriptChunk {
+	// Blocks that can't fit a chunk on their own are split first
+	var fitted []transcriptBlock
+	for _, b := range blocks {
+		for _, piece := range splitBlock(b.text, maxChars) {
+			fitted = append(fitted, transcriptBlock{msg: b.msg, text: piece})
+		}
+	}
+
+	chunks := []TranscriptChunk{}
+	start := 0
+	for start < len(fitted) {
+		end, chars := start, 0
+		for end < len(fitted) {
+			size := utf8.RuneCountInString(fitted[end].text)
+			if end > start {
+				size++ // Newline separating blocks
+			}
+			if end > start && chars+size > maxChars {
+				break
+			}
+			chars += size
+			end++
+		}
+
+		var texts []string
+		for _, b := range fitted[start:end] {
+			texts = append(texts, b.text)
+		}
+		first, last := fitted[start].msg, fitted[end-1].msg
+		chunks = append(chunks, TranscriptChunk{
+			Index:           len(chunks),
+			Text:            strings.Join(texts, "\n"),
+			Chars:           chars,
+			EstimatedTokens: (chars + charsPerToken - 1) / charsPerToken,
+			Messages:        end - start,
+			FirstMessageID:  first.ID,
+			LastMessageID:   last.ID,
+			Start:           first.Time,
+			End:             last.Time,
+		})
+		if end == len(fitted) {
+			break
+		}
+		// Always move forward, even when the overlap covers the whole chunk
+		start = max(end-overlap, start+1)
+	}
+	return chunks
+}
+
+// Parse an optional non-negative integer query parameter
+func parseCountParam(r *http.Request, name string, def int) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, newAPIError(ErrCodeInvalidRequest, "%s must be a non-negative integer", name)
+	}
+	return n, nil
+}
+
+// TranscriptResponse represents the response for the transcript API
+type TranscriptResponse struct {
+	Success  bool              `json:"success"`
+	ChatJID  string            `json:"chat_jid"`
+	ChatName string            `json:"chat_name"`
+	Messages int               `json:"messages"`
+	MaxChars int               `json:"max_chars"`
+	Overlap  int               `json:"overlap"`
+	Chunks   []TranscriptChunk `json:"chunks"`
+}
+
+// Register the REST handler exporting a chat as transcript chunks
+func registerTranscriptHandlers(messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:  http.MethodGet,
+		Path:    "/api/chats/{jid}/transcript",
+		Summary: "Render the messages of a chat as \"Name [time]: text\" lines, oldest first, in chunks that fit a character or token budget",
+		Tag:     "chats",
+		Scope:   ScopeReadMessages,
+		Params: []apiParam{
+			{Name: "jid", In: "path", Description: "Chat JID", Required: true},
+			{Name: "max_chars", Description: "Maximum characters per chunk (default 4000)", Type: "integer"},
+			{Name: "max_tokens", Description: "Maximum estimated tokens per chunk, at 4 characters per token, instead of max_chars", Type: "integer"},
+			{Name: "overlap", Description: "Number of messages repeated at the start of the next chunk (default 2)", Type: "integer"},
+			{Name: "after_time", Description: "Only messages after this time" + timeFormatsHint},
+			{Name: "before_time", Description: "Only messages before this time" + timeFormatsHint},
+			{Name: "limit", Description: "Maximum number of messages, the most recent ones", Type: "integer"},
+			{Name: "offset", Description: "Number of most recent messages to skip", Type: "integer"},
+		},
+		Response: TranscriptResponse{},
+	})
+	http.HandleFunc("GET /api/chats/{jid}/transcript", func(w http.ResponseWriter, r *http.Request) {
+		f, err := parseMessageFilter(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		f.ChatJID = r.PathValue("jid")
+		if f.Revoked == "" {
+			f.Revoked = revokedExclude
+		}
+		maxChars, err := parseCountParam(r, "max_chars", defaultTranscriptChars)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		if r.URL.Query().Get("max_tokens") != "" {
+			tokens, err := parseCountParam(r, "max_tokens", 0)
+			if err != nil {
+				writeAPIError(w, "", err)
+				return
+			}
+			maxChars = tokens * charsPerToken
+		}
+		if maxChars == 0 {
+			writeError(w, ErrCodeInvalidRequest, "The chunk budget must be positive", nil)
+			return
+		}
+		overlap, err := parseCountParam(r, "overlap", defaultTranscriptOverlap)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+
+		messages, err := messageStore.QueryMessages(f)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to load messages: %v", err), nil)
+			return
+		}
+		slices.Reverse(messages)
+
+		names := &senderNames{store: messageStore, names: map[string]string{}}
+		blocks := make([]transcriptBlock, 0, len(messages))
+		for _, msg := range messages {
+			blocks = append(blocks, transcriptBlock{msg: msg, text: renderTranscriptBlock(msg, names.name(msg))})
+		}
+
+		writeJSON(w, http.StatusOK, TranscriptResponse{
+			Success:  true,
+			ChatJID:  f.ChatJID,
+			ChatName: messageStore.chatName(f.ChatJID),
+			Messages: len(messages),
+			MaxChars: maxChars,
+			Overlap:  overlap,
+			Chunks:   chunkTranscript(blocks, maxChars, overlap),
+		})
+	})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Translation engines
+const (
+	translateEngineLibre  = "libretranslate"
+	translateEngineOpenAI = "openai"
+)
+
+// Limits of a translation request
+const (
+	defaultTranslateCount = 50
+	maxTranslateCount     = 200
+)
+
+// Language codes accepted as translation targets, like en, pt-BR or zh-Hans
+var languageCodeRe = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z]{2,4})?$`)
+
+// Client for the translation backend
+var translateClient = &http.Client{Timeout: 60 * time.Second}
+
+// translateConfig is where message text is sent to be translated: a
+// LibreTranslate server, or any OpenAI compatible chat completions endpoint
+type translateConfig struct {
+	Engine string
+	URL    string
+	APIKey string
+	Model  string
+}
+
+// Get the translation settings, ok is false if no backend is configured
+func loadTranslateConfig() (translateConfig, bool) {
+	cfg := translateConfig{
+		Engine: envString("WHATSAPP_TRANSLATE_ENGINE", translateEngineLibre),
+		URL:    envString("WHATSAPP_TRANSLATE_URL", ""),
+		APIKey: envString("WHATSAPP_TRANSLATE_API_KEY", ""),
+		Model:  envString("WHATSAPP_TRANSLATE_MODEL", "gpt-4o-mini"),
+	}
+	return cfg, cfg.URL != "" && (cfg.Engine == translateEngineLibre || cfg.Engine == translateEngineOpenAI)
+}
+
+// Post a JSON request to the translation backend and decode its answer
+func postTranslation(cfg translateConfig, payload, result interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid translation URL: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "whatsapp-bridge")
+	if cfg.APIKey != "" && cfg.Engine == translateEngineOpenAI {
+		req.Header.Set("Authorization", "Bearer "+cfg.APIKey)
+	}
+
+	resp, err := translateClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("translation backend returned HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("invalid translation response: %v", err)
+	}
+	return nil
+}
+
+// Translate a text into the target language, returning the translation and
+// the detected source language when the backend reports it
+func translateText(cfg translateConfig, text, target string) (translated, source string, err error) {
+	if cfg.Engine == translateEngineOpenAI {
+		var result struct {
+			Choices []struct {
+				Message struct {
+					Content string `json:"content"`
+				} `json:"message"`
+			} `json:"choices"`
+		}
+		err := postTranslation(cfg, map[string]interface{}{
+			"model":       cfg.Model,
+			"temperature": 0,
+			"messages": []map[string]string{
+				{"role": "system", "content": fmt.Sprintf("Translate the user's chat message into the language with code %s. Answer with the translation only, keeping emoji, names and formatting.", target)},
+				{"role": "user", "content": text},
+			},
+		}, &result)
+		if err != nil {
+			return "", "", err
+		}
+		if len(result.Choices) == 0 {
+			return "", "", fmt.Errorf("translation backend returned no choices")
+		}
+		return strings.TrimSpace(result.Choices[0].Message.Content), "", nil
+	}
+
+	payload := map[string]string{"q": text, "source": "auto", "target": target, "format": "text"}
+	if cfg.APIKey != "" {
+		payload["api_key"] = cfg.APIKey
+	}
+	var result struct {
+		TranslatedText   string `json:"translatedText"`
+		DetectedLanguage struct {
+			Language string `json:"language"`
+		} `json:"detectedLanguage"`
+	}
+	if err := postTranslation(cfg, payload, &result); err != nil {
+		return "", "", err
+	}
+	return result.TranslatedText, result.DetectedLanguage.Language, nil
+}
+
+// Translation is a message translated into a language
+type Translation struct {
+	Text           string    `json:"text"`
+	SourceLanguage string    `json:"source_language,omitempty"`
+	TranslatedAt   time.Time `json:"translated_at"`
+	Cached         bool      `json:"cached,omitempty"`  // Translated by an earlier request
+	Skipped        bool      `json:"skipped,omitempty"` // Already in the target language, not sent to the backend
+}
+
+// Get the cached translation of a message, nil if there is none or the
+// message changed since it was translated
+func (store *MessageStore) cachedTranslation(msg Message, target string) *Translation {
+	var t Translation
+	err := store.db.QueryRow(
+		`SELECT text, COALESCE(source_language, ''), translated_at FROM message_translations
+		WHERE message_id = ? AND chat_jid = ? AND target_language = ? AND source_text = ?`,
+		msg.ID, msg.ChatJID, target, msg.Content,
+	).Scan(&t.Text, &t.SourceLanguage, &t.TranslatedAt)
+	if err != nil {
+		return nil
+	}
+	t.Cached = true
+	return &t
+}
+
+// Cache the translation of a message
+func (store *MessageStore) storeTranslation(msg Message, target string, t Translation) error {
+	_, err := store.db.Exec(
+		`INSERT OR REPLACE INTO message_translations (message_id, chat_jid, target_language, source_text, source_language, text, translated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		msg.ID, msg.ChatJID, target, msg.Content, t.SourceLanguage, t.Text, t.TranslatedAt,
+	)
+	return err
+}
+
+// Translate a message, from the cache unless refresh is set
+func (store *MessageStore) TranslateMessage(cfg translateConfig, msg Message, target string, refresh bool) (*Translation, error) {
+	// Compare the base languages, pt-BR content is already in pt
+	base := strings.SplitN(target, "-", 2)[0]
+	if msg.Language == base {
+		return &Translation{Text: msg.Content, SourceLanguage: msg.Language, TranslatedAt: time.Now(), Skipped: true}, nil
+	}
+	if !refresh {
+		if t := store.cachedTranslation(msg, target); t != nil {
+			return t, nil
+		}
+	}
+	text, source, err := translateText(cfg, msg.Content, target)
+	if err != nil {
+		return nil, err
+	}
+	if source == "" {
+		source = msg.Language
+	}
+	t := Translation{Text: text, SourceLanguage: source, TranslatedAt: time.Now()}
+	if err := store.storeTranslation(msg, target, t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// TranslateRequest represents the request body for the translation API
+type TranslateRequest struct {
+	ChatJID        string   `json:"chat_jid"`
+	TargetLanguage string   `json:"target_language"`       // Code like en, it or pt-BR
+	MessageIDs     []string `json:"message_ids,omitempty"` // Translate these messages; the latest messages of the chat otherwise
+	Count          int      `json:"count,omitempty"`       // How many of the latest messages to translate, 50 by default
+	BeforeTime     string   `json:"before_time,omitempty"` // Only messages before this time, to page back through the chat
+	Refresh        bool     `json:"refresh,omitempty"`     // Translate again instead of using cached translations
+}
+
+// TranslatedMessage is a message with its translation
+type TranslatedMessage struct {
+	Message
+	Translation *Translation `json:"translation,omitempty"`
+	Error       string       `json:"error,omitempty"` // Why the message couldn't be translated
+}
+
+// TranslateResponse represents the response for the translation API
+type TranslateResponse struct {
+	Success        bool                `json:"success"`
+	ChatJID        string              `json:"chat_jid"`
+	TargetLanguage string              `json:"target_language"`
+	Messages       []TranslatedMessage `json:"messages"` // Oldest first, as a conversation
+	Translated     int                 `json:"translated"`
+	Cached         int                 `json:"cached"`
+	Failed         int                 `json:"failed"`
+}
+
+// Register the REST handler translating stored messages
+func registerTranslateHandlers(messageStore *MessageStore) {
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/messages/translate",
+		Summary:  "Translate messages of a chat into a language with the configured translation backend, caching translations per message and language; returns the conversation oldest first",
+		Tag:      "messages",
+		Scope:    ScopeReadMessages,
+		Request:  TranslateRequest{},
+		Response: TranslateResponse{},
+	})
+	http.HandleFunc("POST /api/messages/translate", func(w http.ResponseWriter, r *http.Request) {
+		var req TranslateRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		if req.ChatJID == "" {
+			writeError(w, ErrCodeInvalidRequest, "chat_jid is required", nil)
+			return
+		}
+		if !languageCodeRe.MatchString(req.TargetLanguage) {
+			writeError(w, ErrCodeInvalidRequest, "target_language must be a language code like en, it or pt-BR", nil)
+			return
+		}
+		if req.Count <= 0 {
+			req.Count = defaultTranslateCount
+		}
+		if req.Count > maxTranslateCount || len(req.MessageIDs) > maxTranslateCount {
+			writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("At most %d messages can be translated at once", maxTranslateCount), nil)
+			return
+		}
+		cfg, ok := loadTranslateConfig()
+		if !ok {
+			writeError(w, ErrCodeInvalidRequest, "No translation backend is configured, set WHATSAPP_TRANSLATE_URL", nil)
+			return
+		}
+
+		filter := MessageFilter{ChatJID: req.ChatJID, IDs: req.MessageIDs, Limit: req.Count}
+		if len(req.MessageIDs) > 0 {
+			filter.Limit = len(req.MessageIDs)
+		}
+		if req.BeforeTime != "" {
+			before, err := parseTimeField("before_time", req.BeforeTime)
+			if err != nil {
+				writeAPIError(w, "", err)
+				return
+			}
+			filter.Before = before
+		}
+		messages, err := messageStore.QueryMessages(filter)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to load messages: %v", err), nil)
+			return
+		}
+		slices.Reverse(messages)
+
+		resp := TranslateResponse{Success: true, ChatJID: req.ChatJID, TargetLanguage: req.TargetLanguage, Messages: []TranslatedMessage{}}
+		for _, msg := range messages {
+			out := TranslatedMessage{Message: msg}
+			if msg.Content != "" {
+				t, err := messageStore.TranslateMessage(cfg, msg, req.TargetLanguage, req.Refresh)
+				switch {
+				case err != nil:
+					out.Error = err.Error()
+					resp.Failed++
+				case t.Cached:
+					resp.Cached++
+				case !t.Skipped:
+					resp.Translated++
+				}
+				out.Translation = t
+			}
+			resp.Messages = append(resp.Messages, out)
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
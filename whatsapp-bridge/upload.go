@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Defaults of the media upload settings
+const (
+	defaultUploadMaxBytes   = 100 << 20
+	defaultUploadTTLMinutes = 24 * 60
+)
+
+// How often expired uploads are removed
+const uploadCleanupInterval = 10 * time.Minute
+
+// Media tokens are random hex strings naming a directory under the uploads directory
+var mediaTokenRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Characters replaced in uploaded file names
+var unsafeFilenameRe = regexp.MustCompile(`[^\pL\pN._ -]+`)
+
+// Directory holding uploaded media until it is sent or expires
+func uploadsDir() string {
+	return filepath.Join(storeDir(), "uploads")
+}
+
+// How long uploaded media is kept after its upload or last use
+func uploadTTL() time.Duration {
+	return time.Duration(max(envInt("WHATSAPP_UPLOAD_TTL_MINUTES", defaultUploadTTLMinutes), 1)) * time.Minute
+}
+
+// Make an uploaded file name safe to store, keeping its extension since the
+// media type is told by it when sending
+func sanitizeUploadFilename(name string) string {
+	// Browsers on Windows may send the full path
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Trim(unsafeFilenameRe.ReplaceAllString(name, "_"), " .")
+	if name == "" || name == "_" {
+		return "upload"
+	}
+	if len(name) > 200 {
+		ext := filepath.Ext(name)
+		if len(ext) > 20 {
+			ext = ""
+		}
+		name = name[:200-len(ext)] + ext
+	}
+	return name
+}
+
+// Get the path of the file uploaded with a media token, marking it used so
+// it isn't removed while the message is sent
+func resolveMediaToken(token string) (string, error) {
+	if !mediaTokenRe.MatchString(token) {
+		return "", newAPIError(ErrCodeInvalidRequest, "Invalid media token")
+	}
+	dir := filepath.Join(uploadsDir(), token)
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 1 || !entries[0].Type().IsRegular() {
+		return "", newAPIError(ErrCodeNotFound, "Unknown or expired media token")
+	}
+	now := time.Now()
+	os.Chtimes(dir, now, now)
+	return filepath.Join(dir, entries[0].Name()), nil
+}
+
+// Create the directory of a new media token
+func newUploadDir() (token, dir string, err error) {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", err
+	}
+	token = hex.EncodeToString(raw)
+	dir = filepath.Join(uploadsDir(), token)
+	return token, dir, os.MkdirAll(dir, 0700)
+}
+
+// Save the file part of a multipart upload under a new media token
+func saveUpload(r *http.Request) (*UploadMediaResponse, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, newAPIError(ErrCodeInvalidRequest, "Expected a multipart/form-data body: %v", err)
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, newAPIError(ErrCodeInvalidRequest, "The form has no file field")
+		}
+		if err != nil {
+			return nil, uploadReadError(err)
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		token, dir, err := newUploadDir()
+		if err != nil {
+			return nil, err
+		}
+		filename := sanitizeUploadFilename(part.FileName())
+		path := filepath.Join(dir, filename)
+
+		size, sniffed, err := writeUpload(path, part)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, uploadReadError(err)
+		}
+		if size == 0 {
+			os.RemoveAll(dir)
+			return nil, newAPIError(ErrCodeInvalidRequest, "The uploaded file is empty")
+		}
+
+		mimeType := mime.TypeByExtension(filepath.Ext(filename))
+		if mimeType == "" {
+			mimeType = sniffed
+		}
+		return &UploadMediaResponse{
+			Success:    true,
+			MediaToken: token,
+			Filename:   filename,
+			Size:       size,
+			MimeType:   mimeType,
+			ExpiresAt:  time.Now().Add(uploadTTL()),
+		}, nil
+	}
+}
+
+// Write an uploaded file, returning its size and sniffed content type
+func writeUpload(path string, src io.Reader) (int64, string, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(src, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return 0, "", err
+	}
+	head = head[:n]
+	if _, err := f.Write(head); err != nil {
+		return 0, "", err
+	}
+	rest, err := io.Copy(f, src)
+	if err != nil {
+		return 0, "", err
+	}
+	return int64(n) + rest, http.DetectContentType(head), f.Close()
+}
+
+// Report a failed upload read, telling apart bodies over the size limit
+func uploadReadError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return newAPIError(ErrCodePayloadTooLarge, "Upload is larger than %d bytes", tooLarge.Limit)
+	}
+	return newAPIError(ErrCodeInvalidRequest, "Failed to read the upload: %v", err)
+}
+
+// Remove uploads unused for longer than the TTL, keeping those of messages
+// still waiting in the outbox
+func (store *MessageStore) cleanupUploads() error {
+	entries, err := os.ReadDir(uploadsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	queued := map[string]bool{}
+	rows, err := store.db.Query(
+		"SELECT media_path FROM outbox WHERE status IN (?, ?, ?, ?) AND COALESCE(media_path, '') != ''",
+		OutboxPending, OutboxApproved, OutboxWaiting, OutboxRetry,
+	)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			rows.Close()
+			return err
+		}
+		queued[filepath.Dir(path)] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-uploadTTL())
+	removed := 0
+	for _, entry := range entries {
+		dir := filepath.Join(uploadsDir(), entry.Name())
+		info, err := entry.Info()
+		if err != nil || info.ModTime().After(cutoff) || queued[dir] {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			bridgeLog.Warnf("Failed to remove expired upload %s: %v", entry.Name(), err)
+			continue
+		}
+		removed++
+	}
+	if removed > 0 {
+		bridgeLog.Infof("Removed %d expired uploads", removed)
+	}
+	return nil
+}
+
+// Periodically remove expired uploads
+func runUploadCleanup(messageStore *MessageStore) {
+	ticker := time.NewTicker(uploadCleanupInterval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		func() {
+			defer recoverPanic("cleaning up uploads")
+			if err := messageStore.cleanupUploads(); err != nil {
+				bridgeLog.Warnf("Failed to clean up uploads: %v", err)
+			}
+		}()
+	}
+}
+
+// UploadMediaResponse represents the response for the media upload API
+type UploadMediaResponse struct {
+	Success    bool      `json:"success"`
+	MediaToken string    `json:"media_token"` // Pass as media_token to /api/send
+	Filename   string    `json:"filename"`
+	Size       int64     `json:"size"`
+	MimeType   string    `json:"mime_type"`
+	ExpiresAt  time.Time `json:"expires_at"` // Removed after this unless used, each use extends it
+}
+
+// Register the REST handler uploading media to send
+func registerUploadHandlers() {
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/media/upload",
+		Summary:  fmt.Sprintf("Upload a file to send, as the file field of a multipart/form-data body; returns a media token to pass as media_token to /api/send. Limited to WHATSAPP_UPLOAD_MAX_BYTES (%d MB by default)", defaultUploadMaxBytes>>20),
+		Tag:      "media",
+		Scope:    ScopeSendMessages,
+		MaxBody:  int64(envInt("WHATSAPP_UPLOAD_MAX_BYTES", defaultUploadMaxBytes)),
+		Response: UploadMediaResponse{},
+	})
+	http.HandleFunc("POST /api/media/upload", func(w http.ResponseWriter, r *http.Request) {
+		resp, err := saveUpload(r)
+		if err != nil {
+			writeAPIError(w, "Failed to upload media", err)
+			return
+		}
+		bridgeLog.Infof("Received upload %s (%d bytes)", resp.Filename, resp.Size)
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
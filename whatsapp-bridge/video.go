@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/jpeg"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default command printing the duration and size of a video as JSON,
+// {input} is replaced with the file path
+const defaultVideoProbeCommand = "ffprobe -v error -select_streams v:0 -show_entries format=duration:stream=width,height -of json {input}"
+
+// Default command writing a frame of a video to a JPEG file, {input},
+// {output} and {seconds} are replaced with the file paths and the time of the frame
+const defaultVideoFrameCommand = "ffmpeg -y -loglevel error -ss {seconds} -i {input} -frames:v 1 {output}"
+
+// Run a media tool from a command template setting, replacing {name}
+// placeholders in its arguments, and return what it printed
+func runCommandTemplate(setting, template string, vars map[string]string, timeout time.Duration) ([]byte, error) {
+	args := strings.Fields(envString(setting, template))
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s is empty", setting)
+	}
+	for i := range args {
+		for name, value := range vars {
+			args[i] = strings.ReplaceAll(args[i], "{"+name+"}", value)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s failed: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// Probe the duration and size of a video
+func probeVideo(path string) (seconds float64, width, height uint32, err error) {
+	out, err := runCommandTemplate("WHATSAPP_VIDEO_PROBE_COMMAND", defaultVideoProbeCommand, map[string]string{"input": path}, 30*time.Second)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	var probe struct {
+		Streams []struct {
+			Width  uint32 `json:"width"`
+			Height uint32 `json:"height"`
+		} `json:"streams"`
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid probe output: %v", err)
+	}
+	seconds, _ = strconv.ParseFloat(probe.Format.Duration, 64)
+	if len(probe.Streams) > 0 {
+		width, height = probe.Streams[0].Width, probe.Streams[0].Height
+	}
+	return seconds, width, height, nil
+}
+
+// Grab a frame of a video as a JPEG thumbnail
+func videoThumbnail(path string, at float64) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "video")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "frame.jpg")
+	vars := map[string]string{"input": path, "output": output, "seconds": strconv.FormatFloat(at, 'f', 2, 64)}
+	if _, err := runCommandTemplate("WHATSAPP_VIDEO_FRAME_COMMAND", defaultVideoFrameCommand, vars, time.Minute); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(output)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	frame, err := jpeg.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid frame: %v", err)
+	}
+	return jpegThumbnail(frame, videoThumbnailSize)
+}
+
+// Fill in the duration, size and thumbnail of a video message, so recipients
+// see a preview before downloading it. A video that can't be probed is sent
+// without them.
+func prepareVideo(out *outgoingMessage) {
+	seconds, width, height, err := probeVideo(out.MediaPath)
+	if err != nil {
+		bridgeLog.Warnf("Failed to probe video %s: %v", filepath.Base(out.MediaPath), err)
+		return
+	}
+	out.Seconds = uint32(math.Round(seconds))
+	out.Width, out.Height = width, height
+
+	// A frame a second in is less likely to be black than the first one
+	thumbnail, err := videoThumbnail(out.MediaPath, math.Min(1, seconds/2))
+	if err != nil {
+		bridgeLog.Warnf("Failed to make a thumbnail of video %s: %v", filepath.Base(out.MediaPath), err)
+		return
+	}
+	out.Thumbnail = thumbnail
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Flag a stored message as view-once media
+func (store *MessageStore) MarkViewOnce(messageID, chatJID string) error {
+	_, err := store.db.Exec("UPDATE messages SET is_view_once = 1 WHERE id = ? AND chat_jid = ?", messageID, chatJID)
+	return err
+}
+
+// Whether a stored message is view-once media
+func (store *MessageStore) IsViewOnce(messageID, chatJID string) (bool, error) {
+	var viewOnce bool
+	err := store.db.QueryRow(
+		"SELECT COALESCE(is_view_once, 0) FROM messages WHERE id = ? AND chat_jid = ?",
+		messageID, chatJID,
+	).Scan(&viewOnce)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return viewOnce, err
+}
+
+// Refuse to hand out view-once media unless the caller explicitly asked for it.
+// The sender expects it to be seen once, so it stays out of reach by default.
+func checkViewOnceAccess(messageStore *MessageStore, messageID, chatJID string, allow bool) error {
+	viewOnce, err := messageStore.IsViewOnce(messageID, chatJID)
+	if err != nil {
+		return err
+	}
+	if viewOnce && !allow {
+		return &APIError{
+			Code:    ErrCodeForbidden,
+			Message: fmt.Sprintf("message %s is view-once media, set allow_view_once to retrieve it", messageID),
+			Details: map[string]string{"message_id": messageID, "chat_jid": chatJID, "override": "allow_view_once"},
+		}
+	}
+	return nil
+}
+
+// Flag view-once media once stored and, if enabled, download it while the
+// sender's upload is still available
+func handleViewOnce(client *whatsmeow.Client, messageStore *MessageStore, msg *events.Message, mediaType string) {
+	if !msg.IsViewOnce || mediaType == "" {
+		return
+	}
+	chatJID := msg.Info.Chat.String()
+	if err := messageStore.MarkViewOnce(msg.Info.ID, chatJID); err != nil {
+		bridgeLog.Warnf("Failed to flag view-once message %s: %v", msg.Info.ID, err)
+		return
+	}
+
+	if !envBool("WHATSAPP_VIEW_ONCE_AUTO_DOWNLOAD", false) {
+		return
+	}
+	goSafe("downloading view-once media", func() {
+		if _, _, _, _, err := downloadMedia(context.Background(), client, messageStore, msg.Info.ID, chatJID); err != nil {
+			bridgeLog.Warnf("Failed to download view-once media of message %s: %v", msg.Info.ID, err)
+		}
+	})
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// Valid names of saved views, usable as they are in URLs
+var viewNameRe = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+
+// ViewFilter is a set of conditions on messages, all of which must hold
+type ViewFilter struct {
+	ChatJIDs  []string `json:"chat_jids,omitempty"` // Any of these chats
+	Sender    string   `json:"sender,omitempty"`
+	Query     string   `json:"query,omitempty"` // Case-insensitive text in the content
+	MediaType string   `json:"media_type,omitempty"`
+	HasMedia  bool     `json:"has_media,omitempty"`
+	Filename  string   `json:"filename,omitempty"` // Case-insensitive text in the file name
+	Starred   bool     `json:"starred,omitempty"`
+	Revoked   string   `json:"revoked,omitempty"` // include, exclude or only
+	Tag       string   `json:"tag,omitempty"`
+}
+
+// Turn view conditions into a filter for QueryMessages
+func (vf ViewFilter) toMessageFilter() MessageFilter {
+	return MessageFilter{
+		ChatJIDs:  vf.ChatJIDs,
+		Sender:    vf.Sender,
+		Query:     vf.Query,
+		MediaType: vf.MediaType,
+		HasMedia:  vf.HasMedia,
+		Filename:  vf.Filename,
+		Starred:   vf.Starred,
+		Revoked:   vf.Revoked,
+		Tag:       vf.Tag,
+	}
+}
+
+// SavedView is a named filter over messages, like a smart folder
+type SavedView struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Filter      ViewFilter   `json:"filter"`           // Conditions every message must meet
+	AnyOf       []ViewFilter `json:"any_of,omitempty"` // Messages must also meet one of these, if given
+	CreatedAt   time.Time    `json:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at"`
+}
+
+// The filter selecting the messages of a view
+func (v *SavedView) messageFilter() MessageFilter {
+	f := v.Filter.toMessageFilter()
+	for _, alternative := range v.AnyOf {
+		f.AnyOf = append(f.AnyOf, alternative.toMessageFilter())
+	}
+	return f
+}
+
+// The stored definition of a view
+type viewDefinition struct {
+	Filter ViewFilter   `json:"filter"`
+	AnyOf  []ViewFilter `json:"any_of,omitempty"`
+}
+
+// Check the conditions of a view
+func validateViewFilter(vf ViewFilter) error {
+	if !slices.Contains([]string{"", revokedInclude, revokedExclude, revokedOnly}, vf.Revoked) {
+		return newAPIError(ErrCodeInvalidRequest, "revoked must be one of %s, %s or %s", revokedInclude, revokedExclude, revokedOnly)
+	}
+	return nil
+}
+
+// Store a view, replacing a view of the same name
+func (store *MessageStore) StoreView(v *SavedView) error {
+	definition, err := json.Marshal(viewDefinition{Filter: v.Filter, AnyOf: v.AnyOf})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	v.UpdatedAt = now
+	_, err = store.db.Exec(
+		`INSERT INTO saved_views (name, description, definition, created_at, updated_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT(name) DO UPDATE SET description = excluded.description, definition = excluded.definition, updated_at = excluded.updated_at`,
+		v.Name, v.Description, string(definition), now, now,
+	)
+	if err != nil {
+		return err
+	}
+	return store.db.QueryRow("SELECT created_at FROM saved_views WHERE name = ?", v.Name).Scan(&v.CreatedAt)
+}
+
+const viewColumns = "name, COALESCE(description, ''), definition, created_at, updated_at"
+
+// Scan a view row selected with viewColumns
+func scanView(row interface{ Scan(...interface{}) error }) (*SavedView, error) {
+	var v SavedView
+	var definition string
+	if err := row.Scan(&v.Name, &v.Description, &definition, &v.CreatedAt, &v.UpdatedAt); err != nil {
+		return nil, err
+	}
+	var d viewDefinition
+	if err := json.Unmarshal([]byte(definition), &d); err != nil {
+		return nil, fmt.Errorf("invalid definition of view %s: %v", v.Name, err)
+	}
+	v.Filter, v.AnyOf = d.Filter, d.AnyOf
+	return &v, nil
+}
+
+// Get a view, nil if it doesn't exist
+func (store *MessageStore) GetView(name string) (*SavedView, error) {
+	v, err := scanView(store.db.QueryRow("SELECT "+viewColumns+" FROM saved_views WHERE name = ?", name))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return v, err
+}
+
+// List all views by name
+func (store *MessageStore) ListViews() ([]*SavedView, error) {
+	rows, err := store.db.Query("SELECT " + viewColumns + " FROM saved_views ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	views := []*SavedView{}
+	for rows.Next() {
+		v, err := scanView(rows)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, v)
+	}
+	return views, rows.Err()
+}
+
+// Delete a view, returns false if it doesn't exist
+func (store *MessageStore) DeleteView(name string) (bool, error) {
+	result, err := store.db.Exec("DELETE FROM saved_views WHERE name = ?", name)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// SavedViewRequest represents the request body for creating or replacing a view
+type SavedViewRequest struct {
+	Description string       `json:"description,omitempty"`
+	Filter      ViewFilter   `json:"filter"`
+	AnyOf       []ViewFilter `json:"any_of,omitempty"`
+}
+
+// SavedViewResponse represents the response for the single view APIs
+type SavedViewResponse struct {
+	Success bool       `json:"success"`
+	View    *SavedView `json:"view"`
+}
+
+// ListViewsResponse represents the response for the list views API
+type ListViewsResponse struct {
+	Success bool         `json:"success"`
+	Views   []*SavedView `json:"views"`
+}
+
+// ViewMessagesResponse represents the response for the view messages API
+type ViewMessagesResponse struct {
+	Success  bool      `json:"success"`
+	View     string    `json:"view"`
+	Messages []Message `json:"messages"`
+	Page
+}
+
+// Look up the view named in the path, writing not_found if it doesn't exist
+func viewFromPath(w http.ResponseWriter, r *http.Request, messageStore *MessageStore) *SavedView {
+	name := r.PathValue("name")
+	v, err := messageStore.GetView(name)
+	if err != nil {
+		writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to get view: %v", err), nil)
+		return nil
+	}
+	if v == nil {
+		writeError(w, ErrCodeNotFound, fmt.Sprintf("View %s not found", name), nil)
+		return nil
+	}
+	return v
+}
+
+// Register the REST handlers for saved views over messages
+func registerViewHandlers(messageStore *MessageStore) {
+	nameParam := apiParam{Name: "name", In: "path", Description: "Name of the view", Required: true}
+
+	// Handler for listing views
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/views",
+		Summary:  "List the saved views over messages",
+		Tag:      "views",
+		Scope:    ScopeReadMessages,
+		Response: ListViewsResponse{},
+	})
+	http.HandleFunc("GET /api/views", func(w http.ResponseWriter, r *http.Request) {
+		views, err := messageStore.ListViews()
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list views: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, ListViewsResponse{Success: true, Views: views})
+	})
+
+	// Handler for getting a view
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/views/{name}",
+		Summary:  "Get a saved view",
+		Tag:      "views",
+		Scope:    ScopeReadMessages,
+		Params:   []apiParam{nameParam},
+		Response: SavedViewResponse{},
+	})
+	http.HandleFunc("GET /api/views/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if v := viewFromPath(w, r, messageStore); v != nil {
+			writeJSON(w, http.StatusOK, SavedViewResponse{Success: true, View: v})
+		}
+	})
+
+	// Handler for creating or replacing a view
+	documentAPI(apiOperation{
+		Method:   http.MethodPut,
+		Path:     "/api/views/{name}",
+		Summary:  "Create or replace a saved view: messages meeting every condition of filter and, if given, one of any_of",
+		Tag:      "views",
+		Scope:    ScopeReadMessages,
+		Audit:    true,
+		Params:   []apiParam{nameParam},
+		Request:  SavedViewRequest{},
+		Response: SavedViewResponse{},
+	})
+	http.HandleFunc("PUT /api/views/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		if !viewNameRe.MatchString(name) {
+			writeError(w, ErrCodeInvalidRequest, "View names use up to 64 lowercase letters, digits, dashes and underscores", nil)
+			return
+		}
+		var req SavedViewRequest
+		if !decodeJSON(w, r, &req) {
+			return
+		}
+		for _, vf := range append([]ViewFilter{req.Filter}, req.AnyOf...) {
+			if err := validateViewFilter(vf); err != nil {
+				writeAPIError(w, "", err)
+				return
+			}
+		}
+		v := &SavedView{Name: name, Description: req.Description, Filter: req.Filter, AnyOf: req.AnyOf}
+		if err := messageStore.StoreView(v); err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to store view: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, SavedViewResponse{Success: true, View: v})
+	})
+
+	// Handler for deleting a view
+	documentAPI(apiOperation{
+		Method:   http.MethodDelete,
+		Path:     "/api/views/{name}",
+		Summary:  "Delete a saved view",
+		Tag:      "views",
+		Scope:    ScopeReadMessages,
+		Audit:    true,
+		Params:   []apiParam{nameParam},
+		Response: StatusResponse{},
+	})
+	http.HandleFunc("DELETE /api/views/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		found, err := messageStore.DeleteView(name)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to delete view: %v", err), nil)
+			return
+		}
+		if !found {
+			writeError(w, ErrCodeNotFound, fmt.Sprintf("View %s not found", name), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, StatusResponse{Success: true, Message: fmt.Sprintf("View %s deleted", name)})
+	})
+
+	// Handler for the messages of a view
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/views/{name}/messages",
+		Summary:  "List the messages of a saved view, newest first; the usual message filters narrow it further",
+		Tag:      "views",
+		Scope:    ScopeReadMessages,
+		Params:   append([]apiParam{nameParam}, messageFilterParams...),
+		Response: ViewMessagesResponse{},
+	})
+	http.HandleFunc("GET /api/views/{name}/messages", func(w http.ResponseWriter, r *http.Request) {
+		v := viewFromPath(w, r, messageStore)
+		if v == nil {
+			return
+		}
+		f, err := parseMessageFilter(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		// The view is a single alternative, so it applies on top of the request's filters
+		f.AnyOf = []MessageFilter{v.messageFilter()}
+		messages, page, err := messageStore.QueryMessagesPage(f)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list messages: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, ViewMessagesResponse{Success: true, View: v.Name, Messages: messages, Page: page})
+	})
+}
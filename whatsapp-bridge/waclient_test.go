@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// sentMessage is a message the fake client was asked to send
+type sentMessage struct {
+	To      types.JID
+	Message *waProto.Message
+	Extra   whatsmeow.SendRequestExtra
+}
+
+// fakeClient is a waClient that records what it is asked to do instead of
+// talking to WhatsApp
+type fakeClient struct {
+	mu           sync.Mutex
+	disconnected bool
+	nextID       int
+	sent         []sentMessage
+	uploads      []whatsmeow.MediaType
+	media        map[string][]byte // Plaintext served by Download, by direct path
+	downloads    int
+	retries      []types.MessageInfo
+
+	// Errors returned by the next calls, if set
+	sendErr     error
+	uploadErr   error
+	downloadErr error
+}
+
+var _ waClient = (*fakeClient)(nil)
+
+// Create a connected fake client
+func newFakeClient() *fakeClient {
+	return &fakeClient{media: map[string][]byte{}}
+}
+
+// Forget everything the client was asked to do and connect it again
+func (c *fakeClient) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.disconnected, c.sent, c.downloads, c.retries = false, nil, 0, nil
+	c.uploads, c.media = nil, map[string][]byte{}
+	c.sendErr, c.uploadErr, c.downloadErr = nil, nil, nil
+}
+
+// Look at or change the state of the client while no call is using it
+func (c *fakeClient) with(f func(c *fakeClient)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	f(c)
+}
+
+// Get the messages sent so far
+func (c *fakeClient) sentMessages() []sentMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]sentMessage(nil), c.sent...)
+}
+
+func (c *fakeClient) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.disconnected
+}
+
+func (c *fakeClient) GenerateMessageID() types.MessageID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	return types.MessageID(fmt.Sprintf("3EB0FAKE%08d", c.nextID))
+}
+
+func (c *fakeClient) SendMessage(ctx context.Context, to types.JID, message *waProto.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return whatsmeow.SendResponse{}, err
+	}
+	if c.sendErr != nil {
+		return whatsmeow.SendResponse{}, c.sendErr
+	}
+	msg := sentMessage{To: to, Message: message}
+	if len(extra) > 0 {
+		msg.Extra = extra[0]
+	}
+	c.sent = append(c.sent, msg)
+	return whatsmeow.SendResponse{ID: msg.Extra.ID}, nil
+}
+
+func (c *fakeClient) SendPresence(ctx context.Context, state types.Presence) error {
+	return nil
+}
+
+func (c *fakeClient) SubscribePresence(ctx context.Context, jid types.JID) error {
+	return nil
+}
+
+func (c *fakeClient) Upload(ctx context.Context, plaintext []byte, appInfo whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.uploadErr != nil {
+		return whatsmeow.UploadResponse{}, c.uploadErr
+	}
+	c.uploads = append(c.uploads, appInfo)
+	path := fmt.Sprintf("/v/t62/fake-%d.enc", len(c.uploads))
+	return whatsmeow.UploadResponse{
+		URL:        "https://mmg.whatsapp.net" + path,
+		DirectPath: path,
+		MediaKey:   []byte("media-key"),
+		FileLength: uint64(len(plaintext)),
+	}, nil
+}
+
+func (c *fakeClient) UploadNewsletter(ctx context.Context, data []byte, appInfo whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	resp, err := c.Upload(ctx, data, appInfo)
+	resp.Handle = "fake-handle"
+	return resp, err
+}
+
+func (c *fakeClient) Download(ctx context.Context, msg whatsmeow.DownloadableMessage) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.downloads++
+	if c.downloadErr != nil {
+		return nil, c.downloadErr
+	}
+	data, ok := c.media[msg.GetDirectPath()]
+	if !ok {
+		return nil, whatsmeow.ErrMediaDownloadFailedWith404
+	}
+	return data, nil
+}
+
+func (c *fakeClient) SendMediaRetryReceipt(ctx context.Context, message *types.MessageInfo, mediaKey []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.retries = append(c.retries, *message)
+	return nil
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Health states of the WhatsApp session
+const (
+	healthOK           = "ok"            // Connected and answering
+	healthDegraded     = "degraded"      // A liveness check failed
+	healthReconnecting = "reconnecting"  // Checks kept failing, a reconnect was forced
+	healthDisconnected = "disconnected"  // Not connected or not logged in
+	healthAuthRequired = "auth_required" // Logged out, waiting to be paired again
+)
+
+// sessionWatchdog tracks whether the WhatsApp session is actually alive, which
+// IsConnected doesn't tell: a socket can stay open while nothing arrives
+type sessionWatchdog struct {
+	mu          sync.Mutex
+	lastEvent   time.Time
+	lastCheck   time.Time
+	lastSuccess time.Time
+	lastError   string
+	failures    int
+	reconnects  int
+	status      string
+	loggedOut   bool // Logged out until pairing succeeds, whatever the connection does
+}
+
+// Liveness of the session, updated by the event handler and runWatchdog
+var watchdog = &sessionWatchdog{status: healthDisconnected}
+
+// Record that an event arrived from WhatsApp
+func (wd *sessionWatchdog) seen() {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	wd.lastEvent = time.Now()
+}
+
+// Time since the last event from WhatsApp, or zero if none arrived yet
+func (wd *sessionWatchdog) idle() time.Duration {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	if wd.lastEvent.IsZero() {
+		return 0
+	}
+	return time.Since(wd.lastEvent)
+}
+
+// Record the outcome of a liveness check and return the number of consecutive failures
+func (wd *sessionWatchdog) record(err error) int {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	wd.lastCheck = time.Now()
+	if err == nil {
+		wd.lastSuccess = wd.lastCheck
+		wd.lastError = ""
+		wd.failures = 0
+		wd.status = healthOK
+		return 0
+	}
+	wd.lastError = err.Error()
+	wd.failures++
+	wd.status = healthDegraded
+	return wd.failures
+}
+
+// Set the health state
+func (wd *sessionWatchdog) setStatus(status string) {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	wd.status = status
+}
+
+// Set whether the bridge was logged out and needs to be paired again
+func (wd *sessionWatchdog) setAuthRequired(required bool) {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	wd.loggedOut = required
+}
+
+// Leave the auth required state once connected, returning whether the bridge
+// was in it
+func (wd *sessionWatchdog) authenticated() bool {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	was := wd.loggedOut
+	wd.loggedOut = false
+	return was
+}
+
+// Record a forced reconnect, starting the count of failed checks over
+func (wd *sessionWatchdog) reconnecting() {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	wd.status = healthReconnecting
+	wd.reconnects++
+	wd.failures = 0
+}
+
+// Check the session is alive by making a round trip to the WhatsApp servers
+func pingWhatsApp(client *whatsmeow.Client, timeout time.Duration) error {
+	if !client.IsConnected() {
+		return fmt.Errorf("not connected to WhatsApp")
+	}
+	if !client.IsLoggedIn() || client.Store.ID == nil {
+		return fmt.Errorf("not logged in to WhatsApp")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return throttle(opQuery, func() error {
+		_, err := client.GetUserInfo(ctx, []types.JID{client.Store.ID.ToNonAD()})
+		return err
+	})
+}
+
+// Force a new connection to WhatsApp
+func forceReconnect(client *whatsmeow.Client) {
+	if client.IsConnected() {
+		// The client reconnects by itself after the reset
+		client.ResetConnection()
+		return
+	}
+	if err := client.Connect(); err != nil {
+		bridgeLog.Warnf("Failed to reconnect to WhatsApp: %v", err)
+	}
+}
+
+// Periodically check the session is alive while no events arrive, forcing a
+// reconnect after WHATSAPP_WATCHDOG_MAX_FAILURES failed checks in a row
+func runWatchdog(client *whatsmeow.Client) {
+	interval := time.Duration(envInt("WHATSAPP_WATCHDOG_INTERVAL_SECONDS", 300)) * time.Second
+	if interval <= 0 {
+		return
+	}
+	timeout := time.Duration(envInt("WHATSAPP_WATCHDOG_TIMEOUT_SECONDS", 30)) * time.Second
+	maxFailures := max(envInt("WHATSAPP_WATCHDOG_MAX_FAILURES", 3), 1)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		checkSession(client, interval, timeout, maxFailures)
+	}
+}
+
+// Check the session once, forcing a reconnect after maxFailures failed checks
+func checkSession(client *whatsmeow.Client, interval, timeout time.Duration, maxFailures int) {
+	defer recoverPanic("checking the WhatsApp session")
+	// Nothing to check before pairing
+	if client.Store.ID == nil {
+		watchdog.setStatus(healthDisconnected)
+		return
+	}
+	// Events arriving prove the session is alive without asking the server
+	if idle := watchdog.idle(); idle > 0 && idle < interval {
+		watchdog.record(nil)
+		return
+	}
+
+	failures := watchdog.record(pingWhatsApp(client, timeout))
+	if failures == 0 {
+		return
+	}
+	bridgeLog.Warnf("WhatsApp liveness check failed (%d/%d): %s", failures, maxFailures, watchdog.Status().LastError)
+	if failures >= maxFailures {
+		bridgeLog.Warnf("WhatsApp session looks dead, forcing a reconnect")
+		watchdog.reconnecting()
+		forceReconnect(client)
+	}
+}
+
+// HealthStatus is the liveness of the WhatsApp session
+type HealthStatus struct {
+	Status      string     `json:"status"`
+	Connected   bool       `json:"connected"`
+	LoggedIn    bool       `json:"logged_in"`
+	LastEvent   *time.Time `json:"last_event,omitempty"`
+	LastCheck   *time.Time `json:"last_check,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	Failures    int        `json:"consecutive_failures"`
+	Reconnects  int        `json:"forced_reconnects"`
+	// Logged out, pair again through POST /api/auth/relogin
+	AuthRequired bool           `json:"auth_required"`
+	Pairing      *PairingStatus `json:"pairing,omitempty"` // Progress of pairing, without its codes
+}
+
+// Get the health of the session as last seen by the watchdog
+func (wd *sessionWatchdog) Status() HealthStatus {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	status := HealthStatus{
+		Status:     wd.status,
+		LastError:  wd.lastError,
+		Failures:   wd.failures,
+		Reconnects: wd.reconnects,
+	}
+	status.LastEvent = optionalTime(wd.lastEvent)
+	status.LastCheck = optionalTime(wd.lastCheck)
+	status.LastSuccess = optionalTime(wd.lastSuccess)
+	if wd.loggedOut {
+		status.Status = healthAuthRequired
+		status.AuthRequired = true
+	}
+	return status
+}
+
+// A time for an optional JSON field, nil if it never happened
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// HealthResponse represents the response for the health API
+type HealthResponse struct {
+	Success bool `json:"success"`
+	HealthStatus
+}
+
+// ProbeResponse represents the response for the liveness and readiness probes
+type ProbeResponse struct {
+	Success bool   `json:"success"`
+	Status  string `json:"status"`
+}
+
+// Whether the bridge can serve requests needing WhatsApp
+func sessionReady(client *whatsmeow.Client) bool {
+	return client.IsConnected() && client.IsLoggedIn() && watchdog.Status().Status == healthOK
+}
+
+// Register the REST handlers reporting the health of the WhatsApp session
+func registerHealthHandlers(client *whatsmeow.Client) {
+	// Probes for container orchestrators, which can't present tokens and only
+	// look at the status code
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/health/live",
+		Summary:  "Liveness probe, answering 200 while the bridge process is serving requests",
+		Tag:      "admin",
+		Public:   true,
+		Response: ProbeResponse{},
+	})
+	http.HandleFunc("GET /api/health/live", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, ProbeResponse{Success: true, Status: "alive"})
+	})
+
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/health/ready",
+		Summary:  "Readiness probe, answering 200 once the WhatsApp session is connected and healthy and 503 otherwise",
+		Tag:      "admin",
+		Public:   true,
+		Response: ProbeResponse{},
+	})
+	http.HandleFunc("GET /api/health/ready", func(w http.ResponseWriter, r *http.Request) {
+		if !sessionReady(client) {
+			writeJSON(w, http.StatusServiceUnavailable, ProbeResponse{Success: false, Status: "not_ready"})
+			return
+		}
+		writeJSON(w, http.StatusOK, ProbeResponse{Success: true, Status: "ready"})
+	})
+
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/health",
+		Summary:  "Get the liveness of the WhatsApp session, answering 503 unless it is healthy",
+		Tag:      "admin",
+		Scope:    ScopeReadMessages,
+		Response: HealthResponse{},
+	})
+	http.HandleFunc("GET /api/health", func(w http.ResponseWriter, r *http.Request) {
+		status := watchdog.Status()
+		status.Connected = client.IsConnected()
+		status.LoggedIn = client.IsLoggedIn()
+		if status.AuthRequired {
+			if p := pairing.Status(); p.Active || p.LastError != "" {
+				p.QRCode, p.PairingCode, p.ExpiresAt = "", "", nil
+				status.Pairing = &p
+			}
+		} else if !status.Connected || !status.LoggedIn {
+			status.Status = healthDisconnected
+		}
+
+		code := http.StatusOK
+		if status.Status != healthOK {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, HealthResponse{Success: status.Status == healthOK, HealthStatus: status})
+	})
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestAuthRequired(t *testing.T) {
+	wd := &sessionWatchdog{status: healthOK}
+	wd.setAuthRequired(true)
+
+	// A disconnect after the logout doesn't hide that pairing is needed
+	wd.setStatus(healthDisconnected)
+	if status := wd.Status(); status.Status != healthAuthRequired || !status.AuthRequired {
+		t.Fatalf("Got status %q, want %q", status.Status, healthAuthRequired)
+	}
+
+	if !wd.authenticated() {
+		t.Error("Connecting after a logout should report the bridge was paired again")
+	}
+	wd.setStatus(healthOK)
+	if status := wd.Status(); status.Status != healthOK || status.AuthRequired {
+		t.Errorf("Got status %q after pairing, want %q", status.Status, healthOK)
+	}
+	if wd.authenticated() {
+		t.Error("Connecting again shouldn't count as being paired again")
+	}
+}
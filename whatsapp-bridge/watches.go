@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Watch alerts on incoming messages matching keywords, a regular expression,
+// a sender or a media type
+type Watch struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	ChatJID     string    `json:"chat_jid,omitempty"`    // Only watch this chat, all chats when empty
+	Keywords    []string  `json:"keywords,omitempty"`    // Case-insensitive words or phrases
+	Pattern     string    `json:"pattern,omitempty"`     // Go regular expression
+	Sender      string    `json:"sender,omitempty"`      // Only match messages from this phone number or LID user
+	MediaType   string    `json:"media_type,omitempty"`  // Only match messages with this media, like document or image
+	AlertChat   string    `json:"alert_chat,omitempty"`  // Chat (JID or phone number) to forward alerts to
+	WebhookURL  string    `json:"webhook_url,omitempty"` // URL to POST alerts to
+	EmailTo     string    `json:"email_to,omitempty"`    // Address to email matching messages to, with their media attached
+	Tag         string    `json:"tag"`                   // Tag added to matching messages
+	NotifyMuted bool      `json:"notify_muted"`          // Alert on chats muted in WhatsApp too
+	Enabled     bool      `json:"enabled"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	pattern *regexp.Regexp
+}
+
+// WatchRequest represents the request body for creating or replacing a watch
+type WatchRequest struct {
+	Name        string   `json:"name"`
+	ChatJID     string   `json:"chat_jid,omitempty"`
+	Keywords    []string `json:"keywords,omitempty"`
+	Pattern     string   `json:"pattern,omitempty"`
+	Sender      string   `json:"sender,omitempty"`
+	MediaType   string   `json:"media_type,omitempty"`
+	AlertChat   string   `json:"alert_chat,omitempty"`
+	WebhookURL  string   `json:"webhook_url,omitempty"`
+	EmailTo     string   `json:"email_to,omitempty"` // Needs WHATSAPP_SMTP_HOST
+	Tag         string   `json:"tag,omitempty"`      // Defaults to "watch:<name>"
+	NotifyMuted bool     `json:"notify_muted,omitempty"`
+	Enabled     *bool    `json:"enabled,omitempty"`
+}
+
+// Validate a watch request and turn it into a watch
+func (req WatchRequest) toWatch() (*Watch, error) {
+	w := &Watch{
+		Name:        strings.TrimSpace(req.Name),
+		ChatJID:     req.ChatJID,
+		Pattern:     req.Pattern,
+		Sender:      normalizeWatchSender(req.Sender),
+		MediaType:   strings.ToLower(strings.TrimSpace(req.MediaType)),
+		AlertChat:   req.AlertChat,
+		WebhookURL:  req.WebhookURL,
+		EmailTo:     strings.TrimSpace(req.EmailTo),
+		Tag:         strings.TrimSpace(req.Tag),
+		NotifyMuted: req.NotifyMuted,
+		Enabled:     req.Enabled == nil || *req.Enabled,
+	}
+	for _, k := range req.Keywords {
+		if k = strings.TrimSpace(k); k != "" {
+			w.Keywords = append(w.Keywords, k)
+		}
+	}
+
+	if w.Name == "" {
+		return nil, newAPIError(ErrCodeInvalidRequest, "Name is required")
+	}
+	if len(w.Keywords) == 0 && w.Pattern == "" && w.Sender == "" && w.MediaType == "" {
+		return nil, newAPIError(ErrCodeInvalidRequest, "At least one keyword, a pattern, a sender or a media type is required")
+	}
+	if w.WebhookURL != "" {
+		if u, err := url.Parse(w.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, newAPIError(ErrCodeInvalidRequest, "webhook_url must be an http(s) URL")
+		}
+	}
+	if w.EmailTo != "" {
+		if _, err := mail.ParseAddress(w.EmailTo); err != nil {
+			return nil, newAPIError(ErrCodeInvalidRequest, "email_to must be an email address")
+		}
+		if envString("WHATSAPP_SMTP_HOST", "") == "" {
+			return nil, newAPIError(ErrCodeInvalidRequest, "email_to needs an SMTP server, set WHATSAPP_SMTP_HOST")
+		}
+	}
+	if w.Tag == "" {
+		w.Tag = "watch:" + w.Name
+	}
+	if err := w.compile(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Compile the regular expression of a watch
+func (w *Watch) compile() error {
+	if w.Pattern == "" {
+		w.pattern = nil
+		return nil
+	}
+	re, err := regexp.Compile(w.Pattern)
+	if err != nil {
+		return newAPIError(ErrCodeInvalidRequest, "Invalid pattern: %v", err)
+	}
+	w.pattern = re
+	return nil
+}
+
+// Get the user of a sender given as a phone number or JID
+func normalizeWatchSender(sender string) string {
+	sender = strings.TrimSpace(sender)
+	if at := strings.Index(sender, "@"); at >= 0 {
+		sender = sender[:at]
+	}
+	return strings.NewReplacer("+", "", " ", "", "-", "").Replace(sender)
+}
+
+// Check whether a message matches the watch. Keywords and the pattern are
+// only checked if the watch has them, so a watch on a sender or media type
+// matches media without a caption.
+func (w *Watch) matches(msg Message) bool {
+	if !w.Enabled || (w.ChatJID != "" && w.ChatJID != msg.ChatJID) {
+		return false
+	}
+	if w.Sender != "" && w.Sender != msg.Sender && w.Sender != msg.SenderID && w.Sender != msg.SenderLID {
+		return false
+	}
+	if w.MediaType != "" && w.MediaType != msg.MediaType {
+		return false
+	}
+	if len(w.Keywords) == 0 && w.Pattern == "" {
+		return true
+	}
+	content := msg.Content
+	if content == "" {
+		return false
+	}
+	lower := strings.ToLower(content)
+	for _, k := range w.Keywords {
+		if strings.Contains(lower, strings.ToLower(k)) {
+			return true
+		}
+	}
+	return w.pattern != nil && w.pattern.MatchString(content)
+}
+
+const watchColumns = "id, name, COALESCE(chat_jid, ''), keywords, COALESCE(pattern, ''), COALESCE(sender, ''), COALESCE(media_type, ''), COALESCE(alert_chat, ''), COALESCE(webhook_url, ''), COALESCE(email_to, ''), tag, COALESCE(notify_muted, 0), enabled, created_at"
+
+// Scan a watch row selected with watchColumns
+func scanWatch(row interface{ Scan(...interface{}) error }) (*Watch, error) {
+	var w Watch
+	var keywords string
+	if err := row.Scan(&w.ID, &w.Name, &w.ChatJID, &keywords, &w.Pattern, &w.Sender, &w.MediaType, &w.AlertChat, &w.WebhookURL,
+		&w.EmailTo, &w.Tag, &w.NotifyMuted, &w.Enabled, &w.CreatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(keywords), &w.Keywords); err != nil {
+		return nil, fmt.Errorf("invalid keywords for watch %d: %v", w.ID, err)
+	}
+	return &w, w.compile()
+}
+
+// List all watches
+func (store *MessageStore) ListWatches() ([]*Watch, error) {
+	rows, err := store.db.Query("SELECT " + watchColumns + " FROM watches ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	watches := []*Watch{}
+	for rows.Next() {
+		w, err := scanWatch(rows)
+		if err != nil {
+			return nil, err
+		}
+		watches = append(watches, w)
+	}
+	return watches, rows.Err()
+}
+
+// Get a watch by ID
+func (store *MessageStore) GetWatch(id int64) (*Watch, error) {
+	return scanWatch(store.db.QueryRow("SELECT "+watchColumns+" FROM watches WHERE id = ?", id))
+}
+
+// Store a new watch, setting its ID
+func (store *MessageStore) StoreWatch(w *Watch) error {
+	keywords, _ := json.Marshal(w.Keywords)
+	w.CreatedAt = time.Now()
+	result, err := store.db.Exec(
+		`INSERT INTO watches (name, chat_jid, keywords, pattern, sender, media_type, alert_chat, webhook_url, email_to, tag,
+		notify_muted, enabled, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		w.Name, w.ChatJID, string(keywords), w.Pattern, w.Sender, w.MediaType, w.AlertChat, w.WebhookURL, w.EmailTo, w.Tag,
+		w.NotifyMuted, w.Enabled, w.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	w.ID, err = result.LastInsertId()
+	return err
+}
+
+// Replace the settings of a watch, returns false if it doesn't exist
+func (store *MessageStore) UpdateWatch(w *Watch) (bool, error) {
+	keywords, _ := json.Marshal(w.Keywords)
+	result, err := store.db.Exec(
+		`UPDATE watches SET name = ?, chat_jid = ?, keywords = ?, pattern = ?, sender = ?, media_type = ?, alert_chat = ?,
+		webhook_url = ?, email_to = ?, tag = ?, notify_muted = ?, enabled = ? WHERE id = ?`,
+		w.Name, w.ChatJID, string(keywords), w.Pattern, w.Sender, w.MediaType, w.AlertChat,
+		w.WebhookURL, w.EmailTo, w.Tag, w.NotifyMuted, w.Enabled, w.ID,
+	)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Delete a watch, returns false if it doesn't exist
+func (store *MessageStore) DeleteWatch(id int64) (bool, error) {
+	result, err := store.db.Exec("DELETE FROM watches WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// Tag a stored message
+func (store *MessageStore) TagMessage(messageID, chatJID, tag string) error {
+	_, err := store.db.Exec(
+		"INSERT OR IGNORE INTO message_tags (message_id, chat_jid, tag, created_at) VALUES (?, ?, ?, ?)",
+		messageID, chatJID, tag, time.Now(),
+	)
+	return err
+}
+
+// In-memory copy of the watches, so matching doesn't hit the database for every message
+var (
+	activeWatches   []*Watch
+	activeWatchesMu sync.RWMutex
+)
+
+// Reload the in-memory watches after they changed
+func reloadWatches(messageStore *MessageStore) error {
+	watches, err := messageStore.ListWatches()
+	if err != nil {
+		return err
+	}
+	activeWatchesMu.Lock()
+	activeWatches = watches
+	activeWatchesMu.Unlock()
+	return nil
+}
+
+// WatchAlert is the payload POSTed to a watch's webhook
+type WatchAlert struct {
+	Event    string  `json:"event"`
+	WatchID  int64   `json:"watch_id"`
+	Watch    string  `json:"watch"`
+	ChatName string  `json:"chat_name"`
+	Message  Message `json:"message"`
+}
+
+// Check an incoming message against the watches, tagging it and sending alerts for every match
+func handleWatches(client *whatsmeow.Client, messageStore *MessageStore, msg Message, chatName string) {
+	activeWatchesMu.RLock()
+	var matched []*Watch
+	for _, w := range activeWatches {
+		// Never alert on the alert chat itself, or a forwarded alert could trigger another
+		if w.AlertChat != "" && w.AlertChat == msg.ChatJID {
+			continue
+		}
+		if w.matches(msg) {
+			matched = append(matched, w)
+		}
+	}
+	activeWatchesMu.RUnlock()
+
+	// Tagging goes on for muted chats, only the alerts are held back
+	suppressed := ""
+	if len(matched) > 0 {
+		if chat, err := types.ParseJID(msg.ChatJID); err == nil {
+			suppressed = notificationSuppression(client, chat)
+		}
+	}
+
+	for _, w := range matched {
+		if err := messageStore.TagMessage(msg.ID, msg.ChatJID, w.Tag); err != nil {
+			bridgeLog.Warnf("Failed to tag message %s for watch %q: %v", msg.ID, w.Name, err)
+		}
+		if suppressed == suppressedExcluded || (suppressed == suppressedMuted && !w.NotifyMuted) {
+			bridgeLog.Debugf("Not alerting for watch %q on %s chat %s", w.Name, suppressed, msg.ChatJID)
+			continue
+		}
+
+		// Deliver alerts in the background so slow webhooks don't hold up message handling
+		goSafe("alerting for watch "+w.Name, func() {
+			if w.AlertChat != "" {
+				text := fmt.Sprintf("🔔 %s: message in %s from %s\n\n%s", w.Name, chatName, msg.Sender, msg.Content)
+				if _, err := sendWhatsAppMessage(context.Background(), client, messageStore, w.AlertChat, text, ""); err != nil {
+					bridgeLog.Warnf("Failed to forward alert for watch %q: %v", w.Name, err)
+				}
+			}
+			if w.WebhookURL != "" {
+				alert := WatchAlert{Event: "watch.match", WatchID: w.ID, Watch: w.Name, ChatName: chatName, Message: msg}
+				if err := postWebhook(w.WebhookURL, alert); err != nil {
+					bridgeLog.Warnf("Failed to call webhook for watch %q: %v", w.Name, err)
+				}
+			}
+			if w.EmailTo != "" {
+				if err := emailWatchMatch(client, messageStore, w, msg, chatName); err != nil {
+					bridgeLog.Warnf("Failed to email message %s for watch %q: %v", msg.ID, w.Name, err)
+				}
+			}
+		})
+	}
+}
+
+// ListWatchesResponse represents the response for the list watches API
+type ListWatchesResponse struct {
+	Success bool     `json:"success"`
+	Watches []*Watch `json:"watches"`
+}
+
+// WatchResponse represents the response for the single watch APIs
+type WatchResponse struct {
+	Success bool   `json:"success"`
+	Watch   *Watch `json:"watch"`
+}
+
+// Parse the {id} path value of a watch route
+func watchIDFromPath(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return 0, newAPIError(ErrCodeInvalidRequest, "Watch ID must be an integer")
+	}
+	return id, nil
+}
+
+// Decode and validate a watch request body
+func decodeWatchRequest(w http.ResponseWriter, r *http.Request) (*Watch, bool) {
+	var req WatchRequest
+	if !decodeJSON(w, r, &req) {
+		return nil, false
+	}
+	watch, err := req.toWatch()
+	if err != nil {
+		writeAPIError(w, "", err)
+		return nil, false
+	}
+	if watch.ChatJID != "" {
+		if _, err := types.ParseJID(watch.ChatJID); err != nil {
+			writeError(w, ErrCodeInvalidRequest, fmt.Sprintf("Invalid chat_jid: %v", err), nil)
+			return nil, false
+		}
+	}
+	return watch, true
+}
+
+// Register the REST handlers for managing keyword watches
+func registerWatchHandlers(messageStore *MessageStore) {
+	if err := reloadWatches(messageStore); err != nil {
+		bridgeLog.Warnf("Failed to load watches: %v", err)
+	}
+
+	idParam := apiParam{Name: "id", In: "path", Description: "ID of the watch", Required: true, Type: "integer"}
+
+	// Handler for listing watches
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/watches",
+		Summary:  "List keyword watches",
+		Tag:      "watches",
+		Scope:    ScopeReadMessages,
+		Response: ListWatchesResponse{},
+	})
+	http.HandleFunc("GET /api/watches", func(w http.ResponseWriter, r *http.Request) {
+		watches, err := messageStore.ListWatches()
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to list watches: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, ListWatchesResponse{Success: true, Watches: watches})
+	})
+
+	// Handler for creating a watch
+	documentAPI(apiOperation{
+		Method:   http.MethodPost,
+		Path:     "/api/watches",
+		Summary:  "Create a watch that tags matching messages and sends alerts, to a chat, a webhook or by email",
+		Tag:      "watches",
+		Scope:    ScopeAdmin,
+		Audit:    true,
+		Request:  WatchRequest{},
+		Response: WatchResponse{},
+	})
+	http.HandleFunc("POST /api/watches", func(w http.ResponseWriter, r *http.Request) {
+		watch, ok := decodeWatchRequest(w, r)
+		if !ok {
+			return
+		}
+		if err := messageStore.StoreWatch(watch); err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to store watch: %v", err), nil)
+			return
+		}
+		if err := reloadWatches(messageStore); err != nil {
+			bridgeLog.Warnf("Failed to reload watches: %v", err)
+		}
+		writeJSON(w, http.StatusCreated, WatchResponse{Success: true, Watch: watch})
+	})
+
+	// Handler for getting a watch
+	documentAPI(apiOperation{
+		Method:   http.MethodGet,
+		Path:     "/api/watches/{id}",
+		Summary:  "Get a keyword watch",
+		Tag:      "watches",
+		Scope:    ScopeReadMessages,
+		Params:   []apiParam{idParam},
+		Response: WatchResponse{},
+	})
+	http.HandleFunc("GET /api/watches/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := watchIDFromPath(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		watch, err := messageStore.GetWatch(id)
+		if err == sql.ErrNoRows {
+			writeError(w, ErrCodeNotFound, fmt.Sprintf("Watch %d not found", id), nil)
+			return
+		} else if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to load watch: %v", err), nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, WatchResponse{Success: true, Watch: watch})
+	})
+
+	// Handler for replacing a watch
+	documentAPI(apiOperation{
+		Method:   http.MethodPut,
+		Path:     "/api/watches/{id}",
+		Summary:  "Replace the settings of a keyword watch",
+		Tag:      "watches",
+		Scope:    ScopeAdmin,
+		Audit:    true,
+		Params:   []apiParam{idParam},
+		Request:  WatchRequest{},
+		Response: WatchResponse{},
+	})
+	http.HandleFunc("PUT /api/watches/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := watchIDFromPath(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		watch, ok := decodeWatchRequest(w, r)
+		if !ok {
+			return
+		}
+		watch.ID = id
+
+		found, err := messageStore.UpdateWatch(watch)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to update watch: %v", err), nil)
+			return
+		}
+		if !found {
+			writeError(w, ErrCodeNotFound, fmt.Sprintf("Watch %d not found", id), nil)
+			return
+		}
+		if err := reloadWatches(messageStore); err != nil {
+			bridgeLog.Warnf("Failed to reload watches: %v", err)
+		}
+
+		// Return the stored watch, including its creation time
+		if stored, err := messageStore.GetWatch(id); err == nil {
+			watch = stored
+		}
+		writeJSON(w, http.StatusOK, WatchResponse{Success: true, Watch: watch})
+	})
+
+	// Handler for deleting a watch
+	documentAPI(apiOperation{
+		Method:   http.MethodDelete,
+		Path:     "/api/watches/{id}",
+		Summary:  "Delete a keyword watch",
+		Tag:      "watches",
+		Scope:    ScopeAdmin,
+		Audit:    true,
+		Params:   []apiParam{idParam},
+		Response: StatusResponse{},
+	})
+	http.HandleFunc("DELETE /api/watches/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := watchIDFromPath(r)
+		if err != nil {
+			writeAPIError(w, "", err)
+			return
+		}
+		found, err := messageStore.DeleteWatch(id)
+		if err != nil {
+			writeError(w, ErrCodeInternal, fmt.Sprintf("Failed to delete watch: %v", err), nil)
+			return
+		}
+		if !found {
+			writeError(w, ErrCodeNotFound, fmt.Sprintf("Watch %d not found", id), nil)
+			return
+		}
+		if err := reloadWatches(messageStore); err != nil {
+			bridgeLog.Warnf("Failed to reload watches: %v", err)
+		}
+		writeJSON(w, http.StatusOK, StatusResponse{Success: true, Message: fmt.Sprintf("Watch %d deleted", id)})
+	})
+}
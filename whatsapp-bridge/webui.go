@@ -0,0 +1,28 @@
+package main
+
+import (
+	"embed"
+	"net/http"
+)
+
+// Static files of the built-in web UI
+//
+//go:embed webui/index.html
+var webUIFiles embed.FS
+
+// Register the handler serving the built-in web UI at /
+func registerWebUIHandlers() {
+	// The page itself is public, it takes the token for its API calls
+	documentAPI(apiOperation{Method: http.MethodGet, Path: "/{$}", Public: true, Hidden: true})
+	// "/{$}" only matches the root, so unknown paths don't reach the page
+	http.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		page, err := webUIFiles.ReadFile("webui/index.html")
+		if err != nil {
+			writeError(w, ErrCodeInternal, "Web UI is not available", nil)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	})
+}
@@ -12,12 +12,32 @@ from whatsapp import (
     send_message as whatsapp_send_message,
     send_file as whatsapp_send_file,
     send_audio_message as whatsapp_audio_voice_message,
-    download_media as whatsapp_download_media
+    download_media as whatsapp_download_media,
+    search as whatsapp_search
 )
 
 # Initialize FastMCP server
 mcp = FastMCP("whatsapp")
 
+@mcp.tool()
+def search(
+    query: str,
+    types: Optional[List[str]] = None,
+    chat_jid: Optional[str] = None,
+    limit: int = 20
+) -> List[Dict[str, Any]]:
+    """Search WhatsApp messages, chats and contacts at once. Results are ranked best
+    first, typed (message, contact, group or chat) and carry a snippet with the
+    matched text wrapped in **.
+    
+    Args:
+        query: Words to search for, the last one also matches as a prefix
+        types: Optional entity types to limit the search to: "messages", "chats", "contacts"
+        chat_jid: Optional chat JID to only search messages of that chat
+        limit: Maximum number of results (default 20)
+    """
+    return whatsapp_search(query, types, chat_jid, limit)
+
 @mcp.tool()
 def search_contacts(query: str) -> List[Dict[str, Any]]:
     """Search WhatsApp contacts by name or phone number.
@@ -157,14 +177,21 @@ def get_message_context(
 @mcp.tool()
 def send_message(
     recipient: str,
-    message: str
+    message: str,
+    dry_run: bool = False,
+    send_when_online: bool = False,
+    max_wait_minutes: Optional[int] = None
 ) -> Dict[str, Any]:
     """Send a WhatsApp message to a person or group. For group chats use the JID.
 
     Args:
         recipient: The recipient - either a phone number with country code but no + or other symbols,
-                 or a JID (e.g., "123456789@s.whatsapp.net" or a group JID like "123456789@g.us")
+                 a JID (e.g., "123456789@s.whatsapp.net" or a group JID like "123456789@g.us"),
+                 or a saved contact name or alias (e.g., "Mum")
         message: The message text to send
+        dry_run: Validate the message and resolve the recipient without actually sending it
+        send_when_online: Hold the message until the recipient shows as online (individual chats only)
+        max_wait_minutes: Send anyway after this many minutes if they don't come online (default 60)
     
     Returns:
         A dictionary containing success status and a status message
@@ -177,45 +204,49 @@ def send_message(
         }
     
     # Call the whatsapp_send_message function with the unified recipient parameter
-    success, status_message = whatsapp_send_message(recipient, message)
+    success, status_message = whatsapp_send_message(recipient, message, dry_run, send_when_online, max_wait_minutes)
     return {
         "success": success,
         "message": status_message
     }
 
 @mcp.tool()
-def send_file(recipient: str, media_path: str) -> Dict[str, Any]:
+def send_file(recipient: str, media_path: str, dry_run: bool = False) -> Dict[str, Any]:
     """Send a file such as a picture, raw audio, video or document via WhatsApp to the specified recipient. For group messages use the JID.
     
     Args:
         recipient: The recipient - either a phone number with country code but no + or other symbols,
-                 or a JID (e.g., "123456789@s.whatsapp.net" or a group JID like "123456789@g.us")
+                 a JID (e.g., "123456789@s.whatsapp.net" or a group JID like "123456789@g.us"),
+                 or a saved contact name or alias (e.g., "Mum")
         media_path: The absolute path to the media file to send (image, video, document)
+        dry_run: Validate and prepare the file without actually sending it
     
     Returns:
         A dictionary containing success status and a status message
     """
     
     # Call the whatsapp_send_file function
-    success, status_message = whatsapp_send_file(recipient, media_path)
+    success, status_message = whatsapp_send_file(recipient, media_path, dry_run)
     return {
         "success": success,
         "message": status_message
     }
 
 @mcp.tool()
-def send_audio_message(recipient: str, media_path: str) -> Dict[str, Any]:
+def send_audio_message(recipient: str, media_path: str, dry_run: bool = False) -> Dict[str, Any]:
     """Send any audio file as a WhatsApp audio message to the specified recipient. For group messages use the JID. If it errors due to ffmpeg not being installed, use send_file instead.
     
     Args:
         recipient: The recipient - either a phone number with country code but no + or other symbols,
-                 or a JID (e.g., "123456789@s.whatsapp.net" or a group JID like "123456789@g.us")
+                 a JID (e.g., "123456789@s.whatsapp.net" or a group JID like "123456789@g.us"),
+                 or a saved contact name or alias (e.g., "Mum")
         media_path: The absolute path to the audio file to send (will be converted to Opus .ogg if it's not a .ogg file)
+        dry_run: Validate and prepare the audio without actually sending it
     
     Returns:
         A dictionary containing success status and a status message
     """
-    success, status_message = whatsapp_audio_voice_message(recipient, media_path)
+    success, status_message = whatsapp_audio_voice_message(recipient, media_path, dry_run)
     return {
         "success": success,
         "message": status_message
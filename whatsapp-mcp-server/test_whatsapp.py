@@ -0,0 +1,29 @@
+import os
+import unittest
+from unittest import mock
+
+import whatsapp
+
+
+class MessagesDBPathTest(unittest.TestCase):
+    def path(self, **env):
+        with mock.patch.dict(os.environ, env, clear=False):
+            for name in ("WHATSAPP_DATA_DIR", "WHATSAPP_STORE_DIR"):
+                if name not in env:
+                    os.environ.pop(name, None)
+            return whatsapp.messages_db_path()
+
+    def test_default_is_the_bridge_store(self):
+        bridge = os.path.join(os.path.dirname(os.path.abspath(whatsapp.__file__)), '..', 'whatsapp-bridge')
+        self.assertEqual(self.path(), os.path.join(bridge, 'store', 'messages.db'))
+
+    def test_store_dir_resolves_under_data_dir(self):
+        self.assertEqual(self.path(WHATSAPP_DATA_DIR="/data"), "/data/store/messages.db")
+        self.assertEqual(self.path(WHATSAPP_DATA_DIR="/data", WHATSAPP_STORE_DIR="db"), "/data/db/messages.db")
+
+    def test_absolute_store_dir_ignores_data_dir(self):
+        self.assertEqual(self.path(WHATSAPP_DATA_DIR="/data", WHATSAPP_STORE_DIR="/srv/wa"), "/srv/wa/messages.db")
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -1,14 +1,28 @@
 import sqlite3
 from datetime import datetime
 from dataclasses import dataclass, asdict
-from typing import Optional, List, Tuple
+from typing import Any, Dict, Optional, List, Tuple
 import os.path
 import requests
 import json
 import audio
 
-MESSAGES_DB_PATH = os.path.join(os.path.dirname(os.path.abspath(__file__)), '..', 'whatsapp-bridge', 'store', 'messages.db')
-WHATSAPP_API_BASE_URL = "http://localhost:8080/api"
+def messages_db_path() -> str:
+    """Locate the bridge's messages.db the way the bridge does: a relative
+    WHATSAPP_STORE_DIR is resolved under WHATSAPP_DATA_DIR, which defaults to
+    the bridge directory it runs from."""
+    data_dir = os.environ.get("WHATSAPP_DATA_DIR") or os.path.join(os.path.dirname(os.path.abspath(__file__)), '..', 'whatsapp-bridge')
+    store_dir = os.environ.get("WHATSAPP_STORE_DIR") or "store"
+    if not os.path.isabs(store_dir):
+        store_dir = os.path.join(data_dir, store_dir)
+    return os.path.join(store_dir, 'messages.db')
+
+# Follow the bridge's WHATSAPP_DATA_DIR, WHATSAPP_STORE_DIR and WHATSAPP_PORT settings when they are moved
+MESSAGES_DB_PATH = messages_db_path()
+WHATSAPP_API_BASE_URL = f"http://localhost:{os.environ.get('WHATSAPP_PORT', '8080')}/api"
+# Bearer token for the bridge's REST API, required when the bridge has API tokens configured
+WHATSAPP_API_TOKEN = os.environ.get("WHATSAPP_API_TOKEN", "")
+API_HEADERS = {"Authorization": f"Bearer {WHATSAPP_API_TOKEN}"} if WHATSAPP_API_TOKEN else {}
 
 @dataclass
 class Message:
@@ -664,7 +678,15 @@ def get_direct_chat_by_contact(sender_phone_number: str) -> Optional[Chat]:
         if 'conn' in locals():
             conn.close()
 
-def send_message(recipient: str, message: str) -> Tuple[bool, str]:
+def _send_result_message(result: Dict[str, Any]) -> str:
+    """Build the status message of a send, including the preview of a dry run."""
+    message = result.get("message", "Unknown response")
+    if result.get("dry_run") and result.get("preview"):
+        message = f"{message}. Would send: {json.dumps(result['preview'])}"
+    return message
+
+def send_message(recipient: str, message: str, dry_run: bool = False, send_when_online: bool = False,
+                 max_wait_minutes: Optional[int] = None) -> Tuple[bool, str]:
     try:
         # Validate input
         if not recipient:
@@ -676,12 +698,19 @@ def send_message(recipient: str, message: str) -> Tuple[bool, str]:
             "message": message,
         }
         
-        response = requests.post(url, json=payload)
+        if dry_run:
+            payload["dry_run"] = True
+        if send_when_online:
+            payload["send_when_online"] = True
+            if max_wait_minutes:
+                payload["max_wait_minutes"] = max_wait_minutes
         
-        # Check if the request was successful
-        if response.status_code == 200:
+        response = requests.post(url, json=payload, headers=API_HEADERS)
+        
+        # Check if the request was successful (202 when the message is held back)
+        if response.status_code in (200, 202):
             result = response.json()
-            return result.get("success", False), result.get("message", "Unknown response")
+            return result.get("success", False), _send_result_message(result)
         else:
             return False, f"Error: HTTP {response.status_code} - {response.text}"
             
@@ -692,7 +721,7 @@ def send_message(recipient: str, message: str) -> Tuple[bool, str]:
     except Exception as e:
         return False, f"Unexpected error: {str(e)}"
 
-def send_file(recipient: str, media_path: str) -> Tuple[bool, str]:
+def send_file(recipient: str, media_path: str, dry_run: bool = False) -> Tuple[bool, str]:
     try:
         # Validate input
         if not recipient:
@@ -710,12 +739,15 @@ def send_file(recipient: str, media_path: str) -> Tuple[bool, str]:
             "media_path": media_path
         }
         
-        response = requests.post(url, json=payload)
+        if dry_run:
+            payload["dry_run"] = True
         
-        # Check if the request was successful
-        if response.status_code == 200:
+        response = requests.post(url, json=payload, headers=API_HEADERS)
+        
+        # Check if the request was successful (202 when the file is held back)
+        if response.status_code in (200, 202):
             result = response.json()
-            return result.get("success", False), result.get("message", "Unknown response")
+            return result.get("success", False), _send_result_message(result)
         else:
             return False, f"Error: HTTP {response.status_code} - {response.text}"
             
@@ -726,7 +758,7 @@ def send_file(recipient: str, media_path: str) -> Tuple[bool, str]:
     except Exception as e:
         return False, f"Unexpected error: {str(e)}"
 
-def send_audio_message(recipient: str, media_path: str) -> Tuple[bool, str]:
+def send_audio_message(recipient: str, media_path: str, dry_run: bool = False) -> Tuple[bool, str]:
     try:
         # Validate input
         if not recipient:
@@ -750,12 +782,15 @@ def send_audio_message(recipient: str, media_path: str) -> Tuple[bool, str]:
             "media_path": media_path
         }
         
-        response = requests.post(url, json=payload)
+        if dry_run:
+            payload["dry_run"] = True
         
-        # Check if the request was successful
-        if response.status_code == 200:
+        response = requests.post(url, json=payload, headers=API_HEADERS)
+        
+        # Check if the request was successful (202 when the file is held back)
+        if response.status_code in (200, 202):
             result = response.json()
-            return result.get("success", False), result.get("message", "Unknown response")
+            return result.get("success", False), _send_result_message(result)
         else:
             return False, f"Error: HTTP {response.status_code} - {response.text}"
             
@@ -783,7 +818,7 @@ def download_media(message_id: str, chat_jid: str) -> Optional[str]:
             "chat_jid": chat_jid
         }
         
-        response = requests.post(url, json=payload)
+        response = requests.post(url, json=payload, headers=API_HEADERS)
         
         if response.status_code == 200:
             result = response.json()
@@ -807,3 +842,36 @@ def download_media(message_id: str, chat_jid: str) -> Optional[str]:
     except Exception as e:
         print(f"Unexpected error: {str(e)}")
         return None
+
+def search(query: str, types: Optional[List[str]] = None, chat_jid: Optional[str] = None, limit: int = 20) -> List[Dict[str, Any]]:
+    """Search messages, chats and contacts in one ranked list.
+    
+    Args:
+        query: Words to search for
+        types: Entity types to search (messages, chats, contacts), all by default
+        chat_jid: Only search messages of this chat
+        limit: Maximum number of results
+    
+    Returns:
+        The typed, ranked results with highlighted snippets, an empty list on errors
+    """
+    try:
+        params: Dict[str, Any] = {"query": query, "limit": limit}
+        if types:
+            params["types"] = ",".join(types)
+        if chat_jid:
+            params["chat_jid"] = chat_jid
+        
+        response = requests.get(f"{WHATSAPP_API_BASE_URL}/search", params=params, headers=API_HEADERS)
+        
+        if response.status_code == 200:
+            return response.json().get("results", [])
+        print(f"Error: HTTP {response.status_code} - {response.text}")
+        return []
+    
+    except requests.RequestException as e:
+        print(f"Request error: {str(e)}")
+        return []
+    except json.JSONDecodeError:
+        print(f"Error parsing response: {response.text}")
+        return []